@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// maxImportAccounts is the maximum number of accounts per import request
+const maxImportAccounts = 10000
+
+// maxImportBody is the largest accepted import request body
+const maxImportBody = 4 << 20
+
+func init() {
+	registerFeature("accountimport")
+	registerLimit("maxImportAccounts", maxImportAccounts)
+	registerFormats("/admin/accounts", "json", "csv")
+}
+
+// addAccounts stores the imported accounts, replaced in tests
+var addAccounts = func(accounts []opm.Account) (int, int, error) {
+	return database.AddAccounts(accounts)
+}
+
+type importAccount struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Provider string `json:"provider"`
+}
+
+type importAccountsResponse struct {
+	Ok      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+	Added   int      `json:"added"`
+	Skipped int      `json:"skipped"`
+	Invalid []string `json:"invalid,omitempty"`
+}
+
+// importAccountsHandler adds the accounts of the request body. The body is either a JSON array
+// of {username, password, provider} (Content-Type application/json) or CSV with username,password
+// per line. Invalid entries are reported, existing usernames are skipped.
+func importAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, importAccountsResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	body := io.LimitReader(r.Body, maxImportBody)
+	var entries []importAccount
+	var invalid []string
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err = json.NewDecoder(body).Decode(&entries)
+	} else {
+		entries, invalid, err = parseAccountsCSV(body)
+	}
+	if err != nil {
+		responder.Write(w, r, http.StatusBadRequest, importAccountsResponse{Error: opm.ErrWrongFormat.Error()})
+		return
+	}
+	if len(entries) > maxImportAccounts {
+		responder.Write(w, r, http.StatusBadRequest, importAccountsResponse{Error: fmt.Sprintf("More than %d accounts", maxImportAccounts)})
+		return
+	}
+	accounts := make([]opm.Account, 0, len(entries))
+	for i, e := range entries {
+		a, err := validateImportAccount(e)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%d: %s", i+1, err))
+			continue
+		}
+		accounts = append(accounts, a)
+	}
+	added, skipped, err := addAccounts(accounts)
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, importAccountsResponse{Error: "Import failed", Added: added, Skipped: skipped, Invalid: invalid})
+		return
+	}
+	log.Printf("%s imported %d accounts (%d skipped, %d invalid)", who, added, skipped, len(invalid))
+	err = addAuditEntry(opm.AuditEntry{
+		Who:    who,
+		Action: "import-accounts",
+		Count:  added,
+		Time:   time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	responder.Write(w, r, http.StatusOK, importAccountsResponse{Ok: true, Added: added, Skipped: skipped, Invalid: invalid})
+}
+
+// parseAccountsCSV reads username,password lines. Malformed records are returned as invalid
+// with their number, empty lines are not counted.
+func parseAccountsCSV(r io.Reader) ([]importAccount, []string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	var entries []importAccount
+	var invalid []string
+	for record := 1; ; record++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return entries, invalid, nil
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			invalid = append(invalid, fmt.Sprintf("record %d: %s", record, err))
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(row) != 2 {
+			invalid = append(invalid, fmt.Sprintf("record %d: expected username,password", record))
+			continue
+		}
+		entries = append(entries, importAccount{Username: row[0], Password: row[1]})
+	}
+}
+
+func validateImportAccount(e importAccount) (opm.Account, error) {
+	a := opm.Account{
+		Username: strings.TrimSpace(e.Username),
+		Password: e.Password,
+		Provider: e.Provider,
+	}
+	if a.Provider == "" {
+		a.Provider = "ptc"
+	}
+	switch {
+	case a.Username == "" || strings.ContainsAny(a.Username, " \t:"):
+		return a, errors.New("invalid username")
+	case a.Password == "":
+		return a, errors.New("missing password")
+	case a.Provider != "ptc" && a.Provider != "google":
+		return a, errors.New("unknown provider")
+	}
+	return a, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// withAccountStore imports accounts into a map that skips known usernames like AddAccounts
+func withAccountStore(t *testing.T, existing ...string) (map[string]opm.Account, *[]opm.AuditEntry) {
+	stored := make(map[string]opm.Account)
+	for _, u := range existing {
+		stored[u] = opm.Account{Username: u}
+	}
+	var audit []opm.AuditEntry
+	oldAdd, oldAudit, oldSecret := addAccounts, addAuditEntry, opmSettings.Secret
+	addAccounts = func(accounts []opm.Account) (int, int, error) {
+		added, skipped := 0, 0
+		for _, a := range accounts {
+			if _, ok := stored[a.Username]; ok {
+				skipped++
+				continue
+			}
+			stored[a.Username] = a
+			added++
+		}
+		return added, skipped, nil
+	}
+	addAuditEntry = func(e opm.AuditEntry) error {
+		audit = append(audit, e)
+		return nil
+	}
+	opmSettings.Secret = "s3cret"
+	t.Cleanup(func() { addAccounts, addAuditEntry, opmSettings.Secret = oldAdd, oldAudit, oldSecret })
+	return stored, &audit
+}
+
+func importAccounts(t *testing.T, contentType, body string) (int, importAccountsResponse) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/admin/accounts?secret=s3cret", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	importAccountsHandler(w, r)
+	var resp importAccountsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body, err)
+	}
+	return w.Code, resp
+}
+
+func TestImportAccountsCSV(t *testing.T) {
+	stored, audit := withAccountStore(t, "misty")
+	body := "ash,pikachu\n" +
+		"\n" +
+		"brock\n" + // no password column
+		"misty,togepi\n" + // exists
+		"gary,eevee,extra\n" +
+		"\"broken,quote\n"
+	code, resp := importAccounts(t, "text/csv", body)
+	if code != http.StatusOK || !resp.Ok || resp.Added != 1 || resp.Skipped != 1 {
+		t.Errorf("import = %d %+v, want 1 added and 1 skipped", code, resp)
+	}
+	if len(resp.Invalid) != 3 || !strings.HasPrefix(resp.Invalid[0], "record 2:") || !strings.HasPrefix(resp.Invalid[1], "record 4:") {
+		t.Errorf("invalid = %q, want the three malformed records by number", resp.Invalid)
+	}
+	if a := stored["ash"]; a.Password != "pikachu" || a.Provider != "ptc" {
+		t.Errorf("stored ash = %+v, want the password and the default provider", a)
+	}
+	if len(*audit) != 1 || (*audit)[0].Count != 1 || (*audit)[0].Who != "admin" {
+		t.Errorf("audit = %+v, want one entry for the import", *audit)
+	}
+}
+
+func TestImportAccountsJSON(t *testing.T) {
+	stored, _ := withAccountStore(t)
+	body := `[
+		{"username": "ash", "password": "pikachu", "provider": "google"},
+		{"username": "ash", "password": "again"},
+		{"username": "", "password": "pw"},
+		{"username": "bad name", "password": "pw"},
+		{"username": "misty"},
+		{"username": "brock", "password": "pw", "provider": "facebook"}
+	]`
+	code, resp := importAccounts(t, "application/json; charset=utf-8", body)
+	if code != http.StatusOK || resp.Added != 1 || resp.Skipped != 1 {
+		t.Errorf("import = %d %+v, want the duplicate username skipped", code, resp)
+	}
+	want := []string{"3: invalid username", "4: invalid username", "5: missing password", "6: unknown provider"}
+	if fmt.Sprint(resp.Invalid) != fmt.Sprint(want) {
+		t.Errorf("invalid = %q, want %q", resp.Invalid, want)
+	}
+	if a := stored["ash"]; a.Password != "pikachu" || a.Provider != "google" {
+		t.Errorf("stored ash = %+v, want the first entry", a)
+	}
+	if code, resp := importAccounts(t, "application/json", `{"username": "ash"}`); code != http.StatusBadRequest || resp.Error != opm.ErrWrongFormat.Error() {
+		t.Errorf("JSON object = %d %+v, want 400", code, resp)
+	}
+}
+
+func TestImportAccountsErrors(t *testing.T) {
+	withAccountStore(t)
+	w := httptest.NewRecorder()
+	importAccountsHandler(w, httptest.NewRequest("POST", "/admin/accounts?secret=wrong", strings.NewReader("ash,pw")))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("wrong secret = %d, want 403", w.Code)
+	}
+	w = httptest.NewRecorder()
+	importAccountsHandler(w, httptest.NewRequest("GET", "/admin/accounts?secret=s3cret", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want 405", w.Code)
+	}
+	var many strings.Builder
+	for i := 0; i <= maxImportAccounts; i++ {
+		fmt.Fprintf(&many, "trainer%d,pw\n", i)
+	}
+	if code, resp := importAccounts(t, "text/csv", many.String()); code != http.StatusBadRequest || resp.Added != 0 {
+		t.Errorf("%d accounts = %d %+v, want 400", maxImportAccounts+1, code, resp)
+	}
+	// A failed write reports the counts of the accounts that were added anyway
+	addAccounts = func(accounts []opm.Account) (int, int, error) { return 1, 0, errors.New("connection reset") }
+	if code, resp := importAccounts(t, "text/csv", "ash,pw\nmisty,pw\n"); code != http.StatusInternalServerError || resp.Ok || resp.Added != 1 {
+		t.Errorf("failed import = %d %+v, want 500 with the added count", code, resp)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/internal/faults"
+	"github.com/pogointel/opm/opm"
+)
+
+// maxBatchAccounts is the maximum number of usernames per batch request
+const maxBatchAccounts = 1000
+
+// maxDeleteObjects is the maximum number of map objects per delete request
+const maxDeleteObjects = 1000
+
+func init() {
+	registerFeature("batch")
+	registerFeature("tombstones")
+	registerLimit("maxBatchAccounts", maxBatchAccounts)
+	registerLimit("maxDeleteObjects", maxDeleteObjects)
+}
+
+type batchAccountsRequest struct {
+	Usernames []string `json:"usernames"`
+	Action    string   `json:"action"`
+	Value     string   `json:"value"`
+}
+
+type batchAccountsResponse struct {
+	Ok      bool              `json:"ok"`
+	Error   string            `json:"error,omitempty"`
+	Updated int               `json:"updated"`
+	Results map[string]string `json:"results"`
+}
+
+// adminLabel returns the label of the admin secret sent with the request,
+// or an empty string if the request is not authorized.
+func adminLabel(r *http.Request) string {
+	secret := r.FormValue("secret")
+	if secret == "" {
+		secret = r.Header.Get("X-Secret")
+	}
+	if secret == "" {
+		return ""
+	}
+	if opmSettings.Secret != "" && secret == opmSettings.Secret {
+		return "admin"
+	}
+	for label, s := range apiSettings.AdminSecrets {
+		if s == secret {
+			return label
+		}
+	}
+	return ""
+}
+
+func batchAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, batchAccountsResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	// Parse request
+	var req batchAccountsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Usernames) == 0 || len(req.Usernames) > maxBatchAccounts {
+		responder.Write(w, r, http.StatusBadRequest, batchAccountsResponse{Error: "Wrong format"})
+		return
+	}
+	if req.Action == opm.AccountActionSetCooldown {
+		if _, err := strconv.ParseInt(req.Value, 10, 64); err != nil {
+			responder.Write(w, r, http.StatusBadRequest, batchAccountsResponse{Error: "Wrong format"})
+			return
+		}
+	}
+	// Apply action
+	results, err := database.BatchAccountAction(req.Usernames, req.Action, req.Value)
+	if err == opm.ErrUnknownAction {
+		responder.Write(w, r, http.StatusBadRequest, batchAccountsResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, batchAccountsResponse{Error: "Batch failed", Results: results})
+		return
+	}
+	updated := 0
+	for _, v := range results {
+		if v == "ok" {
+			updated++
+		}
+	}
+	// Audit trail
+	err = database.AddAuditEntry(opm.AuditEntry{
+		Who:       who,
+		Action:    req.Action,
+		Value:     req.Value,
+		Usernames: req.Usernames,
+		Count:     updated,
+		Time:      time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	log.Printf("%s applied %s to %d/%d accounts", who, req.Action, updated, len(req.Usernames))
+	responder.Write(w, r, http.StatusOK, batchAccountsResponse{Ok: true, Updated: updated, Results: results})
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	entries, err := database.GetAuditEntries(limit)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	responder.Write(w, r, http.StatusOK, entries)
+}
+
+type adminStats struct {
+	Window  string       `json:"window"`
+	Origins []usageEntry `json:"origins"`
+}
+
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	window := time.Hour
+	if r.FormValue("window") != "" {
+		var err error
+		window, err = time.ParseDuration(r.FormValue("window"))
+		if err != nil || window < time.Minute || window > usageHistory {
+			responder.Write(w, r, http.StatusBadRequest, map[string]string{"error": "Wrong format"})
+			return
+		}
+	}
+	responder.Write(w, r, http.StatusOK, adminStats{
+		Window:  window.String(),
+		Origins: originUsage.Usage(window),
+	})
+}
+
+func quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	entries, err := database.GetQuarantine(limit)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	responder.Write(w, r, http.StatusOK, entries)
+}
+
+// addAuditEntry records an admin action, replaced in tests
+var addAuditEntry = func(e opm.AuditEntry) error {
+	return database.AddAuditEntry(e)
+}
+
+// The quarantine of the Mongo database, replaced in tests
+var (
+	getQuarantineEntry = func(id string) (opm.QuarantineEntry, error) {
+		return database.GetQuarantineEntry(id)
+	}
+	removeQuarantineEntry = func(id string) error {
+		return database.RemoveQuarantineEntry(id)
+	}
+	quarantineObject = func(o opm.MapObject, reason error, source string) error {
+		return database.Quarantine(o, reason, source)
+	}
+)
+
+type requeueResponse struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// requeueHandler runs a quarantined object through validation again. If it is
+// still rejected, it ends up in the quarantine with a new id. The entry is only
+// removed once the object is stored or quarantined again, a failed write keeps it.
+func requeueHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, requeueResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	entry, err := getQuarantineEntry(r.FormValue("id"))
+	if errors.Is(err, db.ErrNotFound) {
+		responder.Write(w, r, http.StatusNotFound, requeueResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, requeueResponse{Error: "Requeue failed"})
+		return
+	}
+	log.Printf("%s requeued %s (%s)", who, entry.ID, entry.Reason)
+	// Submitted objects have to pass the same checks as in submitHandler
+	if entry.Object.Source != "" {
+		err = validateMapObject(entry.Object, opm.APIKey{})
+		if err != nil {
+			requeueRejected(w, r, entry, err, false)
+			return
+		}
+	}
+	err = store.AddMapObject(entry.Object)
+	if errors.Is(err, opm.ErrInvalidCoordinates) {
+		// The Mongo store quarantines rejected objects itself
+		requeueRejected(w, r, entry, err, store == opm.Database(database))
+		return
+	}
+	if err != nil && !errors.Is(err, db.ErrDuplicate) {
+		log.Println(err)
+		responder.Write(w, r, http.StatusOK, requeueResponse{Error: err.Error()})
+		return
+	}
+	if err := removeQuarantineEntry(entry.ID); err != nil {
+		log.Println(err)
+	}
+	mapCache.Invalidate(entry.Object.Lat, entry.Object.Lng, 0)
+	responder.Write(w, r, http.StatusOK, requeueResponse{Ok: true})
+}
+
+// requeueRejected quarantines a requeued object that was rejected again and removes its
+// old entry. If the object can't be quarantined, the old entry is kept.
+func requeueRejected(w http.ResponseWriter, r *http.Request, entry opm.QuarantineEntry, reason error, quarantined bool) {
+	if !quarantined {
+		if err := quarantineObject(entry.Object, reason, entry.Source); err != nil {
+			log.Println(err)
+			responder.Write(w, r, http.StatusOK, requeueResponse{Error: reason.Error()})
+			return
+		}
+	}
+	if err := removeQuarantineEntry(entry.ID); err != nil {
+		log.Println(err)
+	}
+	responder.Write(w, r, http.StatusOK, requeueResponse{Error: reason.Error()})
+}
+
+type deleteObjectsResponse struct {
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	Deleted int    `json:"deleted"`
+}
+
+// deleteObjectsHandler deletes the map objects with the given ids (comma separated).
+// Stream consumers get a deletion event for each of them.
+func deleteObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, deleteObjectsResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	var ids []string
+	for _, id := range strings.Split(r.FormValue("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxDeleteObjects {
+		responder.Write(w, r, http.StatusBadRequest, deleteObjectsResponse{Error: "Invalid ids"})
+		return
+	}
+	n, err := database.DeleteMapObjects(ids)
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, deleteObjectsResponse{Error: "Delete failed"})
+		return
+	}
+	log.Printf("%s deleted %d map objects", who, n)
+	// The locations of the objects are unknown here
+	mapCache.Clear()
+	err = database.AddAuditEntry(opm.AuditEntry{
+		Who:    who,
+		Action: "delete-objects",
+		Value:  strings.Join(ids, ","),
+		Time:   time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	responder.Write(w, r, http.StatusOK, deleteObjectsResponse{Ok: true, Deleted: n})
+}
+
+// faultsHandler sets the failure injection rules, see the faults package
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	faults.Handler(w, r)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// fakeStore stores map objects, the other methods of opm.Database aren't used
+type fakeStore struct {
+	opm.Database
+	err     error
+	objects []opm.MapObject
+	radii   []int // of the GetMapObjects queries
+}
+
+func (s *fakeStore) AddMapObject(m opm.MapObject) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.objects = append(s.objects, m)
+	return nil
+}
+
+// fakeQuarantine replaces the quarantine of the database
+type fakeQuarantine struct {
+	entries map[string]opm.QuarantineEntry
+	err     error
+}
+
+func withFakeQuarantine(t *testing.T, entries ...opm.QuarantineEntry) *fakeQuarantine {
+	q := &fakeQuarantine{entries: make(map[string]opm.QuarantineEntry)}
+	for _, e := range entries {
+		q.entries[e.ID] = e
+	}
+	oldGet, oldRemove, oldQuarantine := getQuarantineEntry, removeQuarantineEntry, quarantineObject
+	oldStore, oldCache, oldSecret := store, mapCache, opmSettings.Secret
+	getQuarantineEntry = func(id string) (opm.QuarantineEntry, error) {
+		e, ok := q.entries[id]
+		if !ok {
+			return e, db.ErrNotFound
+		}
+		return e, nil
+	}
+	removeQuarantineEntry = func(id string) error {
+		delete(q.entries, id)
+		return nil
+	}
+	quarantineObject = func(o opm.MapObject, reason error, source string) error {
+		if q.err != nil {
+			return q.err
+		}
+		id := "new" + o.ID
+		q.entries[id] = opm.QuarantineEntry{ID: id, Reason: reason.Error(), Source: source, Object: o}
+		return nil
+	}
+	mapCache = newHotCache(time.Minute, 10)
+	opmSettings.Secret = "s3cret"
+	t.Cleanup(func() {
+		getQuarantineEntry, removeQuarantineEntry, quarantineObject = oldGet, oldRemove, oldQuarantine
+		store, mapCache, opmSettings.Secret = oldStore, oldCache, oldSecret
+	})
+	return q
+}
+
+func requeue(t *testing.T, id string) requeueResponse {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/admin/quarantine/requeue", strings.NewReader(url.Values{"secret": {"s3cret"}, "id": {id}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	requeueHandler(w, r)
+	var resp requeueResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body, err)
+	}
+	return resp
+}
+
+func TestRequeueKeepsEntryOnFailedWrite(t *testing.T) {
+	entry := opm.QuarantineEntry{ID: "e1", Reason: "db down", Source: "db", Object: opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 1, Lng: 2}}
+	q := withFakeQuarantine(t, entry)
+	s := &fakeStore{err: errors.New("connection refused")}
+	store = s
+	if resp := requeue(t, "e1"); resp.Ok || resp.Error == "" {
+		t.Errorf("response = %+v, want the write error", resp)
+	}
+	if _, ok := q.entries["e1"]; !ok || len(q.entries) != 1 {
+		t.Fatalf("entries = %v, want the entry kept after the failed write", q.entries)
+	}
+
+	// The retry succeeds and only then removes the entry
+	s.err = nil
+	if resp := requeue(t, "e1"); !resp.Ok {
+		t.Errorf("response = %+v, want ok", resp)
+	}
+	if len(q.entries) != 0 || len(s.objects) != 1 {
+		t.Errorf("entries = %v, stored %v, want the object moved to the store", q.entries, s.objects)
+	}
+	if resp := requeue(t, "e1"); resp.Error != db.ErrNotFound.Error() {
+		t.Errorf("second requeue = %+v, want not found", resp)
+	}
+}
+
+func TestRequeueRejectedAgain(t *testing.T) {
+	entry := opm.QuarantineEntry{ID: "e1", Reason: opm.ErrInvalidCoordinates.Error(), Source: "db", Object: opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 91, Lng: 2}}
+	q := withFakeQuarantine(t, entry)
+	store = &fakeStore{err: opm.ErrInvalidCoordinates}
+
+	// Without a new quarantine entry the old one is kept
+	q.err = errors.New("connection refused")
+	if resp := requeue(t, "e1"); resp.Error != opm.ErrInvalidCoordinates.Error() {
+		t.Errorf("response = %+v, want the rejection", resp)
+	}
+	if _, ok := q.entries["e1"]; !ok || len(q.entries) != 1 {
+		t.Fatalf("entries = %v, want the old entry kept", q.entries)
+	}
+
+	q.err = nil
+	if resp := requeue(t, "e1"); resp.Error != opm.ErrInvalidCoordinates.Error() {
+		t.Errorf("response = %+v, want the rejection", resp)
+	}
+	if _, ok := q.entries["newg1"]; !ok || len(q.entries) != 1 {
+		t.Errorf("entries = %v, want only the new entry", q.entries)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-	"time"
 
 	"github.com/pogointel/opm/opm"
 )
@@ -28,10 +27,18 @@ func objectFromWebhook(format string, r *http.Request) (opm.MapObject, error) {
 }
 
 func validateMapObject(object opm.MapObject, key opm.APIKey) error {
-	if object.Expiry < time.Now().Unix() {
+	now := opm.Now()
+	if object.Type == opm.POKESTOP {
+		// The expiry is that of the lure, an expired lure is cleared when reading
+		if object.Expiry > opm.ExpiryAfter(now, opm.MaxLureLifetime) {
+			return opm.ErrWrongFormat
+		}
+		return nil
+	}
+	if opm.Expired(object.Expiry, now) {
 		return opm.ErrPokemonExpired
 	}
-	if object.Expiry > time.Now().Add(15*time.Minute).Unix() {
+	if opm.TooFarAhead(object.Expiry, now) {
 		return opm.ErrPokemonFuture
 	}
 	return nil
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+func init() {
+	registerFeature("areas")
+}
+
+type areasResponse struct {
+	Ok    bool       `json:"ok"`
+	Error string     `json:"error,omitempty"`
+	Areas []opm.Area `json:"areas,omitempty"`
+}
+
+// areasHandler lists the areas (GET) or adds an area (POST) with the parameters name, north,
+// south, east, west, owner, interval and the flags geofence, schedule, federation and
+// visibility. An existing area is replaced if its id is given.
+func areasHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method == "GET" {
+		areas, err := database.GetAreas()
+		if err != nil {
+			log.Println(err)
+			responder.Write(w, r, http.StatusInternalServerError, areasResponse{Error: "Failed to get areas"})
+			return
+		}
+		responder.Write(w, r, http.StatusOK, areasResponse{Ok: true, Areas: areas})
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, areasResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	a, err := parseArea(r)
+	if err != nil {
+		responder.Write(w, r, http.StatusBadRequest, areasResponse{Error: err.Error()})
+		return
+	}
+	action := "add-area"
+	if a.ID != "" {
+		action = "update-area"
+		a, err = database.UpdateArea(a)
+	} else {
+		a.CreatedBy = who
+		a, err = database.AddArea(a)
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		responder.Write(w, r, http.StatusNotFound, areasResponse{Error: err.Error()})
+		return
+	}
+	if errors.Is(err, opm.ErrInvalidArea) {
+		responder.Write(w, r, http.StatusBadRequest, areasResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, areasResponse{Error: "Failed to save area"})
+		return
+	}
+	log.Printf("%s saved area %s (%s)", who, a.ID, a.Name)
+	auditAction(who, action, a.ID+" "+a.Name)
+	config.recordChange("areas")
+	responder.Write(w, r, http.StatusOK, areasResponse{Ok: true, Areas: []opm.Area{a}})
+}
+
+// removeAreaHandler deletes the area with the given id
+func removeAreaHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, areasResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	id := r.FormValue("id")
+	err := database.RemoveArea(id)
+	if errors.Is(err, db.ErrNotFound) {
+		responder.Write(w, r, http.StatusNotFound, areasResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, areasResponse{Error: "Failed to remove area"})
+		return
+	}
+	log.Printf("%s removed area %s", who, id)
+	auditAction(who, "remove-area", id)
+	config.recordChange("areas")
+	responder.Write(w, r, http.StatusOK, areasResponse{Ok: true})
+}
+
+// areaStats is the scan coverage of an area
+type areaStats struct {
+	Area     opm.Area `json:"area"`
+	Since    int64    `json:"since"`
+	Scans    int      `json:"scans"`
+	Cells    int      `json:"cells"` // geohash cells with at least one scan
+	LastScan int64    `json:"lastScan,omitempty"`
+}
+
+// areaStatsHandler returns the scans of the area with the given id since the unix time since
+// (default the last 24 hours)
+func areaStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	a, err := database.GetArea(r.FormValue("id"))
+	if errors.Is(err, db.ErrNotFound) {
+		responder.Write(w, r, http.StatusNotFound, areasResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	since := time.Now().Add(-24 * time.Hour)
+	if v := r.FormValue("since"); v != "" {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			responder.Write(w, r, http.StatusBadRequest, areasResponse{Error: "Wrong format"})
+			return
+		}
+		since = time.Unix(ts, 0)
+	}
+	b := a.Bounds
+	cells, err := database.GetScanCoverage(b.North, b.South, b.East, b.West, since)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	stats := areaStats{Area: a, Since: since.Unix(), Cells: len(cells)}
+	for _, c := range cells {
+		stats.Scans += c.Scans
+		if c.LastScan > stats.LastScan {
+			stats.LastScan = c.LastScan
+		}
+	}
+	responder.Write(w, r, http.StatusOK, stats)
+}
+
+func parseArea(r *http.Request) (opm.Area, error) {
+	a := opm.Area{
+		ID:         r.FormValue("id"),
+		Name:       r.FormValue("name"),
+		Owner:      r.FormValue("owner"),
+		Geofence:   r.FormValue("geofence") == "1",
+		Schedule:   r.FormValue("schedule") == "1",
+		Federation: r.FormValue("federation") == "1",
+		Visibility: r.FormValue("visibility") == "1",
+	}
+	bounds := []*float64{&a.Bounds.North, &a.Bounds.South, &a.Bounds.East, &a.Bounds.West}
+	for i, name := range []string{"north", "south", "east", "west"} {
+		v, err := strconv.ParseFloat(r.FormValue(name), 64)
+		if err != nil {
+			return a, errors.New("Invalid " + name)
+		}
+		*bounds[i] = v
+	}
+	if v := r.FormValue("interval"); v != "" {
+		var err error
+		a.ScanInterval, err = strconv.Atoi(v)
+		if err != nil {
+			return a, errors.New("Invalid interval")
+		}
+	}
+	quiet := []*int{&a.QuietStart, &a.QuietEnd}
+	for i, name := range []string{"quietStart", "quietEnd"} {
+		if v := r.FormValue(name); v != "" {
+			var err error
+			*quiet[i], err = strconv.Atoi(v)
+			if err != nil {
+				return a, errors.New("Invalid " + name)
+			}
+		}
+	}
+	a.Timezone = r.FormValue("timezone")
+	return a, a.Validate()
+}
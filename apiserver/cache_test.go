@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulbellamy/ratecounter"
+	"github.com/pogointel/opm/opm"
+)
+
+func (s *fakeStore) GetMapObjects(lat, lng float64, types []int, radius int) ([]opm.MapObject, error) {
+	s.radii = append(s.radii, radius)
+	return s.objects, s.err
+}
+
+// withCacheStore serves /cache from a fake store with the objects
+func withCacheStore(t *testing.T, objects ...opm.MapObject) {
+	oldStore, oldCache, oldUsage, oldMetrics := store, mapCache, originUsage, apiMetrics
+	oldOpm, oldAPI := opmSettings, apiSettings
+	store = &fakeStore{objects: objects}
+	mapCache = newHotCache(time.Minute, 10)
+	originUsage = newUsageCounters(10)
+	apiMetrics = *NewAPIMetrics()
+	opmSettings.CacheRadius = 200
+	apiSettings = settings{MinCacheRadius: 50, MaxCacheRadius: 1000}
+	t.Cleanup(func() {
+		store, mapCache, originUsage, apiMetrics = oldStore, oldCache, oldUsage, oldMetrics
+		opmSettings, apiSettings = oldOpm, oldAPI
+	})
+}
+
+func cacheRequest(values url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/cache", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	cacheHandler(w, r)
+	return w
+}
+
+func TestCacheFormats(t *testing.T) {
+	gym := opm.MapObject{Type: opm.GYM, ID: "gym.1", Lat: 52.5, Lng: 13.4, Team: 2}
+	withCacheStore(t, gym)
+	at := url.Values{"lat": {"52.5"}, "lng": {"13.4"}}
+
+	// The default format is the APIResponse
+	for _, format := range []string{"", "json"} {
+		values := url.Values{"format": {format}, "lat": at["lat"], "lng": at["lng"]}
+		w := cacheRequest(values)
+		var resp opm.APIResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Ok || len(resp.MapObjects) != 1 || resp.MapObjects[0].ID != "gym.1" {
+			t.Errorf("format %q: %d %s, want the APIResponse", format, w.Code, w.Body)
+		}
+		if strings.Contains(w.Body.String(), "FeatureCollection") {
+			t.Errorf("format %q: got GeoJSON", format)
+		}
+	}
+
+	w := cacheRequest(url.Values{"format": {"geojson"}, "lat": at["lat"], "lng": at["lng"]})
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/geo+json") {
+		t.Errorf("GeoJSON content type = %q", ct)
+	}
+	var fc opm.FeatureCollection
+	if err := json.Unmarshal(w.Body.Bytes(), &fc); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 1 || fc.Features[0].Geometry.Coordinates != [2]float64{13.4, 52.5} || fc.Features[0].Properties.Team != 2 {
+		t.Errorf("GeoJSON = %+v, want the gym", fc)
+	}
+
+	w = cacheRequest(url.Values{"format": {"kml"}, "lat": at["lat"], "lng": at["lng"]})
+	var e map[string]string
+	if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &e) != nil || e["error"] != opm.ErrUnknownFormat.Error() {
+		t.Errorf("unknown format = %d %s, want 400 with a JSON error", w.Code, w.Body)
+	}
+}
+
+func TestCacheRejectsPublicKeys(t *testing.T) {
+	mux := withTestServer(t)
+	withCacheStore(t)
+	for key, want := range map[string]int{"pub-partner": http.StatusUnauthorized, "partner": http.StatusOK} {
+		values := url.Values{"lat": {"52.5"}, "lng": {"13.4"}}
+		r := httptest.NewRequest("POST", "/cache", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("key %q: %d %s, want %d", key, w.Code, w.Body, want)
+		}
+	}
+}
+
+func TestCacheRejectsInvalidCoordinates(t *testing.T) {
+	withCacheStore(t, opm.MapObject{Type: opm.GYM, ID: "gym.1", Lat: 52.5, Lng: 13.4})
+	tests := []struct {
+		name   string
+		values url.Values
+		error  string
+	}{
+		{"missing lat", url.Values{"lng": {"13.4"}}, opm.ErrWrongFormat.Error()},
+		{"missing lng", url.Values{"lat": {"52.5"}}, opm.ErrWrongFormat.Error()},
+		{"malformed lng", url.Values{"lat": {"52.5"}, "lng": {"13,4"}}, opm.ErrWrongFormat.Error()},
+		{"NaN", url.Values{"lat": {"NaN"}, "lng": {"13.4"}}, opm.ErrInvalidCoordinates.Error()},
+		{"lat out of range", url.Values{"lat": {"90.1"}, "lng": {"13.4"}}, opm.ErrInvalidCoordinates.Error()},
+		{"lng out of range", url.Values{"lat": {"52.5"}, "lng": {"-180.5"}}, opm.ErrInvalidCoordinates.Error()},
+	}
+	for _, test := range tests {
+		w := cacheRequest(test.values)
+		var resp opm.APIResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: invalid response %q", test.name, w.Body)
+			continue
+		}
+		if w.Code != http.StatusBadRequest || resp.Ok || resp.Error != test.error || len(resp.MapObjects) != 0 {
+			t.Errorf("%s: %d %s, want 400 %q", test.name, w.Code, w.Body, test.error)
+		}
+	}
+	// The edges of the range are valid
+	if w := cacheRequest(url.Values{"lat": {"-90"}, "lng": {"180"}}); w.Code != http.StatusOK {
+		t.Errorf("-90, 180: %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestCacheRadiusClamp(t *testing.T) {
+	withCacheStore(t)
+	for radius, want := range map[string]int{
+		"":      200,
+		"500":   500,
+		"10":    50,
+		"50000": 1000,
+		"0":     200,
+		"-100":  200,
+		"1e3":   200,
+		"wide":  200,
+	} {
+		// A new cache for every query, so each one reaches the store
+		mapCache = newHotCache(time.Minute, 10)
+		s := store.(*fakeStore)
+		s.radii = nil
+		w := cacheRequest(url.Values{"lat": {"52.5"}, "lng": {"13.4"}, "radius": {radius}})
+		if w.Code != http.StatusOK {
+			t.Errorf("radius %q = %d %s, want the default instead of an error", radius, w.Code, w.Body)
+		}
+		if len(s.radii) != 1 || s.radii[0] != want {
+			t.Errorf("radius %q queried %v, want %d", radius, s.radii, want)
+		}
+	}
+}
+
+func TestCacheHistoryRetryAfter(t *testing.T) {
+	withCacheStore(t)
+	apiSettings.HistoryQueriesPerMinute, apiSettings.MaxHistoryHours = 30, 24
+	old := historyQueries
+	historyQueries = ratecounter.NewRateCounter(time.Minute)
+	t.Cleanup(func() { historyQueries = old })
+	historyQueries.Incr(30)
+	w := cacheRequest(url.Values{"lat": {"52.5"}, "lng": {"13.4"}, "at": {strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)}})
+	var resp opm.APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	// A query leaves the sliding minute about every 2 s
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" || resp.RetryAfter == nil || resp.RetryAfter.Reason != opm.RetryReasonRateLimit {
+		t.Errorf("%d, Retry-After %q: %s, want 2 s for the history limit", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+}
+
+func TestCacheGzip(t *testing.T) {
+	mux := withTestServer(t)
+	var objects []opm.MapObject
+	for i := 0; i < 50; i++ {
+		objects = append(objects, opm.MapObject{Type: opm.POKESTOP, ID: "stop." + strconv.Itoa(i), Lat: 52.5, Lng: 13.4})
+	}
+	withCacheStore(t, objects...)
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/cache", strings.NewReader(url.Values{"lat": {"52.5"}, "lng": {"13.4"}, "key": {"default"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	identity, compressed := get(""), get("gzip")
+	if identity.Code != http.StatusOK || identity.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("identity response = %d %v", identity.Code, identity.Header())
+	}
+	if compressed.Code != http.StatusOK || compressed.Header().Get("Content-Encoding") != "gzip" || compressed.Body.Len() >= identity.Body.Len() {
+		t.Fatalf("gzip response = %d %v with %d bytes", compressed.Code, compressed.Header(), compressed.Body.Len())
+	}
+	gz, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil || !bytes.Equal(body, identity.Body.Bytes()) {
+		t.Errorf("decompressed /cache response differs from the identity response: %v", err)
+	}
+}
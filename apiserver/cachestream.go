@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// streamFlushEvery is the number of objects after which a streamed response is flushed
+const streamFlushEvery = 200
+
+// objectIter reads map objects one at a time, see db.MapObjectIter
+type objectIter interface {
+	Next(m *opm.MapObject) bool
+	Close() error
+}
+
+// streamTrailer closes a streamed response. Ok comes last, because an error of the query
+// is only known once the objects before it are sent.
+type streamTrailer struct {
+	Ok    bool
+	Error string
+	// The objects were cut off by an error, the client got only part of the result
+	Truncated bool `json:",omitempty"`
+}
+
+// streamed reports whether a /cache request is answered by streamCacheResponse: with the
+// stream parameter or a large radius, for JSON responses of the current map on MongoDB.
+func streamed(r *http.Request, radius int, at int64) bool {
+	if at != 0 || store != opm.Database(database) {
+		return false
+	}
+	if _, ok := responder.Negotiate(r).(util.JSONSerializer); !ok {
+		return false
+	}
+	return r.FormValue("stream") == "1" || apiSettings.StreamCacheRadius > 0 && radius >= apiSettings.StreamCacheRadius
+}
+
+// streamCacheResponse writes the objects of it as an APIResponse without holding them in
+// memory. The objects are sent as they are read, keep selects the ones that are sent and
+// may modify them. An error of the query can't change the status anymore, it ends the
+// array and is reported in the trailing fields with Truncated set.
+func streamCacheResponse(w http.ResponseWriter, r *http.Request, it objectIter, keep func(o *opm.MapObject) bool) {
+	responder.ApplyCORS(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriter(w)
+	flush := func() {
+		bw.Flush()
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	bw.WriteString(`{"MapObjects":[`)
+	n := 0
+	var o opm.MapObject
+	for it.Next(&o) {
+		if !keep(&o) {
+			continue
+		}
+		b, err := json.Marshal(o)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n > 0 {
+			bw.WriteByte(',')
+		}
+		if _, err := bw.Write(b); err != nil {
+			// Client gone
+			it.Close()
+			return
+		}
+		n++
+		if n%streamFlushEvery == 0 {
+			flush()
+		}
+	}
+	trailer := streamTrailer{Ok: true}
+	if err := it.Close(); err != nil {
+		log.Println(err)
+		apiMetrics.CacheRequestFailsPerMinute.Incr(1)
+		trailer = streamTrailer{Error: "Failed to get MapObjects from DB", Truncated: true}
+	}
+	b, _ := json.Marshal(trailer)
+	bw.WriteString("],")
+	// The fields of the trailer without its opening brace
+	bw.Write(b[1:])
+	bw.WriteByte('\n')
+	flush()
+}
+
+// cacheFilter returns the filters of a /cache request that can be applied one object at a
+// time, for streamCacheResponse
+func cacheFilter(r *http.Request) func(o *opm.MapObject) bool {
+	now := time.Now()
+	var hidden func(o opm.MapObject) bool
+	if visibility.Active() {
+		hidden = visibility.Hidden(callerClass(r), opm.Now())
+	}
+	ivs := r.FormValue("iv") == "1"
+	localTime := r.FormValue("localtime") == "1"
+	return func(o *opm.MapObject) bool {
+		if hidden != nil && hidden(*o) {
+			return false
+		}
+		if ivs && o.IVs == nil {
+			return false
+		}
+		if localTime {
+			*o = util.WithLocalTime([]opm.MapObject{*o}, now)[0]
+		}
+		return true
+	}
+}
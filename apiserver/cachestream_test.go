@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// sliceIter returns the objects and then fails with err, if it is set
+type sliceIter struct {
+	objects []opm.MapObject
+	err     error
+	closed  bool
+}
+
+func (it *sliceIter) Next(m *opm.MapObject) bool {
+	if len(it.objects) == 0 {
+		return false
+	}
+	*m, it.objects = it.objects[0], it.objects[1:]
+	return true
+}
+
+func (it *sliceIter) Close() error {
+	it.closed = true
+	return it.err
+}
+
+func streamStops(n int) []opm.MapObject {
+	objects := make([]opm.MapObject, n)
+	for i := range objects {
+		objects[i] = opm.MapObject{Type: opm.POKESTOP, ID: "stop." + strconv.Itoa(i), Lat: 52.5, Lng: 13.4}
+	}
+	return objects
+}
+
+// streamedResponse is a streamed response as the client decodes it
+type streamedResponse struct {
+	opm.APIResponse
+	Truncated bool
+}
+
+func TestStreamCacheResponse(t *testing.T) {
+	withCacheStore(t)
+	// More objects than are flushed at once, every other one is filtered
+	stream := util.Gzip(func(w http.ResponseWriter, r *http.Request) {
+		streamCacheResponse(w, r, &sliceIter{objects: streamStops(2*streamFlushEvery + 50)}, func(o *opm.MapObject) bool {
+			n, _ := strconv.Atoi(strings.TrimPrefix(o.ID, "stop."))
+			return n%2 == 0
+		})
+	})
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/cache", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		stream(w, r)
+		return w
+	}
+	w := get("")
+	var resp streamedResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", w.Body, err)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || !resp.Ok || resp.Error != "" || resp.Truncated {
+		t.Errorf("response = %d %v %+v, want a complete result", w.Code, w.Header(), resp)
+	}
+	if len(resp.MapObjects) != streamFlushEvery+25 || resp.MapObjects[1].ID != "stop.2" {
+		t.Errorf("%d objects, want the %d kept ones in order", len(resp.MapObjects), streamFlushEvery+25)
+	}
+	if strings.Contains(w.Body.String(), "Truncated") {
+		t.Errorf("complete response %q reports truncation", w.Body.String()[w.Body.Len()-60:])
+	}
+	// Gzip keeps compressing across the flushes
+	compressed := get("gzip")
+	if compressed.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("headers = %v, want gzip", compressed.Header())
+	}
+	gz, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil || !bytes.Equal(body, w.Body.Bytes()) {
+		t.Errorf("decompressed stream differs from the identity one: %v", err)
+	}
+}
+
+func TestStreamCacheResponseEmpty(t *testing.T) {
+	withCacheStore(t)
+	w := httptest.NewRecorder()
+	streamCacheResponse(w, httptest.NewRequest("POST", "/cache", nil), &sliceIter{}, func(*opm.MapObject) bool { return true })
+	if want := `{"MapObjects":[],"Ok":true,"Error":""}` + "\n"; w.Body.String() != want {
+		t.Errorf("empty stream = %q, want %q", w.Body, want)
+	}
+}
+
+func TestStreamCacheResponseMidStreamError(t *testing.T) {
+	withCacheStore(t)
+	it := &sliceIter{objects: streamStops(3), err: errors.New("cursor killed")}
+	w := httptest.NewRecorder()
+	streamCacheResponse(w, httptest.NewRequest("POST", "/cache", nil), it, func(*opm.MapObject) bool { return true })
+	var resp streamedResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", w.Body, err)
+	}
+	// The status was sent with the first byte, the trailer reports the error
+	if w.Code != http.StatusOK || resp.Ok || !resp.Truncated || resp.Error != "Failed to get MapObjects from DB" {
+		t.Errorf("response = %d %+v, want a truncated result with the error", w.Code, resp)
+	}
+	if len(resp.MapObjects) != 3 || !it.closed {
+		t.Errorf("%d objects, closed %v, want the 3 before the error", len(resp.MapObjects), it.closed)
+	}
+	if n := apiMetrics.CacheRequestFailsPerMinute.Rate(); n != 1 {
+		t.Errorf("%d failed requests counted, want 1", n)
+	}
+}
+
+func TestCacheFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/cache?iv=1&localtime=1", nil)
+	keep := cacheFilter(r)
+	plain := opm.MapObject{Type: opm.POKEMON, ID: "plain"}
+	if keep(&plain) {
+		t.Error("Pokemon without IVs kept with iv=1")
+	}
+	o := opm.MapObject{Type: opm.POKEMON, ID: "ivs", IVs: &opm.IVs{Attack: 15}, Timezone: "Europe/Berlin"}
+	if !keep(&o) || o.LocalTime == "" {
+		t.Errorf("object = %+v, want it kept with its local time", o)
+	}
+	// Without parameters everything is kept as is
+	o = opm.MapObject{Type: opm.POKEMON, ID: "plain", Timezone: "Europe/Berlin"}
+	if !cacheFilter(httptest.NewRequest("GET", "/cache", nil))(&o) || o.LocalTime != "" {
+		t.Errorf("object = %+v, want it kept unchanged", o)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// apiVersion is the version of the client facing API. Increase it on breaking changes.
+const apiVersion = "1"
+
+// capabilities describe what this deployment supports
+type capabilities struct {
+	APIVersion string              `json:"apiVersion"`
+	Features   []string            `json:"features"`
+	Limits     map[string]int      `json:"limits"`
+	Formats    map[string][]string `json:"formats"`
+	Endpoints  []string            `json:"endpoints"` // client routes, see registeredRoutes
+	// Rate limits of the API key of the request per endpoint, empty without a key
+	RateLimits map[string]rateLimit `json:"rateLimits,omitempty"`
+}
+
+// rateLimit is a rate limit of the caller
+type rateLimit struct {
+	PerMinute int `json:"perMinute"`
+	Burst     int `json:"burst"`
+}
+
+// capabilityRegistry collects the capabilities registered by the endpoints
+var capabilityRegistry = struct {
+	sync.Mutex
+	features map[string]bool
+	limits   map[string]int
+	formats  map[string][]string
+	callers  map[string]func(r *http.Request) (perMinute, burst int, ok bool)
+}{
+	features: make(map[string]bool),
+	limits:   make(map[string]int),
+	formats:  make(map[string][]string),
+	callers:  make(map[string]func(r *http.Request) (int, int, bool)),
+}
+
+// registerFeature announces an optional feature
+func registerFeature(name string) {
+	capabilityRegistry.Lock()
+	defer capabilityRegistry.Unlock()
+	capabilityRegistry.features[name] = true
+}
+
+// registerLimit announces a limit clients have to respect
+func registerLimit(name string, value int) {
+	capabilityRegistry.Lock()
+	defer capabilityRegistry.Unlock()
+	capabilityRegistry.limits[name] = value
+}
+
+// registerFormats announces the output formats of an endpoint
+func registerFormats(endpoint string, formats ...string) {
+	capabilityRegistry.Lock()
+	defer capabilityRegistry.Unlock()
+	capabilityRegistry.formats[endpoint] = formats
+}
+
+// registerCallerLimit announces the rate limit of an endpoint, which depends on the caller.
+// The API key middleware registers its util.APIKeyAuth.CallerLimit.
+func registerCallerLimit(endpoint string, limit func(r *http.Request) (perMinute, burst int, ok bool)) {
+	capabilityRegistry.Lock()
+	defer capabilityRegistry.Unlock()
+	capabilityRegistry.callers[endpoint] = limit
+}
+
+// currentCapabilities returns a snapshot of the registered capabilities for the caller of r
+func currentCapabilities(r *http.Request) capabilities {
+	capabilityRegistry.Lock()
+	defer capabilityRegistry.Unlock()
+	c := capabilities{
+		APIVersion: apiVersion,
+		Features:   make([]string, 0, len(capabilityRegistry.features)),
+		Limits:     make(map[string]int, len(capabilityRegistry.limits)),
+		Formats:    make(map[string][]string, len(capabilityRegistry.formats)),
+	}
+	for f := range capabilityRegistry.features {
+		c.Features = append(c.Features, f)
+	}
+	sort.Strings(c.Features)
+	for k, v := range capabilityRegistry.limits {
+		c.Limits[k] = v
+	}
+	for k, v := range capabilityRegistry.formats {
+		c.Formats[k] = append([]string(nil), v...)
+	}
+	for endpoint, limit := range capabilityRegistry.callers {
+		if perMinute, burst, ok := limit(r); ok {
+			if c.RateLimits == nil {
+				c.RateLimits = make(map[string]rateLimit)
+			}
+			c.RateLimits[endpoint] = rateLimit{PerMinute: perMinute, Burst: burst}
+		}
+	}
+	c.Endpoints = make([]string, 0)
+	for _, rt := range registeredRoutes() {
+		if rt.Auth != authAdmin {
+			c.Endpoints = append(c.Endpoints, rt.Path)
+		}
+	}
+	return c
+}
+
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, map[string]string{"error": "Wrong method"})
+		return
+	}
+	c := currentCapabilities(r)
+	if c.RateLimits != nil {
+		w.Header().Add("Cache-Control", "private, max-age=300")
+	} else {
+		w.Header().Add("Cache-Control", "public, max-age=300")
+	}
+	responder.Write(w, r, http.StatusOK, c)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// testKeys are the API keys of the fake lookupAPIKey, by private key
+var testKeys = map[string]opm.APIKey{
+	"default":  {PrivateKey: "default", PublicKey: "pub-default", Enabled: true},
+	"partner":  {PrivateKey: "partner", PublicKey: "pub-partner", Enabled: true, RequestsPerMinute: 600, Burst: 50},
+	"disabled": {PrivateKey: "disabled", PublicKey: "pub-disabled"},
+}
+
+// withTestServer configures the apiserver with API keys, the fake key lookup and
+// cache radius limits, and returns its mux
+func withTestServer(t *testing.T) *http.ServeMux {
+	oldOpm, oldAPI, oldLookup := opmSettings, apiSettings, lookupAPIKey
+	opmSettings = opm.DefaultSettings
+	opmSettings.RequireAPIKey = true
+	opmSettings.KeyRequestsPerMinute, opmSettings.KeyBurst = 60, 10
+	apiSettings = settings{MinCacheRadius: 50, MaxCacheRadius: 1000}
+	lookupAPIKey = func(k string) (opm.APIKey, error) {
+		if key, ok := testKeys[k]; ok {
+			return key, nil
+		}
+		return opm.APIKey{}, opm.ErrInvalidAPIKey
+	}
+	routeRegistry.Lock()
+	oldRoutes := routeRegistry.routes
+	routeRegistry.routes = nil
+	routeRegistry.Unlock()
+	t.Cleanup(func() {
+		opmSettings, apiSettings, lookupAPIKey = oldOpm, oldAPI, oldLookup
+		routeRegistry.Lock()
+		routeRegistry.routes = oldRoutes
+		routeRegistry.Unlock()
+	})
+	mux, err := newMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+func getCapabilities(t *testing.T, mux *http.ServeMux, key string) (capabilities, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest("GET", "/capabilities", nil)
+	if key != "" {
+		r.Header.Set("X-Api-Key", key)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var c capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	return c, w
+}
+
+func TestCapabilities(t *testing.T) {
+	mux := withTestServer(t)
+	c, w := getCapabilities(t, mux, "")
+	if c.APIVersion != apiVersion {
+		t.Errorf("apiVersion = %q, want %q", c.APIVersion, apiVersion)
+	}
+	features := make(map[string]bool)
+	for _, f := range c.Features {
+		features[f] = true
+	}
+	for _, f := range []string{"apikeys", "batch", "geojson", "export", "areas"} {
+		if !features[f] {
+			t.Errorf("feature %q missing from %v", f, c.Features)
+		}
+	}
+	for name, want := range map[string]int{"cacheRadius": 1000, "minCacheRadius": 50, "maxCacheRadius": 1000, "maxBatchAccounts": maxBatchAccounts} {
+		if c.Limits[name] != want {
+			t.Errorf("limit %s = %d, want %d", name, c.Limits[name], want)
+		}
+	}
+	if f := c.Formats["/cache"]; len(f) != 2 || f[0] != "json" || f[1] != "geojson" {
+		t.Errorf("formats of /cache = %v, want json and geojson", f)
+	}
+	endpoints := make(map[string]bool)
+	for _, e := range c.Endpoints {
+		endpoints[e] = true
+	}
+	if !endpoints["/cache"] || !endpoints["/scan"] || !endpoints["/capabilities"] || endpoints["/admin/accounts"] {
+		t.Errorf("endpoints = %v, want the client routes only", c.Endpoints)
+	}
+	// Without a key there are no caller limits and the document is the same for everybody
+	if c.RateLimits != nil || w.Header().Get("Cache-Control") != "public, max-age=300" {
+		t.Errorf("anonymous rate limits = %v with Cache-Control %q", c.RateLimits, w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestCapabilitiesCallerLimits(t *testing.T) {
+	mux := withTestServer(t)
+	tests := []struct {
+		key  string
+		want map[string]rateLimit
+	}{
+		{"default", map[string]rateLimit{"/cache": {60, 10}, "/scan": {60, 10}}},
+		{"partner", map[string]rateLimit{"/cache": {600, 50}, "/scan": {600, 50}}},
+		{"disabled", nil},
+		{"unknown", nil},
+	}
+	for _, test := range tests {
+		c, w := getCapabilities(t, mux, test.key)
+		if len(c.RateLimits) != len(test.want) {
+			t.Errorf("%s: rate limits %v, want %v", test.key, c.RateLimits, test.want)
+		}
+		for endpoint, want := range test.want {
+			if c.RateLimits[endpoint] != want {
+				t.Errorf("%s: rate limit of %s = %+v, want %+v", test.key, endpoint, c.RateLimits[endpoint], want)
+			}
+		}
+		if test.want != nil && w.Header().Get("Cache-Control") != "private, max-age=300" {
+			t.Errorf("%s: Cache-Control %q, want a private response", test.key, w.Header().Get("Cache-Control"))
+		}
+	}
+}
+
+func TestCapabilitiesHeaders(t *testing.T) {
+	mux := withTestServer(t)
+	opmSettings.AllowOrigin = "*"
+	oldCORS := responder.CORS
+	responder.CORS = allowOrigin
+	defer func() { responder.CORS = oldCORS }()
+	_, w := getCapabilities(t, mux, "")
+	h := w.Result().Header
+	if h.Get("Content-Type") != "application/json" || h.Get("Cache-Control") != "public, max-age=300" {
+		t.Errorf("headers = %v, want JSON and the cache header", h)
+	}
+	// Applied by the decorator and the responder, but set once
+	if acao := h["Access-Control-Allow-Origin"]; len(acao) != 1 || acao[0] != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want one *", acao)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// captchaAccount is an account that waits for a solved captcha, without its secrets
+type captchaAccount struct {
+	Username   string `json:"username"`
+	Provider   string `json:"provider"`
+	Pool       string `json:"pool,omitempty"`
+	CaptchaURL string `json:"captchaUrl,omitempty"`
+	CaptchaAt  int64  `json:"captchaAt"`
+}
+
+// captchaHandler lists the accounts that are out of rotation because of a captcha
+func captchaHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	accounts, err := store.GetCaptchaAccounts()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := make([]captchaAccount, 0, len(accounts))
+	for _, a := range accounts {
+		result = append(result, captchaAccount{
+			Username:   a.Username,
+			Provider:   a.Provider,
+			Pool:       a.Pool,
+			CaptchaURL: a.CaptchaURL,
+			CaptchaAt:  a.CaptchaAt,
+		})
+	}
+	responder.Write(w, r, http.StatusOK, result)
+}
+
+// clearCaptchaHandler puts an account back into rotation after its captcha was solved
+func clearCaptchaHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, requeueResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	username := r.FormValue("username")
+	err := store.ClearCaptcha(username)
+	if errors.Is(err, db.ErrNotFound) {
+		responder.Write(w, r, http.StatusNotFound, requeueResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, requeueResponse{Error: "Clear failed"})
+		return
+	}
+	log.Printf("%s cleared the captcha of %s", who, util.Username(username))
+	err = addAuditEntry(opm.AuditEntry{
+		Who:       who,
+		Action:    "clear-captcha",
+		Usernames: []string{username},
+		Count:     1,
+		Time:      time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	responder.Write(w, r, http.StatusOK, requeueResponse{Ok: true})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// captchaStore keeps accounts by username, flagged ones wait for ClearCaptcha
+type captchaStore struct {
+	fakeStore
+	accounts map[string]opm.Account
+}
+
+func (s *captchaStore) FlagCaptcha(username, url string) error {
+	a, ok := s.accounts[username]
+	if !ok {
+		return db.ErrNotFound
+	}
+	a.CaptchaFlagged, a.CaptchaURL, a.CaptchaAt = true, url, 1500000000
+	s.accounts[username] = a
+	return nil
+}
+
+func (s *captchaStore) GetCaptchaAccounts() ([]opm.Account, error) {
+	var flagged []opm.Account
+	for _, a := range s.accounts {
+		if a.CaptchaFlagged {
+			flagged = append(flagged, a)
+		}
+	}
+	return flagged, nil
+}
+
+func (s *captchaStore) ClearCaptcha(username string) error {
+	a, ok := s.accounts[username]
+	if !ok || !a.CaptchaFlagged {
+		return db.ErrNotFound
+	}
+	a.CaptchaFlagged, a.CaptchaURL, a.CaptchaAt = false, "", 0
+	s.accounts[username] = a
+	return nil
+}
+
+func captchaAccounts(t *testing.T) []captchaAccount {
+	t.Helper()
+	w := httptest.NewRecorder()
+	captchaHandler(w, httptest.NewRequest("GET", "/admin/captcha?secret=s3cret", nil))
+	var accounts []captchaAccount
+	if err := json.Unmarshal(w.Body.Bytes(), &accounts); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("/admin/captcha = %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "pikachu") {
+		t.Errorf("/admin/captcha has the password: %s", w.Body)
+	}
+	return accounts
+}
+
+func clearCaptcha(username string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/captcha/clear", strings.NewReader(url.Values{"secret": {"s3cret"}, "username": {username}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	clearCaptchaHandler(w, r)
+	return w
+}
+
+func TestCaptchaQuarantineCycle(t *testing.T) {
+	_, audit := withAccountStore(t)
+	oldStore := store
+	s := &captchaStore{accounts: map[string]opm.Account{
+		"ash":   {Username: "ash", Password: "pikachu", Provider: "ptc"},
+		"misty": {Username: "misty", Password: "togepi", Provider: "google"},
+	}}
+	store = s
+	t.Cleanup(func() { store = oldStore })
+
+	// The scanner flags ash
+	if err := s.FlagCaptcha("ash", "https://captcha.example/1"); err != nil {
+		t.Fatal(err)
+	}
+	accounts := captchaAccounts(t)
+	if len(accounts) != 1 || accounts[0] != (captchaAccount{Username: "ash", Provider: "ptc", CaptchaURL: "https://captcha.example/1", CaptchaAt: 1500000000}) {
+		t.Errorf("flagged accounts = %+v, want ash", accounts)
+	}
+	// An admin solved it and puts ash back
+	if w := clearCaptcha("ash"); w.Code != http.StatusOK {
+		t.Errorf("clear = %d %s", w.Code, w.Body)
+	}
+	if a := s.accounts["ash"]; a.CaptchaFlagged || a.CaptchaURL != "" || a.Banned {
+		t.Errorf("ash = %+v after the clear, want it in rotation again", a)
+	}
+	if accounts := captchaAccounts(t); len(accounts) != 0 {
+		t.Errorf("flagged accounts = %+v after the clear, want none", accounts)
+	}
+	if len(*audit) != 1 || (*audit)[0].Action != "clear-captcha" || (*audit)[0].Usernames[0] != "ash" {
+		t.Errorf("audit = %+v, want the clear", *audit)
+	}
+	// Accounts without a flag can't be cleared
+	for _, u := range []string{"ash", "misty", "brock"} {
+		if w := clearCaptcha(u); w.Code != http.StatusNotFound {
+			t.Errorf("clear of %s = %d, want 404", u, w.Code)
+		}
+	}
+	if len(*audit) != 1 {
+		t.Errorf("audit = %+v, want only the successful clear", *audit)
+	}
+}
+
+func TestCaptchaAdminOnly(t *testing.T) {
+	withAccountStore(t)
+	w := httptest.NewRecorder()
+	captchaHandler(w, httptest.NewRequest("GET", "/admin/captcha?secret=wrong", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("list with a wrong secret = %d, want 403", w.Code)
+	}
+	w = httptest.NewRecorder()
+	clearCaptchaHandler(w, httptest.NewRequest("POST", "/admin/captcha/clear?username=ash", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("clear without a secret = %d, want 403", w.Code)
+	}
+	w = httptest.NewRecorder()
+	clearCaptchaHandler(w, httptest.NewRequest("GET", "/admin/captcha/clear?secret=s3cret&username=ash", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET clear = %d, want 405", w.Code)
+	}
+}
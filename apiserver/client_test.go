@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pogointel/opm/client"
+	"github.com/pogointel/opm/opm"
+
+	"golang.org/x/net/context"
+)
+
+// TestClientCache runs the client against the apiserver with a fake store, which checks
+// the client and the API against each other
+func TestClientCache(t *testing.T) {
+	mux := withTestServer(t)
+	gym := opm.MapObject{Type: opm.GYM, ID: "gym", Lat: 52.5, Lng: 13.4, Team: 2, Timezone: "Europe/Berlin"}
+	stop := opm.MapObject{Type: opm.POKESTOP, ID: "stop", Lat: 52.5, Lng: 13.4, Lured: true, LureType: "mossy"}
+	withCacheStore(t, gym, stop)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	c := client.New(server.URL, "default")
+	resp, err := c.Cached(ctx, 52.5, 13.4, client.CacheQuery{LocalTime: true})
+	if err != nil || !resp.Ok || len(resp.MapObjects) != 2 {
+		t.Fatalf("Cached = %+v, %v", resp, err)
+	}
+	got := resp.MapObjects[0]
+	if got.ID != "gym" || got.Team != 2 || got.Timezone != "Europe/Berlin" || got.LocalTime == "" {
+		t.Errorf("gym = %+v, want the stored fields and the local time", got)
+	}
+	if got := resp.MapObjects[1]; got != stop {
+		t.Errorf("stop = %+v, want %+v", got, stop)
+	}
+	// The radius of the query reaches the store, clamped to the limits
+	store.(*fakeStore).radii = nil
+	if _, err := c.Cached(ctx, 52.5, 13.4, client.CacheQuery{Radius: 5000}); err != nil {
+		t.Fatal(err)
+	}
+	if radii := store.(*fakeStore).radii; len(radii) != 1 || radii[0] != 1000 {
+		t.Errorf("radii = %v, want the maximum radius", radii)
+	}
+
+	// Errors of the server arrive with their status, message and code
+	_, err = c.Cached(ctx, 91, 13.4, client.CacheQuery{})
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusBadRequest || e.Message != opm.ErrInvalidCoordinates.Error() {
+		t.Errorf("invalid coordinates = %v, want 400", err)
+	}
+	c = client.New(server.URL, "disabled")
+	_, err = c.Cached(ctx, 52.5, 13.4, client.CacheQuery{})
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusUnauthorized || !client.HasCode(err, opm.ErrCodeAuth) || e.Retryable() {
+		t.Errorf("disabled key = %v, want 401 %s", err, opm.ErrCodeAuth)
+	}
+}
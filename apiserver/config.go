@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// configState keeps track of where the settings of the process came from
+type configState struct {
+	sync.Mutex
+	opmLoaded opm.Settings    // as loaded from the file
+	opmKeys   map[string]bool // keys set in the file
+	apiLoaded settings        // as loaded from the file, before the defaults in main
+	apiKeys   map[string]bool
+	changes   map[string]runtimeChange
+}
+
+// runtimeChange counts the changes of a runtime modified section
+type runtimeChange struct {
+	Changes int   `json:"changes"`
+	Changed int64 `json:"changed,omitempty"`
+}
+
+// runtimeSection is a configuration section that is modified through admin endpoints
+type runtimeSection struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+	runtimeChange
+}
+
+type configResponse struct {
+	Ok        bool                       `json:"ok"`
+	Error     string                     `json:"error,omitempty"`
+	Opm       map[string]opm.ConfigValue `json:"opm,omitempty"`
+	APIServer map[string]opm.ConfigValue `json:"apiserver,omitempty"`
+	Runtime   map[string]runtimeSection  `json:"runtime,omitempty"`
+}
+
+// recordChange counts a change of a runtime section made through this apiserver
+func (c *configState) recordChange(section string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.changes == nil {
+		c.changes = make(map[string]runtimeChange)
+	}
+	rc := c.changes[section]
+	rc.Changes++
+	rc.Changed = time.Now().Unix()
+	c.changes[section] = rc
+}
+
+func (c *configState) change(section string) runtimeChange {
+	c.Lock()
+	defer c.Unlock()
+	return c.changes[section]
+}
+
+// runtimeSource is the source of a runtime section that starts out with the value of a settings key
+func runtimeSource(section, key string) string {
+	if config.change(section).Changes > 0 {
+		return opm.SourceRuntime
+	}
+	if config.apiKeys[key] {
+		return opm.SourceFile
+	}
+	return opm.SourceDefault
+}
+
+// configHandler returns the effective configuration of the apiserver. Every value is annotated
+// with its source, secrets are redacted.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, configResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	suppressions, err := database.GetSuppressions()
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, configResponse{Error: "Failed to get suppressions"})
+		return
+	}
+	responder.Write(w, r, http.StatusOK, configResponse{
+		Ok:        true,
+		Opm:       opm.DescribeConfig(opmSettings, config.opmLoaded, config.opmKeys),
+		APIServer: opm.DescribeConfig(apiSettings, config.apiLoaded, config.apiKeys),
+		Runtime: map[string]runtimeSection{
+			"suppressions": {Value: suppressions, Source: opm.SourceRuntime, runtimeChange: config.change("suppressions")},
+			"visibility":   {Value: visibility.Tiers(), Source: runtimeSource("visibility", "visibility"), runtimeChange: config.change("visibility")},
+			"rarities":     {Value: opm.RarityOverrides(), Source: runtimeSource("species", "rarityoverrides"), runtimeChange: config.change("species")},
+		},
+	})
+}
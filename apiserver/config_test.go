@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func TestRuntimeSectionSources(t *testing.T) {
+	oldKeys, oldChanges := config.apiKeys, config.changes
+	config.apiKeys, config.changes = map[string]bool{"visibility": true}, nil
+	defer func() { config.apiKeys, config.changes = oldKeys, oldChanges }()
+
+	if got := runtimeSource("visibility", "visibility"); got != opm.SourceFile {
+		t.Errorf("visibility from %s, want the file", got)
+	}
+	if got := runtimeSource("species", "rarityoverrides"); got != opm.SourceDefault {
+		t.Errorf("rarities from %s, want the default", got)
+	}
+	config.recordChange("species")
+	config.recordChange("species")
+	if got := runtimeSource("species", "rarityoverrides"); got != opm.SourceRuntime {
+		t.Errorf("rarities from %s after a change, want runtime", got)
+	}
+	if c := config.change("species"); c.Changes != 2 || c.Changed == 0 {
+		t.Errorf("species changes = %+v, want 2 with a time", c)
+	}
+	if c := config.change("visibility"); c.Changes != 0 {
+		t.Errorf("visibility changes = %+v, want none", c)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// maxDeletedObjects caps the limit parameter of the deleted endpoint
+const maxDeletedObjects = 1000
+
+func init() {
+	registerFeature("deleted")
+	registerLimit("maxDeletedObjects", maxDeletedObjects)
+	registerFormats("/deleted", "json")
+}
+
+// getDeletedSince returns the objects deleted after the cursor, replaced in tests
+var getDeletedSince = func(after db.DeletedCursor, limit int) ([]opm.MapObject, db.DeletedCursor, error) {
+	return database.GetDeletedSince(after, limit)
+}
+
+type deletedResponse struct {
+	Ok         bool            `json:"ok"`
+	Error      string          `json:"error,omitempty"`
+	ErrorCode  string          `json:"errorCode,omitempty"`
+	Objects    []opm.MapObject `json:"objects"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+// deletedHandler returns the deleted map objects a page at a time. Clients pass the
+// nextCursor of a response as cursor to get the next page, without one the deletions are
+// listed from the start of the tombstone retention. Cursors from before the retention are
+// rejected, the client has to start over with a full query.
+func deletedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, deletedResponse{Error: opm.ErrWrongMethod.Error(), ErrorCode: opm.ErrCodeBadRequest})
+		return
+	}
+	// Older tombstones may have been purged already
+	horizon := opm.Now().Add(-time.Duration(opmSettings.TombstoneHours) * time.Hour).Unix()
+	cursor := db.DeletedCursorAt(horizon)
+	if s := r.FormValue("cursor"); s != "" {
+		var err error
+		cursor, err = db.ParseDeletedCursor(s)
+		if err != nil || cursor.LastSeen < horizon-1 {
+			responder.Write(w, r, http.StatusBadRequest, deletedResponse{Error: opm.ErrInvalidCursor.Error(), ErrorCode: opm.ErrCodeInvalidCursor})
+			return
+		}
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	if limit > maxDeletedObjects {
+		limit = maxDeletedObjects
+	}
+	objects, next, err := getDeletedSince(cursor, limit)
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, deletedResponse{Error: "Failed to get deleted objects from DB"})
+		return
+	}
+	responder.Write(w, r, http.StatusOK, deletedResponse{Ok: true, Objects: objects, NextCursor: next.String()})
+}
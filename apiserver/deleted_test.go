@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// withTombstones serves the deletions of the given ids like GetDeletedSince, ordered by
+// deletion time and id. It returns the cursors the handler asked for.
+func withTombstones(t *testing.T, deletedAt map[string]int64) *[]db.DeletedCursor {
+	var ids []string
+	for id := range deletedAt {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if deletedAt[ids[i]] != deletedAt[ids[j]] {
+			return deletedAt[ids[i]] < deletedAt[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	var asked []db.DeletedCursor
+	old, oldSettings := getDeletedSince, opmSettings
+	opmSettings = opm.DefaultSettings
+	getDeletedSince = func(after db.DeletedCursor, limit int) ([]opm.MapObject, db.DeletedCursor, error) {
+		asked = append(asked, after)
+		var objects []opm.MapObject
+		next := after
+		for _, id := range ids {
+			if len(objects) == limit {
+				break
+			}
+			c := db.DeletedCursor{LastSeen: deletedAt[id], ID: id}
+			if c.LastSeen > after.LastSeen || (c.LastSeen == after.LastSeen && c.ID > after.ID) {
+				objects = append(objects, opm.MapObject{ID: id})
+				next = c
+			}
+		}
+		return objects, next, nil
+	}
+	t.Cleanup(func() { getDeletedSince, opmSettings = old, oldSettings })
+	return &asked
+}
+
+func getDeleted(t *testing.T, query url.Values) (int, deletedResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	deletedHandler(w, httptest.NewRequest("GET", "/deleted?"+query.Encode(), nil))
+	var resp deletedResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body, err)
+	}
+	return w.Code, resp
+}
+
+func TestDeletedPages(t *testing.T) {
+	now := time.Now().Unix()
+	deletedAt := make(map[string]int64)
+	for i := 0; i < 10; i++ {
+		// Most deletions share a second
+		deletedAt[fmt.Sprintf("o%d", i)] = now - int64(i%4/3)
+	}
+	asked := withTombstones(t, deletedAt)
+	var got []string
+	query := url.Values{"limit": {"3"}}
+	for page := 0; page < 10; page++ {
+		code, resp := getDeleted(t, query)
+		if code != http.StatusOK || !resp.Ok || resp.NextCursor == "" {
+			t.Fatalf("page %d = %d %+v", page, code, resp)
+		}
+		if len(resp.Objects) == 0 {
+			break
+		}
+		for _, o := range resp.Objects {
+			got = append(got, o.ID)
+		}
+		query.Set("cursor", resp.NextCursor)
+	}
+	want := "[o3 o7 o0 o1 o2 o4 o5 o6 o8 o9]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("paged ids = %v, want %s", got, want)
+	}
+	// Without a cursor the deletions since the start of the retention are listed
+	horizon := opm.Now().Add(-24 * time.Hour).Unix()
+	if first := (*asked)[0]; first.ID != "" || first.LastSeen < horizon-2 || first.LastSeen > horizon {
+		t.Errorf("first query after %+v, want the tombstone retention", first)
+	}
+}
+
+func TestDeletedRejectsInvalidCursors(t *testing.T) {
+	asked := withTombstones(t, nil)
+	expired := db.DeletedCursor{LastSeen: opm.Now().Add(-25 * time.Hour).Unix(), ID: "o1"}.String()
+	for _, cursor := range []string{"nope", "MTIz", expired} {
+		code, resp := getDeleted(t, url.Values{"cursor": {cursor}})
+		if code != http.StatusBadRequest || resp.ErrorCode != opm.ErrCodeInvalidCursor || resp.Error != opm.ErrInvalidCursor.Error() {
+			t.Errorf("cursor %q = %d %+v, want %s", cursor, code, resp, opm.ErrCodeInvalidCursor)
+		}
+	}
+	if len(*asked) != 0 {
+		t.Errorf("invalid cursors were queried: %v", *asked)
+	}
+	// An empty page returns the cursor it was asked with
+	current := db.DeletedCursor{LastSeen: time.Now().Unix(), ID: "o1"}.String()
+	if code, resp := getDeleted(t, url.Values{"cursor": {current}}); code != http.StatusOK || resp.NextCursor != current {
+		t.Errorf("empty page = %d %+v, want nextCursor %s", code, resp, current)
+	}
+}
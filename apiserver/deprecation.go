@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/util"
+)
+
+// legacyWarning is added to legacy JSON responses when LegacyWarning is set
+const legacyWarning = "This endpoint is deprecated, see the Deprecation and Sunset headers"
+
+// legacyRoute is a route or a format of a route that is marked legacy in the settings.
+// Entries are either a path ("/cache") or a path with a format ("/submit?format=pgm").
+type legacyRoute struct {
+	Path   string
+	Format string
+}
+
+func (l legacyRoute) String() string {
+	if l.Format == "" {
+		return l.Path
+	}
+	return l.Path + "?format=" + l.Format
+}
+
+// deprecationHeaders returns the values of the Deprecation (RFC 9745) and Sunset (RFC 8594)
+// headers for the dates of the settings. Without a deprecation date the route is just marked deprecated.
+func deprecationHeaders(deprecatedSince, sunset string) (string, string, error) {
+	deprecation, sunsetValue := "true", ""
+	if deprecatedSince != "" {
+		t, err := parseSettingsDate(deprecatedSince)
+		if err != nil {
+			return "", "", err
+		}
+		deprecation = "@" + strconv.FormatInt(t.Unix(), 10)
+	}
+	if sunset != "" {
+		t, err := parseSettingsDate(sunset)
+		if err != nil {
+			return "", "", err
+		}
+		sunsetValue = t.UTC().Format(http.TimeFormat)
+	}
+	return deprecation, sunsetValue, nil
+}
+
+// parseSettingsDate accepts RFC 3339 timestamps and plain dates
+func parseSettingsDate(v string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", v)
+	}
+	return t, err
+}
+
+func parseLegacyRoutes(entries []string) map[string][]legacyRoute {
+	routes := make(map[string][]legacyRoute)
+	for _, e := range entries {
+		l := legacyRoute{Path: e}
+		if i := strings.Index(e, "?format="); i >= 0 {
+			l = legacyRoute{Path: e[:i], Format: e[i+len("?format="):]}
+		}
+		routes[l.Path] = append(routes[l.Path], l)
+	}
+	return routes
+}
+
+// legacyCaller is the usage of a deprecated surface by one caller
+type legacyCaller struct {
+	requests int64
+	lastSeen int64
+}
+
+// deprecationTracker counts the usage of deprecated routes per route and caller.
+// The number of callers per route is bounded, further callers are counted as "other".
+type deprecationTracker struct {
+	sync.Mutex
+	maxCallers int
+	usage      map[string]map[string]*legacyCaller // route -> caller -> usage
+}
+
+func newDeprecationTracker(maxCallers int) *deprecationTracker {
+	return &deprecationTracker{
+		maxCallers: maxCallers,
+		usage:      make(map[string]map[string]*legacyCaller),
+	}
+}
+
+// Record counts a request of the caller to the route
+func (t *deprecationTracker) Record(route, caller string) {
+	t.Lock()
+	defer t.Unlock()
+	callers, ok := t.usage[route]
+	if !ok {
+		callers = make(map[string]*legacyCaller)
+		t.usage[route] = callers
+	}
+	c, ok := callers[caller]
+	if !ok {
+		if len(callers) >= t.maxCallers {
+			caller = usageOther
+			c = callers[caller]
+		}
+		if c == nil {
+			c = &legacyCaller{}
+			callers[caller] = c
+		}
+	}
+	c.requests++
+	c.lastSeen = time.Now().Unix()
+}
+
+// legacyCallerEntry is a line of the deprecation report
+type legacyCallerEntry struct {
+	Route    string `json:"route"`
+	Caller   string `json:"caller"`
+	Requests int64  `json:"requests"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// Report returns the usage of all deprecated routes since the start of the process, highest request count first
+func (t *deprecationTracker) Report() []legacyCallerEntry {
+	t.Lock()
+	entries := make([]legacyCallerEntry, 0)
+	for route, callers := range t.usage {
+		for caller, c := range callers {
+			entries = append(entries, legacyCallerEntry{Route: route, Caller: caller, Requests: c.requests, LastSeen: c.lastSeen})
+		}
+	}
+	t.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Requests != entries[j].Requests {
+			return entries[i].Requests > entries[j].Requests
+		}
+		return entries[i].Route+entries[i].Caller < entries[j].Route+entries[j].Caller
+	})
+	return entries
+}
+
+// String returns the number of requests per deprecated route for expvar
+func (t *deprecationTracker) String() string {
+	t.Lock()
+	defer t.Unlock()
+	counts := make(map[string]int64, len(t.usage))
+	for route, callers := range t.usage {
+		for _, c := range callers {
+			counts[route] += c.requests
+		}
+	}
+	b, _ := json.Marshal(counts)
+	return string(b)
+}
+
+// legacyCallerOf identifies the caller by API key if one is given and by origin otherwise.
+// Keys are resolved to their names in the report so they don't end up in it.
+func legacyCallerOf(r *http.Request) string {
+	if k := util.RequestKey(r); k != "" {
+		return "key:" + k
+	}
+	return "origin:" + requestOrigin(r)
+}
+
+// deprecated wraps the handler of a path with legacy routes. Matching requests get the
+// Deprecation and Sunset headers and are counted per caller.
+func deprecated(path string, inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	routes, ok := legacyRoutes[path]
+	if !ok {
+		return inner
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, ok := matchLegacyRoute(routes, r)
+		if !ok {
+			inner(w, r)
+			return
+		}
+		deprecations.Record(route.String(), legacyCallerOf(r))
+		w.Header().Set("Deprecation", deprecationHeader)
+		if sunsetHeader != "" {
+			w.Header().Set("Sunset", sunsetHeader)
+		}
+		if !apiSettings.LegacyWarning {
+			inner(w, r)
+			return
+		}
+		bw := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+		inner(bw, r)
+		bw.flush(legacyWarning)
+	}
+}
+
+func matchLegacyRoute(routes []legacyRoute, r *http.Request) (legacyRoute, bool) {
+	for _, l := range routes {
+		if l.Format == "" || r.FormValue("format") == l.Format {
+			return l, true
+		}
+	}
+	return legacyRoute{}, false
+}
+
+// bufferedWriter holds back the response so a warning can be added to JSON objects
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// flush writes the response. JSON objects get the warning field, everything else is written unchanged.
+func (w *bufferedWriter) flush(warning string) {
+	body := w.buf.Bytes()
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(body, &fields) == nil && fields != nil {
+			fields["warning"], _ = json.Marshal(warning)
+			if b, err := json.Marshal(fields); err == nil {
+				body = append(b, '\n')
+			}
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// deprecationsHandler lists the callers that still use deprecated routes
+func deprecationsHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	entries := deprecations.Report()
+	names := make(map[string]string)
+	for i, e := range entries {
+		if !strings.HasPrefix(e.Caller, "key:") {
+			continue
+		}
+		k := strings.TrimPrefix(e.Caller, "key:")
+		name, ok := names[k]
+		if !ok {
+			name = "unknown"
+			if key, err := lookupAPIKey(k); err == nil {
+				name = key.Name
+			}
+			names[k] = name
+		}
+		entries[i].Caller = "key:" + name
+	}
+	routes := make([]string, 0)
+	for _, rs := range legacyRoutes {
+		for _, l := range rs {
+			routes = append(routes, l.String())
+		}
+	}
+	sort.Strings(routes)
+	responder.Write(w, r, http.StatusOK, map[string]interface{}{
+		"routes":      routes,
+		"deprecation": deprecationHeader,
+		"sunset":      sunsetHeader,
+		"callers":     entries,
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pogointel/opm/db"
+)
+
+// Diagnostic levels, ordered by severity
+const (
+	levelOk   = "ok"
+	levelWarn = "warn"
+	levelCrit = "crit"
+)
+
+var levelSeverity = map[string]int{levelOk: 0, levelWarn: 1, levelCrit: 2}
+
+// diagnosticCheck is a single entry of the diagnostics report
+type diagnosticCheck struct {
+	Name    string `json:"name"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// diagnosticsReport is the combined report of all subsystems.
+// Level is the worst level of all checks.
+type diagnosticsReport struct {
+	Level  string            `json:"level"`
+	Time   int64             `json:"time"`
+	Checks []diagnosticCheck `json:"checks"`
+}
+
+// diagnosticSource is a subsystem that reports on its own health
+type diagnosticSource interface {
+	Diagnose() []diagnosticCheck
+}
+
+// aggregateDiagnostics runs the checks of all sources and combines them to one report
+func aggregateDiagnostics(sources []diagnosticSource) diagnosticsReport {
+	report := diagnosticsReport{
+		Level:  levelOk,
+		Time:   time.Now().Unix(),
+		Checks: make([]diagnosticCheck, 0),
+	}
+	for _, s := range sources {
+		for _, c := range s.Diagnose() {
+			if levelSeverity[c.Level] > levelSeverity[report.Level] {
+				report.Level = c.Level
+			}
+			report.Checks = append(report.Checks, c)
+		}
+	}
+	return report
+}
+
+// diagnosticsDatabase is the part of the database checked by databaseDiagnostics
+type diagnosticsDatabase interface {
+	Ping() (time.Duration, error)
+	MissingIndexes() ([]string, error)
+	ClockSkew() (time.Duration, error)
+	AccountStats() (db.AccountStats, error)
+	ProxyStats() (alive, aliveUsed, dead int, err error)
+}
+
+// databaseDiagnostics checks the database connection, indexes and the account and proxy pools
+type databaseDiagnostics struct {
+	db          diagnosticsDatabase
+	slowPing    time.Duration
+	minAccounts int
+	minProxies  int
+	maxSkew     time.Duration
+}
+
+func (d databaseDiagnostics) Diagnose() []diagnosticCheck {
+	// Connection
+	rtt, err := d.db.Ping()
+	if err != nil {
+		return []diagnosticCheck{{"database", levelCrit, err.Error()}}
+	}
+	checks := []diagnosticCheck{{"database", levelOk, fmt.Sprintf("Ping %s", rtt)}}
+	if rtt > d.slowPing {
+		checks[0].Level = levelWarn
+	}
+	// Indexes
+	missing, err := d.db.MissingIndexes()
+	switch {
+	case err != nil:
+		checks = append(checks, diagnosticCheck{"indexes", levelWarn, err.Error()})
+	case len(missing) > 0:
+		checks = append(checks, diagnosticCheck{"indexes", levelWarn, "Missing " + strings.Join(missing, " ")})
+	default:
+		checks = append(checks, diagnosticCheck{"indexes", levelOk, "All indexes present"})
+	}
+	// Clock
+	skew, err := d.db.ClockSkew()
+	if err != nil {
+		checks = append(checks, diagnosticCheck{"clock", levelWarn, err.Error()})
+	} else {
+		level := levelOk
+		if skew > d.maxSkew || skew < -d.maxSkew {
+			level = levelWarn
+		}
+		checks = append(checks, diagnosticCheck{"clock", level, fmt.Sprintf("Local clock is off by %s", skew.Round(time.Millisecond))})
+	}
+	// Accounts
+	a, err := d.db.AccountStats()
+	if err != nil {
+		checks = append(checks, diagnosticCheck{"accounts", levelWarn, err.Error()})
+	} else {
+		free := a.Total - a.Used - a.Banned - a.Flagged
+		checks = append(checks, diagnosticCheck{"accounts", thresholdLevel(free, d.minAccounts),
+			fmt.Sprintf("%d free of %d (%d banned, %d flagged)", free, a.Total, a.Banned, a.Flagged)})
+	}
+	// Proxies
+	alive, aliveUsed, dead, err := d.db.ProxyStats()
+	if err != nil {
+		checks = append(checks, diagnosticCheck{"proxies", levelWarn, err.Error()})
+	} else {
+		free := alive - aliveUsed
+		checks = append(checks, diagnosticCheck{"proxies", thresholdLevel(free, d.minProxies),
+			fmt.Sprintf("%d free of %d alive (%d dead)", free, alive, dead)})
+	}
+	return checks
+}
+
+// thresholdLevel is crit when nothing is left and warn below the threshold
+func thresholdLevel(free, min int) string {
+	if free <= 0 {
+		return levelCrit
+	}
+	if free < min {
+		return levelWarn
+	}
+	return levelOk
+}
+
+// scannerSummary is the part of the scanner status summary used for diagnostics
+type scannerSummary struct {
+	Budget struct {
+		Paused bool   `json:"paused"`
+		Reason string `json:"reason"`
+		Until  int64  `json:"until"`
+	} `json:"budget"`
+	Queue struct {
+		Available int64 `json:"available"`
+		Busy      int64 `json:"busy"`
+		Cooling   int64 `json:"cooling"`
+		Timeouts  int64 `json:"timeouts"`
+	} `json:"queue"`
+	Trainers int `json:"trainers"`
+}
+
+// scannerDiagnostics checks pause state and trainer queue of the scanner
+type scannerDiagnostics struct {
+	statusURL string
+}
+
+func (d scannerDiagnostics) Diagnose() []diagnosticCheck {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(d.statusURL)
+	if err != nil {
+		return []diagnosticCheck{{"scanner", levelCrit, err.Error()}}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []diagnosticCheck{{"scanner", levelCrit, resp.Status}}
+	}
+	var s scannerSummary
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	if err != nil {
+		return []diagnosticCheck{{"scanner", levelCrit, err.Error()}}
+	}
+	checks := []diagnosticCheck{{"scanner", levelOk, fmt.Sprintf("%d trainers", s.Trainers)}}
+	// Pause (error budget)
+	if s.Budget.Paused {
+		msg := fmt.Sprintf("Scanning paused until %s: %s", time.Unix(s.Budget.Until, 0).Format(time.RFC3339), s.Budget.Reason)
+		checks = append(checks, diagnosticCheck{"pause", levelCrit, msg})
+	} else {
+		checks = append(checks, diagnosticCheck{"pause", levelOk, "Not paused"})
+	}
+	// Queue saturation
+	q := s.Queue
+	msg := fmt.Sprintf("%d available, %d busy, %d cooling, %d timeouts", q.Available, q.Busy, q.Cooling, q.Timeouts)
+	level := levelOk
+	if q.Available == 0 {
+		level = levelWarn
+	}
+	checks = append(checks, diagnosticCheck{"queue", level, msg})
+	return checks
+}
+
+// alertState is a condition of the stats service
+type alertState struct {
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	Firing   bool   `json:"firing"`
+	Message  string `json:"message"`
+}
+
+// alertDiagnostics reports the alert conditions evaluated by the stats service
+type alertDiagnostics struct {
+	alertsURL string
+}
+
+func (d alertDiagnostics) Diagnose() []diagnosticCheck {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(d.alertsURL)
+	if err != nil {
+		// Stats are optional, so this is no emergency
+		return []diagnosticCheck{{"alerts", levelWarn, err.Error()}}
+	}
+	defer resp.Body.Close()
+	var states []alertState
+	err = json.NewDecoder(resp.Body).Decode(&states)
+	if err != nil {
+		return []diagnosticCheck{{"alerts", levelWarn, err.Error()}}
+	}
+	checks := make([]diagnosticCheck, 0, len(states))
+	for _, s := range states {
+		c := diagnosticCheck{"alert:" + s.Name, levelOk, "Not firing"}
+		if s.Firing {
+			c.Level, c.Message = s.Severity, s.Message
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// diagnosticSources returns the subsystems checked by /admin/diagnostics
+func diagnosticSources() []diagnosticSource {
+	statusURL := fmt.Sprintf("http://%s:%d/status?summary=1&secret=%s", opmSettings.ScannerListenAddress, opmSettings.ScannerListenPort, opmSettings.Secret)
+	return []diagnosticSource{
+		databaseDiagnostics{
+			db:          database,
+			slowPing:    500 * time.Millisecond,
+			minAccounts: apiSettings.MinFreeAccounts,
+			minProxies:  apiSettings.MinFreeProxies,
+			maxSkew:     time.Duration(opmSettings.MaxClockSkew) * time.Second,
+		},
+		scannerDiagnostics{statusURL: statusURL},
+		alertDiagnostics{alertsURL: apiSettings.StatsAlertsURL},
+	}
+}
+
+// diagnosticsHandler answers with 503 if any check is critical, so simple watchdogs only need the status code
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	report := aggregateDiagnostics(diagnosticSources())
+	status := http.StatusOK
+	if report.Level == levelCrit {
+		status = http.StatusServiceUnavailable
+	}
+	responder.Write(w, r, status, report)
+}
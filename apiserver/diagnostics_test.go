@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/db"
+)
+
+// fakeSource returns fixed checks
+type fakeSource []diagnosticCheck
+
+func (s fakeSource) Diagnose() []diagnosticCheck {
+	return s
+}
+
+// fakeDiagnosticsDatabase returns fixed values or err for every check
+type fakeDiagnosticsDatabase struct {
+	ping     time.Duration
+	missing  []string
+	skew     time.Duration
+	accounts db.AccountStats
+	alive    int
+	used     int
+	dead     int
+	err      error
+}
+
+func (f fakeDiagnosticsDatabase) Ping() (time.Duration, error)           { return f.ping, f.err }
+func (f fakeDiagnosticsDatabase) MissingIndexes() ([]string, error)      { return f.missing, f.err }
+func (f fakeDiagnosticsDatabase) ClockSkew() (time.Duration, error)      { return f.skew, f.err }
+func (f fakeDiagnosticsDatabase) AccountStats() (db.AccountStats, error) { return f.accounts, f.err }
+func (f fakeDiagnosticsDatabase) ProxyStats() (int, int, int, error) {
+	return f.alive, f.used, f.dead, f.err
+}
+
+// levels returns the level of each check by name
+func levels(checks []diagnosticCheck) map[string]string {
+	got := make(map[string]string)
+	for _, c := range checks {
+		got[c.Name] = c.Level
+	}
+	return got
+}
+
+func TestAggregateDiagnostics(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []diagnosticSource
+		level   string
+		checks  int
+	}{
+		{"no sources", nil, levelOk, 0},
+		{"all ok", []diagnosticSource{fakeSource{{"a", levelOk, ""}}, fakeSource{{"b", levelOk, ""}}}, levelOk, 2},
+		{"warn", []diagnosticSource{fakeSource{{"a", levelOk, ""}, {"b", levelWarn, ""}}}, levelWarn, 2},
+		{"crit wins", []diagnosticSource{fakeSource{{"a", levelCrit, ""}}, fakeSource{{"b", levelWarn, ""}}}, levelCrit, 2},
+		{"empty source", []diagnosticSource{fakeSource{}, fakeSource{{"a", levelWarn, ""}}}, levelWarn, 1},
+	}
+	for _, test := range tests {
+		report := aggregateDiagnostics(test.sources)
+		if report.Level != test.level || len(report.Checks) != test.checks {
+			t.Errorf("%s: level %s with %d checks, want %s with %d", test.name, report.Level, len(report.Checks), test.level, test.checks)
+		}
+		if report.Checks == nil {
+			t.Errorf("%s: checks are null, want an array", test.name)
+		}
+	}
+}
+
+func TestDatabaseDiagnostics(t *testing.T) {
+	healthy := fakeDiagnosticsDatabase{
+		ping:     time.Millisecond,
+		accounts: db.AccountStats{Total: 20, Used: 5},
+		alive:    10,
+		used:     2,
+	}
+	d := databaseDiagnostics{slowPing: 100 * time.Millisecond, minAccounts: 5, minProxies: 5, maxSkew: time.Second}
+	tests := []struct {
+		name   string
+		change func(f *fakeDiagnosticsDatabase)
+		want   map[string]string
+	}{
+		{"healthy", func(f *fakeDiagnosticsDatabase) {},
+			map[string]string{"database": levelOk, "indexes": levelOk, "clock": levelOk, "accounts": levelOk, "proxies": levelOk}},
+		{"degraded", func(f *fakeDiagnosticsDatabase) {
+			f.ping, f.missing, f.skew = time.Second, []string{"objects.loc_2dsphere"}, -2*time.Second
+			f.accounts.Used, f.used = 17, 8
+		}, map[string]string{"database": levelWarn, "indexes": levelWarn, "clock": levelWarn, "accounts": levelWarn, "proxies": levelWarn}},
+		{"exhausted", func(f *fakeDiagnosticsDatabase) {
+			f.accounts.Banned, f.accounts.Flagged, f.used = 10, 5, 10
+		}, map[string]string{"accounts": levelCrit, "proxies": levelCrit}},
+		{"down", func(f *fakeDiagnosticsDatabase) { f.err = errors.New("no reachable servers") },
+			map[string]string{"database": levelCrit}},
+	}
+	for _, test := range tests {
+		f := healthy
+		test.change(&f)
+		d.db = f
+		got := levels(d.Diagnose())
+		for name, level := range test.want {
+			if got[name] != level {
+				t.Errorf("%s: %s is %q, want %s", test.name, name, got[name], level)
+			}
+		}
+		if test.name == "down" && len(got) != 1 {
+			t.Errorf("down: checks %v, want only the connection", got)
+		}
+	}
+}
+
+func TestScannerDiagnostics(t *testing.T) {
+	summary := `{"budget":{"paused":false},"queue":{"available":3},"trainers":3}`
+	status := http.StatusOK
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, summary)
+	}))
+	defer scanner.Close()
+	d := scannerDiagnostics{statusURL: scanner.URL}
+	if got := levels(d.Diagnose()); got["scanner"] != levelOk || got["pause"] != levelOk || got["queue"] != levelOk {
+		t.Errorf("healthy scanner: %v", got)
+	}
+
+	summary = `{"budget":{"paused":true,"reason":"ban rate exceeded","until":1501592400},"queue":{"available":0,"busy":3},"trainers":3}`
+	checks := d.Diagnose()
+	if got := levels(checks); got["pause"] != levelCrit || got["queue"] != levelWarn {
+		t.Errorf("paused scanner: %v", got)
+	}
+	for _, c := range checks {
+		if c.Name == "pause" && !strings.Contains(c.Message, "ban rate exceeded") {
+			t.Errorf("pause message %q, want the reason", c.Message)
+		}
+	}
+
+	status = http.StatusForbidden
+	if got := levels(d.Diagnose()); len(got) != 1 || got["scanner"] != levelCrit {
+		t.Errorf("scanner answering 403: %v", got)
+	}
+	scanner.Close()
+	if got := levels(d.Diagnose()); got["scanner"] != levelCrit {
+		t.Errorf("scanner down: %v", got)
+	}
+}
+
+func TestAlertDiagnostics(t *testing.T) {
+	stats := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"name":"bans","severity":"crit","firing":true,"message":"10 bans"},{"name":"proxies","severity":"warn","firing":false}]`)
+	}))
+	defer stats.Close()
+	d := alertDiagnostics{alertsURL: stats.URL}
+	if got := levels(d.Diagnose()); got["alert:bans"] != levelCrit || got["alert:proxies"] != levelOk {
+		t.Errorf("alerts: %v", got)
+	}
+	// Stats are optional
+	stats.Close()
+	if got := levels(d.Diagnose()); got["alerts"] != levelWarn {
+		t.Errorf("stats down: %v, want a warning", got)
+	}
+}
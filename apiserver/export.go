@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+func init() {
+	registerFeature("export")
+	registerFormats("/admin/export/accounts", opm.ExportCSV, opm.ExportJSON)
+	registerFormats("/admin/export/proxies", opm.ExportCSV, opm.ExportJSON)
+}
+
+// exportFormat returns the requested export format, csv by default
+func exportFormat(r *http.Request) string {
+	format := r.FormValue("format")
+	if format == "" {
+		format = opm.ExportCSV
+	}
+	return format
+}
+
+// startExport sets the headers of an export download and creates the writer
+func startExport(w http.ResponseWriter, format, name string, header []string) (*opm.ExportWriter, error) {
+	if format != opm.ExportCSV && format != opm.ExportJSON {
+		return nil, opm.ErrUnknownFormat
+	}
+	if format == opm.ExportCSV {
+		w.Header().Add("Content-Type", "text/csv")
+	} else {
+		w.Header().Add("Content-Type", "application/json")
+	}
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102"), format)
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	return opm.NewExportWriter(w, format, header)
+}
+
+func exportAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	filter, err := db.ParseAccountFilter(r.Form)
+	if err != nil {
+		http.Error(w, "Wrong format", http.StatusBadRequest)
+		return
+	}
+	// Passwords need an explicit confirmation
+	includeSecrets := r.FormValue("includeSecrets") == "1"
+	if includeSecrets && r.FormValue("confirmSecrets") != "yes" {
+		http.Error(w, "includeSecrets requires confirmSecrets=yes", http.StatusBadRequest)
+		return
+	}
+	format := exportFormat(r)
+	ew, err := startExport(w, format, "accounts", opm.AccountExportHeader(includeSecrets))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = database.EachAccount(filter, func(a opm.Account) error {
+		return ew.Write(opm.AccountExportRow(a, includeSecrets))
+	})
+	if err != nil {
+		// The response is already on its way, all we can do is log
+		log.Println(err)
+	}
+	err = ew.Close()
+	if err != nil {
+		log.Println(err)
+	}
+	action := "export-accounts"
+	if includeSecrets {
+		action = "export-accounts-with-secrets"
+	}
+	err = database.AddAuditEntry(opm.AuditEntry{
+		Who:    who,
+		Action: action,
+		Value:  r.Form.Encode(),
+		Count:  ew.Rows(),
+		Time:   time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	log.Printf("%s exported %d accounts", who, ew.Rows())
+}
+
+func exportProxiesHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	filter, err := db.ParseProxyFilter(r.Form)
+	if err != nil {
+		http.Error(w, "Wrong format", http.StatusBadRequest)
+		return
+	}
+	ew, err := startExport(w, exportFormat(r), "proxies", opm.ProxyExportHeader())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = database.EachProxy(filter, func(p opm.Proxy) error {
+		return ew.Write(opm.ProxyExportRow(p))
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	err = ew.Close()
+	if err != nil {
+		log.Println(err)
+	}
+	log.Printf("%s exported %d proxies", who, ew.Rows())
+}
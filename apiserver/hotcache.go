@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+)
+
+// hotCachePrecision is the geohash precision of the cache cells (about 150m x 150m)
+const hotCachePrecision = 7
+
+// hotCache keeps recent /cache results in memory, so viewers of the same neighborhood
+// share one database query. Queries are rounded to the center of their geohash cell,
+// so every viewer of a cell gets the same result. Entries expire after the TTL, the
+// least recently used entry is evicted when the cache is full.
+type hotCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*list.Element
+	lru     *list.List // front = most recently used
+	nowFunc func() time.Time
+
+	hits          int64
+	misses        int64
+	invalidations int64
+}
+
+type hotCacheEntry struct {
+	key      string
+	lat, lng float64
+	radius   int
+	objects  []opm.MapObject
+	stored   time.Time
+}
+
+func newHotCache(ttl time.Duration, max int) *hotCache {
+	return &hotCache{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		nowFunc: opm.Now,
+	}
+}
+
+// GetMapObjects returns the objects around the cell of lat/lng, from the cache if possible
+func (c *hotCache) GetMapObjects(lat, lng float64, types []int, radius int, load func(lat, lng float64, types []int, radius int) ([]opm.MapObject, error)) ([]opm.MapObject, error) {
+	cell := geo.Geohash(geo.LatLng{Lat: lat, Lng: lng}, hotCachePrecision)
+	key := hotCacheKey(cell, types, radius)
+	if objects, ok := c.get(key); ok {
+		atomic.AddInt64(&c.hits, 1)
+		return objects, nil
+	}
+	atomic.AddInt64(&c.misses, 1)
+	center := geo.GeohashCenter(cell)
+	lat, lng = center.Lat, center.Lng
+	objects, err := load(lat, lng, types, radius)
+	if err != nil {
+		return nil, err
+	}
+	c.put(&hotCacheEntry{key: key, lat: lat, lng: lng, radius: radius, objects: objects, stored: c.nowFunc()})
+	return objects, nil
+}
+
+func hotCacheKey(cell string, types []int, radius int) string {
+	sorted := append([]int(nil), types...)
+	sort.Ints(sorted)
+	parts := make([]string, len(sorted))
+	for i, t := range sorted {
+		parts[i] = strconv.Itoa(t)
+	}
+	return cell + "|" + strings.Join(parts, ",") + "|" + strconv.Itoa(radius)
+}
+
+// get returns the unexpired objects of a fresh entry
+func (c *hotCache) get(key string) ([]opm.MapObject, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*hotCacheEntry)
+	now := c.nowFunc()
+	if now.Sub(e.stored) >= c.ttl {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	// Pokemon and lures may have expired since the entry was stored
+	objects := make([]opm.MapObject, 0, len(e.objects))
+	for _, o := range e.objects {
+		o = opm.ClearExpiredLure(o, now)
+		if !opm.Expired(o.Expiry, now) {
+			objects = append(objects, o)
+		}
+	}
+	return objects, true
+}
+
+func (c *hotCache) put(e *hotCacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry. Must be called with the lock held.
+func (c *hotCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*hotCacheEntry).key)
+}
+
+// Invalidate drops all entries whose area overlaps the circle around lat/lng, so new
+// objects show up with the next request
+func (c *hotCache) Invalidate(lat, lng float64, radius int) {
+	c.Lock()
+	defer c.Unlock()
+	p := geo.LatLng{Lat: lat, Lng: lng}
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*hotCacheEntry)
+		if geo.Distance(p, geo.LatLng{Lat: e.lat, Lng: e.lng}) <= float64(e.radius+radius) {
+			c.remove(el)
+			atomic.AddInt64(&c.invalidations, 1)
+		}
+		el = next
+	}
+}
+
+// Clear drops all entries
+func (c *hotCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	atomic.AddInt64(&c.invalidations, int64(c.lru.Len()))
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// String returns the size and the hit and miss counters for expvar
+func (c *hotCache) String() string {
+	c.Lock()
+	size := c.lru.Len()
+	c.Unlock()
+	b, _ := json.Marshal(map[string]int64{
+		"entries":       int64(size),
+		"hits":          atomic.LoadInt64(&c.hits),
+		"misses":        atomic.LoadInt64(&c.misses),
+		"invalidations": atomic.LoadInt64(&c.invalidations),
+	})
+	return string(b)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// countingLoad returns objects like GetMapObjects and counts its calls
+type countingLoad struct {
+	calls   int
+	objects []opm.MapObject
+}
+
+func (l *countingLoad) load(lat, lng float64, types []int, radius int) ([]opm.MapObject, error) {
+	l.calls++
+	return l.objects, nil
+}
+
+// newTestHotCache returns a cache whose clock is advanced by the returned function
+func newTestHotCache(ttl time.Duration, max int) (*hotCache, func(time.Duration)) {
+	c := newHotCache(ttl, max)
+	now := time.Unix(1500000000, 0)
+	c.nowFunc = func() time.Time { return now }
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestHotCacheSharesCells(t *testing.T) {
+	c, _ := newTestHotCache(10*time.Second, 10)
+	l := &countingLoad{}
+	types := []int{opm.POKEMON, opm.GYM}
+	c.GetMapObjects(52.50001, 13.40001, types, 200, l.load)
+	// A viewer a few meters away with the types in a different order
+	c.GetMapObjects(52.50003, 13.40002, []int{opm.GYM, opm.POKEMON}, 200, l.load)
+	if l.calls != 1 {
+		t.Errorf("%d queries for one cell, want 1", l.calls)
+	}
+	c.GetMapObjects(52.50001, 13.40001, []int{opm.POKEMON}, 200, l.load)
+	c.GetMapObjects(52.50001, 13.40001, types, 500, l.load)
+	c.GetMapObjects(52.51, 13.40001, types, 200, l.load)
+	if l.calls != 4 {
+		t.Errorf("%d queries, want one more for other types, radius and cell", l.calls)
+	}
+}
+
+func TestHotCacheExpiry(t *testing.T) {
+	c, advance := newTestHotCache(10*time.Second, 10)
+	now := c.nowFunc()
+	l := &countingLoad{objects: []opm.MapObject{
+		{Type: opm.POKEMON, ID: "short", Expiry: now.Add(5 * time.Second).Unix()},
+		{Type: opm.POKEMON, ID: "long", Expiry: now.Add(time.Minute).Unix()},
+		{Type: opm.POKESTOP, ID: "stop", Lured: true, LureType: opm.LureGlacial, Expiry: now.Add(5 * time.Second).Unix()},
+		{Type: opm.GYM, ID: "gym"},
+	}}
+	types := []int{opm.POKEMON, opm.POKESTOP, opm.GYM}
+	c.GetMapObjects(52.5, 13.4, types, 200, l.load)
+	// Objects that expired since the entry was stored are left out
+	advance(6 * time.Second)
+	got, _ := c.GetMapObjects(52.5, 13.4, types, 200, l.load)
+	if l.calls != 1 || len(got) != 3 {
+		t.Fatalf("%d queries and objects %v, want the cached entry without the short Pokemon", l.calls, got)
+	}
+	for _, o := range got {
+		if o.ID == "stop" && (o.Lured || o.Expiry != 0) {
+			t.Errorf("stop = %+v, want its expired lure cleared", o)
+		}
+	}
+	if l.objects[2].Lured != true {
+		t.Error("the cached entry was modified")
+	}
+	// The entry expires after the TTL
+	advance(4 * time.Second)
+	c.GetMapObjects(52.5, 13.4, types, 200, l.load)
+	if l.calls != 2 {
+		t.Errorf("%d queries after the TTL, want 2", l.calls)
+	}
+}
+
+func TestHotCacheEviction(t *testing.T) {
+	c, _ := newTestHotCache(time.Minute, 2)
+	l := &countingLoad{}
+	get := func(lat float64) { c.GetMapObjects(lat, 13.4, []int{opm.POKEMON}, 200, l.load) }
+	get(52.50)
+	get(52.51)
+	// 52.50 is used again, so 52.51 is the least recently used entry
+	get(52.50)
+	get(52.52)
+	if l.calls != 3 {
+		t.Fatalf("%d queries, want 3", l.calls)
+	}
+	get(52.50)
+	get(52.52)
+	if l.calls != 3 {
+		t.Errorf("%d queries for the entries in the cache, want none", l.calls-3)
+	}
+	get(52.51)
+	if l.calls != 4 {
+		t.Errorf("evicted entry was served from the cache")
+	}
+	if c.lru.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("%d entries, want the maximum of 2", c.lru.Len())
+	}
+}
+
+func TestHotCacheInvalidate(t *testing.T) {
+	c, _ := newTestHotCache(time.Minute, 10)
+	l := &countingLoad{}
+	c.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 200, l.load)
+	c.GetMapObjects(52.6, 13.4, []int{opm.POKEMON}, 200, l.load)
+	// A scan 150 m away overlaps the first entry only
+	c.Invalidate(52.50135, 13.4, scanVisibility)
+	c.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 200, l.load)
+	c.GetMapObjects(52.6, 13.4, []int{opm.POKEMON}, 200, l.load)
+	if l.calls != 3 {
+		t.Errorf("%d queries, want one more for the invalidated entry", l.calls)
+	}
+	c.Clear()
+	c.GetMapObjects(52.6, 13.4, []int{opm.POKEMON}, 200, l.load)
+	if l.calls != 4 {
+		t.Errorf("%d queries after Clear, want 4", l.calls)
+	}
+}
+
+func TestScanInvalidatesCache(t *testing.T) {
+	withCacheStore(t)
+	l := &countingLoad{}
+	mapCache.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 200, l.load)
+	scan := invalidateScanned(func(w http.ResponseWriter, r *http.Request) {
+		// The scanner reads the body that was passed on
+		r.ParseForm()
+		if r.PostForm.Get("lat") != "52.5" {
+			t.Errorf("scanner received %v", r.PostForm)
+		}
+	})
+	r := httptest.NewRequest("POST", "/scan", strings.NewReader("lat=52.5&lng=13.4"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	scan(httptest.NewRecorder(), r)
+	mapCache.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 200, l.load)
+	if l.calls != 2 {
+		t.Errorf("%d queries, want the scanned cell loaded again", l.calls)
+	}
+}
+
+// BenchmarkHotCache has viewers spread over a neighborhood of about 1 km², with 100 requests
+// per second. It reports the database queries per request, without the cache every request is one.
+func BenchmarkHotCache(b *testing.B) {
+	c, advance := newTestHotCache(10*time.Second, 1000)
+	l := &countingLoad{objects: make([]opm.MapObject, 100)}
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		advance(10 * time.Millisecond)
+		c.GetMapObjects(52.5+r.Float64()*0.01, 13.4+r.Float64()*0.015, []int{opm.POKEMON, opm.POKESTOP, opm.GYM}, 200, l.load)
+	}
+	b.ReportMetric(float64(l.calls)/float64(b.N), "queries/op")
+}
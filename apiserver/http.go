@@ -1,8 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -11,25 +14,30 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/internal/faults"
 	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
 )
 
 var securityCheck = func(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
+// lookupAPIKey returns the API key for the API key middleware
+var lookupAPIKey = func(k string) (opm.APIKey, error) {
+	key, err := database.GetAPIKey(k)
+	if errors.Is(err, db.ErrNotFound) {
+		return key, opm.ErrInvalidAPIKey
+	}
+	return key, err
+}
+
 func startHTTP() {
-	// Routes/Handlers
-	mux := http.NewServeMux()
-	scanHandler, err := createScanProxy()
+	mux, err := newMux()
 	if err != nil {
 		log.Fatal(err)
 	}
-	mux.Handle("/fe/", http.StripPrefix("/fe/", http.FileServer(http.Dir(apiSettings.StaticFilesDir))))
-	mux.HandleFunc("/scan", httpDecorator(scanHandler.ServeHTTP))
-	mux.HandleFunc("/cache", httpDecorator(cacheHandler))
-	mux.HandleFunc("/submit", httpDecorator(submitHandler))
-	mux.Handle("/debug/vars", http.DefaultServeMux)
 	// Create http server with timeouts
 	s := http.Server{
 		ReadTimeout:  10 * time.Second,
@@ -42,6 +50,86 @@ func startHTTP() {
 	log.Fatal(s.ListenAndServe())
 }
 
+// newMux mounts the routes and registers the capabilities that depend on the settings
+func newMux() (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	scanHandler, err := createScanProxy()
+	if err != nil {
+		return nil, err
+	}
+	get, post, getPost := []string{"GET"}, []string{"POST"}, []string{"GET", "POST"}
+	// Clients
+	handleUndecorated(mux, route{Path: "/fe/", Methods: get}, http.StripPrefix("/fe/", http.FileServer(http.Dir(apiSettings.StaticFilesDir))))
+	scanRoute := route{Path: "/scan", Methods: post}
+	if opmSettings.RequireAPIKey {
+		// Checked by the scanner, with the same limits
+		scanRoute.Auth, scanRoute.RateLimit = authAPIKey, rateKey
+		registerCallerLimit("/scan", util.NewAPIKeyAuth(lookupAPIKey, opmSettings.KeyRequestsPerMinute, opmSettings.KeyBurst).CallerLimit)
+	}
+	handle(mux, scanRoute, invalidateScanned(scanHandler.ServeHTTP))
+	cacheFn := cacheHandler
+	cacheRoute := route{Path: "/cache", Methods: post}
+	if opmSettings.RequireAPIKey && !opmSettings.CacheKeyExempt {
+		auth := util.NewAPIKeyAuth(lookupAPIKey, opmSettings.KeyRequestsPerMinute, opmSettings.KeyBurst)
+		auth.Responder = responder
+		cacheFn = auth.Wrap(cacheFn)
+		cacheRoute.Auth, cacheRoute.RateLimit = authAPIKey, rateKey
+		registerCallerLimit("/cache", auth.CallerLimit)
+	}
+	// Results of /scan are compressed by the scanner, the proxy passes them on
+	handle(mux, cacheRoute, util.Gzip(cacheFn))
+	handle(mux, route{Path: "/submit", Methods: getPost, Auth: authAPIKey}, submitHandler)
+	handle(mux, route{Path: "/recent", Methods: get}, recentHandler)
+	handle(mux, route{Path: "/gym", Methods: get}, gymHandler)
+	handle(mux, route{Path: "/deleted", Methods: get}, deletedHandler)
+	if apiSettings.DemoMap {
+		handle(mux, route{Path: "/map", Methods: get}, mapHandler)
+	}
+	handle(mux, route{Path: "/capabilities", Methods: get}, capabilitiesHandler)
+	// Operators
+	admin := func(path string, methods []string, h func(http.ResponseWriter, *http.Request)) {
+		handle(mux, route{Path: path, Methods: methods, Auth: authAdmin}, h)
+	}
+	admin("/routes", get, routesHandler)
+	admin("/admin/accounts", post, importAccountsHandler)
+	admin("/admin/accounts/batch", post, batchAccountsHandler)
+	admin("/admin/audit", get, auditHandler)
+	admin("/admin/objects/delete", post, deleteObjectsHandler)
+	admin("/admin/quarantine", get, quarantineHandler)
+	admin("/admin/quarantine/requeue", post, requeueHandler)
+	admin("/admin/captcha", get, captchaHandler)
+	admin("/admin/captcha/clear", post, clearCaptchaHandler)
+	admin("/admin/suppressions", getPost, suppressionsHandler)
+	admin("/admin/suppressions/remove", post, removeSuppressionHandler)
+	admin("/admin/areas", getPost, areasHandler)
+	admin("/admin/areas/remove", post, removeAreaHandler)
+	admin("/admin/areas/stats", get, areaStatsHandler)
+	admin("/admin/visibility", getPost, visibilityHandler)
+	admin("/admin/species", get, speciesHandler)
+	admin("/admin/species/rarity", post, rarityHandler)
+	admin("/admin/config", get, configHandler)
+	admin("/admin/diagnostics", get, diagnosticsHandler)
+	admin("/admin/stats", get, adminStatsHandler)
+	admin("/admin/deprecations", get, deprecationsHandler)
+	admin("/admin/export/accounts", get, exportAccountsHandler)
+	admin("/admin/export/proxies", get, exportProxiesHandler)
+	handleUndecorated(mux, route{Path: "/debug/vars", Methods: get}, http.DefaultServeMux)
+	if opmSettings.UnsafeFaultInjection {
+		if !faults.Compiled {
+			log.Println("UnsafeFaultInjection is set, but this binary was built without the faults tag")
+		}
+		admin("/debug/faults", getPost, faultsHandler)
+	}
+	// Limits that depend on the settings
+	registerLimit("cacheRadius", opmSettings.CacheRadius)
+	registerLimit("minCacheRadius", apiSettings.MinCacheRadius)
+	registerLimit("maxCacheRadius", apiSettings.MaxCacheRadius)
+	if opmSettings.RequireAPIKey {
+		registerFeature("apikeys")
+	}
+	return mux, nil
+}
+
 func httpDecorator(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Log start
@@ -63,17 +151,8 @@ func httpDecorator(inner func(http.ResponseWriter, *http.Request)) func(http.Res
 			apiMetrics.BlockedRequestsPerMinute.Incr(1)
 			return
 		}
-		// ACAO
-		if opmSettings.AllowOrigin == "*" {
-			w.Header().Add("Access-Control-Allow-Origin", opmSettings.AllowOrigin)
-		} else {
-			origin := r.Header.Get("Origin")
-			if origin != "" {
-				if strings.HasSuffix(origin, opmSettings.AllowOrigin) {
-					w.Header().Add("Access-Control-Allow-Origin", origin)
-				}
-			}
-		}
+		// ACAO, also for the responses that are not written by the responder
+		responder.ApplyCORS(w, r)
 
 		// Actually handle request
 		inner(w, r)
@@ -81,7 +160,19 @@ func httpDecorator(inner func(http.ResponseWriter, *http.Request)) func(http.Res
 		// Metrics
 		dt := time.Since(start)
 		// Log it
-		log.Printf("%-6s %-10s %-15s %s", r.Method, r.URL.Path, dt, remoteAddr)
+		log.Printf("%-6s %-10s %-15s %s", r.Method, r.URL.Path, dt, util.AnonymizeIP(remoteAddr, opmSettings.LogIPs, opmSettings.Secret))
+	}
+}
+
+// allowOrigin sets the ACAO header for the origins allowed by the settings
+func allowOrigin(h http.Header, r *http.Request) {
+	if opmSettings.AllowOrigin == "*" {
+		h.Set("Access-Control-Allow-Origin", opmSettings.AllowOrigin)
+		return
+	}
+	origin := r.Header.Get("Origin")
+	if origin != "" && strings.HasSuffix(origin, opmSettings.AllowOrigin) {
+		h.Set("Access-Control-Allow-Origin", origin)
 	}
 }
 
@@ -93,6 +184,37 @@ func createScanProxy() (http.Handler, error) {
 	return httputil.NewSingleHostReverseProxy(targetURL), nil
 }
 
+// maxScanBody is the largest /scan request body that is buffered for the cache invalidation
+const maxScanBody = 64 << 10
+
+// scanVisibility is the radius in meters in which a scan finds objects, the default ScanRadius of the scanner
+const scanVisibility = 70
+
+// invalidateScanned drops the cached results around a scanned point after the scan, so
+// the new objects show up with the next /cache request
+func invalidateScanned(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The body is proxied to the scanner, so it is parsed from a copy
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxScanBody))
+		r.Body.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		inner(w, r)
+		values, _ := url.ParseQuery(string(body))
+		for k, v := range r.URL.Query() {
+			values[k] = append(values[k], v...)
+		}
+		lat, errLat := strconv.ParseFloat(values.Get("lat"), 64)
+		lng, errLng := strconv.ParseFloat(values.Get("lng"), 64)
+		if errLat == nil && errLng == nil {
+			mapCache.Invalidate(lat, lng, scanVisibility)
+		}
+	}
+}
+
 func submitHandler(w http.ResponseWriter, r *http.Request) {
 	// Helper function for sending http.StatusBadRequest back
 	badRequest := func() { w.WriteHeader(http.StatusBadRequest) }
@@ -106,14 +228,18 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check API key
 	key, err := database.GetAPIKey(keyString)
+	if errors.Is(err, db.ErrNotFound) {
+		responder.WriteWith(w, r, http.StatusBadRequest, "Key not found\n", util.TextSerializer{})
+		return
+	}
 	if err != nil {
-		badRequest()
-		fmt.Fprintln(w, "Key not found")
+		log.Println(err)
+		util.RetryAfter(w, util.RetrySignal{Reason: opm.RetryReasonUnavailable, Wait: util.UnavailableRetry})
+		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 	if !key.Enabled {
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprintln(w, "Key disabled")
+		responder.WriteWith(w, r, http.StatusForbidden, "Key disabled\n", util.TextSerializer{})
 		return
 	}
 	// Metrics
@@ -132,6 +258,10 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 	// Time validation
 	err = validateMapObject(object, key)
 	if err != nil {
+		qErr := database.Quarantine(object, err, object.Source)
+		if qErr != nil {
+			log.Println(qErr)
+		}
 		if err == opm.ErrPokemonExpired {
 			keyMetrics[key.PublicKey].ExpiredCounter.Incr(1)
 			badRequest()
@@ -143,31 +273,47 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	// Suppressed species (events)
+	if database.Suppress(object) {
+		responder.WriteWith(w, r, http.StatusOK, "<3\n", util.TextSerializer{})
+		return
+	}
 	// Add to database
 	keyMetrics[key.PublicKey].PokemonCounter.Incr(1)
 	log.Printf("Adding Pokemon %d from %s (%f,%f)\n", object.PokemonID, key.Name, object.Lat, object.Lng)
-	database.AddMapObject(object)
+	err = store.AddMapObject(object)
+	if err != nil && !errors.Is(err, db.ErrDuplicate) {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	mapCache.Invalidate(object.Lat, object.Lng, 0)
 	// Write response
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "<3")
+	responder.WriteWith(w, r, http.StatusOK, "<3\n", util.TextSerializer{})
 }
 
-func cacheHandler(w http.ResponseWriter, r *http.Request) {
+func cacheHandler(rw http.ResponseWriter, r *http.Request) {
+	// Usage per frontend
+	w := &countingWriter{ResponseWriter: rw}
+	defer func() { originUsage.Record(requestOrigin(r), w.bytes) }()
 	var objects []opm.MapObject
 	// Check method
 	if r.Method != "POST" {
-		writeCacheResponse(w, false, opm.ErrWrongMethod.Error(), objects)
+		writeCacheResponse(w, r, false, opm.ErrWrongMethod.Error(), objects)
 		return
 	}
-	// Get Latitude and Longitude
-	lat, err := strconv.ParseFloat(r.FormValue("lat"), 64)
-	if err != nil {
-		writeCacheResponse(w, false, "Wrong format", objects)
+	// Output format
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "geojson" && format != "pb" {
+		apiMetrics.CacheRequestFailsPerMinute.Incr(1)
+		responder.Write(w, r, http.StatusBadRequest, map[string]string{"error": opm.ErrUnknownFormat.Error()})
 		return
 	}
-	lng, err := strconv.ParseFloat(r.FormValue("lng"), 64)
+	// Get Latitude and Longitude
+	lat, lng, err := util.ParseLatLng(r)
 	if err != nil {
-		writeCacheResponse(w, false, "Wrong format", objects)
+		apiMetrics.CacheRequestFailsPerMinute.Incr(1)
+		responder.Write(w, r, http.StatusBadRequest, opm.APIResponse{Ok: false, Error: err.Error(), MapObjects: objects})
 		return
 	}
 	// Pokemon/Gym/Pokestop filter
@@ -185,14 +331,160 @@ func cacheHandler(w http.ResponseWriter, r *http.Request) {
 	if len(filter) == 0 {
 		filter = []int{opm.POKEMON, opm.POKESTOP, opm.GYM}
 	}
+	// Historical query
+	var at int64
+	if r.FormValue("at") != "" {
+		at, err = strconv.ParseInt(r.FormValue("at"), 10, 64)
+		if err != nil || at > time.Now().Unix() {
+			writeCacheResponse(w, r, false, "Wrong format", objects)
+			return
+		}
+		if at < time.Now().Add(-time.Duration(apiSettings.MaxHistoryHours)*time.Hour).Unix() {
+			writeCacheResponse(w, r, false, opm.ErrHistoryTooOld.Error(), objects)
+			return
+		}
+		// Historical queries are more expensive and have their own limit
+		if historyQueries.Rate() >= int64(apiSettings.HistoryQueriesPerMinute) {
+			apiMetrics.CacheRequestFailsPerMinute.Incr(1)
+			// The counter is a sliding minute, a query drops out about every minute/limit
+			wait := time.Minute / time.Duration(apiSettings.HistoryQueriesPerMinute+1)
+			hint := util.RetryAfter(w, util.RetrySignal{Reason: opm.RetryReasonRateLimit, Wait: wait})
+			responder.Write(w, r, http.StatusTooManyRequests, opm.APIResponse{Error: opm.ErrHistoryRateLimited.Error(), RetryAfter: hint})
+			return
+		}
+		historyQueries.Incr(1)
+	}
 	// Get objects from db
-	objects, err = database.GetMapObjects(lat, lng, filter, opmSettings.CacheRadius)
+	radius := cacheRadius(r.FormValue("radius"))
+	if format != "geojson" && streamed(r, radius, at) {
+		streamCacheResponse(w, r, database.GetMapObjectsIter(lat, lng, filter, radius), cacheFilter(r))
+		return
+	}
+	if at != 0 {
+		objects, err = database.GetMapObjectsAt(lat, lng, radius, at)
+		w.Header().Add("X-Historical-At", strconv.FormatInt(at, 10))
+	} else {
+		objects, err = mapCache.GetMapObjects(lat, lng, filter, radius, store.GetMapObjects)
+	}
 	if err != nil {
-		writeCacheResponse(w, false, "Failed to get MapObjects from DB", objects)
+		writeCacheResponse(w, r, false, "Failed to get MapObjects from DB", objects)
 		log.Println(err)
 		return
 	}
-	writeCacheResponse(w, true, "", objects)
+	// Delayed species for this caller
+	if visibility.Active() {
+		objects = visibility.Filter(objects, callerClass(r), opm.Now())
+	}
+	// Only objects with IV data
+	if r.FormValue("iv") == "1" {
+		objects = withIVs(objects)
+	}
+	// Local time at the forts
+	if r.FormValue("localtime") == "1" {
+		objects = util.WithLocalTime(objects, time.Now())
+	}
+	if format == "geojson" {
+		fc := opm.NewFeatureCollection(objects)
+		if at != 0 {
+			fc.Properties = &opm.CollectionProperties{HistoricalAt: at}
+		}
+		responder.WriteWith(w, r, http.StatusOK, fc, util.JSONSerializer{Type: "application/geo+json"})
+		return
+	}
+	if at != 0 {
+		responder.Write(w, r, http.StatusOK, opm.APIResponse{Ok: true, MapObjects: objects, HistoricalAt: at})
+		return
+	}
+	writeCacheResponse(w, r, true, "", objects)
+}
+
+// cacheRadius returns the radius parameter clamped to the configured limits. Missing or
+// invalid values get the default radius.
+func cacheRadius(v string) int {
+	radius, err := strconv.Atoi(v)
+	if err != nil || radius <= 0 {
+		return opmSettings.CacheRadius
+	}
+	if radius < apiSettings.MinCacheRadius {
+		return apiSettings.MinCacheRadius
+	}
+	if radius > apiSettings.MaxCacheRadius {
+		return apiSettings.MaxCacheRadius
+	}
+	return radius
+}
+
+// withIVs returns the objects that have IV data
+func withIVs(objects []opm.MapObject) []opm.MapObject {
+	filtered := make([]opm.MapObject, 0, len(objects))
+	for _, o := range objects {
+		if o.IVs != nil {
+			filtered = append(filtered, o)
+		}
+	}
+	return filtered
+}
+
+// maxRecentSightings caps the limit parameter of the recent endpoint
+const maxRecentSightings = 100
+
+func init() {
+	registerFeature("recent")
+	registerLimit("maxRecentSightings", maxRecentSightings)
+	registerFeature("geojson")
+	registerFeature("iv")
+	registerFormats("/cache", "json", "geojson")
+	registerFormats("/recent", "json")
+	registerFeature("gyms")
+	registerFormats("/gym", "json")
+}
+
+func recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, map[string]string{"error": opm.ErrWrongMethod.Error()})
+		return
+	}
+	// Species by id or name
+	pokemonID := opm.ResolvePokemonID(r.FormValue("pid"))
+	if pokemonID == 0 {
+		responder.Write(w, r, http.StatusBadRequest, map[string]string{"error": "Unknown species"})
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if limit > maxRecentSightings {
+		limit = maxRecentSightings
+	}
+	sightings, err := database.GetRecentSightings(pokemonID, limit)
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, map[string]string{"error": "Failed to get sightings from DB"})
+		return
+	}
+	w.Header().Add("Cache-Control", "public, max-age=30")
+	responder.Write(w, r, http.StatusOK, sightings)
+}
+
+// gymHandler returns the details of the gym with the given id
+func gymHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, map[string]string{"error": opm.ErrWrongMethod.Error()})
+		return
+	}
+	gym, err := database.GetObject(r.FormValue("id"))
+	if errors.Is(err, db.ErrNotFound) || err == nil && gym.Type != opm.GYM {
+		responder.Write(w, r, http.StatusNotFound, map[string]string{"error": "Unknown gym"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, map[string]string{"error": "Failed to get gym from DB"})
+		return
+	}
+	w.Header().Add("Cache-Control", "public, max-age=30")
+	responder.Write(w, r, http.StatusOK, gym)
 }
 
 func addBlacklist(w http.ResponseWriter, r *http.Request) {
@@ -202,28 +494,20 @@ func addBlacklist(w http.ResponseWriter, r *http.Request) {
 	}
 	if r.FormValue("addr") != "" {
 		blacklist[r.FormValue("addr")] = true
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, r.FormValue("addr"))
+		responder.WriteWith(w, r, http.StatusOK, r.FormValue("addr")+"\n", util.TextSerializer{})
 	}
 }
 
-func writeCacheResponse(w http.ResponseWriter, ok bool, e string, response []opm.MapObject) {
+func writeCacheResponse(w http.ResponseWriter, r *http.Request, ok bool, e string, response []opm.MapObject) {
 	if !ok {
 		apiMetrics.CacheRequestFailsPerMinute.Incr(1)
 	}
-	writeAPIResopnse(w, ok, e, response)
+	writeAPIResponse(w, r, ok, e, response)
 }
 
-func writeAPIResopnse(w http.ResponseWriter, ok bool, e string, response []opm.MapObject) {
-	w.Header().Add("Content-Type", "application/json")
-
-	if e != "" && e != opm.ErrScanTimeout.Error() && e != opm.ErrBusy.Error() && e != "Wrong format" && e != "Wrong method" && e != "Failed to get MapObjects from DB" {
+func writeAPIResponse(w http.ResponseWriter, r *http.Request, ok bool, e string, response []opm.MapObject) {
+	if e != "" && e != opm.ErrScanTimeout.Error() && e != opm.ErrBusy.Error() && e != "Wrong format" && e != "Wrong method" && e != "Failed to get MapObjects from DB" && e != opm.ErrHistoryTooOld.Error() {
 		e = "Scan failed"
 	}
-
-	r := opm.APIResponse{Ok: ok, Error: e, MapObjects: response}
-	err := json.NewEncoder(w).Encode(r)
-	if err != nil {
-		log.Println(err)
-	}
+	responder.Write(w, r, http.StatusOK, opm.APIResponse{Ok: ok, Error: e, MapObjects: response})
 }
@@ -2,38 +2,180 @@ package main
 
 import (
 	"expvar"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
+	"github.com/paulbellamy/ratecounter"
 	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/db/postgres"
+	"github.com/pogointel/opm/internal/logging"
 	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
 )
 
 var (
 	database    *db.OpenMapDb
+	store       opm.Database // map objects, see opm.Settings.DbBackend
 	opmSettings opm.Settings
 	apiSettings settings
 	keyMetrics  KeyMetrics
 	apiMetrics  APIMetrics
 	blacklist   map[string]bool
+	originUsage *usageCounters
+	mapCache    *hotCache
+	// Rate of historical cache queries
+	historyQueries *ratecounter.RateCounter
+	// Provenance of the settings for /admin/config
+	config configState
+	// Legacy routes
+	legacyRoutes      map[string][]legacyRoute
+	deprecations      *deprecationTracker
+	deprecationHeader string
+	sunsetHeader      string
+	// Delays of rare Pokemon on /cache
+	visibility visibilityPolicy
+	// Writes the responses of the handlers
+	responder = util.NewResponder(util.JSONSerializer{}, util.ProtobufSerializer{})
 )
 
 func main() {
 	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
 	// Settings
 	var err error
-	apiSettings, err = loadSettings()
+	apiSettings, config.apiKeys, err = loadSettings()
 	if err != nil {
 		log.Println(err)
 	}
-	opmSettings, err = opm.LoadSettings("")
+	config.apiLoaded = apiSettings
+	opmSettings, config.opmKeys, err = opm.LoadSettingsWithKeys("")
+	config.opmLoaded = opmSettings
+	adminSecrets := make([]string, 0, len(apiSettings.AdminSecrets))
+	for _, s := range apiSettings.AdminSecrets {
+		adminSecrets = append(adminSecrets, s)
+	}
+	util.RedactLogs(opmSettings, adminSecrets...)
+	if err := logging.SetFormat(opmSettings.LogFormat); err != nil {
+		log.Println(err)
+	}
 	// Db connections
-	database, err = db.NewOpenMapDb(opmSettings.DbName, opmSettings.DbHost, opmSettings.DbUser, opmSettings.DbPassword)
+	database, err = db.NewOpenMapDb(opmSettings.DbName, opmSettings.DbHost, opmSettings.DbUser, opmSettings.DbPassword, db.Options{ReadHost: opmSettings.DbReadHost, ReadTags: opmSettings.DbReadTags})
+	if err != nil {
+		log.Fatal(err)
+	}
+	database.Region = opmSettings.Region
+	database.FixSwappedCoordinates = opmSettings.FixSwappedCoordinates
+	database.SuppressAfterMisses = opmSettings.SuppressAfterMisses
+	database.Leagues = opmSettings.Leagues
+	database.AccountIntake = opmSettings.AccountIntake
+	database.SnapDistance = opmSettings.SnapDistance
+	if opmSettings.TimezoneURL != "" {
+		database.ResolveTimezone = util.NewTimezoneClient(opmSettings.TimezoneURL).Lookup
+	}
+	database.WarnClockSkew(time.Duration(opmSettings.MaxClockSkew) * time.Second)
+	store, err = openStore(database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	database.SetPoolLimit(opmSettings.DbPoolLimit)
+	if opmSettings.MigrateOnStartup {
+		applied, err := database.Migrate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) > 0 {
+			log.Printf("Applied migrations: %s", strings.Join(applied, ", "))
+		}
+	}
+	// Areas replace the Region setting
+	if imported, err := database.ImportRegion(); err != nil {
+		log.Println(err)
+	} else if imported {
+		log.Printf("Imported the Region setting as area %q", opm.RegionAreaID)
+	}
+	// Usage of the cache endpoint per frontend
+	if apiSettings.MaxOrigins <= 0 {
+		apiSettings.MaxOrigins = 50
+	}
+	if apiSettings.UsageLogEvery <= 0 {
+		apiSettings.UsageLogEvery = 60
+	}
+	originUsage = newUsageCounters(apiSettings.MaxOrigins)
+	// Hot cache for /cache
+	if apiSettings.CacheTTL <= 0 {
+		apiSettings.CacheTTL = 10
+	}
+	if apiSettings.CacheEntries <= 0 {
+		apiSettings.CacheEntries = 1000
+	}
+	mapCache = newHotCache(time.Duration(apiSettings.CacheTTL)*time.Second, apiSettings.CacheEntries)
+	expvar.Publish("cache_hot", mapCache)
+	go logUsageSummary("Cache", originUsage, time.Duration(apiSettings.UsageLogEvery)*time.Minute, 10)
+	// Cache radius
+	if apiSettings.MinCacheRadius <= 0 {
+		apiSettings.MinCacheRadius = 50
+	}
+	if apiSettings.MaxCacheRadius <= 0 {
+		apiSettings.MaxCacheRadius = opmSettings.CacheRadius
+	}
+	// Historical queries
+	if apiSettings.MaxHistoryHours <= 0 {
+		apiSettings.MaxHistoryHours = 7 * 24
+	}
+	if apiSettings.HistoryQueriesPerMinute <= 0 {
+		apiSettings.HistoryQueriesPerMinute = 30
+	}
+	historyQueries = ratecounter.NewRateCounter(time.Minute)
+	// Diagnostics
+	if apiSettings.MinFreeAccounts <= 0 {
+		apiSettings.MinFreeAccounts = 10
+	}
+	if apiSettings.MinFreeProxies <= 0 {
+		apiSettings.MinFreeProxies = 5
+	}
+	if apiSettings.StatsAlertsURL == "" {
+		apiSettings.StatsAlertsURL = "http://localhost:8324/alerts"
+	}
+	// Legacy routes
+	legacyRoutes = parseLegacyRoutes(apiSettings.LegacyRoutes)
+	deprecations = newDeprecationTracker(apiSettings.MaxOrigins)
+	deprecationHeader, sunsetHeader, err = deprecationHeaders(apiSettings.DeprecatedSince, apiSettings.SunsetDate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	expvar.Publish("deprecations", deprecations)
+	// Species rarities, before the visibility policy refers to them
+	err = opm.SetRarityOverrides(apiSettings.RarityOverrides)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Visibility policy
+	err = visibility.Set(apiSettings.Visibility)
 	if err != nil {
 		log.Fatal(err)
 	}
 	// Expvar
 	keyMetrics = make(map[string]APIKeyMetrics)
 	expvar.Publish("metrics", keyMetrics)
+	responder.CORS = allowOrigin
+	expvar.Publish("responses", responder.Stats)
 	// Start webserver
 	startHTTP()
 }
+
+// openStore returns the configured backend for map objects
+func openStore(mongo *db.OpenMapDb) (opm.Database, error) {
+	switch opmSettings.DbBackend {
+	case "", opm.BackendMongo:
+		return mongo, nil
+	case opm.BackendPostgres:
+		p, err := postgres.New(opmSettings.DbDSN)
+		if err != nil {
+			return nil, err
+		}
+		p.Leagues = opmSettings.Leagues
+		return p, nil
+	}
+	return nil, fmt.Errorf("Unknown database backend %q", opmSettings.DbBackend)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// mapPage is a minimal map for checking a new deployment. It uses /cache and /scan.
+//
+//go:embed map.html
+var mapPage []byte
+
+func mapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/map" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Write(mapPage)
+}
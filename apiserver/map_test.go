@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// withDemoMap serves the demo map with /cache from a fake store with the objects and
+// /scan from a fake scanner, and returns the mux
+func withDemoMap(t *testing.T, scanner http.HandlerFunc, objects ...opm.MapObject) *http.ServeMux {
+	withCacheStore(t, objects...)
+	withTestServer(t)
+	s := httptest.NewServer(scanner)
+	t.Cleanup(s.Close)
+	host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	opmSettings.ScannerListenAddress = host
+	opmSettings.ScannerListenPort, _ = strconv.Atoi(port)
+	apiSettings.DemoMap = true
+	mux, err := newMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+// mapRequest sends a request the way the page does, a form with lat, lng and key
+func mapRequest(mux *http.ServeMux, path string) map[string]interface{} {
+	body := url.Values{"lat": {"52.5"}, "lng": {"13.4"}, "key": {"default"}}
+	r := httptest.NewRequest("POST", path, strings.NewReader(body.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestDemoMapIsOptional(t *testing.T) {
+	mux := withTestServer(t)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/map", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("/map without DemoMap = %d, want 404", w.Code)
+	}
+}
+
+func TestDemoMapPage(t *testing.T) {
+	mux := withDemoMap(t, func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/map", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("/map = %d %q, want the page", w.Code, w.Header().Get("Content-Type"))
+	}
+	page := w.Body.String()
+	for _, s := range []string{`post("/cache"`, `post("/scan"`, `integrity="sha`, "<script>"} {
+		if !strings.Contains(page, s) {
+			t.Errorf("page is missing %s", s)
+		}
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/map/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("/map/other = %d, want 404", w.Code)
+	}
+}
+
+func TestDemoMapAPICalls(t *testing.T) {
+	expiry := time.Now().Add(10 * time.Minute).Unix()
+	var scanned url.Values
+	mux := withDemoMap(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		scanned = r.PostForm
+		json.NewEncoder(w).Encode(opm.APIResponse{Ok: true, MapObjects: []opm.MapObject{{Type: opm.POKEMON, ID: "p2", PokemonID: 19, Lat: 52.5, Lng: 13.4, Expiry: expiry}}})
+	}, opm.MapObject{Type: opm.POKEMON, ID: "p1", PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: expiry})
+
+	// The fields the page reads from the responses
+	check := func(path string, resp map[string]interface{}, id string) {
+		objects, _ := resp["MapObjects"].([]interface{})
+		if resp["Ok"] != true || len(objects) != 1 {
+			t.Fatalf("%s = %v, want Ok with one object", path, resp)
+		}
+		o := objects[0].(map[string]interface{})
+		for _, field := range []string{"id", "type", "pokemonID", "lat", "lng", "expiry"} {
+			if _, ok := o[field]; !ok {
+				t.Errorf("%s object %v has no %s", path, o, field)
+			}
+		}
+		if o["id"] != id {
+			t.Errorf("%s object = %v, want %s", path, o, id)
+		}
+	}
+	check("/cache", mapRequest(mux, "/cache"), "p1")
+	check("/scan", mapRequest(mux, "/scan"), "p2")
+	if scanned.Get("lat") != "52.5" || scanned.Get("lng") != "13.4" || scanned.Get("key") != "default" {
+		t.Errorf("scanner received %v, want the point and the key", scanned)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pogointel/opm/util"
+)
+
+func TestRequestLogWithoutRawIPs(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	oldLogIPs, oldSecret := opmSettings.LogIPs, opmSettings.Secret
+	t.Cleanup(func() { opmSettings.LogIPs, opmSettings.Secret = oldLogIPs, oldSecret })
+	opmSettings.Secret = "s3cret"
+	handler := httpDecorator(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(cfIP string) {
+		r := httptest.NewRequest("GET", "/recent", nil)
+		r.RemoteAddr = "198.51.100.23:40000"
+		if cfIP != "" {
+			r.Header.Set("CF-Connecting-IP", cfIP)
+		}
+		handler(httptest.NewRecorder(), r)
+	}
+	for _, mode := range []string{util.IPHash, util.IPTruncate} {
+		logs.Reset()
+		opmSettings.LogIPs = mode
+		request("")
+		request("203.0.113.77")
+		for _, raw := range []string{"198.51.100.23", "203.0.113.77"} {
+			if strings.Contains(logs.String(), raw) {
+				t.Errorf("%s: the log contains %s:\n%s", mode, raw, logs.String())
+			}
+		}
+		if strings.Count(logs.String(), "/recent") != 2 {
+			t.Errorf("%s: log = %q, want a line per request", mode, logs.String())
+		}
+	}
+	logs.Reset()
+	opmSettings.LogIPs = util.IPHash
+	request("203.0.113.77")
+	if !strings.Contains(logs.String(), util.AnonymizeIP("203.0.113.77", util.IPHash, "s3cret")) {
+		t.Errorf("log = %q, want the hash of the client", logs.String())
+	}
+}
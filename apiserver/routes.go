@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Auth classes of routes
+const (
+	authNone   = "none"
+	authAPIKey = "apikey" // API key of the client
+	authAdmin  = "admin"  // admin secret, see adminLabel
+)
+
+// Rate limit classes of routes
+const (
+	rateNone = "none"
+	rateKey  = "key" // per API key, see KeyRequestsPerMinute
+)
+
+// route describes an endpoint for the route listing
+type route struct {
+	Path              string   `json:"path"`
+	Methods           []string `json:"methods"`
+	Auth              string   `json:"auth"`
+	RateLimit         string   `json:"rateLimit"`
+	Deprecated        bool     `json:"deprecated"`
+	DeprecatedFormats []string `json:"deprecatedFormats,omitempty"`
+}
+
+// routeRegistry collects the routes mounted by startHTTP
+var routeRegistry = struct {
+	sync.Mutex
+	routes []route
+}{}
+
+// handle mounts the handler with httpDecorator and deprecated and registers the route.
+// The mux panics on duplicate paths, so every path is registered once.
+func handle(mux *http.ServeMux, rt route, h func(http.ResponseWriter, *http.Request)) {
+	handleUndecorated(mux, rt, http.HandlerFunc(httpDecorator(deprecated(rt.Path, h))))
+}
+
+// handleUndecorated mounts the handler as it is and registers the route
+func handleUndecorated(mux *http.ServeMux, rt route, h http.Handler) {
+	mux.Handle(rt.Path, h)
+	if rt.Auth == "" {
+		rt.Auth = authNone
+	}
+	if rt.RateLimit == "" {
+		rt.RateLimit = rateNone
+	}
+	for _, l := range legacyRoutes[rt.Path] {
+		if l.Format == "" {
+			rt.Deprecated = true
+		} else {
+			rt.DeprecatedFormats = append(rt.DeprecatedFormats, l.Format)
+		}
+	}
+	routeRegistry.Lock()
+	defer routeRegistry.Unlock()
+	routeRegistry.routes = append(routeRegistry.routes, rt)
+}
+
+// registeredRoutes returns the registered routes sorted by path
+func registeredRoutes() []route {
+	routeRegistry.Lock()
+	defer routeRegistry.Unlock()
+	routes := append([]route(nil), routeRegistry.routes...)
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	return routes
+}
+
+// routesHandler lists the routes this build serves
+func routesHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, map[string]string{"error": "Wrong method"})
+		return
+	}
+	responder.Write(w, r, http.StatusOK, registeredRoutes())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withAllRoutes mounts the routes with every optional one enabled
+func withAllRoutes(t *testing.T) *http.ServeMux {
+	withTestServer(t)
+	oldLegacy := legacyRoutes
+	legacyRoutes = map[string][]legacyRoute{
+		"/recent": {{Path: "/recent"}},
+		"/cache":  {{Path: "/cache", Format: "v0"}},
+	}
+	t.Cleanup(func() { legacyRoutes = oldLegacy })
+	apiSettings.DemoMap = true
+	opmSettings.UnsafeFaultInjection = true
+	opmSettings.Secret = "s3cret"
+	routeRegistry.Lock()
+	routeRegistry.routes = nil
+	routeRegistry.Unlock()
+	mux, err := newMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+func TestRegisteredRoutes(t *testing.T) {
+	mux := withAllRoutes(t)
+	routes := registeredRoutes()
+	byPath := make(map[string]route)
+	for _, rt := range routes {
+		if _, ok := byPath[rt.Path]; ok {
+			t.Errorf("%s registered twice", rt.Path)
+		}
+		byPath[rt.Path] = rt
+		// The mux serves the path with the registered handler
+		if _, pattern := mux.Handler(httptest.NewRequest("GET", rt.Path, nil)); pattern != rt.Path {
+			t.Errorf("%s is served by the pattern %q", rt.Path, pattern)
+		}
+		if len(rt.Methods) == 0 || rt.Auth == "" || rt.RateLimit == "" {
+			t.Errorf("route %+v, want methods and classes", rt)
+		}
+	}
+	for _, path := range []string{"/scan", "/cache", "/map", "/routes", "/admin/accounts", "/debug/faults", "/debug/vars"} {
+		if _, ok := byPath[path]; !ok {
+			t.Errorf("%s is not registered", path)
+		}
+	}
+	if rt := byPath["/scan"]; rt.Auth != authAPIKey || rt.RateLimit != rateKey {
+		t.Errorf("/scan = %+v, want the API key limits", rt)
+	}
+	if rt := byPath["/admin/accounts"]; rt.Auth != authAdmin || rt.RateLimit != rateNone {
+		t.Errorf("/admin/accounts = %+v, want admin auth", rt)
+	}
+	if rt := byPath["/recent"]; !rt.Deprecated {
+		t.Errorf("/recent = %+v, want it deprecated", rt)
+	}
+	if rt := byPath["/cache"]; rt.Deprecated || len(rt.DeprecatedFormats) != 1 || rt.DeprecatedFormats[0] != "v0" {
+		t.Errorf("/cache = %+v, want the v0 format deprecated", rt)
+	}
+}
+
+func TestRoutesHandler(t *testing.T) {
+	mux := withAllRoutes(t)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/routes", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("/routes without the secret = %d, want 403", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/routes?secret=s3cret", nil))
+	var listed []route
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("/routes = %d %s", w.Code, w.Body)
+	}
+	routes := registeredRoutes()
+	if len(listed) != len(routes) {
+		t.Fatalf("/routes lists %d routes, want the %d registered", len(listed), len(routes))
+	}
+	for i := range routes {
+		if listed[i].Path != routes[i].Path || listed[i].Auth != routes[i].Auth {
+			t.Errorf("route %d = %+v, want %+v", i, listed[i], routes[i])
+		}
+	}
+	// The capabilities list the same routes without the admin ones
+	c, _ := getCapabilities(t, mux, "")
+	var clients []string
+	for _, rt := range routes {
+		if rt.Auth != authAdmin {
+			clients = append(clients, rt.Path)
+		}
+	}
+	if len(c.Endpoints) != len(clients) {
+		t.Fatalf("endpoints = %v, want %v", c.Endpoints, clients)
+	}
+	for i := range clients {
+		if c.Endpoints[i] != clients[i] {
+			t.Errorf("endpoints = %v, want %v", c.Endpoints, clients)
+			break
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func init() {
+	registerFeature("species")
+}
+
+type speciesResponse struct {
+	Ok        bool           `json:"ok"`
+	Error     string         `json:"error,omitempty"`
+	Species   []opm.Species  `json:"species,omitempty"`
+	Overrides map[int]string `json:"overrides,omitempty"`
+}
+
+// speciesHandler returns the species table with the effective rarities
+func speciesHandler(w http.ResponseWriter, r *http.Request) {
+	if adminLabel(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, speciesResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	responder.Write(w, r, http.StatusOK, speciesResponse{Ok: true, Species: opm.AllSpecies(), Overrides: opm.RarityOverrides()})
+}
+
+// rarityHandler overrides the rarity of a species with the parameters pokemon (id or name)
+// and rarity. An empty rarity restores the one of the table. Overrides are not persisted,
+// the settings file has the overrides at startup.
+func rarityHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, speciesResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	id := opm.ResolvePokemonID(r.FormValue("pokemon"))
+	if id == 0 {
+		responder.Write(w, r, http.StatusBadRequest, speciesResponse{Error: "Unknown species"})
+		return
+	}
+	overrides := opm.RarityOverrides()
+	rarity := r.FormValue("rarity")
+	if rarity == "" {
+		delete(overrides, id)
+	} else {
+		overrides[id] = rarity
+	}
+	err := opm.SetRarityOverrides(overrides)
+	if err != nil {
+		responder.Write(w, r, http.StatusBadRequest, speciesResponse{Error: err.Error()})
+		return
+	}
+	// Tiers of the visibility policy may refer to the rarity
+	if err := visibility.Set(visibility.Tiers()); err != nil {
+		log.Println(err)
+	}
+	s, _ := opm.LookupSpecies(id)
+	log.Printf("%s set the rarity of %s to %s", who, s.Name, s.Rarity)
+	err = database.AddAuditEntry(opm.AuditEntry{
+		Who:    who,
+		Action: "set-rarity",
+		Value:  strconv.Itoa(id) + "=" + s.Rarity,
+		Time:   time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	config.recordChange("species")
+	responder.Write(w, r, http.StatusOK, speciesResponse{Ok: true, Species: []opm.Species{s}})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// maxSuppressionHours is the longest a suppression entry can be active
+const maxSuppressionHours = 14 * 24
+
+func init() {
+	registerFeature("suppressions")
+	registerLimit("maxSuppressionHours", maxSuppressionHours)
+}
+
+type suppressionsResponse struct {
+	Ok                  bool              `json:"ok"`
+	Error               string            `json:"error,omitempty"`
+	Suppressions        []opm.Suppression `json:"suppressions,omitempty"`
+	SuppressedBySpecies map[int]int64     `json:"suppressedBySpecies,omitempty"`
+}
+
+// suppressionsHandler lists the suppression list (GET) or adds an entry (POST) with the
+// parameters pokemon (comma separated ids), hours, keep (1 in n, optional) and reason.
+// The counts are those of submissions to this apiserver, scans are counted in the scanner metrics.
+func suppressionsHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method == "GET" {
+		entries, err := database.GetSuppressions()
+		if err != nil {
+			log.Println(err)
+			responder.Write(w, r, http.StatusInternalServerError, suppressionsResponse{Error: "Failed to get suppressions"})
+			return
+		}
+		responder.Write(w, r, http.StatusOK, suppressionsResponse{Ok: true, Suppressions: entries, SuppressedBySpecies: database.SuppressedCounts()})
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, suppressionsResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	s, err := parseSuppression(r)
+	if err != nil {
+		responder.Write(w, r, http.StatusBadRequest, suppressionsResponse{Error: err.Error()})
+		return
+	}
+	s.CreatedBy = who
+	s, err = database.AddSuppression(s)
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, suppressionsResponse{Error: "Failed to add suppression"})
+		return
+	}
+	log.Printf("%s suppressed %v until %s (keep 1 in %d): %s", who, s.PokemonIDs, time.Unix(s.Expires, 0).Format(time.RFC3339), s.KeepOneIn, s.Reason)
+	auditAction(who, "add-suppression", r.Form.Encode())
+	config.recordChange("suppressions")
+	responder.Write(w, r, http.StatusOK, suppressionsResponse{Ok: true, Suppressions: []opm.Suppression{s}})
+}
+
+// removeSuppressionHandler removes the entry with the given id before it expires
+func removeSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, suppressionsResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	id := r.FormValue("id")
+	err := database.RemoveSuppression(id)
+	if errors.Is(err, db.ErrNotFound) {
+		responder.Write(w, r, http.StatusNotFound, suppressionsResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		responder.Write(w, r, http.StatusInternalServerError, suppressionsResponse{Error: "Failed to remove suppression"})
+		return
+	}
+	log.Printf("%s removed suppression %s", who, id)
+	auditAction(who, "remove-suppression", id)
+	config.recordChange("suppressions")
+	responder.Write(w, r, http.StatusOK, suppressionsResponse{Ok: true})
+}
+
+func parseSuppression(r *http.Request) (opm.Suppression, error) {
+	var s opm.Suppression
+	for _, v := range strings.Split(r.FormValue("pokemon"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || !opm.ValidPokemonID(id) {
+			return s, errors.New("Invalid pokemon ids")
+		}
+		s.PokemonIDs = append(s.PokemonIDs, id)
+	}
+	// Every entry expires, so a forgotten suppression ends by itself
+	hours, err := strconv.Atoi(r.FormValue("hours"))
+	if err != nil || hours <= 0 || hours > maxSuppressionHours {
+		return s, errors.New("Invalid hours")
+	}
+	s.Expires = time.Now().Add(time.Duration(hours) * time.Hour).Unix()
+	if r.FormValue("keep") != "" {
+		s.KeepOneIn, err = strconv.Atoi(r.FormValue("keep"))
+		if err != nil || s.KeepOneIn < 0 {
+			return s, errors.New("Invalid keep")
+		}
+	}
+	s.Reason = r.FormValue("reason")
+	return s, nil
+}
+
+func auditAction(who, action, value string) {
+	err := database.AddAuditEntry(opm.AuditEntry{
+		Who:    who,
+		Action: action,
+		Value:  value,
+		Time:   time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
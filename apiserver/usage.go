@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageHistory is the longest window that can be queried
+const usageHistory = 24 * time.Hour
+
+// usageOther collects all keys once the maximum number of keys is tracked
+const usageOther = "other"
+
+// usageBucket holds the usage of a single minute
+type usageBucket struct {
+	minute   int64
+	requests int64
+	bytes    int64
+}
+
+// usageSeries is a ring of per-minute buckets covering usageHistory
+type usageSeries struct {
+	buckets []usageBucket
+}
+
+func (s *usageSeries) add(minute, bytes int64) {
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute {
+		*b = usageBucket{minute: minute}
+	}
+	b.requests++
+	b.bytes += bytes
+}
+
+func (s *usageSeries) sum(from, to int64) (int64, int64) {
+	var requests, bytes int64
+	for _, b := range s.buckets {
+		if b.minute > from && b.minute <= to {
+			requests += b.requests
+			bytes += b.bytes
+		}
+	}
+	return requests, bytes
+}
+
+// usageEntry is the usage of a single key within a window
+type usageEntry struct {
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// usageCounters counts requests and bytes served per key over time.
+// The number of keys is bounded, further keys are counted as "other".
+type usageCounters struct {
+	sync.Mutex
+	max    int
+	series map[string]*usageSeries
+}
+
+func newUsageCounters(max int) *usageCounters {
+	return &usageCounters{
+		max:    max,
+		series: make(map[string]*usageSeries),
+	}
+}
+
+// Record adds a request with the given response size to the key
+func (u *usageCounters) Record(key string, bytes int64) {
+	u.Lock()
+	defer u.Unlock()
+	s, ok := u.series[key]
+	if !ok {
+		if len(u.series) >= u.max {
+			key = usageOther
+			s = u.series[key]
+		}
+		if s == nil {
+			s = &usageSeries{buckets: make([]usageBucket, int(usageHistory/time.Minute))}
+			u.series[key] = s
+		}
+	}
+	s.add(time.Now().Unix()/60, bytes)
+}
+
+// Usage returns the usage of all keys within the window, highest request count first
+func (u *usageCounters) Usage(window time.Duration) []usageEntry {
+	if window <= 0 || window > usageHistory {
+		window = usageHistory
+	}
+	now := time.Now().Unix() / 60
+	from := now - int64(window/time.Minute)
+	u.Lock()
+	entries := make([]usageEntry, 0, len(u.series))
+	for k, s := range u.series {
+		requests, bytes := s.sum(from, now)
+		if requests > 0 {
+			entries = append(entries, usageEntry{Key: k, Requests: requests, Bytes: bytes})
+		}
+	}
+	u.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Requests != entries[j].Requests {
+			return entries[i].Requests > entries[j].Requests
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// logUsageSummary periodically logs the top entries of the counters
+func logUsageSummary(name string, u *usageCounters, interval time.Duration, top int) {
+	for range time.Tick(interval) {
+		entries := u.Usage(interval)
+		if len(entries) > top {
+			entries = entries[:top]
+		}
+		for _, e := range entries {
+			log.Printf("%s usage (last %s): %-30s %8d requests %10d bytes", name, interval, e.Key, e.Requests, e.Bytes)
+		}
+	}
+}
+
+// requestOrigin returns the lowercase host of the Origin or Referer header
+func requestOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return "direct"
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Hostname() == "" {
+		return "invalid"
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// countingWriter counts the bytes written to the response
+type countingWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes flushes of streamed responses on
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
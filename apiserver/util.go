@@ -9,6 +9,7 @@ import (
 
 	"github.com/paulbellamy/ratecounter"
 	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
 )
 
 type RingBuffer struct {
@@ -148,25 +149,55 @@ func (m APIKeyMetrics) Eval() APIKeyMetricsRaw {
 
 type settings struct {
 	StaticFilesDir string
-}
-
-func loadSettings() (settings, error) {
+	DemoMap        bool              // serve a minimal map on /map for testing a deployment
+	AdminSecrets   map[string]string // label -> secret for admin endpoints
+	MaxOrigins     int               // number of frontends tracked separately for /cache usage
+	CacheTTL       int               // seconds /cache results are kept in memory
+	CacheEntries   int               // maximum number of /cache results kept in memory
+	UsageLogEvery  int               // interval of the usage summary log in minutes
+	// Radius parameter of /cache in meters, the default is opm.Settings.CacheRadius
+	MinCacheRadius int
+	MaxCacheRadius int
+	// /cache queries with at least this radius are streamed, see streamCacheResponse (0 =
+	// only with stream=1). The number of objects isn't known before the query, the radius
+	// stands in for it.
+	StreamCacheRadius int
+	// Historical /cache queries
+	MaxHistoryHours         int // how far back queries may reach
+	HistoryQueriesPerMinute int // limit for all historical queries
+	// Diagnostics thresholds
+	MinFreeAccounts int    // warn when fewer accounts are free
+	MinFreeProxies  int    // warn when fewer proxies are free
+	StatsAlertsURL  string // alert conditions of the stats service
+	// Deprecation of legacy routes
+	LegacyRoutes    []string // paths or formats ("/submit?format=pgm") that are deprecated
+	DeprecatedSince string   // date for the Deprecation header, RFC 3339 or 2006-01-02 (optional)
+	SunsetDate      string   // date the legacy routes are turned off, for the Sunset header (optional)
+	LegacyWarning   bool     // add a warning field to legacy JSON responses
+	// Delays of Pokemon on /cache per species tier and caller class, changed at runtime via /admin/visibility
+	Visibility []visibilityTier
+	// Rarity tiers that differ from the species table (species id -> rarity), changed at runtime via /admin/species/rarity
+	RarityOverrides map[int]string
+}
+
+// loadSettings returns the settings and the keys set in the settings file
+func loadSettings() (settings, map[string]bool, error) {
 	// Try to find system settings file
 	bytes, err := ioutil.ReadFile("/etc/opm/api.json")
 	if err != nil {
 		// Use local config
 		bytes, err = ioutil.ReadFile("config.json")
 		if err != nil {
-			return settings{}, err
+			return settings{}, nil, err
 		}
 	}
 	// Unmarshal json
 	var s settings
 	err = json.Unmarshal(bytes, &s)
 	if err != nil {
-		return s, err
+		return s, nil, err
 	}
-	return s, err
+	return s, opm.FileKeys(bytes), err
 }
 
 func handleFuncDecorator(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -185,6 +216,6 @@ func handleFuncDecorator(inner func(http.ResponseWriter, *http.Request)) func(ht
 		// Metrics
 		dt := time.Since(start)
 		// Logging
-		log.Printf("%-6s %-10s\t%-15s\t%s", r.Method, r.URL.Path, dt, remoteAddr)
+		log.Printf("%-6s %-10s\t%-15s\t%s", r.Method, r.URL.Path, dt, util.AnonymizeIP(remoteAddr, opmSettings.LogIPs, opmSettings.Secret))
 	}
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// Caller classes of the visibility policy
+const (
+	callerAnonymous = "anonymous"
+	callerKey       = "key"
+	callerTrusted   = "trusted"
+)
+
+// maxVisibilityDelay is the longest delay in minutes. A Pokemon delayed any longer would never be shown.
+const maxVisibilityDelay = int(opm.MaxPokemonLifetime / time.Minute)
+
+func init() {
+	registerFeature("visibility")
+	registerLimit("maxVisibilityDelay", maxVisibilityDelay)
+}
+
+// visibilityTier delays the Pokemon of some species on /cache for the given caller classes.
+// The species are the listed ids plus those of the rarity tier, if set.
+type visibilityTier struct {
+	Name       string         `json:"name"`
+	PokemonIDs []int          `json:"pokemonIDs"`
+	Rarity     string         `json:"rarity,omitempty"`
+	Delays     map[string]int `json:"delays"` // caller class -> minutes
+}
+
+// visibilityPolicy hides Pokemon from /cache until they have been known for the delay of
+// their tier. It is applied when reading only, storage and admin views see everything.
+type visibilityPolicy struct {
+	sync.RWMutex
+	tiers  []visibilityTier
+	delays map[string]map[int]int64 // caller class -> species -> seconds
+}
+
+type visibilityResponse struct {
+	Ok    bool             `json:"ok"`
+	Error string           `json:"error,omitempty"`
+	Tiers []visibilityTier `json:"tiers"`
+}
+
+// Set validates the tiers and replaces the policy. A species in several tiers gets the longest delay.
+// Rarity tiers are resolved here, so Set has to be called again when the rarities change.
+func (p *visibilityPolicy) Set(tiers []visibilityTier) error {
+	delays := make(map[string]map[int]int64)
+	for _, t := range tiers {
+		if err := opm.ValidatePokemonIDs(t.PokemonIDs); err != nil {
+			return fmt.Errorf("%s in tier %q", err, t.Name)
+		}
+		ids := t.PokemonIDs
+		if t.Rarity != "" {
+			if !opm.ValidRarity(t.Rarity) {
+				return fmt.Errorf("Unknown rarity %q in tier %q", t.Rarity, t.Name)
+			}
+			ids = append(opm.SpeciesWithRarity(t.Rarity), ids...)
+		}
+		for class, minutes := range t.Delays {
+			if class != callerAnonymous && class != callerKey && class != callerTrusted {
+				return fmt.Errorf("Unknown caller class %q in tier %q", class, t.Name)
+			}
+			if minutes < 0 || minutes > maxVisibilityDelay {
+				return fmt.Errorf("Invalid delay %d in tier %q", minutes, t.Name)
+			}
+			if minutes == 0 {
+				continue
+			}
+			if delays[class] == nil {
+				delays[class] = make(map[int]int64)
+			}
+			for _, id := range ids {
+				if d := int64(minutes) * 60; d > delays[class][id] {
+					delays[class][id] = d
+				}
+			}
+		}
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.tiers = tiers
+	p.delays = delays
+	return nil
+}
+
+// Tiers returns the current policy
+func (p *visibilityPolicy) Tiers() []visibilityTier {
+	p.RLock()
+	defer p.RUnlock()
+	return p.tiers
+}
+
+// Active reports whether any caller class has a delay
+func (p *visibilityPolicy) Active() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.delays) > 0
+}
+
+// Filter returns the objects the caller class may see at now. Objects without a first
+// sighting time predate the policy and are shown.
+func (p *visibilityPolicy) Filter(objects []opm.MapObject, class string, now time.Time) []opm.MapObject {
+	hidden := p.Hidden(class, now)
+	if hidden == nil {
+		return objects
+	}
+	filtered := make([]opm.MapObject, 0, len(objects))
+	for _, o := range objects {
+		if !hidden(o) {
+			filtered = append(filtered, o)
+		}
+	}
+	return filtered
+}
+
+// Hidden returns the test for the objects the caller class may not see yet at now, for
+// filtering one object at a time. It is nil if the class has no delays.
+func (p *visibilityPolicy) Hidden(class string, now time.Time) func(o opm.MapObject) bool {
+	p.RLock()
+	delays := p.delays[class]
+	p.RUnlock()
+	if len(delays) == 0 {
+		return nil
+	}
+	return func(o opm.MapObject) bool {
+		return o.Type == opm.POKEMON && o.SeenAt != 0 && now.Unix()-o.SeenAt < delays[o.PokemonID]
+	}
+}
+
+// callerClass returns the caller class of a request by its API key. Unknown and disabled
+// keys are anonymous.
+func callerClass(r *http.Request) string {
+	k := util.RequestKey(r)
+	if k == "" {
+		return callerAnonymous
+	}
+	key, err := lookupAPIKey(k)
+	if err != nil {
+		if err != opm.ErrInvalidAPIKey {
+			log.Println(err)
+		}
+		return callerAnonymous
+	}
+	if !key.Enabled {
+		return callerAnonymous
+	}
+	if key.Trusted {
+		return callerTrusted
+	}
+	return callerKey
+}
+
+// visibilityHandler returns (GET) or replaces (POST with a JSON body {"tiers": [...]}) the
+// visibility policy. Changes are not persisted, the settings file has the policy at startup.
+func visibilityHandler(w http.ResponseWriter, r *http.Request) {
+	who := adminLabel(r)
+	if who == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method == "GET" {
+		responder.Write(w, r, http.StatusOK, visibilityResponse{Ok: true, Tiers: visibility.Tiers()})
+		return
+	}
+	if r.Method != "POST" {
+		responder.Write(w, r, http.StatusMethodNotAllowed, visibilityResponse{Error: opm.ErrWrongMethod.Error()})
+		return
+	}
+	var request visibilityResponse
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request)
+	if err != nil {
+		responder.Write(w, r, http.StatusBadRequest, visibilityResponse{Error: "Invalid JSON"})
+		return
+	}
+	err = visibility.Set(request.Tiers)
+	if err != nil {
+		responder.Write(w, r, http.StatusBadRequest, visibilityResponse{Error: err.Error()})
+		return
+	}
+	value, _ := json.Marshal(request.Tiers)
+	log.Printf("%s changed the visibility policy: %s", who, value)
+	err = addAuditEntry(opm.AuditEntry{
+		Who:    who,
+		Action: "set-visibility",
+		Value:  string(value),
+		Count:  len(request.Tiers),
+		Time:   time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	config.recordChange("visibility")
+	responder.Write(w, r, http.StatusOK, visibilityResponse{Ok: true, Tiers: visibility.Tiers()})
+}
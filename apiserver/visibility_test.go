@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// withVisibility sets the policy and a key lookup with a trusted key
+func withVisibility(t *testing.T, tiers ...visibilityTier) {
+	oldLookup, oldTiers, oldAudit := lookupAPIKey, visibility.Tiers(), addAuditEntry
+	lookupAPIKey = func(k string) (opm.APIKey, error) {
+		if k == "trusted" {
+			return opm.APIKey{PrivateKey: k, Enabled: true, Trusted: true}, nil
+		}
+		if key, ok := testKeys[k]; ok {
+			return key, nil
+		}
+		return opm.APIKey{}, opm.ErrInvalidAPIKey
+	}
+	addAuditEntry = func(e opm.AuditEntry) error { return nil }
+	if err := visibility.Set(tiers); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		lookupAPIKey, addAuditEntry = oldLookup, oldAudit
+		visibility.Set(oldTiers)
+	})
+}
+
+// visibleIDs returns the ids of the objects /cache returns for the key
+func visibleIDs(t *testing.T, key string) map[string]bool {
+	t.Helper()
+	values := url.Values{"lat": {"52.5"}, "lng": {"13.4"}}
+	if key != "" {
+		values.Set("key", key)
+	}
+	w := cacheRequest(values)
+	var resp opm.APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Ok {
+		t.Fatalf("/cache = %d %s", w.Code, w.Body)
+	}
+	ids := make(map[string]bool)
+	for _, o := range resp.MapObjects {
+		ids[o.ID] = true
+	}
+	return ids
+}
+
+func TestVisibilityPerCallerClass(t *testing.T) {
+	now := time.Now()
+	seen := func(id string, pokemonID int, ago time.Duration) opm.MapObject {
+		o := opm.MapObject{Type: opm.POKEMON, ID: id, PokemonID: pokemonID, Lat: 52.5, Lng: 13.4, Expiry: now.Add(10 * time.Minute).Unix()}
+		if ago != 0 {
+			o.SeenAt = now.Add(-ago).Unix()
+		}
+		return o
+	}
+	withCacheStore(t,
+		seen("pidgey", 16, 2*time.Minute),
+		seen("new", 149, 2*time.Minute),
+		seen("older", 149, 7*time.Minute),
+		seen("old", 149, 12*time.Minute),
+		// Stored before first sightings were recorded
+		seen("unknown", 149, 0),
+		opm.MapObject{Type: opm.GYM, ID: "gym", Lat: 52.5, Lng: 13.4},
+	)
+	withVisibility(t, visibilityTier{Name: "rare", PokemonIDs: []int{149}, Delays: map[string]int{callerAnonymous: 10, callerKey: 5}})
+
+	want := map[string][]string{
+		"":          {"pidgey", "old", "unknown", "gym"},
+		"disabled":  {"pidgey", "old", "unknown", "gym"},
+		"default":   {"pidgey", "older", "old", "unknown", "gym"},
+		"trusted":   {"pidgey", "new", "older", "old", "unknown", "gym"},
+		"not-a-key": {"pidgey", "old", "unknown", "gym"},
+	}
+	for key, ids := range want {
+		got := visibleIDs(t, key)
+		if len(got) != len(ids) {
+			t.Errorf("key %q sees %v, want %v", key, got, ids)
+			continue
+		}
+		for _, id := range ids {
+			if !got[id] {
+				t.Errorf("key %q sees %v, want %v", key, got, ids)
+				break
+			}
+		}
+	}
+	// The policy only applies when reading
+	if s := store.(*fakeStore); len(s.objects) != 6 {
+		t.Errorf("store has %d objects, want all 6", len(s.objects))
+	}
+}
+
+func TestVisibilityRuntimeChange(t *testing.T) {
+	withCacheStore(t, opm.MapObject{Type: opm.POKEMON, ID: "new", PokemonID: 149, Lat: 52.5, Lng: 13.4, SeenAt: time.Now().Unix()})
+	withVisibility(t)
+	opmSettings.Secret = "s3cret"
+	if !visibleIDs(t, "")["new"] {
+		t.Fatal("Pokemon hidden without a policy")
+	}
+	body := `{"tiers": [{"name": "rare", "pokemonIDs": [149], "delays": {"anonymous": 10}}]}`
+	w := httptest.NewRecorder()
+	visibilityHandler(w, httptest.NewRequest("POST", "/admin/visibility?secret=s3cret", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /admin/visibility = %d %s", w.Code, w.Body)
+	}
+	if visibleIDs(t, "")["new"] || !visibleIDs(t, "trusted")["new"] {
+		t.Error("the new policy doesn't apply to /cache")
+	}
+	w = httptest.NewRecorder()
+	visibilityHandler(w, httptest.NewRequest("POST", "/admin/visibility?secret=s3cret", strings.NewReader(`{"tiers": [{"name": "x", "pokemonIDs": [149], "delays": {"public": 10}}]}`)))
+	if w.Code != http.StatusBadRequest || visibleIDs(t, "")["new"] {
+		t.Errorf("invalid policy = %d %s, want 400 and the old policy kept", w.Code, w.Body)
+	}
+}
+
+func TestVisibilityPolicyValidation(t *testing.T) {
+	var p visibilityPolicy
+	for name, tier := range map[string]visibilityTier{
+		"unknown class":  {Name: "x", PokemonIDs: []int{149}, Delays: map[string]int{"public": 5}},
+		"negative delay": {Name: "x", PokemonIDs: []int{149}, Delays: map[string]int{callerAnonymous: -1}},
+		"too long":       {Name: "x", PokemonIDs: []int{149}, Delays: map[string]int{callerAnonymous: maxVisibilityDelay + 1}},
+		"unknown rarity": {Name: "x", Rarity: "mythic-ish", Delays: map[string]int{callerAnonymous: 5}},
+		"invalid id":     {Name: "x", PokemonIDs: []int{0}, Delays: map[string]int{callerAnonymous: 5}},
+	} {
+		if err := p.Set([]visibilityTier{tier}); err == nil {
+			t.Errorf("%s: Set succeeded", name)
+		}
+	}
+	// A species in several tiers gets the longest delay
+	err := p.Set([]visibilityTier{
+		{Name: "a", PokemonIDs: []int{149}, Delays: map[string]int{callerAnonymous: 5}},
+		{Name: "b", PokemonIDs: []int{149}, Delays: map[string]int{callerAnonymous: 10, callerKey: 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	hidden := p.Hidden(callerAnonymous, now)
+	if o := (opm.MapObject{Type: opm.POKEMON, PokemonID: 149, SeenAt: now.Add(-7 * time.Minute).Unix()}); !hidden(o) {
+		t.Error("Pokemon shown after the shorter delay")
+	}
+	if p.Hidden(callerKey, now) != nil {
+		t.Error("a zero delay delays the class")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/femot/gophermon/encrypt"
 	"github.com/femot/pgoapi-go/api"
 	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/internal/logging"
 	"github.com/pogointel/opm/opm"
 	"github.com/pogointel/opm/util"
 )
@@ -26,6 +27,10 @@ func main() {
 	if err != nil {
 		log.Printf("Error loading settings (%s). Using default settings.\n", err)
 	}
+	util.RedactLogs(opmSettings)
+	if err := logging.SetFormat(opmSettings.LogFormat); err != nil {
+		log.Println(err)
+	}
 	api.ProxyHost = fmt.Sprintf("%s:%d", opmSettings.ProxyListenAddress, opmSettings.ProxyListenPort)
 	// Databse connections
 	database, err = db.NewOpenMapDb(opmSettings.DbName, opmSettings.DbHost, opmSettings.DbUser, opmSettings.DbPassword)
@@ -45,7 +50,7 @@ func main() {
 		}
 		// Check accounts
 		for _, a := range accounts {
-			log.Printf("Checking <%s> now\n", a.Username)
+			log.Printf("Checking <%s> now\n", util.Username(a.Username))
 			checkAccount(a)
 			time.Sleep(30 * time.Second)
 		}
@@ -63,7 +68,11 @@ func checkAccount(account opm.Account) {
 		log.Println(err)
 		return
 	}
-	defer database.ReturnProxy(proxy)
+	defer func() {
+		if err := database.ReturnProxy(proxy); err != nil {
+			log.Println(err)
+		}
+	}()
 	trainer.SetProxy(proxy)
 	// Login
 	err = trainer.Login()
@@ -87,13 +96,15 @@ func checkAccount(account opm.Account) {
 	_, err = trainer.GetPlayerMap()
 	if err != nil && err != api.ErrNewRPCURL {
 		if err == api.ErrBadRequest {
-			log.Printf("Account <%s> banned for sure! (StatusCode 3)", account.Username)
+			log.Printf("Account <%s> banned for sure! (StatusCode 3)", util.Username(account.Username))
 		} else {
-			log.Printf("Account <%s> produced error: %s", account.Username, err.Error())
+			log.Printf("Account <%s> produced error: %s", util.Username(account.Username), err.Error())
 		}
 	} else {
-		log.Printf("Account <%s> probably not banned, or just temp ban. Marking as not banned", account.Username)
-		account.Banned = false
-		database.UpdateAccount(account)
+		log.Printf("Account <%s> probably not banned, or just temp ban. Marking as not banned", util.Username(account.Username))
+		_, err = database.BatchAccountAction([]string{account.Username}, opm.AccountActionUnban, "")
+		if err != nil {
+			log.Println(err)
+		}
 	}
 }
@@ -0,0 +1,155 @@
+// Package client is a Go client for the public API of the apiserver and the map object
+// stream of the scanner. Responses are decoded into the opm types the servers encode, so
+// the client can't drift from the API.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultMaxRetries is the number of times a busy or rate limited request is retried
+const DefaultMaxRetries = 3
+
+// maxRetryWait caps the wait between retries, whatever the server asks for
+const maxRetryWait = time.Minute
+
+// Client sends requests to an apiserver. The zero value is not usable, see New.
+type Client struct {
+	// BaseURL of the apiserver, e.g. https://example.com
+	BaseURL string
+	// StreamURL is the websocket endpoint for Watch. Defaults to /ws on BaseURL, which only
+	// works if the apiserver is behind the same proxy as the scanner.
+	StreamURL string
+	// APIKey is sent as X-Api-Key with every request if set
+	APIKey string
+	// HTTP is the client used for the requests
+	HTTP *http.Client
+	// MaxRetries of busy and rate limited requests, 0 disables retries
+	MaxRetries int
+}
+
+// New returns a client for the apiserver at baseURL
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTP:       &http.Client{Timeout: 2 * time.Minute},
+		MaxRetries: DefaultMaxRetries,
+	}
+}
+
+// Scan scans the location and returns the objects that were found
+func (c *Client) Scan(ctx context.Context, lat, lng float64) (opm.APIResponse, error) {
+	return c.post(ctx, "/scan", latLng(lat, lng))
+}
+
+// CacheQuery selects the objects returned by Cached. Without a type filter all types are
+// returned, a zero Radius uses the default radius of the server.
+type CacheQuery struct {
+	Pokemon, Pokestops, Gyms bool
+	Radius                   int
+	// At is a unix timestamp for historical queries
+	At int64
+	// IVsOnly returns only the objects with IV data
+	IVsOnly bool
+	// LocalTime adds the local time at the forts
+	LocalTime bool
+}
+
+func (q CacheQuery) values(v url.Values) {
+	flag(v, "p", q.Pokemon)
+	flag(v, "s", q.Pokestops)
+	flag(v, "g", q.Gyms)
+	flag(v, "iv", q.IVsOnly)
+	flag(v, "localtime", q.LocalTime)
+	if q.Radius > 0 {
+		v.Set("radius", strconv.Itoa(q.Radius))
+	}
+	if q.At != 0 {
+		v.Set("at", strconv.FormatInt(q.At, 10))
+	}
+}
+
+// Cached returns the stored objects around the location
+func (c *Client) Cached(ctx context.Context, lat, lng float64, q CacheQuery) (opm.APIResponse, error) {
+	v := latLng(lat, lng)
+	q.values(v)
+	return c.post(ctx, "/cache", v)
+}
+
+// post sends the form to path and decodes the response. Busy and rate limited requests
+// are retried after the wait the server asked for.
+func (c *Client) post(ctx context.Context, path string, form url.Values) (opm.APIResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.do(ctx, path, form)
+		apiErr, ok := err.(*Error)
+		if !ok || !apiErr.Retryable() || attempt >= c.MaxRetries {
+			return resp, err
+		}
+		t := time.NewTimer(apiErr.wait())
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return resp, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, path string, form url.Values) (opm.APIResponse, error) {
+	var result opm.APIResponse
+	req, err := http.NewRequest("POST", c.BaseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return result, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("X-Api-Key", c.APIKey)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, err
+	}
+	if json.Unmarshal(body, &result) != nil {
+		// Plain text or empty bodies, e.g. 403 of the auth middleware
+		if resp.StatusCode != http.StatusOK {
+			return result, newError(resp, opm.APIResponse{Error: strings.TrimSpace(string(body))})
+		}
+		return result, fmt.Errorf("client: unexpected response from %s", path)
+	}
+	if resp.StatusCode != http.StatusOK || !result.Ok {
+		return result, newError(resp, result)
+	}
+	return result, nil
+}
+
+func latLng(lat, lng float64) url.Values {
+	v := url.Values{}
+	v.Set("lat", strconv.FormatFloat(lat, 'f', -1, 64))
+	v.Set("lng", strconv.FormatFloat(lng, 'f', -1, 64))
+	return v
+}
+
+func flag(v url.Values, name string, set bool) {
+	if set {
+		v.Set(name, "1")
+	}
+}
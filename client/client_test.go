@@ -0,0 +1,140 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+
+	"golang.org/x/net/context"
+)
+
+// scriptedServer answers the requests with the responses in order and records the forms
+type scriptedServer struct {
+	sync.Mutex
+	responses []func(w http.ResponseWriter)
+	requests  []*http.Request
+}
+
+func (s *scriptedServer) start(t *testing.T) *Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.Lock()
+		n := len(s.requests)
+		s.requests = append(s.requests, r)
+		s.Unlock()
+		if n >= len(s.responses) {
+			t.Errorf("unexpected request %d to %s", n+1, r.URL)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.responses[n](w)
+	}))
+	t.Cleanup(server.Close)
+	return New(server.URL+"/", "k3y")
+}
+
+func reply(status int, resp opm.APIResponse) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func TestCachedRequest(t *testing.T) {
+	s := &scriptedServer{responses: []func(http.ResponseWriter){
+		reply(http.StatusOK, opm.APIResponse{Ok: true, MapObjects: []opm.MapObject{{Type: opm.GYM, ID: "gym", Lat: 52.5, Lng: 13.4, Team: 2}}}),
+	}}
+	c := s.start(t)
+	resp, err := c.Cached(context.Background(), 52.5, 13.4, CacheQuery{Gyms: true, Radius: 300, At: 1500000000, LocalTime: true})
+	if err != nil || len(resp.MapObjects) != 1 || resp.MapObjects[0].Team != 2 {
+		t.Fatalf("Cached = %+v, %v", resp, err)
+	}
+	r := s.requests[0]
+	if r.Method != "POST" || r.URL.Path != "/cache" || r.Header.Get("X-Api-Key") != "k3y" {
+		t.Errorf("request = %s %s with key %q", r.Method, r.URL.Path, r.Header.Get("X-Api-Key"))
+	}
+	want := map[string]string{"lat": "52.5", "lng": "13.4", "g": "1", "radius": "300", "at": "1500000000", "localtime": "1", "p": "", "s": "", "iv": ""}
+	for name, v := range want {
+		if got := r.PostForm.Get(name); got != v {
+			t.Errorf("form %s = %q, want %q", name, got, v)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := &scriptedServer{responses: []func(http.ResponseWriter){
+		reply(http.StatusBadRequest, opm.APIResponse{Error: opm.ErrInvalidCoordinates.Error(), ErrorCode: opm.ErrCodeBadRequest}),
+		// The auth middleware answers with plain text and only the header
+		func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "7")
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		},
+		reply(http.StatusOK, opm.APIResponse{Ok: false, Error: "Scan failed"}),
+		func(w http.ResponseWriter) { w.Write([]byte("<html>")) },
+	}}
+	c := s.start(t)
+	c.MaxRetries = 0
+	_, err := c.Scan(context.Background(), 91, 0)
+	if !HasCode(err, opm.ErrCodeBadRequest) || err.(*Error).Retryable() {
+		t.Errorf("invalid coordinates = %v, want a bad request that isn't retried", err)
+	}
+	_, err = c.Scan(context.Background(), 52.5, 13.4)
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusTooManyRequests || e.Message != "Rate limit exceeded" || e.RetryAfter == nil || e.RetryAfter.Seconds != 7 || !e.Retryable() {
+		t.Errorf("rate limited = %#v, want the status, text and header", err)
+	}
+	if _, err := c.Scan(context.Background(), 52.5, 13.4); err == nil || err.Error() != "opm: 200 Scan failed" {
+		t.Errorf("failed scan = %v, want an error without code", err)
+	}
+	if _, err := c.Scan(context.Background(), 52.5, 13.4); err == nil {
+		t.Error("a body that isn't JSON was accepted")
+	}
+}
+
+func TestRetryAfterHint(t *testing.T) {
+	s := &scriptedServer{responses: []func(http.ResponseWriter){
+		reply(http.StatusServiceUnavailable, opm.APIResponse{Error: "busy", ErrorCode: opm.ErrCodeBusy, RetryAfter: &opm.RetryHint{Seconds: 1, Reason: opm.RetryReasonQueue}}),
+		reply(http.StatusOK, opm.APIResponse{Ok: true}),
+	}}
+	c := s.start(t)
+	start := time.Now()
+	if _, err := c.Scan(context.Background(), 52.5, 13.4); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); len(s.requests) != 2 || d < time.Second {
+		t.Errorf("%d requests in %s, want the retry after the hint", len(s.requests), d)
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	for hint, want := range map[int]time.Duration{0: time.Second, 5: 5 * time.Second, 3600: maxRetryWait} {
+		e := &Error{StatusCode: http.StatusServiceUnavailable, RetryAfter: &opm.RetryHint{Seconds: hint}}
+		if got := e.wait(); got != want {
+			t.Errorf("wait for %d s = %s, want %s", hint, got, want)
+		}
+	}
+	if got := (&Error{}).wait(); got != time.Second {
+		t.Errorf("wait without a hint = %s, want a second", got)
+	}
+}
+
+func TestRetryStopsWithContext(t *testing.T) {
+	busy := reply(http.StatusServiceUnavailable, opm.APIResponse{ErrorCode: opm.ErrCodeBusy, RetryAfter: &opm.RetryHint{Seconds: 30}})
+	s := &scriptedServer{responses: []func(http.ResponseWriter){busy}}
+	c := s.start(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Scan(ctx, 52.5, 13.4); err != context.DeadlineExceeded {
+		t.Errorf("Scan = %v, want the context error", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Scan returned after %s, want it to stop waiting with the context", d)
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// Error is a failed request. Code is one of the opm.ErrCode constants, or empty for
+// errors the server doesn't classify.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Set for busy, paused and rate limited responses
+	RetryAfter *opm.RetryHint
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("opm: %d %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("opm: %s: %s", e.Code, e.Message)
+}
+
+// Retryable reports whether the request can be sent again later
+func (e *Error) Retryable() bool {
+	switch e.Code {
+	case opm.ErrCodeBusy, opm.ErrCodeTimeout, opm.ErrCodeRateLimited:
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// wait returns the time to wait before the request is retried
+func (e *Error) wait() time.Duration {
+	wait := time.Second
+	if e.RetryAfter != nil && e.RetryAfter.Seconds > 0 {
+		wait = time.Duration(e.RetryAfter.Seconds) * time.Second
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+// HasCode reports whether err is an Error with the code
+func HasCode(err error, code string) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
+
+func newError(resp *http.Response, r opm.APIResponse) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Code: r.ErrorCode, Message: r.Error, RetryAfter: r.RetryAfter}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	// Some responses only have the header
+	if e.RetryAfter == nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = &opm.RetryHint{Seconds: s}
+		}
+	}
+	return e
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/pogointel/opm/opm"
+
+	"golang.org/x/net/context"
+)
+
+// WatchQuery selects the objects sent by Watch. Without a type filter all types are sent,
+// a zero Radius subscribes to everywhere.
+type WatchQuery struct {
+	Pokemon, Pokestops, Gyms bool
+	Lat, Lng                 float64
+	Radius                   float64 // meters
+}
+
+func (q WatchQuery) values() url.Values {
+	v := url.Values{}
+	if q.Radius > 0 {
+		v = latLng(q.Lat, q.Lng)
+		v.Set("radius", strconv.FormatFloat(q.Radius, 'f', -1, 64))
+	}
+	flag(v, "p", q.Pokemon)
+	flag(v, "s", q.Pokestops)
+	flag(v, "g", q.Gyms)
+	return v
+}
+
+// Stream receives the map objects saved by the scanner, see Watch
+type Stream struct {
+	conn *websocket.Conn
+}
+
+// Watch subscribes to newly saved map objects. Deleted objects arrive with Deleted set.
+// Cancelling ctx only aborts the connect, call Close to stop the stream.
+func (c *Client) Watch(ctx context.Context, q WatchQuery) (*Stream, error) {
+	u := c.StreamURL
+	if u == "" {
+		u = c.BaseURL + "/ws"
+		u = strings.Replace(strings.Replace(u, "https://", "wss://", 1), "http://", "ws://", 1)
+	}
+	header := http.Header{}
+	if c.APIKey != "" {
+		header.Set("X-Api-Key", c.APIKey)
+	}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u+"?"+q.values().Encode(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, newError(resp, opm.APIResponse{})
+		}
+		return nil, err
+	}
+	// Pings of the scanner are answered by the default handler while Next reads
+	return &Stream{conn: conn}, nil
+}
+
+// Next blocks until the next object arrives. It returns an error once the stream is
+// closed, by Close or because the scanner evicted the client.
+func (s *Stream) Next() (opm.MapObject, error) {
+	var o opm.MapObject
+	err := s.conn.ReadJSON(&o)
+	return o, err
+}
+
+// Close ends the stream
+func (s *Stream) Close() error {
+	return s.conn.Close()
+}
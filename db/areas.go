@@ -0,0 +1,162 @@
+package db
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// areaRefresh is how often the areas used by the coordinate checks are reloaded
+const areaRefresh = 30 * time.Second
+
+// areaCache is the in-process copy of the geofence areas
+type areaCache struct {
+	sync.Mutex
+	geofences      []opm.BoundingBox
+	regionImported bool
+	loaded         time.Time
+}
+
+// AddArea stores a new area and returns it with its id
+func (db *OpenMapDb) AddArea(a opm.Area) (opm.Area, error) {
+	if err := a.Validate(); err != nil {
+		return a, err
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	if a.ID == "" {
+		a.ID = bson.NewObjectId().Hex()
+	}
+	a.Created = time.Now().Unix()
+	a.Updated = a.Created
+	err := session.DB(db.DbName).C(db.Collections.Areas).Insert(a)
+	if err == nil {
+		db.areas.invalidate()
+	}
+	return a, mapErr(err)
+}
+
+// UpdateArea replaces an area. The creation time and creator are kept.
+func (db *OpenMapDb) UpdateArea(a opm.Area) (opm.Area, error) {
+	if err := a.Validate(); err != nil {
+		return a, err
+	}
+	old, err := db.GetArea(a.ID)
+	if err != nil {
+		return a, err
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	a.Created, a.CreatedBy = old.Created, old.CreatedBy
+	a.Updated = time.Now().Unix()
+	err = session.DB(db.DbName).C(db.Collections.Areas).Update(bson.M{"id": a.ID}, a)
+	if err == nil {
+		db.areas.invalidate()
+	}
+	return a, mapErr(err)
+}
+
+// RemoveArea deletes an area
+func (db *OpenMapDb) RemoveArea(id string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	err := session.DB(db.DbName).C(db.Collections.Areas).Remove(bson.M{"id": id})
+	if err == nil {
+		db.areas.invalidate()
+	}
+	return mapErr(err)
+}
+
+// GetArea returns the area with the id
+func (db *OpenMapDb) GetArea(id string) (opm.Area, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var a opm.Area
+	err := session.DB(db.DbName).C(db.Collections.Areas).Find(bson.M{"id": id}).One(&a)
+	return a, mapErr(err)
+}
+
+// GetAreas returns all areas sorted by name
+func (db *OpenMapDb) GetAreas() ([]opm.Area, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	areas := make([]opm.Area, 0)
+	err := session.DB(db.DbName).C(db.Collections.Areas).Find(nil).Sort("name").All(&areas)
+	return areas, mapErr(err)
+}
+
+// ImportRegion stores the Region setting as the geofence area opm.RegionAreaID, unless the
+// area exists already. From then on the area is used instead of the setting, so it can be
+// changed without a restart. It returns true if the area was created.
+func (db *OpenMapDb) ImportRegion() (bool, error) {
+	if !db.Region.IsSet() {
+		return false, nil
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	now := time.Now().Unix()
+	a := opm.Area{
+		ID:        opm.RegionAreaID,
+		Name:      "Region",
+		Bounds:    db.Region,
+		Geofence:  true,
+		CreatedBy: "settings",
+		Created:   now,
+		Updated:   now,
+	}
+	info, err := session.DB(db.DbName).C(db.Collections.Areas).Upsert(bson.M{"id": a.ID}, bson.M{"$setOnInsert": a})
+	if err != nil {
+		return false, mapErr(err)
+	}
+	db.areas.invalidate()
+	return info.UpsertedId != nil, nil
+}
+
+// geofences returns the bounds of the geofence areas. The Region setting counts as one
+// until it is imported, see ImportRegion.
+func (db *OpenMapDb) geofences() []opm.BoundingBox {
+	c := db.areas
+	c.Lock()
+	defer c.Unlock()
+	if now := time.Now(); now.Sub(c.loaded) > areaRefresh {
+		if err := c.load(db); err != nil {
+			// Keep the old areas
+			log.Println(err)
+		}
+		c.loaded = now
+	}
+	if !c.regionImported && db.Region.IsSet() {
+		return append([]opm.BoundingBox{db.Region}, c.geofences...)
+	}
+	return c.geofences
+}
+
+func (c *areaCache) load(db *OpenMapDb) error {
+	session := db.readSession()
+	defer session.Close()
+	var areas []opm.Area
+	err := session.DB(db.DbName).C(db.Collections.Areas).Find(nil).Select(bson.M{"id": 1, "bounds": 1, "geofence": 1}).All(&areas)
+	if err != nil {
+		return mapErr(err)
+	}
+	c.geofences, c.regionImported = nil, false
+	for _, a := range areas {
+		if a.ID == opm.RegionAreaID {
+			c.regionImported = true
+		}
+		if a.Geofence {
+			c.geofences = append(c.geofences, a.Bounds)
+		}
+	}
+	return nil
+}
+
+// invalidate makes the next coordinate check reload the areas
+func (c *areaCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.loaded = time.Time{}
+}
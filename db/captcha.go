@@ -0,0 +1,40 @@
+package db
+
+import (
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FlagCaptcha takes the account out of rotation until its captcha is solved. The account is
+// not banned and not in use anymore, ClearCaptcha makes it available again.
+func (db *OpenMapDb) FlagCaptcha(username, url string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Accounts).Update(bson.M{"username": username}, bson.M{"$set": bson.M{
+		"captchaflagged": true,
+		"captchaurl":     url,
+		"captchaat":      time.Now().Unix(),
+		"used":           false,
+	}}))
+}
+
+// GetCaptchaAccounts returns the accounts that wait for a solved captcha, oldest first
+func (db *OpenMapDb) GetCaptchaAccounts() ([]opm.Account, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var accounts []opm.Account
+	err := session.DB(db.DbName).C(db.Collections.Accounts).Find(bson.M{"captchaflagged": true}).Sort("captchaat").All(&accounts)
+	return accounts, mapErr(err)
+}
+
+// ClearCaptcha puts an account flagged by FlagCaptcha back into rotation. Unknown or
+// unflagged accounts are reported as ErrNotFound.
+func (db *OpenMapDb) ClearCaptcha(username string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Accounts).Update(
+		bson.M{"username": username, "captchaflagged": true},
+		bson.M{"$set": bson.M{"captchaflagged": false}, "$unset": bson.M{"captchaurl": "", "captchaat": ""}}))
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// customCollections prefixes every default collection name
+func customCollections(prefix string) Collections {
+	c := DefaultCollections
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		v.Field(i).SetString(prefix + v.Field(i).String())
+	}
+	return c
+}
+
+func TestCustomNamesAreUsed(t *testing.T) {
+	db := testDB(t, Options{Collections: customCollections("custom_")})
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	before, err := session.DatabaseNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes to the main collections
+	if err := db.AddMapObject(testPokemon("p1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddAccount(opm.Account{Username: "trainer", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddProxy(opm.Proxy{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddAPIKey(opm.APIKey{PrivateKey: "private", PublicKey: "public", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Quarantine(testPokemon("p2"), ErrInvalidCoordinates, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddScan(52.5, 13.4, opm.BoundingBox{}, "trainer", 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// Reads go to the same collections
+	if objects, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 100); err != nil || len(objects) != 1 {
+		t.Errorf("GetMapObjects = %v, %v, want the Pokemon", objects, err)
+	}
+	if _, err := db.GetAPIKey("private"); err != nil {
+		t.Errorf("GetAPIKey = %v", err)
+	}
+
+	names, err := session.DB(db.DbName).CollectionNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") {
+			continue
+		}
+		if !strings.HasPrefix(name, "custom_") {
+			t.Errorf("collection %s has a default name", name)
+		}
+		found[name] = true
+	}
+	for _, name := range []string{"custom_Objects", "custom_Accounts", "custom_Proxy", "custom_Keys", "custom_Quarantine", "custom_Scans"} {
+		if !found[name] {
+			t.Errorf("collection %s missing, found %v", name, names)
+		}
+	}
+	// Nothing was written to another database, like the hardcoded OpenPogoMap
+	after, err := session.DatabaseNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	existed := make(map[string]bool)
+	for _, name := range before {
+		existed[name] = true
+	}
+	for _, name := range after {
+		if !existed[name] && name != db.DbName && !strings.HasPrefix(name, "opm_test_") {
+			t.Errorf("database %s was created", name)
+		}
+	}
+}
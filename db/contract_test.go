@@ -0,0 +1,15 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/internal/dbtest"
+)
+
+func TestContract(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) dbtest.Backend {
+		d := db.TestDB(t)
+		return dbtest.Backend{Database: d, AddAccount: d.AddAccount, AddProxy: d.AddProxy}
+	})
+}
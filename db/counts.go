@@ -0,0 +1,85 @@
+package db
+
+import (
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Circle restricts a query to the objects within Radius meters of a point
+type Circle struct {
+	Lat, Lng float64
+	Radius   int
+}
+
+// match adds the circle to the $match stage of a pipeline, nil matches everywhere
+func (c *Circle) match(q bson.M) bson.M {
+	if c != nil {
+		q["loc"] = bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": []interface{}{[]float64{c.Lng, c.Lat}, geo.Angle(float64(c.Radius))},
+			},
+		}
+	}
+	return q
+}
+
+// CountActiveObjects returns the number of objects of the given types that are on the map
+// right now, within area if it is not nil. Forts never expire, Pokemon count until their expiry.
+func (db *OpenMapDb) CountActiveObjects(types []int, area *Circle) (int, error) {
+	session := db.readSession()
+	defer session.Close()
+	q := area.match(bson.M{
+		"type":    bson.M{"$in": types},
+		"$or":     []bson.M{{"expiry": notExpired(opm.Now())}, {"expiry": 0}},
+		"deleted": notDeleted,
+	})
+	var result struct {
+		Count int `bson:"count"`
+	}
+	pipeline := []bson.M{
+		{"$match": q},
+		{"$group": bson.M{"_id": nil, "count": bson.M{"$sum": 1}}},
+	}
+	err := session.DB(db.DbName).C(db.Collections.Objects).Pipe(pipeline).One(&result)
+	// No documents, no group
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, mapErr(err)
+	}
+	return result.Count, nil
+}
+
+// PokemonCountsBySpecies returns the number of Pokemon per species, within area if it is
+// not nil. With since 0 only the Pokemon on the map right now are counted, otherwise all
+// stored Pokemon seen since the unix time since.
+func (db *OpenMapDb) PokemonCountsBySpecies(since int64, area *Circle) (map[int]int, error) {
+	session := db.readSession()
+	defer session.Close()
+	q := area.match(bson.M{"type": opm.POKEMON, "deleted": notDeleted})
+	if since == 0 {
+		q["expiry"] = notExpired(opm.Now())
+	} else {
+		q["seenat"] = bson.M{"$gte": since}
+	}
+	var groups []struct {
+		ID    int `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	pipeline := []bson.M{
+		{"$match": q},
+		{"$group": bson.M{"_id": "$pokemonid", "count": bson.M{"$sum": 1}}},
+	}
+	err := session.DB(db.DbName).C(db.Collections.Objects).Pipe(pipeline).All(&groups)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	counts := make(map[int]int, len(groups))
+	for _, g := range groups {
+		counts[g.ID] = g.Count
+	}
+	return counts, nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCircleMatch(t *testing.T) {
+	var everywhere *Circle
+	if q := everywhere.match(bson.M{"type": opm.POKEMON}); len(q) != 1 {
+		t.Errorf("nil circle = %v, want the query unchanged", q)
+	}
+	q := (&Circle{Lat: 52.5, Lng: 13.4, Radius: 1000}).match(bson.M{})
+	sphere := q["loc"].(bson.M)["$geoWithin"].(bson.M)["$centerSphere"].([]interface{})
+	if center := sphere[0].([]float64); center[0] != 13.4 || center[1] != 52.5 {
+		t.Errorf("center = %v, want lng, lat", center)
+	}
+	// The radius is in radians of the earth
+	if r := sphere[1].(float64); r < 1.56e-4 || r > 1.58e-4 {
+		t.Errorf("radius = %v, want 1 km in radians", r)
+	}
+}
+
+// seedCounts stores objects in Berlin and one Pokemon in Hamburg, with seenat set to the given
+// times
+func seedCounts(t *testing.T, db *OpenMapDb) {
+	t.Helper()
+	now := time.Now().Unix()
+	seed := []struct {
+		m      opm.MapObject
+		seenAt int64
+	}{
+		{opm.MapObject{Type: opm.POKEMON, ID: "p1", PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: now + 600}, now},
+		{opm.MapObject{Type: opm.POKEMON, ID: "p2", PokemonID: 16, Lat: 52.501, Lng: 13.4, Expiry: now + 600}, now - 60},
+		{opm.MapObject{Type: opm.POKEMON, ID: "p3", PokemonID: 149, Lat: 52.5, Lng: 13.401, Expiry: now + 600}, now},
+		// Expired, only counted by the species counts with since
+		{opm.MapObject{Type: opm.POKEMON, ID: "p4", PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: now - 60}, now - 900},
+		{opm.MapObject{Type: opm.POKEMON, ID: "p5", PokemonID: 10, Lat: 52.5, Lng: 13.4, Expiry: now - 60}, now - 7200},
+		// Deleted objects are never counted
+		{opm.MapObject{Type: opm.POKEMON, ID: "p6", PokemonID: 149, Lat: 52.5, Lng: 13.4, Expiry: now + 600, Deleted: true}, now},
+		{opm.MapObject{Type: opm.POKESTOP, ID: "s1", Lat: 52.5, Lng: 13.402}, now},
+		{opm.MapObject{Type: opm.POKESTOP, ID: "s2", Lat: 52.502, Lng: 13.4, Expiry: now + 1800}, now},
+		{opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 52.5, Lng: 13.403, Team: 1}, now},
+		{opm.MapObject{Type: opm.POKEMON, ID: "hamburg", PokemonID: 16, Lat: 53.55, Lng: 10, Expiry: now + 600}, now},
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	for _, s := range seed {
+		o := newObject(s.m, nil, nil)
+		o.SeenAt, o.Deleted = s.seenAt, s.m.Deleted
+		if err := session.DB(db.DbName).C(db.Collections.Objects).Insert(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCountActiveObjects(t *testing.T) {
+	db := testDB(t)
+	if n, err := db.CountActiveObjects([]int{opm.POKEMON}, nil); n != 0 || err != nil {
+		t.Errorf("count of an empty collection = %d, %v, want 0", n, err)
+	}
+	seedCounts(t, db)
+	berlin := &Circle{Lat: 52.5, Lng: 13.4, Radius: 2000}
+	for _, c := range []struct {
+		types []int
+		area  *Circle
+		want  int
+	}{
+		{[]int{opm.POKEMON}, nil, 4},
+		{[]int{opm.POKEMON}, berlin, 3},
+		{[]int{opm.POKESTOP}, nil, 2},
+		{[]int{opm.GYM}, berlin, 1},
+		{[]int{opm.POKESTOP, opm.GYM}, nil, 3},
+		{[]int{opm.POKEMON}, &Circle{Lat: 0, Lng: 0, Radius: 2000}, 0},
+	} {
+		if n, err := db.CountActiveObjects(c.types, c.area); n != c.want || err != nil {
+			t.Errorf("CountActiveObjects(%v, %+v) = %d, %v, want %d", c.types, c.area, n, err, c.want)
+		}
+	}
+}
+
+func TestPokemonCountsBySpecies(t *testing.T) {
+	db := testDB(t)
+	seedCounts(t, db)
+	now := time.Now().Unix()
+	berlin := &Circle{Lat: 52.5, Lng: 13.4, Radius: 2000}
+	for _, c := range []struct {
+		since int64
+		area  *Circle
+		want  map[int]int
+	}{
+		{0, nil, map[int]int{16: 3, 149: 1}},
+		{0, berlin, map[int]int{16: 2, 149: 1}},
+		// The expired Pokemon seen in the last hour count as well
+		{now - 3600, berlin, map[int]int{16: 3, 149: 1}},
+		{now - 10000, nil, map[int]int{10: 1, 16: 4, 149: 1}},
+		{now + 60, nil, map[int]int{}},
+	} {
+		counts, err := db.PokemonCountsBySpecies(c.since, c.area)
+		if err != nil || !reflect.DeepEqual(counts, c.want) {
+			t.Errorf("PokemonCountsBySpecies(%d, %+v) = %v, %v, want %v", c.since, c.area, counts, err, c.want)
+		}
+	}
+}
@@ -2,23 +2,67 @@ package db
 
 import (
 	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/pogointel/opm/internal/faults"
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/internal/logging"
 	"github.com/pogointel/opm/opm"
+	"golang.org/x/net/context"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 type OpenMapDb struct {
 	mongoSession *mgo.Session
+	read         *readEndpoint // nil = all queries use mongoSession
 	DbName       string
 	DbHost       string
+	Collections  Collections
+	suppressions *suppressionFilter
+	timezones    *timezoneCache
+	areas        *areaCache
+	// Coordinate normalization. Region is imported as an area once, see ImportRegion.
+	Region                opm.BoundingBox
+	FixSwappedCoordinates bool
+	// Pokemon missing in this many rescans are not returned anymore (0 = disabled)
+	SuppressAfterMisses int
+	// Pokemon within this many meters of their spawnpoint get its location (0 = disabled)
+	SnapDistance float64
+	// Pokemon are upserted by id instead of inserted, so known Pokemon cause no duplicate key errors
+	UpsertPokemon bool
+	// Added accounts start in quarantine, see opm.AccountStageQuarantine
+	AccountIntake bool
+	// Leagues whose ranks are stored with the IVs of Pokemon
+	Leagues []opm.League
+	// Accounts below this level are left to GetLevelingAccount (0 = no leveling)
+	MinAccountLevel int
+	// Scans recorded by AddScan are kept this long (0 = 14 days)
+	ScanHistory time.Duration
+	// Returns the IANA timezone of a location. Forts are resolved once when they are first
+	// saved (nil = no timezones).
+	ResolveTimezone func(lat, lng float64) (string, error)
 }
 
 type proxy struct {
 	Id   int64
 	Use  bool
 	Dead bool
+	// Missing in legacy documents
+	URL      string `bson:",omitempty"`
+	Username string `bson:",omitempty"`
+	Password string `bson:",omitempty"`
+	// Last health check (unix time)
+	LastCheck int64 `bson:",omitempty"`
+}
+
+// mapProxy converts a stored proxy to an opm.Proxy
+func (p proxy) mapProxy() opm.Proxy {
+	return opm.Proxy{ID: p.Id, Use: p.Use, Dead: p.Dead, URL: p.URL, Username: p.Username, Password: p.Password, LastCheck: p.LastCheck}
 }
 
 type location struct {
@@ -34,58 +78,265 @@ type object struct {
 	Loc          location
 	Expiry       int64
 	Lured        bool
+	LureType     string
+	LuredBy      string
 	Team         int
 	Source       string
+	SeenAt       int64
+	IVs          *opm.IVs `bson:",omitempty"`
+	// Coordinates as scanned, if Loc was snapped to the spawnpoint
+	RawLoc *location `bson:",omitempty"`
+	CP     int       `bson:",omitempty"`
+	Move1  int       `bson:",omitempty"`
+	Move2  int       `bson:",omitempty"`
+	// Gyms
+	GymPoints      int64 `bson:",omitempty"`
+	GuardPokemonID int   `bson:",omitempty"`
+	GuardPokemonCP int   `bson:",omitempty"`
+	// Negative evidence: rescans of the area that did not return the object
+	Misses   int   `bson:",omitempty"`
+	LastMiss int64 `bson:",omitempty"`
+	// Tombstone, see DeleteMapObjects
+	Deleted   bool  `bson:",omitempty"`
+	DeletedAt int64 `bson:",omitempty"`
+	// IANA timezone of forts, see OpenMapDb.ResolveTimezone
+	Timezone string `bson:",omitempty"`
+	// Capture time in unix milliseconds of the stored observation, see replaceFort
+	LastSeen int64 `bson:",omitempty"`
+}
+
+// mapObject converts a stored object to an opm.MapObject
+func (o object) mapObject() opm.MapObject {
+	m := opm.MapObject{
+		Type:       o.Type,
+		PokemonID:  o.PokemonID,
+		ID:         o.ID,
+		Expiry:     o.Expiry,
+		Lured:      o.Lured,
+		LureType:   o.LureType,
+		LuredBy:    o.LuredBy,
+		Team:       o.Team,
+		IVs:        o.IVs,
+		CP:         o.CP,
+		Move1:      o.Move1,
+		Move2:      o.Move2,
+		Deleted:    o.Deleted,
+		SeenAt:     o.SeenAt,
+		Timezone:   o.Timezone,
+		CapturedAt: o.LastSeen,
+		// Gyms
+		GymPoints:      o.GymPoints,
+		GuardPokemonID: o.GuardPokemonID,
+		GuardPokemonCP: o.GuardPokemonCP,
+	}
+	// Cast coordinates
+	if len(o.Loc.Coordinates) == 2 {
+		m.Lat = o.Loc.Coordinates[1]
+		m.Lng = o.Loc.Coordinates[0]
+	}
+	return m
+}
+
+type sighting struct {
+	PokemonID int
+	ID        string
+	Loc       location
+	Expiry    int64
+	LureType  string
+	LuredBy   string
+	SeenAt    int64
+}
+
+// Collections are the names of the collections used by OpenMapDb
+type Collections struct {
+	Objects      string
+	Sightings    string
+	Accounts     string
+	Proxy        string
+	Keys         string
+	AdminAudit   string
+	Quarantine   string
+	Raw          string
+	Suppressions string
+	Spawnpoints  string
+	Nearby       string
+	Scans        string
+	Schema       string
+	Timezones    string
+	Areas        string
 }
 
-// NewOpenMapDb creates a new connection to
-func NewOpenMapDb(dbName, dbHost, user, password string) (*OpenMapDb, error) {
-	db := &OpenMapDb{DbName: dbName, DbHost: dbHost}
+// DefaultCollections are the default collection names
+var DefaultCollections = Collections{
+	Objects:      "Objects",
+	Sightings:    "Sightings",
+	Accounts:     "Accounts",
+	Proxy:        "Proxy",
+	Keys:         "Keys",
+	AdminAudit:   "AdminAudit",
+	Quarantine:   "Quarantine",
+	Raw:          "Raw",
+	Suppressions: "Suppressions",
+	Spawnpoints:  "Spawnpoints",
+	Nearby:       "Nearby",
+	Scans:        "Scans",
+	Schema:       "Schema",
+	Timezones:    "Timezones",
+	Areas:        "Areas",
+}
+
+// Options are optional settings for NewOpenMapDb
+type Options struct {
+	// Collection names, empty names keep the default
+	Collections Collections
+	// Optional endpoint for map, stats and export reads, e.g. nearby secondaries
+	ReadHost string
+	// Only read from members with these tags (ReadHost)
+	ReadTags map[string]string
+}
+
+// withDefaults fills empty names with the default names
+func (c Collections) withDefaults() Collections {
+	d := DefaultCollections
+	if c.Objects != "" {
+		d.Objects = c.Objects
+	}
+	if c.Sightings != "" {
+		d.Sightings = c.Sightings
+	}
+	if c.Accounts != "" {
+		d.Accounts = c.Accounts
+	}
+	if c.Proxy != "" {
+		d.Proxy = c.Proxy
+	}
+	if c.Keys != "" {
+		d.Keys = c.Keys
+	}
+	if c.AdminAudit != "" {
+		d.AdminAudit = c.AdminAudit
+	}
+	if c.Quarantine != "" {
+		d.Quarantine = c.Quarantine
+	}
+	if c.Raw != "" {
+		d.Raw = c.Raw
+	}
+	if c.Suppressions != "" {
+		d.Suppressions = c.Suppressions
+	}
+	if c.Spawnpoints != "" {
+		d.Spawnpoints = c.Spawnpoints
+	}
+	if c.Nearby != "" {
+		d.Nearby = c.Nearby
+	}
+	if c.Scans != "" {
+		d.Scans = c.Scans
+	}
+	if c.Schema != "" {
+		d.Schema = c.Schema
+	}
+	if c.Timezones != "" {
+		d.Timezones = c.Timezones
+	}
+	if c.Areas != "" {
+		d.Areas = c.Areas
+	}
+	return d
+}
+
+// NewOpenMapDb creates a new connection to the database dbName on dbHost
+func NewOpenMapDb(dbName, dbHost, user, password string, options ...Options) (*OpenMapDb, error) {
+	db := &OpenMapDb{DbName: dbName, DbHost: dbHost, Collections: DefaultCollections, suppressions: newSuppressionFilter(), timezones: newTimezoneCache(), areas: &areaCache{}}
+	if len(options) > 0 {
+		db.Collections = options[0].Collections.withDefaults()
+	}
 	s, err := mgo.Dial(db.DbHost)
 	if err != nil {
-		return db, err
+		return db, mapErr(err)
 	}
 	db.mongoSession = s
 	if user != "" && password != "" {
 		err = db.mongoSession.DB(db.DbName).Login(user, password)
 		if err != nil {
-			return db, err
+			return db, mapErr(err)
 		}
 	}
 	err = db.ensureIndex()
-	return db, err
+	if len(options) > 0 && options[0].ReadHost != "" {
+		db.dialRead(options[0].ReadHost, user, password, options[0].ReadTags)
+	}
+	return db, mapErr(err)
 }
 
-func (db *OpenMapDb) ensureIndex() error {
-	err := db.mongoSession.DB(db.DbName).C("Objects").EnsureIndex(mgo.Index{Key: []string{"$2dsphere:loc"}})
-	if err != nil {
-		return err
-	}
-	err = db.mongoSession.DB(db.DbName).C("Objects").EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true, DropDups: true})
-	if err != nil {
-		return err
-	}
-	err = db.mongoSession.DB(db.DbName).C("Accounts").EnsureIndex(mgo.Index{Key: []string{"username"}, Unique: true, DropDups: true})
-	if err != nil {
-		return err
+var _ opm.Database = (*OpenMapDb)(nil)
+
+type collectionIndex struct {
+	collection string
+	index      mgo.Index
+}
+
+// indexes returns the indexes every collection needs
+func (db *OpenMapDb) indexes() []collectionIndex {
+	c := db.Collections
+	return []collectionIndex{
+		{c.Objects, mgo.Index{Key: []string{"$2dsphere:loc"}}},
+		{c.Objects, mgo.Index{Key: []string{"id"}, Unique: true, DropDups: true}},
+		{c.Objects, mgo.Index{Key: []string{"deletedat"}, Sparse: true}},
+		{c.Sightings, mgo.Index{Key: []string{"id"}, Unique: true, DropDups: true}},
+		{c.Sightings, mgo.Index{Key: []string{"pokemonid", "-seenat"}}},
+		{c.Sightings, mgo.Index{Key: []string{"$2dsphere:loc", "expiry", "seenat"}}},
+		{c.Accounts, mgo.Index{Key: []string{"username"}, Unique: true, DropDups: true}},
+		{c.AdminAudit, mgo.Index{Key: []string{"-time"}}},
+		{c.Quarantine, mgo.Index{Key: []string{"created"}, ExpireAfter: quarantineTTL}},
+		{c.Quarantine, mgo.Index{Key: []string{"id"}, Unique: true}},
+		{c.Raw, mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}},
+		{c.Raw, mgo.Index{Key: []string{"scanid"}, Unique: true}},
+		{c.Raw, mgo.Index{Key: []string{"time"}}},
+		{c.Suppressions, mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second}},
+		{c.Suppressions, mgo.Index{Key: []string{"id"}, Unique: true}},
+		{c.Spawnpoints, mgo.Index{Key: []string{"id"}, Unique: true}},
+		{c.Spawnpoints, mgo.Index{Key: []string{"$2dsphere:loc"}}},
+		{c.Nearby, mgo.Index{Key: []string{"fortid", "encounterid"}, Unique: true}},
+		{c.Nearby, mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second}},
+		{c.Scans, mgo.Index{Key: []string{"$2dsphere:loc", "ts"}}},
+		{c.Scans, mgo.Index{Key: []string{"$2dsphere:area", "ts"}}},
+		{c.Scans, mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second}},
+		{c.Timezones, mgo.Index{Key: []string{"id"}, Unique: true}},
+		{c.Areas, mgo.Index{Key: []string{"id"}, Unique: true}},
+		{c.Keys, mgo.Index{Key: []string{"privatekey"}, Unique: true, DropDups: true}},
+		{c.Keys, mgo.Index{Key: []string{"publickey"}, Unique: true, DropDups: true}},
+		{c.Proxy, mgo.Index{Key: []string{"id"}, Unique: true, DropDups: true}},
 	}
-	err = db.mongoSession.DB(db.DbName).C("Keys").EnsureIndex(mgo.Index{Key: []string{"privatekey"}, Unique: true, DropDups: true})
-	if err != nil {
-		return err
+}
+
+func (db *OpenMapDb) ensureIndex() error {
+	for _, i := range db.indexes() {
+		err := db.mongoSession.DB(db.DbName).C(i.collection).EnsureIndex(i.index)
+		if err != nil {
+			return err
+		}
 	}
-	err = db.mongoSession.DB(db.DbName).C("Keys").EnsureIndex(mgo.Index{Key: []string{"publickey"}, Unique: true, DropDups: true})
-	if err != nil {
-		return err
+	return nil
+}
+
+// SetPoolLimit sets the maximum number of sockets per server. It applies to all
+// sessions copied afterwards, so it should be called before the db is used.
+func (db *OpenMapDb) SetPoolLimit(limit int) {
+	if limit > 0 {
+		db.mongoSession.SetPoolLimit(limit)
 	}
-	return db.mongoSession.DB(db.DbName).C("Proxy").EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true, DropDups: true})
 }
 
 func (db *OpenMapDb) Login(user, password string) error {
-	return db.mongoSession.DB(db.DbName).Login(user, password)
+	return mapErr(db.mongoSession.DB(db.DbName).Login(user, password))
 }
 
 // Cleanup updates the use status of all proxies/accounts based on the input status entries
 func (db *OpenMapDb) Cleanup(list []opm.StatusEntry) (int, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
 	// Get usernames and proxy ids
 	usernames := make([]string, len(list))
 	proxies := make([]int64, len(list))
@@ -105,22 +356,22 @@ func (db *OpenMapDb) Cleanup(list []opm.StatusEntry) (int, error) {
 		},
 	}
 	total := 0
-	change, err := db.mongoSession.DB(db.DbName).C("Accounts").UpdateAll(inAcc, bson.M{
+	change, err := session.DB(db.DbName).C(db.Collections.Accounts).UpdateAll(inAcc, bson.M{
 		"$set": bson.M{
 			"used": true,
 		},
 	})
 	if err != nil {
-		return total, err
+		return total, mapErr(err)
 	}
 	total += change.Updated
-	change, err = db.mongoSession.DB(db.DbName).C("Accounts").UpdateAll(ninAcc, bson.M{
+	change, err = session.DB(db.DbName).C(db.Collections.Accounts).UpdateAll(ninAcc, bson.M{
 		"$set": bson.M{
 			"used": false,
 		},
 	})
 	if err != nil {
-		return total, err
+		return total, mapErr(err)
 	}
 	total += change.Updated
 	// Update proxies
@@ -134,22 +385,22 @@ func (db *OpenMapDb) Cleanup(list []opm.StatusEntry) (int, error) {
 			"$nin": proxies,
 		},
 	}
-	change, err = db.mongoSession.DB(db.DbName).C("Proxy").UpdateAll(inProxies, bson.M{
+	change, err = session.DB(db.DbName).C(db.Collections.Proxy).UpdateAll(inProxies, bson.M{
 		"$set": bson.M{
 			"use": true,
 		},
 	})
 	if err != nil {
-		return total, err
+		return total, mapErr(err)
 	}
 	total += change.Updated
-	change, err = db.mongoSession.DB(db.DbName).C("Proxy").UpdateAll(ninProxies, bson.M{
+	change, err = session.DB(db.DbName).C(db.Collections.Proxy).UpdateAll(ninProxies, bson.M{
 		"$set": bson.M{
 			"use": false,
 		},
 	})
 	if err != nil {
-		return total, err
+		return total, mapErr(err)
 	}
 	total += change.Updated
 
@@ -159,50 +410,74 @@ func (db *OpenMapDb) Cleanup(list []opm.StatusEntry) (int, error) {
 
 // MapObjectStats returns stats about MapObjects
 func (db *OpenMapDb) MapObjectStats() (int, int, int, int) {
-	c := db.mongoSession.DB(db.DbName).C("Objects")
-	totalPokemon, _ := c.Find(bson.M{"type": opm.POKEMON}).Count()
+	session := db.readSession()
+	defer session.Close()
+	c := session.DB(db.DbName).C(db.Collections.Objects)
+	totalPokemon, _ := c.Find(bson.M{"type": opm.POKEMON, "deleted": notDeleted}).Count()
 	alivePokemon, _ := c.Find(bson.M{
-		"type": opm.POKEMON,
-		"expiry": bson.M{
-			"$gt": time.Now().Unix(),
-		},
+		"type":    opm.POKEMON,
+		"expiry":  notExpired(opm.Now()),
+		"deleted": notDeleted,
 	}).Count()
-	gyms, _ := c.Find(bson.M{"type": opm.GYM}).Count()
-	pokestops, _ := c.Find(bson.M{"type": opm.POKESTOP}).Count()
+	gyms, _ := c.Find(bson.M{"type": opm.GYM, "deleted": notDeleted}).Count()
+	pokestops, _ := c.Find(bson.M{"type": opm.POKESTOP, "deleted": notDeleted}).Count()
 	return totalPokemon, alivePokemon, gyms, pokestops
 }
 
 // AddPokemon adds a pokemon to the db
 func (db *OpenMapDb) AddPokemon(p opm.Pokemon) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var err error
+	p.Lat, p.Lng, err = db.normalizeCoordinates(p.Lat, p.Lng)
+	if err != nil {
+		return db.quarantine(opm.MapObject{Type: opm.POKEMON, ID: p.EncounterID, PokemonID: p.PokemonID, Lat: p.Lat, Lng: p.Lng, Expiry: p.DisappearTime}, err)
+	}
 	o := object{
 		Type:      opm.POKEMON,
 		PokemonID: p.PokemonID,
 		ID:        p.EncounterID,
 		Expiry:    p.DisappearTime,
+		SeenAt:    time.Now().Unix(),
 		Loc: location{
 			Type:        "Point",
 			Coordinates: []float64{p.Lng, p.Lat},
 		},
 	}
-	return db.mongoSession.DB(db.DbName).C("Objects").Insert(o)
+	return mapErr(session.DB(db.DbName).C(db.Collections.Objects).Insert(o))
 }
 
 // AddPokestop adds a pokestop to the db
-func (db *OpenMapDb) AddPokestop(ps opm.Pokestop) {
+func (db *OpenMapDb) AddPokestop(ps opm.Pokestop) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var err error
+	ps.Lat, ps.Lng, err = db.normalizeCoordinates(ps.Lat, ps.Lng)
+	if err != nil {
+		return db.quarantine(opm.MapObject{Type: opm.POKESTOP, ID: ps.ID, Lat: ps.Lat, Lng: ps.Lng, Lured: ps.Lured, LureType: ps.LureType}, err)
+	}
 	o := object{
-		Type:  opm.POKESTOP,
-		ID:    ps.ID,
-		Lured: ps.Lured,
+		Type:     opm.POKESTOP,
+		ID:       ps.ID,
+		Lured:    ps.Lured,
+		LureType: ps.LureType,
 		Loc: location{
 			Type:        "Point",
 			Coordinates: []float64{ps.Lng, ps.Lat},
 		},
 	}
-	db.mongoSession.DB(db.DbName).C("Objects").Insert(o)
+	return mapErr(session.DB(db.DbName).C(db.Collections.Objects).Insert(o))
 }
 
 // AddGym adds a gym to the db
-func (db *OpenMapDb) AddGym(g opm.Gym) {
+func (db *OpenMapDb) AddGym(g opm.Gym) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var err error
+	g.Lat, g.Lng, err = db.normalizeCoordinates(g.Lat, g.Lng)
+	if err != nil {
+		return db.quarantine(opm.MapObject{Type: opm.GYM, ID: g.ID, Lat: g.Lat, Lng: g.Lng, Team: g.Team}, err)
+	}
 	o := object{
 		Type: opm.GYM,
 		ID:   g.ID,
@@ -212,11 +487,12 @@ func (db *OpenMapDb) AddGym(g opm.Gym) {
 			Coordinates: []float64{g.Lng, g.Lat},
 		},
 	}
-	db.mongoSession.DB(db.DbName).C("Objects").Insert(o)
+	return mapErr(session.DB(db.DbName).C(db.Collections.Objects).Insert(o))
 }
 
-// AddMapObject adds a opm.MapObject to the db
-func (db *OpenMapDb) AddMapObject(m opm.MapObject) {
+// newObject converts a map object with normalized coordinates to the stored form. The IVs
+// are stored with their ranks in the leagues.
+func newObject(m opm.MapObject, raw *location, leagues []opm.League) object {
 	o := object{
 		Type:         m.Type,
 		PokemonID:    m.PokemonID,
@@ -226,25 +502,211 @@ func (db *OpenMapDb) AddMapObject(m opm.MapObject) {
 			Type:        "Point",
 			Coordinates: []float64{m.Lng, m.Lat},
 		},
-		Expiry: m.Expiry,
-		Team:   m.Team,
-		Source: m.Source,
+		Expiry:   m.Expiry,
+		Lured:    m.Lured,
+		LureType: m.LureType,
+		LuredBy:  m.LuredBy,
+		Team:     m.Team,
+		Source:   m.Source,
+		SeenAt:   time.Now().Unix(),
+		LastSeen: m.CapturedAt,
+		RawLoc:   raw,
+		// Gyms
+		GymPoints:      m.GymPoints,
+		GuardPokemonID: m.GuardPokemonID,
+		GuardPokemonCP: m.GuardPokemonCP,
+	}
+	if o.LastSeen == 0 {
+		// Not from a scan response, e.g. added through the API
+		o.LastSeen = time.Now().UnixNano() / int64(time.Millisecond)
 	}
-	if o.Type != opm.POKEMON {
-		db.mongoSession.DB(db.DbName).C("Objects").Upsert(bson.M{"id": o.ID}, o)
-	} else {
-		db.mongoSession.DB(db.DbName).C("Objects").Insert(o)
+	if m.IVs != nil && m.IVs.Valid() {
+		// Computed once here so all consumers get the same value
+		ivs := m.IVs.WithRanks(m.PokemonID, leagues)
+		o.IVs = &ivs
+		o.CP = m.CP
+		o.Move1 = m.Move1
+		o.Move2 = m.Move2
+	}
+	return o
+}
+
+// AddMapObject adds a opm.MapObject to the db
+// Duplicate Pokemon and forts older than the stored observation are reported as ErrDuplicate.
+func (db *OpenMapDb) AddMapObject(m opm.MapObject) error {
+	_, err := db.addMapObject(m)
+	return err
+}
+
+// addMapObject stores the object and returns it with the coordinates that were stored
+func (db *OpenMapDb) addMapObject(m opm.MapObject) (opm.MapObject, error) {
+	if err := faults.Inject(faults.DbWrite); err != nil {
+		return m, mapErr(err)
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var err error
+	m.Lat, m.Lng, err = db.normalizeCoordinates(m.Lat, m.Lng)
+	if err != nil {
+		return m, db.quarantine(m, err)
+	}
+	raw := db.snapToSpawnpoint(&m)
+	o := newObject(m, raw, db.Leagues)
+	o.Timezone = db.timezoneOf(session, m)
+	c := session.DB(db.DbName).C(db.Collections.Objects)
+	switch {
+	case o.Type != opm.POKEMON:
+		err = replaceFort(c, o)
+	case db.UpsertPokemon:
+		// The first sighting wins, like with Insert
+		var change *mgo.ChangeInfo
+		change, err = c.Upsert(bson.M{"id": o.ID}, bson.M{"$setOnInsert": o})
+		if err == nil && change.UpsertedId == nil {
+			return m, ErrDuplicate
+		}
+	default:
+		err = c.Insert(o)
 	}
+	return m, mapErr(err)
 }
 
-func (db *OpenMapDb) AddMapObjects(m []opm.MapObject) {
+// replaceFort stores the fort unless the stored observation is at least as new, which is
+// reported as ErrDuplicate. Racing scans can finish out of order, so the last write isn't
+// necessarily the latest data. Forts are replaced as a whole, so a new owner doesn't keep
+// the old details, see fortUpdate.
+func replaceFort(c *mgo.Collection, o object) error {
+	update, err := fortUpdate(o)
+	if err != nil {
+		return err
+	}
+	// A newer fort doesn't match, the upsert then fails on the unique id instead of
+	// overwriting it. Forts stored before capture times were recorded always match.
+	q := bson.M{"id": o.ID, "lastseen": bson.M{"$not": bson.M{"$gte": o.LastSeen}}}
+	_, err = c.Upsert(q, update)
+	if mgo.IsDup(err) {
+		// Either newer or inserted by a concurrent scan, which may be older
+		_, err = c.Upsert(q, update)
+	}
+	return err
+}
+
+// objectFields are the keys of all stored object fields
+var objectFields = func() []string {
+	t := reflect.TypeOf(object{})
+	fields := make([]string, t.NumField())
+	for i := range fields {
+		fields[i] = strings.ToLower(t.Field(i).Name)
+	}
+	return fields
+}()
+
+// fortUpdate sets the observed fields of the fort and unsets the ones it doesn't have. The
+// tombstone of a deleted fort is kept unless o sets it, a scan doesn't bring the fort back.
+// The timezone is kept the same way, it is empty while the lookup is pending (see timezoneOf).
+func fortUpdate(o object) (bson.M, error) {
+	data, err := bson.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	var set bson.M
+	if err := bson.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	unset := bson.M{}
+	for _, f := range objectFields {
+		if _, ok := set[f]; !ok && f != "deleted" && f != "deletedat" && f != "timezone" {
+			unset[f] = ""
+		}
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, nil
+}
+
+// AddMapObjects adds multiple opm.MapObjects to the db. Duplicates are skipped,
+// the first other error is returned after all objects were processed.
+func (db *OpenMapDb) AddMapObjects(m []opm.MapObject) error {
+	var firstErr error
 	for _, o := range m {
-		db.AddMapObject(o)
+		err := db.AddMapObject(o)
+		if err != nil && err != ErrDuplicate && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SaveMapObjects persists the result of a scan and returns the objects that were new.
+// Suppressed species are skipped, wild Pokemon update their spawnpoint and lured
+// Pokemon are also recorded as sightings.
+// Errors are logged with the request id of ctx, not returned.
+func (db *OpenMapDb) SaveMapObjects(ctx context.Context, mapObjects []opm.MapObject) []opm.MapObject {
+	saved := make([]opm.MapObject, 0, len(mapObjects))
+	for _, o := range mapObjects {
+		if db.Suppress(o) {
+			continue
+		}
+		o, err := db.addMapObject(o)
+		if err == ErrDuplicate {
+			// Already known
+			continue
+		}
+		if err != nil {
+			logging.Log(ctx, logging.Entry{Level: logging.Error, Event: "db.save", Msg: "Failed to save " + o.ID, Err: err})
+			continue
+		}
+		saved = append(saved, o)
+		// Learn spawnpoints from wild Pokemon
+		if o.Type == opm.POKEMON && o.SpawnpointID != "" && o.Expiry > 0 {
+			err := db.UpsertSpawnpoint(o.SpawnpointID, o.Lat, o.Lng, o.Expiry)
+			if err != nil {
+				logging.Log(ctx, logging.Entry{Level: logging.Error, Event: "db.spawnpoint", Lat: o.Lat, Lng: o.Lng, Err: err})
+			}
+		}
+		// Lured pokemon are tracked separately
+		if o.LuredBy != "" {
+			err := db.AddSighting(o)
+			if err != nil {
+				logging.Log(ctx, logging.Entry{Level: logging.Error, Event: "db.sighting", Lat: o.Lat, Lng: o.Lng, Err: err})
+			}
+		}
 	}
+	return saved
 }
 
-// GetMapObjects returns all objects within a radius (in meters) of the given lat/lng
+// GetMapObjects returns all objects within a radius (in meters) of the given lat/lng.
+// Large results should be read with GetMapObjectsIter instead.
 func (db *OpenMapDb) GetMapObjects(lat, lng float64, types []int, radius int) ([]opm.MapObject, error) {
+	it := db.GetMapObjectsIter(lat, lng, types, radius)
+	mapObjects := make([]opm.MapObject, 0)
+	var m opm.MapObject
+	for it.Next(&m) {
+		mapObjects = append(mapObjects, m)
+	}
+	if err := it.Close(); err != nil {
+		return nil, err
+	}
+	return mapObjects, nil
+}
+
+// MapObjectIter reads map objects one at a time, see GetMapObjectsIter
+type MapObjectIter struct {
+	session *mgo.Session
+	iter    *mgo.Iter
+	now     time.Time
+	err     error // failed before the query
+}
+
+// GetMapObjectsIter returns the objects of GetMapObjects as an iterator, so only one batch
+// of documents is in memory at a time. The iterator must be closed.
+func (db *OpenMapDb) GetMapObjectsIter(lat, lng float64, types []int, radius int) *MapObjectIter {
+	if err := faults.Inject(faults.DbRead); err != nil {
+		return &MapObjectIter{err: mapErr(err)}
+	}
+	session := db.readSession()
+	now := opm.Now()
 	// Build query
 	q := bson.M{
 		"loc": bson.M{
@@ -255,226 +717,927 @@ func (db *OpenMapDb) GetMapObjects(lat, lng float64, types []int, radius int) ([
 				"$maxDistance": radius,
 			},
 		},
+		// Pokestops with an expired lure are still there, see opm.ClearExpiredLure
 		"$or": []bson.M{
-			{"expiry": bson.M{"$gt": time.Now().Unix()}},
+			{"expiry": notExpired(now)},
 			{"expiry": 0},
+			{"type": opm.POKESTOP},
 		},
-		"type": bson.M{"$in": types},
+		"type":    bson.M{"$in": types},
+		"deleted": notDeleted,
 	}
-	// Query db
+	if db.SuppressAfterMisses > 0 {
+		q["misses"] = bson.M{"$not": bson.M{"$gte": db.SuppressAfterMisses}}
+	}
+	iter := session.DB(db.DbName).C(db.Collections.Objects).Find(q).Iter()
+	return &MapObjectIter{session: session, iter: iter, now: now}
+}
+
+// Next reads the next object into m. It returns false at the end of the result or on error.
+func (it *MapObjectIter) Next(m *opm.MapObject) bool {
+	var o object
+	if it.err != nil || !it.iter.Next(&o) {
+		return false
+	}
+	*m = opm.ClearExpiredLure(o.mapObject(), it.now)
+	return true
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *MapObjectIter) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return mapErr(it.iter.Err())
+}
+
+// Close ends the query and releases its connection. It returns the error of the iteration.
+func (it *MapObjectIter) Close() error {
+	if it.err != nil {
+		return it.err
+	}
+	err := it.iter.Close()
+	it.session.Close()
+	return mapErr(err)
+}
+
+// GetObject returns the map object with the given id
+func (db *OpenMapDb) GetObject(id string) (opm.MapObject, error) {
+	if err := faults.Inject(faults.DbRead); err != nil {
+		return opm.MapObject{}, mapErr(err)
+	}
+	session := db.readSession()
+	defer session.Close()
+	var o object
+	err := session.DB(db.DbName).C(db.Collections.Objects).Find(bson.M{"id": id, "deleted": notDeleted}).One(&o)
+	if err != nil {
+		return opm.MapObject{}, mapErr(err)
+	}
+	return opm.ClearExpiredLure(o.mapObject(), opm.Now()), nil
+}
+
+// RecordMisses flags the Pokemon within radius meters that were known before the scan
+// started, but were not in the scan result. Flagged Pokemon are kept for the audit trail,
+// GetMapObjects only hides them after SuppressAfterMisses misses.
+func (db *OpenMapDb) RecordMisses(lat, lng float64, radius int, scanStart int64, seen []string) (int, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	q := bson.M{
+		"loc": bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": []interface{}{[]float64{lng, lat}, geo.Angle(float64(radius))},
+			},
+		},
+		"type":    opm.POKEMON,
+		"seenat":  bson.M{"$lt": scanStart},
+		"expiry":  notExpired(opm.Now()),
+		"id":      bson.M{"$nin": seen},
+		"deleted": notDeleted,
+	}
+	c := session.DB(db.DbName).C(db.Collections.Objects)
+	change, err := c.UpdateAll(q, bson.M{
+		"$inc": bson.M{"misses": 1},
+		"$set": bson.M{"lastmiss": time.Now().Unix()},
+	})
+	if err != nil {
+		return 0, mapErr(err)
+	}
+	// Seen again, so earlier misses were wrong
+	if len(seen) > 0 {
+		_, err = c.UpdateAll(bson.M{"id": bson.M{"$in": seen}, "misses": bson.M{"$gt": 0}}, bson.M{"$set": bson.M{"misses": 0}})
+		if err != nil {
+			return change.Updated, mapErr(err)
+		}
+	}
+	return change.Updated, nil
+}
+
+// AddSighting records a pokemon sighting in the Sightings collection
+func (db *OpenMapDb) AddSighting(m opm.MapObject) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var err error
+	m.Lat, m.Lng, err = db.normalizeCoordinates(m.Lat, m.Lng)
+	if err != nil {
+		return err
+	}
+	s := sighting{
+		PokemonID: m.PokemonID,
+		ID:        m.ID,
+		Loc: location{
+			Type:        "Point",
+			Coordinates: []float64{m.Lng, m.Lat},
+		},
+		Expiry:   m.Expiry,
+		LureType: m.LureType,
+		LuredBy:  m.LuredBy,
+		SeenAt:   time.Now().Unix(),
+	}
+	_, err = session.DB(db.DbName).C(db.Collections.Sightings).Upsert(bson.M{"id": s.ID}, s)
+	return mapErr(err)
+}
+
+// GetRecentSightings returns the most recent sightings of a Pokemon species, newest first.
+// Active Pokemon from the Objects collection are merged with archived Sightings.
+func (db *OpenMapDb) GetRecentSightings(pokemonID int, limit int) ([]opm.Sighting, error) {
+	session := db.readSession()
+	defer session.Close()
+	now := opm.Now()
+	// Active objects
 	var objects []object
-	err := db.mongoSession.DB(db.DbName).C("Objects").Find(q).All(&objects)
+	err := session.DB(db.DbName).C(db.Collections.Objects).Find(bson.M{
+		"type":      opm.POKEMON,
+		"pokemonid": pokemonID,
+		"expiry":    notExpired(now),
+		"deleted":   notDeleted,
+	}).Sort("-seenat").Limit(limit).All(&objects)
 	if err != nil {
-		return nil, err
+		return nil, mapErr(err)
 	}
-	// Convert objects to opm.MapObjects
-	mapObjects := make([]opm.MapObject, len(objects))
-	for i, o := range objects {
-		// Cast coordinates
-		mapObjects[i] = opm.MapObject{
-			Type:      o.Type,
-			PokemonID: o.PokemonID,
+	// Archived sightings
+	var sightings []sighting
+	err = session.DB(db.DbName).C(db.Collections.Sightings).Find(bson.M{"pokemonid": pokemonID}).Sort("-seenat").Limit(limit).All(&sightings)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	// Merge
+	seen := make(map[string]bool)
+	result := make([]opm.Sighting, 0, len(objects)+len(sightings))
+	for _, o := range objects {
+		seen[o.ID] = true
+		result = append(result, opm.Sighting{
 			ID:        o.ID,
+			PokemonID: o.PokemonID,
 			Lat:       o.Loc.Coordinates[1],
 			Lng:       o.Loc.Coordinates[0],
+			SeenAt:    o.SeenAt,
 			Expiry:    o.Expiry,
-			Team:      o.Team,
+			Active:    true,
+		})
+	}
+	for _, s := range sightings {
+		if seen[s.ID] {
+			continue
 		}
+		result = append(result, opm.Sighting{
+			ID:        s.ID,
+			PokemonID: s.PokemonID,
+			Lat:       s.Loc.Coordinates[1],
+			Lng:       s.Loc.Coordinates[0],
+			SeenAt:    s.SeenAt,
+			Expiry:    s.Expiry,
+			Active:    !opm.Expired(s.Expiry, now),
+		})
 	}
-	return mapObjects, nil
+	sort.Slice(result, func(i, j int) bool { return result[i].SeenAt > result[j].SeenAt })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// GetMapObjectsAt returns the Pokemon that were visible at the given unix timestamp within
+// a radius (in meters). Only Pokemon are archived, so gyms and pokestops are never returned.
+func (db *OpenMapDb) GetMapObjectsAt(lat, lng float64, radius int, at int64) ([]opm.MapObject, error) {
+	session := db.readSession()
+	defer session.Close()
+	near := bson.M{
+		"$near": bson.M{
+			"$geometry": bson.M{
+				"type":        "Point",
+				"coordinates": []float64{lng, lat}},
+			"$maxDistance": radius,
+		},
+	}
+	// Archived sightings
+	var sightings []sighting
+	err := session.DB(db.DbName).C(db.Collections.Sightings).Find(bson.M{
+		"loc":    near,
+		"expiry": bson.M{"$gte": at},
+		"seenat": bson.M{"$lte": at},
+	}).All(&sightings)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	// Pokemon that are not archived yet
+	var objects []object
+	err = session.DB(db.DbName).C(db.Collections.Objects).Find(bson.M{
+		"loc":     near,
+		"type":    opm.POKEMON,
+		"expiry":  bson.M{"$gte": at},
+		"seenat":  bson.M{"$lte": at},
+		"deleted": notDeleted,
+	}).All(&objects)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	seen := make(map[string]bool)
+	result := make([]opm.MapObject, 0, len(sightings)+len(objects))
+	for _, o := range objects {
+		seen[o.ID] = true
+		result = append(result, o.mapObject())
+	}
+	for _, s := range sightings {
+		if seen[s.ID] {
+			continue
+		}
+		result = append(result, opm.MapObject{
+			Type:      opm.POKEMON,
+			PokemonID: s.PokemonID,
+			ID:        s.ID,
+			Lat:       s.Loc.Coordinates[1],
+			Lng:       s.Loc.Coordinates[0],
+			Expiry:    s.Expiry,
+			Lured:     s.LureType != "",
+			LureType:  s.LureType,
+			LuredBy:   s.LuredBy,
+		})
+	}
+	return result, nil
 }
 
 // RemoveOldPokemon removes all Pokemon that expire before the given unix timestamp.
+// Removed Pokemon are archived in the Sightings collection. Deleted Pokemon are left to PurgeTombstones.
 // It will return the count of removed Pokemon and an error, if removal was not successful.
 func (db *OpenMapDb) RemoveOldPokemon(threshold int64) (int, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
 	filter := bson.M{
 		"expiry": bson.M{
 			"$lt": threshold,
 		},
-		"type": opm.POKEMON,
+		"type":    opm.POKEMON,
+		"deleted": notDeleted,
 	}
-	change, err := db.mongoSession.DB(db.DbName).C("Objects").RemoveAll(filter)
+	err := db.archiveSightings(filter)
 	if err != nil {
 		return 0, err
 	}
+	change, err := session.DB(db.DbName).C(db.Collections.Objects).RemoveAll(filter)
+	if err != nil {
+		return 0, mapErr(err)
+	}
 	return change.Removed, nil
 }
 
+// archiveSightings copies all Pokemon matching the filter to the Sightings collection
+func (db *OpenMapDb) archiveSightings(filter bson.M) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	iter := session.DB(db.DbName).C(db.Collections.Objects).Find(filter).Iter()
+	bulk := session.DB(db.DbName).C(db.Collections.Sightings).Bulk()
+	bulk.Unordered()
+	var o object
+	count := 0
+	for iter.Next(&o) {
+		bulk.Upsert(bson.M{"id": o.ID}, sighting{
+			PokemonID: o.PokemonID,
+			ID:        o.ID,
+			Loc:       o.Loc,
+			Expiry:    o.Expiry,
+			LureType:  o.LureType,
+			LuredBy:   o.LuredBy,
+			SeenAt:    o.SeenAt,
+		})
+		count++
+		if count%1000 == 0 {
+			if _, err := bulk.Run(); err != nil {
+				iter.Close()
+				return mapErr(err)
+			}
+			bulk = session.DB(db.DbName).C(db.Collections.Sightings).Bulk()
+			bulk.Unordered()
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return mapErr(err)
+	}
+	if count%1000 != 0 {
+		_, err := bulk.Run()
+		return mapErr(err)
+	}
+	return nil
+}
+
 // MarkAccountsAsUnused sets the used flag for all accounts in the database to false
 func (db *OpenMapDb) MarkAccountsAsUnused() (int, error) {
-	change, err := db.mongoSession.DB(db.DbName).C("Accounts").UpdateAll(bson.M{"used": true}, bson.M{"$set": bson.M{"used": false}})
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	change, err := session.DB(db.DbName).C(db.Collections.Accounts).UpdateAll(bson.M{"used": true}, bson.M{"$set": bson.M{"used": false}})
 	if err != nil {
-		return -1, err
+		return -1, mapErr(err)
 	}
 	return change.Updated, nil
 }
 
-// AccountStats returns total, used and banned number of accounts (in that order)
-func (db *OpenMapDb) AccountStats() (int, int, int, int, error) {
-	c := db.mongoSession.DB(db.DbName).C("Accounts")
-	total, err := c.Count()
-	if err != nil {
-		return 0, 0, 0, 0, err
+// AccountStats are the number of accounts by state
+type AccountStats struct {
+	Total   int
+	Used    int // and not banned
+	Banned  int
+	Flagged int // for a captcha
+	// Banned accounts per ban reason, "" are the bans before reasons were recorded
+	BannedBy map[string]int
+}
+
+// AccountStats counts the accounts by state
+func (db *OpenMapDb) AccountStats() (AccountStats, error) {
+	session := db.readSession()
+	defer session.Close()
+	c := session.DB(db.DbName).C(db.Collections.Accounts)
+	var s AccountStats
+	var err error
+	if s.Total, err = c.Count(); err != nil {
+		return s, mapErr(err)
 	}
-	used, err := c.Find(bson.M{"used": true, "banned": false}).Count()
-	if err != nil {
-		return 0, 0, 0, 0, err
+	if s.Used, err = c.Find(bson.M{"used": true, "banned": false}).Count(); err != nil {
+		return s, mapErr(err)
 	}
-	flagged, err := c.Find(bson.M{"captchaflagged": true}).Count()
+	if s.Flagged, err = c.Find(bson.M{"captchaflagged": true}).Count(); err != nil {
+		return s, mapErr(err)
+	}
+	var groups []struct {
+		ID    string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	pipeline := []bson.M{
+		{"$match": bson.M{"banned": true}},
+		{"$group": bson.M{"_id": bson.M{"$ifNull": []interface{}{"$banreason", ""}}, "count": bson.M{"$sum": 1}}},
+	}
+	if err := c.Pipe(pipeline).All(&groups); err != nil {
+		return s, mapErr(err)
+	}
+	s.BannedBy = make(map[string]int, len(groups))
+	for _, g := range groups {
+		s.BannedBy[g.ID] = g.Count
+		s.Banned += g.Count
+	}
+	return s, nil
+}
+
+// AccountStageCounts returns the number of accounts per stage. Accounts of the main pool
+// are counted as active or banned.
+func (db *OpenMapDb) AccountStageCounts() (map[string]int, error) {
+	session := db.readSession()
+	defer session.Close()
+	var groups []struct {
+		ID    string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	pipeline := []bson.M{
+		{"$group": bson.M{
+			"_id": bson.M{"$cond": []interface{}{
+				bson.M{"$eq": []interface{}{"$banned", true}}, opm.AccountStageBanned,
+				bson.M{"$ifNull": []interface{}{"$stage", opm.AccountStageActive}},
+			}},
+			"count": bson.M{"$sum": 1},
+		}},
+	}
+	err := session.DB(db.DbName).C(db.Collections.Accounts).Pipe(pipeline).All(&groups)
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return nil, mapErr(err)
+	}
+	counts := map[string]int{
+		opm.AccountStageQuarantine: 0,
+		opm.AccountStageInvalid:    0,
+		opm.AccountStageActive:     0,
+		opm.AccountStageBanned:     0,
 	}
-	banned, err := c.Find(bson.M{"banned": true}).Count()
-	return total, used, banned, flagged, err
+	for _, g := range groups {
+		counts[g.ID] += g.Count
+	}
+	return counts, nil
+}
+
+// GetWarmupAccount returns a quarantined account that is due for its next warm-up and
+// marks it as used. Return it with ReturnAccount.
+func (db *OpenMapDb) GetWarmupAccount(now time.Time) (opm.Account, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var a opm.Account
+	q := bson.M{
+		"stage":          opm.AccountStageQuarantine,
+		"used":           false,
+		"banned":         false,
+		"captchaflagged": false,
+		"nextwarmup":     bson.M{"$not": bson.M{"$gt": now.Unix()}},
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"used": true}},
+		ReturnNew: true,
+	}
+	_, err := session.DB(db.DbName).C(db.Collections.Accounts).Find(q).Sort("nextwarmup").Apply(change, &a)
+	if err == mgo.ErrNotFound {
+		return opm.Account{}, ErrNoAccountAvailable
+	}
+	return a, mapErr(err)
 }
 
 // GetBannedAccounts returns all accounts that are flagged as banned from the db
 func (db *OpenMapDb) GetBannedAccounts() ([]opm.Account, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var accounts []opm.Account
+	err := session.DB(db.DbName).C(db.Collections.Accounts).Find(bson.M{"banned": true}).All(&accounts)
+	return accounts, mapErr(err)
+}
+
+// GetBannedAccountsSince returns the accounts that were banned at or after t. Accounts that
+// were banned before bans were timestamped are not returned.
+func (db *OpenMapDb) GetBannedAccountsSince(t time.Time) ([]opm.Account, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
 	var accounts []opm.Account
-	err := db.mongoSession.DB(db.DbName).C("Accounts").Find(bson.M{"banned": true}).All(&accounts)
-	return accounts, err
+	err := session.DB(db.DbName).C(db.Collections.Accounts).Find(bson.M{"banned": true, "bannedat": bson.M{"$gte": t.Unix()}}).All(&accounts)
+	return accounts, mapErr(err)
+}
+
+// MarkAccountBanned flags the account as banned and records the reason and time of the ban
+func (db *OpenMapDb) MarkAccountBanned(username, reason string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Accounts).Update(bson.M{"username": username}, bson.M{"$set": bson.M{"banned": true, "bannedat": time.Now().Unix(), "banreason": reason}}))
+}
+
+// MarkTokenExpired flags the account for a new token, the ban state is left alone
+func (db *OpenMapDb) MarkTokenExpired(username string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Accounts).Update(bson.M{"username": username}, bson.M{"$set": bson.M{"tokenexpired": true}}))
+}
+
+// ReactivateAccounts puts the accounts that were banned for the reason more than olderThan
+// ago back into rotation and returns their number
+func (db *OpenMapDb) ReactivateAccounts(reason string, olderThan time.Duration) (int, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	q := bson.M{"banned": true, "banreason": reason, "bannedat": bson.M{"$lt": time.Now().Add(-olderThan).Unix()}}
+	change, err := session.DB(db.DbName).C(db.Collections.Accounts).UpdateAll(q, bson.M{"$set": bson.M{"banned": false}, "$unset": bson.M{"bannedat": "", "banreason": ""}})
+	if err != nil {
+		return 0, mapErr(err)
+	}
+	return change.Updated, nil
 }
 
 // GetAccount tries to get an account from the db that is neither in use, nor banned
 func (db *OpenMapDb) GetAccount() (opm.Account, error) {
-	// Get account from db
+	if err := faults.Inject(faults.DbRead); err != nil {
+		return opm.Account{}, mapErr(err)
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return db.takeAccount(session, freeAccounts())
+}
+
+// GetAccountMinLevel returns a free account of at least the given level and marks it as used.
+// There is no fallback to lower levels, ErrNoAccountAvailable is returned instead.
+func (db *OpenMapDb) GetAccountMinLevel(min int) (opm.Account, error) {
+	if err := faults.Inject(faults.DbRead); err != nil {
+		return opm.Account{}, mapErr(err)
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	q := freeAccounts()
+	q["level"] = bson.M{"$gte": min}
+	return db.takeAccount(session, q)
+}
+
+// GetLevelingAccount returns a free account below MinAccountLevel and marks it as used,
+// the lowest levels first
+func (db *OpenMapDb) GetLevelingAccount() (opm.Account, error) {
+	if db.MinAccountLevel <= 0 {
+		return opm.Account{}, ErrNoAccountAvailable
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	q := freeAccounts()
+	q["level"] = bson.M{"$not": bson.M{"$gte": db.MinAccountLevel}}
+	return db.takeAccount(session, q, "level")
+}
+
+// freeAccounts is the query for accounts that can be used for scanning
+func freeAccounts() bson.M {
+	return bson.M{
+		"used":           false,
+		"banned":         false,
+		"captchaflagged": false,
+		"cooldownuntil":  bson.M{"$not": bson.M{"$gt": time.Now().Unix()}},
+		"tokenexpired":   bson.M{"$ne": true},
+		"stage":          bson.M{"$nin": []string{opm.AccountStageQuarantine, opm.AccountStageInvalid}},
+	}
+}
+
+// takeAccount finds an account and marks it as used in one step, so concurrent callers
+// never get the same account
+func (db *OpenMapDb) takeAccount(session *mgo.Session, q bson.M, sort ...string) (opm.Account, error) {
 	var a opm.Account
-	err := db.mongoSession.DB(db.DbName).C("Accounts").Find(bson.M{"used": false, "banned": false, "captchaflagged": false}).One(&a)
-	if err != nil {
-		return opm.Account{}, err
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"used": true}},
+		ReturnNew: true,
+	}
+	query := session.DB(db.DbName).C(db.Collections.Accounts).Find(q)
+	if len(sort) > 0 {
+		query = query.Sort(sort...)
+	}
+	_, err := query.Apply(change, &a)
+	if err == mgo.ErrNotFound {
+		return opm.Account{}, ErrNoAccountAvailable
 	}
-	// Mark account as used
-	db_col := bson.M{"username": a.Username}
-	a.Used = true
-	err = db.mongoSession.DB(db.DbName).C("Accounts").Update(db_col, a)
 	if err != nil {
-		log.Println(err)
+		return opm.Account{}, mapErr(err)
 	}
-	// Return account
 	return a, nil
 }
 
-// ReturnAccount puts an Account back in the db and marks it as not used
-func (db *OpenMapDb) ReturnAccount(a opm.Account) {
-	db_col := bson.M{"username": a.Username}
+// ReturnAccount marks the account as not used. The rest of the stored account is kept, so
+// bans, captcha flags and reactivations since it was handed out are not reverted.
+func (db *OpenMapDb) ReturnAccount(a opm.Account) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Accounts).Update(bson.M{"username": a.Username}, bson.M{"$set": bson.M{"used": false}}))
+}
+
+// ReturnWarmupAccount stores a quarantined account after a warm-up and marks it as not
+// used. Quarantined accounts are only handed out to the intake, so the whole account is
+// stored with its stage.
+func (db *OpenMapDb) ReturnWarmupAccount(a opm.Account) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
 	a.Used = false
-	db.mongoSession.DB(db.DbName).C("Accounts").Update(db_col, a)
+	return mapErr(session.DB(db.DbName).C(db.Collections.Accounts).Update(bson.M{"username": a.Username}, a))
 }
 
 // AddAccount adds an Account to the database
-func (db *OpenMapDb) AddAccount(a opm.Account) {
-	db.mongoSession.DB(db.DbName).C("Accounts").Insert(a)
+func (db *OpenMapDb) AddAccount(a opm.Account) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	if db.AccountIntake {
+		a.Stage = opm.AccountStageQuarantine
+	}
+	return mapErr(session.DB(db.DbName).C(db.Collections.Accounts).Insert(a))
+}
+
+// AddAccounts inserts the accounts with one unordered bulk operation. Accounts whose
+// username already exists are skipped and counted instead of failing the batch. Other
+// failures are returned as error, the counts still cover the accounts that were added.
+func (db *OpenMapDb) AddAccounts(accounts []opm.Account) (int, int, error) {
+	if len(accounts) == 0 {
+		return 0, 0, nil
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	bulk := session.DB(db.DbName).C(db.Collections.Accounts).Bulk()
+	bulk.Unordered()
+	for _, a := range accounts {
+		if db.AccountIntake {
+			a.Stage = opm.AccountStageQuarantine
+		}
+		bulk.Insert(a)
+	}
+	_, err := bulk.Run()
+	if err == nil {
+		return len(accounts), 0, nil
+	}
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		return 0, 0, mapErr(err)
+	}
+	skipped, failed := 0, 0
+	for _, c := range bulkErr.Cases() {
+		if mgo.IsDup(c.Err) {
+			skipped++
+		} else {
+			failed++
+		}
+	}
+	added := len(accounts) - skipped - failed
+	if failed > 0 {
+		return added, skipped, mapErr(err)
+	}
+	return added, skipped, nil
+}
+
+// UpdateAccount stores the fields the trainer owns: the auth token and the progress of the
+// account. Bans and flags have their own methods, see MarkAccountBanned.
+func (db *OpenMapDb) UpdateAccount(a opm.Account) error {
+	if err := faults.Inject(faults.DbWrite); err != nil {
+		return mapErr(err)
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Accounts).Update(bson.M{"username": a.Username}, bson.M{"$set": bson.M{
+		"authtoken":     a.AuthToken,
+		"level":         a.Level,
+		"xp":            a.XP,
+		"tutorial_done": a.TutorialDone,
+	}}))
+}
+
+// BatchAccountAction applies an action to all given accounts with a single bulk operation.
+// It returns the result for every username ("ok" or "unknown").
+func (db *OpenMapDb) BatchAccountAction(usernames []string, action, value string) (map[string]string, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	c := session.DB(db.DbName).C(db.Collections.Accounts)
+	// Build update
+	var update bson.M
+	switch action {
+	case opm.AccountActionBan:
+		update = bson.M{"$set": bson.M{"banned": true, "bannedat": time.Now().Unix(), "banreason": opm.BanManual}}
+	case opm.AccountActionUnban:
+		update = bson.M{"$set": bson.M{"banned": false}, "$unset": bson.M{"bannedat": "", "banreason": ""}}
+	case opm.AccountActionSetPool:
+		update = bson.M{"$set": bson.M{"pool": value}}
+	case opm.AccountActionSetCooldown:
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		update = bson.M{"$set": bson.M{"cooldownuntil": time.Now().Unix() + seconds}}
+	case opm.AccountActionRemove:
+	default:
+		return nil, opm.ErrUnknownAction
+	}
+	// Find known accounts
+	var known []opm.Account
+	err := c.Find(bson.M{"username": bson.M{"$in": usernames}}).Select(bson.M{"username": 1}).All(&known)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	results := make(map[string]string)
+	for _, u := range usernames {
+		results[u] = "unknown"
+	}
+	if len(known) == 0 {
+		return results, nil
+	}
+	// Bulk update
+	bulk := c.Bulk()
+	bulk.Unordered()
+	for _, a := range known {
+		if action == opm.AccountActionRemove {
+			bulk.Remove(bson.M{"username": a.Username})
+		} else {
+			bulk.Update(bson.M{"username": a.Username}, update)
+		}
+	}
+	_, err = bulk.Run()
+	if err != nil {
+		return results, mapErr(err)
+	}
+	for _, a := range known {
+		results[a.Username] = "ok"
+	}
+	return results, nil
+}
+
+// AddAuditEntry records an admin action in the AdminAudit collection
+func (db *OpenMapDb) AddAuditEntry(e opm.AuditEntry) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.AdminAudit).Insert(e))
 }
 
-// UpdateAccount updates the account information in the database
-func (db *OpenMapDb) UpdateAccount(a opm.Account) {
-	db.mongoSession.DB(db.DbName).C("Accounts").Update(bson.M{"username": a.Username}, a)
+// GetAuditEntries returns the most recent admin actions
+func (db *OpenMapDb) GetAuditEntries(limit int) ([]opm.AuditEntry, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var entries []opm.AuditEntry
+	err := session.DB(db.DbName).C(db.Collections.AdminAudit).Find(nil).Sort("-time").Limit(limit).All(&entries)
+	return entries, mapErr(err)
 }
 
 // MarkProxiesAsUnused sets the used flag for all accounts in the database to false
 func (db *OpenMapDb) MarkProxiesAsUnused() (int, error) {
-	change, err := db.mongoSession.DB(db.DbName).C("Proxy").UpdateAll(bson.M{"use": true}, bson.M{"$set": bson.M{"use": false}})
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	change, err := session.DB(db.DbName).C(db.Collections.Proxy).UpdateAll(bson.M{"use": true}, bson.M{"$set": bson.M{"use": false}})
 	if err != nil {
-		return -1, err
+		return -1, mapErr(err)
 	}
 	return change.Updated, nil
 }
 
 // AddProxy adds a new proxy to the database
 func (db *OpenMapDb) AddProxy(p opm.Proxy) error {
-	return db.mongoSession.DB(db.DbName).C("Proxy").Insert(p)
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Proxy).Insert(p))
+}
+
+// AddProxies adds multiple proxies to the database. Proxies without id get the next free ids.
+// It returns the number of added proxies; duplicates are skipped, other errors abort.
+func (db *OpenMapDb) AddProxies(proxies []opm.Proxy) (int, error) {
+	maxID, err := db.MaxProxyId()
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	added := 0
+	for _, p := range proxies {
+		if p.ID == 0 {
+			maxID++
+			p.ID = maxID
+		}
+		err := db.AddProxy(p)
+		if err == ErrDuplicate {
+			continue
+		}
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
 }
 
-// UpdateProxy updates a proxy in the database
+// UpdateProxy updates the state of a proxy in the database. The address is kept.
 func (db *OpenMapDb) UpdateProxy(p opm.Proxy) error {
-	_, err := db.mongoSession.DB(db.DbName).C("Proxy").Upsert(bson.M{"id": p.ID}, p)
-	return err
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	_, err := session.DB(db.DbName).C(db.Collections.Proxy).Upsert(bson.M{"id": p.ID}, bson.M{"$set": bson.M{"use": p.Use, "dead": p.Dead}})
+	return mapErr(err)
 }
 
 func (db *OpenMapDb) MaxProxyId() (int64, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
 	var proxy opm.Proxy
-	err := db.mongoSession.DB(db.DbName).C("Proxy").Find(nil).Sort("-id").Limit(1).One(&proxy)
+	err := session.DB(db.DbName).C(db.Collections.Proxy).Find(nil).Sort("-id").Limit(1).One(&proxy)
 	if err != nil {
-		return 0, err
+		return 0, mapErr(err)
 	}
 	log.Println(proxy.ID)
-	return proxy.ID, err
+	return proxy.ID, mapErr(err)
 }
 
 // DropProxies removes ALL proxies from the database
 func (db *OpenMapDb) DropProxies() error {
-	return db.mongoSession.DB(db.DbName).C("Proxy").DropCollection()
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Proxy).DropCollection())
 }
 
 // RemoveDeadProxies removes dead proxies from the database
 func (db *OpenMapDb) RemoveDeadProxies() (int, error) {
-	change, err := db.mongoSession.DB(db.DbName).C("Proxy").RemoveAll(bson.M{"dead": true})
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	change, err := session.DB(db.DbName).C(db.Collections.Proxy).RemoveAll(bson.M{"dead": true})
 	if err != nil {
-		return -1, err
+		return -1, mapErr(err)
 	}
 	return change.Removed, nil
 }
 
-// ProxyStats returns the number of currently alive/used proxies (in that order)
-func (db *OpenMapDb) ProxyStats() (int, int, error) {
-	alive, err := db.mongoSession.DB(db.DbName).C("Proxy").Find(bson.M{"dead": false}).Count()
+// ProxyStats returns the number of currently alive/used/dead proxies (in that order)
+func (db *OpenMapDb) ProxyStats() (int, int, int, error) {
+	session := db.readSession()
+	defer session.Close()
+	alive, err := session.DB(db.DbName).C(db.Collections.Proxy).Find(bson.M{"dead": false}).Count()
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, mapErr(err)
 	}
-	aliveUsed, err := db.mongoSession.DB(db.DbName).C("Proxy").Find(bson.M{"dead": false, "use": true}).Count()
-	return alive, aliveUsed, err
+	aliveUsed, err := session.DB(db.DbName).C(db.Collections.Proxy).Find(bson.M{"dead": false, "use": true}).Count()
+	if err != nil {
+		return 0, 0, 0, mapErr(err)
+	}
+	dead, err := session.DB(db.DbName).C(db.Collections.Proxy).Find(bson.M{"dead": true}).Count()
+	return alive, aliveUsed, dead, mapErr(err)
 }
 
 // GetProxy gets a new Proxy from the db
 func (db *OpenMapDb) GetProxy() (opm.Proxy, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
 	var p proxy
-	err := db.mongoSession.DB(db.DbName).C("Proxy").Find(bson.M{"use": false, "dead": false}).One(&p)
-	if err != nil {
-		return opm.Proxy{}, opm.ErrNoProxiesAvailable
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"use": true}},
+		ReturnNew: true,
+	}
+	_, err := session.DB(db.DbName).C(db.Collections.Proxy).Find(bson.M{"use": false, "dead": false}).Apply(change, &p)
+	if err == mgo.ErrNotFound {
+		return opm.Proxy{}, ErrNoProxyAvailable
 	}
-	// Mark proxy as used
-	db_col := bson.M{"id": p.Id}
-	p.Use = true
-	err = db.mongoSession.DB(db.DbName).C("Proxy").Update(db_col, p)
 	if err != nil {
-		log.Println(err)
+		return opm.Proxy{}, mapErr(err)
 	}
 	// Return proxy
-	return opm.Proxy{ID: p.Id}, nil
+	return p.mapProxy(), nil
 }
 
 // ReturnProxy returns a Proxy back to the db and marks it as not used
-func (db *OpenMapDb) ReturnProxy(p opm.Proxy) {
+func (db *OpenMapDb) ReturnProxy(p opm.Proxy) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
 	db_col := bson.M{"id": p.ID}
-	change := proxy{Id: p.ID, Dead: false, Use: false}
-	db.mongoSession.DB(db.DbName).C("Proxy").Update(db_col, change)
+	change := bson.M{"$set": bson.M{"dead": false, "use": false}}
+	return mapErr(session.DB(db.DbName).C(db.Collections.Proxy).Update(db_col, change))
+}
+
+// GetProxiesToCheck returns unused, alive proxies with an address that were not checked
+// since the given unix time, least recently checked first
+func (db *OpenMapDb) GetProxiesToCheck(checkedBefore int64, limit int) ([]opm.Proxy, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	q := bson.M{
+		"use":       false,
+		"dead":      false,
+		"url":       bson.M{"$gt": ""},
+		"lastcheck": bson.M{"$not": bson.M{"$gte": checkedBefore}},
+	}
+	var proxies []proxy
+	err := session.DB(db.DbName).C(db.Collections.Proxy).Find(q).Sort("lastcheck").Limit(limit).All(&proxies)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	result := make([]opm.Proxy, len(proxies))
+	for i, p := range proxies {
+		result[i] = p.mapProxy()
+	}
+	return result, nil
+}
+
+// ClaimProxy marks an unused, alive proxy as used for its health check. It returns false
+// if the proxy was taken or marked dead in the meantime.
+func (db *OpenMapDb) ClaimProxy(id int64) (bool, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	err := session.DB(db.DbName).C(db.Collections.Proxy).Update(bson.M{"id": id, "use": false, "dead": false}, bson.M{"$set": bson.M{"use": true}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, mapErr(err)
+	}
+	return true, nil
+}
+
+// RecordProxyCheck sets the time of the last successful health check of a claimed proxy
+// and marks it as not used
+func (db *OpenMapDb) RecordProxyCheck(id int64) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Proxy).Update(bson.M{"id": id}, bson.M{"$set": bson.M{"use": false, "lastcheck": time.Now().Unix()}}))
+}
+
+// MarkProxyDead marks a claimed proxy that failed its health checks as dead and not used
+func (db *OpenMapDb) MarkProxyDead(id int64) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Proxy).Update(bson.M{"id": id}, bson.M{"$set": bson.M{"dead": true, "use": false, "lastcheck": time.Now().Unix()}}))
 }
 
 func (db *OpenMapDb) AddAPIKey(k opm.APIKey) error {
-	return db.mongoSession.DB(db.DbName).C("Keys").Insert(k)
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Keys).Insert(k))
 }
 
+// GetAPIKey returns the API key with the given private key. Requests authenticate with it,
+// the public key is shown in stats and sources and doesn't grant access.
 func (db *OpenMapDb) GetAPIKey(k string) (opm.APIKey, error) {
+	return db.getAPIKey(bson.M{"privatekey": k})
+}
+
+// GetAPIKeyByPublic returns the API key with the given public key, for managing keys
+func (db *OpenMapDb) GetAPIKeyByPublic(k string) (opm.APIKey, error) {
+	return db.getAPIKey(bson.M{"publickey": k})
+}
+
+func (db *OpenMapDb) getAPIKey(q bson.M) (opm.APIKey, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
 	var key opm.APIKey
-	err := db.mongoSession.DB(db.DbName).C("Keys").Find(bson.M{"key": k}).One(&key)
-	return key, err
+	err := session.DB(db.DbName).C(db.Collections.Keys).Find(q).One(&key)
+	return key, mapErr(err)
 }
 
 func (db *OpenMapDb) UpdateAPIKey(k opm.APIKey) error {
-	return db.mongoSession.DB(db.DbName).C("Keys").Update(bson.M{"key": k.PublicKey}, k)
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Keys).Update(bson.M{"publickey": k.PublicKey}, k))
+}
+
+// RevokeAPIKey disables the API key with the given private or public key
+func (db *OpenMapDb) RevokeAPIKey(k string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	q := bson.M{"$or": []bson.M{{"privatekey": k}, {"publickey": k}}}
+	return mapErr(session.DB(db.DbName).C(db.Collections.Keys).Update(q, bson.M{"$set": bson.M{"enabled": false}}))
 }
 
 func (db *OpenMapDb) APIKeyStats() map[string]int {
+	session := db.readSession()
+	defer session.Close()
 	result := make(map[string]int)
 	// Get API keys
 	var keys []opm.APIKey
-	err := db.mongoSession.DB(db.DbName).C("Keys").Find(nil).All(&keys)
+	err := session.DB(db.DbName).C(db.Collections.Keys).Find(nil).All(&keys)
 	if err != nil {
 		return result
 	}
 	// Get alive pokemon for all of them
 	for _, k := range keys {
-		count, _ := db.mongoSession.DB(db.DbName).C("Objects").Find(bson.M{"source": k.PublicKey, "expiry": bson.M{"$gt": time.Now().Unix()}}).Count()
+		count, _ := session.DB(db.DbName).C(db.Collections.Objects).Find(bson.M{"source": k.PublicKey, "expiry": notExpired(opm.Now()), "deleted": notDeleted}).Count()
 		result[k.Name] = count
 	}
 	// Return result
@@ -0,0 +1,410 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"golang.org/x/net/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testDB connects to the MongoDB of OPM_TEST_MONGO (e.g. localhost:27017) and returns a
+// database that is dropped after the test. Tests that need it are skipped without it.
+func testDB(t testing.TB, options ...Options) *OpenMapDb {
+	t.Helper()
+	host := os.Getenv("OPM_TEST_MONGO")
+	if host == "" {
+		t.Skip("OPM_TEST_MONGO not set")
+	}
+	db, err := NewOpenMapDb(fmt.Sprintf("opm_test_%d", time.Now().UnixNano()), host, "", "", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.mongoSession.DB(db.DbName).DropDatabase(); err != nil {
+			t.Log(err)
+		}
+		db.mongoSession.Close()
+	})
+	return db
+}
+
+func TestBatchAccountActionUnknownUsernames(t *testing.T) {
+	db := testDB(t)
+	for _, u := range []string{"ash", "misty"} {
+		if err := db.AddAccount(opm.Account{Username: u, Password: "pw", Provider: "ptc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := db.BatchAccountAction([]string{"ash", "brock", "misty", "gary"}, opm.AccountActionBan, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ash": "ok", "misty": "ok", "brock": "unknown", "gary": "unknown"}
+	for u, r := range want {
+		if results[u] != r {
+			t.Errorf("result of %s = %q, want %q", u, results[u], r)
+		}
+	}
+	banned, err := db.GetBannedAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(banned) != 2 {
+		t.Errorf("%d banned accounts, want the 2 known ones", len(banned))
+	}
+	for _, a := range banned {
+		if a.BanReason != opm.BanManual {
+			t.Errorf("reason of %s = %q, want %q", a.Username, a.BanReason, opm.BanManual)
+		}
+	}
+
+	// Only unknown accounts change nothing
+	results, err = db.BatchAccountAction([]string{"brock"}, opm.AccountActionRemove, "")
+	if err != nil || results["brock"] != "unknown" {
+		t.Errorf("remove of an unknown account = %v, %v", results, err)
+	}
+	results, err = db.BatchAccountAction([]string{"ash", "brock"}, opm.AccountActionRemove, "")
+	if err != nil || results["ash"] != "ok" || results["brock"] != "unknown" {
+		t.Errorf("remove = %v, %v", results, err)
+	}
+	if _, err := db.BatchAccountAction([]string{"misty"}, "promote", ""); err != opm.ErrUnknownAction {
+		t.Errorf("unknown action = %v, want opm.ErrUnknownAction", err)
+	}
+}
+
+func TestBannedAccounts(t *testing.T) {
+	db := testDB(t)
+	for _, u := range []string{"ash", "misty", "brock", "gary"} {
+		if err := db.AddAccount(opm.Account{Username: u, Password: "pw", Provider: "ptc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Banned before bans were timestamped
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	if err := session.DB(db.DbName).C(db.Collections.Accounts).Update(bson.M{"username": "gary"}, bson.M{"$set": bson.M{"banned": true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MarkAccountBanned("ash", opm.BanPermanent); err != nil {
+		t.Fatal(err)
+	}
+	// bannedat has a resolution of seconds
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	since := time.Now()
+	if err := db.MarkAccountBanned("misty", opm.BanTemporary); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MarkAccountBanned("nobody", opm.BanTemporary); err != ErrNotFound {
+		t.Errorf("MarkAccountBanned of an unknown account = %v, want ErrNotFound", err)
+	}
+
+	banned, err := db.GetBannedAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]opm.Account)
+	for _, a := range banned {
+		got[a.Username] = a
+	}
+	if len(got) != 3 || got["brock"].Username != "" {
+		t.Errorf("banned accounts = %v, want ash, misty and gary", got)
+	}
+	if a := got["misty"]; a.BanReason != opm.BanTemporary || a.BannedAt < since.Unix() {
+		t.Errorf("misty = %+v, want the reason and time of the ban", a)
+	}
+	recent, err := db.GetBannedAccountsSince(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 1 || recent[0].Username != "misty" {
+		t.Errorf("banned since %s = %v, want misty", since, recent)
+	}
+}
+
+// storeAccounts inserts the accounts as they are, without AddAccount's defaults
+func storeAccounts(t *testing.T, db *OpenMapDb, accounts ...opm.Account) {
+	t.Helper()
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	for _, a := range accounts {
+		if err := session.DB(db.DbName).C(db.Collections.Accounts).Insert(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReactivateAccounts(t *testing.T) {
+	db := testDB(t)
+	old, recent := time.Now().Add(-2*time.Hour).Unix(), time.Now().Unix()
+	storeAccounts(t, db,
+		opm.Account{Username: "ash", Banned: true, BannedAt: old, BanReason: opm.BanTemporary},
+		opm.Account{Username: "misty", Banned: true, BannedAt: recent, BanReason: opm.BanTemporary},
+		opm.Account{Username: "brock", Banned: true, BannedAt: old, BanReason: opm.BanPermanent},
+		opm.Account{Username: "gary", Banned: true},
+		opm.Account{Username: "tracey"})
+	if n, err := db.ReactivateAccounts(opm.BanTemporary, time.Hour); err != nil || n != 1 {
+		t.Fatalf("ReactivateAccounts = %d, %v, want ash", n, err)
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var stored []bson.M
+	if err := session.DB(db.DbName).C(db.Collections.Accounts).Find(nil).Sort("username").All(&stored); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range stored {
+		_, hasTime := a["bannedat"]
+		_, hasReason := a["banreason"]
+		switch a["username"] {
+		case "ash":
+			if a["banned"] != false || hasTime || hasReason {
+				t.Errorf("ash = %v, want the ban lifted and its time and reason removed", a)
+			}
+		case "misty", "brock", "gary":
+			if a["banned"] != true {
+				t.Errorf("%s = %v, want still banned", a["username"], a)
+			}
+		}
+	}
+	if n, err := db.ReactivateAccounts(opm.BanTemporary, time.Hour); err != nil || n != 0 {
+		t.Errorf("second ReactivateAccounts = %d, %v, want 0", n, err)
+	}
+	if a, err := db.GetAccount(); err != nil || a.Username == "misty" || a.Username == "brock" || a.Username == "gary" {
+		t.Errorf("GetAccount = %+v, %v, want ash or tracey", a, err)
+	}
+}
+
+func TestAccountStatsByReason(t *testing.T) {
+	db := testDB(t)
+	storeAccounts(t, db,
+		opm.Account{Username: "ash", Banned: true, BannedAt: 1000, BanReason: opm.BanPermanent},
+		opm.Account{Username: "misty", Banned: true, BannedAt: 1000, BanReason: opm.BanTemporary},
+		opm.Account{Username: "brock", Banned: true, BannedAt: 1000, BanReason: opm.BanTemporary},
+		opm.Account{Username: "gary", Banned: true},
+		opm.Account{Username: "tracey", CaptchaFlagged: true},
+		opm.Account{Username: "max", Used: true})
+	s, err := db.AccountStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{opm.BanPermanent: 1, opm.BanTemporary: 2, "": 1}
+	if s.Total != 6 || s.Used != 1 || s.Flagged != 1 || s.Banned != 4 || fmt.Sprint(s.BannedBy) != fmt.Sprint(want) {
+		t.Errorf("AccountStats = %+v, want 6 accounts with the bans %v", s, want)
+	}
+}
+
+func TestGetAccountConcurrent(t *testing.T) {
+	db := testDB(t)
+	for i := 0; i < 50; i++ {
+		if err := db.AddAccount(opm.Account{Username: fmt.Sprintf("trainer%d", i), Password: "pw", Provider: "ptc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	handedOut := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := db.GetAccount()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			handedOut[a.Username]++
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(handedOut) != 50 {
+		t.Errorf("%d different accounts handed out to 50 goroutines", len(handedOut))
+	}
+	for u, n := range handedOut {
+		if n > 1 {
+			t.Errorf("%s was handed out %d times", u, n)
+		}
+	}
+	if _, err := db.GetAccount(); !errors.Is(err, ErrNoAccountAvailable) {
+		t.Errorf("GetAccount after all accounts were handed out = %v, want ErrNoAccountAvailable", err)
+	}
+}
+
+func TestGetAPIKeyMatchesPrivateKeys(t *testing.T) {
+	db := testDB(t)
+	if err := db.AddAPIKey(opm.APIKey{PrivateKey: "secret", PublicKey: "public", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := db.GetAPIKey("secret"); err != nil || key.PublicKey != "public" {
+		t.Errorf("GetAPIKey(private) = %+v, %v", key, err)
+	}
+	if _, err := db.GetAPIKey("public"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAPIKey(public) = %v, want ErrNotFound", err)
+	}
+	if key, err := db.GetAPIKeyByPublic("public"); err != nil || key.PrivateKey != "secret" {
+		t.Errorf("GetAPIKeyByPublic = %+v, %v", key, err)
+	}
+}
+
+func TestClaimProxyForCheck(t *testing.T) {
+	db := testDB(t)
+	if _, err := db.AddProxies([]opm.Proxy{{ID: 1, URL: "http://127.0.0.1:3128"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.ClaimProxy(1); !ok || err != nil {
+		t.Fatalf("ClaimProxy = %v, %v, want the unused proxy", ok, err)
+	}
+	if _, err := db.GetProxy(); err != ErrNoProxyAvailable {
+		t.Errorf("GetProxy during the check = %v, want ErrNoProxyAvailable", err)
+	}
+	if ok, _ := db.ClaimProxy(1); ok {
+		t.Error("claimed a proxy twice")
+	}
+	if err := db.RecordProxyCheck(1); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := db.GetProxy(); err != nil || p.ID != 1 || p.LastCheck == 0 {
+		t.Errorf("GetProxy after the check = %+v, %v", p, err)
+	}
+}
+
+func TestAddAccountsSkipsDuplicates(t *testing.T) {
+	db := testDB(t)
+	if err := db.AddAccount(opm.Account{Username: "misty", Password: "pw", Provider: "ptc"}); err != nil {
+		t.Fatal(err)
+	}
+	accounts := []opm.Account{
+		{Username: "ash", Password: "pw", Provider: "ptc"},
+		{Username: "misty", Password: "other", Provider: "ptc"},
+		{Username: "ash", Password: "again", Provider: "ptc"},
+		{Username: "brock", Password: "pw", Provider: "google"},
+	}
+	added, skipped, err := db.AddAccounts(accounts)
+	if err != nil || added != 2 || skipped != 2 {
+		t.Errorf("AddAccounts = %d added, %d skipped, %v, want 2 and 2", added, skipped, err)
+	}
+	// The first of the duplicates wins, existing accounts are unchanged
+	passwords := make(map[string]string)
+	err = db.EachAccount(AccountFilter{}, func(a opm.Account) error {
+		passwords[a.Username] = a.Password
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 3 || passwords["ash"] != "pw" || passwords["misty"] != "pw" {
+		t.Errorf("accounts = %v, want ash, misty and brock with their first passwords", passwords)
+	}
+	if added, skipped, err := db.AddAccounts(nil); added != 0 || skipped != 0 || err != nil {
+		t.Errorf("AddAccounts(nil) = %d, %d, %v", added, skipped, err)
+	}
+
+	// A document over the size limit fails, the duplicates after it are still counted
+	accounts = []opm.Account{
+		{Username: "gary", Password: strings.Repeat("x", 17<<20), Provider: "ptc"},
+		{Username: "ash", Password: "pw", Provider: "ptc"},
+		{Username: "tracey", Password: "pw", Provider: "ptc"},
+	}
+	added, skipped, err = db.AddAccounts(accounts)
+	if err == nil || added != 1 || skipped != 1 {
+		t.Errorf("AddAccounts with a failing account = %d added, %d skipped, %v, want 1 and 1 with an error", added, skipped, err)
+	}
+}
+
+func TestUpsertPokemonStoresOneDocument(t *testing.T) {
+	db := testDB(t)
+	db.UpsertPokemon = true
+	first := opm.MapObject{Type: opm.POKEMON, ID: "encounter", PokemonID: 16, Lat: 52.5, Lng: 13.4, SeenAt: 1500000000, Expiry: time.Now().Add(10 * time.Minute).Unix()}
+	if _, err := db.addMapObject(first); err != nil {
+		t.Fatal(err)
+	}
+	again := first
+	again.SeenAt++
+	if _, err := db.addMapObject(again); err != ErrDuplicate {
+		t.Errorf("second write = %v, want ErrDuplicate", err)
+	}
+	if saved := db.SaveMapObjects(context.Background(), []opm.MapObject{again}); len(saved) != 0 {
+		t.Errorf("SaveMapObjects = %v, want the known Pokemon left out", saved)
+	}
+	var stored []object
+	if err := db.mongoSession.DB(db.DbName).C(db.Collections.Objects).Find(bson.M{"id": "encounter"}).All(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].SeenAt != first.SeenAt {
+		t.Errorf("stored = %+v, want one document of the first sighting", stored)
+	}
+}
+
+func TestWarmupAccounts(t *testing.T) {
+	db := testDB(t)
+	now := time.Unix(1500000000, 0)
+	for _, a := range []opm.Account{
+		{Username: "later", Stage: opm.AccountStageQuarantine, NextWarmup: now.Add(time.Hour).Unix()},
+		{Username: "flagged", Stage: opm.AccountStageQuarantine, CaptchaFlagged: true},
+		{Username: "due", Stage: opm.AccountStageQuarantine, NextWarmup: now.Unix()},
+		{Username: "active"},
+	} {
+		a.Password, a.Provider = "pw", "ptc"
+		if err := db.AddAccount(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := db.GetWarmupAccount(now)
+	if err != nil || a.Username != "due" {
+		t.Fatalf("GetWarmupAccount = %s, %v, want the due account", a.Username, err)
+	}
+	if a, err := db.GetWarmupAccount(now); err != ErrNoAccountAvailable {
+		t.Errorf("GetWarmupAccount = %s, %v, want none with the due one in use", a.Username, err)
+	}
+	// Quarantined accounts are not in rotation
+	if a, err := db.GetAccount(); err != nil || a.Username != "active" {
+		t.Errorf("GetAccount = %s, %v, want the active account", a.Username, err)
+	}
+	if a, err := db.GetAccount(); err == nil {
+		t.Errorf("GetAccount = %s, want no quarantined account", a.Username)
+	}
+}
+
+func TestGetMapObjectsIterMatchesSlice(t *testing.T) {
+	db := testDB(t)
+	expiry := time.Now().Add(10 * time.Minute).Unix()
+	for i := 0; i < 250; i++ {
+		o := opm.MapObject{Type: opm.POKEMON, ID: fmt.Sprintf("p%d", i), PokemonID: 16, Lat: 52.5 + float64(i)/1e5, Lng: 13.4, Expiry: expiry}
+		if i%10 == 0 {
+			o.Expiry = time.Now().Add(-time.Minute).Unix()
+		}
+		if err := db.AddMapObject(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read in more than one batch of documents
+	it := db.GetMapObjectsIter(52.5, 13.4, []int{opm.POKEMON}, 1000)
+	var got []opm.MapObject
+	var o opm.MapObject
+	for it.Next(&o) {
+		got = append(got, o)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 225 || len(got) != len(want) {
+		t.Fatalf("iterator read %d objects, GetMapObjects %d, want the 225 active ones", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].ID != want[i].ID {
+			t.Errorf("object %d = %s, want %s in the order of GetMapObjects", i, got[i].ID, want[i].ID)
+			break
+		}
+	}
+}
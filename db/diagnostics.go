@@ -0,0 +1,73 @@
+package db
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Ping checks the connection to the database and returns the round trip time
+func (db *OpenMapDb) Ping() (time.Duration, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	start := time.Now()
+	err := session.Ping()
+	return time.Since(start), mapErr(err)
+}
+
+// ClockSkew returns how far the local clock is ahead of the clock of the database server.
+// The server time is taken as the middle of the round trip.
+func (db *OpenMapDb) ClockSkew() (time.Duration, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var status struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+	start := time.Now()
+	err := session.Run(bson.D{{Name: "serverStatus", Value: 1}}, &status)
+	if err != nil {
+		return 0, mapErr(err)
+	}
+	rtt := time.Since(start)
+	return start.Add(rtt / 2).Sub(status.LocalTime), nil
+}
+
+// WarnClockSkew logs a warning when the local clock is off by more than max. Expiries are
+// compared with the local clock, so a skewed clock hides Pokemon early or shows them too long.
+func (db *OpenMapDb) WarnClockSkew(max time.Duration) {
+	skew, err := db.ClockSkew()
+	if err != nil {
+		log.Printf("Failed to check the clock against the database: %s", err)
+		return
+	}
+	if skew > max || skew < -max {
+		log.Printf("WARNING: the local clock is off by %s compared to the database server, expiries will be wrong. Check NTP.", skew.Round(time.Millisecond))
+	}
+}
+
+// MissingIndexes returns the indexes that should exist but don't, as "collection:key1,key2"
+func (db *OpenMapDb) MissingIndexes() ([]string, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	existing := make(map[string]map[string]bool)
+	var missing []string
+	for _, i := range db.indexes() {
+		if existing[i.collection] == nil {
+			existing[i.collection] = make(map[string]bool)
+			list, err := session.DB(db.DbName).C(i.collection).Indexes()
+			if err != nil {
+				return nil, mapErr(err)
+			}
+			for _, e := range list {
+				existing[i.collection][strings.Join(e.Key, ",")] = true
+			}
+		}
+		key := strings.Join(i.index.Key, ",")
+		if !existing[i.collection][key] {
+			missing = append(missing, i.collection+":"+key)
+		}
+	}
+	return missing, nil
+}
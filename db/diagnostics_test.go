@@ -0,0 +1,39 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func TestClockSkew(t *testing.T) {
+	db := testDB(t)
+	// The test database runs next to the tests
+	skew, err := db.ClockSkew()
+	if err != nil || skew > time.Second || skew < -time.Second {
+		t.Errorf("ClockSkew = %s, %v, want about 0", skew, err)
+	}
+}
+
+func TestGetMapObjectsUsesClock(t *testing.T) {
+	db := testDB(t)
+	p := testPokemon("p1")
+	if err := db.AddMapObject(p); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { opm.Now = time.Now }()
+	for _, c := range []struct {
+		now     time.Time
+		visible bool
+	}{
+		{time.Unix(p.Expiry, 0), true},
+		{time.Unix(p.Expiry, 0).Add(time.Second), false},
+	} {
+		opm.Now = func() time.Time { return c.now }
+		got, err := db.GetMapObjects(p.Lat, p.Lng, []int{opm.POKEMON}, 100)
+		if err != nil || (len(got) == 1) != c.visible {
+			t.Errorf("objects at %s = %v, %v, want visible %v", c.now, got, err, c.visible)
+		}
+	}
+}
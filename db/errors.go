@@ -0,0 +1,72 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/pogointel/opm/internal/faults"
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2"
+)
+
+// Errors returned by OpenMapDb methods. Use errors.Is to check for them.
+var (
+	ErrNoAccountAvailable = errors.New("No account available")
+	ErrNoProxyAvailable   = opm.ErrNoProxiesAvailable
+	ErrNotFound           = errors.New("Not found")
+	ErrDuplicate          = errors.New("Duplicate entry")
+	ErrUnavailable        = errors.New("Database unavailable")
+	ErrInvalidCursor      = opm.ErrInvalidCursor
+)
+
+// UnavailableError is returned when the database could not be reached.
+// It matches ErrUnavailable and wraps the underlying cause.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return ErrUnavailable.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrUnavailable
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// Unreachable reports whether err means the database server couldn't be reached: network
+// errors, a connection closed by the server, no reachable servers and injected db faults
+func Unreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, faults.ErrInjected) {
+		return true
+	}
+	// mgo has no error values for these
+	return strings.HasPrefix(err.Error(), "no reachable servers")
+}
+
+// mapErr converts errors returned by mgo to the errors of this package. Errors the driver
+// returns without reaching the server are UnavailableErrors, all others are returned
+// unchanged.
+func mapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	if Unreachable(err) {
+		return &UnavailableError{Err: err}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/pogointel/opm/internal/faults"
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2"
+)
+
+func TestMapErr(t *testing.T) {
+	parseErr := func() error { _, err := strconv.ParseInt("soon", 10, 64); return err }()
+	queryErr := &mgo.QueryError{Code: 2, Message: "bad query"}
+	tests := []struct {
+		name        string
+		err         error
+		is          error // nil = returned unchanged
+		unavailable bool
+	}{
+		{"not found", mgo.ErrNotFound, ErrNotFound, false},
+		{"duplicate key", &mgo.LastError{Code: 11000, Err: "E11000 duplicate key"}, ErrDuplicate, false},
+		{"duplicate in bulk", &mgo.QueryError{Code: 11001}, ErrDuplicate, false},
+		{"query error", queryErr, nil, false},
+		{"parse error", parseErr, nil, false},
+		{"other error", errors.New("something else"), nil, false},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ErrUnavailable, true},
+		{"closed by the server", io.EOF, ErrUnavailable, true},
+		{"no servers", errors.New("no reachable servers"), ErrUnavailable, true},
+		{"injected", faults.ErrInjected, ErrUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mapErr(tt.err)
+			if tt.is == nil {
+				if got != tt.err {
+					t.Errorf("mapErr = %v, want the error unchanged", got)
+				}
+			} else if !errors.Is(got, tt.is) {
+				t.Errorf("mapErr = %v, want %v", got, tt.is)
+			}
+			if errors.Is(got, ErrUnavailable) != tt.unavailable {
+				t.Errorf("mapErr = %v, unavailable = %v, want %v", got, !tt.unavailable, tt.unavailable)
+			}
+		})
+	}
+	if mapErr(nil) != nil {
+		t.Error("mapErr(nil) != nil")
+	}
+	var unavailable *UnavailableError
+	if err := mapErr(io.EOF); !errors.As(err, &unavailable) || !errors.Is(err, io.EOF) {
+		t.Errorf("mapErr(io.EOF) = %v, want an UnavailableError wrapping io.EOF", err)
+	}
+}
+
+// TestMethodErrors checks the error mapping of the methods for their common failures
+func TestMethodErrors(t *testing.T) {
+	db := testDB(t)
+	if _, err := db.GetAccount(); !errors.Is(err, ErrNoAccountAvailable) {
+		t.Errorf("GetAccount without accounts = %v, want ErrNoAccountAvailable", err)
+	}
+	if _, err := db.GetProxy(); !errors.Is(err, ErrNoProxyAvailable) {
+		t.Errorf("GetProxy without proxies = %v, want ErrNoProxyAvailable", err)
+	}
+	if _, err := db.GetObject("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetObject of a missing object = %v, want ErrNotFound", err)
+	}
+	if _, err := db.GetAPIKey("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAPIKey of a missing key = %v, want ErrNotFound", err)
+	}
+	a := opm.Account{Username: "ash", Password: "pw", Provider: "ptc"}
+	if err := db.AddAccount(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddAccount(a); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("AddAccount of a known account = %v, want ErrDuplicate", err)
+	}
+	if _, err := db.BatchAccountAction([]string{"ash"}, opm.AccountActionSetCooldown, "soon"); err == nil || errors.Is(err, ErrUnavailable) {
+		t.Errorf("BatchAccountAction with an invalid cooldown = %v, want a parse error", err)
+	}
+}
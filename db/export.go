@@ -0,0 +1,125 @@
+package db
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AccountFilter selects accounts for list and export queries. Nil fields match everything.
+type AccountFilter struct {
+	Used           *bool
+	Banned         *bool
+	CaptchaFlagged *bool
+	Pool           string
+}
+
+// ProxyFilter selects proxies for list and export queries. Nil fields match everything.
+type ProxyFilter struct {
+	Use  *bool
+	Dead *bool
+}
+
+// ParseAccountFilter reads an AccountFilter from the used, banned, captchaflagged and pool parameters
+func ParseAccountFilter(v url.Values) (AccountFilter, error) {
+	var f AccountFilter
+	var err error
+	if f.Used, err = parseBoolParam(v, "used"); err != nil {
+		return f, err
+	}
+	if f.Banned, err = parseBoolParam(v, "banned"); err != nil {
+		return f, err
+	}
+	if f.CaptchaFlagged, err = parseBoolParam(v, "captchaflagged"); err != nil {
+		return f, err
+	}
+	f.Pool = v.Get("pool")
+	return f, nil
+}
+
+// ParseProxyFilter reads a ProxyFilter from the use and dead parameters
+func ParseProxyFilter(v url.Values) (ProxyFilter, error) {
+	var f ProxyFilter
+	var err error
+	if f.Use, err = parseBoolParam(v, "use"); err != nil {
+		return f, err
+	}
+	f.Dead, err = parseBoolParam(v, "dead")
+	return f, err
+}
+
+func parseBoolParam(v url.Values, name string) (*bool, error) {
+	s := v.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (f AccountFilter) query() bson.M {
+	q := bson.M{}
+	if f.Used != nil {
+		q["used"] = *f.Used
+	}
+	if f.Banned != nil {
+		q["banned"] = *f.Banned
+	}
+	if f.CaptchaFlagged != nil {
+		q["captchaflagged"] = *f.CaptchaFlagged
+	}
+	if f.Pool != "" {
+		q["pool"] = f.Pool
+	}
+	return q
+}
+
+func (f ProxyFilter) query() bson.M {
+	q := bson.M{}
+	if f.Use != nil {
+		q["use"] = *f.Use
+	}
+	if f.Dead != nil {
+		q["dead"] = *f.Dead
+	}
+	return q
+}
+
+// EachAccount calls fn for every account matching the filter, sorted by username.
+// Iteration stops at the first error returned by fn.
+func (db *OpenMapDb) EachAccount(f AccountFilter, fn func(opm.Account) error) error {
+	session := db.readSession()
+	defer session.Close()
+	iter := session.DB(db.DbName).C(db.Collections.Accounts).Find(f.query()).Sort("username").Iter()
+	var a opm.Account
+	for iter.Next(&a) {
+		if err := fn(a); err != nil {
+			iter.Close()
+			return err
+		}
+		a = opm.Account{}
+	}
+	return mapErr(iter.Close())
+}
+
+// EachProxy calls fn for every proxy matching the filter, sorted by id.
+// Iteration stops at the first error returned by fn.
+func (db *OpenMapDb) EachProxy(f ProxyFilter, fn func(opm.Proxy) error) error {
+	session := db.readSession()
+	defer session.Close()
+	iter := session.DB(db.DbName).C(db.Collections.Proxy).Find(f.query()).Sort("id").Iter()
+	var p opm.Proxy
+	for iter.Next(&p) {
+		if err := fn(p); err != nil {
+			iter.Close()
+			return err
+		}
+		p = opm.Proxy{}
+	}
+	return mapErr(iter.Close())
+}
@@ -0,0 +1,4 @@
+package db
+
+// TestDB is testDB for the tests of package db_test
+var TestDB = testDB
@@ -0,0 +1,281 @@
+package db
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"golang.org/x/net/context"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Ingest formats
+const (
+	IngestNDJSON = "ndjson"
+	IngestCSV    = "csv"
+)
+
+// defaultIngestBatch is the number of records written per bulk operation
+const defaultIngestBatch = 1000
+
+// IngestOptions are optional settings for BulkIngest
+type IngestOptions struct {
+	BatchSize int // records per bulk write, 0 = default
+	Skip      int // records to skip, e.g. those of an interrupted run
+	Total     int // number of records for the progress callback, if known
+	// Pokemon that already expired are archived in the Sightings collection directly
+	ArchiveExpired bool
+}
+
+// IngestResult counts the records of a BulkIngest
+type IngestResult struct {
+	Done    int // records processed, including skipped ones
+	Written int // records written, duplicates included
+	Invalid int // records that could not be parsed or had invalid coordinates
+}
+
+// ingestRecord is a record of an ingest file. SeenAt is optional.
+type ingestRecord struct {
+	opm.MapObject
+	SeenAt int64 `json:"seenAt"`
+}
+
+// BulkIngest imports map objects from another scanner. Every NDJSON line is a map object as
+// returned by /cache, CSV files have a header with the same field names. Records are written in
+// unordered batches, duplicates are skipped. progress is called after every batch, the Done
+// count of the last call can be passed as Skip to resume an interrupted import.
+// Records without seenAt use their expiry if it is in the past, the current time otherwise.
+func (db *OpenMapDb) BulkIngest(ctx context.Context, r io.Reader, format string, progress func(done, total int), options ...IngestOptions) (IngestResult, error) {
+	var o IngestOptions
+	if len(options) > 0 {
+		o = options[0]
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultIngestBatch
+	}
+	var next func() (ingestRecord, error)
+	switch format {
+	case IngestNDJSON:
+		next = ndjsonRecords(r)
+	case IngestCSV:
+		var err error
+		next, err = csvRecords(r)
+		if err != nil {
+			return IngestResult{}, err
+		}
+	default:
+		return IngestResult{}, opm.ErrUnknownFormat
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	b := db.newIngestBatch(session, o.ArchiveExpired)
+	var result IngestResult
+	now := opm.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		result.Done++
+		if result.Done <= o.Skip {
+			continue
+		}
+		if err != nil {
+			result.Invalid++
+			continue
+		}
+		m := rec.MapObject
+		m.Lat, m.Lng, err = db.normalizeCoordinates(m.Lat, m.Lng)
+		if err != nil || m.ID == "" {
+			result.Invalid++
+			continue
+		}
+		seenAt := rec.SeenAt
+		if seenAt == 0 {
+			seenAt = now.Unix()
+			if opm.Expired(m.Expiry, now) {
+				seenAt = m.Expiry
+			}
+		}
+		b.add(m, seenAt, now)
+		result.Written++
+		if b.n >= o.BatchSize {
+			if err := b.run(); err != nil {
+				return result, err
+			}
+			b = db.newIngestBatch(session, o.ArchiveExpired)
+			if progress != nil {
+				progress(result.Done, o.Total)
+			}
+		}
+	}
+	if err := b.run(); err != nil {
+		return result, err
+	}
+	if progress != nil {
+		progress(result.Done, o.Total)
+	}
+	return result, nil
+}
+
+// ingestBatch collects the writes of one batch for the Objects and Sightings collections
+type ingestBatch struct {
+	objects        *mgo.Bulk
+	sightings      *mgo.Bulk
+	archiveExpired bool
+	leagues        []opm.League
+	n              int
+}
+
+func (db *OpenMapDb) newIngestBatch(session *mgo.Session, archiveExpired bool) *ingestBatch {
+	b := &ingestBatch{
+		objects:        session.DB(db.DbName).C(db.Collections.Objects).Bulk(),
+		sightings:      session.DB(db.DbName).C(db.Collections.Sightings).Bulk(),
+		archiveExpired: archiveExpired,
+		leagues:        db.Leagues,
+	}
+	b.objects.Unordered()
+	b.sightings.Unordered()
+	return b
+}
+
+func (b *ingestBatch) add(m opm.MapObject, seenAt int64, now time.Time) {
+	b.n++
+	o := newObject(m, nil, b.leagues)
+	o.SeenAt = seenAt
+	switch {
+	case o.Type != opm.POKEMON:
+		b.objects.Upsert(bson.M{"id": o.ID}, o)
+	case b.archiveExpired && opm.Expired(o.Expiry, now):
+		b.sightings.Upsert(bson.M{"id": o.ID}, sighting{
+			PokemonID: o.PokemonID,
+			ID:        o.ID,
+			Loc:       o.Loc,
+			Expiry:    o.Expiry,
+			LureType:  o.LureType,
+			LuredBy:   o.LuredBy,
+			SeenAt:    o.SeenAt,
+		})
+	default:
+		b.objects.Insert(o)
+	}
+}
+
+// run writes the batch. Duplicate Pokemon are not an error.
+func (b *ingestBatch) run() error {
+	if b.n == 0 {
+		return nil
+	}
+	for _, bulk := range []*mgo.Bulk{b.objects, b.sightings} {
+		_, err := bulk.Run()
+		if err != nil && !mgo.IsDup(err) {
+			return mapErr(err)
+		}
+	}
+	return nil
+}
+
+func ndjsonRecords(r io.Reader) func() (ingestRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return func() (ingestRecord, error) {
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var rec ingestRecord
+			err := json.Unmarshal([]byte(line), &rec)
+			return rec, err
+		}
+		if err := scanner.Err(); err != nil {
+			return ingestRecord{}, err
+		}
+		return ingestRecord{}, io.EOF
+	}
+}
+
+// csvRecords reads records with a header of map object field names (see opm.MapObject)
+func csvRecords(r io.Reader) (func() (ingestRecord, error), error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, required := range []string{"type", "id", "lat", "lng"} {
+		if _, ok := columns[required]; !ok {
+			return nil, errors.New("Missing column " + required)
+		}
+	}
+	return func() (ingestRecord, error) {
+		row, err := cr.Read()
+		if err != nil {
+			return ingestRecord{}, err
+		}
+		var rec ingestRecord
+		var perr error
+		get := func(name string) string {
+			if i, ok := columns[strings.ToLower(name)]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		atoi := func(name string) int {
+			v := get(name)
+			if v == "" {
+				return 0
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				perr = err
+			}
+			return n
+		}
+		atoi64 := func(name string) int64 {
+			v := get(name)
+			if v == "" {
+				return 0
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				perr = err
+			}
+			return n
+		}
+		atof := func(name string) float64 {
+			n, err := strconv.ParseFloat(get(name), 64)
+			if err != nil {
+				perr = err
+			}
+			return n
+		}
+		rec.Type = atoi("type")
+		rec.ID = get("id")
+		rec.Lat = atof("lat")
+		rec.Lng = atof("lng")
+		rec.PokemonID = atoi("pokemonID")
+		rec.Expiry = atoi64("expiry")
+		rec.Lured = get("lured") == "true"
+		rec.LureType = get("lureType")
+		rec.LuredBy = get("luredBy")
+		rec.Team = atoi("team")
+		rec.Source = get("source")
+		rec.SeenAt = atoi64("seenAt")
+		return rec, perr
+	}, nil
+}
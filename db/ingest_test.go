@@ -0,0 +1,149 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"golang.org/x/net/context"
+)
+
+func TestNDJSONRecords(t *testing.T) {
+	next := ndjsonRecords(strings.NewReader(`{"type":1,"id":"p1","lat":52.5,"lng":13.4,"seenAt":10}
+
+{"type":1,"id":
+{"type":3,"id":"g1","lat":1,"lng":2}
+`))
+	rec, err := next()
+	if err != nil || rec.ID != "p1" || rec.SeenAt != 10 || rec.Lat != 52.5 {
+		t.Errorf("first record = %+v, %v", rec, err)
+	}
+	// Empty lines are skipped, broken ones are an error of their own record
+	if _, err := next(); err == nil {
+		t.Error("broken line didn't fail")
+	}
+	if rec, err := next(); err != nil || rec.ID != "g1" {
+		t.Errorf("record after the broken line = %+v, %v", rec, err)
+	}
+	if _, err := next(); err != io.EOF {
+		t.Errorf("end = %v, want io.EOF", err)
+	}
+}
+
+func TestCSVRecords(t *testing.T) {
+	next, err := csvRecords(strings.NewReader("ID,Type,Lat,Lng,PokemonID,Expiry,Lured,LureType\np1,1,52.5,13.4,16,1500000000,,\ns1,2,1,2,,,true,glacial\np2,1,north,13.4,16,,,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := next()
+	if err != nil || rec.ID != "p1" || rec.Type != opm.POKEMON || rec.PokemonID != 16 || rec.Expiry != 1500000000 || rec.Lng != 13.4 {
+		t.Errorf("first record = %+v, %v", rec, err)
+	}
+	if rec, err := next(); err != nil || !rec.Lured || rec.LureType != "glacial" {
+		t.Errorf("lured stop = %+v, %v", rec, err)
+	}
+	if _, err := next(); err == nil {
+		t.Error("record with an invalid latitude didn't fail")
+	}
+	if _, err := next(); err != io.EOF {
+		t.Errorf("end = %v, want io.EOF", err)
+	}
+	if _, err := csvRecords(strings.NewReader("id,lat,lng\n")); err == nil {
+		t.Error("header without type didn't fail")
+	}
+}
+
+func TestBulkIngest(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	var lines []string
+	for i := 0; i < 5; i++ {
+		lines = append(lines, fmt.Sprintf(`{"type":1,"id":"p%d","pokemonID":16,"lat":52.5,"lng":13.4,"expiry":%d}`, i, now.Add(10*time.Minute).Unix()))
+	}
+	lines = append(lines,
+		`{"type":1,"id":"p0","pokemonID":16,"lat":52.5,"lng":13.4}`,
+		fmt.Sprintf(`{"type":1,"id":"old","pokemonID":19,"lat":52.5,"lng":13.4,"expiry":%d}`, now.Add(-time.Hour).Unix()),
+		`{"type":3,"id":"g1","lat":52.5,"lng":13.4,"team":1}`,
+		`{"type":3,"id":"g1","lat":52.5,"lng":13.4,"team":2}`,
+		`{"type":1,"id":"far","lat":91,"lng":13.4}`,
+		`not json`,
+	)
+	var calls [][2]int
+	progress := func(done, total int) { calls = append(calls, [2]int{done, total}) }
+	result, err := db.BulkIngest(context.Background(), strings.NewReader(strings.Join(lines, "\n")), IngestNDJSON, progress, IngestOptions{BatchSize: 4, Total: 11, ArchiveExpired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Done != 11 || result.Written != 9 || result.Invalid != 2 {
+		t.Errorf("result = %+v, want 11 done, 9 written and 2 invalid", result)
+	}
+	if len(calls) != 3 || calls[0] != [2]int{4, 11} || calls[2] != [2]int{11, 11} {
+		t.Errorf("progress calls = %v, want one per batch", calls)
+	}
+	if g, err := db.GetObject("g1"); err != nil || g.Team != 2 {
+		t.Errorf("gym = %+v, %v, want the last record", g, err)
+	}
+	// The duplicate didn't keep the rest of its batch from being written
+	for _, id := range []string{"p0", "p3", "p4"} {
+		if _, err := db.GetObject(id); err != nil {
+			t.Errorf("GetObject(%s) = %v", id, err)
+		}
+	}
+	if _, err := db.GetObject("old"); err == nil {
+		t.Error("expired Pokemon was stored as a map object, want a sighting")
+	}
+	sightings, err := db.GetRecentSightings(19, 10)
+	if err != nil || len(sightings) != 1 || sightings[0].ID != "old" {
+		t.Errorf("sightings = %+v, %v, want the expired Pokemon", sightings, err)
+	}
+
+	// Resuming skips the records of the interrupted run
+	result, err = db.BulkIngest(context.Background(), strings.NewReader(strings.Join(lines, "\n")), IngestNDJSON, nil, IngestOptions{Skip: 10})
+	if err != nil || result.Done != 11 || result.Written != 0 || result.Invalid != 1 {
+		t.Errorf("resumed result = %+v, %v, want only the last record", result, err)
+	}
+	if _, err := db.BulkIngest(context.Background(), strings.NewReader(""), "xml", nil); err != opm.ErrUnknownFormat {
+		t.Errorf("unknown format = %v, want opm.ErrUnknownFormat", err)
+	}
+}
+
+// ingestDump returns n Pokemon as NDJSON
+func ingestDump(n int) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := 0; i < n; i++ {
+		enc.Encode(testPokemon(fmt.Sprintf("p%d", i)))
+	}
+	return buf.Bytes()
+}
+
+// The bulk path against AddMapObject, run with -bench Ingest and OPM_TEST_MONGO
+
+func BenchmarkBulkIngest(b *testing.B) {
+	db := testDB(b)
+	dump := ingestDump(b.N)
+	b.ResetTimer()
+	if _, err := db.BulkIngest(context.Background(), bytes.NewReader(dump), IngestNDJSON, nil); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkSingleInsertIngest(b *testing.B) {
+	db := testDB(b)
+	next := ndjsonRecords(bytes.NewReader(ingestDump(b.N)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec, err := next()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := db.AddMapObject(rec.MapObject); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// schemaID is the _id of the SchemaVersion document in the Schema collection
+const schemaID = "schema"
+
+// SchemaVersion records which migrations ran on the database
+type SchemaVersion struct {
+	ID      string `bson:"_id"`
+	Version int
+	// Unix time of the last migration
+	UpdatedAt int64
+}
+
+// migration brings stored documents up to date with a schema change. Run returns the
+// number of changed documents and has to be idempotent: a migration that was interrupted
+// runs again from the start.
+type migration struct {
+	name string
+	run  func(db *OpenMapDb, session *mgo.Session) (int, error)
+}
+
+// migrations are applied in order, the schema version is the number of applied migrations.
+// Only append to this list.
+var migrations = []migration{
+	{"backfill_banned_at", migrateBannedAt},
+	{"legacy_proxies", migrateLegacyProxies},
+	{"object_loc", migrateObjectLoc},
+}
+
+// SchemaVersion returns the stored schema version of the database
+func (db *OpenMapDb) SchemaVersion() (SchemaVersion, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return db.schemaVersion(session)
+}
+
+func (db *OpenMapDb) schemaVersion(session *mgo.Session) (SchemaVersion, error) {
+	var v SchemaVersion
+	err := session.DB(db.DbName).C(db.Collections.Schema).FindId(schemaID).One(&v)
+	if err == mgo.ErrNotFound {
+		return SchemaVersion{ID: schemaID}, nil
+	}
+	return v, mapErr(err)
+}
+
+// Migrate runs all migrations newer than the stored schema version and returns the names
+// of the applied migrations with the number of changed documents.
+func (db *OpenMapDb) Migrate() (applied []string, err error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	v, err := db.schemaVersion(session)
+	if err != nil {
+		return nil, err
+	}
+	if v.Version > len(migrations) {
+		return nil, fmt.Errorf("Schema version %d is newer than this build (%d)", v.Version, len(migrations))
+	}
+	for i := v.Version; i < len(migrations); i++ {
+		m := migrations[i]
+		changed, err := m.run(db, session)
+		if err != nil {
+			return applied, fmt.Errorf("Migration %s: %s", m.name, err)
+		}
+		_, err = session.DB(db.DbName).C(db.Collections.Schema).UpsertId(schemaID, bson.M{"$set": bson.M{"version": i + 1, "updatedat": time.Now().Unix()}})
+		if err != nil {
+			return applied, mapErr(err)
+		}
+		log.Printf("Applied migration %s (%d changed)", m.name, changed)
+		applied = append(applied, fmt.Sprintf("%s (%d changed)", m.name, changed))
+	}
+	return applied, nil
+}
+
+// migrateBannedAt sets the ban time of accounts that were banned before it was recorded.
+// The time of the migration is the best guess we have.
+func migrateBannedAt(db *OpenMapDb, session *mgo.Session) (int, error) {
+	change, err := session.DB(db.DbName).C(db.Collections.Accounts).UpdateAll(
+		bson.M{"banned": true, "bannedat": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"bannedat": time.Now().Unix()}})
+	if err != nil {
+		return 0, mapErr(err)
+	}
+	return change.Updated, nil
+}
+
+// migrateLegacyProxies fills the flags of proxies stored before they were written and
+// removes empty credentials, so legacy documents look like the ones written today.
+// Proxies without use or dead flags are never handed out by GetProxy.
+func migrateLegacyProxies(db *OpenMapDb, session *mgo.Session) (int, error) {
+	c := session.DB(db.DbName).C(db.Collections.Proxy)
+	var legacy []bson.M
+	for _, field := range []string{"use", "dead"} {
+		legacy = append(legacy, bson.M{field: bson.M{"$exists": false}})
+	}
+	for _, field := range []string{"url", "username", "password"} {
+		legacy = append(legacy, bson.M{field: bson.M{"$exists": true, "$in": []interface{}{nil, ""}}})
+	}
+	legacy = append(legacy, bson.M{"lastcheck": bson.M{"$exists": true, "$in": []interface{}{nil, 0}}})
+	iter := c.Find(bson.M{"$or": legacy}).Iter()
+	var doc bson.M
+	changed := 0
+	for iter.Next(&doc) {
+		set, unset := bson.M{}, bson.M{}
+		for _, field := range []string{"use", "dead"} {
+			if _, ok := doc[field]; !ok {
+				set[field] = false
+			}
+		}
+		for _, field := range []string{"url", "username", "password", "lastcheck"} {
+			if v, ok := doc[field]; ok && emptyProxyField(field, v) {
+				unset[field] = ""
+			}
+		}
+		update := bson.M{}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		if err := c.UpdateId(doc["_id"], update); err != nil {
+			iter.Close()
+			return changed, mapErr(err)
+		}
+		changed++
+		doc = nil
+	}
+	return changed, mapErr(iter.Close())
+}
+
+// emptyProxyField reports whether a stored proxy field is null, or "" for the credentials
+// and 0 for lastcheck. migrateLegacyProxies removes these values.
+func emptyProxyField(field string, v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	if field != "lastcheck" {
+		return v == ""
+	}
+	switch v := v.(type) {
+	case int:
+		return v == 0
+	case int64:
+		return v == 0
+	case float64:
+		return v == 0
+	}
+	return false
+}
+
+// migrateObjectLoc moves the coordinates of objects stored with plain lat and lng fields
+// to loc, so the geo queries find them. Documents without any coordinates are left to
+// NormalizeObjects.
+func migrateObjectLoc(db *OpenMapDb, session *mgo.Session) (int, error) {
+	c := session.DB(db.DbName).C(db.Collections.Objects)
+	iter := c.Find(bson.M{
+		"loc": bson.M{"$exists": false},
+		"lat": bson.M{"$exists": true},
+		"lng": bson.M{"$exists": true},
+	}).Select(bson.M{"lat": 1, "lng": 1}).Iter()
+	var doc struct {
+		ObjectID bson.ObjectId `bson:"_id"`
+		Lat      float64
+		Lng      float64
+	}
+	changed := 0
+	for iter.Next(&doc) {
+		err := c.UpdateId(doc.ObjectID, bson.M{
+			"$set":   bson.M{"loc": location{Type: "Point", Coordinates: []float64{doc.Lng, doc.Lat}}},
+			"$unset": bson.M{"lat": "", "lng": ""},
+		})
+		if err != nil {
+			iter.Close()
+			return changed, mapErr(err)
+		}
+		changed++
+	}
+	return changed, mapErr(iter.Close())
+}
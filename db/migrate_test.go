@@ -0,0 +1,64 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := testDB(t)
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	insert := func(collection string, docs ...bson.M) {
+		t.Helper()
+		for _, d := range docs {
+			if err := session.DB(db.DbName).C(collection).Insert(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// One document per collection needs each migration, the others are up to date
+	insert(db.Collections.Accounts,
+		bson.M{"username": "legacy", "banned": true},
+		bson.M{"username": "banned", "banned": true, "bannedat": int64(1000)},
+		bson.M{"username": "active", "banned": false})
+	insert(db.Collections.Proxy,
+		bson.M{"id": int64(1), "url": "", "username": "", "lastcheck": 0},
+		bson.M{"id": int64(2), "use": true, "dead": false, "url": "http://p2", "lastcheck": int64(1000)},
+		bson.M{"id": int64(3), "use": false, "dead": false})
+	insert(db.Collections.Objects,
+		bson.M{"id": "legacy", "type": 1, "lat": 52.5, "lng": 13.4},
+		bson.M{"id": "current", "type": 1, "loc": bson.M{"type": "Point", "coordinates": []float64{13.4, 52.5}}})
+
+	applied, err := db.Migrate()
+	want := "[backfill_banned_at (1 changed) legacy_proxies (1 changed) object_loc (1 changed)]"
+	if err != nil || fmt.Sprint(applied) != want {
+		t.Fatalf("Migrate = %v, %v, want %s", applied, err, want)
+	}
+	if v, err := db.SchemaVersion(); err != nil || v.Version != len(migrations) {
+		t.Errorf("SchemaVersion = %+v, %v, want version %d", v, err, len(migrations))
+	}
+	if applied, err := db.Migrate(); err != nil || len(applied) != 0 {
+		t.Errorf("second Migrate = %v, %v, want nothing applied", applied, err)
+	}
+	var legacy bson.M
+	if err := session.DB(db.DbName).C(db.Collections.Proxy).Find(bson.M{"id": 1}).One(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) != 4 || legacy["use"] != false || legacy["dead"] != false {
+		t.Errorf("migrated proxy = %v, want the flags without the empty fields", legacy)
+	}
+	var account bson.M
+	if err := session.DB(db.DbName).C(db.Collections.Accounts).Find(bson.M{"username": "banned"}).One(&account); err != nil || account["bannedat"] != int64(1000) {
+		t.Errorf("banned account = %v, %v, want the recorded ban time kept", account, err)
+	}
+
+	// Interrupted migrations run again from the start and change nothing the second time
+	for _, m := range migrations {
+		if changed, err := m.run(db, session); err != nil || changed != 0 {
+			t.Errorf("migration %s again = %d changed, %v, want 0", m.name, changed, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// served returns the ids of the Pokemon GetMapObjects returns around testPokemon
+func served(t *testing.T, db *OpenMapDb) map[string]bool {
+	t.Helper()
+	objects, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, o := range objects {
+		ids[o.ID] = true
+	}
+	return ids
+}
+
+func TestRescanMissesSuppressPokemon(t *testing.T) {
+	db := testDB(t)
+	db.SuppressAfterMisses = 2
+	for _, id := range []string{"gone", "there", "flaky"} {
+		if err := db.AddMapObject(testPokemon(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Scans that started after the Pokemon were stored
+	rescan := func(seen ...string) {
+		t.Helper()
+		if _, err := db.RecordMisses(52.5, 13.4, 100, time.Now().Unix()+1, seen); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rescan("there")
+	if got := served(t, db); !got["gone"] || !got["there"] || !got["flaky"] {
+		t.Fatalf("served %v after one miss, want all", got)
+	}
+	// Seen again, the miss of flaky was wrong
+	rescan("there", "flaky")
+	rescan("there")
+	got := served(t, db)
+	if got["gone"] {
+		t.Error("gone is still served after two misses")
+	}
+	if !got["there"] || !got["flaky"] {
+		t.Errorf("served %v, want there and flaky", got)
+	}
+	// Flagged, not deleted
+	if _, err := db.GetObject("gone"); err != nil {
+		t.Errorf("GetObject of the suppressed Pokemon = %v, want it kept", err)
+	}
+
+	// A scan that started before a Pokemon was stored says nothing about it
+	if err := db.AddMapObject(testPokemon("new")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.RecordMisses(52.5, 13.4, 100, time.Now().Unix()-60, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !served(t, db)["new"] {
+		t.Error("new is suppressed by scans that started before it was stored")
+	}
+}
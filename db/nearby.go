@@ -0,0 +1,47 @@
+package db
+
+import (
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// nearbyTTL is how long nearby Pokemon are kept for triangulation
+const nearbyTTL = time.Hour
+
+type nearby struct {
+	EncounterID string
+	PokemonID   int
+	FortID      string
+	Distance    float64
+	Loc         location // scan location
+	SeenAt      int64
+	ExpiresAt   time.Time // used by the TTL index
+}
+
+// AddNearby records nearby Pokemon, one document per encounter and fort. Repeated reports
+// update the scan location and distance, so the latest one is kept.
+func (db *OpenMapDb) AddNearby(pokemon []opm.NearbyPokemon) error {
+	if len(pokemon) == 0 {
+		return nil
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	bulk := session.DB(db.DbName).C(db.Collections.Nearby).Bulk()
+	bulk.Unordered()
+	for _, p := range pokemon {
+		n := nearby{
+			EncounterID: p.EncounterID,
+			PokemonID:   p.PokemonID,
+			FortID:      p.FortID,
+			Distance:    p.Distance,
+			Loc:         location{Type: "Point", Coordinates: []float64{p.Lng, p.Lat}},
+			SeenAt:      p.SeenAt,
+			ExpiresAt:   time.Unix(p.SeenAt, 0).Add(nearbyTTL),
+		}
+		bulk.Upsert(bson.M{"encounterid": n.EncounterID, "fortid": n.FortID}, n)
+	}
+	_, err := bulk.Run()
+	return mapErr(err)
+}
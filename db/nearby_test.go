@@ -0,0 +1,32 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAddNearbyKeepsLatestReport(t *testing.T) {
+	db := testDB(t)
+	first := opm.NearbyPokemon{EncounterID: "5", PokemonID: 147, FortID: "stop1", Lat: 52.5, Lng: 13.4, SeenAt: 1500000000}
+	later := first
+	later.Lat, later.SeenAt = 52.6, first.SeenAt+60
+	other := opm.NearbyPokemon{EncounterID: "5", PokemonID: 147, FortID: "stop2", Lat: 52.5, Lng: 13.4, SeenAt: 1500000000}
+	if err := db.AddNearby([]opm.NearbyPokemon{first, other}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddNearby([]opm.NearbyPokemon{later}); err != nil {
+		t.Fatal(err)
+	}
+	var stored []nearby
+	if err := db.mongoSession.DB(db.DbName).C(db.Collections.Nearby).Find(bson.M{"encounterid": "5"}).Sort("fortid").All(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || stored[0].SeenAt != later.SeenAt || stored[0].Loc.Coordinates[1] != 52.6 {
+		t.Errorf("stored = %+v, want one document per fort with the latest report", stored)
+	}
+	if err := db.AddNearby(nil); err != nil {
+		t.Errorf("AddNearby(nil) = %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"log"
+	"math"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrInvalidCoordinates is returned when an object with invalid coordinates should be stored
+var ErrInvalidCoordinates = opm.ErrInvalidCoordinates
+
+// coordinatePrecision is the number of decimal places coordinates are rounded to
+const coordinatePrecision = 6
+
+func roundCoordinate(v float64) float64 {
+	p := math.Pow(10, coordinatePrecision)
+	return math.Round(v*p) / p
+}
+
+func validCoordinates(lat, lng float64) bool {
+	if math.IsNaN(lat) || math.IsNaN(lng) {
+		return false
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return false
+	}
+	// Null island
+	return lat != 0 || lng != 0
+}
+
+// normalizeCoordinates rounds and validates a coordinate pair. If geofence areas exist and
+// only the swapped pair falls inside one of them, the pair is swapped back (or rejected).
+func (db *OpenMapDb) normalizeCoordinates(lat, lng float64) (float64, float64, error) {
+	lat, lng = roundCoordinate(lat), roundCoordinate(lng)
+	fences := db.geofences()
+	if len(fences) == 0 {
+		if !validCoordinates(lat, lng) {
+			return lat, lng, ErrInvalidCoordinates
+		}
+		return lat, lng, nil
+	}
+	if validCoordinates(lat, lng) && insideAny(fences, lat, lng) {
+		return lat, lng, nil
+	}
+	if validCoordinates(lng, lat) && insideAny(fences, lng, lat) {
+		if !db.FixSwappedCoordinates {
+			log.Printf("Rejecting swapped coordinates %f,%f", lat, lng)
+			return lat, lng, ErrInvalidCoordinates
+		}
+		log.Printf("Fixing swapped coordinates %f,%f", lat, lng)
+		return lng, lat, nil
+	}
+	if !validCoordinates(lat, lng) {
+		return lat, lng, ErrInvalidCoordinates
+	}
+	return lat, lng, nil
+}
+
+func insideAny(boxes []opm.BoundingBox, lat, lng float64) bool {
+	for _, b := range boxes {
+		if b.Contains(lat, lng) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeObjects re-normalizes the coordinates of all stored objects in batches.
+// It returns the number of updated and removed objects. Removed objects are left as tombstones.
+func (db *OpenMapDb) NormalizeObjects(batchSize int) (int, int, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	c := session.DB(db.DbName).C(db.Collections.Objects)
+	updated, removed := 0, 0
+	lastID := bson.ObjectId("")
+	for {
+		q := bson.M{"deleted": notDeleted}
+		if lastID != "" {
+			q["_id"] = bson.M{"$gt": lastID}
+		}
+		var docs []struct {
+			ObjectID bson.ObjectId `bson:"_id"`
+			object   `bson:",inline"`
+		}
+		err := c.Find(q).Sort("_id").Limit(batchSize).All(&docs)
+		if err != nil {
+			return updated, removed, mapErr(err)
+		}
+		if len(docs) == 0 {
+			return updated, removed, nil
+		}
+		for _, d := range docs {
+			lastID = d.ObjectID
+			if len(d.Loc.Coordinates) != 2 {
+				db.quarantine(d.mapObject(), ErrInvalidCoordinates)
+				err = c.UpdateId(d.ObjectID, tombstone())
+				if err == nil {
+					removed++
+				}
+				continue
+			}
+			lng, lat := d.Loc.Coordinates[0], d.Loc.Coordinates[1]
+			nLat, nLng, err := db.normalizeCoordinates(lat, lng)
+			if err != nil {
+				db.quarantine(d.mapObject(), err)
+				err = c.UpdateId(d.ObjectID, tombstone())
+				if err == nil {
+					removed++
+				}
+				continue
+			}
+			if nLat == lat && nLng == lng {
+				continue
+			}
+			err = c.UpdateId(d.ObjectID, bson.M{"$set": bson.M{"loc.coordinates": []float64{nLng, nLat}}})
+			if err != nil {
+				return updated, removed, mapErr(err)
+			}
+			updated++
+		}
+	}
+}
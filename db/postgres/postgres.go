@@ -0,0 +1,371 @@
+// Package postgres implements opm.Database on PostgreSQL with PostGIS.
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// schema creates the tables on startup. Accounts and proxies are added with plain SQL.
+var schema = []string{
+	`CREATE EXTENSION IF NOT EXISTS postgis`,
+	`CREATE TABLE IF NOT EXISTS objects (
+		id               text PRIMARY KEY,
+		type             integer NOT NULL,
+		pokemon_id       integer NOT NULL DEFAULT 0,
+		spawnpoint_id    text NOT NULL DEFAULT '',
+		loc              geography(Point, 4326) NOT NULL,
+		expiry           bigint NOT NULL DEFAULT 0,
+		lured            boolean NOT NULL DEFAULT false,
+		lure_type        text NOT NULL DEFAULT '',
+		lured_by         text NOT NULL DEFAULT '',
+		team             integer NOT NULL DEFAULT 0,
+		source           text NOT NULL DEFAULT '',
+		seen_at          bigint NOT NULL DEFAULT 0,
+		iv_attack        integer,
+		iv_defense       integer,
+		iv_stamina       integer,
+		iv_percent       double precision,
+		cp               integer NOT NULL DEFAULT 0,
+		move1            integer NOT NULL DEFAULT 0,
+		move2            integer NOT NULL DEFAULT 0,
+		gym_points       bigint NOT NULL DEFAULT 0,
+		guard_pokemon_id integer NOT NULL DEFAULT 0,
+		guard_pokemon_cp integer NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS objects_loc ON objects USING GIST (loc)`,
+	`CREATE INDEX IF NOT EXISTS objects_expiry ON objects (expiry)`,
+	`CREATE TABLE IF NOT EXISTS accounts (
+		username        text PRIMARY KEY,
+		password        text NOT NULL DEFAULT '',
+		provider        text NOT NULL DEFAULT 'ptc',
+		used            boolean NOT NULL DEFAULT false,
+		banned          boolean NOT NULL DEFAULT false,
+		banned_at       bigint NOT NULL DEFAULT 0,
+		captcha_flagged boolean NOT NULL DEFAULT false,
+		pool            text NOT NULL DEFAULT '',
+		cooldown_until  bigint NOT NULL DEFAULT 0,
+		auth_token      text NOT NULL DEFAULT '',
+		token_expired   boolean NOT NULL DEFAULT false
+	)`,
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS captcha_url text NOT NULL DEFAULT ''`,
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS captcha_at bigint NOT NULL DEFAULT 0`,
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS ban_reason text NOT NULL DEFAULT ''`,
+	`ALTER TABLE objects ADD COLUMN IF NOT EXISTS captured_at bigint NOT NULL DEFAULT 0`,
+	`ALTER TABLE objects ADD COLUMN IF NOT EXISTS iv_ranks jsonb`,
+	`CREATE TABLE IF NOT EXISTS proxies (
+		id         bigint PRIMARY KEY,
+		use        boolean NOT NULL DEFAULT false,
+		dead       boolean NOT NULL DEFAULT false,
+		url        text NOT NULL DEFAULT '',
+		username   text NOT NULL DEFAULT '',
+		password   text NOT NULL DEFAULT '',
+		last_check bigint NOT NULL DEFAULT 0
+	)`,
+}
+
+const objectColumns = `id, type, pokemon_id, spawnpoint_id, ST_Y(loc::geometry), ST_X(loc::geometry), expiry, lured, lure_type, lured_by,
+	team, source, seen_at, iv_attack, iv_defense, iv_stamina, iv_percent, cp, move1, move2, gym_points, guard_pokemon_id, guard_pokemon_cp, iv_ranks`
+
+const insertObject = `INSERT INTO objects (id, type, pokemon_id, spawnpoint_id, loc, expiry, lured, lure_type, lured_by, team, source, seen_at,
+	iv_attack, iv_defense, iv_stamina, iv_percent, cp, move1, move2, gym_points, guard_pokemon_id, guard_pokemon_cp, captured_at, iv_ranks)
+	VALUES ($1, $2, $3, $4, ST_SetSRID(ST_MakePoint($5, $6), 4326)::geography, $7, $8, $9, $10, $11, $12, $13,
+	$14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25)
+	ON CONFLICT (id)`
+
+// replaceObject replaces all columns of a fort, so a new owner doesn't keep the old details.
+// Only a newer observation replaces the stored one, racing scans can finish out of order.
+const replaceObject = `type = EXCLUDED.type, pokemon_id = EXCLUDED.pokemon_id, spawnpoint_id = EXCLUDED.spawnpoint_id, loc = EXCLUDED.loc,
+	expiry = EXCLUDED.expiry, lured = EXCLUDED.lured, lure_type = EXCLUDED.lure_type, lured_by = EXCLUDED.lured_by, team = EXCLUDED.team,
+	source = EXCLUDED.source, seen_at = EXCLUDED.seen_at, iv_attack = EXCLUDED.iv_attack, iv_defense = EXCLUDED.iv_defense,
+	iv_stamina = EXCLUDED.iv_stamina, iv_percent = EXCLUDED.iv_percent, cp = EXCLUDED.cp, move1 = EXCLUDED.move1, move2 = EXCLUDED.move2,
+	gym_points = EXCLUDED.gym_points, guard_pokemon_id = EXCLUDED.guard_pokemon_id, guard_pokemon_cp = EXCLUDED.guard_pokemon_cp,
+	captured_at = EXCLUDED.captured_at, iv_ranks = EXCLUDED.iv_ranks
+	WHERE objects.captured_at < EXCLUDED.captured_at`
+
+const accountColumns = `username, password, provider, used, banned, banned_at, captcha_flagged, pool, cooldown_until, auth_token, token_expired, captcha_url, captcha_at, ban_reason`
+
+const proxyColumns = `id, use, dead, url, username, password, last_check`
+
+// Database stores map objects, accounts and proxies in PostgreSQL. It returns the
+// errors of the db package, so callers don't depend on the backend.
+type Database struct {
+	sql *sql.DB
+	// Leagues whose ranks are stored with the IVs of Pokemon
+	Leagues []opm.League
+}
+
+var _ opm.Database = (*Database)(nil)
+
+// New connects to the database and creates the schema if needed
+func New(dsn string) (*Database, error) {
+	s, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := &Database{sql: s}
+	for _, stmt := range schema {
+		if _, err := s.Exec(stmt); err != nil {
+			s.Close()
+			return nil, mapErr(err)
+		}
+	}
+	return d, nil
+}
+
+// Close closes the connection pool
+func (d *Database) Close() error {
+	return d.sql.Close()
+}
+
+// mapErr converts errors of database/sql and the driver to the errors of the db package
+func mapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == sql.ErrNoRows {
+		return db.ErrNotFound
+	}
+	if e, ok := err.(*pq.Error); ok {
+		if e.Code == "23505" {
+			// unique_violation
+			return db.ErrDuplicate
+		}
+		// The server answered, so it is reachable
+		return err
+	}
+	if err == driver.ErrBadConn || db.Unreachable(err) {
+		return &db.UnavailableError{Err: err}
+	}
+	return err
+}
+
+// GetMapObjects returns the unexpired objects of the given types within radius meters, nearest first
+func (d *Database) GetMapObjects(lat, lng float64, types []int, radius int) ([]opm.MapObject, error) {
+	if len(types) == 0 {
+		return []opm.MapObject{}, nil
+	}
+	now := opm.Now()
+	rows, err := d.sql.Query(`SELECT `+objectColumns+` FROM objects
+		WHERE ST_DWithin(loc, ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography, $3)
+		AND (expiry >= $4 OR expiry = 0 OR type = $6)
+		AND type = ANY($5)
+		ORDER BY loc <-> ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography`,
+		lng, lat, radius, now.Unix(), pq.Array(types), opm.POKESTOP)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	defer rows.Close()
+	objects := make([]opm.MapObject, 0)
+	for rows.Next() {
+		var m opm.MapObject
+		var attack, defense, stamina sql.NullInt64
+		var percent sql.NullFloat64
+		var ranks []byte
+		err := rows.Scan(&m.ID, &m.Type, &m.PokemonID, &m.SpawnpointID, &m.Lat, &m.Lng, &m.Expiry, &m.Lured, &m.LureType, &m.LuredBy,
+			&m.Team, &m.Source, &m.SeenAt, &attack, &defense, &stamina, &percent, &m.CP, &m.Move1, &m.Move2, &m.GymPoints, &m.GuardPokemonID, &m.GuardPokemonCP, &ranks)
+		if err != nil {
+			return nil, mapErr(err)
+		}
+		if attack.Valid {
+			m.IVs = &opm.IVs{Attack: int(attack.Int64), Defense: int(defense.Int64), Stamina: int(stamina.Int64), Percent: percent.Float64}
+			if len(ranks) > 0 {
+				if err := json.Unmarshal(ranks, &m.IVs.Ranks); err != nil {
+					return nil, err
+				}
+			}
+		}
+		objects = append(objects, opm.ClearExpiredLure(m, now))
+	}
+	return objects, mapErr(rows.Err())
+}
+
+// AddMapObject adds a Pokemon or replaces a fort as a whole.
+// Duplicate Pokemon are reported as db.ErrDuplicate.
+func (d *Database) AddMapObject(m opm.MapObject) error {
+	if math.IsNaN(m.Lat) || math.IsNaN(m.Lng) || m.Lat < -90 || m.Lat > 90 || m.Lng < -180 || m.Lng > 180 {
+		return opm.ErrInvalidCoordinates
+	}
+	var attack, defense, stamina sql.NullInt64
+	var percent sql.NullFloat64
+	// A string, pq would send bytes as bytea
+	var ranks sql.NullString
+	cp, move1, move2 := 0, 0, 0
+	if m.IVs != nil && m.IVs.Valid() {
+		ivs := m.IVs.WithRanks(m.PokemonID, d.Leagues)
+		attack = sql.NullInt64{Int64: int64(ivs.Attack), Valid: true}
+		defense = sql.NullInt64{Int64: int64(ivs.Defense), Valid: true}
+		stamina = sql.NullInt64{Int64: int64(ivs.Stamina), Valid: true}
+		percent = sql.NullFloat64{Float64: ivs.Percent, Valid: true}
+		if len(ivs.Ranks) > 0 {
+			b, _ := json.Marshal(ivs.Ranks)
+			ranks = sql.NullString{String: string(b), Valid: true}
+		}
+		cp, move1, move2 = m.CP, m.Move1, m.Move2
+	}
+	query := insertObject + ` DO NOTHING`
+	if m.Type != opm.POKEMON {
+		query = insertObject + ` DO UPDATE SET ` + replaceObject
+	}
+	captured := m.CapturedAt
+	if captured == 0 {
+		captured = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	result, err := d.sql.Exec(query,
+		m.ID, m.Type, m.PokemonID, m.SpawnpointID, m.Lng, m.Lat, m.Expiry, m.Lured, m.LureType, m.LuredBy, m.Team, m.Source, time.Now().Unix(),
+		attack, defense, stamina, percent, cp, move1, move2, m.GymPoints, m.GuardPokemonID, m.GuardPokemonCP, captured, ranks)
+	if err != nil {
+		return mapErr(err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.ErrDuplicate
+	}
+	return nil
+}
+
+// GetAccount returns a free account and marks it as used in one step, so concurrent
+// callers never get the same account
+func (d *Database) GetAccount() (opm.Account, error) {
+	row := d.sql.QueryRow(`UPDATE accounts SET used = true WHERE username = (
+			SELECT username FROM accounts
+			WHERE NOT used AND NOT banned AND NOT captcha_flagged AND cooldown_until <= $1 AND NOT token_expired
+			LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING `+accountColumns, time.Now().Unix())
+	a, err := scanAccount(row)
+	if err == sql.ErrNoRows {
+		return opm.Account{}, db.ErrNoAccountAvailable
+	}
+	return a, mapErr(err)
+}
+
+func scanAccount(row *sql.Row) (opm.Account, error) {
+	var a opm.Account
+	err := row.Scan(&a.Username, &a.Password, &a.Provider, &a.Used, &a.Banned, &a.BannedAt, &a.CaptchaFlagged, &a.Pool, &a.CooldownUntil, &a.AuthToken, &a.TokenExpired, &a.CaptchaURL, &a.CaptchaAt, &a.BanReason)
+	return a, err
+}
+
+// ReturnAccount marks the account as not used, the rest of the stored account is kept
+func (d *Database) ReturnAccount(a opm.Account) error {
+	result, err := d.sql.Exec(`UPDATE accounts SET used = false WHERE username = $1`, a.Username)
+	if err != nil {
+		return mapErr(err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// UpdateAccount stores the auth token, the only field of the trainer in this schema.
+// Unknown accounts are reported as db.ErrNotFound.
+func (d *Database) UpdateAccount(a opm.Account) error {
+	result, err := d.sql.Exec(`UPDATE accounts SET auth_token = $2 WHERE username = $1`, a.Username, a.AuthToken)
+	if err != nil {
+		return mapErr(err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// MarkAccountBanned flags the account as banned and records the reason and time of the ban
+func (d *Database) MarkAccountBanned(username, reason string) error {
+	result, err := d.sql.Exec(`UPDATE accounts SET banned = true, banned_at = $2, ban_reason = $3 WHERE username = $1`, username, time.Now().Unix(), reason)
+	if err != nil {
+		return mapErr(err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// MarkTokenExpired flags the account for a new token, the ban state is left alone
+func (d *Database) MarkTokenExpired(username string) error {
+	result, err := d.sql.Exec(`UPDATE accounts SET token_expired = true WHERE username = $1`, username)
+	if err != nil {
+		return mapErr(err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// FlagCaptcha takes the account out of rotation until its captcha is solved
+func (d *Database) FlagCaptcha(username, url string) error {
+	result, err := d.sql.Exec(`UPDATE accounts SET captcha_flagged = true, captcha_url = $2, captcha_at = $3, used = false
+		WHERE username = $1`, username, url, time.Now().Unix())
+	if err != nil {
+		return mapErr(err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// GetCaptchaAccounts returns the accounts that wait for a solved captcha, oldest first
+func (d *Database) GetCaptchaAccounts() ([]opm.Account, error) {
+	rows, err := d.sql.Query(`SELECT ` + accountColumns + ` FROM accounts WHERE captcha_flagged ORDER BY captcha_at`)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	defer rows.Close()
+	var accounts []opm.Account
+	for rows.Next() {
+		var a opm.Account
+		err := rows.Scan(&a.Username, &a.Password, &a.Provider, &a.Used, &a.Banned, &a.BannedAt, &a.CaptchaFlagged, &a.Pool, &a.CooldownUntil, &a.AuthToken, &a.TokenExpired, &a.CaptchaURL, &a.CaptchaAt, &a.BanReason)
+		if err != nil {
+			return nil, mapErr(err)
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, mapErr(rows.Err())
+}
+
+// ClearCaptcha puts a flagged account back into rotation. Unknown or unflagged accounts
+// are reported as db.ErrNotFound.
+func (d *Database) ClearCaptcha(username string) error {
+	result, err := d.sql.Exec(`UPDATE accounts SET captcha_flagged = false, captcha_url = '', captcha_at = 0
+		WHERE username = $1 AND captcha_flagged`, username)
+	if err != nil {
+		return mapErr(err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// GetProxy returns a free proxy and marks it as used
+func (d *Database) GetProxy() (opm.Proxy, error) {
+	var p opm.Proxy
+	err := d.sql.QueryRow(`UPDATE proxies SET use = true WHERE id = (
+			SELECT id FROM proxies WHERE NOT use AND NOT dead LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING `+proxyColumns).Scan(&p.ID, &p.Use, &p.Dead, &p.URL, &p.Username, &p.Password, &p.LastCheck)
+	if err == sql.ErrNoRows {
+		return opm.Proxy{}, db.ErrNoProxyAvailable
+	}
+	return p, mapErr(err)
+}
+
+// ReturnProxy marks the proxy as alive and not used
+func (d *Database) ReturnProxy(p opm.Proxy) error {
+	result, err := d.sql.Exec(`UPDATE proxies SET dead = false, use = false WHERE id = $1`, p.ID)
+	if err != nil {
+		return mapErr(err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/internal/dbtest"
+	"github.com/pogointel/opm/opm"
+)
+
+// testDatabase connects to the PostgreSQL of OPM_TEST_POSTGRES, a key/value connection string
+// (e.g. "host=localhost user=postgres sslmode=disable"), and returns a database in a schema of
+// its own that is dropped after the test. Tests that need it are skipped without it.
+func testDatabase(t *testing.T) *Database {
+	t.Helper()
+	dsn := os.Getenv("OPM_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("OPM_TEST_POSTGRES not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("opm_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Log(err)
+		}
+		admin.Close()
+	})
+	// PostGIS is usually installed in public
+	d, err := New(dsn + " search_path=" + schema + ",public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestContract(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) dbtest.Backend {
+		d := testDatabase(t)
+		return dbtest.Backend{
+			Database: d,
+			AddAccount: func(a opm.Account) error {
+				_, err := d.sql.Exec(`INSERT INTO accounts (username, password, provider) VALUES ($1, $2, $3)`, a.Username, a.Password, a.Provider)
+				return mapErr(err)
+			},
+			AddProxy: func(p opm.Proxy) error {
+				_, err := d.sql.Exec(`INSERT INTO proxies (id, url, username, password) VALUES ($1, $2, $3, $4)`, p.ID, p.URL, p.Username, p.Password)
+				return mapErr(err)
+			},
+		}
+	})
+}
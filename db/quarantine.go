@@ -0,0 +1,98 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// quarantineTTL is how long rejected objects are kept
+const quarantineTTL = 7 * 24 * time.Hour
+
+type quarantineEntry struct {
+	ID      string
+	Reason  string
+	Source  string
+	Object  opm.MapObject
+	Time    int64
+	Created time.Time // used by the TTL index
+}
+
+// Quarantine stores a rejected object together with the reason and its source,
+// so dropped data can be inspected and requeued later. All rejections go through here.
+func (db *OpenMapDb) Quarantine(o opm.MapObject, reason error, source string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	now := time.Now()
+	e := quarantineEntry{
+		ID:      bson.NewObjectId().Hex(),
+		Reason:  reason.Error(),
+		Source:  source,
+		Object:  o,
+		Time:    now.Unix(),
+		Created: now,
+	}
+	log.Printf("Quarantined %s from %s: %s", o.ID, source, e.Reason)
+	return mapErr(session.DB(db.DbName).C(db.Collections.Quarantine).Insert(e))
+}
+
+// quarantine is a helper for the rejection sites of this package. It stores
+// the object and returns the rejection reason.
+func (db *OpenMapDb) quarantine(o opm.MapObject, reason error) error {
+	source := o.Source
+	if source == "" {
+		source = "db"
+	}
+	err := db.Quarantine(o, reason, source)
+	if err != nil {
+		log.Println(err)
+	}
+	return reason
+}
+
+// GetQuarantine returns the most recent quarantined objects, newest first
+func (db *OpenMapDb) GetQuarantine(limit int) ([]opm.QuarantineEntry, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var entries []quarantineEntry
+	err := session.DB(db.DbName).C(db.Collections.Quarantine).Find(nil).Sort("-time").Limit(limit).All(&entries)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	result := make([]opm.QuarantineEntry, len(entries))
+	for i, e := range entries {
+		result[i] = e.entry()
+	}
+	return result, nil
+}
+
+// GetQuarantineEntry returns a quarantined object
+func (db *OpenMapDb) GetQuarantineEntry(id string) (opm.QuarantineEntry, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var e quarantineEntry
+	err := session.DB(db.DbName).C(db.Collections.Quarantine).Find(bson.M{"id": id}).One(&e)
+	if err != nil {
+		return opm.QuarantineEntry{}, mapErr(err)
+	}
+	return e.entry(), nil
+}
+
+// RemoveQuarantineEntry removes a quarantined object, e.g. after it was requeued
+func (db *OpenMapDb) RemoveQuarantineEntry(id string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	return mapErr(session.DB(db.DbName).C(db.Collections.Quarantine).Remove(bson.M{"id": id}))
+}
+
+func (e quarantineEntry) entry() opm.QuarantineEntry {
+	return opm.QuarantineEntry{
+		ID:     e.ID,
+		Reason: e.Reason,
+		Source: e.Source,
+		Object: e.Object,
+		Time:   e.Time,
+	}
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuarantineEntryIsKeptUntilRemoved(t *testing.T) {
+	db := testDB(t)
+	if err := db.Quarantine(testPokemon("p1"), ErrInvalidCoordinates, "test"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.GetQuarantine(10)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("GetQuarantine = %v, %v, want one entry", entries, err)
+	}
+	id := entries[0].ID
+	for i := 0; i < 2; i++ {
+		e, err := db.GetQuarantineEntry(id)
+		if err != nil || e.Object.ID != "p1" || e.Reason != ErrInvalidCoordinates.Error() {
+			t.Fatalf("GetQuarantineEntry #%d = %+v, %v, want the entry", i+1, e, err)
+		}
+	}
+	if err := db.RemoveQuarantineEntry(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetQuarantineEntry(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetQuarantineEntry after removal = %v, want ErrNotFound", err)
+	}
+	if err := db.RemoveQuarantineEntry(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second RemoveQuarantineEntry = %v, want ErrNotFound", err)
+	}
+}
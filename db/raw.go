@@ -0,0 +1,89 @@
+package db
+
+import (
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+	"golang.org/x/net/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type rawResponse struct {
+	ScanID  string
+	Lat     float64
+	Lng     float64
+	Time    int64
+	Data    []byte
+	Expires time.Time // used by the TTL index
+}
+
+// AddRawResponse stores a captured response. It is removed by the TTL index after ttl.
+func (db *OpenMapDb) AddRawResponse(r opm.RawResponse, ttl time.Duration) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	e := rawResponse{
+		ScanID:  r.ScanID,
+		Lat:     r.Lat,
+		Lng:     r.Lng,
+		Time:    r.Time,
+		Data:    r.Data,
+		Expires: time.Unix(r.Time, 0).Add(ttl),
+	}
+	return mapErr(session.DB(db.DbName).C(db.Collections.Raw).Insert(e))
+}
+
+// GetRawResponse returns the captured response of a scan
+func (db *OpenMapDb) GetRawResponse(scanID string) (opm.RawResponse, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var e rawResponse
+	err := session.DB(db.DbName).C(db.Collections.Raw).Find(bson.M{"scanid": scanID}).One(&e)
+	return e.response(), mapErr(err)
+}
+
+// EachRawResponse calls fn for every response captured between since and until (unix time,
+// 0 = open), oldest first. Iteration stops at the first error returned by fn.
+func (db *OpenMapDb) EachRawResponse(since, until int64, fn func(opm.RawResponse) error) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	t := bson.M{"$gte": since}
+	if until > 0 {
+		t["$lte"] = until
+	}
+	iter := session.DB(db.DbName).C(db.Collections.Raw).Find(bson.M{"time": t}).Sort("time").Iter()
+	var e rawResponse
+	for iter.Next(&e) {
+		if err := fn(e.response()); err != nil {
+			iter.Close()
+			return err
+		}
+		e = rawResponse{}
+	}
+	return mapErr(iter.Close())
+}
+
+// Replay feeds a captured response through the production parser. With backfill the objects
+// also go through the persistence pipeline and the new ones are returned, otherwise (dry run)
+// all parsed objects are returned and nothing is written.
+func (db *OpenMapDb) Replay(r opm.RawResponse, backfill bool) ([]opm.MapObject, error) {
+	resp, err := util.DecodeMapResponse(r.Data)
+	if err != nil {
+		return nil, err
+	}
+	objects := util.ParseMapObjects(resp, time.Unix(r.Time, 0))
+	if !backfill {
+		return objects, nil
+	}
+	return db.SaveMapObjects(context.Background(), objects), nil
+}
+
+func (e rawResponse) response() opm.RawResponse {
+	return opm.RawResponse{
+		ScanID: e.ScanID,
+		Lat:    e.Lat,
+		Lng:    e.Lng,
+		Time:   e.Time,
+		Data:   e.Data,
+	}
+}
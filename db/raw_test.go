@@ -0,0 +1,123 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pogodevorg/POGOProtos-go"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// capturedResponse returns a captured response received at with a wild Pokemon, a lured
+// Pokestop and a gym
+func capturedResponse(t *testing.T, scanID string, at time.Time) opm.RawResponse {
+	t.Helper()
+	lureExpiry := at.Add(20*time.Minute).UnixNano() / int64(time.Millisecond)
+	r := &protos.GetMapObjectsResponse{MapCells: []*protos.MapCell{{
+		S2CellId: 5221390301548036096,
+		WildPokemons: []*protos.WildPokemon{{
+			EncounterId:      1234,
+			Latitude:         52.5,
+			Longitude:        13.4,
+			SpawnPointId:     "47a84e5",
+			PokemonData:      &protos.PokemonData{PokemonId: 16},
+			TimeTillHiddenMs: 600000,
+		}},
+		Forts: []*protos.FortData{
+			{
+				Id:                 "stop." + scanID,
+				Latitude:           52.501,
+				Longitude:          13.401,
+				Type:               protos.FortType_CHECKPOINT,
+				ActiveFortModifier: []protos.ItemId{501},
+				LureInfo:           &protos.FortLureInfo{EncounterId: 5678, ActivePokemonId: 129, LureExpiresTimestampMs: lureExpiry},
+			},
+			{Id: "gym." + scanID, Latitude: 52.502, Longitude: 13.402, Type: protos.FortType_GYM, OwnedByTeam: 2},
+		},
+	}}}
+	data, err := util.EncodeMapResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opm.RawResponse{ScanID: scanID, Lat: 52.5, Lng: 13.4, Time: at.Unix(), Data: data}
+}
+
+func TestReplayDryRun(t *testing.T) {
+	at := time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)
+	// A dry run doesn't touch the database
+	objects, err := (&OpenMapDb{}).Replay(capturedResponse(t, "scan1", at), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]opm.MapObject)
+	for _, o := range objects {
+		byID[o.ID] = o
+		if o.CapturedAt != at.UnixNano()/int64(time.Millisecond) {
+			t.Errorf("%s captured at %d, want the capture time", o.ID, o.CapturedAt)
+		}
+	}
+	if len(objects) != 4 {
+		t.Fatalf("replayed %d objects, want the Pokemon, the lured Pokemon, the stop and the gym", len(objects))
+	}
+	// Relative times are resolved against the capture time, not the replay time
+	if p := byID["ya"]; p.Type != opm.POKEMON || p.PokemonID != 16 || p.Expiry != at.Add(10*time.Minute).Unix() {
+		t.Errorf("wild Pokemon = %+v", p)
+	}
+	if p := byID["4dq"]; p.LuredBy != "stop.scan1" || p.Expiry != at.Add(20*time.Minute).Unix() {
+		t.Errorf("lured Pokemon = %+v", p)
+	}
+	if s := byID["stop.scan1"]; !s.Lured || s.LureType == "" {
+		t.Errorf("Pokestop = %+v, want lured", s)
+	}
+	if g := byID["gym.scan1"]; g.Type != opm.GYM || g.Team != 2 {
+		t.Errorf("gym = %+v", g)
+	}
+}
+
+func TestReplayCorruptResponse(t *testing.T) {
+	if _, err := (&OpenMapDb{}).Replay(opm.RawResponse{ScanID: "bad", Data: []byte("not gzip")}, false); err == nil {
+		t.Error("replayed a corrupt response")
+	}
+}
+
+func TestReplayBackfill(t *testing.T) {
+	db := testDB(t)
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+	for i, id := range []string{"scan2", "scan1"} {
+		if err := db.AddRawResponse(capturedResponse(t, id, at.Add(time.Duration(-i)*time.Second)), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err := db.GetRawResponse("scan2"); err != nil || r.Time != at.Unix() {
+		t.Fatalf("GetRawResponse = %+v, %v", r, err)
+	}
+	var scans []string
+	err := db.EachRawResponse(0, 0, func(r opm.RawResponse) error {
+		scans = append(scans, r.ScanID)
+		saved, err := db.Replay(r, true)
+		if err != nil {
+			return err
+		}
+		// Both scans saw the same Pokemon, only the first one saves them
+		pokemon := 0
+		for _, o := range saved {
+			if o.Type == opm.POKEMON {
+				pokemon++
+			}
+		}
+		if want := map[string]int{"scan1": 2, "scan2": 0}[r.ScanID]; pokemon != want {
+			t.Errorf("%s saved %d Pokemon, want %d", r.ScanID, pokemon, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scans) != 2 || scans[0] != "scan1" {
+		t.Errorf("replayed %v, want the oldest first", scans)
+	}
+	if _, err := db.GetObject("ya"); err != nil {
+		t.Errorf("backfilled Pokemon not found: %v", err)
+	}
+}
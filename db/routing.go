@@ -0,0 +1,86 @@
+package db
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// readCheckInterval is the time between health checks of the read endpoint
+const readCheckInterval = 10 * time.Second
+
+// readEndpoint is the optional session for reads that may be served by secondaries
+type readEndpoint struct {
+	session *mgo.Session
+	healthy int32 // 1 if the last ping succeeded
+	ping    func() error
+}
+
+// dialRead connects the read endpoint. Reads go to the nearest member, or to the members
+// matching tags if any are given. A failure is not fatal, reads then use the write session.
+func (db *OpenMapDb) dialRead(host, user, password string, tags map[string]string) {
+	s, err := mgo.Dial(host)
+	if err != nil {
+		log.Printf("Read endpoint %s unavailable, reading from %s: %s", host, db.DbHost, err)
+		return
+	}
+	if user != "" && password != "" {
+		if err := s.DB(db.DbName).Login(user, password); err != nil {
+			log.Printf("Login to read endpoint %s failed, reading from %s: %s", host, db.DbHost, err)
+			s.Close()
+			return
+		}
+	}
+	s.SetMode(mgo.Nearest, true)
+	if len(tags) > 0 {
+		var d bson.D
+		for k, v := range tags {
+			d = append(d, bson.DocElem{Name: k, Value: v})
+		}
+		s.SelectServers(d)
+	}
+	r := &readEndpoint{session: s, healthy: 1}
+	r.ping = func() error {
+		s := r.session.Copy()
+		defer s.Close()
+		return s.Ping()
+	}
+	db.read = r
+	go r.watch()
+}
+
+// watch checks the read endpoint regularly
+func (r *readEndpoint) watch() {
+	for {
+		time.Sleep(readCheckInterval)
+		r.check()
+	}
+}
+
+// check pings the read endpoint and updates its health
+func (r *readEndpoint) check() {
+	err := r.ping()
+	var healthy int32
+	if err == nil {
+		healthy = 1
+	}
+	if old := atomic.SwapInt32(&r.healthy, healthy); old != healthy {
+		if err != nil {
+			log.Printf("Read endpoint unavailable, falling back to the write session: %s", err)
+		} else {
+			log.Println("Read endpoint available again")
+		}
+	}
+}
+
+// readSession returns a session for queries that tolerate slightly stale data (map objects,
+// stats and exports). It is a copy of the write session if there is no healthy read endpoint.
+func (db *OpenMapDb) readSession() *mgo.Session {
+	if db.read != nil && atomic.LoadInt32(&db.read.healthy) == 1 {
+		return db.read.session.Copy()
+	}
+	return db.mongoSession.Copy()
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2"
+)
+
+func TestReadEndpointHealth(t *testing.T) {
+	var pingErr error
+	r := &readEndpoint{healthy: 1, ping: func() error { return pingErr }}
+	steps := []struct {
+		err     error
+		healthy int32
+	}{
+		{nil, 1},
+		{errors.New("no reachable servers"), 0},
+		{errors.New("no reachable servers"), 0},
+		{nil, 1},
+	}
+	for i, step := range steps {
+		pingErr = step.err
+		r.check()
+		if got := atomic.LoadInt32(&r.healthy); got != step.healthy {
+			t.Errorf("step %d: healthy = %d, want %d", i, got, step.healthy)
+		}
+	}
+}
+
+func TestReadRouting(t *testing.T) {
+	// The read endpoint only reads from members with a tag nobody has, so every read
+	// routed to it fails while the write session works
+	db := testDB(t, Options{ReadHost: os.Getenv("OPM_TEST_MONGO"), ReadTags: map[string]string{"region": "nowhere"}})
+	if db.read == nil {
+		t.Fatal("read endpoint not dialed")
+	}
+	session := db.read.session
+	defer session.Close()
+	session.SetSyncTimeout(200 * time.Millisecond)
+	var pingErr error
+	r := &readEndpoint{session: session, healthy: 1, ping: func() error { return pingErr }}
+	db.read = r
+
+	if err := db.AddMapObject(testPokemon("p1")); err != nil {
+		t.Fatalf("write = %v, want it on the write session", err)
+	}
+	if mode := db.readSession().Mode(); mode != mgo.Nearest {
+		t.Errorf("read session mode = %v, want the nearest member", mode)
+	}
+	if _, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 100); err == nil {
+		t.Error("map read succeeded, want it on the read endpoint")
+	}
+	if _, err := db.AccountStats(); err == nil {
+		t.Error("stats read succeeded, want it on the read endpoint")
+	}
+
+	// Unavailable, reads fall back to the write session
+	pingErr = errors.New("no reachable servers")
+	r.check()
+	objects, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 100)
+	if err != nil || len(objects) != 1 {
+		t.Errorf("map read after the fallback = %v, %v, want the Pokemon", objects, err)
+	}
+
+	pingErr = nil
+	r.check()
+	if _, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 100); err == nil {
+		t.Error("map read succeeded, want it on the read endpoint again")
+	}
+}
+
+func TestReadEndpointDialFailure(t *testing.T) {
+	// Takes the dial timeout of mgo
+	db := testDB(t, Options{ReadHost: "127.0.0.1:1"})
+	if db.read != nil {
+		t.Fatal("read endpoint set up without a server")
+	}
+	if err := db.AddMapObject(testPokemon("p1")); err != nil {
+		t.Fatal(err)
+	}
+	if objects, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 100); err != nil || len(objects) != 1 {
+		t.Errorf("map read = %v, %v, want it on the write session", objects, err)
+	}
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"time"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultScanHistory is how long scans are kept if ScanHistory is not set
+const defaultScanHistory = 14 * 24 * time.Hour
+
+// coveragePrecision is the geohash length of the coverage cells (about 1.2 x 0.6 km)
+const coveragePrecision = 6
+
+type scan struct {
+	Loc location
+	// Map cells returned by the scan, missing for scans without cells
+	Footprint *opm.BoundingBox `bson:",omitempty"`
+	Area      *polygon         `bson:",omitempty"`
+	Trainer   string
+	Objects   int
+	Ts        int64
+	ExpiresAt time.Time // used by the TTL index
+}
+
+type polygon struct {
+	Type        string
+	Coordinates [][][]float64
+}
+
+// AddScan records a successful scan for the coverage map. The footprint is the area the scan
+// refreshed, scans with an empty footprint are counted at their location.
+func (db *OpenMapDb) AddScan(lat, lng float64, footprint opm.BoundingBox, trainer string, objects int, ts time.Time) error {
+	history := db.ScanHistory
+	if history <= 0 {
+		history = defaultScanHistory
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	s := scan{
+		Loc:       location{Type: "Point", Coordinates: []float64{lng, lat}},
+		Trainer:   trainer,
+		Objects:   objects,
+		Ts:        ts.Unix(),
+		ExpiresAt: ts.Add(history),
+	}
+	if footprint.IsSet() {
+		s.Footprint = &footprint
+		s.Area = &polygon{Type: "Polygon", Coordinates: [][][]float64{boxRing(geo.Box(footprint))}}
+	}
+	return mapErr(session.DB(db.DbName).C(db.Collections.Scans).Insert(s))
+}
+
+// GetScanCoverage returns the number of scans since the given time per geohash cell of the
+// bounding box. A scan counts for the cells whose centers are in its footprint, or for the
+// cell of its location if it has none. Cells without scans are not returned.
+func (db *OpenMapDb) GetScanCoverage(north, south, east, west float64, since time.Time) ([]opm.CoverageCell, error) {
+	box := geo.Box{North: north, South: south, East: east, West: west}
+	session := db.readSession()
+	defer session.Close()
+	area := bson.M{"type": "Polygon", "coordinates": [][][]float64{boxRing(box)}}
+	q := bson.M{
+		"$or": []bson.M{
+			{"area": bson.M{"$geoIntersects": bson.M{"$geometry": area}}},
+			{"area": bson.M{"$exists": false}, "loc": bson.M{"$geoWithin": bson.M{"$geometry": area}}},
+		},
+		"ts": bson.M{"$gte": since.Unix()},
+	}
+	cells := make(map[string]*opm.CoverageCell)
+	var order []string
+	iter := session.DB(db.DbName).C(db.Collections.Scans).Find(q).Select(bson.M{"loc": 1, "footprint": 1, "ts": 1}).Iter()
+	var s scan
+	for iter.Next(&s) {
+		for _, hash := range scanCells(s) {
+			center := geo.GeohashCenter(hash)
+			// The polygon edges are geodesics, so the query can return scans just outside
+			if !box.Contains(center) {
+				continue
+			}
+			c, ok := cells[hash]
+			if !ok {
+				c = &opm.CoverageCell{Geohash: hash, Lat: center.Lat, Lng: center.Lng}
+				cells[hash] = c
+				order = append(order, hash)
+			}
+			c.Scans++
+			if s.Ts > c.LastScan {
+				c.LastScan = s.Ts
+			}
+		}
+		s = scan{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, mapErr(err)
+	}
+	result := make([]opm.CoverageCell, len(order))
+	for i, hash := range order {
+		result[i] = *cells[hash]
+	}
+	return result, nil
+}
+
+// scanCells returns the coverage cells a scan counts for
+func scanCells(s scan) []string {
+	if s.Footprint != nil {
+		if hashes := geo.GeohashesInBox(geo.Box(*s.Footprint), coveragePrecision); len(hashes) > 0 {
+			return hashes
+		}
+		// Smaller than a cell
+		return []string{geo.Geohash(geo.Box(*s.Footprint).Center(), coveragePrecision)}
+	}
+	if len(s.Loc.Coordinates) != 2 {
+		return nil
+	}
+	return []string{geo.Geohash(geo.LatLng{Lat: s.Loc.Coordinates[1], Lng: s.Loc.Coordinates[0]}, coveragePrecision)}
+}
+
+// boxRing returns the box as a closed GeoJSON ring. The east and west edges are meridians,
+// so they are geodesics already, the north and south edges get a vertex every degree to stay
+// close to their parallel.
+func boxRing(b geo.Box) [][]float64 {
+	east := b.East
+	if b.West > b.East {
+		east += 360
+	}
+	var ring [][]float64
+	for lng := b.West; lng < east; lng++ {
+		ring = append(ring, []float64{geo.NormalizeLng(lng), b.South})
+	}
+	ring = append(ring, []float64{b.East, b.South})
+	for lng := east; lng > b.West; lng-- {
+		ring = append(ring, []float64{geo.NormalizeLng(lng), b.North})
+	}
+	ring = append(ring, []float64{b.West, b.North}, []float64{b.West, b.South})
+	return ring
+}
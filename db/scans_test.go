@@ -0,0 +1,76 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+)
+
+func TestScanCells(t *testing.T) {
+	center := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	at := func(p geo.LatLng) location { return location{Type: "Point", Coordinates: []float64{p.Lng, p.Lat}} }
+	// A footprint of several coverage cells counts for those whose centers it contains
+	wide := opm.BoundingBox(geo.BoxAround(center, 2000))
+	cells := scanCells(scan{Loc: at(center), Footprint: &wide})
+	if len(cells) < 4 {
+		t.Fatalf("cells = %v, want the cells of the footprint", cells)
+	}
+	for _, hash := range cells {
+		if c := geo.GeohashCenter(hash); !wide.Contains(c.Lat, c.Lng) {
+			t.Errorf("cell %s is outside of the footprint", hash)
+		}
+	}
+	// A footprint of a few S2 cells is smaller than a coverage cell
+	small := opm.BoundingBox(geo.S2CellsBound(geo.S2Covering(center, 70, geo.S2Level)))
+	got := scanCells(scan{Loc: at(geo.Destination(center, 5000, 0)), Footprint: &small})
+	if len(got) != 1 || geo.Distance(geo.GeohashCenter(got[0]), center) > 1000 {
+		t.Errorf("cells of a small footprint = %v, want the one it is in", got)
+	}
+	// Scans recorded before footprints count at their location
+	if got := scanCells(scan{Loc: at(center)}); len(got) != 1 || got[0] != geo.Geohash(center, coveragePrecision) {
+		t.Errorf("cells without a footprint = %v, want the cell of the location", got)
+	}
+	if got := scanCells(scan{}); got != nil {
+		t.Errorf("cells without a location = %v", got)
+	}
+}
+
+func TestScanCoverageUsesFootprint(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	center := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	// The game returned cells east of the scan location only
+	east := geo.Destination(center, 3000, 90)
+	footprint := opm.BoundingBox(geo.BoxAround(east, 1500))
+	if err := db.AddScan(center.Lat, center.Lng, footprint, "ash", 3, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddScan(center.Lat, center.Lng, opm.BoundingBox{}, "misty", 1, now); err != nil {
+		t.Fatal(err)
+	}
+	// A box around the footprint doesn't contain the scan location
+	q := geo.BoxAround(east, 2000)
+	cells, err := db.GetScanCoverage(q.North, q.South, q.East, q.West, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) == 0 {
+		t.Fatal("no coverage around the footprint")
+	}
+	for _, c := range cells {
+		if c.Scans != 1 || !footprint.Contains(c.Lat, c.Lng) {
+			t.Errorf("cell %+v, want one scan in the footprint", c)
+		}
+	}
+	// The scan without a footprint still counts at its location
+	q = geo.BoxAround(center, 1000)
+	cells, err = db.GetScanCoverage(q.North, q.South, q.East, q.West, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 1 || cells[0].Scans != 1 || cells[0].Geohash != geo.Geohash(center, coveragePrecision) {
+		t.Errorf("coverage at the location = %+v, want misty's scan only", cells)
+	}
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BenchmarkGetMapObjectsParallel compares parallel map queries on a copied session per
+// operation, as GetMapObjects does, with all queries sharing one session
+func BenchmarkGetMapObjectsParallel(b *testing.B) {
+	db := testDB(b)
+	var objects []opm.MapObject
+	for i := 0; i < 200; i++ {
+		p := testPokemon(fmt.Sprintf("p%d", i))
+		p.Lat += float64(i%20) * 0.0001
+		p.Lng += float64(i/20) * 0.0001
+		objects = append(objects, p)
+	}
+	if err := db.AddMapObjects(objects); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("copied", func(b *testing.B) {
+		b.SetParallelism(8)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 500); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+	b.Run("shared", func(b *testing.B) {
+		q := bson.M{"loc": bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{[]float64{13.4, 52.5}, geo.Angle(500)}}}}
+		b.SetParallelism(8)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				var found []object
+				if err := db.mongoSession.DB(db.DbName).C(db.Collections.Objects).Find(q).All(&found); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+}
+
+// benchObjects is the number of Pokemon of the iterator benchmarks, all within benchRadius
+const (
+	benchObjects = 100000
+	benchRadius  = 1000
+)
+
+// seedBenchObjects stores benchObjects Pokemon on a grid of about 2m around 52.5, 13.4
+func seedBenchObjects(b *testing.B, db *OpenMapDb) {
+	b.Helper()
+	objects := make([]opm.MapObject, 0, 1000)
+	for i := 0; i < benchObjects; i++ {
+		p := testPokemon(fmt.Sprintf("p%d", i))
+		p.Lat += float64(i%316) * 0.00002
+		p.Lng += float64(i/316) * 0.00003
+		objects = append(objects, p)
+		if len(objects) == cap(objects) || i == benchObjects-1 {
+			if err := db.AddMapObjects(objects); err != nil {
+				b.Fatal(err)
+			}
+			objects = objects[:0]
+		}
+	}
+}
+
+// BenchmarkGetMapObjectsIter reads a large result one object at a time, only a batch of
+// documents is in memory
+func BenchmarkGetMapObjectsIter(b *testing.B) {
+	db := testDB(b)
+	seedBenchObjects(b, db)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := db.GetMapObjectsIter(52.5, 13.4, []int{opm.POKEMON}, benchRadius)
+		n := 0
+		var m opm.MapObject
+		for it.Next(&m) {
+			n++
+		}
+		if err := it.Close(); err != nil || n != benchObjects {
+			b.Fatalf("read %d objects, %v", n, err)
+		}
+	}
+}
+
+// BenchmarkGetMapObjects reads the result of BenchmarkGetMapObjectsIter into a slice
+func BenchmarkGetMapObjects(b *testing.B) {
+	db := testDB(b)
+	seedBenchObjects(b, db)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		objects, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, benchRadius)
+		if err != nil || len(objects) != benchObjects {
+			b.Fatalf("read %d objects, %v", len(objects), err)
+		}
+	}
+}
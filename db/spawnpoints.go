@@ -0,0 +1,107 @@
+package db
+
+import (
+	"time"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type spawnpoint struct {
+	ID            string
+	Loc           location
+	DespawnSecond int
+	Samples       int
+	LastSeen      int64
+}
+
+// UpsertSpawnpoint records a sighting at a spawnpoint. The despawn second of the hour is
+// taken from the expiry; repeated sightings refine it with a running mean instead of
+// adding documents.
+func (db *OpenMapDb) UpsertSpawnpoint(id string, lat, lng float64, expiry int64) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	c := session.DB(db.DbName).C(db.Collections.Spawnpoints)
+	observed := int(expiry % 3600)
+	var sp spawnpoint
+	err := c.Find(bson.M{"id": id}).One(&sp)
+	if err != nil && mapErr(err) != ErrNotFound {
+		return mapErr(err)
+	}
+	if err == nil {
+		// The second of the hour wraps around, so use the shortest distance
+		d := observed - sp.DespawnSecond
+		if d > 1800 {
+			d -= 3600
+		} else if d < -1800 {
+			d += 3600
+		}
+		observed = ((sp.DespawnSecond+d/(sp.Samples+1))%3600 + 3600) % 3600
+	}
+	_, err = c.Upsert(bson.M{"id": id}, bson.M{
+		"$set": bson.M{
+			"despawnsecond": observed,
+			"lastseen":      time.Now().Unix(),
+		},
+		// The first location is the canonical one, see snapToSpawnpoint
+		"$setOnInsert": bson.M{"loc": location{Type: "Point", Coordinates: []float64{lng, lat}}},
+		"$inc":         bson.M{"samples": 1},
+	})
+	return mapErr(err)
+}
+
+// snapToSpawnpoint moves a Pokemon to the canonical location of its spawnpoint, so repeated
+// spawns don't jitter. It returns the original location if the coordinates were changed.
+func (db *OpenMapDb) snapToSpawnpoint(m *opm.MapObject) *location {
+	if db.SnapDistance <= 0 || m.Type != opm.POKEMON || m.SpawnpointID == "" {
+		return nil
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var sp spawnpoint
+	err := session.DB(db.DbName).C(db.Collections.Spawnpoints).Find(bson.M{"id": m.SpawnpointID}).One(&sp)
+	if err != nil || len(sp.Loc.Coordinates) != 2 {
+		return nil
+	}
+	canonical := geo.LatLng{Lat: sp.Loc.Coordinates[1], Lng: sp.Loc.Coordinates[0]}
+	d := geo.Distance(geo.LatLng{Lat: m.Lat, Lng: m.Lng}, canonical)
+	if d == 0 || d > db.SnapDistance {
+		return nil
+	}
+	raw := &location{Type: "Point", Coordinates: []float64{m.Lng, m.Lat}}
+	m.Lat, m.Lng = canonical.Lat, canonical.Lng
+	return raw
+}
+
+// GetSpawnpoints returns the known spawnpoints within a radius (in meters) of the given lat/lng
+func (db *OpenMapDb) GetSpawnpoints(lat, lng float64, radius int) ([]opm.Spawnpoint, error) {
+	session := db.readSession()
+	defer session.Close()
+	q := bson.M{
+		"loc": bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": []interface{}{[]float64{lng, lat}, geo.Angle(float64(radius))},
+			},
+		},
+	}
+	var points []spawnpoint
+	err := session.DB(db.DbName).C(db.Collections.Spawnpoints).Find(q).All(&points)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	result := make([]opm.Spawnpoint, len(points))
+	for i, p := range points {
+		result[i] = opm.Spawnpoint{
+			ID:            p.ID,
+			DespawnSecond: p.DespawnSecond,
+			Samples:       p.Samples,
+			LastSeen:      p.LastSeen,
+		}
+		if len(p.Loc.Coordinates) == 2 {
+			result[i].Lat = p.Loc.Coordinates[1]
+			result[i].Lng = p.Loc.Coordinates[0]
+		}
+	}
+	return result, nil
+}
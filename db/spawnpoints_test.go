@@ -0,0 +1,86 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+	"golang.org/x/net/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRepeatedSpawnsSnapToSpawnpoint(t *testing.T) {
+	db := testDB(t)
+	db.SnapDistance = 10
+	// A few meters of jitter per scan, the last one is too far away to be the same spawn
+	jitter := [][2]float64{{0, 0}, {0.00002, -0.00001}, {-0.00003, 0.00002}, {0.00001, 0.00004}, {0.001, 0}}
+	var scan []opm.MapObject
+	for i, d := range jitter {
+		p := testPokemon(fmt.Sprintf("p%d", i))
+		p.SpawnpointID = "sp1"
+		p.Lat, p.Lng = p.Lat+d[0], p.Lng+d[1]
+		scan = append(scan, p)
+	}
+	saved := db.SaveMapObjects(context.Background(), scan)
+	if len(saved) != len(scan) {
+		t.Fatalf("saved %d Pokemon, want %d", len(saved), len(scan))
+	}
+	canonical := [2]float64{52.5, 13.4}
+	for _, o := range saved[:4] {
+		if [2]float64{o.Lat, o.Lng} != canonical {
+			t.Errorf("%s saved at %v,%v, want the spawnpoint", o.ID, o.Lat, o.Lng)
+		}
+	}
+
+	objects, err := db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := make(map[[2]float64]int)
+	for _, o := range objects {
+		locations[[2]float64{o.Lat, o.Lng}]++
+	}
+	if len(objects) != 5 || locations[canonical] != 4 {
+		t.Errorf("served locations %v, want 4 Pokemon at the spawnpoint and the far one apart", locations)
+	}
+
+	// The scanned coordinates are kept for auditing
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	for i, d := range jitter {
+		var o object
+		if err := session.DB(db.DbName).C(db.Collections.Objects).Find(bson.M{"id": fmt.Sprintf("p%d", i)}).One(&o); err != nil {
+			t.Fatal(err)
+		}
+		snapped := i > 0 && i < 4
+		if snapped != (o.RawLoc != nil) {
+			t.Errorf("p%d raw location = %v, want one only if it was snapped", i, o.RawLoc)
+			continue
+		}
+		if snapped && (o.RawLoc.Coordinates[1] != 52.5+d[0] || o.RawLoc.Coordinates[0] != 13.4+d[1]) {
+			t.Errorf("p%d raw location = %v, want the scanned coordinates", i, o.RawLoc.Coordinates)
+		}
+	}
+	// The spawnpoint keeps its first location
+	var sp spawnpoint
+	if err := session.DB(db.DbName).C(db.Collections.Spawnpoints).Find(bson.M{"id": "sp1"}).One(&sp); err != nil {
+		t.Fatal(err)
+	}
+	if sp.Loc.Coordinates[1] != 52.5 || sp.Loc.Coordinates[0] != 13.4 {
+		t.Errorf("spawnpoint moved to %v", sp.Loc.Coordinates)
+	}
+}
+
+func TestSnapToSpawnpointDisabled(t *testing.T) {
+	db := testDB(t)
+	p := testPokemon("p1")
+	p.SpawnpointID = "sp1"
+	if err := db.UpsertSpawnpoint("sp1", 52.5, 13.4, p.Expiry); err != nil {
+		t.Fatal(err)
+	}
+	p.Lat += 0.00002
+	scanned := p.Lat
+	if raw := db.snapToSpawnpoint(&p); raw != nil || p.Lat != scanned {
+		t.Errorf("snapped to %v with SnapDistance 0", p.Lat)
+	}
+}
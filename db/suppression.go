@@ -0,0 +1,167 @@
+package db
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// suppressionRefresh is how often the suppression list is reloaded from the db
+const suppressionRefresh = 30 * time.Second
+
+type suppression struct {
+	ID         string
+	PokemonIDs []int
+	KeepOneIn  int
+	Reason     string
+	CreatedBy  string
+	Expires    int64
+	ExpiresAt  time.Time // used by the TTL index
+}
+
+// suppressionFilter is the in-process copy of the suppression list
+type suppressionFilter struct {
+	sync.Mutex
+	entries []opm.Suppression
+	loaded  time.Time
+	matched map[string]int64 // entry id -> matching Pokemon, for 1 in n sampling
+	dropped map[int]int64    // species -> dropped Pokemon
+}
+
+func newSuppressionFilter() *suppressionFilter {
+	return &suppressionFilter{
+		matched: make(map[string]int64),
+		dropped: make(map[int]int64),
+	}
+}
+
+// AddSuppression adds an entry to the suppression list. It is removed automatically when it expires.
+func (db *OpenMapDb) AddSuppression(s opm.Suppression) (opm.Suppression, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	s.ID = bson.NewObjectId().Hex()
+	e := suppression{
+		ID:         s.ID,
+		PokemonIDs: s.PokemonIDs,
+		KeepOneIn:  s.KeepOneIn,
+		Reason:     s.Reason,
+		CreatedBy:  s.CreatedBy,
+		Expires:    s.Expires,
+		ExpiresAt:  time.Unix(s.Expires, 0),
+	}
+	err := session.DB(db.DbName).C(db.Collections.Suppressions).Insert(e)
+	if err == nil {
+		db.suppressions.invalidate()
+	}
+	return s, mapErr(err)
+}
+
+// RemoveSuppression removes an entry from the suppression list
+func (db *OpenMapDb) RemoveSuppression(id string) error {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	err := session.DB(db.DbName).C(db.Collections.Suppressions).Remove(bson.M{"id": id})
+	if err == nil {
+		db.suppressions.invalidate()
+	}
+	return mapErr(err)
+}
+
+// GetSuppressions returns the entries of the suppression list that have not expired yet
+func (db *OpenMapDb) GetSuppressions() ([]opm.Suppression, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var entries []suppression
+	// The TTL monitor only runs once a minute, so expired entries are filtered here
+	err := session.DB(db.DbName).C(db.Collections.Suppressions).Find(bson.M{"expires": bson.M{"$gt": time.Now().Unix()}}).Sort("expires").All(&entries)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	result := make([]opm.Suppression, len(entries))
+	for i, e := range entries {
+		result[i] = opm.Suppression{
+			ID:         e.ID,
+			PokemonIDs: e.PokemonIDs,
+			KeepOneIn:  e.KeepOneIn,
+			Reason:     e.Reason,
+			CreatedBy:  e.CreatedBy,
+			Expires:    e.Expires,
+		}
+	}
+	return result, nil
+}
+
+// Suppress reports whether the object should be dropped because of the suppression list.
+// Dropped Pokemon are counted per species, see SuppressedCounts.
+func (db *OpenMapDb) Suppress(o opm.MapObject) bool {
+	if o.Type != opm.POKEMON {
+		return false
+	}
+	f := db.suppressions
+	now := time.Now()
+	f.Lock()
+	stale := now.Sub(f.loaded) > suppressionRefresh
+	if stale {
+		// Other objects are checked against the old list while it's reloaded
+		f.loaded = now
+	}
+	f.Unlock()
+	if stale {
+		entries, err := db.GetSuppressions()
+		f.Lock()
+		if err != nil {
+			// Keep the old list
+			log.Println(err)
+		} else if f.loaded.Equal(now) {
+			// Not invalidated while loading, otherwise the next call loads it again
+			f.entries = entries
+		}
+		f.Unlock()
+	}
+	f.Lock()
+	defer f.Unlock()
+	for _, e := range f.entries {
+		if e.Expires <= now.Unix() || !containsInt(e.PokemonIDs, o.PokemonID) {
+			continue
+		}
+		n := f.matched[e.ID]
+		f.matched[e.ID] = n + 1
+		if e.KeepOneIn > 0 && n%int64(e.KeepOneIn) == 0 {
+			return false
+		}
+		f.dropped[o.PokemonID]++
+		return true
+	}
+	return false
+}
+
+// SuppressedCounts returns the number of dropped Pokemon per species since the start of the process
+func (db *OpenMapDb) SuppressedCounts() map[int]int64 {
+	f := db.suppressions
+	f.Lock()
+	defer f.Unlock()
+	counts := make(map[int]int64, len(f.dropped))
+	for id, n := range f.dropped {
+		counts[id] = n
+	}
+	return counts
+}
+
+// invalidate makes the next Suppress call reload the list
+func (f *suppressionFilter) invalidate() {
+	f.Lock()
+	defer f.Unlock()
+	f.loaded = time.Time{}
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func TestSuppressWhileReloading(t *testing.T) {
+	db := testDB(t)
+	s, err := db.AddSuppression(opm.Suppression{PokemonIDs: []int{25}, Reason: "event", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pikachu := opm.MapObject{Type: opm.POKEMON, PokemonID: 25}
+	// Loads the list, later reloads check against the old one until they are done
+	if !db.Suppress(pikachu) {
+		t.Fatal("Pikachu not suppressed")
+	}
+	// Run with -race, the list is reloaded while objects are checked
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if j%10 == 0 {
+					db.suppressions.invalidate()
+				}
+				if !db.Suppress(pikachu) {
+					t.Error("Pikachu not suppressed")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := db.SuppressedCounts()[25]; n != 801 {
+		t.Errorf("suppressed %d Pikachu, want 801", n)
+	}
+	if db.Suppress(opm.MapObject{Type: opm.POKEMON, PokemonID: 16}) {
+		t.Error("Pidgey suppressed")
+	}
+	if err := db.RemoveSuppression(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if db.Suppress(pikachu) {
+		t.Error("Pikachu suppressed after the entry was removed")
+	}
+}
+
+func TestSuppressKeepsOneInN(t *testing.T) {
+	db := testDB(t)
+	if _, err := db.AddSuppression(opm.Suppression{PokemonIDs: []int{25}, KeepOneIn: 4, Expires: time.Now().Add(time.Hour).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for i := 0; i < 20; i++ {
+		if !db.Suppress(opm.MapObject{Type: opm.POKEMON, PokemonID: 25}) {
+			kept++
+		}
+	}
+	if kept != 5 {
+		t.Errorf("kept %d of 20, want 1 in 4", kept)
+	}
+}
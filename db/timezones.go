@@ -0,0 +1,108 @@
+package db
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// timezoneQueue is the number of forts waiting for their timezone to be resolved
+const timezoneQueue = 1000
+
+// fortTimezone is the resolved timezone of a fort in the Timezones collection
+type fortTimezone struct {
+	ID       string
+	Timezone string
+}
+
+// timezoneCache keeps the timezones of the forts by id. A fort is resolved once, the result
+// is kept forever because forts don't move.
+type timezoneCache struct {
+	sync.Mutex
+	zones   map[string]string
+	pending map[string]bool
+	queue   chan opm.MapObject
+	start   sync.Once
+}
+
+func newTimezoneCache() *timezoneCache {
+	return &timezoneCache{
+		zones:   make(map[string]string),
+		pending: make(map[string]bool),
+		queue:   make(chan opm.MapObject, timezoneQueue),
+	}
+}
+
+// timezoneOf returns the stored timezone of a fort, "" if it is not known yet. Unknown
+// forts are queued for resolution, so the scan that saves them is not delayed by the lookup.
+func (db *OpenMapDb) timezoneOf(session *mgo.Session, m opm.MapObject) string {
+	if db.ResolveTimezone == nil || m.Type == opm.POKEMON {
+		return ""
+	}
+	c := db.timezones
+	c.Lock()
+	tz, ok := c.zones[m.ID]
+	pending := c.pending[m.ID]
+	c.Unlock()
+	if ok || pending {
+		return tz
+	}
+	var stored fortTimezone
+	err := session.DB(db.DbName).C(db.Collections.Timezones).Find(bson.M{"id": m.ID}).One(&stored)
+	if err == nil {
+		c.Lock()
+		c.zones[m.ID] = stored.Timezone
+		c.Unlock()
+		return stored.Timezone
+	}
+	if err != mgo.ErrNotFound {
+		log.Println(err)
+		return ""
+	}
+	c.start.Do(func() { go db.resolveTimezones() })
+	c.Lock()
+	defer c.Unlock()
+	select {
+	case c.queue <- m:
+		c.pending[m.ID] = true
+	default:
+		// Tried again the next time the fort is saved
+	}
+	return ""
+}
+
+// resolveTimezones resolves the queued forts one after another and adds the timezone to
+// the stored fort
+func (db *OpenMapDb) resolveTimezones() {
+	for m := range db.timezones.queue {
+		tz, err := db.ResolveTimezone(m.Lat, m.Lng)
+		if err != nil {
+			log.Printf("Failed to resolve the timezone of %s: %s", m.ID, err)
+			db.timezones.Lock()
+			delete(db.timezones.pending, m.ID)
+			db.timezones.Unlock()
+			continue
+		}
+		session := db.mongoSession.Copy()
+		_, err = session.DB(db.DbName).C(db.Collections.Timezones).Upsert(bson.M{"id": m.ID}, fortTimezone{ID: m.ID, Timezone: tz})
+		if err == nil {
+			err = session.DB(db.DbName).C(db.Collections.Objects).Update(bson.M{"id": m.ID}, bson.M{"$set": bson.M{"timezone": tz}})
+			if err == mgo.ErrNotFound {
+				err = nil
+			}
+		}
+		session.Close()
+		if err != nil {
+			log.Println(err)
+		}
+		db.timezones.Lock()
+		if err == nil {
+			db.timezones.zones[m.ID] = tz
+		}
+		delete(db.timezones.pending, m.ID)
+		db.timezones.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// countingResolver resolves every location to zone and counts the lookups
+type countingResolver struct {
+	sync.Mutex
+	zone  string
+	calls int
+}
+
+func (r *countingResolver) resolve(lat, lng float64) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls++
+	return r.zone, nil
+}
+
+func (r *countingResolver) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.calls
+}
+
+// storedTimezone waits until the stored fort has a timezone
+func storedTimezone(t *testing.T, db *OpenMapDb, id string) string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		o, err := db.GetObject(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.Timezone != "" {
+			return o.Timezone
+		}
+	}
+	t.Fatalf("timezone of %s not resolved", id)
+	return ""
+}
+
+func TestFortTimezoneResolvedOnce(t *testing.T) {
+	db := testDB(t)
+	r := &countingResolver{zone: "Europe/Berlin"}
+	db.ResolveTimezone = r.resolve
+	gym := opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 52.520008, Lng: 13.404954, Team: 1}
+	if err := db.AddMapObject(gym); err != nil {
+		t.Fatal(err)
+	}
+	if tz := storedTimezone(t, db, "g1"); tz != "Europe/Berlin" {
+		t.Errorf("timezone = %q, want Europe/Berlin", tz)
+	}
+	// Pokemon have no timezone
+	if err := db.AddMapObject(opm.MapObject{Type: opm.POKEMON, ID: "p1", PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: time.Now().Add(time.Hour).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	// Later upserts of the fort keep the zone without another lookup
+	gym.Team = 2
+	if err := db.AddMapObject(gym); err != nil {
+		t.Fatal(err)
+	}
+	if o, err := db.GetObject("g1"); err != nil || o.Team != 2 || o.Timezone != "Europe/Berlin" {
+		t.Errorf("updated gym = %+v, %v, want the new team and the zone", o, err)
+	}
+	// A new process reads the stored result instead of resolving again
+	db.timezones = newTimezoneCache()
+	if err := db.AddMapObject(gym); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.count(); n != 1 {
+		t.Errorf("%d lookups, want 1 for the gym", n)
+	}
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// notDeleted matches objects that are not tombstones
+var notDeleted = bson.M{"$ne": true}
+
+// notExpired matches expiries that have not passed at now, see opm.Expired
+func notExpired(now time.Time) bson.M {
+	return bson.M{"$gte": now.Unix()}
+}
+
+// tombstone is the update that marks an object as deleted
+func tombstone() bson.M {
+	return bson.M{"$set": bson.M{"deleted": true, "deletedat": time.Now().Unix()}}
+}
+
+// DeleteMapObjects marks the objects with the given ids as deleted. They are hidden from all
+// queries, but kept as tombstones so stream consumers learn about the deletion (see
+// GetDeletedSince), until PurgeTombstones removes them. It returns the number of deleted objects.
+func (db *OpenMapDb) DeleteMapObjects(ids []string) (int, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	change, err := session.DB(db.DbName).C(db.Collections.Objects).UpdateAll(bson.M{
+		"id":      bson.M{"$in": ids},
+		"deleted": notDeleted,
+	}, tombstone())
+	if err != nil {
+		return 0, mapErr(err)
+	}
+	return change.Updated, nil
+}
+
+// DeletedCursor is a position in the deleted objects, ordered by deletion time and id. It
+// points at the last object a consumer got, the zero cursor is before all tombstones.
+type DeletedCursor struct {
+	LastSeen int64 // unix time of the deletion
+	ID       string
+}
+
+// DeletedCursorAt returns the cursor before the objects deleted at or after the unix timestamp
+func DeletedCursorAt(since int64) DeletedCursor {
+	return DeletedCursor{LastSeen: since - 1}
+}
+
+// String encodes the cursor for clients, who pass it back opaque, see ParseDeletedCursor
+func (c DeletedCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.LastSeen, 10) + ":" + c.ID))
+}
+
+// ParseDeletedCursor decodes a cursor of DeletedCursor.String. Malformed cursors are
+// reported as ErrInvalidCursor.
+func ParseDeletedCursor(s string) (DeletedCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return DeletedCursor{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return DeletedCursor{}, ErrInvalidCursor
+	}
+	lastSeen, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || lastSeen < 0 {
+		return DeletedCursor{}, ErrInvalidCursor
+	}
+	return DeletedCursor{LastSeen: lastSeen, ID: parts[1]}, nil
+}
+
+// GetDeletedSince returns up to limit objects deleted after the cursor, in the order of
+// deletion time and id, and the cursor of the next page. Objects deleted in the same
+// second are split between pages without gaps or duplicates. Without new deletions the
+// given cursor is returned.
+func (db *OpenMapDb) GetDeletedSince(after DeletedCursor, limit int) ([]opm.MapObject, DeletedCursor, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var objects []object
+	q := bson.M{"$or": []bson.M{
+		{"deletedat": bson.M{"$gt": after.LastSeen}},
+		{"deletedat": after.LastSeen, "id": bson.M{"$gt": after.ID}},
+	}}
+	err := session.DB(db.DbName).C(db.Collections.Objects).Find(q).Sort("deletedat", "id").Limit(limit).All(&objects)
+	if err != nil {
+		return nil, after, mapErr(err)
+	}
+	next := after
+	result := make([]opm.MapObject, 0, len(objects))
+	for _, o := range objects {
+		next = DeletedCursor{LastSeen: o.DeletedAt, ID: o.ID}
+		if len(o.Loc.Coordinates) != 2 {
+			// Deleted for having no location, nobody can show it
+			continue
+		}
+		result = append(result, o.mapObject())
+	}
+	return result, next, nil
+}
+
+// PurgeTombstones removes the objects deleted before the given unix timestamp.
+// It returns the number of removed objects.
+func (db *OpenMapDb) PurgeTombstones(before int64) (int, error) {
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	change, err := session.DB(db.DbName).C(db.Collections.Objects).RemoveAll(bson.M{"deletedat": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, mapErr(err)
+	}
+	return change.Removed, nil
+}
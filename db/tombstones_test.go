@@ -0,0 +1,145 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFortUpdateKeepsTombstone(t *testing.T) {
+	gym := opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 52.5, Lng: 13.4, Team: 1, CapturedAt: 2000}
+	update, err := fortUpdate(newObject(gym, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, unset := update["$set"].(bson.M), update["$unset"].(bson.M)
+	if set["id"] != "g1" || set["team"] != 1 || set["lastseen"] != int64(2000) {
+		t.Errorf("$set = %v, want the observed fields", set)
+	}
+	// Details of the old owner are removed
+	if _, ok := unset["guardpokemonid"]; !ok {
+		t.Errorf("$unset = %v, want the fields the fort doesn't have", unset)
+	}
+	for _, f := range []string{"deleted", "deletedat", "timezone"} {
+		_, inSet := set[f]
+		_, inUnset := unset[f]
+		if inSet || inUnset {
+			t.Errorf("update changes %s: %v", f, update)
+		}
+	}
+	for f := range set {
+		if _, ok := unset[f]; ok {
+			t.Errorf("%s is set and unset", f)
+		}
+	}
+}
+
+func TestDeletedFortStaysDeleted(t *testing.T) {
+	db := testDB(t)
+	gym := opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 52.5, Lng: 13.4, Team: 1, GuardPokemonID: 149, CapturedAt: 1000}
+	if err := db.AddMapObject(gym); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.DeleteMapObjects([]string{"g1"}); n != 1 || err != nil {
+		t.Fatalf("DeleteMapObjects = %d, %v", n, err)
+	}
+	// A newer scan still sees the gym, now with a new owner
+	gym.Team, gym.GuardPokemonID, gym.CapturedAt = 2, 0, 2000
+	if err := db.AddMapObject(gym); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetObject("g1"); err != ErrNotFound {
+		t.Errorf("GetObject = %v, want the gym hidden", err)
+	}
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	var o object
+	if err := session.DB(db.DbName).C(db.Collections.Objects).Find(bson.M{"id": "g1"}).One(&o); err != nil {
+		t.Fatal(err)
+	}
+	if !o.Deleted || o.DeletedAt == 0 || o.Team != 2 || o.GuardPokemonID != 0 {
+		t.Errorf("stored gym = %+v, want the new observation with the tombstone", o)
+	}
+	if deleted, _, err := db.GetDeletedSince(DeletedCursorAt(o.DeletedAt), 10); err != nil || len(deleted) != 1 {
+		t.Errorf("GetDeletedSince = %v, %v, want the gym", deleted, err)
+	}
+}
+
+func TestDeletedCursor(t *testing.T) {
+	for _, c := range []DeletedCursor{{}, {LastSeen: 1500000000, ID: "abc"}, {LastSeen: 7, ID: "with:colon"}} {
+		got, err := ParseDeletedCursor(c.String())
+		if err != nil || got != c {
+			t.Errorf("ParseDeletedCursor(%s) = %+v, %v, want %+v", c, got, err, c)
+		}
+	}
+	for _, s := range []string{"", "!!", "MTIz", "eDph", "LTE6YQ"} {
+		if _, err := ParseDeletedCursor(s); err != ErrInvalidCursor {
+			t.Errorf("ParseDeletedCursor(%q) = %v, want ErrInvalidCursor", s, err)
+		}
+	}
+}
+
+func TestGetDeletedSincePages(t *testing.T) {
+	db := testDB(t)
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	c := session.DB(db.DbName).C(db.Collections.Objects)
+	// Most deletions share a second, the pages have to split them by id
+	var want []string
+	for i := 0; i < 23; i++ {
+		o := object{Type: opm.POKEMON, ID: fmt.Sprintf("p%02d", i), Loc: location{Type: "Point", Coordinates: []float64{13.4, 52.5}}, Deleted: true, DeletedAt: 1000}
+		switch {
+		case i%7 == 0:
+			o.DeletedAt = 1001
+		case i == 5:
+			// Not shown, but the cursor moves past it
+			o.Loc = location{}
+		}
+		if err := c.Insert(o); err != nil {
+			t.Fatal(err)
+		}
+		if i != 5 && o.DeletedAt == 1000 {
+			want = append(want, o.ID)
+		}
+	}
+	for i := 0; i < 23; i += 7 {
+		want = append(want, fmt.Sprintf("p%02d", i))
+	}
+	if err := c.Insert(object{Type: opm.POKEMON, ID: "alive", Loc: location{Type: "Point", Coordinates: []float64{13.4, 52.5}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	var cursor DeletedCursor
+	for page := 0; page < 10; page++ {
+		deleted, next, err := db.GetDeletedSince(cursor, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next == cursor {
+			break
+		}
+		// The cursor passes through its encoding like it does for clients
+		if cursor, err = ParseDeletedCursor(next.String()); err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range deleted {
+			got = append(got, o.ID)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("paged ids = %v, want %v", got, want)
+	}
+	if cursor != (DeletedCursor{LastSeen: 1001, ID: "p21"}) {
+		t.Errorf("last cursor = %+v, want the last deletion", cursor)
+	}
+	// New deletions in the second of the cursor are found
+	if err := c.Insert(object{Type: opm.POKEMON, ID: "p99", Loc: location{Type: "Point", Coordinates: []float64{13.4, 52.5}}, Deleted: true, DeletedAt: 1001}); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, _, err := db.GetDeletedSince(cursor, 4); err != nil || len(deleted) != 1 || deleted[0].ID != "p99" {
+		t.Errorf("GetDeletedSince after a new deletion = %v, %v, want p99", deleted, err)
+	}
+}
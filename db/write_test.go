@@ -0,0 +1,121 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"gopkg.in/mgo.v2/bson"
+
+	"golang.org/x/net/context"
+)
+
+func testPokemon(id string) opm.MapObject {
+	return opm.MapObject{Type: opm.POKEMON, ID: id, PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: time.Now().Add(10 * time.Minute).Unix()}
+}
+
+func TestAddMapObjectDuplicates(t *testing.T) {
+	for _, upsert := range []bool{false, true} {
+		db := testDB(t)
+		db.UpsertPokemon = upsert
+		if err := db.AddMapObject(testPokemon("p1")); err != nil {
+			t.Fatalf("upsert %v: %v", upsert, err)
+		}
+		if err := db.AddMapObject(testPokemon("p1")); !errors.Is(err, ErrDuplicate) {
+			t.Errorf("upsert %v: second AddMapObject = %v, want ErrDuplicate", upsert, err)
+		}
+		// Duplicates in a batch are skipped quietly
+		if err := db.AddMapObjects([]opm.MapObject{testPokemon("p1"), testPokemon("p2")}); err != nil {
+			t.Errorf("upsert %v: AddMapObjects with a duplicate = %v, want nil", upsert, err)
+		}
+		if _, err := db.GetObject("p2"); err != nil {
+			t.Errorf("upsert %v: the object after the duplicate wasn't stored: %v", upsert, err)
+		}
+	}
+}
+
+func TestWriteFailures(t *testing.T) {
+	db := testDB(t)
+	// Mongo refuses collection names with a $, every write fails
+	db.Collections.Objects = "broken$objects"
+	db.Collections.Accounts = "broken$accounts"
+	err := db.AddMapObject(testPokemon("p1"))
+	if err == nil || errors.Is(err, ErrDuplicate) {
+		t.Errorf("AddMapObject into a broken collection = %v, want the write error", err)
+	}
+	if err := db.AddMapObjects([]opm.MapObject{testPokemon("p1")}); err == nil {
+		t.Error("AddMapObjects into a broken collection didn't fail")
+	}
+	fort := opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 52.5, Lng: 13.4}
+	if err := db.AddMapObject(fort); err == nil || errors.Is(err, ErrDuplicate) {
+		t.Errorf("AddMapObject of a gym into a broken collection = %v, want the write error", err)
+	}
+	a := opm.Account{Username: "ash", Password: "pw", Provider: "ptc"}
+	if err := db.AddAccount(a); err == nil {
+		t.Error("AddAccount into a broken collection didn't fail")
+	}
+	if err := db.UpdateAccount(a); err == nil {
+		t.Error("UpdateAccount in a broken collection didn't fail")
+	}
+}
+
+func TestIVRanksAreStored(t *testing.T) {
+	db := testDB(t)
+	db.Leagues = []opm.League{{Name: "great", MaxCP: 1500}}
+	p := testPokemon("venusaur")
+	p.PokemonID = 3
+	p.IVs = &opm.IVs{Attack: 0, Defense: 14, Stamina: 11}
+	if err := db.AddMapObject(p); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := db.GetObject("venusaur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.IVs == nil || stored.IVs.Percent != 55.6 || len(stored.IVs.Ranks) != 1 || stored.IVs.Ranks[0].Rank != 1 {
+		t.Errorf("stored IVs = %+v, want 55.6%% and rank 1 in the great league", stored.IVs)
+	}
+}
+
+func TestSaveMapObjectsSkipsStaleForts(t *testing.T) {
+	db := testDB(t)
+	gym := func(team int, captured int64) opm.MapObject {
+		return opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 52.5, Lng: 13.4, Team: team, CapturedAt: captured}
+	}
+	// The later scan finishes first
+	if saved := db.SaveMapObjects(context.Background(), []opm.MapObject{gym(2, 2000)}); len(saved) != 1 {
+		t.Fatalf("saved %v, want the gym", saved)
+	}
+	// The older one is neither stored nor published
+	if saved := db.SaveMapObjects(context.Background(), []opm.MapObject{gym(1, 1000)}); len(saved) != 0 {
+		t.Errorf("saved %v of the older scan, want nothing", saved)
+	}
+	o, err := db.GetObject("g1")
+	if err != nil || o.Team != 2 || o.CapturedAt != 2000 {
+		t.Errorf("GetObject = %+v, %v, want the newer observation", o, err)
+	}
+}
+
+func TestFortWithoutCaptureTimeIsReplaced(t *testing.T) {
+	db := testDB(t)
+	// Stored before capture times were recorded
+	old := newObject(opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 52.5, Lng: 13.4, Team: 1}, nil, nil)
+	old.LastSeen = 0
+	session := db.mongoSession.Copy()
+	defer session.Close()
+	c := session.DB(db.DbName).C(db.Collections.Objects)
+	if err := c.Insert(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddMapObject(opm.MapObject{Type: opm.GYM, ID: "g1", Lat: 52.5, Lng: 13.4, Team: 2, CapturedAt: 1000}); err != nil {
+		t.Fatalf("AddMapObject = %v, want the fort replaced", err)
+	}
+	var stored []object
+	if err := c.Find(bson.M{"id": "g1"}).All(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].Team != 2 || stored[0].LastSeen != 1000 {
+		t.Errorf("stored = %+v, want one gym with the new observation", stored)
+	}
+}
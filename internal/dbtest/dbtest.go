@@ -0,0 +1,272 @@
+// Package dbtest has the contract tests of opm.Database, which every storage backend runs
+// against a database of its own.
+package dbtest
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// Backend is a backend under test with the setup methods that opm.Database doesn't have
+type Backend struct {
+	opm.Database
+	AddAccount func(a opm.Account) error
+	AddProxy   func(p opm.Proxy) error
+}
+
+// Run runs the contract tests. open returns an empty database that is dropped after the test.
+func Run(t *testing.T, open func(t *testing.T) Backend) {
+	t.Run("MapObjects", func(t *testing.T) { testMapObjects(t, open(t)) })
+	t.Run("Forts", func(t *testing.T) { testForts(t, open(t)) })
+	t.Run("FortRace", func(t *testing.T) { testFortRace(t, open(t)) })
+	t.Run("Accounts", func(t *testing.T) { testAccounts(t, open(t)) })
+	t.Run("Captchas", func(t *testing.T) { testCaptchas(t, open(t)) })
+	t.Run("Proxies", func(t *testing.T) { testProxies(t, open(t)) })
+}
+
+func ids(objects []opm.MapObject) map[string]bool {
+	got := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		got[o.ID] = true
+	}
+	return got
+}
+
+func testMapObjects(t *testing.T, b Backend) {
+	expiry := time.Now().Add(10 * time.Minute).Unix()
+	objects := []opm.MapObject{
+		{Type: opm.POKEMON, ID: "near", PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: expiry},
+		// About 1.1 km north
+		{Type: opm.POKEMON, ID: "far", PokemonID: 16, Lat: 52.51, Lng: 13.4, Expiry: expiry},
+		{Type: opm.POKEMON, ID: "expired", PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: time.Now().Add(-time.Minute).Unix()},
+		{Type: opm.GYM, ID: "gym", Lat: 52.5001, Lng: 13.4, Team: 2},
+	}
+	for _, o := range objects {
+		if err := b.AddMapObject(o); err != nil {
+			t.Fatalf("AddMapObject(%s) = %v", o.ID, err)
+		}
+	}
+	if err := b.AddMapObject(objects[0]); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("duplicate Pokemon = %v, want db.ErrDuplicate", err)
+	}
+	if err := b.AddMapObject(opm.MapObject{Type: opm.POKEMON, ID: "invalid", Lat: 91, Lng: 13.4, Expiry: expiry}); err == nil {
+		t.Error("Pokemon with an invalid latitude was stored")
+	}
+
+	got, err := b.GetMapObjects(52.5, 13.4, []int{opm.POKEMON, opm.GYM}, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := ids(got); len(got) != 2 || !found["near"] || !found["gym"] {
+		t.Errorf("objects within 200 m = %v, want near and gym", found)
+	}
+	for _, o := range got {
+		if o.ID == "near" && (o.PokemonID != 16 || o.Expiry != expiry || o.Lat != 52.5 || o.Lng != 13.4) {
+			t.Errorf("stored Pokemon = %+v, want %+v", o, objects[0])
+		}
+	}
+	got, err = b.GetMapObjects(52.5, 13.4, []int{opm.POKEMON}, 2000)
+	if found := ids(got); err != nil || len(got) != 2 || !found["near"] || !found["far"] {
+		t.Errorf("Pokemon within 2 km = %v, %v, want near and far", found, err)
+	}
+	got, err = b.GetMapObjects(52.5, 13.4, nil, 2000)
+	if err != nil || len(got) != 0 {
+		t.Errorf("objects without types = %v, %v, want none", got, err)
+	}
+}
+
+func testForts(t *testing.T, b Backend) {
+	gym := func(team int, captured int64) opm.MapObject {
+		return opm.MapObject{Type: opm.GYM, ID: "gym", Lat: 52.5, Lng: 13.4, Team: team, CapturedAt: captured}
+	}
+	team := func() int {
+		got, err := b.GetMapObjects(52.5, 13.4, []int{opm.GYM}, 100)
+		if err != nil || len(got) != 1 {
+			t.Fatalf("gyms = %v, %v, want one", got, err)
+		}
+		return got[0].Team
+	}
+	if err := b.AddMapObject(gym(1, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	// Racing scans finish out of order, an older observation doesn't replace the fort
+	if err := b.AddMapObject(gym(2, 1000)); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("older fort = %v, want db.ErrDuplicate", err)
+	}
+	if got := team(); got != 1 {
+		t.Errorf("team after an older observation = %d, want 1", got)
+	}
+	if err := b.AddMapObject(gym(3, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	if got := team(); got != 3 {
+		t.Errorf("team after a newer observation = %d, want 3", got)
+	}
+}
+
+// testFortRace saves the gym of overlapping scans at the same time, started in random order.
+// The scan captured last wins however the writes interleave.
+func testFortRace(t *testing.T, b Backend) {
+	const scans = 20
+	var wg sync.WaitGroup
+	for _, i := range rand.Perm(scans) {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			gym := opm.MapObject{Type: opm.GYM, ID: "gym", Lat: 52.5, Lng: 13.4, Team: 1 + i%3, GymPoints: int64(i), CapturedAt: int64(1000 + i)}
+			if err := b.AddMapObject(gym); err != nil && !errors.Is(err, db.ErrDuplicate) {
+				t.Errorf("scan %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	got, err := b.GetMapObjects(52.5, 13.4, []int{opm.GYM}, 100)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("gyms = %v, %v, want one", got, err)
+	}
+	if last := scans - 1; got[0].GymPoints != int64(last) || got[0].Team != 1+last%3 {
+		t.Errorf("stored gym = %+v, want the one of scan %d", got[0], last)
+	}
+}
+
+func testAccounts(t *testing.T, b Backend) {
+	if _, err := b.GetAccount(); !errors.Is(err, db.ErrNoAccountAvailable) {
+		t.Errorf("GetAccount without accounts = %v, want db.ErrNoAccountAvailable", err)
+	}
+	for _, u := range []string{"ash", "misty"} {
+		if err := b.AddAccount(opm.Account{Username: u, Password: "pw", Provider: "ptc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Accounts are handed out once until they are returned
+	first, err := b.GetAccount()
+	if err != nil || !first.Used || first.Password != "pw" {
+		t.Fatalf("GetAccount = %+v, %v", first, err)
+	}
+	second, err := b.GetAccount()
+	if err != nil || second.Username == first.Username {
+		t.Fatalf("second GetAccount = %+v, %v, want the other account", second, err)
+	}
+	if _, err := b.GetAccount(); !errors.Is(err, db.ErrNoAccountAvailable) {
+		t.Errorf("GetAccount with all accounts in use = %v, want db.ErrNoAccountAvailable", err)
+	}
+	// Returning an account only marks it as not used, the copy of the trainer isn't stored
+	first.Pool = "eu"
+	if err := b.ReturnAccount(first); err != nil {
+		t.Fatal(err)
+	}
+	again, err := b.GetAccount()
+	if err != nil || again.Username != first.Username || again.Pool != "" {
+		t.Fatalf("GetAccount after ReturnAccount = %+v, %v, want %s without a pool", again, err, first.Username)
+	}
+	if err := b.ReturnAccount(opm.Account{Username: "brock"}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ReturnAccount of an unknown account = %v, want db.ErrNotFound", err)
+	}
+	// UpdateAccount only stores the fields the trainer changes
+	again.AuthToken, again.Banned = "rotated", true
+	if err := b.UpdateAccount(again); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReturnAccount(again); err != nil {
+		t.Fatal(err)
+	}
+	again, err = b.GetAccount()
+	if err != nil || again.Username != first.Username || again.AuthToken != "rotated" || again.Banned {
+		t.Fatalf("GetAccount after UpdateAccount = %+v, %v, want %s with the new token", again, err, first.Username)
+	}
+	if err := b.UpdateAccount(opm.Account{Username: "brock"}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("UpdateAccount of an unknown account = %v, want db.ErrNotFound", err)
+	}
+
+	// Banned accounts are not handed out anymore, returning the trainer's copy keeps the ban
+	if err := b.MarkAccountBanned(again.Username, opm.BanCredentials); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReturnAccount(again); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetAccount(); !errors.Is(err, db.ErrNoAccountAvailable) {
+		t.Errorf("GetAccount with a banned account = %v, want db.ErrNoAccountAvailable", err)
+	}
+	if err := b.MarkAccountBanned("brock", opm.BanCredentials); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("MarkAccountBanned of an unknown account = %v, want db.ErrNotFound", err)
+	}
+
+	// Accounts with an expired token wait for a new one
+	if err := b.MarkTokenExpired(second.Username); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReturnAccount(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetAccount(); !errors.Is(err, db.ErrNoAccountAvailable) {
+		t.Errorf("GetAccount with an expired token = %v, want db.ErrNoAccountAvailable", err)
+	}
+	if err := b.MarkTokenExpired("brock"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("MarkTokenExpired of an unknown account = %v, want db.ErrNotFound", err)
+	}
+}
+
+func testCaptchas(t *testing.T, b Backend) {
+	if err := b.AddAccount(opm.Account{Username: "ash", Password: "pw", Provider: "ptc"}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := b.GetAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A flagged account is put back, but not handed out
+	if err := b.FlagCaptcha(a.Username, "https://captcha.example/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetAccount(); !errors.Is(err, db.ErrNoAccountAvailable) {
+		t.Errorf("GetAccount with a flagged account = %v, want db.ErrNoAccountAvailable", err)
+	}
+	flagged, err := b.GetCaptchaAccounts()
+	if err != nil || len(flagged) != 1 || flagged[0].CaptchaURL != "https://captcha.example/1" || flagged[0].Used {
+		t.Errorf("captcha accounts = %+v, %v, want ash with the URL", flagged, err)
+	}
+	if err := b.ClearCaptcha(a.Username); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ClearCaptcha(a.Username); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ClearCaptcha of an unflagged account = %v, want db.ErrNotFound", err)
+	}
+	if a, err := b.GetAccount(); err != nil || a.CaptchaFlagged {
+		t.Errorf("GetAccount after ClearCaptcha = %+v, %v", a, err)
+	}
+	if flagged, err := b.GetCaptchaAccounts(); err != nil || len(flagged) != 0 {
+		t.Errorf("captcha accounts after ClearCaptcha = %+v, %v, want none", flagged, err)
+	}
+}
+
+func testProxies(t *testing.T, b Backend) {
+	if _, err := b.GetProxy(); !errors.Is(err, db.ErrNoProxyAvailable) {
+		t.Errorf("GetProxy without proxies = %v, want db.ErrNoProxyAvailable", err)
+	}
+	if err := b.AddProxy(opm.Proxy{ID: 1, URL: "http://proxy.example:3128"}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := b.GetProxy()
+	if err != nil || p.ID != 1 || !p.Use || p.URL != "http://proxy.example:3128" {
+		t.Fatalf("GetProxy = %+v, %v", p, err)
+	}
+	if _, err := b.GetProxy(); !errors.Is(err, db.ErrNoProxyAvailable) {
+		t.Errorf("GetProxy with the proxy in use = %v, want db.ErrNoProxyAvailable", err)
+	}
+	if err := b.ReturnProxy(p); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := b.GetProxy(); err != nil || p.ID != 1 {
+		t.Errorf("GetProxy after ReturnProxy = %+v, %v", p, err)
+	}
+	if err := b.ReturnProxy(opm.Proxy{ID: 2}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ReturnProxy of an unknown proxy = %v, want db.ErrNotFound", err)
+	}
+}
@@ -0,0 +1,44 @@
+// Package faults injects failures at named points of the services, for testing retries,
+// pauses and degraded modes against an outage. Injection is only compiled in with the
+// faults build tag, other builds get no-op hooks:
+//
+//	go build -tags faults ./scanner
+//
+// Rules are set at runtime through Handler, which the services only mount when the
+// UnsafeFaultInjection setting is on.
+package faults
+
+import (
+	"errors"
+	"time"
+)
+
+// Injection points
+const (
+	DbRead        = "db.read"
+	DbWrite       = "db.write"
+	UpstreamLogin = "upstream.login"
+	UpstreamMap   = "upstream.map"
+	ProxyConnect  = "proxy.connect"
+)
+
+// Points are the known injection points
+var Points = []string{DbRead, DbWrite, UpstreamLogin, UpstreamMap, ProxyConnect}
+
+// ErrInjected is returned by Inject for an injected failure
+var ErrInjected = errors.New("Injected failure")
+
+// Rule is the failure behaviour of an injection point
+type Rule struct {
+	ErrorRate float64       `json:"errorRate"` // fraction of calls that fail
+	Latency   time.Duration `json:"latency"`   // added to every call
+}
+
+func validPoint(point string) bool {
+	for _, p := range Points {
+		if p == point {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build !faults
+
+package faults
+
+import "net/http"
+
+// Compiled reports whether injection is compiled in
+const Compiled = false
+
+// Inject does nothing without the faults build tag
+func Inject(point string) error {
+	return nil
+}
+
+// Set does nothing without the faults build tag
+func Set(point string, r Rule) {}
+
+// Rules returns no rules without the faults build tag
+func Rules() map[string]Rule {
+	return nil
+}
+
+// Handler answers 404 without the faults build tag
+func Handler(w http.ResponseWriter, r *http.Request) {
+	http.NotFound(w, r)
+}
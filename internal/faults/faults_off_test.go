@@ -0,0 +1,21 @@
+//go:build !faults
+
+package faults
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNoInjectionWithoutTag(t *testing.T) {
+	Set(DbWrite, Rule{ErrorRate: 1})
+	if err := Inject(DbWrite); err != nil || len(Rules()) != 0 {
+		t.Errorf("Inject = %v with rules %v, want the hooks to do nothing", err, Rules())
+	}
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/debug/faults", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Handler = %d, want 404", w.Code)
+	}
+}
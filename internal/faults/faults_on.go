@@ -0,0 +1,95 @@
+//go:build faults
+
+package faults
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Compiled reports whether injection is compiled in
+const Compiled = true
+
+var (
+	mutex sync.RWMutex
+	rules = make(map[string]Rule)
+)
+
+// Inject applies the rule of the point: it waits for the latency and returns ErrInjected
+// for the configured fraction of calls
+func Inject(point string) error {
+	mutex.RLock()
+	r, ok := rules[point]
+	mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	if r.Latency > 0 {
+		time.Sleep(r.Latency)
+	}
+	if r.ErrorRate > 0 && rand.Float64() < r.ErrorRate {
+		return ErrInjected
+	}
+	return nil
+}
+
+// Set replaces the rule of the point, a zero rule removes it
+func Set(point string, r Rule) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if r == (Rule{}) {
+		delete(rules, point)
+		return
+	}
+	rules[point] = r
+}
+
+// Rules returns the active rules by point
+func Rules() map[string]Rule {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	active := make(map[string]Rule, len(rules))
+	for p, r := range rules {
+		active[p] = r
+	}
+	return active
+}
+
+// Handler lists the rules (GET) or sets the rule of a point (POST) with the parameters
+// point, errorRate (0-1) and latencyMs. Authorization is up to the caller.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		point := r.FormValue("point")
+		if !validPoint(point) {
+			http.Error(w, "Unknown point", http.StatusBadRequest)
+			return
+		}
+		var rule Rule
+		var err error
+		if v := r.FormValue("errorRate"); v != "" {
+			rule.ErrorRate, err = strconv.ParseFloat(v, 64)
+			if err != nil || rule.ErrorRate < 0 || rule.ErrorRate > 1 {
+				http.Error(w, "Invalid errorRate", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.FormValue("latencyMs"); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil || ms < 0 {
+				http.Error(w, "Invalid latencyMs", http.StatusBadRequest)
+				return
+			}
+			rule.Latency = time.Duration(ms) * time.Millisecond
+		}
+		Set(point, rule)
+	} else if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Rules())
+}
@@ -0,0 +1,88 @@
+//go:build faults
+
+package faults
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInject(t *testing.T) {
+	defer Set(DbRead, Rule{})
+	if err := Inject(DbRead); err != nil {
+		t.Errorf("Inject without a rule = %v", err)
+	}
+	Set(DbRead, Rule{ErrorRate: 1, Latency: 20 * time.Millisecond})
+	start := time.Now()
+	if err := Inject(DbRead); err != ErrInjected {
+		t.Errorf("Inject = %v, want ErrInjected", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Inject returned after %s, want the latency", d)
+	}
+	if err := Inject(DbWrite); err != nil {
+		t.Errorf("Inject at another point = %v", err)
+	}
+	// A zero rule removes the point
+	Set(DbRead, Rule{})
+	if len(Rules()) != 0 || Inject(DbRead) != nil {
+		t.Errorf("rules = %v after the reset, want none", Rules())
+	}
+}
+
+func TestInjectErrorRate(t *testing.T) {
+	defer Set(UpstreamMap, Rule{})
+	Set(UpstreamMap, Rule{ErrorRate: 0.25})
+	failed := 0
+	for i := 0; i < 4000; i++ {
+		if Inject(UpstreamMap) != nil {
+			failed++
+		}
+	}
+	if failed < 800 || failed > 1200 {
+		t.Errorf("%d of 4000 calls failed, want about 1000", failed)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	defer Set(ProxyConnect, Rule{})
+	post := func(values url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/debug/faults", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		Handler(w, r)
+		return w
+	}
+	for name, values := range map[string]url.Values{
+		"unknown point":    {"point": {"db.delete"}, "errorRate": {"1"}},
+		"rate above 1":     {"point": {ProxyConnect}, "errorRate": {"1.5"}},
+		"negative rate":    {"point": {ProxyConnect}, "errorRate": {"-0.1"}},
+		"invalid latency":  {"point": {ProxyConnect}, "latencyMs": {"soon"}},
+		"negative latency": {"point": {ProxyConnect}, "latencyMs": {"-5"}},
+	} {
+		if w := post(values); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", name, w.Code)
+		}
+	}
+	if len(Rules()) != 0 {
+		t.Fatalf("rules = %v, want the invalid ones rejected", Rules())
+	}
+	w := post(url.Values{"point": {ProxyConnect}, "errorRate": {"0.5"}, "latencyMs": {"100"}})
+	var rules map[string]Rule
+	if err := json.Unmarshal(w.Body.Bytes(), &rules); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", w.Code, w.Body)
+	}
+	if want := (Rule{ErrorRate: 0.5, Latency: 100 * time.Millisecond}); rules[ProxyConnect] != want || Rules()[ProxyConnect] != want {
+		t.Errorf("rules = %v, want %v for %s", rules, want, ProxyConnect)
+	}
+	w = httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("DELETE", "/debug/faults", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE = %d, want 405", w.Code)
+	}
+}
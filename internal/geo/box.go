@@ -0,0 +1,60 @@
+package geo
+
+import "math"
+
+// Box is a rectangular area on the map. Boxes crossing the antimeridian have West > East.
+type Box struct {
+	North float64
+	South float64
+	East  float64
+	West  float64
+}
+
+// IsSet returns true if the box is not empty
+func (b Box) IsSet() bool {
+	return b.North != b.South && b.East != b.West
+}
+
+// Contains returns true if the point is inside the box
+func (b Box) Contains(p LatLng) bool {
+	if p.Lat > b.North || p.Lat < b.South {
+		return false
+	}
+	if b.West > b.East {
+		return p.Lng >= b.West || p.Lng <= b.East
+	}
+	return p.Lng >= b.West && p.Lng <= b.East
+}
+
+// BoxAround returns the smallest box that contains the circle around center. Circles
+// that reach a pole get all longitudes.
+func BoxAround(center LatLng, radius float64) Box {
+	d := Angle(radius)
+	b := Box{
+		North: center.Lat + degrees(d),
+		South: center.Lat - degrees(d),
+	}
+	if b.North >= 90 || b.South <= -90 {
+		b.North = math.Min(b.North, 90)
+		b.South = math.Max(b.South, -90)
+		b.West, b.East = -180, 180
+		return b
+	}
+	dLng := degrees(math.Asin(math.Sin(d) / math.Cos(radians(center.Lat))))
+	if dLng >= 180 {
+		b.West, b.East = -180, 180
+		return b
+	}
+	b.West = NormalizeLng(center.Lng - dLng)
+	b.East = NormalizeLng(center.Lng + dLng)
+	return b
+}
+
+// Center returns the center of the box
+func (b Box) Center() LatLng {
+	east := b.East
+	if b.West > b.East {
+		east += 360
+	}
+	return LatLng{Lat: (b.North + b.South) / 2, Lng: NormalizeLng((b.West + east) / 2)}
+}
@@ -0,0 +1,49 @@
+package geo
+
+import (
+	"math"
+	"testing"
+	"testing/quick"
+)
+
+func TestBoxAroundContainsCircle(t *testing.T) {
+	// Every point of the circle is in the box, also near the poles and across the antimeridian
+	contains := func(p point, r uint32, bearing uint16) bool {
+		radius := float64(r%500000) + 1
+		return BoxAround(p.LatLng, radius).Contains(Destination(p.LatLng, radius*0.999, float64(bearing%360)))
+	}
+	if err := quick.Check(contains, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoxAroundEdgeCases(t *testing.T) {
+	// Across the antimeridian west is east of east
+	b := BoxAround(LatLng{0, 179.99}, 10000)
+	if b.West < b.East || !b.Contains(LatLng{0, -179.99}) || !b.Contains(LatLng{0, 179.95}) || b.Contains(LatLng{0, 0}) {
+		t.Errorf("box across the antimeridian = %+v", b)
+	}
+	if c := b.Center(); math.Abs(c.Lng-179.99) > 1e-6 || math.Abs(c.Lat) > 1e-9 {
+		t.Errorf("center = %v, want the center of the circle", c)
+	}
+	// Reaching a pole covers all longitudes
+	for _, center := range []LatLng{{89.99, 0}, {-89.99, 120}} {
+		b := BoxAround(center, 10000)
+		if b.West != -180 || b.East != 180 || math.Max(b.North, -b.South) != 90 {
+			t.Errorf("box around %v = %+v, want all longitudes up to the pole", center, b)
+		}
+	}
+	if b := BoxAround(LatLng{52.5, 13.4}, 20000); !b.IsSet() || b.North <= 52.5 || b.West >= 13.4 {
+		t.Errorf("box = %+v", b)
+	}
+	if (Box{}).IsSet() {
+		t.Error("empty box is set")
+	}
+}
+
+func BenchmarkBoxAround(b *testing.B) {
+	p := LatLng{52.5, 13.4}
+	for i := 0; i < b.N; i++ {
+		BoxAround(p, 1000)
+	}
+}
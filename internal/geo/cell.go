@@ -0,0 +1,143 @@
+package geo
+
+import (
+	"math"
+	"strings"
+
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Geohash encodes the point with the given number of characters
+func Geohash(p LatLng, precision int) string {
+	lat, lng := p.Lat, p.Lng
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	bit, ch, even := 0, 0, true
+	for len(hash) < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lngRange, lng
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// GeohashCenter returns the center of a geohash cell
+func GeohashCenter(hash string) LatLng {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	even := true
+	for i := 0; i < len(hash); i++ {
+		ch := strings.IndexByte(geohashAlphabet, hash[i])
+		for b := 4; b >= 0; b-- {
+			r := &latRange
+			if even {
+				r = &lngRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if ch&(1<<uint(b)) != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return LatLng{Lat: (latRange[0] + latRange[1]) / 2, Lng: (lngRange[0] + lngRange[1]) / 2}
+}
+
+// S2Level is the S2 cell level of the map cells of the game
+const S2Level = 15
+
+// S2Cell returns the id of the S2 cell at level that contains p
+func S2Cell(p LatLng, level int) uint64 {
+	return uint64(s2.CellIDFromLatLng(s2.LatLngFromDegrees(p.Lat, p.Lng)).Parent(level))
+}
+
+// S2Covering returns the ids of the S2 cells at level that cover the circle around center
+func S2Covering(center LatLng, radius float64, level int) []uint64 {
+	region := s2.CapFromCenterAngle(s2.PointFromLatLng(s2.LatLngFromDegrees(center.Lat, center.Lng)), s1.Angle(Angle(radius)))
+	coverer := s2.RegionCoverer{MinLevel: level, MaxLevel: level, MaxCells: 1 << 10}
+	cells := coverer.Covering(region)
+	ids := make([]uint64, len(cells))
+	for i, c := range cells {
+		ids[i] = uint64(c)
+	}
+	return ids
+}
+
+// S2Parent returns the id of the cell at level that contains the cell with the given id
+func S2Parent(id uint64, level int) uint64 {
+	return uint64(s2.CellID(id).Parent(level))
+}
+
+// S2CellCenter returns the center of the cell with the given id
+func S2CellCenter(id uint64) LatLng {
+	ll := s2.CellID(id).LatLng()
+	return LatLng{Lat: ll.Lat.Degrees(), Lng: ll.Lng.Degrees()}
+}
+
+// S2CellsBound returns the smallest box that contains the cells with the given ids, or an
+// empty box if there are none
+func S2CellsBound(ids []uint64) Box {
+	rect := s2.EmptyRect()
+	for _, id := range ids {
+		rect = rect.Union(s2.CellFromCellID(s2.CellID(id)).RectBound())
+	}
+	if rect.IsEmpty() {
+		return Box{}
+	}
+	if rect.Lng.IsFull() {
+		// Cells at a pole, NormalizeLng would turn the range into a single meridian
+		return Box{North: degrees(rect.Lat.Hi), South: degrees(rect.Lat.Lo), East: 180, West: -180}
+	}
+	return Box{
+		North: degrees(rect.Lat.Hi),
+		South: degrees(rect.Lat.Lo),
+		East:  NormalizeLng(degrees(rect.Lng.Hi)),
+		West:  NormalizeLng(degrees(rect.Lng.Lo)),
+	}
+}
+
+// GeohashesInBox returns the geohash cells of the given precision whose centers are in the box.
+// The number of cells grows with the area, so this is meant for boxes of a few cells.
+func GeohashesInBox(b Box, precision int) []string {
+	lngBits := uint(5*precision+1) / 2
+	latBits := uint(5*precision) / 2
+	width := 360 / float64(uint64(1)<<lngBits)
+	height := 180 / float64(uint64(1)<<latBits)
+	east := b.East
+	if b.West > b.East {
+		east += 360
+	}
+	var hashes []string
+	for lat := math.Floor((b.South+90)/height)*height - 90 + height/2; lat <= b.North; lat += height {
+		if lat < b.South {
+			continue
+		}
+		for lng := math.Floor((b.West+180)/width)*width - 180 + width/2; lng <= east; lng += width {
+			if lng < b.West {
+				continue
+			}
+			hashes = append(hashes, Geohash(LatLng{Lat: lat, Lng: NormalizeLng(lng)}, precision))
+		}
+	}
+	return hashes
+}
@@ -0,0 +1,97 @@
+package geo
+
+import (
+	"testing"
+	"testing/quick"
+)
+
+func TestGeohash(t *testing.T) {
+	// The example of geohash.org
+	p := LatLng{57.64911, 10.40744}
+	if got := Geohash(p, 11); got != "u4pruydqqvj" {
+		t.Errorf("Geohash = %s, want u4pruydqqvj", got)
+	}
+	roundTrip := func(p point) bool {
+		if p.Lat == 90 {
+			// The top edge belongs to no cell
+			return true
+		}
+		h := Geohash(p.LatLng, 9)
+		return Geohash(GeohashCenter(h), 9) == h && Distance(p.LatLng, GeohashCenter(h)) < 5
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGeohashesInBox(t *testing.T) {
+	for _, b := range []Box{
+		BoxAround(LatLng{52.5, 13.4}, 3000),
+		BoxAround(LatLng{0, 179.99}, 3000),
+	} {
+		hashes := GeohashesInBox(b, 6)
+		seen := make(map[string]bool)
+		for _, h := range hashes {
+			if seen[h] || !b.Contains(GeohashCenter(h)) {
+				t.Errorf("box %+v: cell %s is a duplicate or outside", b, h)
+			}
+			seen[h] = true
+		}
+		// Cells of precision 6 are about 1.2 x 0.6 km, so the box has more than a few
+		if center := Geohash(b.Center(), 6); len(hashes) < 20 || !seen[center] {
+			t.Errorf("box %+v: %d cells, want the one of the center %s among them", b, len(hashes), center)
+		}
+	}
+	// Both sides of the antimeridian
+	east, west := false, false
+	for _, h := range GeohashesInBox(BoxAround(LatLng{0, 179.99}, 3000), 6) {
+		c := GeohashCenter(h)
+		east, west = east || c.Lng > 0, west || c.Lng < 0
+	}
+	if !east || !west {
+		t.Error("cells across the antimeridian are missing a side")
+	}
+}
+
+func TestS2Cells(t *testing.T) {
+	inCell := func(p point) bool {
+		id := S2Cell(p.LatLng, S2Level)
+		// Level 15 cells are about 300 m across
+		return S2Parent(id, 10) == S2Cell(p.LatLng, 10) && Distance(p.LatLng, S2CellCenter(id)) < 400 && S2CellsBound([]uint64{id}).Contains(p.LatLng)
+	}
+	if err := quick.Check(inCell, nil); err != nil {
+		t.Error(err)
+	}
+	center := LatLng{52.5, 13.4}
+	cells := S2Covering(center, 500, S2Level)
+	found := false
+	for _, id := range cells {
+		found = found || id == S2Cell(center, S2Level)
+		if d := Distance(center, S2CellCenter(id)); d > 500+400 {
+			t.Errorf("cell %d is %.0f m away", id, d)
+		}
+	}
+	if !found || len(cells) < 4 {
+		t.Errorf("covering = %v, want the cell of the center and its neighbors", cells)
+	}
+	if b := S2CellsBound(cells); !b.Contains(Destination(center, 499, 45)) || !b.Contains(Destination(center, 499, 225)) {
+		t.Errorf("bound %+v doesn't contain the circle", b)
+	}
+	if b := S2CellsBound(nil); b.IsSet() {
+		t.Errorf("bound of no cells = %+v", b)
+	}
+}
+
+func BenchmarkS2Covering(b *testing.B) {
+	center := LatLng{52.5, 13.4}
+	for i := 0; i < b.N; i++ {
+		S2Covering(center, 70, S2Level)
+	}
+}
+
+func BenchmarkGeohash(b *testing.B) {
+	p := LatLng{52.5, 13.4}
+	for i := 0; i < b.N; i++ {
+		Geohash(p, 7)
+	}
+}
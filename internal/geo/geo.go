@@ -0,0 +1,84 @@
+// Package geo has the distance and geometry primitives used by the OPM services.
+// Coordinates are in degrees, distances in meters and bearings in degrees clockwise from north.
+package geo
+
+import "math"
+
+// EarthRadius is the mean earth radius in meters
+const EarthRadius = 6371008.8
+
+// LatLng is a point on the map
+type LatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func degrees(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// NormalizeLng wraps a longitude into [-180, 180)
+func NormalizeLng(lng float64) float64 {
+	lng = math.Mod(lng+180, 360)
+	if lng < 0 {
+		lng += 360
+	}
+	return lng - 180
+}
+
+// Distance returns the great circle distance between two points (haversine)
+func Distance(a, b LatLng) float64 {
+	lat1 := radians(a.Lat)
+	lat2 := radians(b.Lat)
+	dLat := lat2 - lat1
+	dLng := radians(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Angle returns the distance as an angle in radians, as used by $centerSphere queries
+func Angle(meters float64) float64 {
+	return meters / EarthRadius
+}
+
+// Bearing returns the initial bearing of the great circle from a to b in [0, 360)
+func Bearing(a, b LatLng) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLng := radians(b.Lng - a.Lng)
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return math.Mod(degrees(math.Atan2(y, x))+360, 360)
+}
+
+// Destination returns the point at the given distance and bearing from p
+func Destination(p LatLng, distance, bearing float64) LatLng {
+	d := Angle(distance)
+	lat1, lng1 := radians(p.Lat), radians(p.Lng)
+	b := radians(bearing)
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(b))
+	lng2 := lng1 + math.Atan2(math.Sin(b)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+	return LatLng{Lat: degrees(lat2), Lng: NormalizeLng(degrees(lng2))}
+}
+
+// Interpolate returns the point at fraction f on the great circle between a and b
+func Interpolate(a, b LatLng, f float64) LatLng {
+	d := Angle(Distance(a, b))
+	if d == 0 {
+		return a
+	}
+	lat1, lng1 := radians(a.Lat), radians(a.Lng)
+	lat2, lng2 := radians(b.Lat), radians(b.Lng)
+	x1 := math.Sin((1-f)*d) / math.Sin(d)
+	x2 := math.Sin(f*d) / math.Sin(d)
+	x := x1*math.Cos(lat1)*math.Cos(lng1) + x2*math.Cos(lat2)*math.Cos(lng2)
+	y := x1*math.Cos(lat1)*math.Sin(lng1) + x2*math.Cos(lat2)*math.Sin(lng2)
+	z := x1*math.Sin(lat1) + x2*math.Sin(lat2)
+	return LatLng{
+		Lat: degrees(math.Atan2(z, math.Sqrt(x*x+y*y))),
+		Lng: degrees(math.Atan2(y, x)),
+	}
+}
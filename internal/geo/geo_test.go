@@ -0,0 +1,170 @@
+package geo
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// point is a random point, including the poles and the antimeridian
+type point struct{ LatLng }
+
+func (point) Generate(r *rand.Rand, size int) reflect.Value {
+	p := LatLng{Lat: r.Float64()*180 - 90, Lng: r.Float64()*360 - 180}
+	switch r.Intn(10) {
+	case 0:
+		p.Lat = 90 * float64(1-2*r.Intn(2))
+	case 1:
+		p.Lng = -180
+	}
+	return reflect.ValueOf(point{p})
+}
+
+// near reports whether the distances are equal up to a millimeter and rounding
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-3+1e-9*math.Max(a, b)
+}
+
+func TestDistanceFixtures(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b LatLng
+		want float64
+	}{
+		{"same point", LatLng{52.5, 13.4}, LatLng{52.5, 13.4}, 0},
+		{"degree at the equator", LatLng{0, 0}, LatLng{0, 1}, EarthRadius * math.Pi / 180},
+		{"degree of latitude", LatLng{10, 50}, LatLng{11, 50}, EarthRadius * math.Pi / 180},
+		{"antimeridian", LatLng{0, 179.5}, LatLng{0, -179.5}, EarthRadius * math.Pi / 180},
+		{"pole to pole", LatLng{90, 0}, LatLng{-90, 0}, EarthRadius * math.Pi},
+		{"antipodes", LatLng{0, 0}, LatLng{0, 180}, EarthRadius * math.Pi},
+		{"longitudes at the pole", LatLng{90, 0}, LatLng{90, 120}, 0},
+		{"Paris to London", LatLng{48.8566, 2.3522}, LatLng{51.5074, -0.1278}, 343556},
+	}
+	for _, test := range tests {
+		if got := Distance(test.a, test.b); math.Abs(got-test.want) > 1 {
+			t.Errorf("%s: Distance = %.1f m, want %.1f m", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDistanceProperties(t *testing.T) {
+	symmetric := func(a, b point) bool { return Distance(a.LatLng, b.LatLng) == Distance(b.LatLng, a.LatLng) }
+	if err := quick.Check(symmetric, nil); err != nil {
+		t.Error(err)
+	}
+	triangle := func(a, b, c point) bool {
+		return Distance(a.LatLng, c.LatLng) <= Distance(a.LatLng, b.LatLng)+Distance(b.LatLng, c.LatLng)+1e-6
+	}
+	if err := quick.Check(triangle, nil); err != nil {
+		t.Error(err)
+	}
+	bounded := func(a, b point) bool {
+		d := Distance(a.LatLng, b.LatLng)
+		return d >= 0 && d <= EarthRadius*math.Pi+1e-6
+	}
+	if err := quick.Check(bounded, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDestination(t *testing.T) {
+	// Walking d meters in any direction ends d meters away, also across the poles and the antimeridian
+	roundTrip := func(p point, d uint32, bearing float64) bool {
+		meters := float64(d % 20000000)
+		q := Destination(p.LatLng, meters, math.Mod(math.Abs(bearing), 360))
+		return near(Distance(p.LatLng, q), meters) && q.Lng >= -180 && q.Lng < 180 && math.Abs(q.Lat) <= 90
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+	// Away from the poles the initial bearing is the one walked
+	bearingKept := func(p point, d uint16, bearing uint16) bool {
+		if math.Abs(p.Lat) > 80 || d == 0 {
+			return true
+		}
+		b := float64(bearing % 360)
+		got := Bearing(p.LatLng, Destination(p.LatLng, float64(d), b))
+		diff := math.Abs(got - b)
+		return math.Min(diff, 360-diff) < 1e-6
+	}
+	if err := quick.Check(bearingKept, nil); err != nil {
+		t.Error(err)
+	}
+	if q := Destination(LatLng{0, 179.9}, 50000, 90); q.Lng > -179 || q.Lng < -180 {
+		t.Errorf("east across the antimeridian = %v", q)
+	}
+	pole := LatLng{Lat: 90}
+	if q := Destination(LatLng{89.9, 0}, 50000, 0); !near(Distance(q, pole), 50000-Distance(LatLng{89.9, 0}, pole)) || math.Abs(math.Abs(q.Lng)-180) > 1e-6 {
+		t.Errorf("north across the pole = %v, want the other side", q)
+	}
+}
+
+func TestBearing(t *testing.T) {
+	tests := []struct {
+		a, b LatLng
+		want float64
+	}{
+		{LatLng{0, 0}, LatLng{1, 0}, 0},
+		{LatLng{0, 0}, LatLng{0, 1}, 90},
+		{LatLng{0, 0}, LatLng{-1, 0}, 180},
+		{LatLng{0, 0}, LatLng{0, -1}, 270},
+		{LatLng{0, 179.9}, LatLng{0, -179.9}, 90},
+		{LatLng{0, -179.9}, LatLng{0, 179.9}, 270},
+	}
+	for _, test := range tests {
+		if got := Bearing(test.a, test.b); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("Bearing(%v, %v) = %f, want %f", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeLng(t *testing.T) {
+	for lng, want := range map[float64]float64{0: 0, 180: -180, -180: -180, 190: -170, -190: 170, 540: -180, 359.5: -0.5, -720.25: -0.25} {
+		if got := NormalizeLng(lng); math.Abs(got-want) > 1e-9 {
+			t.Errorf("NormalizeLng(%v) = %v, want %v", lng, got, want)
+		}
+	}
+	sameDirection := func(lng float64) bool {
+		n := NormalizeLng(math.Mod(lng, 1e6))
+		return n >= -180 && n < 180 && math.Abs(math.Sin(radians(n))-math.Sin(radians(math.Mod(lng, 1e6)))) < 1e-6
+	}
+	if err := quick.Check(sameDirection, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	split := func(a, b point, f uint8) bool {
+		d := Distance(a.LatLng, b.LatLng)
+		if d > EarthRadius*3 {
+			// Near antipodes, there is no unique great circle
+			return true
+		}
+		frac := float64(f) / 255
+		m := Interpolate(a.LatLng, b.LatLng, frac)
+		return near(Distance(a.LatLng, m), frac*d) && near(Distance(m, b.LatLng), (1-frac)*d)
+	}
+	if err := quick.Check(split, nil); err != nil {
+		t.Error(err)
+	}
+	a := LatLng{52.5, 13.4}
+	if got := Interpolate(a, a, 0.5); got != a {
+		t.Errorf("Interpolate of one point = %v", got)
+	}
+}
+
+func BenchmarkDistance(b *testing.B) {
+	p, q := LatLng{52.5, 13.4}, LatLng{52.51, 13.41}
+	for i := 0; i < b.N; i++ {
+		Distance(p, q)
+	}
+}
+
+func BenchmarkDestination(b *testing.B) {
+	p := LatLng{52.5, 13.4}
+	for i := 0; i < b.N; i++ {
+		Destination(p, 70, float64(i%360))
+	}
+}
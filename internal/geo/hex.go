@@ -0,0 +1,34 @@
+package geo
+
+import "math"
+
+// Beehive returns the centers of a hexagonal grid around center, spacing apart, with the
+// given number of rings. Ring 0 is the center itself, the grid has 3*rings*(rings+1)+1 points.
+// Scans with radius r cover the area without gaps for spacing <= r*sqrt(3).
+func Beehive(center LatLng, rings int, spacing float64) []LatLng {
+	if rings < 0 {
+		return nil
+	}
+	points := make([]LatLng, 0, 3*rings*(rings+1)+1)
+	for q := -rings; q <= rings; q++ {
+		r1, r2 := -rings, rings
+		if -q-rings > r1 {
+			r1 = -q - rings
+		}
+		if -q+rings < r2 {
+			r2 = -q + rings
+		}
+		for r := r1; r <= r2; r++ {
+			// Axial coordinates to meters east and north of the center
+			east := spacing * (float64(q) + float64(r)/2)
+			north := spacing * float64(r) * math.Sqrt(3) / 2
+			if east == 0 && north == 0 {
+				points = append(points, center)
+				continue
+			}
+			bearing := math.Mod(degrees(math.Atan2(east, north))+360, 360)
+			points = append(points, Destination(center, math.Hypot(east, north), bearing))
+		}
+	}
+	return points
+}
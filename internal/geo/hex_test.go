@@ -0,0 +1,46 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBeehive(t *testing.T) {
+	centers := []LatLng{{52.5, 13.4}, {0, 179.999}, {-60, -30}}
+	for _, center := range centers {
+		for rings := 0; rings <= 4; rings++ {
+			points := Beehive(center, rings, 120)
+			if len(points) != 3*rings*(rings+1)+1 || points[len(points)/2] != center {
+				t.Fatalf("%d rings around %v: %d points, want %d with the center in the middle", rings, center, len(points), 3*rings*(rings+1)+1)
+			}
+			for i, p := range points {
+				if p.Lng < -180 || p.Lng >= 180 {
+					t.Errorf("point %v outside of the longitude range", p)
+				}
+				// Every point has its nearest neighbors one spacing away
+				nearest := math.Inf(1)
+				for j, q := range points {
+					if i != j {
+						nearest = math.Min(nearest, Distance(p, q))
+					}
+				}
+				if rings > 0 && math.Abs(nearest-120) > 0.5 {
+					t.Errorf("%d rings around %v: point %d is %.2f m from its nearest neighbor, want 120", rings, center, i, nearest)
+				}
+				if d := Distance(center, p); d > float64(rings)*120+0.5 {
+					t.Errorf("%d rings: point %.1f m from the center", rings, d)
+				}
+			}
+		}
+	}
+	if points := Beehive(LatLng{}, -1, 120); points != nil {
+		t.Errorf("negative rings = %v", points)
+	}
+}
+
+func BenchmarkBeehive(b *testing.B) {
+	center := LatLng{52.5, 13.4}
+	for i := 0; i < b.N; i++ {
+		Beehive(center, 5, 120)
+	}
+}
@@ -0,0 +1,27 @@
+package geo
+
+// PointInPolygon reports whether p is inside the polygon given by its ring of vertices
+// (even-odd rule, the ring doesn't need to be closed). Longitudes are taken relative to the
+// first vertex, so rings crossing the antimeridian work. Rings spanning 180 degrees of
+// longitude or more, or containing a pole, are not supported.
+func PointInPolygon(p LatLng, ring []LatLng) bool {
+	if len(ring) == 0 {
+		return false
+	}
+	origin := ring[0].Lng
+	pLng := NormalizeLng(p.Lng - origin)
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > p.Lat) == (b.Lat > p.Lat) {
+			continue
+		}
+		aLng, bLng := NormalizeLng(a.Lng-origin), NormalizeLng(b.Lng-origin)
+		// Longitude of the edge at the latitude of p
+		lng := aLng + (p.Lat-a.Lat)/(b.Lat-a.Lat)*(bLng-aLng)
+		if lng > pLng {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,48 @@
+package geo
+
+import "testing"
+
+func TestPointInPolygon(t *testing.T) {
+	square := []LatLng{{52, 13}, {52, 14}, {53, 14}, {53, 13}}
+	// Concave, the notch between the arms is outside
+	u := []LatLng{{0, 0}, {0, 3}, {3, 3}, {3, 2}, {1, 2}, {1, 1}, {3, 1}, {3, 0}}
+	// Across the antimeridian
+	dateline := []LatLng{{-1, 179}, {-1, -179}, {1, -179}, {1, 179}}
+	tests := []struct {
+		ring []LatLng
+		p    LatLng
+		want bool
+	}{
+		{square, LatLng{52.5, 13.5}, true},
+		{square, LatLng{51.9, 13.5}, false},
+		{square, LatLng{52.5, 14.1}, false},
+		{append(square, square[0]), LatLng{52.5, 13.5}, true},
+		{u, LatLng{0.5, 1.5}, true},
+		{u, LatLng{2, 1.5}, false},
+		{u, LatLng{2, 2.5}, true},
+		{dateline, LatLng{0, 180}, true},
+		{dateline, LatLng{0, -179.5}, true},
+		{dateline, LatLng{0, 179.5}, true},
+		{dateline, LatLng{0, 178}, false},
+		{dateline, LatLng{0, 0}, false},
+		{nil, LatLng{0, 0}, false},
+	}
+	for _, test := range tests {
+		if got := PointInPolygon(test.p, test.ring); got != test.want {
+			t.Errorf("PointInPolygon(%v, %v) = %v, want %v", test.p, test.ring, got, test.want)
+		}
+	}
+}
+
+func BenchmarkPointInPolygon(b *testing.B) {
+	// A circle of 100 vertices, like a drawn area
+	center := LatLng{52.5, 13.4}
+	ring := make([]LatLng, 100)
+	for i := range ring {
+		ring[i] = Destination(center, 5000, float64(i)*3.6)
+	}
+	p := Destination(center, 4000, 45)
+	for i := 0; i < b.N; i++ {
+		PointInPolygon(p, ring)
+	}
+}
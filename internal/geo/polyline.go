@@ -0,0 +1,112 @@
+package geo
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// ErrInvalidPolyline is returned when an encoded polyline can not be decoded
+var ErrInvalidPolyline = errors.New("Invalid polyline")
+
+// PathLength returns the length of a path
+func PathLength(path []LatLng) float64 {
+	length := 0.0
+	for i := 1; i < len(path); i++ {
+		length += Distance(path[i-1], path[i])
+	}
+	return length
+}
+
+// SamplePath returns points along the path that are at most spacing apart.
+// The first and last point of the path are always included.
+func SamplePath(path []LatLng, spacing float64) []LatLng {
+	if len(path) == 0 || spacing <= 0 {
+		return path
+	}
+	points := []LatLng{path[0]}
+	// Distance travelled since the last sampled point
+	carry := 0.0
+	for i := 1; i < len(path); i++ {
+		a, b := path[i-1], path[i]
+		segment := Distance(a, b)
+		pos := spacing - carry
+		for pos < segment {
+			points = append(points, Interpolate(a, b, pos/segment))
+			pos += spacing
+		}
+		carry = segment - (pos - spacing)
+	}
+	last := path[len(path)-1]
+	if Distance(points[len(points)-1], last) > 1 {
+		points = append(points, last)
+	}
+	return points
+}
+
+// DecodePolyline decodes an encoded Google polyline
+func DecodePolyline(encoded string) ([]LatLng, error) {
+	var points []LatLng
+	lat, lng := 0, 0
+	i := 0
+	next := func() (int, error) {
+		result, shift := 0, uint(0)
+		for {
+			if i >= len(encoded) {
+				return 0, ErrInvalidPolyline
+			}
+			b := int(encoded[i]) - 63
+			i++
+			if b < 0 || b > 63 {
+				return 0, ErrInvalidPolyline
+			}
+			result |= (b & 0x1f) << shift
+			shift += 5
+			if b < 0x20 {
+				break
+			}
+		}
+		if result&1 != 0 {
+			return ^(result >> 1), nil
+		}
+		return result >> 1, nil
+	}
+	for i < len(encoded) {
+		dLat, err := next()
+		if err != nil {
+			return nil, err
+		}
+		dLng, err := next()
+		if err != nil {
+			return nil, err
+		}
+		lat += dLat
+		lng += dLng
+		points = append(points, LatLng{Lat: float64(lat) / 1e5, Lng: float64(lng) / 1e5})
+	}
+	return points, nil
+}
+
+// EncodePolyline encodes the points as a Google polyline, the inverse of DecodePolyline
+func EncodePolyline(points []LatLng) string {
+	var b strings.Builder
+	write := func(v int) {
+		u := v << 1
+		if v < 0 {
+			u = ^u
+		}
+		for u >= 0x20 {
+			b.WriteByte(byte((0x20 | (u & 0x1f)) + 63))
+			u >>= 5
+		}
+		b.WriteByte(byte(u + 63))
+	}
+	lat, lng := 0, 0
+	for _, p := range points {
+		pLat, pLng := int(math.Round(p.Lat*1e5)), int(math.Round(p.Lng*1e5))
+		write(pLat - lat)
+		write(pLng - lng)
+		lat, lng = pLat, pLng
+	}
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSamplePathStraight(t *testing.T) {
+	// 1000 m due north
+	start := LatLng{Lat: 52, Lng: 13}
+	end := Destination(start, 1000, 0)
+	points := SamplePath([]LatLng{start, end}, 70)
+	// 14 full steps of 70 m and the end point 20 m after the last of them
+	if len(points) != 16 {
+		t.Fatalf("%d points, want 16", len(points))
+	}
+	if points[0] != start || points[len(points)-1] != end {
+		t.Errorf("path from %v to %v, want the start and end of the path", points[0], points[len(points)-1])
+	}
+	for i := 1; i < len(points); i++ {
+		d := Distance(points[i-1], points[i])
+		if d > 70.01 {
+			t.Errorf("points %d and %d are %.2f m apart", i-1, i, d)
+		}
+		if i < len(points)-1 && math.Abs(d-70) > 0.01 {
+			t.Errorf("points %d and %d are %.2f m apart, want 70 m", i-1, i, d)
+		}
+	}
+}
+
+func TestSamplePathCorner(t *testing.T) {
+	// 100 m east, then 100 m north. The spacing is carried around the corner.
+	a := LatLng{Lat: 52, Lng: 13}
+	b := Destination(a, 100, 90)
+	c := Destination(b, 100, 0)
+	points := SamplePath([]LatLng{a, b, c}, 70)
+	if len(points) != 4 {
+		t.Fatalf("%d points, want 4", len(points))
+	}
+	// The second point is 70 m along the first leg, the third 40 m along the second
+	if d := Distance(a, points[1]); math.Abs(d-70) > 0.01 {
+		t.Errorf("first point %.2f m from the start, want 70 m", d)
+	}
+	if d := Distance(b, points[2]); math.Abs(d-40) > 0.01 {
+		t.Errorf("second point %.2f m after the corner, want 40 m", d)
+	}
+	if points[3] != c {
+		t.Errorf("last point %v, want the end of the path %v", points[3], c)
+	}
+}
+
+func TestSamplePathShort(t *testing.T) {
+	a := LatLng{Lat: 52, Lng: 13}
+	b := Destination(a, 30, 45)
+	tests := []struct {
+		name string
+		path []LatLng
+		want int
+	}{
+		{"single point", []LatLng{a}, 1},
+		{"shorter than the spacing", []LatLng{a, b}, 2},
+		{"duplicate points", []LatLng{a, a, a}, 1},
+		// The turning point is within the spacing of the start, which is also the end
+		{"back and forth", []LatLng{a, b, a}, 1},
+		{"empty", nil, 0},
+	}
+	for _, test := range tests {
+		if got := SamplePath(test.path, 70); len(got) != test.want {
+			t.Errorf("%s: %d points, want %d", test.name, len(got), test.want)
+		}
+	}
+}
+
+func TestDecodePolyline(t *testing.T) {
+	// The example of the polyline format documentation
+	points, err := DecodePolyline("_p~iF~ps|U_ulLnnqC_mqNvxq`@")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LatLng{{Lat: 38.5, Lng: -120.2}, {Lat: 40.7, Lng: -120.95}, {Lat: 43.252, Lng: -126.453}}
+	if len(points) != len(want) {
+		t.Fatalf("decoded %v, want %v", points, want)
+	}
+	for i := range want {
+		if math.Abs(points[i].Lat-want[i].Lat) > 1e-9 || math.Abs(points[i].Lng-want[i].Lng) > 1e-9 {
+			t.Errorf("point %d = %v, want %v", i, points[i], want[i])
+		}
+	}
+	if got := EncodePolyline(points); got != "_p~iF~ps|U_ulLnnqC_mqNvxq`@" {
+		t.Errorf("encoded %q, want the original polyline", got)
+	}
+	for _, invalid := range []string{"_p~iF", "_p~iF~ps|U_", " "} {
+		if _, err := DecodePolyline(invalid); err != ErrInvalidPolyline {
+			t.Errorf("DecodePolyline(%q) = %v, want ErrInvalidPolyline", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Package logging writes log lines that carry the id of the request they belong to, so the
+// lines of one scan can be found among the interleaved lines of concurrent requests:
+//
+//	logging.Log(ctx, logging.Entry{Event: "scan.done", Lat: lat, Lng: lng, Msg: "Scanned"})
+//
+// By default the lines go through the standard logger like every other line. After
+// SetFormat(FormatJSON) every line is a JSON object with the fields ts, level, request_id,
+// account, proxy, lat, lng, event, error and msg. Plain log.Printf lines are wrapped too,
+// they only have ts, level and msg.
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Formats of SetFormat
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Levels of an Entry
+const (
+	Info  = "info"
+	Warn  = "warn"
+	Error = "error"
+)
+
+// Entry is a log line. Zero fields are left out.
+type Entry struct {
+	Level string // Info if empty
+	// Event is a short name for grepping, e.g. "scan.done"
+	Event string
+	Msg   string
+	// Account username, pass it through util.Username first
+	Account  string
+	Proxy    string
+	Lat, Lng float64
+	Err      error
+}
+
+// record is the JSON form of an Entry
+type record struct {
+	TS        string  `json:"ts"`
+	Level     string  `json:"level"`
+	RequestID string  `json:"request_id,omitempty"`
+	Account   string  `json:"account,omitempty"`
+	Proxy     string  `json:"proxy,omitempty"`
+	Lat       float64 `json:"lat,omitempty"`
+	Lng       float64 `json:"lng,omitempty"`
+	Event     string  `json:"event,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Msg       string  `json:"msg,omitempty"`
+}
+
+// output is the writer of the JSON lines, nil in the text format
+var output struct {
+	sync.RWMutex
+	w *jsonWriter
+}
+
+// SetFormat switches the log between FormatText, the format of the standard logger, and
+// FormatJSON. "" is FormatText. Call it after the output of the standard logger is set up,
+// the JSON lines are written to it.
+func SetFormat(format string) error {
+	switch format {
+	case "", FormatText:
+		return nil
+	case FormatJSON:
+		w := &jsonWriter{out: log.Writer()}
+		output.Lock()
+		output.w = w
+		output.Unlock()
+		log.SetFlags(0)
+		log.SetOutput(w)
+		return nil
+	}
+	return fmt.Errorf("logging: unknown format %q", format)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose lines are logged with the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id of the context, or "" if it has none
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request id
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether an id sent by a client can be used as request id
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Log writes the entry with the request id of ctx
+func Log(ctx context.Context, e Entry) {
+	id := RequestID(ctx)
+	output.RLock()
+	w := output.w
+	output.RUnlock()
+	if w == nil {
+		log.Output(2, text(id, e))
+		return
+	}
+	if e.Level == "" {
+		e.Level = Info
+	}
+	r := record{
+		TS:        now(),
+		Level:     e.Level,
+		RequestID: id,
+		Account:   e.Account,
+		Proxy:     e.Proxy,
+		Lat:       e.Lat,
+		Lng:       e.Lng,
+		Event:     e.Event,
+		Msg:       e.Msg,
+	}
+	if e.Err != nil {
+		r.Error = e.Err.Error()
+	}
+	w.write(r)
+}
+
+// text is the entry as a line of the text format
+func text(id string, e Entry) string {
+	line := e.Msg
+	if line == "" {
+		line = e.Event
+	}
+	if e.Err != nil {
+		if line == "" {
+			line = e.Err.Error()
+		} else {
+			line += ": " + e.Err.Error()
+		}
+	}
+	if e.Account != "" {
+		line += " (" + e.Account + ")"
+	}
+	if id != "" {
+		line = "[" + id + "] " + line
+	}
+	return line
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// jsonWriter writes the JSON lines of Log and wraps the lines of the standard logger
+type jsonWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// Write wraps a line of the standard logger, which writes every line with a single call
+func (w *jsonWriter) Write(b []byte) (int, error) {
+	if err := w.write(record{TS: now(), Level: Info, Msg: strings.TrimSuffix(string(b), "\n")}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *jsonWriter) write(r record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = w.out.Write(append(b, '\n'))
+	return err
+}
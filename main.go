@@ -1,18 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pogointel/opm/db"
 	"github.com/pogointel/opm/opm"
+	"golang.org/x/net/context"
 )
 
 func init() {
@@ -29,29 +36,57 @@ func main() {
 	dbPass := flag.String("dbpass", opmSettings.DbPassword, "Password for the database")
 	dbName := flag.String("dbname", opmSettings.DbName, "Name of the database")
 	// Commands
-	removePokemon := flag.Int64("removepokemon", -1, "Delete Pokemon which expire before the provided unix timestamp")
+	removePokemon := flag.Int64("removepokemon", -1, "Delete Pokemon which expire before the provided unix timestamp and purge old tombstones")
 	dropProxies := flag.Bool("dropproxies", false, "Delete all proxies from the database")
 	addAccounts := flag.Bool("addaccounts", false, "Add accounts to the db")
-	accountsFile := flag.String("accountsfile", "accounts.txt", "Add accounts from provided file to database")
+	accountsFile := flag.String("accountsfile", "accounts.txt", "Add accounts from provided file to database (username:password or token:provider:username:authtoken per line)")
 	cleanProxies := flag.Bool("cleanproxies", false, "Marks all proxies as unused")
 	cleanAccounts := flag.Bool("cleanaccounts", false, "Marks all accounts as unused")
 	ufs := flag.Bool("ufs", false, "Update database from status")
 	statusPage := flag.String("statuspage", "http://localhost:8000/s", "Status page to use with -ufs and -status flags")
 	secret := flag.String("secret", opmSettings.Secret, "Secret for the status page")
 	status := flag.Bool("status", false, "Show status")
+	listAreas := flag.Bool("areas", false, "List the areas")
+	removeArea := flag.String("removearea", "", "Delete the area with the given id")
+	normalize := flag.Bool("normalize", false, "Normalize the coordinates of all objects in the database")
+	migrate := flag.Bool("migrate", false, "Run pending schema migrations of the stored documents")
 	removeDeadProxies := flag.Bool("removedeadproxies", false, "Remove all dead proxies from the database")
 	addPokemon := flag.Bool("addpokemon", false, "Adds a pokemon to the database. Use with -id, -lat and -lng")
 	pokeId := flag.Int("id", 151, "Pokemon Id to add to the database (-addpokemon)")
 	lat := flag.Float64("lat", 34.008096, "Latitude for pokemon (-addpokemon)")
 	lng := flag.Float64("lng", -118.497933, "Latitude for pokemon (-addpokemon)")
+	// Exports
+	export := flag.String("export", "", "Export accounts or proxies (\"accounts\", \"proxies\"). Use with -format, -filter and -out")
+	exportFormat := flag.String("format", opm.ExportCSV, "Format of the export (csv, json) or ingest (csv, ndjson)")
+	exportFilter := flag.String("filter", "", "Filter for the export, e.g. \"banned=true&pool=main\"")
+	exportOut := flag.String("out", "", "File to write the export to (-export)")
+	includeSecrets := flag.Bool("includesecrets", false, "Include passwords in the account export (-export)")
+	// Replay of captured responses
+	replay := flag.Bool("replay", false, "Replay captured scan responses through the parser. Use with -scanid or -since/-until")
+	scanID := flag.String("scanid", "", "Scan id of the captured response (-replay)")
+	since := flag.Int64("since", 0, "Replay responses captured after this unix timestamp (-replay)")
+	until := flag.Int64("until", 0, "Replay responses captured before this unix timestamp (-replay)")
+	backfill := flag.Bool("backfill", false, "Save the replayed objects instead of a dry run (-replay)")
+	// Ingest of map object dumps
+	ingest := flag.String("ingest", "", "Import map objects from the given file. Use with -format, an interrupted import resumes where it stopped")
+	archiveExpired := flag.Bool("archiveexpired", false, "Archive expired Pokemon as sightings instead of adding them to the map (-ingest)")
+	// Scans
+	scanRoute := flag.Bool("scanroute", false, "Scan along a route. Use with -polyline")
+	polyline := flag.String("polyline", "", "Encoded polyline of the route (-scanroute)")
+	scannerURL := flag.String("scanner", "http://localhost:8100", "Scanner to use with -scanroute")
 	// API keys
-	key := flag.String("key", "", "API key. Use with -enablekey, -disablekey, ...")
+	key := flag.String("key", "", "Public API key. Use with -enablekey, -disablekey, ...")
 	enableKey := flag.Bool("enablekey", false, "Enables an API key")
 	disableKey := flag.Bool("disablekey", false, "Disables an API key")
 	verifyKey := flag.Bool("verifykey", false, "Verifies an API key")
 	unverifyKey := flag.Bool("unverifykey", false, "Unverifies an API key")
+	trustKey := flag.Bool("trustkey", false, "Marks an API key as trusted, it sees delayed Pokemon immediately")
+	untrustKey := flag.Bool("untrustkey", false, "Removes the trusted mark of an API key")
 	setName := flag.String("setname", "", "Sets the name for an API key")
 	setURL := flag.String("seturl", "", "Sets the URL for an API key")
+	revokeKey := flag.Bool("revokekey", false, "Revokes an API key")
+	setRate := flag.Int("setrate", -1, "Sets the scans per minute for an API key (0 = default)")
+	setBurst := flag.Int("setburst", -1, "Sets the burst for an API key (0 = default)")
 	keyStats := flag.Bool("keystats", false, "Shows stats for API keys")
 	genKey := flag.Bool("genkey", false, "Generate a new API Key")
 	// Parse flags
@@ -62,6 +97,9 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	database.Region = opmSettings.Region
+	database.FixSwappedCoordinates = opmSettings.FixSwappedCoordinates
+	database.AccountIntake = opmSettings.AccountIntake
 
 	// API key stuff
 	// Generate Key
@@ -110,7 +148,7 @@ func main() {
 	}
 	// Enable
 	if *enableKey && *key != "" {
-		k, err := database.GetAPIKey(*key)
+		k, err := database.GetAPIKeyByPublic(*key)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -125,7 +163,7 @@ func main() {
 
 	// Disable
 	if *disableKey && *key != "" {
-		k, err := database.GetAPIKey(*key)
+		k, err := database.GetAPIKeyByPublic(*key)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -137,9 +175,16 @@ func main() {
 			}
 		}
 	}
+	// Revoke
+	if *revokeKey && *key != "" {
+		err := database.RevokeAPIKey(*key)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
 	// Verify
 	if *verifyKey && *key != "" {
-		k, err := database.GetAPIKey(*key)
+		k, err := database.GetAPIKeyByPublic(*key)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -153,7 +198,7 @@ func main() {
 	}
 	// Unverify
 	if *unverifyKey && *key != "" {
-		k, err := database.GetAPIKey(*key)
+		k, err := database.GetAPIKeyByPublic(*key)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -165,9 +210,37 @@ func main() {
 			}
 		}
 	}
+	// Trust
+	if *trustKey && *key != "" {
+		k, err := database.GetAPIKeyByPublic(*key)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			if !k.Trusted {
+				k.Trusted = true
+				database.UpdateAPIKey(k)
+			} else {
+				fmt.Println("Key already trusted")
+			}
+		}
+	}
+	// Untrust
+	if *untrustKey && *key != "" {
+		k, err := database.GetAPIKeyByPublic(*key)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			if k.Trusted {
+				k.Trusted = false
+				database.UpdateAPIKey(k)
+			} else {
+				fmt.Println("Key not trusted")
+			}
+		}
+	}
 	// Set name for API key
 	if *setName != "" && *key != "" {
-		k, err := database.GetAPIKey(*key)
+		k, err := database.GetAPIKeyByPublic(*key)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -177,7 +250,7 @@ func main() {
 	}
 	// Set URL for API key
 	if *setURL != "" && *key != "" {
-		k, err := database.GetAPIKey(*key)
+		k, err := database.GetAPIKeyByPublic(*key)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -185,6 +258,21 @@ func main() {
 			database.UpdateAPIKey(k)
 		}
 	}
+	// Set rate limit for API key
+	if (*setRate >= 0 || *setBurst >= 0) && *key != "" {
+		k, err := database.GetAPIKeyByPublic(*key)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			if *setRate >= 0 {
+				k.RequestsPerMinute = *setRate
+			}
+			if *setBurst >= 0 {
+				k.Burst = *setBurst
+			}
+			database.UpdateAPIKey(k)
+		}
+	}
 
 	// Status
 	if *status {
@@ -202,18 +290,50 @@ func main() {
 			fmt.Printf("Scanner currently using %d accounts/proxies\n", len(s))
 		}
 		// Proxy status
-		pAlive, pUsed, err := database.ProxyStats()
+		pAlive, pUsed, pDead, err := database.ProxyStats()
 		if err != nil {
 			log.Println(err)
 		} else {
-			fmt.Printf("Proxies:\n\tTotal:\t%d\n\tIn use:\t%d (%.2f%%)\n", pAlive, pUsed, float64(pUsed)/float64(pAlive)*100)
+			fmt.Printf("Proxies:\n\tTotal:\t%d\n\tIn use:\t%d (%.2f%%)\n\tDead:\t%d\n", pAlive, pUsed, float64(pUsed)/float64(pAlive)*100, pDead)
 		}
 		// Account status
-		aTotal, aUsed, aBanned, aFlagged, err := database.AccountStats()
+		a, err := database.AccountStats()
 		if err != nil {
 			log.Println(err)
 		} else {
-			fmt.Printf("Accounts:\n\tTotal:\t\t%d\n\tIn use:\t\t%d (%.2f%%)\n\tBanned:\t\t%d (%.2f%%)\n\tFlagged:\t%d (%.2f%%)\n", aTotal, aUsed, float64(aUsed)/float64(aTotal)*100, aBanned, float64(aBanned)/float64(aTotal)*100, aFlagged, float64(aFlagged)/float64(aTotal)*100)
+			fmt.Printf("Accounts:\n\tTotal:\t\t%d\n\tIn use:\t\t%d (%.2f%%)\n\tBanned:\t\t%d (%.2f%%)\n\tFlagged:\t%d (%.2f%%)\n", a.Total, a.Used, float64(a.Used)/float64(a.Total)*100, a.Banned, float64(a.Banned)/float64(a.Total)*100, a.Flagged, float64(a.Flagged)/float64(a.Total)*100)
+			fmt.Println("Ban reasons:")
+			for _, reason := range []string{opm.BanCredentials, opm.BanTemporary, opm.BanPermanent, opm.BanInactive, opm.BanManual, ""} {
+				if n := a.BannedBy[reason]; n > 0 {
+					if reason == "" {
+						reason = "unknown"
+					}
+					fmt.Printf("\t%-14s\t%d\n", reason+":", n)
+				}
+			}
+		}
+		stages, err := database.AccountStageCounts()
+		if err != nil {
+			log.Println(err)
+		} else {
+			fmt.Printf("Account stages:\n\tQuarantine:\t%d\n\tInvalid:\t%d\n\tActive:\t\t%d\n\tBanned:\t\t%d\n", stages[opm.AccountStageQuarantine], stages[opm.AccountStageInvalid], stages[opm.AccountStageActive], stages[opm.AccountStageBanned])
+		}
+	}
+	// Areas
+	if *listAreas {
+		areas, err := database.GetAreas()
+		if err != nil {
+			fmt.Println(err)
+		}
+		for _, a := range areas {
+			b := a.Bounds
+			fmt.Printf("%-24s %-24s %f,%f %f,%f owner=%q geofence=%t\n", a.ID, a.Name, b.North, b.West, b.South, b.East, a.Owner, a.Geofence)
+		}
+	}
+	if *removeArea != "" {
+		err := database.RemoveArea(*removeArea)
+		if err != nil {
+			fmt.Println(err)
 		}
 	}
 	// Remove old Pokemon
@@ -223,6 +343,12 @@ func main() {
 			fmt.Println(err)
 		}
 		fmt.Printf("Removed %d Pokemon from database\n", count)
+		// Tombstones older than the retention window
+		count, err = database.PurgeTombstones(opm.Now().Add(-time.Duration(opmSettings.TombstoneHours) * time.Hour).Unix())
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Printf("Purged %d deleted objects from database\n", count)
 	}
 	// Clean up the Proxies
 	if *dropProxies {
@@ -247,13 +373,17 @@ func main() {
 		// Get accounts from file
 		accounts := make([]opm.Account, 0)
 		for _, l := range lines {
-			split := strings.Split(l, ":")
-			if len(split) == 2 && split[0] != "false" {
-				accounts = append(accounts, opm.Account{Username: split[0], Password: split[1], Provider: "ptc", Used: false, Banned: false})
-				database.AddAccount(opm.Account{Username: split[0], Password: split[1], Provider: "ptc"})
+			a, ok := parseAccountLine(l)
+			if !ok {
+				continue
 			}
+			accounts = append(accounts, a)
+		}
+		added, skipped, err := database.AddAccounts(accounts)
+		if err != nil {
+			fmt.Println(err)
 		}
-		fmt.Printf("Added %d accounts\n", len(accounts))
+		fmt.Printf("Added %d accounts, skipped %d existing\n", added, skipped)
 	}
 	// Mark accounts as unused
 	if *cleanAccounts {
@@ -280,6 +410,27 @@ func main() {
 			fmt.Printf("Removed %d proxies\n", count)
 		}
 	}
+	// Normalize coordinates
+	if *normalize {
+		updated, removed, err := database.NormalizeObjects(1000)
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Printf("Normalized %d objects, removed %d invalid objects\n", updated, removed)
+	}
+	// Schema migrations
+	if *migrate {
+		applied, err := database.Migrate()
+		if err != nil {
+			fmt.Println(err)
+		}
+		if len(applied) == 0 && err == nil {
+			fmt.Println("Schema is up to date")
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied %s\n", m)
+		}
+	}
 	// Add pokemon
 	if *addPokemon {
 		rand.Seed(time.Now().UnixNano())
@@ -296,9 +447,53 @@ func main() {
 			Lng:       *lng,
 			ID:        randId,
 			PokemonID: *pokeId,
-			Expiry:    time.Now().Add(15 * time.Minute).Unix(),
+			Expiry:    opm.ExpiryAfter(opm.Now(), opm.MaxPokemonLifetime),
+		}
+		err := database.AddMapObject(obj)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// Export
+	if *export != "" {
+		err := runExport(database, *export, *exportFormat, *exportFilter, *exportOut, *includeSecrets)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// Replay
+	if *replay {
+		err := runReplay(database, *scanID, *since, *until, *backfill)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// Ingest
+	if *ingest != "" {
+		err := runIngest(database, *ingest, *exportFormat, *archiveExpired)
+		if err != nil {
+			fmt.Println(err)
 		}
-		database.AddMapObject(obj)
+	}
+
+	// Route scan
+	if *scanRoute && *polyline != "" {
+		resp, err := http.PostForm(*scannerURL+"/routescan", url.Values{"polyline": {*polyline}})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		var result opm.MultiPointResponse
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		printMultiPointResponse(result)
 	}
 
 	// UFS
@@ -310,12 +505,19 @@ func main() {
 			log.Println(err)
 			return
 		}
-		var status []opm.StatusEntry
-		err = json.NewDecoder(resp.Body).Decode(&status)
+		var entries []opm.StatusEntry
+		err = json.NewDecoder(resp.Body).Decode(&entries)
 		if err != nil {
 			log.Println(err)
 			return
 		}
+		// Banned trainers are still listed for a while, their accounts are not in use
+		status := make([]opm.StatusEntry, 0, len(entries))
+		for _, e := range entries {
+			if e.State != "banned" {
+				status = append(status, e)
+			}
+		}
 
 		count, err := database.Cleanup(status)
 		if err != nil {
@@ -327,6 +529,221 @@ func main() {
 
 }
 
+// printMultiPointResponse renders the result of a multi-point scan
+func printMultiPointResponse(r opm.MultiPointResponse) {
+	switch {
+	case r.Ok:
+		fmt.Printf("All %d points scanned, %d objects found\n", r.Succeeded, len(r.MapObjects))
+	case r.Partial:
+		fmt.Printf("Partial result: %d of %d points scanned (%d failed, %d skipped), %d objects found\n", r.Succeeded, len(r.Points), r.Failed, r.Skipped, len(r.MapObjects))
+	default:
+		fmt.Printf("Scan failed: %s\n", r.Error)
+	}
+	for i, p := range r.Points {
+		if p.Status != opm.PointOk {
+			fmt.Printf("\t#%-3d %f,%f\t%s\t%s\n", i, p.Lat, p.Lng, p.Status, p.Error)
+		}
+	}
+}
+
+// runExport writes an account or proxy export to the given file
+func runExport(database *db.OpenMapDb, what, format, filter, out string, includeSecrets bool) error {
+	if out == "" {
+		return errors.New("No output file given (-out)")
+	}
+	values, err := url.ParseQuery(filter)
+	if err != nil {
+		return err
+	}
+	var header []string
+	switch what {
+	case "accounts":
+		header = opm.AccountExportHeader(includeSecrets)
+	case "proxies":
+		header = opm.ProxyExportHeader()
+	default:
+		return fmt.Errorf("Unknown export %q", what)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ew, err := opm.NewExportWriter(f, format, header)
+	if err != nil {
+		return err
+	}
+	if what == "accounts" {
+		var af db.AccountFilter
+		af, err = db.ParseAccountFilter(values)
+		if err != nil {
+			return err
+		}
+		err = database.EachAccount(af, func(a opm.Account) error {
+			return ew.Write(opm.AccountExportRow(a, includeSecrets))
+		})
+	} else {
+		var pf db.ProxyFilter
+		pf, err = db.ParseProxyFilter(values)
+		if err != nil {
+			return err
+		}
+		err = database.EachProxy(pf, func(p opm.Proxy) error {
+			return ew.Write(opm.ProxyExportRow(p))
+		})
+	}
+	if err != nil {
+		return err
+	}
+	err = ew.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d %s to %s\n", ew.Rows(), what, out)
+	return f.Close()
+}
+
+// runReplay feeds captured responses through the parser. Without backfill nothing is written.
+func runReplay(database *db.OpenMapDb, scanID string, since, until int64, backfill bool) error {
+	replayed, objects := 0, 0
+	replayOne := func(r opm.RawResponse) error {
+		result, err := database.Replay(r, backfill)
+		if err != nil {
+			return fmt.Errorf("%s: %s", r.ScanID, err)
+		}
+		replayed++
+		objects += len(result)
+		counts := make(map[int]int)
+		for _, o := range result {
+			counts[o.Type]++
+		}
+		fmt.Printf("%s\t%s\t%f,%f\t%d pokemon, %d pokestops, %d gyms\n", r.ScanID, time.Unix(r.Time, 0).Format(time.RFC3339), r.Lat, r.Lng, counts[opm.POKEMON], counts[opm.POKESTOP], counts[opm.GYM])
+		return nil
+	}
+	var err error
+	if scanID != "" {
+		var r opm.RawResponse
+		r, err = database.GetRawResponse(scanID)
+		if err == nil {
+			err = replayOne(r)
+		}
+	} else {
+		err = database.EachRawResponse(since, until, replayOne)
+	}
+	if err != nil {
+		return err
+	}
+	if backfill {
+		fmt.Printf("Replayed %d responses, saved %d new objects\n", replayed, objects)
+	} else {
+		fmt.Printf("Replayed %d responses, parsed %d objects (dry run)\n", replayed, objects)
+	}
+	return nil
+}
+
+// runIngest imports a map object dump with a progress bar. The number of processed records is
+// kept in <file>.progress after every batch, so an interrupted import continues from there.
+func runIngest(database *db.OpenMapDb, file, format string, archiveExpired bool) error {
+	total, err := countLines(file)
+	if err != nil {
+		return err
+	}
+	if format == db.IngestCSV && total > 0 {
+		// Header
+		total--
+	}
+	progressFile := file + ".progress"
+	skip := 0
+	if b, err := ioutil.ReadFile(progressFile); err == nil {
+		skip, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		fmt.Printf("Resuming after %d records\n", skip)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	start := time.Now()
+	progress := func(done, total int) {
+		ioutil.WriteFile(progressFile, []byte(strconv.Itoa(done)), 0644)
+		printProgress(done, total)
+	}
+	result, err := database.BulkIngest(ctx, f, format, progress, db.IngestOptions{
+		Skip:           skip,
+		Total:          total,
+		ArchiveExpired: archiveExpired,
+	})
+	fmt.Println()
+	if err == context.Canceled {
+		return fmt.Errorf("Ingest interrupted, run again to resume after record %d", result.Done)
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(progressFile)
+	elapsed := time.Since(start)
+	fmt.Printf("Ingested %d records in %s (%.0f/s), %d invalid\n", result.Written, elapsed.Round(time.Second), float64(result.Written)/elapsed.Seconds(), result.Invalid)
+	return nil
+}
+
+// printProgress draws a progress bar on the current line
+func printProgress(done, total int) {
+	const width = 40
+	if total <= 0 {
+		fmt.Printf("\r%d records", done)
+		return
+	}
+	if done > total {
+		done = total
+	}
+	n := done * width / total
+	fmt.Printf("\r[%s%s] %3d%% %d/%d", strings.Repeat("=", n), strings.Repeat(" ", width-n), done*100/total, done, total)
+}
+
+// countLines returns the number of non-empty lines of a file
+func countLines(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) > 0 {
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
+
+// parseAccountLine reads an account from a line of the accounts file. Lines are either
+// "username:password" for PTC accounts or "token:provider:username:authtoken" for
+// pre-authenticated accounts.
+func parseAccountLine(l string) (opm.Account, bool) {
+	split := strings.SplitN(l, ":", 4)
+	if len(split) == 4 && split[0] == "token" {
+		return opm.Account{Username: split[2], AuthToken: split[3], Provider: split[1]}, split[2] != "" && split[3] != ""
+	}
+	if len(split) == 2 && split[0] != "false" {
+		return opm.Account{Username: split[0], Password: split[1], Provider: "ptc"}, true
+	}
+	return opm.Account{}, false
+}
+
 func generateRandomKey() string {
 	var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 	b := make([]rune, 8)
@@ -0,0 +1,74 @@
+package opm
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInvalidArea is returned for areas without a name or with empty bounds
+var ErrInvalidArea = errors.New("Invalid area")
+
+// RegionAreaID is the id of the area imported from the Region setting
+const RegionAreaID = "region"
+
+// Area is a named part of the map. The features that are limited to a part of the map
+// refer to areas instead of having their own configuration.
+type Area struct {
+	ID     string      `json:"id"`
+	Name   string      `json:"name"`
+	Bounds BoundingBox `json:"bounds"`
+	// Public API key of the owner, empty for areas of the operators
+	Owner string `json:"owner,omitempty"`
+	// Seconds between scheduled scans of the area, 0 = not scanned on a schedule
+	ScanInterval int `json:"scanInterval,omitempty"`
+	// Features the area is used for
+	Geofence   bool `json:"geofence"`   // swapped coordinates are detected with the area, see FixSwappedCoordinates
+	Schedule   bool `json:"schedule"`   // scanned every ScanInterval
+	Federation bool `json:"federation"` // shared with federated instances
+	Visibility bool `json:"visibility"` // the visibility policy applies inside the area
+	// Local hours [QuietStart, QuietEnd) in which the scheduled scans of the area pause, e.g.
+	// 23 to 6. Equal hours mean no quiet hours, see Quiet.
+	QuietStart int `json:"quietStart,omitempty"`
+	QuietEnd   int `json:"quietEnd,omitempty"`
+	// IANA timezone of the quiet hours, UTC if empty
+	Timezone string `json:"timezone,omitempty"`
+
+	CreatedBy string `json:"createdBy,omitempty"`
+	Created   int64  `json:"created"`
+	Updated   int64  `json:"updated"`
+}
+
+// Validate checks the fields that are required for every area
+func (a Area) Validate() error {
+	if a.Name == "" || !a.Bounds.IsSet() || a.ScanInterval < 0 {
+		return ErrInvalidArea
+	}
+	if a.QuietStart < 0 || a.QuietStart > 23 || a.QuietEnd < 0 || a.QuietEnd > 23 {
+		return ErrInvalidArea
+	}
+	if _, err := time.LoadLocation(a.Timezone); err != nil {
+		return ErrInvalidArea
+	}
+	b := a.Bounds
+	if b.North > 90 || b.South < -90 || b.North <= b.South || b.East < -180 || b.East > 180 || b.West < -180 || b.West > 180 {
+		return ErrInvalidArea
+	}
+	return nil
+}
+
+// Quiet reports whether now is in the quiet hours of the area, local to its Timezone.
+// Quiet hours can span midnight.
+func (a Area) Quiet(now time.Time) bool {
+	if a.QuietStart == a.QuietEnd {
+		return false
+	}
+	loc, err := time.LoadLocation(a.Timezone)
+	if err != nil {
+		return false
+	}
+	h := now.In(loc).Hour()
+	if a.QuietStart < a.QuietEnd {
+		return h >= a.QuietStart && h < a.QuietEnd
+	}
+	return h >= a.QuietStart || h < a.QuietEnd
+}
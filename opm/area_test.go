@@ -0,0 +1,44 @@
+package opm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAreaQuiet(t *testing.T) {
+	bounds := BoundingBox{North: 52.6, South: 52.4, East: 13.5, West: 13.3}
+	// 22:30 UTC on a summer day, 00:30 in Berlin
+	night := time.Date(2017, 7, 1, 22, 30, 0, 0, time.UTC)
+	tests := []struct {
+		area  Area
+		at    time.Time
+		quiet bool
+	}{
+		{Area{}, night, false},
+		{Area{QuietStart: 1, QuietEnd: 6}, night, false},
+		{Area{QuietStart: 22, QuietEnd: 6}, night, true},
+		{Area{QuietStart: 0, QuietEnd: 6, Timezone: "Europe/Berlin"}, night, true},
+		{Area{QuietStart: 0, QuietEnd: 6, Timezone: "Europe/Berlin"}, night.Add(-time.Hour), false},
+		// The end hour is not quiet anymore
+		{Area{QuietStart: 23, QuietEnd: 2, Timezone: "Europe/Berlin"}, night.Add(90 * time.Minute), false},
+		{Area{QuietStart: 23, QuietEnd: 2, Timezone: "Europe/Berlin"}, night.Add(-time.Hour), true},
+		{Area{QuietStart: 1, QuietEnd: 6, Timezone: "America/New_York"}, night, false},
+		{Area{QuietStart: 1, QuietEnd: 6, Timezone: "America/New_York"}, night.Add(8 * time.Hour), true},
+	}
+	for _, test := range tests {
+		a := test.area
+		a.Name, a.Bounds = "test", bounds
+		if err := a.Validate(); err != nil {
+			t.Errorf("%+v: %v", a, err)
+		}
+		if quiet := a.Quiet(test.at); quiet != test.quiet {
+			t.Errorf("quiet hours %d-%d %s at %s = %t, want %t", a.QuietStart, a.QuietEnd, a.Timezone, test.at, quiet, test.quiet)
+		}
+	}
+	for _, a := range []Area{{QuietStart: 24}, {QuietEnd: -1}, {Timezone: "Mars/Olympus"}} {
+		a.Name, a.Bounds = "test", bounds
+		if err := a.Validate(); err != ErrInvalidArea {
+			t.Errorf("Validate(%+v) = %v, want ErrInvalidArea", a, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package opm
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Sources of configuration values
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceRuntime = "runtime"
+)
+
+// redacted replaces secrets in the configuration introspection
+const redacted = "[redacted]"
+
+// urlCredentials matches the user info of URLs, e.g. the password of a proxy
+var urlCredentials = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*://)[^\s/@]+@`)
+
+// RedactCredentials strips user names and passwords from the URLs in s
+func RedactCredentials(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	return urlCredentials.ReplaceAllString(s, "${1}"+redacted+"@")
+}
+
+// ConfigValue is an effective configuration value together with its source
+type ConfigValue struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// FileKeys returns the lower case top level keys of a json settings file
+func FileKeys(data []byte) map[string]bool {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(data, &raw) != nil {
+		return nil
+	}
+	keys := make(map[string]bool, len(raw))
+	for k := range raw {
+		keys[strings.ToLower(k)] = true
+	}
+	return keys
+}
+
+// DescribeConfig annotates every field of the settings struct effective with its source.
+// loaded is the struct as it was unmarshaled from the file, before defaults were applied by
+// the caller, and fileKeys are the keys of the file (see FileKeys). A value is from the file
+// if its key was set and it was not replaced afterwards. Secrets, passwords and the
+// credentials of URLs are redacted.
+func DescribeConfig(effective, loaded interface{}, fileKeys map[string]bool) map[string]ConfigValue {
+	e := reflect.ValueOf(effective)
+	l := reflect.ValueOf(loaded)
+	result := make(map[string]ConfigValue, e.NumField())
+	for i := 0; i < e.NumField(); i++ {
+		f := e.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		v := ConfigValue{Value: e.Field(i).Interface(), Source: SourceDefault}
+		if fileKeys[strings.ToLower(f.Name)] && reflect.DeepEqual(v.Value, l.Field(i).Interface()) {
+			v.Source = SourceFile
+		}
+		if isSecret(f.Name) && !isZero(e.Field(i)) {
+			v.Value = redacted
+		} else if str, ok := v.Value.(string); ok {
+			v.Value = RedactCredentials(str)
+		}
+		result[f.Name] = v
+	}
+	return result
+}
+
+func isSecret(name string) bool {
+	return strings.Contains(name, "Secret") || strings.Contains(name, "Password")
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
@@ -0,0 +1,38 @@
+package opm
+
+// Storage backends
+const (
+	BackendMongo    = "mongo"
+	BackendPostgres = "postgres"
+)
+
+// Database is the storage used for the map and the account and proxy lifecycle of the scanner.
+// db.OpenMapDb implements it on MongoDB, db/postgres on PostgreSQL with PostGIS.
+type Database interface {
+	// GetMapObjects returns the unexpired objects of the given types within radius meters
+	GetMapObjects(lat, lng float64, types []int, radius int) ([]MapObject, error)
+	// AddMapObject adds a Pokemon or replaces a fort with an older capture time. Duplicate
+	// Pokemon and stale forts are an error.
+	AddMapObject(m MapObject) error
+	// GetAccount returns a free account and marks it as used
+	GetAccount() (Account, error)
+	// ReturnAccount marks the account as not used, the rest of the stored account is kept
+	ReturnAccount(a Account) error
+	// UpdateAccount stores the fields the trainer changes: the auth token and its progress
+	UpdateAccount(a Account) error
+	// MarkAccountBanned flags the account as banned and records the reason (see BanCredentials)
+	// and time of the ban
+	MarkAccountBanned(username, reason string) error
+	// MarkTokenExpired takes the account out of rotation until it has a new token, it is not banned
+	MarkTokenExpired(username string) error
+	// FlagCaptcha takes the account out of rotation until its captcha is solved, see ClearCaptcha
+	FlagCaptcha(username, url string) error
+	// GetCaptchaAccounts returns the accounts that wait for a solved captcha
+	GetCaptchaAccounts() ([]Account, error)
+	// ClearCaptcha puts a flagged account back into rotation
+	ClearCaptcha(username string) error
+	// GetProxy returns a free proxy and marks it as used
+	GetProxy() (Proxy, error)
+	// ReturnProxy marks the proxy as alive and not used
+	ReturnProxy(p Proxy) error
+}
@@ -4,10 +4,22 @@ import "errors"
 
 var ErrBusy = errors.New("All our minions are busy")
 var ErrScanTimeout = errors.New("Scan timed out")
+var ErrPaused = errors.New("Scanning is paused")
 var ErrWrongMethod = errors.New("Wrong method")
+var ErrWrongFormat = errors.New("Wrong format")
+var ErrInvalidCoordinates = errors.New("Invalid coordinates")
 var ErrNoProxiesAvailable = errors.New("No proxy available.")
 var ErrProxyNotFound = errors.New("Proxy not found")
 var ErrTimeout = errors.New("Timeout")
 var ErrInvalidWebhook = errors.New("Invalid webhook")
 var ErrPokemonExpired = errors.New("Pokemon already expired")
 var ErrPokemonFuture = errors.New("Pokemons disappear time too far in the future")
+var ErrUnknownAction = errors.New("Unknown action")
+var ErrUnknownFormat = errors.New("Unknown format")
+var ErrHistoryTooOld = errors.New("Query too far in the past")
+var ErrHistoryRateLimited = errors.New("Too many historical queries")
+var ErrNoAPIKey = errors.New("API key required")
+var ErrInvalidAPIKey = errors.New("Invalid API key")
+var ErrRateLimited = errors.New("Rate limit exceeded")
+var ErrTokenExpired = errors.New("Auth token expired")
+var ErrInvalidCursor = errors.New("Invalid or expired cursor, restart without a cursor")
@@ -0,0 +1,48 @@
+package opm
+
+import "time"
+
+// MaxPokemonLifetime is the longest time a wild Pokemon stays on the map
+const MaxPokemonLifetime = 15 * time.Minute
+
+// MaxLureLifetime is the longest time a lure module stays on a Pokestop
+const MaxLureLifetime = 30 * time.Minute
+
+// Now returns the current time for all expiry math. Tests replace it to get a deterministic clock.
+var Now = time.Now
+
+// Expiries are unix timestamps in seconds (UTC), 0 means the object doesn't expire.
+// All comparisons go through these functions so the boundaries are the same everywhere.
+
+// ExpiryAfter returns the expiry of an object that disappears ttl after at
+func ExpiryAfter(at time.Time, ttl time.Duration) int64 {
+	return at.Add(ttl).Unix()
+}
+
+// ExpiryFromMs converts an absolute timestamp in milliseconds, as sent by the game, to an expiry
+func ExpiryFromMs(ms int64) int64 {
+	return ms / 1000
+}
+
+// Expired reports whether the expiry has passed at now. An object is still visible in the
+// second it expires.
+func Expired(expiry int64, now time.Time) bool {
+	return expiry != 0 && expiry < now.Unix()
+}
+
+// TooFarAhead reports whether a Pokemon with this expiry would stay longer than MaxPokemonLifetime
+func TooFarAhead(expiry int64, now time.Time) bool {
+	return expiry > now.Add(MaxPokemonLifetime).Unix()
+}
+
+// ClearExpiredLure returns a Pokestop whose lure has expired at now as a plain Pokestop.
+// The expiry of a Pokestop is that of its lure, unlured Pokestops have expiry 0.
+// Other objects are returned unchanged.
+func ClearExpiredLure(m MapObject, now time.Time) MapObject {
+	if m.Type == POKESTOP && Expired(m.Expiry, now) {
+		m.Lured = false
+		m.LureType = ""
+		m.Expiry = 0
+	}
+	return m
+}
@@ -0,0 +1,103 @@
+package opm
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// instant is a random time with nanoseconds in a random time zone, the expiry math must not
+// depend on either
+type instant struct{ time.Time }
+
+func (instant) Generate(r *rand.Rand, size int) reflect.Value {
+	t := time.Unix(1500000000+r.Int63n(1000000000), r.Int63n(int64(time.Second)))
+	zones := []*time.Location{time.UTC, time.Local, time.FixedZone("UTC-11", -11*3600), time.FixedZone("UTC+14", 14*3600), time.FixedZone("UTC+5:45", 5*3600+45*60)}
+	return reflect.ValueOf(instant{t.In(zones[r.Intn(len(zones))])})
+}
+
+func TestExpiryBoundaries(t *testing.T) {
+	// Visible up to and including the second of the expiry, in every zone
+	visibleInLastSecond := func(at instant, ttl uint16) bool {
+		expiry := ExpiryAfter(at.Time, time.Duration(ttl)*time.Second)
+		last := time.Unix(expiry, int64(time.Second)-1).In(at.Location())
+		return !Expired(expiry, time.Unix(expiry, 0)) && !Expired(expiry, last) && Expired(expiry, last.Add(time.Nanosecond))
+	}
+	if err := quick.Check(visibleInLastSecond, nil); err != nil {
+		t.Error(err)
+	}
+	// An object is never expired before its ttl has passed, and the zone of now doesn't matter
+	notExpiredEarly := func(at, now instant, ttl uint16) bool {
+		expiry := ExpiryAfter(at.Time, time.Duration(ttl)*time.Second)
+		if now.Before(at.Add(time.Duration(ttl) * time.Second)) {
+			return !Expired(expiry, now.Time)
+		}
+		return Expired(expiry, now.Time) == Expired(expiry, now.UTC())
+	}
+	if err := quick.Check(notExpiredEarly, nil); err != nil {
+		t.Error(err)
+	}
+	neverExpires := func(now instant) bool { return !Expired(0, now.Time) }
+	if err := quick.Check(neverExpires, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpiryFromMs(t *testing.T) {
+	// The game sends milliseconds, the second of the expiry is the one the millisecond is in
+	truncates := func(ms uint32) bool {
+		at := int64(ms) + 1500000000000
+		expiry := ExpiryFromMs(at)
+		return expiry*1000 <= at && at < (expiry+1)*1000 && !Expired(expiry, time.Unix(0, at*int64(time.Millisecond)))
+	}
+	if err := quick.Check(truncates, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTooFarAhead(t *testing.T) {
+	maxLifetime := func(now instant, offset int16) bool {
+		expiry := now.Unix() + int64(MaxPokemonLifetime/time.Second) + int64(offset)
+		return TooFarAhead(expiry, now.Time) == (offset > 0)
+	}
+	if err := quick.Check(maxLifetime, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpiryAcrossDaylightSaving(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// Clocks jump from 2:00 to 3:00 and back from 3:00 to 2:00
+	for _, at := range []time.Time{
+		time.Date(2017, 3, 26, 1, 50, 0, 0, berlin),
+		time.Date(2017, 10, 29, 2, 50, 0, 0, berlin).Add(time.Hour),
+	} {
+		expiry := ExpiryAfter(at, 15*time.Minute)
+		if expiry-at.Unix() != 15*60 {
+			t.Errorf("expiry at %s is %d s later, want 900", at, expiry-at.Unix())
+		}
+		if Expired(expiry, at.Add(15*time.Minute)) || !Expired(expiry, at.Add(15*time.Minute+time.Second)) {
+			t.Errorf("Pokemon seen at %s expires at the wrong time", at)
+		}
+	}
+}
+
+func TestClearExpiredLure(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	stop := MapObject{Type: POKESTOP, Lured: true, LureType: LureGlacial, Expiry: now.Unix()}
+	if got := ClearExpiredLure(stop, now); !got.Lured || got.Expiry != now.Unix() {
+		t.Errorf("lure in its last second = %+v, want it kept", got)
+	}
+	if got := ClearExpiredLure(stop, now.Add(time.Second)); got.Lured || got.LureType != "" || got.Expiry != 0 {
+		t.Errorf("expired lure = %+v, want a plain Pokestop", got)
+	}
+	pokemon := MapObject{Type: POKEMON, Expiry: now.Unix()}
+	if got := ClearExpiredLure(pokemon, now.Add(time.Hour)); got != pokemon {
+		t.Errorf("Pokemon = %+v, want it unchanged", got)
+	}
+}
@@ -0,0 +1,121 @@
+package opm
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Export formats
+const (
+	ExportCSV  = "csv"
+	ExportJSON = "json"
+)
+
+// ExportWriter writes rows of an export as CSV or as a JSON array of objects.
+// Rows are written as they come, so large exports don't have to fit in memory.
+type ExportWriter struct {
+	format string
+	header []string
+	w      io.Writer
+	csv    *csv.Writer
+	rows   int
+}
+
+// NewExportWriter creates an ExportWriter for the given format and columns
+func NewExportWriter(w io.Writer, format string, header []string) (*ExportWriter, error) {
+	e := &ExportWriter{format: format, header: header, w: w}
+	switch format {
+	case ExportCSV:
+		e.csv = csv.NewWriter(w)
+		return e, e.csv.Write(header)
+	case ExportJSON:
+		_, err := io.WriteString(w, "[")
+		return e, err
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Write writes a single row. The values must be in the order of the header.
+func (e *ExportWriter) Write(row []interface{}) error {
+	e.rows++
+	if e.format == ExportCSV {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = fmt.Sprint(v)
+		}
+		err := e.csv.Write(record)
+		// Flush regularly to stream the output
+		if err == nil && e.rows%100 == 0 {
+			e.csv.Flush()
+			err = e.csv.Error()
+		}
+		return err
+	}
+	// JSON object with the keys in header order
+	buf := []byte("{")
+	if e.rows > 1 {
+		buf = []byte(",{")
+	}
+	for i, v := range row {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendQuote(buf, e.header[i])
+		buf = append(buf, ':')
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b...)
+	}
+	buf = append(buf, '}')
+	_, err := e.w.Write(buf)
+	return err
+}
+
+// Rows returns the number of rows written
+func (e *ExportWriter) Rows() int {
+	return e.rows
+}
+
+// Close finishes the export. It doesn't close the underlying writer.
+func (e *ExportWriter) Close() error {
+	if e.format == ExportCSV {
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+// AccountExportHeader returns the columns of an account export.
+// Password and auth token are only included if includeSecrets is set.
+func AccountExportHeader(includeSecrets bool) []string {
+	h := []string{"username", "provider", "used", "banned", "captchaFlagged", "pool", "cooldownUntil", "tokenExpired"}
+	if includeSecrets {
+		h = append(h, "password", "authToken")
+	}
+	return h
+}
+
+// AccountExportRow returns an account as export row
+func AccountExportRow(a Account, includeSecrets bool) []interface{} {
+	row := []interface{}{a.Username, a.Provider, a.Used, a.Banned, a.CaptchaFlagged, a.Pool, a.CooldownUntil, a.TokenExpired}
+	if includeSecrets {
+		row = append(row, a.Password, a.AuthToken)
+	}
+	return row
+}
+
+// ProxyExportHeader returns the columns of a proxy export
+func ProxyExportHeader() []string {
+	return []string{"id", "use", "dead", "url", "lastCheck"}
+}
+
+// ProxyExportRow returns a proxy as export row
+func ProxyExportRow(p Proxy) []interface{} {
+	return []interface{}{p.ID, p.Use, p.Dead, p.URL, p.LastCheck}
+}
@@ -0,0 +1,65 @@
+package opm
+
+// GeoJSON types for map objects, see RFC 7946
+
+// FeatureCollection is a GeoJSON FeatureCollection
+type FeatureCollection struct {
+	Type       string                `json:"type"`
+	Features   []Feature             `json:"features"`
+	Properties *CollectionProperties `json:"properties,omitempty"`
+}
+
+// CollectionProperties are the properties of a FeatureCollection of map objects
+type CollectionProperties struct {
+	// HistoricalAt is the instant of a historical query (unix seconds)
+	HistoricalAt int64 `json:"historicalAt,omitempty"`
+}
+
+// Feature is a GeoJSON Feature with a Point geometry
+type Feature struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id,omitempty"`
+	Geometry   Point             `json:"geometry"`
+	Properties FeatureProperties `json:"properties"`
+}
+
+// Point is a GeoJSON Point. Coordinates are in lng, lat order.
+type Point struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// FeatureProperties are the properties of a map object feature
+type FeatureProperties struct {
+	Type      int   `json:"type"`
+	PokemonID int   `json:"pokemonId,omitempty"`
+	Expiry    int64 `json:"expiry,omitempty"`
+	Team      int   `json:"team,omitempty"`
+	Lured     bool  `json:"lured,omitempty"`
+}
+
+// NewFeatureCollection converts map objects to a GeoJSON FeatureCollection
+func NewFeatureCollection(objects []MapObject) FeatureCollection {
+	fc := FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]Feature, len(objects)),
+	}
+	for i, o := range objects {
+		fc.Features[i] = Feature{
+			Type: "Feature",
+			ID:   o.ID,
+			Geometry: Point{
+				Type:        "Point",
+				Coordinates: [2]float64{o.Lng, o.Lat},
+			},
+			Properties: FeatureProperties{
+				Type:      o.Type,
+				PokemonID: o.PokemonID,
+				Expiry:    o.Expiry,
+				Team:      o.Team,
+				Lured:     o.Lured,
+			},
+		}
+	}
+	return fc
+}
@@ -0,0 +1,57 @@
+package opm
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// checkGolden compares v encoded as indented JSON with testdata/name
+func checkGolden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs, run go test -update to see the changes\ngot:\n%s", name, got)
+	}
+}
+
+func TestFeatureCollectionGolden(t *testing.T) {
+	objects := []MapObject{
+		{Type: POKEMON, ID: "8412345678901234567", PokemonID: 149, Lat: 52.520008, Lng: 13.404954, Expiry: 1501592400},
+		{Type: GYM, ID: "gym.1", Lat: 40.7128, Lng: -74.006, Team: 2},
+		{Type: POKESTOP, ID: "stop.1", Lat: -33.8688, Lng: 151.2093, Lured: true, Expiry: 1501592700},
+		// Unknown expiry and no team are left out
+		{Type: POKESTOP, ID: "stop.2", Lat: 0.5, Lng: -0.5},
+	}
+	checkGolden(t, "featurecollection.json", NewFeatureCollection(objects))
+}
+
+func TestFeatureCollectionEmpty(t *testing.T) {
+	// Clients iterate the features, an empty result is an empty array and not null
+	checkGolden(t, "featurecollection-empty.json", NewFeatureCollection(nil))
+}
+
+func TestFeatureCollectionHistorical(t *testing.T) {
+	fc := NewFeatureCollection([]MapObject{{Type: POKEMON, ID: "p1", PokemonID: 16, Lat: 1, Lng: 2, Expiry: 1501592400}})
+	fc.Properties = &CollectionProperties{HistoricalAt: 1501591800}
+	checkGolden(t, "featurecollection-historical.json", fc)
+}
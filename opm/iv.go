@@ -0,0 +1,29 @@
+package opm
+
+import "math"
+
+// MaxIV is the highest possible value of a single individual value
+const MaxIV = 15
+
+// IVs are the individual values of an encountered Pokemon
+type IVs struct {
+	Attack  int     `json:"attack"`
+	Defense int     `json:"defense"`
+	Stamina int     `json:"stamina"`
+	Percent float64 `json:"percent"`
+	// Ranks in the configured leagues, see WithRanks
+	Ranks []LeagueRank `json:"ranks,omitempty" bson:",omitempty"`
+}
+
+// Valid returns true if all values are within 0 and MaxIV
+func (iv IVs) Valid() bool {
+	return iv.Attack >= 0 && iv.Attack <= MaxIV &&
+		iv.Defense >= 0 && iv.Defense <= MaxIV &&
+		iv.Stamina >= 0 && iv.Stamina <= MaxIV
+}
+
+// IVPercent returns the sum of the IVs as percentage of the maximum, rounded to one decimal
+func (iv IVs) IVPercent() float64 {
+	sum := iv.Attack + iv.Defense + iv.Stamina
+	return math.Round(float64(sum)/float64(3*MaxIV)*1000) / 10
+}
@@ -0,0 +1,176 @@
+package opm
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// MaxLevel is the highest level a Pokemon can be powered up to, without the best buddy boost
+const MaxLevel = 50
+
+// League is a PvP league. The Pokemon of a species are ranked by their stat product at the
+// highest level that keeps them within the CP cap.
+type League struct {
+	Name  string
+	MaxCP int // 0 = no cap
+}
+
+// LeagueRank is the rank of the IVs of a Pokemon among the 4096 IV combinations of its species
+type LeagueRank struct {
+	League  string  `json:"league"`
+	Rank    int     `json:"rank"`    // 1 = highest stat product, equal products share a rank
+	Level   float64 `json:"level"`   // highest level within the CP cap
+	CP      int     `json:"cp"`      // CP at that level
+	Percent float64 `json:"percent"` // stat product in percent of rank 1, rounded to one decimal
+}
+
+type cpmLevel struct {
+	Level float64 `json:"level"`
+	CPM   float64 `json:"cpm"`
+}
+
+//go:embed cpm.json
+var cpmData []byte
+
+// cpmTable are the CP multipliers of levels 1 to MaxLevel in steps of 0.5
+var cpmTable = loadCPM(cpmData)
+
+// loadCPM parses the table and makes sure it has every level from 1 to MaxLevel
+func loadCPM(data []byte) []cpmLevel {
+	var table []cpmLevel
+	if err := json.Unmarshal(data, &table); err != nil {
+		panic("opm: invalid CP multiplier table: " + err.Error())
+	}
+	if len(table) != 2*MaxLevel-1 {
+		panic(fmt.Sprintf("opm: CP multiplier table has %d levels", len(table)))
+	}
+	for i, l := range table {
+		if l.Level != 1+float64(i)/2 || (i > 0 && l.CPM <= table[i-1].CPM) {
+			panic(fmt.Sprintf("opm: invalid CP multiplier table entry %d", i))
+		}
+	}
+	return table
+}
+
+// CPMultiplier returns the CP multiplier of a level. Levels are 1 to MaxLevel in steps of 0.5.
+func CPMultiplier(level float64) (float64, bool) {
+	i := level*2 - 2
+	if i < 0 || i >= float64(len(cpmTable)) || i != math.Trunc(i) {
+		return 0, false
+	}
+	return cpmTable[int(i)].CPM, true
+}
+
+// CP returns the combat power of a Pokemon of the species with the IVs at the level
+func (s Species) CP(iv IVs, level float64) (int, bool) {
+	cpm, ok := CPMultiplier(level)
+	if !ok || !iv.Valid() {
+		return 0, false
+	}
+	return s.cp(iv, cpm), true
+}
+
+func (s Species) cp(iv IVs, cpm float64) int {
+	attack := float64(s.BaseAttack + iv.Attack)
+	defense := float64(s.BaseDefense + iv.Defense)
+	stamina := float64(s.BaseStamina + iv.Stamina)
+	cp := int(attack * math.Sqrt(defense) * math.Sqrt(stamina) * cpm * cpm / 10)
+	if cp < 10 {
+		return 10
+	}
+	return cp
+}
+
+// topLevel returns the index in cpmTable of the highest level within maxCP and the stat
+// product there, or -1 if the Pokemon is over the cap even at level 1
+func (s Species) topLevel(iv IVs, maxCP int) (int, float64) {
+	i := len(cpmTable) - 1
+	if maxCP > 0 {
+		// CP grows with the level
+		i = sort.Search(len(cpmTable), func(i int) bool { return s.cp(iv, cpmTable[i].CPM) > maxCP }) - 1
+		if i < 0 {
+			return -1, 0
+		}
+	}
+	cpm := cpmTable[i].CPM
+	attack := float64(s.BaseAttack+iv.Attack) * cpm
+	defense := float64(s.BaseDefense+iv.Defense) * cpm
+	// The game rounds the HP down
+	hp := math.Floor(float64(s.BaseStamina+iv.Stamina) * cpm)
+	return i, attack * defense * hp
+}
+
+type leagueKey struct {
+	species int
+	maxCP   int
+}
+
+// statProducts caches the stat products of all IV combinations per species and CP cap,
+// sorted from highest to lowest
+var statProducts = struct {
+	sync.Mutex
+	m map[leagueKey][]float64
+}{m: make(map[leagueKey][]float64)}
+
+// rankedProducts returns the sorted stat products of the species in a league
+func rankedProducts(s Species, maxCP int) []float64 {
+	key := leagueKey{s.ID, maxCP}
+	statProducts.Lock()
+	defer statProducts.Unlock()
+	if products, ok := statProducts.m[key]; ok {
+		return products
+	}
+	products := make([]float64, 0, (MaxIV+1)*(MaxIV+1)*(MaxIV+1))
+	for a := 0; a <= MaxIV; a++ {
+		for d := 0; d <= MaxIV; d++ {
+			for st := 0; st <= MaxIV; st++ {
+				if i, product := s.topLevel(IVs{Attack: a, Defense: d, Stamina: st}, maxCP); i >= 0 {
+					products = append(products, product)
+				}
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(products)))
+	statProducts.m[key] = products
+	return products
+}
+
+// RankIVs returns the rank of the IVs of a Pokemon in the league. It's false for unknown
+// species, invalid IVs and Pokemon that are over the CP cap even at level 1.
+func RankIVs(pokemonID int, iv IVs, league League) (LeagueRank, bool) {
+	s, ok := LookupSpecies(pokemonID)
+	if !ok || !iv.Valid() {
+		return LeagueRank{}, false
+	}
+	i, product := s.topLevel(iv, league.MaxCP)
+	if i < 0 {
+		return LeagueRank{}, false
+	}
+	products := rankedProducts(s, league.MaxCP)
+	// Products are computed the same way for the table, so equal IVs compare equal
+	higher := sort.Search(len(products), func(j int) bool { return products[j] <= product })
+	return LeagueRank{
+		League:  league.Name,
+		Rank:    higher + 1,
+		Level:   cpmTable[i].Level,
+		CP:      s.cp(iv, cpmTable[i].CPM),
+		Percent: math.Round(product/products[0]*1000) / 10,
+	}, true
+}
+
+// WithRanks returns the IVs with their percentage and their ranks in the leagues, the
+// values that are stored with a Pokemon
+func (iv IVs) WithRanks(pokemonID int, leagues []League) IVs {
+	iv.Percent = iv.IVPercent()
+	iv.Ranks = nil
+	for _, l := range leagues {
+		if r, ok := RankIVs(pokemonID, iv, l); ok {
+			iv.Ranks = append(iv.Ranks, r)
+		}
+	}
+	return iv
+}
@@ -0,0 +1,120 @@
+package opm
+
+import (
+	"math"
+	"testing"
+)
+
+var (
+	hundo = IVs{Attack: 15, Defense: 15, Stamina: 15}
+	zero  = IVs{}
+)
+
+func TestCPMultiplier(t *testing.T) {
+	tests := []struct {
+		level float64
+		cpm   float64
+		ok    bool
+	}{
+		{1, 0.094, true},
+		{20, 0.59740001, true},
+		{40, 0.79030001, true},
+		{MaxLevel, 0.84029999, true},
+		{0.5, 0, false},
+		{20.25, 0, false},
+		{MaxLevel + 0.5, 0, false},
+	}
+	for _, test := range tests {
+		if cpm, ok := CPMultiplier(test.level); cpm != test.cpm || ok != test.ok {
+			t.Errorf("CPMultiplier(%v) = %v, %v, want %v, %v", test.level, cpm, ok, test.cpm, test.ok)
+		}
+	}
+}
+
+// TestCP checks well-known CPs of perfect Pokemon: level 40, raid catches at level 20 and
+// weather boosted raid catches at level 25
+func TestCP(t *testing.T) {
+	tests := []struct {
+		pokemonID int
+		level     float64
+		cp        int
+	}{
+		{25, 40, 938},   // Pikachu
+		{6, 40, 2889},   // Charizard
+		{68, 40, 3056},  // Machamp
+		{130, 40, 3391}, // Gyarados
+		{149, 40, 3792}, // Dragonite
+		{150, 40, 4178}, // Mewtwo
+		{150, 20, 2387},
+		{150, 25, 2984},
+	}
+	for _, test := range tests {
+		s, _ := LookupSpecies(test.pokemonID)
+		if cp, ok := s.CP(hundo, test.level); !ok || cp != test.cp {
+			t.Errorf("CP of a perfect %s at level %v = %d, want %d", s.Name, test.level, cp, test.cp)
+		}
+	}
+	s, _ := LookupSpecies(16)
+	if cp, _ := s.CP(zero, 1); cp != 10 {
+		t.Errorf("CP of a level 1 Pidgey = %d, want the minimum of 10", cp)
+	}
+	if _, ok := s.CP(IVs{Attack: 16}, 20); ok {
+		t.Error("CP with an attack IV of 16 is ok")
+	}
+}
+
+func TestRankIVs(t *testing.T) {
+	great := League{Name: "great", MaxCP: 1500}
+	ultra := League{Name: "ultra", MaxCP: 2500}
+	master := League{Name: "master"}
+	tests := []struct {
+		name      string
+		pokemonID int
+		ivs       IVs
+		league    League
+		want      LeagueRank
+	}{
+		// The well-known rank 1 Venusaur of the Great League. At level 21 its stats are
+		// 198 * 0.61215729 = 121.2 attack, 203 * 0.61215729 = 124.3 defense and
+		// floor(201 * 0.61215729) = 123 HP, a stat product of 1852646 at 1498 CP.
+		{"venusaur rank 1", 3, IVs{Attack: 0, Defense: 14, Stamina: 11}, great, LeagueRank{League: "great", Rank: 1, Level: 21, CP: 1498, Percent: 100}},
+		// A perfect Venusaur has to stay at level 19 and is far behind
+		{"perfect venusaur", 3, hundo, great, LeagueRank{League: "great", Rank: 2388, Level: 19, CP: 1476, Percent: 94.6}},
+		{"perfect venusaur ultra", 3, hundo, ultra, LeagueRank{League: "ultra", Rank: 2511, Level: 34, CP: 2487, Percent: 95.6}},
+		// Without a cap the perfect IVs are rank 1 at the maximum level
+		{"perfect mewtwo master", 150, hundo, master, LeagueRank{League: "master", Rank: 1, Level: MaxLevel, CP: 4724, Percent: 100}},
+	}
+	for _, test := range tests {
+		got, ok := RankIVs(test.pokemonID, test.ivs, test.league)
+		if !ok || got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.name, got, test.want)
+		}
+	}
+	if got, ok := RankIVs(150, zero, master); !ok || got.Rank != 4096 || got.Level != MaxLevel {
+		t.Errorf("worst mewtwo master: %+v, want the last rank at level %d", got, MaxLevel)
+	}
+	if _, ok := RankIVs(1000, hundo, great); ok {
+		t.Error("rank of an unknown species")
+	}
+	if _, ok := RankIVs(3, IVs{Attack: -1}, great); ok {
+		t.Error("rank of invalid IVs")
+	}
+	if _, ok := RankIVs(150, zero, League{Name: "tiny", MaxCP: 10}); ok {
+		t.Error("rank of a Mewtwo that's over the cap at level 1")
+	}
+}
+
+func TestWithRanks(t *testing.T) {
+	leagues := []League{{Name: "great", MaxCP: 1500}, {Name: "tiny", MaxCP: 10}, {Name: "master"}}
+	iv := IVs{Attack: 0, Defense: 14, Stamina: 11, Ranks: []LeagueRank{{League: "stale"}}}.WithRanks(3, leagues)
+	if math.Abs(iv.Percent-55.6) > 1e-9 {
+		t.Errorf("percent = %v, want 55.6", iv.Percent)
+	}
+	// Venusaur is over the cap of the tiny league
+	if len(iv.Ranks) != 2 || iv.Ranks[0].League != "great" || iv.Ranks[0].Rank != 1 || iv.Ranks[1].League != "master" {
+		t.Errorf("ranks = %+v, want great and master", iv.Ranks)
+	}
+	if got := hundo.WithRanks(3, nil); got.Percent != 100 || got.Ranks != nil {
+		t.Errorf("without leagues = %+v, want only the percentage", got)
+	}
+}
@@ -1,5 +1,7 @@
 package opm
 
+import "github.com/pogointel/opm/internal/geo"
+
 // MapObject types
 const (
 	POKEMON  = 1
@@ -7,6 +9,37 @@ const (
 	GYM      = 3
 )
 
+// Lure types
+const (
+	LureNormal   = "normal"
+	LureGlacial  = "glacial"
+	LureMossy    = "mossy"
+	LureMagnetic = "magnetic"
+)
+
+// lureItems maps lure module item ids to lure types
+var lureItems = map[int]string{
+	501: LureNormal,
+	502: LureGlacial,
+	503: LureMossy,
+	504: LureMagnetic,
+}
+
+// LureTypeFromItem returns the lure type for a fort modifier item id or "" if the item is not a lure module
+func LureTypeFromItem(item int) string {
+	return lureItems[item]
+}
+
+// LureItem returns the item id of the lure module of a lure type, 0 for unknown types
+func LureItem(lureType string) int {
+	for item, t := range lureItems {
+		if t == lureType {
+			return item
+		}
+	}
+	return 0
+}
+
 // RequestTimeout is the global timeout for http requests
 const RequestTimeout = 15
 
@@ -17,7 +50,108 @@ type Account struct {
 	Provider       string
 	Used           bool
 	Banned         bool
+	BannedAt       int64  `bson:",omitempty"` // unix timestamp, see db.MarkAccountBanned
+	BanReason      string `bson:",omitempty"` // see BanCredentials, empty for bans before reasons were recorded
 	CaptchaFlagged bool
+	CaptchaURL     string `bson:",omitempty"` // challenge to solve, empty if the game didn't send one
+	CaptchaAt      int64  `bson:",omitempty"` // unix timestamp, see db.FlagCaptcha
+	Pool           string
+	CooldownUntil  int64
+	// Pre-authenticated accounts have a token instead of a password
+	AuthToken    string
+	TokenExpired bool
+	// Intake of new accounts, see AccountStageQuarantine
+	Stage       string `bson:",omitempty"`
+	StageReason string `bson:",omitempty"`
+	CleanRuns   int    `bson:",omitempty"` // clean warm-up interactions
+	NextWarmup  int64  `bson:",omitempty"` // unix timestamp
+	// Trainer progress, see db.GetAccountMinLevel
+	Level        int   `bson:",omitempty"`
+	XP           int64 `bson:"xp,omitempty"`
+	TutorialDone bool  `bson:"tutorial_done,omitempty"`
+}
+
+// Account stages. Accounts without a stage are in the main pool.
+const (
+	// Imported accounts wait here until the warm-up of the scanner promotes them
+	AccountStageQuarantine = "quarantine"
+	// The warm-up found the credentials invalid or the account not activated
+	AccountStageInvalid = "invalid"
+	AccountStageActive  = "active"
+	AccountStageBanned  = "banned"
+)
+
+// Ban reasons of accounts
+const (
+	// The game rejected the username or password
+	BanCredentials = "credentials"
+	// Empty responses, the account usually recovers after a cooloff
+	BanTemporary = "temporary"
+	// The game reported the account as banned
+	BanPermanent = "permanent"
+	// The account was never activated
+	BanInactive = "inactive"
+	// Banned by an admin
+	BanManual = "manual"
+)
+
+// Batch account actions
+const (
+	AccountActionBan         = "ban"
+	AccountActionUnban       = "unban"
+	AccountActionSetPool     = "set-pool"
+	AccountActionSetCooldown = "set-cooldown"
+	AccountActionRemove      = "remove"
+)
+
+// AuditEntry records an admin action
+type AuditEntry struct {
+	Who       string
+	Action    string
+	Value     string
+	Usernames []string
+	Count     int
+	Time      int64
+}
+
+// QuarantineEntry is an object that was rejected during validation
+type QuarantineEntry struct {
+	ID     string
+	Reason string
+	Source string
+	Object MapObject
+	Time   int64
+}
+
+// Spawnpoint is a learned spawn location. DespawnSecond is the second of the hour
+// at which its Pokemon disappear, refined with every sighting.
+type Spawnpoint struct {
+	ID            string  `json:"id"`
+	Lat           float64 `json:"lat"`
+	Lng           float64 `json:"lng"`
+	DespawnSecond int     `json:"despawnSecond"`
+	Samples       int     `json:"samples"`
+	LastSeen      int64   `json:"lastSeen"`
+}
+
+// Suppression drops or downsamples Pokemon of the listed species until it expires.
+// KeepOneIn keeps every n-th matching Pokemon, 0 drops all of them.
+type Suppression struct {
+	ID         string `json:"id"`
+	PokemonIDs []int  `json:"pokemonIds"`
+	KeepOneIn  int    `json:"keepOneIn,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	CreatedBy  string `json:"createdBy,omitempty"`
+	Expires    int64  `json:"expires"`
+}
+
+// RawResponse is a captured GetMapObjectsResponse. Data is the gzipped protobuf message.
+type RawResponse struct {
+	ScanID string
+	Lat    float64
+	Lng    float64
+	Time   int64
+	Data   []byte
 }
 
 // Proxy represents a proxy that is connected to the hub
@@ -25,14 +159,119 @@ type Proxy struct {
 	ID   int64
 	Use  bool
 	Dead bool
+	// Address of the proxy. Empty for proxies that connect to the hub themselves.
+	URL      string `bson:",omitempty"`
+	Username string `bson:",omitempty"`
+	Password string `bson:",omitempty"`
+	// Last health check (unix time), only proxies with URL are checked
+	LastCheck int64 `bson:",omitempty"`
 }
 
 // APIResponse represents a response sent back to the requesting client
 // This response type is used for cache and scan requests.
 type APIResponse struct {
+	Ok    bool
+	Error string
+	// Machine readable class of the error, see the ErrCode constants
+	ErrorCode  string `json:",omitempty"`
+	MapObjects []MapObject
+	// Set to the queried unix timestamp for historical responses
+	HistoricalAt int64 `json:",omitempty"`
+	// Area refreshed by a scan, the bounds of the map cells the game returned
+	Footprint *BoundingBox `json:",omitempty"`
+	// Set for busy, paused and rate limited responses
+	RetryAfter *RetryHint `json:",omitempty"`
+}
+
+// RetryHint tells the client when to retry a busy, paused or rate limited request and why.
+// Seconds is also sent as the Retry-After header.
+type RetryHint struct {
+	Seconds int    `json:"seconds"`
+	Reason  string `json:"reason"`
+}
+
+// Reasons of RetryHint
+const (
+	RetryReasonBusy        = "busy"             // no better estimate
+	RetryReasonQueue       = "queue"            // time until the queued requests are through
+	RetryReasonCooldown    = "trainer_cooldown" // time until the next trainer is out of its ScanDelay
+	RetryReasonPaused      = "paused"           // end of the error budget pause
+	RetryReasonRateLimit   = "rate_limit"       // time until the rate limit allows the request
+	RetryReasonUnavailable = "unavailable"      // the database can't be reached
+)
+
+// Error codes of APIResponse. Clients can retry ErrCodeBusy, ErrCodeTimeout and
+// ErrCodeRateLimited later, and ErrCodeProxy and ErrCodeAccount right away.
+const (
+	ErrCodeBadRequest  = "ERR_BAD_REQUEST"
+	ErrCodeAuth        = "ERR_AUTH"
+	ErrCodeRateLimited = "ERR_RATE_LIMITED"
+	ErrCodeBusy        = "ERR_BUSY"
+	ErrCodeTimeout     = "ERR_TIMEOUT"
+	ErrCodeProxy       = "ERR_PROXY"
+	ErrCodeAccount     = "ERR_ACCOUNT"
+	ErrCodeScanFailed  = "ERR_SCAN_FAILED"
+	// The cursor can't be resumed, the client has to start over without a cursor
+	ErrCodeInvalidCursor = "ERR_INVALID_CURSOR"
+)
+
+// Point statuses of multi-point responses
+const (
+	PointOk      = "ok"
+	PointFailed  = "failed"
+	PointSkipped = "skipped"
+)
+
+// PointStatus is the result for a single point of a multi-point operation
+type PointStatus struct {
+	Lat     float64
+	Lng     float64
+	Status  string
+	Error   string `json:",omitempty"`
+	Objects int
+	// Objects found at this point, only set by batch scans
+	MapObjects []MapObject `json:",omitempty"`
+	// Map cells scanned at this point, only set by area scans
+	Cells int `json:",omitempty"`
+}
+
+// MultiPointResponse is sent back for operations that scan multiple points (batch, route, area).
+// Ok is only true if all points succeeded, Partial is true if some, but not all, points succeeded.
+type MultiPointResponse struct {
 	Ok         bool
+	Partial    bool
 	Error      string
+	Succeeded  int
+	Failed     int
+	Skipped    int
 	MapObjects []MapObject
+	Points     []PointStatus
+	RetryAfter *RetryHint `json:",omitempty"`
+}
+
+// Summarize updates the counts and flags from the point statuses
+func (r *MultiPointResponse) Summarize() {
+	r.Succeeded, r.Failed, r.Skipped = 0, 0, 0
+	for _, p := range r.Points {
+		switch p.Status {
+		case PointOk:
+			r.Succeeded++
+		case PointSkipped:
+			r.Skipped++
+		default:
+			r.Failed++
+		}
+	}
+	r.Ok = len(r.Points) > 0 && r.Succeeded == len(r.Points)
+	r.Partial = r.Succeeded > 0 && !r.Ok
+}
+
+// HTTPStatus returns the status code for the response: 200 if at least one point succeeded, 502 otherwise
+func (r *MultiPointResponse) HTTPStatus() int {
+	if r.Succeeded > 0 {
+		return 200
+	}
+	return 502
 }
 
 // MapObject represents an object on the map (Pokemon, Gym or Pokestop)
@@ -45,8 +284,61 @@ type MapObject struct {
 	Lng          float64 `json:"lng"`
 	Expiry       int64   `json:"expiry,omitempty"`
 	Lured        bool    `json:"lured,omitempty"`
+	LureType     string  `json:"lureType,omitempty"`
+	LuredBy      string  `json:"luredBy,omitempty"`
 	Team         int     `json:"team,omitempty"`
 	Source       string  `json:"source,omitempty"`
+	IVs          *IVs    `json:"ivs,omitempty"`
+	CP           int     `json:"cp,omitempty"`
+	Move1        int     `json:"move1,omitempty"`
+	Move2        int     `json:"move2,omitempty"`
+	// Gym details
+	GymPoints      int64 `json:"gymPoints,omitempty"`
+	GuardPokemonID int   `json:"guardPokemonID,omitempty"`
+	GuardPokemonCP int   `json:"guardPokemonCP,omitempty"`
+	// Set on deletion events of the stream
+	Deleted bool `json:"deleted,omitempty"`
+	// IANA timezone of forts, empty until it is resolved. LocalTime is only set on request.
+	Timezone  string `json:"timezone,omitempty"`
+	LocalTime string `json:"localTime,omitempty"`
+	// Unix time the object was first stored, 0 if unknown. Only used for the visibility delay.
+	SeenAt int64 `json:"-"`
+	// Unix time in milliseconds the scan response with the object was received, 0 if unknown.
+	// A stored fort is only replaced by a newer observation.
+	CapturedAt int64 `json:"-"`
+}
+
+// NearbyPokemon is a Pokemon the game reported near a scan, without coordinates. Newer
+// responses name the fort it is at, older ones the distance from the scan location.
+type NearbyPokemon struct {
+	EncounterID string  `json:"encounterID"`
+	PokemonID   int     `json:"pokemonID"`
+	FortID      string  `json:"fortID,omitempty"`
+	Distance    float64 `json:"distance,omitempty"` // meters
+	Lat         float64 `json:"lat"`                // scan location
+	Lng         float64 `json:"lng"`
+	SeenAt      int64   `json:"seenAt"`
+}
+
+// CoverageCell is a geohash cell of the coverage map with the number of scans in it.
+// Lat and Lng are the center of the cell.
+type CoverageCell struct {
+	Geohash  string  `json:"geohash"`
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Scans    int     `json:"scans"`
+	LastScan int64   `json:"lastScan"`
+}
+
+// Sighting represents a past or active sighting of a Pokemon
+type Sighting struct {
+	ID        string  `json:"id"`
+	PokemonID int     `json:"pokemonID"`
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	SeenAt    int64   `json:"seenAt"`
+	Expiry    int64   `json:"expiry"`
+	Active    bool    `json:"active"`
 }
 
 // Pokemon represents a Pokemon MapObject
@@ -60,10 +352,11 @@ type Pokemon struct {
 
 // Pokestop represents a Pokestop MapObject
 type Pokestop struct {
-	ID    string
-	Lat   float64
-	Lng   float64
-	Lured bool
+	ID       string
+	Lat      float64
+	Lng      float64
+	Lured    bool
+	LureType string
 }
 
 // Gym represents a Gym MapObject
@@ -74,11 +367,37 @@ type Gym struct {
 	Team int
 }
 
+// BoundingBox is a rectangular area on the map
+type BoundingBox struct {
+	North float64
+	South float64
+	East  float64
+	West  float64
+}
+
+// IsSet returns true if the bounding box is not empty
+func (b BoundingBox) IsSet() bool {
+	return geo.Box(b).IsSet()
+}
+
+// Contains returns true if the coordinates are inside the bounding box
+func (b BoundingBox) Contains(lat, lng float64) bool {
+	return geo.Box(b).Contains(geo.LatLng{Lat: lat, Lng: lng})
+}
+
 // StatusEntry represents a key-value pair for account names and proxy IDs
-// This is used by the scanner to report accounts/proxies in use
+// This is used by the scanner to report accounts/proxies in use, together with
+// the activity of the trainer
 type StatusEntry struct {
-	AccountName string
-	ProxyId     int64
+	AccountName       string
+	ProxyId           int64
+	State             string // idle, scanning or banned
+	Scans             int
+	Failures          int
+	ConsecutiveErrors int
+	LastScan          int64
+	LastLat           float64
+	LastLng           float64
 }
 
 // APIKey is used for for managing ingress/egress via API
@@ -89,4 +408,9 @@ type APIKey struct {
 	URL        string
 	Verified   bool
 	Enabled    bool
+	// Rate limit for scans with this key, 0 uses the default from the settings
+	RequestsPerMinute int
+	Burst             int
+	// Trusted partners see delayed Pokemon on /cache immediately, see the visibility policy of the apiserver
+	Trusted bool
 }
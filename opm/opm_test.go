@@ -0,0 +1,35 @@
+package opm
+
+import "testing"
+
+func TestMultiPointContract(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		ok       bool
+		partial  bool
+		counts   [3]int
+		status   int
+	}{
+		{"all succeeded", []string{PointOk, PointOk}, true, false, [3]int{2, 0, 0}, 200},
+		{"partial", []string{PointOk, PointFailed, PointSkipped}, false, true, [3]int{1, 1, 1}, 200},
+		{"nothing succeeded", []string{PointFailed, PointSkipped}, false, false, [3]int{0, 1, 1}, 502},
+		{"no points", nil, false, false, [3]int{0, 0, 0}, 502},
+	}
+	for _, test := range tests {
+		r := MultiPointResponse{Succeeded: 9}
+		for _, s := range test.statuses {
+			r.Points = append(r.Points, PointStatus{Status: s})
+		}
+		r.Summarize()
+		if r.Ok != test.ok || r.Partial != test.partial {
+			t.Errorf("%s: ok %v partial %v, want %v %v", test.name, r.Ok, r.Partial, test.ok, test.partial)
+		}
+		if got := [3]int{r.Succeeded, r.Failed, r.Skipped}; got != test.counts {
+			t.Errorf("%s: succeeded/failed/skipped %v, want %v", test.name, got, test.counts)
+		}
+		if got := r.HTTPStatus(); got != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, got, test.status)
+		}
+	}
+}
@@ -8,9 +8,15 @@ import (
 // DefaultSettings are the default value for Settings
 var DefaultSettings = Settings{
 	AllowOrigin:          "*",
+	KeyRequestsPerMinute: 60,
+	KeyBurst:             10,
 	CacheRadius:          1000,
+	SnapDistance:         10,
+	TombstoneHours:       24,
+	MaxClockSkew:         5,
 	DbHost:               "localhost",
 	DbName:               "OPM",
+	DbBackend:            BackendMongo,
 	APIListenAddress:     "localhost",
 	APIListenPort:        80,
 	ProxyListenAddress:   "localhost",
@@ -28,13 +34,59 @@ type Settings struct {
 	// Security
 	Secret      string
 	AllowOrigin string
+	// Client IPs in the request logs: "" logs them as is, "truncate" drops the host part and
+	// "hash" logs a hash keyed with Secret
+	LogIPs string
+	// Account usernames are logged as a hash keyed with Secret, unless this is set
+	LogUsernames bool
+	// Format of the logs: "" or "text" for plain lines, "json" for a JSON object per line
+	LogFormat string
+	// API keys
+	RequireAPIKey        bool // Scans need an enabled API key
+	CacheKeyExempt       bool // The cache endpoint works without API key
+	KeyRequestsPerMinute int  // Default rate limit per key
+	KeyBurst             int  // Default burst per key
 	// General
 	CacheRadius int
+	// Region that is scanned. Used to detect swapped coordinates.
+	Region                BoundingBox
+	FixSwappedCoordinates bool
+	// Hide Pokemon that were missing in this many rescans of their area (0 = disabled)
+	SuppressAfterMisses int
+	// Deleted objects are kept as tombstones for this many hours, so stream consumers learn about them
+	TombstoneHours int
+	// PvP leagues whose ranks are stored with the IVs of Pokemon, e.g.
+	// [{"Name": "great", "MaxCP": 1500}, {"Name": "master"}]
+	Leagues []League
+	// Snap Pokemon to their spawnpoint when they are closer than this (meters, 0 = disabled)
+	SnapDistance float64
+	// Warn when the local clock differs from the database server by more seconds than this
+	MaxClockSkew int
+	// Timezone lookup service for forts, e.g. "http://localhost:8300/tz?lat={lat}&lng={lng}".
+	// Empty = no timezones (MongoDB only).
+	TimezoneURL string
+	// Mount /debug/faults for setting failure injection rules. Only has an effect in builds
+	// with the faults tag. Never turn this on in production.
+	UnsafeFaultInjection bool
+	// Imported accounts start in quarantine and are promoted by the warm-up of the scanner (MongoDB only)
+	AccountIntake bool
 	// DB
+	// Backend for map objects, accounts and proxies ("mongo" or "postgres"). The other
+	// collections are always stored in MongoDB.
+	DbBackend string
+	// Connection string for the postgres backend, e.g. "postgres://opm@localhost/opm?sslmode=disable"
+	DbDSN      string
 	DbHost     string
 	DbName     string
 	DbUser     string
 	DbPassword string
+	// Maximum number of sockets per database server, 0 keeps the driver default
+	DbPoolLimit int
+	// Optional read endpoint for map objects, stats and exports, e.g. nearby secondaries
+	DbReadHost string
+	DbReadTags map[string]string
+	// Run pending schema migrations of the stored documents on startup (MongoDB only)
+	MigrateOnStartup bool
 	// Listen addresses
 	APIListenAddress     string
 	APIListenPort        int
@@ -50,6 +102,12 @@ type Settings struct {
 
 // LoadSettings parses the content of the provided settings file as json
 func LoadSettings(settingsFile string) (Settings, error) {
+	settings, _, err := LoadSettingsWithKeys(settingsFile)
+	return settings, err
+}
+
+// LoadSettingsWithKeys is LoadSettings, but also returns the keys set in the file (see FileKeys)
+func LoadSettingsWithKeys(settingsFile string) (Settings, map[string]bool, error) {
 	settings := DefaultSettings
 	// Use default file, if no file is specified
 	if settingsFile == "" {
@@ -58,10 +116,10 @@ func LoadSettings(settingsFile string) (Settings, error) {
 	// Read file
 	bytes, err := ioutil.ReadFile(settingsFile)
 	if err != nil {
-		return settings, err
+		return settings, nil, err
 	}
 	// Parse json
 	err = json.Unmarshal(bytes, &settings)
 	// Return result
-	return settings, err
+	return settings, FileKeys(bytes), err
 }
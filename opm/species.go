@@ -0,0 +1,182 @@
+package opm
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rarity tiers of the species table
+const (
+	RarityCommon    = "common"
+	RarityUncommon  = "uncommon"
+	RarityRare      = "rare"
+	RarityLegendary = "legendary"
+	RarityMythical  = "mythical"
+)
+
+// Rarities lists the rarity tiers from most to least common
+var Rarities = []string{RarityCommon, RarityUncommon, RarityRare, RarityLegendary, RarityMythical}
+
+// Species is the metadata of a Pokemon species. The base stats are those of the game,
+// the rarity tier is a default that operators can override at runtime.
+type Species struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	BaseAttack  int    `json:"baseAttack"`
+	BaseDefense int    `json:"baseDefense"`
+	BaseStamina int    `json:"baseStamina"`
+	Rarity      string `json:"rarity"`
+	Generation  int    `json:"generation"`
+}
+
+//go:embed species.json
+var speciesData []byte
+
+// species is the embedded table, indexed by Pokemon id - 1
+var species = loadSpecies(speciesData)
+
+// rarityOverrides replace the rarity of the table, see SetRarityOverrides
+var rarityOverrides = struct {
+	sync.RWMutex
+	m map[int]string
+}{m: make(map[int]string)}
+
+// loadSpecies parses the table and makes sure the ids are 1..n without gaps
+func loadSpecies(data []byte) []Species {
+	var table []Species
+	if err := json.Unmarshal(data, &table); err != nil {
+		panic("opm: invalid species table: " + err.Error())
+	}
+	for i, s := range table {
+		if s.ID != i+1 || s.Name == "" || !ValidRarity(s.Rarity) {
+			panic(fmt.Sprintf("opm: invalid species table entry %d", i))
+		}
+	}
+	return table
+}
+
+// ValidRarity reports whether r is a rarity tier
+func ValidRarity(r string) bool {
+	for _, t := range Rarities {
+		if r == t {
+			return true
+		}
+	}
+	return false
+}
+
+// SpeciesCount returns the number of known species. Ids are 1..SpeciesCount().
+func SpeciesCount() int {
+	return len(species)
+}
+
+// ValidPokemonID reports whether id is a known species
+func ValidPokemonID(id int) bool {
+	return id >= 1 && id <= len(species)
+}
+
+// ValidatePokemonIDs returns an error for the first unknown species in ids.
+// Filters that reference species check their ids with it.
+func ValidatePokemonIDs(ids []int) error {
+	for _, id := range ids {
+		if !ValidPokemonID(id) {
+			return fmt.Errorf("Unknown species %d", id)
+		}
+	}
+	return nil
+}
+
+// LookupSpecies returns the metadata of a species with the effective rarity
+func LookupSpecies(id int) (Species, bool) {
+	if !ValidPokemonID(id) {
+		return Species{}, false
+	}
+	s := species[id-1]
+	rarityOverrides.RLock()
+	defer rarityOverrides.RUnlock()
+	if r, ok := rarityOverrides.m[id]; ok {
+		s.Rarity = r
+	}
+	return s, true
+}
+
+// AllSpecies returns the metadata of all species with the effective rarity, ordered by id
+func AllSpecies() []Species {
+	all := make([]Species, len(species))
+	for i := range species {
+		all[i], _ = LookupSpecies(i + 1)
+	}
+	return all
+}
+
+// SpeciesWithRarity returns the ids of the species with the given effective rarity
+func SpeciesWithRarity(rarity string) []int {
+	var ids []int
+	for _, s := range AllSpecies() {
+		if s.Rarity == rarity {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
+
+// SetRarityOverrides replaces all rarity overrides (species id -> rarity)
+func SetRarityOverrides(overrides map[int]string) error {
+	m := make(map[int]string, len(overrides))
+	for id, r := range overrides {
+		if !ValidPokemonID(id) {
+			return fmt.Errorf("Unknown species %d", id)
+		}
+		if !ValidRarity(r) {
+			return fmt.Errorf("Unknown rarity %q", r)
+		}
+		if r != species[id-1].Rarity {
+			m[id] = r
+		}
+	}
+	rarityOverrides.Lock()
+	defer rarityOverrides.Unlock()
+	rarityOverrides.m = m
+	return nil
+}
+
+// RarityOverrides returns the current rarity overrides
+func RarityOverrides() map[int]string {
+	rarityOverrides.RLock()
+	defer rarityOverrides.RUnlock()
+	m := make(map[int]string, len(rarityOverrides.m))
+	for id, r := range rarityOverrides.m {
+		m[id] = r
+	}
+	return m
+}
+
+// PokemonName returns the name for a Pokemon id or "" if the id is unknown
+func PokemonName(id int) string {
+	if !ValidPokemonID(id) {
+		return ""
+	}
+	return species[id-1].Name
+}
+
+// ResolvePokemonID resolves a Pokemon id or name (case insensitive) to the Pokemon id.
+// It returns 0 if the species is unknown.
+func ResolvePokemonID(s string) int {
+	s = strings.TrimSpace(s)
+	if id, err := strconv.Atoi(s); err == nil {
+		if !ValidPokemonID(id) {
+			return 0
+		}
+		return id
+	}
+	for _, sp := range species {
+		if strings.EqualFold(sp.Name, s) {
+			return sp.ID
+		}
+	}
+	return 0
+}
@@ -51,7 +51,7 @@ func main() {
 		log.Printf("Error loading settings (%s). Using default settings.\n", err)
 	}
 	// Login DB
-	database, err = db.NewOpenMapDb("OpenPogoMap", MongoAddr, opmSettings.DbUser, opmSettings.DbPassword)
+	database, err = db.NewOpenMapDb(opmSettings.DbName, MongoAddr, opmSettings.DbUser, opmSettings.DbPassword)
 	if err != nil {
 		log.Fatal(err)
 	}
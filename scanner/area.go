@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// areaGroupLevel is the S2 level of the cell groups of an area scan. A level 14 cell holds
+// four map cells, which a scan at its center returns together.
+const areaGroupLevel = 14
+
+// cellGroup is a part of an area that is scanned with a single map request
+type cellGroup struct {
+	Center geo.LatLng
+	Cells  []uint64
+}
+
+// splitArea splits the circle around center into groups of map cells, in the order of the covering
+func splitArea(center geo.LatLng, radius float64) []cellGroup {
+	var groups []cellGroup
+	index := make(map[uint64]int)
+	for _, id := range geo.S2Covering(center, radius, geo.S2Level) {
+		parent := geo.S2Parent(id, areaGroupLevel)
+		i, ok := index[parent]
+		if !ok {
+			i = len(groups)
+			index[parent] = i
+			groups = append(groups, cellGroup{Center: geo.S2CellCenter(parent)})
+		}
+		groups[i].Cells = append(groups[i].Cells, id)
+	}
+	return groups
+}
+
+// mergeGroups returns the objects of all groups without duplicates. Neighbouring groups
+// overlap, so objects near their borders are returned by both.
+func mergeGroups(points []opm.PointStatus) []opm.MapObject {
+	merged := make([]opm.MapObject, 0)
+	seen := make(map[string]bool)
+	for _, p := range points {
+		for _, o := range p.MapObjects {
+			if !seen[o.ID] {
+				seen[o.ID] = true
+				merged = append(merged, o)
+			}
+		}
+	}
+	return merged
+}
+
+// scanGroups scans the groups concurrently, at most parallel at a time and each with a trainer
+// of its own. scanGroup is called for every group and its results are returned in group order.
+func scanGroups(groups []cellGroup, parallel int, scanGroup func(cellGroup) opm.PointStatus) []opm.PointStatus {
+	results := make([]opm.PointStatus, len(groups))
+	if parallel > len(groups) {
+		parallel = len(groups)
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < parallel; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = scanGroup(groups[i])
+				results[i].Cells = len(groups[i].Cells)
+			}
+		}()
+	}
+	for i := range groups {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// areaHandler scans the circle of radius meters around lat/lng. The area is split into groups
+// of map cells that are scanned concurrently by different trainers and the results are merged.
+// Groups that get no trainer fail, so busy pools return partial results.
+func areaHandler(w http.ResponseWriter, r *http.Request) {
+	var response opm.MultiPointResponse
+	if r.Method != "POST" {
+		writeMultiPointResponse(w, r, response, opm.ErrWrongMethod.Error())
+		return
+	}
+	lat, lng, err := util.ParseLatLng(r)
+	if err != nil {
+		writeMultiPointResponse(w, r, response, "Wrong format")
+		return
+	}
+	radius, err := strconv.Atoi(r.FormValue("radius"))
+	if err != nil || radius <= 0 || radius > scannerSettings.MaxAreaRadius {
+		writeMultiPointResponse(w, r, response, "Wrong format")
+		return
+	}
+	if budget.Paused() {
+		writeMultiPointResponse(w, r, response, opm.ErrPaused.Error())
+		return
+	}
+	groups := splitArea(geo.LatLng{Lat: lat, Lng: lng}, float64(radius))
+	log.Printf("Scanning area around %f, %f with %d groups", lat, lng, len(groups))
+	deadline := time.Now().Add(time.Duration(scannerSettings.MaxRouteDuration) * time.Second)
+	extendWriteDeadline(w, deadline)
+	response.Points = scanGroups(groups, scannerSettings.AreaParallelism, func(g cellGroup) opm.PointStatus {
+		return scanBatchPoint(r, g.Center, deadline)
+	})
+	response.MapObjects = mergeGroups(response.Points)
+	for i := range response.Points {
+		response.Points[i].MapObjects = nil
+	}
+	writeMultiPointResponse(w, r, response, "")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+func TestSplitArea(t *testing.T) {
+	center := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	cells := geo.S2Covering(center, 1000, geo.S2Level)
+	groups := splitArea(center, 1000)
+	if len(groups) == 0 || len(groups) >= len(cells) {
+		t.Fatalf("%d groups of %d cells, want fewer groups than cells", len(groups), len(cells))
+	}
+	// Every cell of the covering is in exactly one group of at most four cells around its center
+	grouped := make(map[uint64]int)
+	for _, g := range groups {
+		if len(g.Cells) == 0 || len(g.Cells) > 4 {
+			t.Errorf("group at %v has %d cells", g.Center, len(g.Cells))
+		}
+		for _, id := range g.Cells {
+			grouped[id]++
+			if parent := geo.S2Parent(id, areaGroupLevel); geo.S2CellCenter(parent) != g.Center {
+				t.Errorf("cell %d in the group at %v, want it in the group of its parent", id, g.Center)
+			}
+		}
+	}
+	for _, id := range cells {
+		if grouped[id] != 1 {
+			t.Errorf("cell %d is in %d groups", id, grouped[id])
+		}
+	}
+	if len(grouped) != len(cells) {
+		t.Errorf("%d cells grouped, want the %d of the covering", len(grouped), len(cells))
+	}
+}
+
+func TestMergeGroups(t *testing.T) {
+	object := func(id string) opm.MapObject { return opm.MapObject{Type: opm.POKEMON, ID: id} }
+	merged := mergeGroups([]opm.PointStatus{
+		{Status: opm.PointOk, MapObjects: []opm.MapObject{object("a"), object("border")}},
+		{Status: opm.PointFailed},
+		{Status: opm.PointOk, MapObjects: []opm.MapObject{object("border"), object("b")}},
+	})
+	var ids []string
+	for _, o := range merged {
+		ids = append(ids, o.ID)
+	}
+	if fmt.Sprint(ids) != "[a border b]" {
+		t.Errorf("merged %v, want each object once in group order", ids)
+	}
+	if merged := mergeGroups(nil); merged == nil || len(merged) != 0 {
+		t.Errorf("merged %v without groups, want an empty list", merged)
+	}
+}
+
+func TestScanGroupsParallelism(t *testing.T) {
+	groups := make([]cellGroup, 10)
+	for i := range groups {
+		groups[i] = cellGroup{Center: geo.LatLng{Lat: float64(i)}, Cells: make([]uint64, i%4+1)}
+	}
+	for _, parallel := range []int{0, 1, 3, 20} {
+		var running, most int32
+		results := scanGroups(groups, parallel, func(g cellGroup) opm.PointStatus {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return opm.PointStatus{Lat: g.Center.Lat, Status: opm.PointOk}
+		})
+		want := int32(parallel)
+		if want < 1 {
+			want = 1
+		}
+		if want > int32(len(groups)) {
+			want = int32(len(groups))
+		}
+		if most > want {
+			t.Errorf("parallelism %d: %d groups scanned at once, want at most %d", parallel, most, want)
+		}
+		for i, r := range results {
+			if r.Lat != float64(i) || r.Cells != len(groups[i].Cells) {
+				t.Errorf("parallelism %d: result %d = %+v, want the one of group %d", parallel, i, r, i)
+			}
+		}
+	}
+}
+
+func TestAreaScanPartial(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.MaxAreaRadius, s.AreaParallelism, s.MaxRouteDuration, s.ScanDelay, s.MaxJumpSpeed = 1500, 2, 60, 0, 0
+	})
+	center := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	groups := splitArea(center, 400)
+	failing := 0
+	for _, g := range groups {
+		if g.Center.Lat > center.Lat {
+			failing++
+		}
+	}
+	if failing == 0 || failing == len(groups) {
+		t.Fatalf("%d of %d groups north of the center, want some on both sides", failing, len(groups))
+	}
+	withTrainers(t, budgetTrainer("trainer1", 0, 0), budgetTrainer("trainer2", 0, 0))
+	// Groups north of the center fail, every group finds the object at the center
+	getMapResult = func(trainer *util.TrainerSession, lat, lng float64) ([]opm.MapObject, error) {
+		if lat > center.Lat {
+			return nil, errors.New("unexpected EOF")
+		}
+		return []opm.MapObject{
+			{Type: opm.POKEMON, ID: "center", PokemonID: 16, Lat: center.Lat, Lng: center.Lng},
+			{Type: opm.POKEMON, ID: fmt.Sprintf("%f,%f", lat, lng), PokemonID: 19, Lat: lat, Lng: lng},
+		}, nil
+	}
+	values := url.Values{"lat": {"52.5"}, "lng": {"13.4"}, "radius": {"400"}}
+	r := httptest.NewRequest("POST", "/areascan", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	areaHandler(w, r)
+	var response opm.MultiPointResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("X-Partial-Result") != "true" || response.Ok || !response.Partial {
+		t.Fatalf("%d %s, want a partial result", w.Code, w.Body)
+	}
+	if response.Failed != failing || response.Succeeded != len(groups)-failing || len(response.Points) != len(groups) {
+		t.Errorf("response = %+v, want %d of %d groups failed", response, failing, len(groups))
+	}
+	for i, p := range response.Points {
+		if failed := groups[i].Center.Lat > center.Lat; failed != (p.Status == opm.PointFailed) || p.Cells != len(groups[i].Cells) || p.MapObjects != nil {
+			t.Errorf("group %d = %+v, want its status and cells without objects", i, p)
+		}
+	}
+	// The object every group found once, and one for every successful group
+	if len(response.MapObjects) != 1+len(groups)-failing || response.MapObjects[0].ID != "center" {
+		t.Errorf("merged %v, want the shared object once and one per successful group", response.MapObjects)
+	}
+}
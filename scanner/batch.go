@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// batchLine is a line of a streamed batch response
+type batchLine struct {
+	Index int
+	opm.PointStatus
+}
+
+// batchHandler scans a list of points concurrently, each point with its own trainer.
+// With stream=1 the results are sent as newline-delimited JSON as soon as a point is done,
+// followed by a summary line.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	var response opm.MultiPointResponse
+	if r.Method != "POST" {
+		writeMultiPointResponse(w, r, response, opm.ErrWrongMethod.Error())
+		return
+	}
+	var points []geo.LatLng
+	err := json.NewDecoder(r.Body).Decode(&points)
+	if err != nil || len(points) == 0 || len(points) > scannerSettings.MaxBatchPoints {
+		writeMultiPointResponse(w, r, response, "Wrong format")
+		return
+	}
+	if budget.Paused() {
+		writeMultiPointResponse(w, r, response, opm.ErrPaused.Error())
+		return
+	}
+	log.Printf("Scanning batch with %d points", len(points))
+	streamed := r.FormValue("stream") == "1"
+	flusher, _ := w.(http.Flusher)
+	if streamed {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	// Worker pool
+	deadline := time.Now().Add(time.Duration(scannerSettings.MaxRouteDuration) * time.Second)
+	extendWriteDeadline(w, deadline)
+	response.Points = make([]opm.PointStatus, len(points))
+	jobs := make(chan int)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	workers := scannerSettings.MaxBatchWorkers
+	if workers > len(points) {
+		workers = len(points)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result := scanBatchPoint(r, points[i], deadline)
+				mutex.Lock()
+				response.Points[i] = result
+				if streamed {
+					err := json.NewEncoder(w).Encode(batchLine{Index: i, PointStatus: result})
+					if err != nil {
+						log.Println(err)
+					}
+					if flusher != nil {
+						flusher.Flush()
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range points {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	if streamed {
+		// Summary without the points that were already sent
+		response.Summarize()
+		response.Points = nil
+		if !response.Ok {
+			response.Error = "Scan failed"
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	writeMultiPointResponse(w, r, response, "")
+}
+
+// scanBatchPoint scans a single point of a batch with a trainer of its own. Points with
+// invalid coordinates fail without a scan.
+func scanBatchPoint(r *http.Request, p geo.LatLng, deadline time.Time) opm.PointStatus {
+	result := opm.PointStatus{Lat: p.Lat, Lng: p.Lng, Status: opm.PointSkipped}
+	if !util.ValidLatLng(p.Lat, p.Lng) {
+		result.Status = opm.PointFailed
+		result.Error = opm.ErrInvalidCoordinates.Error()
+		return result
+	}
+	if time.Now().After(deadline) || budget.Paused() {
+		return result
+	}
+	wait, cancel := context.WithDeadline(detached(r), deadline)
+	trainer, err := getTrainerFor(wait, 1, 0)
+	cancel()
+	if err != nil {
+		result.Status = opm.PointFailed
+		result.Error = publicError(err.Error())
+		return result
+	}
+	defer trainerQueue.Queue(trainer, time.Duration(scannerSettings.ScanDelay)*time.Second)
+	scannerMetrics.ScansPerMinute.Incr(1)
+	ctx, cancel := scanContext(r, deadline)
+	defer cancel()
+	trainer.Context = ctx
+	mapObjects, err := scan(trainer, p.Lat, p.Lng)
+	if err != nil {
+		result.Status = opm.PointFailed
+		result.Error = publicError(err.Error())
+		return result
+	}
+	persist(ctx, mapObjects)
+	result.Status = opm.PointOk
+	result.Objects = len(mapObjects)
+	result.MapObjects = mapObjects
+	return result
+}
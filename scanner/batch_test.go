@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func batchRequest(t *testing.T, body string) opm.MultiPointResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	batchHandler(w, httptest.NewRequest("POST", "/qb", strings.NewReader(body)))
+	var response opm.MultiPointResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	return response
+}
+
+func TestBatchWithoutWorkers(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.MaxBatchPoints, s.MaxBatchWorkers, s.MaxRouteDuration, s.ScanDelay = 32, 0, 60, 0
+	})
+	withTrainers(t, budgetTrainer("trainer", 0, 0))
+	response := batchRequest(t, `[{"Lat":52.5,"Lng":13.4},{"Lat":52.6,"Lng":13.4}]`)
+	if !response.Ok || response.Succeeded != 2 {
+		t.Errorf("response = %+v, want both points scanned by one worker", response)
+	}
+}
+
+func TestBatchInvalidCoordinates(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.MaxBatchPoints, s.MaxBatchWorkers, s.MaxRouteDuration, s.ScanDelay = 32, 4, 60, 0
+	})
+	u, _ := withTrainers(t, budgetTrainer("trainer", 0, 0))
+	response := batchRequest(t, `[{"Lat":52.5,"Lng":13.4},{"Lat":91,"Lng":13.4},{"Lat":52.5,"Lng":-181}]`)
+	if !response.Partial || response.Succeeded != 1 || response.Failed != 2 {
+		t.Fatalf("response = %+v, want the valid point scanned", response)
+	}
+	for _, i := range []int{1, 2} {
+		if p := response.Points[i]; p.Status != opm.PointFailed || p.Error != opm.ErrInvalidCoordinates.Error() {
+			t.Errorf("point %d = %+v, want invalid coordinates", i, p)
+		}
+	}
+	if len(u.scans) != 1 {
+		t.Errorf("%d scans, want only the valid point scanned", len(u.scans))
+	}
+}
+
+func TestBatchScansEndAtDeadline(t *testing.T) {
+	// The batch deadline is before the request timeout
+	withSettings(t, func(s *settings) {
+		s.MaxBatchPoints, s.MaxBatchWorkers, s.MaxRouteDuration, s.ScanDelay = 32, 2, 2, 0
+	})
+	u, _ := withTrainers(t, budgetTrainer("trainer1", 0, 0), budgetTrainer("trainer2", 0, 0))
+	start := time.Now()
+	response := batchRequest(t, `[{"Lat":52.5,"Lng":13.4},{"Lat":52.6,"Lng":13.4}]`)
+	if !response.Ok {
+		t.Fatalf("response = %+v", response)
+	}
+	for i, d := range u.deadlines {
+		if d.IsZero() || d.After(start.Add(2*time.Second+100*time.Millisecond)) {
+			t.Errorf("scan %d ends at %s, want the batch deadline %s", i, d, start.Add(2*time.Second))
+		}
+	}
+}
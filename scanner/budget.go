@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errorBudget keeps track of bans and upstream failures and pauses all scanning
+// when one of the configured thresholds is exceeded.
+type errorBudget struct {
+	sync.Mutex
+	maxBansPerHour int
+	maxFailureRate float64 // percent
+	minSamples     int
+	window         time.Duration
+	cooldown       time.Duration
+	alertURL       string
+
+	bans    []time.Time
+	scans   []scanSample
+	paused  bool
+	reason  string
+	since   time.Time
+	until   time.Time
+	pauses  int
+	nowFunc func() time.Time
+}
+
+type scanSample struct {
+	t  time.Time
+	ok bool
+}
+
+// budgetState is the exported snapshot of the error budget
+type budgetState struct {
+	Paused       bool    `json:"paused"`
+	Reason       string  `json:"reason,omitempty"`
+	Since        int64   `json:"since,omitempty"`
+	Until        int64   `json:"until,omitempty"`
+	BansLastHour int     `json:"bans_last_hour"`
+	FailureRate  float64 `json:"failure_rate"`
+	Pauses       int     `json:"pauses"`
+}
+
+func newErrorBudget(s settings) *errorBudget {
+	return &errorBudget{
+		maxBansPerHour: s.MaxBansPerHour,
+		maxFailureRate: s.MaxFailureRate,
+		minSamples:     s.MinFailureSamples,
+		window:         time.Duration(s.FailureWindow) * time.Second,
+		cooldown:       time.Duration(s.PauseCooldown) * time.Second,
+		alertURL:       s.AlertURL,
+		nowFunc:        time.Now,
+	}
+}
+
+// RecordBan registers a banned account
+func (b *errorBudget) RecordBan() {
+	b.Lock()
+	defer b.Unlock()
+	b.bans = append(b.bans, b.nowFunc())
+	b.evaluate()
+}
+
+// RecordScan registers the outcome of an upstream call
+func (b *errorBudget) RecordScan(ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.scans = append(b.scans, scanSample{t: b.nowFunc(), ok: ok})
+	b.evaluate()
+}
+
+// Paused reports whether scanning is currently paused. An expired pause is lifted here.
+func (b *errorBudget) Paused() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.paused && !b.nowFunc().Before(b.until) {
+		b.resume("cooldown expired")
+	}
+	return b.paused
+}
+
+// Resume lifts the pause immediately (admin action)
+func (b *errorBudget) Resume() {
+	b.Lock()
+	defer b.Unlock()
+	if b.paused {
+		b.resume("admin action")
+	}
+}
+
+// State returns a snapshot of the current budget state
+func (b *errorBudget) State() budgetState {
+	b.Lock()
+	defer b.Unlock()
+	b.prune()
+	s := budgetState{
+		Paused:       b.paused,
+		Reason:       b.reason,
+		BansLastHour: len(b.bans),
+		FailureRate:  b.failureRate(),
+		Pauses:       b.pauses,
+	}
+	if b.paused {
+		s.Since = b.since.Unix()
+		s.Until = b.until.Unix()
+	}
+	return s
+}
+
+// evaluate checks the thresholds and trips the pause. Must be called with the lock held.
+func (b *errorBudget) evaluate() {
+	b.prune()
+	if b.paused {
+		return
+	}
+	if b.maxBansPerHour > 0 && len(b.bans) > b.maxBansPerHour {
+		b.pause("ban rate exceeded")
+		return
+	}
+	if b.maxFailureRate > 0 && len(b.scans) >= b.minSamples && b.failureRate() > b.maxFailureRate {
+		b.pause("upstream failure rate exceeded")
+	}
+}
+
+// prune drops samples that are outside of their windows
+func (b *errorBudget) prune() {
+	now := b.nowFunc()
+	i := 0
+	for i < len(b.bans) && now.Sub(b.bans[i]) > time.Hour {
+		i++
+	}
+	b.bans = b.bans[i:]
+	i = 0
+	for i < len(b.scans) && now.Sub(b.scans[i].t) > b.window {
+		i++
+	}
+	b.scans = b.scans[i:]
+}
+
+func (b *errorBudget) failureRate() float64 {
+	if len(b.scans) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, s := range b.scans {
+		if !s.ok {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(b.scans)) * 100
+}
+
+func (b *errorBudget) pause(reason string) {
+	now := b.nowFunc()
+	b.paused = true
+	b.reason = reason
+	b.since = now
+	b.until = now.Add(b.cooldown)
+	b.pauses++
+	log.Printf("Scanning paused until %s: %s", b.until.Format(time.RFC3339), reason)
+	go sendAlert(b.alertURL, "Scanning paused: "+reason)
+}
+
+func (b *errorBudget) resume(reason string) {
+	log.Printf("Scanning resumed (%s), was paused since %s: %s", reason, b.since.Format(time.RFC3339), b.reason)
+	b.paused = false
+	b.reason = ""
+	// Start over with a fresh budget
+	b.bans = nil
+	b.scans = nil
+}
+
+// sendAlert posts an operator alert to the configured URL
+func sendAlert(url, message string) {
+	log.Printf("ALERT: %s", message)
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"content": message})
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// ApproxBytes returns the approximate memory used by the samples
+func (b *errorBudget) ApproxBytes() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return int64(len(b.bans)*24 + len(b.scans)*32)
+}
+
+// Shrink drops the samples outside of their windows and compacts the rest. The samples
+// within the windows are kept, the pause decision needs all of them.
+func (b *errorBudget) Shrink() {
+	b.Lock()
+	defer b.Unlock()
+	b.prune()
+	b.bans = append([]time.Time(nil), b.bans...)
+	b.scans = append([]scanSample(nil), b.scans...)
+}
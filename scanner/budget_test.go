@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// fakeClock is a settable clock for the time dependent parts of the scanner
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.t = c.t.Add(d)
+	c.Unlock()
+}
+
+// eventually fails the test if cond doesn't become true within a second
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// withBudget replaces the error budget of the scanner for a test
+func withBudget(t *testing.T, s settings) (*errorBudget, *fakeClock) {
+	clock := newFakeClock()
+	b := newErrorBudget(s)
+	b.nowFunc = clock.Now
+	old := budget
+	budget = b
+	t.Cleanup(func() { budget = old })
+	return b, clock
+}
+
+func TestBanSpikePausesScanning(t *testing.T) {
+	b, clock := withBudget(t, settings{MaxBansPerHour: 3, MinFailureSamples: 20, FailureWindow: 600, PauseCooldown: 1800})
+	bus := newEventBus()
+	subscribeAll(bus)
+	// Bans classified the way scan classifies upstream errors
+	for _, err := range []error{api.ErrAccountBanned, api.ErrAccountBanned, api.ErrAccountBanned} {
+		if reason := banReason(err); reason != "" {
+			bus.Emit(accountBanned{Username: "trainer"})
+		}
+	}
+	eventually(t, "three bans", func() bool { return b.State().BansLastHour == 3 })
+	if b.Paused() {
+		t.Fatal("paused at the threshold, want a pause only above it")
+	}
+	bus.Emit(accountBanned{Username: "trainer"})
+	eventually(t, "the pause", b.Paused)
+	s := b.State()
+	if s.Reason != "ban rate exceeded" || s.Pauses != 1 {
+		t.Errorf("state = %+v, want a ban rate pause", s)
+	}
+	clock.Advance(29 * time.Minute)
+	if !b.Paused() {
+		t.Fatal("pause lifted before the cooldown")
+	}
+	clock.Advance(time.Minute)
+	if b.Paused() {
+		t.Fatal("pause not lifted after the cooldown")
+	}
+	if s := b.State(); s.BansLastHour != 0 {
+		t.Errorf("bans after resume = %d, want a fresh budget", s.BansLastHour)
+	}
+}
+
+func TestFailedScansPauseScanning(t *testing.T) {
+	b, _ := withBudget(t, settings{MaxFailureRate: 50, MinFailureSamples: 4, FailureWindow: 600, PauseCooldown: 1800})
+	bus := newEventBus()
+	subscribeAll(bus)
+	// Busy scans never reached upstream and don't count
+	for i := 0; i < 10; i++ {
+		bus.Emit(scanCompleted{Err: opm.ErrBusy})
+	}
+	bus.Emit(scanCompleted{})
+	bus.Emit(scanCompleted{Err: opm.ErrScanTimeout})
+	bus.Emit(scanCompleted{Err: opm.ErrScanTimeout})
+	eventually(t, "three samples", func() bool {
+		b.Lock()
+		defer b.Unlock()
+		return len(b.scans) == 3
+	})
+	if b.Paused() {
+		t.Fatal("paused before MinFailureSamples scans")
+	}
+	bus.Emit(scanCompleted{Err: opm.ErrScanTimeout})
+	eventually(t, "the pause", b.Paused)
+	if s := b.State(); s.Reason != "upstream failure rate exceeded" || s.FailureRate != 75 {
+		t.Errorf("state = %+v, want a failure rate pause at 75%%", s)
+	}
+}
+
+func TestPauseIsReportedAndResumed(t *testing.T) {
+	b, _ := withBudget(t, settings{MaxBansPerHour: 1, FailureWindow: 600, PauseCooldown: 1800})
+	oldStatus, oldSecret := scannerStatus, opmSettings.Secret
+	scannerStatus, opmSettings.Secret = newStatusRegistry(), "s3cret"
+	defer func() { scannerStatus, opmSettings.Secret = oldStatus, oldSecret }()
+	b.RecordBan()
+	b.RecordBan()
+
+	w := httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"degraded"`) {
+		t.Errorf("/healthz = %d %s, want 503 degraded", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status?secret=s3cret&format=text", nil))
+	if !strings.HasPrefix(w.Body.String(), "Scanning paused until ") || !strings.Contains(w.Body.String(), "ban rate exceeded") {
+		t.Errorf("/status body = %q, want the pause", w.Body)
+	}
+	w = httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status?secret=s3cret&summary=1", nil))
+	if !strings.Contains(w.Body.String(), `"paused":true`) {
+		t.Errorf("/status summary = %s, want the pause", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	resumeHandler(w, httptest.NewRequest("POST", "/resume?secret=s3cret", nil))
+	if w.Code != http.StatusOK || b.Paused() {
+		t.Fatalf("/resume = %d, paused %v", w.Code, b.Paused())
+	}
+	w = httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/healthz after resume = %d, want 200", w.Code)
+	}
+}
+
+func TestStatusSummaryWhileScanning(t *testing.T) {
+	withBudget(t, settings{})
+	oldStatus, oldSecret := scannerStatus, opmSettings.Secret
+	scannerStatus, opmSettings.Secret = newStatusRegistry(), "s3cret"
+	defer func() { scannerStatus, opmSettings.Secret = oldStatus, oldSecret }()
+	// Run with -race, the summary reads the registry while trainers come and go
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				name := fmt.Sprintf("trainer%d-%d", i, j%5)
+				scannerStatus.Set(util.NewTrainerSession(opm.Account{Username: name}, nil, nil, nil))
+				scannerStatus.Scanning(name, 1, 2)
+				scannerStatus.Done(name, nil)
+				if j%5 == 4 {
+					scannerStatus.Remove(name)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		statusHandler(w, httptest.NewRequest("GET", "/status?secret=s3cret&summary=1", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"trainers":`) {
+			t.Fatalf("/status summary = %d %s", w.Code, w.Body)
+		}
+	}
+	wg.Wait()
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status?secret=s3cret&summary=1", nil))
+	if !strings.Contains(w.Body.String(), `"trainers":16`) {
+		t.Errorf("/status summary = %s, want the 16 trainers left", w.Body)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/pogodevorg/POGOProtos-go"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// captureResponse stores a sample of the raw responses, so they can be replayed
+// through the parser after parser fixes. Capture is off unless CapturePercent is set.
+func captureResponse(lat, lng float64, received time.Time, r *protos.GetMapObjectsResponse) {
+	if scannerSettings.CapturePercent <= 0 || r == nil || rand.Float64()*100 >= scannerSettings.CapturePercent {
+		return
+	}
+	data, err := util.EncodeMapResponse(r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	raw := opm.RawResponse{
+		ScanID: strconv.FormatInt(received.UnixNano(), 36) + strconv.FormatInt(rand.Int63n(1<<20), 36),
+		Lat:    lat,
+		Lng:    lng,
+		Time:   received.Unix(),
+		Data:   data,
+	}
+	go func() {
+		err := database.AddRawResponse(raw, time.Duration(scannerSettings.CaptureTTL)*time.Hour)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/pogointel/opm/client"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+
+	"golang.org/x/net/context"
+)
+
+// TestClientScan runs the client against the scanner with a fake store and upstream, which
+// checks the client and the API against each other
+func TestClientScan(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.ScanDelay, s.MaxJumpSpeed, s.StickyRadius, s.MockMode, s.BusyRetryAfter = 0, 0, 0, false, 5
+	})
+	u, _ := withTrainers(t, util.NewTrainerSession(opm.Account{Username: "trainer"}, &api.Location{}, nil, nil))
+	server := httptest.NewServer(newMux())
+	t.Cleanup(server.Close)
+	c := client.New(server.URL, "")
+	c.MaxRetries = 0
+	ctx := context.Background()
+
+	resp, err := c.Scan(ctx, 52.5, 13.4)
+	if err != nil || !resp.Ok || len(resp.MapObjects) != 1 {
+		t.Fatalf("Scan = %+v, %v", resp, err)
+	}
+	if o := resp.MapObjects[0]; o.ID != "p1" || o.PokemonID != 16 || o.Lat != 52.5 || o.Lng != 13.4 {
+		t.Errorf("object = %+v, want the scanned Pokemon", o)
+	}
+	if _, err := c.Scan(ctx, 91, 13.4); !client.HasCode(err, opm.ErrCodeBadRequest) {
+		t.Errorf("invalid coordinates = %v, want %s", err, opm.ErrCodeBadRequest)
+	}
+
+	// Without a trainer the scanner is busy and says when to come back
+	if _, err := trainerQueue.Get(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Scan(ctx, 52.5, 13.4)
+	e, ok := err.(*client.Error)
+	if !ok || e.StatusCode != http.StatusServiceUnavailable || e.Code != opm.ErrCodeBusy || !e.Retryable() || e.RetryAfter == nil || e.RetryAfter.Seconds != 5 {
+		t.Errorf("busy scan = %#v, want a retryable busy error with the hint", err)
+	}
+	if len(u.scans) != 1 {
+		t.Errorf("scans = %v, want only the first", u.scans)
+	}
+}
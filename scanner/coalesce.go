@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// coalesceDecimals is the precision of the cells shared by scans, about 11 m of latitude
+const coalesceDecimals = 4
+
+// scanResult is the outcome of a scan that is shared by the requests for its cell
+type scanResult struct {
+	objects   []opm.MapObject
+	footprint opm.BoundingBox
+}
+
+// scanCoalescer lets concurrent requests for the same cell share one scan instead of taking
+// a trainer each. A finished scan is still handed out for the window, failed scans only to
+// the requests that waited for them.
+type scanCoalescer struct {
+	sync.Mutex
+	window time.Duration
+	scans  map[string]*sharedScan
+	pruned time.Time
+	shared int64
+}
+
+// sharedScan is a running or finished scan of a cell
+type sharedScan struct {
+	done     chan struct{}
+	result   scanResult
+	err      error
+	finished time.Time // zero while running
+}
+
+func newScanCoalescer(window time.Duration) *scanCoalescer {
+	return &scanCoalescer{window: window, scans: make(map[string]*sharedScan)}
+}
+
+// cellKey returns the cell of a location
+func cellKey(lat, lng float64) string {
+	return strconv.FormatFloat(lat, 'f', coalesceDecimals, 64) + "," + strconv.FormatFloat(lng, 'f', coalesceDecimals, 64)
+}
+
+// Do returns the result of a running or recent scan of the cell of lat/lng, or runs scan.
+// A waiting request gives up with opm.ErrScanTimeout when ctx is done, the scan goes on for
+// the others. Without a coalescer every request scans.
+func (c *scanCoalescer) Do(ctx context.Context, lat, lng float64, scan func() (scanResult, error)) (result scanResult, shared bool, err error) {
+	if c == nil {
+		result, err = scan()
+		return result, false, err
+	}
+	key := cellKey(lat, lng)
+	now := time.Now()
+	c.Lock()
+	if now.Sub(c.pruned) > c.window {
+		c.prune(now)
+	}
+	if s, ok := c.scans[key]; ok && (s.finished.IsZero() || now.Sub(s.finished) < c.window) {
+		c.Unlock()
+		atomic.AddInt64(&c.shared, 1)
+		select {
+		case <-s.done:
+			return s.result, true, s.err
+		case <-ctx.Done():
+			return scanResult{}, true, opm.ErrScanTimeout
+		}
+	}
+	s := &sharedScan{done: make(chan struct{})}
+	c.scans[key] = s
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		s.finished = time.Now()
+		if s.err != nil && c.scans[key] == s {
+			delete(c.scans, key)
+		}
+		c.Unlock()
+		close(s.done)
+	}()
+	s.result, s.err = scan()
+	return s.result, false, s.err
+}
+
+// prune drops the scans that finished before the window, the lock must be held
+func (c *scanCoalescer) prune(now time.Time) {
+	for key, s := range c.scans {
+		if !s.finished.IsZero() && now.Sub(s.finished) >= c.window {
+			delete(c.scans, key)
+		}
+	}
+	c.pruned = now
+}
+
+// String returns the number of requests that got a shared scan for expvar
+func (c *scanCoalescer) String() string {
+	c.Lock()
+	cells := len(c.scans)
+	c.Unlock()
+	b, _ := json.Marshal(map[string]int64{"shared": atomic.LoadInt64(&c.shared), "cells": int64(cells)})
+	return string(b)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// withCoalescer shares the scans of a cell for window
+func withCoalescer(t *testing.T, window time.Duration) *scanCoalescer {
+	old := coalescer
+	coalescer = newScanCoalescer(window)
+	t.Cleanup(func() { coalescer = old })
+	return coalescer
+}
+
+// blockedUpstream holds the scans of u until release is closed
+func blockedUpstream(u *scriptedUpstream) (started chan struct{}, release chan struct{}) {
+	started, release = make(chan struct{}, 10), make(chan struct{})
+	getMapResult = func(trainer *util.TrainerSession, lat, lng float64) ([]opm.MapObject, error) {
+		started <- struct{}{}
+		<-release
+		return u.getMapResult(trainer, lat, lng)
+	}
+	return started, release
+}
+
+func TestCoalescedScanTakesOneTrainer(t *testing.T) {
+	withSettings(t, func(s *settings) { s.ScanDelay, s.MaxJumpSpeed, s.StickyRadius, s.MockMode = 0, 0, 0, false })
+	u, _ := withTrainers(t, budgetTrainer("first", 0, 0), budgetTrainer("second", 0, 0))
+	c := withCoalescer(t, time.Minute)
+	started, release := blockedUpstream(u)
+	server := httptest.NewServer(http.HandlerFunc(requestHandler))
+	defer server.Close()
+
+	responses := make(chan opm.APIResponse, 2)
+	post := func() {
+		resp, err := http.PostForm(server.URL, url.Values{"lat": {"52.50001"}, "lng": {"13.40001"}})
+		if err != nil {
+			t.Error(err)
+			responses <- opm.APIResponse{}
+			return
+		}
+		defer resp.Body.Close()
+		var r opm.APIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("response %d: %v", resp.StatusCode, err)
+		}
+		responses <- r
+	}
+	go post()
+	<-started
+	// The second request is for the same cell while the first one scans
+	go post()
+	eventually(t, "the shared request", func() bool { return atomic.LoadInt64(&c.shared) == 1 })
+	if s := trainerQueue.Stats(); s.Available != 1 {
+		t.Errorf("%d trainers idle during the scan, want one checked out", s.Available)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if r := <-responses; !r.Ok || len(r.MapObjects) != 1 || r.MapObjects[0].ID != "p1" {
+			t.Errorf("response %d = %+v, want the objects of the one scan", i, r)
+		}
+	}
+	if len(u.scans) != 1 {
+		t.Errorf("scans = %v, want one for both requests", u.scans)
+	}
+	// The shared request is counted by the coalescer only
+	if n := scannerMetrics.ScansPerMinute.Rate(); n != 1 {
+		t.Errorf("%d scans per minute, want 1", n)
+	}
+}
+
+func TestCoalescedScanOutlivesFirstClient(t *testing.T) {
+	withSettings(t, func(s *settings) { s.ScanDelay, s.MaxJumpSpeed, s.StickyRadius, s.MockMode = 0, 0, 0, false })
+	p, start := withPool(t, 5*time.Second, budgetTrainer("trainer", 0, 0))
+	u := &scriptedUpstream{}
+	getMapResult = u.getMapResult
+	c := withCoalescer(t, time.Minute)
+	busy, err := trainerQueue.Get(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(ctx context.Context) *http.Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"lat": {"52.5"}, "lng": {"13.4"}}.Encode())).WithContext(ctx)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	// The first request waits for the busy trainer, the second one for its scan
+	ctx, cancel := context.WithCancel(context.Background())
+	go requestHandler(httptest.NewRecorder(), request(ctx))
+	eventually(t, "the first request waits for a trainer", func() bool { return len(p.jobs) == 1 })
+	second := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		requestHandler(w, request(context.Background()))
+		second <- w
+	}()
+	eventually(t, "the shared request", func() bool { return atomic.LoadInt64(&c.shared) == 1 })
+	// The client of the first request goes away, its scan goes on for the second
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	start()
+	trainerQueue.Queue(busy, 0)
+	select {
+	case w := <-second:
+		var resp opm.APIResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || !resp.Ok || len(resp.MapObjects) != 1 {
+			t.Errorf("shared request = %d %s, want the result of the scan", w.Code, w.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the shared request got no result")
+	}
+	if s := p.Stats(); s.Abandoned != 0 {
+		t.Errorf("pool = %+v, want the trainer request kept", s)
+	}
+}
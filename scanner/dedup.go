@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// Ways to avoid writing Pokemon that are already stored, see settings.PokemonWrites
+const (
+	writesInsert = "insert" // insert every Pokemon, the db rejects duplicates
+	writesSeen   = "seen"   // skip Pokemon this scanner saved before they expire
+	writesUpsert = "upsert" // upsert Pokemon by encounter id, no duplicate key errors
+)
+
+// seenSet remembers the encounters saved by this scanner until they expire
+type seenSet struct {
+	sync.Mutex
+	expiries map[string]int64 // encounter id -> expiry
+	pruned   time.Time
+	skipped  int64
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{expiries: make(map[string]int64)}
+}
+
+// Filter returns the objects without the Pokemon that were saved before and have not
+// expired yet. All Pokemon of the result are remembered.
+func (s *seenSet) Filter(objects []opm.MapObject, now time.Time) []opm.MapObject {
+	s.Lock()
+	defer s.Unlock()
+	if now.Sub(s.pruned) > time.Minute {
+		s.prune(now)
+	}
+	filtered := make([]opm.MapObject, 0, len(objects))
+	for _, o := range objects {
+		if o.Type != opm.POKEMON {
+			filtered = append(filtered, o)
+			continue
+		}
+		if expiry, ok := s.expiries[o.ID]; ok && !opm.Expired(expiry, now) {
+			s.skipped++
+			continue
+		}
+		expiry := o.Expiry
+		if expiry == 0 {
+			expiry = opm.ExpiryAfter(now, opm.MaxPokemonLifetime)
+		}
+		s.expiries[o.ID] = expiry
+		filtered = append(filtered, o)
+	}
+	return filtered
+}
+
+// Skipped returns the number of Pokemon that were not written again
+func (s *seenSet) Skipped() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.skipped
+}
+
+// prune drops expired encounters. Must be called with the lock held.
+func (s *seenSet) prune(now time.Time) {
+	for id, expiry := range s.expiries {
+		if opm.Expired(expiry, now) {
+			delete(s.expiries, id)
+		}
+	}
+	s.pruned = now
+}
+
+// ApproxBytes returns the approximate memory used by the set
+func (s *seenSet) ApproxBytes() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return int64(len(s.expiries) * 48)
+}
+
+// Shrink forgets all encounters. They are written once more and rejected by the db.
+func (s *seenSet) Shrink() {
+	s.Lock()
+	defer s.Unlock()
+	s.expiries = make(map[string]int64)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+func TestSeenSetFilter(t *testing.T) {
+	s := newSeenSet()
+	now := time.Unix(1500000000, 0)
+	pokemon := opm.MapObject{Type: opm.POKEMON, ID: "p1", Expiry: now.Add(time.Minute).Unix()}
+	stop := opm.MapObject{Type: opm.POKESTOP, ID: "s1"}
+	if got := s.Filter([]opm.MapObject{pokemon, stop}, now); len(got) != 2 {
+		t.Fatalf("first scan = %v, want both objects", got)
+	}
+	// Forts are always written, they change
+	got := s.Filter([]opm.MapObject{pokemon, stop, {Type: opm.POKEMON, ID: "p2"}}, now.Add(time.Second))
+	if len(got) != 2 || got[0].ID != "s1" || got[1].ID != "p2" || s.Skipped() != 1 {
+		t.Errorf("second scan = %v with %d skipped, want the Pokestop and the new Pokemon", got, s.Skipped())
+	}
+	// Written again once its expiry passed, Pokemon without one are kept for the maximum lifetime
+	if got := s.Filter([]opm.MapObject{pokemon}, now.Add(time.Minute+time.Second)); len(got) != 1 {
+		t.Errorf("expired encounter = %v, want it written", got)
+	}
+	if got := s.Filter([]opm.MapObject{{Type: opm.POKEMON, ID: "p2"}}, now.Add(time.Minute+time.Second)); len(got) != 0 {
+		t.Errorf("encounter without expiry = %v, want it skipped", got)
+	}
+}
+
+func TestSeenSetPrunes(t *testing.T) {
+	s := newSeenSet()
+	now := time.Unix(1500000000, 0)
+	s.Filter([]opm.MapObject{
+		{Type: opm.POKEMON, ID: "short", Expiry: now.Add(30 * time.Second).Unix()},
+		{Type: opm.POKEMON, ID: "long", Expiry: now.Add(10 * time.Minute).Unix()},
+	}, now)
+	s.Filter(nil, now.Add(2*time.Minute))
+	if _, ok := s.expiries["short"]; ok || len(s.expiries) != 1 {
+		t.Errorf("encounters = %v, want the expired one pruned", s.expiries)
+	}
+	if s.ApproxBytes() == 0 {
+		t.Error("ApproxBytes = 0 with a remembered encounter")
+	}
+	s.Shrink()
+	if s.ApproxBytes() != 0 {
+		t.Errorf("ApproxBytes = %d after Shrink", s.ApproxBytes())
+	}
+}
+
+func TestSameEncounterScannedTwice(t *testing.T) {
+	withSettings(t, func(s *settings) { s.ScanDelay, s.MaxJumpSpeed, s.StickyRadius, s.MockMode = 0, 0, 0, false })
+	for _, mode := range []struct {
+		name   string
+		seen   *seenSet
+		writes int
+	}{
+		{writesSeen, newSeenSet(), 1},
+		{writesInsert, nil, 2},
+	} {
+		_, s := withTrainers(t, budgetTrainer("ash", 0, 0))
+		getMapResult = func(trainer *util.TrainerSession, lat, lng float64) ([]opm.MapObject, error) {
+			return []opm.MapObject{{Type: opm.POKEMON, ID: "encounter", PokemonID: 16, Lat: lat, Lng: lng, Expiry: opm.Now().Add(10 * time.Minute).Unix()}}, nil
+		}
+		oldSeen := seen
+		seen = mode.seen
+		for i := 0; i < 2; i++ {
+			if w, resp := scanRequest(t, "POST"); w.Code != http.StatusOK || len(resp.MapObjects) != 1 {
+				t.Fatalf("%s: scan = %d %+v, want the Pokemon", mode.name, w.Code, resp)
+			}
+		}
+		seen = oldSeen
+		if len(s.objects) != mode.writes {
+			t.Errorf("%s: %d writes, want %d", mode.name, len(s.objects), mode.writes)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// eventBuffer is the number of events buffered per subscriber before events are dropped
+const eventBuffer = 1024
+
+// Events of the scan pipeline
+
+// scanCompleted is emitted after every scan, failed or not
+type scanCompleted struct {
+	Lat, Lng float64
+	Start    int64 // unix time the scan started
+	Err      error
+	Objects  []opm.MapObject
+}
+
+// objectsPersisted is emitted with the objects a scan added to the db
+type objectsPersisted struct {
+	Objects []opm.MapObject
+}
+
+// objectsDeleted is emitted with the objects deleted by any process, see watchTombstones
+type objectsDeleted struct {
+	Objects []opm.MapObject
+}
+
+// accountBanned is emitted when an account is flagged as banned
+type accountBanned struct {
+	Username string
+}
+
+// proxyDied is emitted when a proxy stops working
+type proxyDied struct {
+	ProxyID int64
+}
+
+// eventBus delivers events to its subscribers. Every subscriber has its own buffer and
+// goroutine, so a slow or panicking subscriber doesn't affect the others or the scan.
+// Each subscriber receives the events in the order they were emitted.
+type eventBus struct {
+	sync.Mutex
+	subscribers []*subscriber
+	closed      bool
+}
+
+type subscriber struct {
+	name    string
+	events  chan interface{}
+	handle  func(e interface{})
+	done    chan struct{}
+	dropped int64
+	panics  int64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{}
+}
+
+// Subscribe calls handle for every emitted event. Subscribers ignore the events they don't handle.
+func (b *eventBus) Subscribe(name string, handle func(e interface{})) {
+	s := &subscriber{name: name, events: make(chan interface{}, eventBuffer), handle: handle, done: make(chan struct{})}
+	b.Lock()
+	b.subscribers = append(b.subscribers, s)
+	b.Unlock()
+	go s.run()
+}
+
+// Emit sends the event to all subscribers. It never blocks, the event is dropped for
+// subscribers whose buffer is full.
+func (b *eventBus) Emit(e interface{}) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return
+	}
+	for _, s := range b.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			if atomic.AddInt64(&s.dropped, 1)%100 == 1 {
+				log.Printf("Event subscriber %s can't keep up, dropping events", s.name)
+			}
+		}
+	}
+}
+
+// Close waits until the subscribers handled the queued events and stops them. Later events are dropped.
+func (b *eventBus) Close() {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return
+	}
+	b.closed = true
+	for _, s := range b.subscribers {
+		close(s.events)
+	}
+	subscribers := b.subscribers
+	b.Unlock()
+	for _, s := range subscribers {
+		<-s.done
+	}
+}
+
+func (s *subscriber) run() {
+	defer close(s.done)
+	for e := range s.events {
+		s.deliver(e)
+	}
+}
+
+// deliver handles one event and recovers from panics of the subscriber
+func (s *subscriber) deliver(e interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&s.panics, 1)
+			log.Printf("Event subscriber %s panicked: %v", s.name, r)
+		}
+	}()
+	s.handle(e)
+}
+
+// String returns the dropped events and panics per subscriber for expvar
+func (b *eventBus) String() string {
+	b.Lock()
+	defer b.Unlock()
+	type subscriberStats struct {
+		Queued  int   `json:"queued"`
+		Dropped int64 `json:"dropped"`
+		Panics  int64 `json:"panics"`
+	}
+	stats := make(map[string]subscriberStats, len(b.subscribers))
+	for _, s := range b.subscribers {
+		stats[s.name] = subscriberStats{len(s.events), atomic.LoadInt64(&s.dropped), atomic.LoadInt64(&s.panics)}
+	}
+	data, _ := json.Marshal(stats)
+	return string(data)
+}
+
+// subscribeAll wires the subsystems of the scanner to the events of the scan pipeline
+func subscribeAll(b *eventBus) {
+	b.Subscribe("error_budget", func(e interface{}) {
+		switch e := e.(type) {
+		case accountBanned:
+			budget.RecordBan()
+		case scanCompleted:
+			// Busy scans never reached upstream
+			if e.Err != opm.ErrBusy {
+				budget.RecordScan(e.Err == nil)
+			}
+		}
+	})
+	b.Subscribe("stream", func(e interface{}) {
+		switch e := e.(type) {
+		case objectsPersisted:
+			stream.Publish(e.Objects)
+		case objectsDeleted:
+			stream.Publish(e.Objects)
+		}
+	})
+	if opmSettings.SuppressAfterMisses > 0 {
+		b.Subscribe("misses", func(e interface{}) {
+			if e, ok := e.(scanCompleted); ok && e.Err == nil {
+				recordMisses(e.Lat, e.Lng, e.Start, e.Objects)
+			}
+		})
+	}
+	if webhooks != nil {
+		b.Subscribe("webhooks", func(e interface{}) {
+			switch e := e.(type) {
+			case objectsPersisted:
+				webhooks.Dispatch(e.Objects)
+			case objectsDeleted:
+				webhooks.Dispatch(e.Objects)
+			}
+		})
+	}
+	b.Subscribe("log", func(e interface{}) {
+		switch e := e.(type) {
+		case accountBanned:
+			log.Printf("Account %s banned", util.Username(e.Username))
+		case proxyDied:
+			log.Printf("Proxy %d died", e.ProxyID)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func TestEventBusCloseHandlesQueuedEvents(t *testing.T) {
+	bus := newEventBus()
+	var handled int64
+	block := make(chan struct{})
+	bus.Subscribe("slow", func(e interface{}) {
+		<-block
+		atomic.AddInt64(&handled, 1)
+	})
+	for i := 0; i < 10; i++ {
+		bus.Emit(scanCompleted{})
+	}
+	close(block)
+	bus.Close()
+	if n := atomic.LoadInt64(&handled); n != 10 {
+		t.Errorf("handled %d events before Close returned, want 10", n)
+	}
+	// Events after Close are dropped, a second Close returns right away
+	bus.Emit(scanCompleted{})
+	bus.Close()
+	if n := atomic.LoadInt64(&handled); n != 10 {
+		t.Errorf("handled %d events, want none after Close", n)
+	}
+}
+
+func TestEventBusOrder(t *testing.T) {
+	bus := newEventBus()
+	var mutex sync.Mutex
+	got := make(map[string][]int)
+	for _, name := range []string{"a", "b"} {
+		name := name
+		bus.Subscribe(name, func(e interface{}) {
+			mutex.Lock()
+			got[name] = append(got[name], e.(int))
+			mutex.Unlock()
+		})
+	}
+	for i := 0; i < 500; i++ {
+		bus.Emit(i)
+	}
+	bus.Close()
+	for _, name := range []string{"a", "b"} {
+		if len(got[name]) != 500 {
+			t.Fatalf("%s received %d events, want 500", name, len(got[name]))
+		}
+		for i, e := range got[name] {
+			if e != i {
+				t.Fatalf("event %d of %s = %d, want the order of Emit", i, name, e)
+			}
+		}
+	}
+}
+
+func TestEventBusIsolatesPanics(t *testing.T) {
+	bus := newEventBus()
+	var handled, survived int64
+	bus.Subscribe("panics", func(e interface{}) {
+		if e.(int)%2 == 0 {
+			panic("broken subscriber")
+		}
+		atomic.AddInt64(&survived, 1)
+	})
+	bus.Subscribe("healthy", func(e interface{}) {
+		atomic.AddInt64(&handled, 1)
+	})
+	for i := 0; i < 10; i++ {
+		bus.Emit(i)
+	}
+	bus.Close()
+	if n := atomic.LoadInt64(&handled); n != 10 {
+		t.Errorf("healthy subscriber handled %d events, want 10", n)
+	}
+	// The panicking subscriber keeps getting the later events
+	if n := atomic.LoadInt64(&survived); n != 5 {
+		t.Errorf("panicking subscriber handled %d events, want the 5 odd ones", n)
+	}
+	var stats map[string]struct{ Dropped, Panics int64 }
+	if err := json.Unmarshal([]byte(bus.String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["panics"].Panics != 5 || stats["healthy"].Panics != 0 {
+		t.Errorf("stats = %+v, want 5 panics of the broken subscriber", stats)
+	}
+}
+
+func TestEventBusDropsForSlowSubscribers(t *testing.T) {
+	bus := newEventBus()
+	holding, block := make(chan struct{}), make(chan struct{})
+	var fast int64
+	bus.Subscribe("slow", func(e interface{}) {
+		if e.(int) == 0 {
+			close(holding)
+		}
+		<-block
+	})
+	bus.Subscribe("fast", func(e interface{}) { atomic.AddInt64(&fast, 1) })
+	bus.Emit(0)
+	<-holding
+	eventually(t, "the first event", func() bool { return atomic.LoadInt64(&fast) == 1 })
+	// The slow subscriber holds the first event and buffers eventBuffer more
+	for i := 1; i <= eventBuffer; i++ {
+		bus.Emit(i)
+	}
+	eventually(t, "the fast subscriber", func() bool { return atomic.LoadInt64(&fast) == eventBuffer+1 })
+	for i := 0; i < 10; i++ {
+		bus.Emit(i)
+	}
+	eventually(t, "the fast subscriber", func() bool { return atomic.LoadInt64(&fast) == eventBuffer+11 })
+	var stats map[string]struct{ Dropped, Panics int64 }
+	if err := json.Unmarshal([]byte(bus.String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["slow"].Dropped != 10 || stats["fast"].Dropped != 0 {
+		t.Errorf("stats = %+v, want 10 events dropped for the slow subscriber", stats)
+	}
+	close(block)
+	bus.Close()
+}
+
+func TestWebhooksSubscribeToPersistedObjects(t *testing.T) {
+	rec := newWebhookRecorder(t)
+	old := webhooks
+	webhooks = newTestDispatcher(settings{WebhookURLs: []string{rec.URL + "/hook"}})
+	defer func() { webhooks = old }()
+	withStream(t)
+	bus := newEventBus()
+	subscribeAll(bus)
+	expiry := time.Now().Add(10 * time.Minute).Unix()
+	bus.Emit(objectsPersisted{Objects: []opm.MapObject{{Type: opm.POKEMON, ID: "p1", PokemonID: 16, Expiry: expiry}}})
+	bus.Emit(objectsDeleted{Objects: []opm.MapObject{{Type: opm.POKEMON, ID: "p1", Deleted: true}}})
+	bus.Close()
+	eventually(t, "the messages", func() bool { return len(rec.received("/hook")) == 2 })
+	if got := rec.received("/hook"); got[0] != "pokemon" || got[1] != "deleted" {
+		t.Errorf("webhook received %v, want the Pokemon and then its deletion", got)
+	}
+}
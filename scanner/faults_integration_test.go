@@ -0,0 +1,156 @@
+//go:build integration && faults
+
+// Outage scenarios scripted with the failure injection points, on top of the integration
+// setup. They need the faults tag as well, make integration sets both.
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/internal/faults"
+	"github.com/pogointel/opm/opm"
+)
+
+// inject sets the rules of the points until the end of the test
+func inject(t *testing.T, rule faults.Rule, points ...string) {
+	for _, p := range points {
+		faults.Set(p, rule)
+	}
+	t.Cleanup(func() {
+		for _, p := range points {
+			faults.Set(p, faults.Rule{})
+		}
+	})
+}
+
+// stored counts the objects of the scan result that are in the database
+func (s *integrationServer) stored(t *testing.T, objects []opm.MapObject) int {
+	t.Helper()
+	n := 0
+	for _, o := range objects {
+		_, err := s.db.GetObject(o.ID)
+		if err == nil {
+			n++
+		} else if err != db.ErrNotFound {
+			t.Fatal(err)
+		}
+	}
+	return n
+}
+
+func TestScenarioDatabaseFlap(t *testing.T) {
+	s := startScanner(t, []string{"ash"}, 1, nil)
+	// The database goes away and comes back three times. Scans are answered from the upstream
+	// either way, what they found while it was away is lost.
+	for i := 0; i < 3; i++ {
+		lat := 52.5 + float64(i)/100
+		inject(t, faults.Rule{ErrorRate: 1}, faults.DbRead, faults.DbWrite)
+		status, r := s.scan(t, lat, 13.4)
+		if status != http.StatusOK || len(r.MapObjects) != 3 {
+			t.Fatalf("scan %d without the database = %d %+v, want the upstream result", i, status, r)
+		}
+		faults.Set(faults.DbRead, faults.Rule{})
+		faults.Set(faults.DbWrite, faults.Rule{})
+		if n := s.stored(t, r.MapObjects); n != 0 {
+			t.Errorf("%d objects stored during the outage", n)
+		}
+		if status, _ := s.scan(t, lat, 13.4); status != http.StatusOK {
+			t.Fatalf("scan %d after the outage = %d", i, status)
+		}
+		if n := s.stored(t, r.MapObjects); n != 3 {
+			t.Errorf("%d objects stored by the rescan, want 3", n)
+		}
+	}
+	// Losing writes isn't an upstream failure
+	if state := budget.State(); state.Paused || state.FailureRate != 0 {
+		t.Errorf("budget = %+v after the flaps, want no failures", state)
+	}
+}
+
+func TestScenarioUpstreamBrownout(t *testing.T) {
+	s := startScanner(t, []string{"ash", "misty"}, 2, func(s *settings) {
+		s.MaxFailureRate, s.MinFailureSamples = 50, 5
+	})
+	opmSettings.Secret = "s3cret"
+	// Every map request fails until the error budget pauses scanning
+	inject(t, faults.Rule{ErrorRate: 1}, faults.UpstreamMap)
+	failed := 0
+	for !budget.Paused() && failed < 20 {
+		status, r := s.scan(t, 52.5, 13.4)
+		if status == http.StatusServiceUnavailable {
+			// The pause was tripped by the events of the earlier scans
+			break
+		}
+		if status != http.StatusBadGateway || r.ErrorCode != opm.ErrCodeScanFailed {
+			t.Fatalf("scan during the brownout = %d %+v, want a failed scan", status, r)
+		}
+		failed++
+	}
+	eventually(t, "the pause", budget.Paused)
+	if failed < 5 {
+		t.Errorf("paused after %d failed scans, want the minimum of 5 samples", failed)
+	}
+	status, r := s.scan(t, 52.5, 13.4)
+	if status != http.StatusServiceUnavailable || r.ErrorCode != opm.ErrCodeBusy || r.RetryAfter == nil || r.RetryAfter.Reason != opm.RetryReasonPaused {
+		t.Errorf("scan while paused = %d %+v, want busy until the end of the pause", status, r)
+	}
+	resp, err := http.Get(s.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/healthz while paused = %d, want 503", resp.StatusCode)
+	}
+	// Upstream errors are not held against the accounts
+	if banned, err := s.db.GetBannedAccounts(); err != nil || len(banned) != 0 {
+		t.Errorf("banned accounts = %+v, %v, want none", banned, err)
+	}
+
+	// The upstream recovers and scanning is resumed
+	faults.Set(faults.UpstreamMap, faults.Rule{})
+	resp, err = http.Post(s.URL+"/resume?secret=s3cret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if status, r := s.scan(t, 52.5, 13.4); status != http.StatusOK || len(r.MapObjects) != 3 {
+		t.Errorf("scan after the brownout = %d %+v", status, r)
+	}
+}
+
+func TestScenarioProxyPoolCollapse(t *testing.T) {
+	s := startScanner(t, []string{"ash"}, 2, nil)
+	if _, r := s.scan(t, 52.5, 13.4); !r.Ok {
+		t.Fatalf("scan failed: %+v", r)
+	}
+	// Every proxy dies. The first scan burns the spare proxy on its retry.
+	inject(t, faults.Rule{ErrorRate: 1}, faults.ProxyConnect)
+	status, r := s.scan(t, 52.51, 13.4)
+	if status != http.StatusBadGateway || r.ErrorCode != opm.ErrCodeProxy {
+		t.Errorf("scan with dead proxies = %d %+v, want a proxy error", status, r)
+	}
+	// Without proxies the trainer is given up and the scanner is busy
+	for i := 0; i < 3; i++ {
+		status, r := s.scan(t, 52.52, 13.4)
+		if status != http.StatusServiceUnavailable || r.ErrorCode != opm.ErrCodeBusy || r.RetryAfter == nil {
+			t.Errorf("scan %d without proxies = %d %+v, want busy with a retry hint", i, status, r)
+		}
+	}
+	if got := pool.Stats().Size; got != 0 {
+		t.Errorf("pool has %d trainers, want the one without a proxy retired", got)
+	}
+	// The account isn't lost with its proxies
+	stats, err := s.db.AccountStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Used != 0 || stats.Banned != 0 {
+		t.Errorf("accounts = %+v, want ash free again and not banned", stats)
+	}
+	if calls := s.upstream.answered(); len(calls) != 1 {
+		t.Errorf("upstream answered %d map requests, want only the one before the collapse", len(calls))
+	}
+}
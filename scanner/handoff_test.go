@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+
+	"golang.org/x/net/context"
+)
+
+// fakeStore hands out the accounts and a proxy and stores map objects, the other methods of
+// opm.Database aren't used
+type fakeStore struct {
+	opm.Database
+	sync.Mutex
+	accounts []opm.Account
+	objects  []opm.MapObject
+	banned   []string
+	expired  []string // accounts waiting for a new token
+	captchas []string // flagged accounts, out of rotation until ClearCaptcha
+}
+
+func (s *fakeStore) GetProxy() (opm.Proxy, error) {
+	return opm.Proxy{ID: 1}, nil
+}
+
+func (s *fakeStore) ReturnProxy(p opm.Proxy) error {
+	return nil
+}
+
+func (s *fakeStore) GetAccount() (opm.Account, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.accounts) == 0 {
+		return opm.Account{}, opm.ErrBusy
+	}
+	a := s.accounts[0]
+	s.accounts = s.accounts[1:]
+	return a, nil
+}
+
+func (s *fakeStore) ReturnAccount(a opm.Account) error {
+	s.Lock()
+	defer s.Unlock()
+	s.accounts = append(s.accounts, a)
+	return nil
+}
+
+func (s *fakeStore) MarkAccountBanned(username, reason string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.banned = append(s.banned, username)
+	return nil
+}
+
+func (s *fakeStore) MarkTokenExpired(username string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.expired = append(s.expired, username)
+	return nil
+}
+
+func (s *fakeStore) FlagCaptcha(username, url string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.captchas = append(s.captchas, username)
+	return nil
+}
+
+// ClearCaptcha puts a flagged account back into rotation like db.ClearCaptcha
+func (s *fakeStore) ClearCaptcha(username string) error {
+	s.Lock()
+	defer s.Unlock()
+	for i, u := range s.captchas {
+		if u == username {
+			s.captchas = append(s.captchas[:i], s.captchas[i+1:]...)
+			s.accounts = append(s.accounts, opm.Account{Username: u})
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (s *fakeStore) AddMapObject(m opm.MapObject) error {
+	s.Lock()
+	defer s.Unlock()
+	s.objects = append(s.objects, m)
+	return nil
+}
+
+// scriptedUpstream answers map requests with one Pokemon per scan and records the trainer
+// and the context deadline of each scan
+type scriptedUpstream struct {
+	sync.Mutex
+	scans     []string
+	deadlines []time.Time
+}
+
+func (u *scriptedUpstream) getMapResult(trainer *util.TrainerSession, lat, lng float64) ([]opm.MapObject, error) {
+	u.Lock()
+	defer u.Unlock()
+	u.scans = append(u.scans, trainer.Account.Username)
+	deadline, _ := trainer.Context.Deadline()
+	u.deadlines = append(u.deadlines, deadline)
+	return []opm.MapObject{{Type: opm.POKEMON, ID: fmt.Sprintf("p%d", len(u.scans)), PokemonID: 16, Lat: lat, Lng: lng}}, nil
+}
+
+// withTrainers sets up a scanner with the trainers in the queue and a pool of just them,
+// scans are answered by the scripted upstream
+func withTrainers(t *testing.T, trainers ...*util.TrainerSession) (*scriptedUpstream, *fakeStore) {
+	withBudget(t, settings{})
+	withMetrics(t)
+	oldQueue, oldPool, oldStatus, oldEvents, oldStore, oldUpstream := trainerQueue, pool, scannerStatus, events, store, getMapResult
+	u := &scriptedUpstream{}
+	s := &fakeStore{}
+	trainerQueue = util.NewTrainerQueue(trainers)
+	p := newTrainerPool(len(trainers), len(trainers), 10, 200*time.Millisecond)
+	pool = p
+	done := make(chan struct{})
+	go func() {
+		p.run()
+		close(done)
+	}()
+	scannerStatus, events, store, getMapResult = newStatusRegistry(), newEventBus(), s, u.getMapResult
+	t.Cleanup(func() {
+		// The manager may still serve a job that was given up
+		close(p.jobs)
+		<-done
+		trainerQueue, pool, scannerStatus, events, store, getMapResult = oldQueue, oldPool, oldStatus, oldEvents, oldStore, oldUpstream
+	})
+	return u, s
+}
+
+// budgetTrainer returns a trainer with a budget of max scans per hour, used scans of it are spent
+func budgetTrainer(name string, max, used int) *util.TrainerSession {
+	trainer := util.NewTrainerSession(opm.Account{Username: name}, &api.Location{}, nil, nil)
+	trainer.MaxScansPerHour = max
+	for i := 0; i < used; i++ {
+		trainer.RecordScan()
+	}
+	return trainer
+}
+
+func TestRouteHandoffOnBudgetExhaustion(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.ScanRadius, s.MaxRouteLength, s.MaxRouteDuration, s.MaxSpeed, s.ScanDelay = 70, 5000, 300, 0, 0
+	})
+	start := geo.LatLng{Lat: 52, Lng: 13}
+	path := []geo.LatLng{start, geo.Destination(start, 500, 90)}
+	points := len(geo.SamplePath(path, 70))
+	if points < 4 {
+		t.Fatalf("route has %d points, want enough for a handoff", points)
+	}
+	// Neither trainer can walk the route alone, the exhausted one can't scan at all
+	first := points / 2
+	exhausted := budgetTrainer("exhausted", 1, 1)
+	u, s := withTrainers(t, exhausted, budgetTrainer("first", first, 0), budgetTrainer("second", points-first, 0))
+
+	body, _ := json.Marshal(path)
+	r := httptest.NewRequest("POST", "/routescan", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	routeHandler(w, r)
+	var response opm.MultiPointResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if !response.Ok || response.Succeeded != points || len(response.MapObjects) != points {
+		t.Fatalf("response = %s, want all %d points scanned", w.Body, points)
+	}
+	counts := make(map[string]int)
+	for _, name := range u.scans {
+		counts[name]++
+	}
+	if counts["first"] != first || counts["second"] != points-first || counts["exhausted"] != 0 {
+		t.Errorf("scans per trainer = %v, want the route handed off from first to second", counts)
+	}
+	if len(s.objects) != points {
+		t.Errorf("%d objects saved, want %d", len(s.objects), points)
+	}
+	// The exhausted trainer waits for its budget
+	if d := exhausted.BudgetResetIn(); d < 59*time.Minute {
+		t.Errorf("exhausted trainer is ready in %s, want in about an hour", d)
+	}
+}
+
+func TestExhaustedTrainersFallBackToDb(t *testing.T) {
+	withSettings(t, func(s *settings) { s.MaxScansPerHour = 10 })
+	_, s := withTrainers(t, budgetTrainer("exhausted1", 2, 2), budgetTrainer("exhausted2", 1, 1))
+	s.accounts = []opm.Account{{Username: "fresh"}}
+
+	start := time.Now()
+	trainer, err := getTrainerFor(context.Background(), 5, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trainer.Account.Username != "fresh" || trainer.Capacity(time.Second) != 10 {
+		t.Errorf("got %s with capacity %d, want a fresh trainer from the db", trainer.Account.Username, trainer.Capacity(time.Second))
+	}
+	// Only the first trainer waits in the queue
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("took %s to pass the exhausted trainers", d)
+	}
+	if got := pool.Stats(); got.Size != 3 || got.Created != 1 {
+		t.Errorf("pool = %+v, want the new trainer counted", got)
+	}
+
+	// Without accounts in the db the job is busy
+	if _, err := getTrainerFor(context.Background(), 5, time.Second); err != opm.ErrBusy {
+		t.Errorf("getTrainerFor without accounts = %v, want ErrBusy", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// inflightLimiter limits the number of concurrent upstream requests
+type inflightLimiter struct {
+	slots   chan struct{}
+	current int64
+	waits   int64
+	maxWait time.Duration
+}
+
+func newInflightLimiter(size int, maxWait time.Duration) *inflightLimiter {
+	if size <= 0 {
+		size = 1
+	}
+	return &inflightLimiter{
+		slots:   make(chan struct{}, size),
+		maxWait: maxWait,
+	}
+}
+
+// Acquire reserves a slot. If all slots are taken it waits for at most maxWait
+// (or until the context is done) and returns opm.ErrBusy on failure.
+func (l *inflightLimiter) Acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		atomic.AddInt64(&l.current, 1)
+		return nil
+	default:
+	}
+	// Saturated
+	atomic.AddInt64(&l.waits, 1)
+	t := time.NewTimer(l.maxWait)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		atomic.AddInt64(&l.current, 1)
+		return nil
+	case <-t.C:
+		return opm.ErrBusy
+	case <-ctx.Done():
+		return opm.ErrBusy
+	}
+}
+
+// Release frees a slot
+func (l *inflightLimiter) Release() {
+	atomic.AddInt64(&l.current, -1)
+	<-l.slots
+}
+
+// InFlight returns the number of currently running upstream requests
+func (l *inflightLimiter) InFlight() int64 {
+	return atomic.LoadInt64(&l.current)
+}
+
+// Waits returns the number of times a request had to wait for a slot
+func (l *inflightLimiter) Waits() int64 {
+	return atomic.LoadInt64(&l.waits)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// intakeTimeout limits a single warm-up interaction
+const intakeTimeout = 30 * time.Second
+
+// accountIntake warms up quarantined accounts. Every interval one account that is due gets
+// a login and a small scan at the intake location. After enough clean interactions, spaced
+// apart, the account is promoted to the main pool.
+type accountIntake struct {
+	sync.Mutex
+	interval  time.Duration
+	spacing   time.Duration
+	cleanRuns int
+	lat, lng  float64
+	nowFunc   func() time.Time
+	// upstream performs the interaction, getMapResult unless replaced
+	upstream func(trainer *util.TrainerSession, lat, lng float64) error
+	// getAccount and returnAccount check quarantined accounts out of the db and back in, unless replaced
+	getAccount    func(now time.Time) (opm.Account, error)
+	returnAccount func(a opm.Account) error
+
+	warmups  int64
+	promoted int64
+	invalid  int64
+	banned   int64
+}
+
+// intakeStats is the exported state of the intake
+type intakeStats struct {
+	Warmups  int64 `json:"warmups"`
+	Promoted int64 `json:"promoted"`
+	Invalid  int64 `json:"invalid"`
+	Banned   int64 `json:"banned"`
+}
+
+func newAccountIntake(s settings) *accountIntake {
+	return &accountIntake{
+		interval:  time.Duration(s.IntakeInterval) * time.Second,
+		spacing:   time.Duration(s.IntakeSpacing) * time.Second,
+		cleanRuns: s.IntakeCleanRuns,
+		lat:       s.IntakeLat,
+		lng:       s.IntakeLng,
+		nowFunc:   time.Now,
+		upstream: func(trainer *util.TrainerSession, lat, lng float64) error {
+			_, err := getMapResult(trainer, lat, lng)
+			return err
+		},
+		getAccount:    func(now time.Time) (opm.Account, error) { return database.GetWarmupAccount(now) },
+		returnAccount: func(a opm.Account) error { return database.ReturnWarmupAccount(a) },
+	}
+}
+
+func (in *accountIntake) run() {
+	for {
+		time.Sleep(in.interval)
+		if budget.Paused() {
+			// Paused for bans or failures, new accounts would suffer the same
+			continue
+		}
+		if err := in.warmupNext(); err != nil && !errors.Is(err, db.ErrNoAccountAvailable) {
+			log.Println(err)
+		}
+	}
+}
+
+// warmupNext performs the warm-up interaction of the next account that is due
+func (in *accountIntake) warmupNext() error {
+	now := in.nowFunc()
+	a, err := in.getAccount(now)
+	if err != nil {
+		return err
+	}
+	p, err := store.GetProxy()
+	if err != nil {
+		if err := in.returnAccount(a); err != nil {
+			log.Println(err)
+		}
+		return err
+	}
+	trainer := newTrainer(a, p)
+	ctx, cancel := context.WithTimeout(context.Background(), intakeTimeout)
+	trainer.Context = ctx
+	err = in.upstream(trainer, in.lat, in.lng)
+	cancel()
+	if err == api.ErrProxyDead {
+		trainer.Proxy.Dead = true
+		events.Emit(proxyDied{ProxyID: trainer.Proxy.ID})
+	}
+	if err := store.ReturnProxy(trainer.Proxy); err != nil {
+		log.Println(err)
+	}
+	return in.returnAccount(in.record(trainer.Account, err, now))
+}
+
+// record updates the stage of the account with the outcome of a warm-up interaction
+func (in *accountIntake) record(a opm.Account, err error, now time.Time) opm.Account {
+	in.Lock()
+	defer in.Unlock()
+	in.warmups++
+	if err != nil {
+		s := err.Error()
+		reason := banReason(err)
+		switch {
+		case reason == opm.BanCredentials || reason == opm.BanInactive:
+			in.invalid++
+			a.Stage = opm.AccountStageInvalid
+			a.StageReason = s
+			log.Printf("Account %s failed warm-up: %s", util.Username(a.Username), s)
+		case reason != "":
+			in.banned++
+			a.Banned = true
+			a.BannedAt = now.Unix()
+			a.BanReason = reason
+			a.StageReason = s
+			log.Printf("Account %s banned during warm-up", util.Username(a.Username))
+		case err == api.ErrCheckChallenge:
+			a.CaptchaFlagged = true
+			a.StageReason = s
+			log.Printf("Account %s flagged for Challenge during warm-up", util.Username(a.Username))
+		default:
+			// Proxy or upstream trouble, says nothing about the account
+			a.NextWarmup = now.Add(in.interval).Unix()
+		}
+		return a
+	}
+	a.CleanRuns++
+	a.NextWarmup = now.Add(in.spacing).Unix()
+	if a.CleanRuns >= in.cleanRuns {
+		in.promoted++
+		a.Stage = ""
+		a.StageReason = ""
+		log.Printf("Account %s promoted after %d clean warm-ups", util.Username(a.Username), a.CleanRuns)
+	}
+	return a
+}
+
+// Stats returns the counters since the start of the scanner
+func (in *accountIntake) Stats() intakeStats {
+	in.Lock()
+	defer in.Unlock()
+	return intakeStats{Warmups: in.warmups, Promoted: in.promoted, Invalid: in.invalid, Banned: in.banned}
+}
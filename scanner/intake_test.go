@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// intakeAccounts holds quarantined accounts and hands out the due ones like GetWarmupAccount
+type intakeAccounts struct {
+	accounts map[string]opm.Account
+	used     map[string]bool
+}
+
+func (s *intakeAccounts) get(now time.Time) (opm.Account, error) {
+	var due []opm.Account
+	for _, a := range s.accounts {
+		if a.Stage == opm.AccountStageQuarantine && !s.used[a.Username] && !a.Banned && !a.CaptchaFlagged && a.NextWarmup <= now.Unix() {
+			due = append(due, a)
+		}
+	}
+	if len(due) == 0 {
+		return opm.Account{}, db.ErrNoAccountAvailable
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].NextWarmup == due[j].NextWarmup {
+			return due[i].Username < due[j].Username
+		}
+		return due[i].NextWarmup < due[j].NextWarmup
+	})
+	s.used[due[0].Username] = true
+	return due[0], nil
+}
+
+func (s *intakeAccounts) put(a opm.Account) error {
+	s.accounts[a.Username] = a
+	s.used[a.Username] = false
+	return nil
+}
+
+func TestIntakePipeline(t *testing.T) {
+	withTrainers(t)
+	accounts := &intakeAccounts{accounts: make(map[string]opm.Account), used: make(map[string]bool)}
+	for _, u := range []string{"ash", "brock", "misty", "gary", "tracey"} {
+		accounts.put(opm.Account{Username: u, Stage: opm.AccountStageQuarantine})
+	}
+	// The outcome of every warm-up of each account, clean after the scripted ones
+	script := map[string][]error{
+		"brock":  {errors.New("Your username or password is incorrect")},
+		"misty":  {nil, api.ErrAccountBanned},
+		"gary":   {api.ErrCheckChallenge},
+		"tracey": {api.ErrProxyDead, errors.New("connection reset")},
+	}
+	now := time.Unix(1500000000, 0)
+	warmups := make(map[string][]time.Time)
+	in := newAccountIntake(settings{IntakeInterval: 60, IntakeSpacing: 3600, IntakeCleanRuns: 3})
+	in.nowFunc = func() time.Time { return now }
+	in.getAccount, in.returnAccount = accounts.get, accounts.put
+	in.upstream = func(trainer *util.TrainerSession, lat, lng float64) error {
+		u := trainer.Account.Username
+		warmups[u] = append(warmups[u], now)
+		if n := len(warmups[u]); n <= len(script[u]) {
+			return script[u][n-1]
+		}
+		return nil
+	}
+
+	// A day in steps of the interval
+	for i := 0; i < 24*60; i++ {
+		now = now.Add(in.interval)
+		if err := in.warmupNext(); err != nil && !errors.Is(err, db.ErrNoAccountAvailable) {
+			t.Fatal(err)
+		}
+	}
+
+	for _, u := range []string{"ash", "tracey"} {
+		a := accounts.accounts[u]
+		if a.Stage != "" || a.CleanRuns != 3 {
+			t.Errorf("%s = %+v, want promoted after 3 clean runs", u, a)
+		}
+		// Clean runs are spaced apart, trouble with the proxy or upstream is retried after the interval
+		clean := warmups[u][len(script[u]):]
+		for i := 1; i < len(clean); i++ {
+			if d := clean[i].Sub(clean[i-1]); d < in.spacing {
+				t.Errorf("%s warmed up again after %s, want at least %s", u, d, in.spacing)
+			}
+		}
+		if len(clean) != 3 {
+			t.Errorf("%s had %d clean warm-ups, want 3 and none after the promotion", u, len(clean))
+		}
+	}
+	// One account per interval, the others that are due may go first
+	if d := warmups["tracey"][1].Sub(warmups["tracey"][0]); d < in.interval || d > 5*in.interval {
+		t.Errorf("failed warm-up retried after %s, want the next turn after the interval", d)
+	}
+	if a := accounts.accounts["brock"]; a.Stage != opm.AccountStageInvalid || a.StageReason == "" || len(warmups["brock"]) != 1 {
+		t.Errorf("brock = %+v after %d warm-ups, want invalid with the reason", a, len(warmups["brock"]))
+	}
+	if a := accounts.accounts["misty"]; !a.Banned || a.BanReason != opm.BanPermanent || a.CleanRuns != 1 || len(warmups["misty"]) != 2 {
+		t.Errorf("misty = %+v, want banned on the second warm-up", a)
+	}
+	if a := accounts.accounts["gary"]; !a.CaptchaFlagged || a.Stage != opm.AccountStageQuarantine || len(warmups["gary"]) != 1 {
+		t.Errorf("gary = %+v after %d warm-ups, want flagged and left in quarantine", a, len(warmups["gary"]))
+	}
+	want := intakeStats{Warmups: 3 + 5 + 1 + 2 + 1, Promoted: 2, Invalid: 1, Banned: 1}
+	if s := in.Stats(); s != want {
+		t.Errorf("stats = %+v, want %+v", s, want)
+	}
+}
+
+func TestIntakeReturnsAccountWithoutProxy(t *testing.T) {
+	withTrainers(t)
+	oldStore := store
+	store = noProxyStore{store}
+	defer func() { store = oldStore }()
+	accounts := &intakeAccounts{accounts: map[string]opm.Account{"ash": {Username: "ash", Stage: opm.AccountStageQuarantine}}, used: make(map[string]bool)}
+	in := newAccountIntake(settings{IntakeInterval: 60, IntakeSpacing: 3600, IntakeCleanRuns: 3})
+	in.getAccount, in.returnAccount = accounts.get, accounts.put
+	in.upstream = func(*util.TrainerSession, float64, float64) error {
+		t.Error("warm-up without a proxy")
+		return nil
+	}
+	if err := in.warmupNext(); err != opm.ErrBusy {
+		t.Errorf("warmupNext = %v, want the proxy error", err)
+	}
+	if accounts.used["ash"] || accounts.accounts["ash"].CleanRuns != 0 || in.Stats().Warmups != 0 {
+		t.Errorf("account = %+v, want it returned unchanged", accounts.accounts["ash"])
+	}
+}
+
+// noProxyStore has no free proxies
+type noProxyStore struct {
+	opm.Database
+}
+
+func (noProxyStore) GetProxy() (opm.Proxy, error) {
+	return opm.Proxy{}, opm.ErrBusy
+}
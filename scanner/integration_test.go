@@ -0,0 +1,500 @@
+//go:build integration
+
+// Integration tests of the scan pipeline: the scanner HTTP server, the trainer pool and MongoDB,
+// with a fake upstream in place of the game. They need a MongoDB in OPM_TEST_MONGO, run them with
+//
+//	make integration
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/femot/pgoapi-go/auth"
+	"github.com/pogodevorg/POGOProtos-go"
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+	"gopkg.in/mgo.v2"
+
+	"golang.org/x/net/context"
+)
+
+// upstreamCall is a map request the fake upstream answered
+type upstreamCall struct {
+	Username string
+	ProxyID  int64
+}
+
+// fakeUpstream stands in for the game servers. It answers map requests with a Pokemon, a
+// Pokestop and a gym at the location of the trainer, and fails logins and map requests as
+// told. The ids depend on the location only, so rescans find the same objects.
+type fakeUpstream struct {
+	sync.Mutex
+	loginErr  map[string]error // by username
+	mapErr    map[string]error // by username
+	dead      map[int64]bool   // proxies that fail every request
+	killProxy bool             // the next map request kills its proxy
+	block     chan struct{}    // map requests wait until it is closed, if set
+	blocked   int              // map requests that waited for block
+	logins    []string
+	calls     []upstreamCall
+}
+
+func newFakeUpstream() *fakeUpstream {
+	return &fakeUpstream{loginErr: make(map[string]error), mapErr: make(map[string]error), dead: make(map[int64]bool)}
+}
+
+func (u *fakeUpstream) newSession(t *util.TrainerSession, provider auth.Provider) util.Upstream {
+	return &fakeSession{upstream: u, username: t.Account.Username, location: t.Location}
+}
+
+func (u *fakeUpstream) login(username string, proxyID int64) error {
+	u.Lock()
+	defer u.Unlock()
+	if u.dead[proxyID] {
+		return api.ErrProxyDead
+	}
+	if err := u.loginErr[username]; err != nil {
+		return err
+	}
+	u.logins = append(u.logins, username)
+	return nil
+}
+
+func (u *fakeUpstream) playerMap(ctx context.Context, username string, proxyID int64, location *api.Location) (*protos.GetMapObjectsResponse, error) {
+	u.Lock()
+	block := u.block
+	if block != nil {
+		u.blocked++
+	}
+	u.Unlock()
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	u.Lock()
+	defer u.Unlock()
+	if u.killProxy {
+		u.killProxy = false
+		u.dead[proxyID] = true
+	}
+	if u.dead[proxyID] {
+		return nil, api.ErrProxyDead
+	}
+	if err := u.mapErr[username]; err != nil {
+		return nil, err
+	}
+	u.calls = append(u.calls, upstreamCall{Username: username, ProxyID: proxyID})
+	return mapResponse(location.Lat, location.Lon), nil
+}
+
+func (u *fakeUpstream) answered() []upstreamCall {
+	u.Lock()
+	defer u.Unlock()
+	return append([]upstreamCall(nil), u.calls...)
+}
+
+// mapResponse is the response of the game to a map request at lat/lng
+func mapResponse(lat, lng float64) *protos.GetMapObjectsResponse {
+	h := fnv.New64a()
+	h.Write([]byte(cellKey(lat, lng)))
+	id := h.Sum64()
+	return &protos.GetMapObjectsResponse{MapCells: []*protos.MapCell{{
+		S2CellId: 5221390301548036096,
+		WildPokemons: []*protos.WildPokemon{{
+			EncounterId:      id,
+			Latitude:         lat + 0.0002,
+			Longitude:        lng,
+			SpawnPointId:     fmt.Sprintf("sp%x", id),
+			PokemonData:      &protos.PokemonData{PokemonId: 16},
+			TimeTillHiddenMs: 900000,
+		}},
+		Forts: []*protos.FortData{
+			{Id: fmt.Sprintf("stop%x", id), Latitude: lat, Longitude: lng + 0.0002, Type: protos.FortType_CHECKPOINT},
+			{Id: fmt.Sprintf("gym%x", id), Latitude: lat - 0.0002, Longitude: lng, Type: protos.FortType_GYM, OwnedByTeam: 1},
+		},
+	}}}
+}
+
+// fakeSession is the session of a trainer with the fake upstream
+type fakeSession struct {
+	upstream *fakeUpstream
+	username string
+	location *api.Location
+	loggedIn bool
+}
+
+func (s *fakeSession) IsExpired() bool { return !s.loggedIn }
+
+func (s *fakeSession) Init(ctx context.Context, proxyID int64) error {
+	if err := s.upstream.login(s.username, proxyID); err != nil {
+		return err
+	}
+	s.loggedIn = true
+	return nil
+}
+
+func (s *fakeSession) GetPlayerMap(ctx context.Context, proxyID int64) (*protos.GetMapObjectsResponse, error) {
+	return s.upstream.playerMap(ctx, s.username, proxyID, s.location)
+}
+
+func (s *fakeSession) MoveTo(location *api.Location) { s.location = location }
+
+// The scanner only logs in and requests maps
+func (s *fakeSession) Announce(ctx context.Context, proxyID int64) (*protos.GetMapObjectsResponse, error) {
+	return nil, errors.New("not supported by the fake upstream")
+}
+func (s *fakeSession) Call(ctx context.Context, requests []*protos.Request, proxyID int64) (*protos.ResponseEnvelope, error) {
+	return nil, errors.New("not supported by the fake upstream")
+}
+func (s *fakeSession) GetInventory(ctx context.Context, proxyID int64) (*protos.GetInventoryResponse, error) {
+	return nil, errors.New("not supported by the fake upstream")
+}
+func (s *fakeSession) GetPlayer(ctx context.Context, proxyID int64) (*protos.GetPlayerResponse, error) {
+	return nil, errors.New("not supported by the fake upstream")
+}
+
+// integrationServer is the scanner HTTP server on a fresh MongoDB database with the fake upstream
+type integrationServer struct {
+	*httptest.Server
+	upstream *fakeUpstream
+	db       *db.OpenMapDb
+}
+
+// startScanner sets up the scanner the way main does, with the accounts and proxies 1 to
+// proxies in the database and a trainer for each account
+func startScanner(t *testing.T, accounts []string, proxies int, change func(s *settings)) *integrationServer {
+	host := os.Getenv("OPM_TEST_MONGO")
+	if host == "" {
+		t.Fatal("OPM_TEST_MONGO not set, run make integration")
+	}
+	name := fmt.Sprintf("opm_integration_%d", time.Now().UnixNano())
+	mongo, err := db.NewOpenMapDb(name, host, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range accounts {
+		if err := mongo.AddAccount(opm.Account{Username: a, Password: "pw", Provider: "ptc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := 1; id <= proxies; id++ {
+		if err := mongo.AddProxy(opm.Proxy{ID: int64(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := defaultScannerSettings
+	s.Accounts = len(accounts)
+	s.ScanDelay = 0
+	s.ScansPerProxyPerMinute = 6000
+	s.CoalesceWindow = 0
+	s.PokemonWrites = writesInsert
+	s.QueueTimeout = 1
+	if change != nil {
+		change(&s)
+	}
+	u := newFakeUpstream()
+	withMetrics(t)
+	saved := saveGlobals()
+	scannerSettings, opmSettings = s, opm.DefaultSettings
+	budget = newErrorBudget(s)
+	scannerStatus = newStatusRegistry()
+	stream = newStreamHub(s.MaxStreamClients)
+	events = newEventBus()
+	subscribeAll(events)
+	feed, crypto = &api.VoidFeed{}, nil
+	util.NewUpstream = u.newSession
+	database, store = mongo, mongo
+	writer, coalescer, seen, webhooks = nil, nil, nil, nil
+
+	// Logins are not rate limited
+	ticks, done := make(chan bool), make(chan struct{})
+	loginTicks = ticks
+	go func() {
+		for {
+			select {
+			case ticks <- true:
+			case <-done:
+				return
+			}
+		}
+	}()
+	trainers := make([]*util.TrainerSession, 0)
+	for len(trainers) < s.Accounts {
+		trainer, err := NewTrainerFromDb()
+		if err != nil {
+			t.Fatal(err)
+		}
+		trainers = append(trainers, trainer)
+		scannerStatus.Set(trainer)
+	}
+	trainerQueue = util.NewTrainerQueue(trainers)
+	pool = newTrainerPool(s.Accounts, len(trainers), s.TrainerJobQueue, time.Duration(s.QueueTimeout)*time.Second)
+	trainerQueue.OnDrop = pool.Retire
+	stopped := make(chan struct{})
+	go func() {
+		pool.run()
+		close(stopped)
+	}()
+	server := httptest.NewServer(newMux())
+	t.Cleanup(func() {
+		server.Close()
+		close(done)
+		close(pool.jobs)
+		<-stopped
+		events.Close()
+		saved.restore()
+		session, err := mgo.Dial(host)
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		defer session.Close()
+		if err := session.DB(name).DropDatabase(); err != nil {
+			t.Log(err)
+		}
+	})
+	return &integrationServer{Server: server, upstream: u, db: mongo}
+}
+
+// scannerGlobals is the state of the scanner that startScanner replaces
+type scannerGlobals struct {
+	scannerSettings settings
+	opmSettings     opm.Settings
+	database        *db.OpenMapDb
+	store           opm.Database
+	budget          *errorBudget
+	scannerStatus   *statusRegistry
+	stream          *streamHub
+	events          *eventBus
+	feed            api.Feed
+	crypto          api.Crypto
+	loginTicks      chan bool
+	trainerQueue    *util.TrainerQueue
+	pool            *trainerPool
+	writer          *persistWriter
+	coalescer       *scanCoalescer
+	seen            *seenSet
+	webhooks        *webhookDispatcher
+	newUpstream     func(*util.TrainerSession, auth.Provider) util.Upstream
+}
+
+func saveGlobals() scannerGlobals {
+	return scannerGlobals{scannerSettings, opmSettings, database, store, budget, scannerStatus, stream, events,
+		feed, crypto, loginTicks, trainerQueue, pool, writer, coalescer, seen, webhooks, util.NewUpstream}
+}
+
+func (g scannerGlobals) restore() {
+	scannerSettings, opmSettings, database, store, budget, scannerStatus, stream, events = g.scannerSettings, g.opmSettings, g.database, g.store, g.budget, g.scannerStatus, g.stream, g.events
+	feed, crypto, loginTicks, trainerQueue, pool = g.feed, g.crypto, g.loginTicks, g.trainerQueue, g.pool
+	writer, coalescer, seen, webhooks, util.NewUpstream = g.writer, g.coalescer, g.seen, g.webhooks, g.newUpstream
+}
+
+// scan requests a scan of lat/lng from the server
+func (s *integrationServer) scan(t *testing.T, lat, lng float64) (int, opm.APIResponse) {
+	t.Helper()
+	resp, err := http.PostForm(s.URL+"/scan", url.Values{"lat": {fmt.Sprint(lat)}, "lng": {fmt.Sprint(lng)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r opm.APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, r
+}
+
+// types counts the objects of a response by type
+func types(objects []opm.MapObject) map[int]int {
+	counts := make(map[int]int)
+	for _, o := range objects {
+		counts[o.Type]++
+	}
+	return counts
+}
+
+func TestIntegrationScan(t *testing.T) {
+	s := startScanner(t, []string{"ash"}, 1, nil)
+	for i := 0; i < 2; i++ {
+		status, r := s.scan(t, 52.5, 13.4)
+		if status != http.StatusOK || !r.Ok {
+			t.Fatalf("scan %d: %d %+v", i, status, r)
+		}
+		if got := types(r.MapObjects); got[opm.POKEMON] != 1 || got[opm.POKESTOP] != 1 || got[opm.GYM] != 1 {
+			t.Errorf("scan %d returned %v, want a Pokemon, a Pokestop and a gym", i, got)
+		}
+		if r.Footprint == nil {
+			t.Errorf("scan %d has no footprint", i)
+		}
+	}
+	// The session of the trainer is kept between scans
+	if got := s.upstream.logins; len(got) != 1 || got[0] != "ash" {
+		t.Errorf("logins = %v, want one of ash", got)
+	}
+	if got := s.upstream.answered(); len(got) != 2 {
+		t.Errorf("upstream answered %d map requests, want 2", len(got))
+	}
+	resp, err := http.Get(s.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz = %d", resp.StatusCode)
+	}
+}
+
+func TestIntegrationPersistence(t *testing.T) {
+	s := startScanner(t, []string{"ash"}, 1, nil)
+	_, r := s.scan(t, 52.5, 13.4)
+	if !r.Ok {
+		t.Fatalf("scan failed: %+v", r)
+	}
+	for _, o := range r.MapObjects {
+		stored, err := s.db.GetObject(o.ID)
+		if err != nil {
+			t.Errorf("%s not stored: %v", o.ID, err)
+			continue
+		}
+		if stored.Type != o.Type || stored.Lat != o.Lat || stored.Lng != o.Lng {
+			t.Errorf("stored %+v, want %+v", stored, o)
+		}
+	}
+	spawnpoints, err := s.db.GetSpawnpoints(52.5, 13.4, 100)
+	if err != nil || len(spawnpoints) != 1 {
+		t.Errorf("spawnpoints = %v, %v, want the one of the Pokemon", spawnpoints, err)
+	}
+	// A rescan finds the same objects, they are not stored twice
+	if _, r := s.scan(t, 52.5, 13.4); !r.Ok {
+		t.Fatalf("rescan failed: %+v", r)
+	}
+	objects, err := s.db.GetMapObjects(52.5, 13.4, []int{opm.POKEMON, opm.POKESTOP, opm.GYM}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := types(objects); got[opm.POKEMON] != 1 || got[opm.POKESTOP] != 1 || got[opm.GYM] != 1 {
+		t.Errorf("stored %v after the rescan, want each object once", got)
+	}
+}
+
+func TestIntegrationProxyDeath(t *testing.T) {
+	s := startScanner(t, []string{"ash"}, 2, nil)
+	if _, r := s.scan(t, 52.5, 13.4); !r.Ok {
+		t.Fatalf("scan failed: %+v", r)
+	}
+	first := s.upstream.answered()[0].ProxyID
+	// The proxy dies during the next scan, which is retried with the other proxy
+	s.upstream.Lock()
+	s.upstream.killProxy = true
+	s.upstream.Unlock()
+	status, r := s.scan(t, 52.51, 13.41)
+	if status != http.StatusOK || !r.Ok || len(r.MapObjects) != 3 {
+		t.Fatalf("scan with a dying proxy = %d %+v, want the result of the retry", status, r)
+	}
+	calls := s.upstream.answered()
+	if len(calls) != 2 || calls[1].ProxyID == first {
+		t.Errorf("upstream calls = %+v, want the retry through the other proxy", calls)
+	}
+	// The trainer keeps the new proxy
+	if _, r := s.scan(t, 52.52, 13.42); !r.Ok {
+		t.Fatalf("scan after the retry failed: %+v", r)
+	}
+	if calls := s.upstream.answered(); calls[2].ProxyID != calls[1].ProxyID {
+		t.Errorf("upstream calls = %+v, want the new proxy", calls)
+	}
+
+	// Without another proxy the scan is busy and the account goes back to the database
+	s.upstream.Lock()
+	s.upstream.killProxy = true
+	s.upstream.Unlock()
+	status, r = s.scan(t, 52.53, 13.43)
+	if status != http.StatusServiceUnavailable || r.ErrorCode != opm.ErrCodeBusy {
+		t.Errorf("scan without proxies = %d %+v, want busy", status, r)
+	}
+}
+
+func TestIntegrationBanClassification(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		loginErr error
+		mapErr   error
+		reason   string
+	}{
+		{"banned", nil, api.ErrAccountBanned, opm.BanPermanent},
+		{"temporary", nil, errors.New("Empty response"), opm.BanTemporary},
+		{"credentials", errors.New("Your username or password is incorrect"), nil, opm.BanCredentials},
+		{"inactive", errors.New("Your account is not yet active"), nil, opm.BanInactive},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := startScanner(t, []string{"ash"}, 1, nil)
+			s.upstream.loginErr["ash"] = c.loginErr
+			s.upstream.mapErr["ash"] = c.mapErr
+			status, r := s.scan(t, 52.5, 13.4)
+			if status != http.StatusBadGateway || r.Ok || r.ErrorCode != opm.ErrCodeAccount {
+				t.Errorf("scan = %d %+v, want an account error", status, r)
+			}
+			if strings.Contains(r.Error, "password") || strings.Contains(r.Error, "banned") {
+				t.Errorf("error %q shows the upstream error", r.Error)
+			}
+			banned, err := s.db.GetBannedAccounts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(banned) != 1 || banned[0].Username != "ash" || banned[0].BanReason != c.reason {
+				t.Errorf("banned accounts = %+v, want ash with reason %q", banned, c.reason)
+			}
+		})
+	}
+}
+
+func TestIntegrationBusy(t *testing.T) {
+	s := startScanner(t, []string{"ash"}, 1, nil)
+	block := make(chan struct{})
+	s.upstream.Lock()
+	s.upstream.block = block
+	s.upstream.Unlock()
+	first := make(chan opm.APIResponse)
+	go func() {
+		_, r := s.scan(t, 52.5, 13.4)
+		first <- r
+	}()
+	// The only trainer is scanning, the second request gives up after the queue timeout
+	eventually(t, "the first scan", func() bool {
+		s.upstream.Lock()
+		defer s.upstream.Unlock()
+		return s.upstream.blocked == 1
+	})
+	start := time.Now()
+	status, r := s.scan(t, 52.6, 13.5)
+	if status != http.StatusServiceUnavailable || r.ErrorCode != opm.ErrCodeBusy || r.RetryAfter == nil {
+		t.Errorf("second scan = %d %+v, want busy with a retry hint", status, r)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("busy after %s, want the queue timeout", waited)
+	}
+	close(block)
+	if r := <-first; !r.Ok {
+		t.Errorf("first scan = %+v", r)
+	}
+	// The trainer is back for the next request
+	if _, r := s.scan(t, 52.6, 13.5); !r.Ok {
+		t.Errorf("scan after the busy one = %+v", r)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// janitor removes expired Pokemon, returns idle trainers to the db and reactivates
+// temporarily banned accounts, in place of the cron job that called opmctl -removepokemon
+type janitor struct {
+	interval time.Duration
+	idle     time.Duration // trainers idle this long are returned, 0 = kept
+	cooloff  time.Duration // temporary bans are lifted after this, 0 = kept
+	running  int32
+	wg       sync.WaitGroup // running cycle, only touched by run
+	stop     chan struct{}
+	done     chan struct{} // closed when run has returned
+	stopOnce sync.Once
+	mu       sync.Mutex
+	stats    janitorStats
+}
+
+// janitorStats are shown in the status summary
+type janitorStats struct {
+	LastRun      int64 `json:"last_run"`      // unix time the last cycle finished
+	LastRemoved  int   `json:"last_removed"`  // expired Pokemon removed by the last cycle
+	LastReturned int   `json:"last_returned"` // idle trainers returned by the last cycle
+	Reactivated  int   `json:"reactivated"`   // temporarily banned accounts back in rotation
+	Skipped      int64 `json:"skipped"`       // cycles skipped because the previous one was still running
+}
+
+func newJanitor(s settings) *janitor {
+	return &janitor{
+		interval: time.Duration(s.CleanupInterval) * time.Second,
+		idle:     time.Duration(s.IdleTrainerMinutes) * time.Minute,
+		cooloff:  time.Duration(s.TempBanCooloff) * time.Minute,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (j *janitor) run() {
+	t := time.NewTicker(j.interval)
+	defer t.Stop()
+	// Added and waited for in this goroutine only, so Stop can't miss a cycle
+	defer close(j.done)
+	defer j.wg.Wait()
+	for {
+		select {
+		case <-t.C:
+		case <-j.stop:
+			return
+		}
+		// No new cycle once Stop was called, even if a tick was pending too
+		select {
+		case <-j.stop:
+			return
+		default:
+		}
+		if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+			j.mu.Lock()
+			j.stats.Skipped++
+			j.mu.Unlock()
+			log.Println("Cleanup is still running, skipping a cycle")
+			continue
+		}
+		j.wg.Add(1)
+		go func() {
+			defer j.wg.Done()
+			defer atomic.StoreInt32(&j.running, 0)
+			j.cycle()
+		}()
+	}
+}
+
+// Stop ends the janitor and waits for a running cycle. run has to be started.
+func (j *janitor) Stop() {
+	j.stopOnce.Do(func() { close(j.stop) })
+	<-j.done
+}
+
+// cycle removes the expired Pokemon, returns the idle trainers and reactivates the accounts
+// whose temporary ban is over
+func (j *janitor) cycle() {
+	removed, returned, reactivated := 0, 0, 0
+	// Expired Pokemon are only removed from MongoDB
+	if store == opm.Database(database) {
+		n, err := database.RemoveOldPokemon(time.Now().Unix())
+		if err != nil {
+			log.Println(err)
+		} else {
+			removed = n
+			log.Printf("Removed %d expired Pokemon", n)
+		}
+	}
+	if j.idle > 0 && trainerQueue != nil {
+		returned = j.returnIdle(time.Now().Add(-j.idle).Unix())
+	}
+	if j.cooloff > 0 && store == opm.Database(database) {
+		n, err := database.ReactivateAccounts(opm.BanTemporary, j.cooloff)
+		if err != nil {
+			log.Println(err)
+		} else if n > 0 {
+			reactivated = n
+			log.Printf("Reactivated %d temporarily banned accounts", n)
+		}
+	}
+	j.mu.Lock()
+	j.stats.LastRun = time.Now().Unix()
+	j.stats.LastRemoved = removed
+	j.stats.LastReturned = returned
+	j.stats.Reactivated += reactivated
+	j.mu.Unlock()
+}
+
+// returnIdle takes the trainers that haven't scanned since cutoff out of the queue and
+// returns their accounts and proxies. The pool creates new trainers when it needs them.
+func (j *janitor) returnIdle(cutoff int64) int {
+	idle := trainerQueue.Prune(func(t *util.TrainerSession) bool {
+		return scannerStatus.Idle(t.Account.Username, cutoff)
+	})
+	for _, t := range idle {
+		scannerStatus.Remove(t.Account.Username)
+		pool.Retire(t)
+		if err := store.ReturnAccount(t.Account); err != nil {
+			log.Println(err)
+		}
+		if t.Proxy.ID != 0 {
+			if err := store.ReturnProxy(t.Proxy); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	if len(idle) > 0 {
+		log.Printf("Returned %d idle trainers", len(idle))
+	}
+	return len(idle)
+}
+
+// Stats returns the results of the last cycle
+func (j *janitor) Stats() janitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// withIdleTrainers queues ash, idle for two hours, and misty, who was just added
+func withIdleTrainers(t *testing.T) *fakeStore {
+	ash := util.NewTrainerSession(opm.Account{Username: "ash"}, nil, nil, nil)
+	ash.Proxy = opm.Proxy{ID: 7}
+	misty := util.NewTrainerSession(opm.Account{Username: "misty"}, nil, nil, nil)
+	_, s := withTrainers(t, ash, misty)
+	scannerStatus.nowFunc = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	scannerStatus.Set(ash)
+	scannerStatus.nowFunc = time.Now
+	scannerStatus.Set(misty)
+	eventually(t, "both trainers available", func() bool {
+		s := trainerQueue.Stats()
+		return s.Available == 2 && s.Cooling == 0
+	})
+	return s
+}
+
+// blockingStore blocks ReturnAccount until release is closed
+type blockingStore struct {
+	*fakeStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) ReturnAccount(a opm.Account) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.fakeStore.ReturnAccount(a)
+}
+
+func TestJanitorReturnsIdleTrainers(t *testing.T) {
+	s := withIdleTrainers(t)
+	j := newJanitor(settings{CleanupInterval: 1, IdleTrainerMinutes: 60})
+	if n := j.returnIdle(time.Now().Add(-j.idle).Unix()); n != 1 {
+		t.Fatalf("returnIdle = %d, want ash", n)
+	}
+	s.Lock()
+	returned := fmt.Sprint(s.accounts)
+	s.Unlock()
+	if returned != fmt.Sprint([]opm.Account{{Username: "ash"}}) {
+		t.Errorf("returned accounts %s, want ash", returned)
+	}
+	if st := trainerQueue.Stats(); st.Available != 1 {
+		t.Errorf("queue %+v, want misty left", st)
+	}
+	if scannerStatus.Idle("ash", time.Now().Unix()) || !scannerStatus.Idle("misty", time.Now().Unix()+1) {
+		t.Errorf("status %v, want only misty", scannerStatus.List())
+	}
+	// Nobody is idle anymore
+	if n := j.returnIdle(time.Now().Add(-j.idle).Unix()); n != 0 {
+		t.Errorf("second returnIdle = %d, want 0", n)
+	}
+}
+
+func TestJanitorCycleStats(t *testing.T) {
+	withIdleTrainers(t)
+	j := newJanitor(settings{CleanupInterval: 1, IdleTrainerMinutes: 60})
+	j.cycle()
+	st := j.Stats()
+	if st.LastReturned != 1 || st.LastRemoved != 0 || st.Reactivated != 0 || st.LastRun < time.Now().Unix()-1 {
+		t.Errorf("stats after a cycle = %+v, want ash returned", st)
+	}
+	j.cycle()
+	if st := j.Stats(); st.LastReturned != 0 {
+		t.Errorf("stats after the second cycle = %+v, want nothing returned", st)
+	}
+}
+
+func TestJanitorSkipsWhileRunning(t *testing.T) {
+	s := withIdleTrainers(t)
+	blocking := &blockingStore{fakeStore: s, entered: make(chan struct{}), release: make(chan struct{})}
+	store = blocking
+	j := newJanitor(settings{IdleTrainerMinutes: 60})
+	j.interval = time.Millisecond
+	go j.run()
+	select {
+	case <-blocking.entered:
+	case <-time.After(time.Second):
+		t.Fatal("the cycle didn't return ash")
+	}
+	eventually(t, "skipped cycles", func() bool { return j.Stats().Skipped >= 2 })
+
+	// Stop waits for the running cycle
+	stopped := make(chan struct{})
+	go func() {
+		j.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned with a running cycle")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(blocking.release)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop didn't return after the cycle")
+	}
+	if st := j.Stats(); st.LastReturned != 1 {
+		t.Errorf("stats = %+v, want the blocked cycle finished", st)
+	}
+}
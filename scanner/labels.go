@@ -0,0 +1,84 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/paulbellamy/ratecounter"
+)
+
+// otherLabel collects all labels above the cardinality limit
+const otherLabel = "other"
+
+var labelPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// validLabel checks a client supplied scan label. An empty label is valid.
+func validLabel(label string) bool {
+	return label == "" || labelPattern.MatchString(label)
+}
+
+// labelCounters counts scans per client label with a bounded number of distinct labels
+type labelCounters struct {
+	sync.Mutex
+	max      int
+	counters map[string]*ratecounter.RateCounter
+}
+
+func newLabelCounters(max int) *labelCounters {
+	return &labelCounters{
+		max:      max,
+		counters: make(map[string]*ratecounter.RateCounter),
+	}
+}
+
+// Incr counts a scan for the label and returns the label it was counted under
+func (l *labelCounters) Incr(label string) string {
+	if label == "" {
+		label = "none"
+	}
+	l.Lock()
+	defer l.Unlock()
+	c, ok := l.counters[label]
+	if !ok {
+		if len(l.counters) >= l.max {
+			label = otherLabel
+			c = l.counters[otherLabel]
+		}
+		if c == nil {
+			c = ratecounter.NewRateCounter(time.Minute)
+			l.counters[label] = c
+		}
+	}
+	c.Incr(1)
+	return label
+}
+
+// Rates returns the scans per minute for every label
+func (l *labelCounters) Rates() map[string]int64 {
+	l.Lock()
+	defer l.Unlock()
+	rates := make(map[string]int64)
+	for k, v := range l.counters {
+		rates[k] = v.Rate()
+	}
+	return rates
+}
+
+// ApproxBytes returns the approximate memory used by the counters
+func (l *labelCounters) ApproxBytes() int64 {
+	l.Lock()
+	defer l.Unlock()
+	return int64(len(l.counters) * 256)
+}
+
+// Shrink drops counters of labels that were not used within the last minute
+func (l *labelCounters) Shrink() {
+	l.Lock()
+	defer l.Unlock()
+	for k, v := range l.counters {
+		if v.Rate() == 0 {
+			delete(l.counters, k)
+		}
+	}
+}
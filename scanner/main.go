@@ -4,6 +4,10 @@ import (
 	"expvar"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -11,21 +15,35 @@ import (
 	"github.com/femot/gophermon/encrypt"
 	"github.com/femot/pgoapi-go/api"
 	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/db/postgres"
+	"github.com/pogointel/opm/internal/logging"
 	"github.com/pogointel/opm/opm"
 	"github.com/pogointel/opm/util"
 )
 
 var scannerSettings settings
 var opmSettings opm.Settings
-var ticks chan bool
 var loginTicks chan bool
 var feed api.Feed
 var crypto api.Crypto
+var proxyLimiter = util.NewKeyLimiter() // upstream calls per proxy id
 var trainerQueue *util.TrainerQueue
+var pool *trainerPool
 var database *db.OpenMapDb
-var scannerStatus status
+var scannerStatus *statusRegistry
 var scannerMetrics *metrics
 var blacklist map[string]bool
+var budget *errorBudget
+var stream *streamHub
+var events *eventBus
+var webhooks *webhookDispatcher
+var store opm.Database
+var seen *seenSet // nil unless PokemonWrites is "seen"
+var responder = util.NewResponder(util.JSONSerializer{}, util.ProtobufSerializer{})
+var intake *accountIntake    // nil unless quarantined accounts are warmed up
+var cleanup *janitor         // nil if CleanupInterval is 0
+var writer *persistWriter    // nil if WriteBatchSize is 0
+var coalescer *scanCoalescer // nil if CoalesceWindow is 0
 
 func main() {
 	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
@@ -39,19 +57,102 @@ func main() {
 	if err != nil {
 		log.Printf("Error loading settings (%s). Using default settings.\n", err)
 	}
-	scannerStatus = make(status)
+	util.RedactLogs(opmSettings, scannerSettings.GoogleClientSecret)
+	if err := logging.SetFormat(opmSettings.LogFormat); err != nil {
+		log.Println(err)
+	}
+	scannerStatus = newStatusRegistry()
 	crypto = &encrypt.Crypto{}
 	feed = &api.VoidFeed{}
 	api.ProxyHost = fmt.Sprintf("%s:%d", opmSettings.ProxyListenAddress, opmSettings.ProxyListenPort)
 	blacklist = make(map[string]bool)
+	initTracing(scannerSettings)
+	budget = newErrorBudget(scannerSettings)
+	stream = newStreamHub(scannerSettings.MaxStreamClients)
+	go stream.run()
+	events = newEventBus()
+	expvar.Publish("scanner_events", events)
 	// Metrics
 	scannerMetrics = NewScannerMetrics()
+	scannerMetrics.Memory = newMemoryAccountant(scannerSettings.MaxTrackedMemory)
+	scannerMetrics.ScansByLabel = newLabelCounters(scannerSettings.MaxScanLabels)
+	scannerMetrics.Inflight = newInflightLimiter(scannerSettings.MaxInFlight, time.Duration(scannerSettings.InFlightWaitMs)*time.Millisecond)
 	expvar.Publish("scanner_metrics", scannerMetrics)
+	expvar.Publish("scanner_responses", responder.Stats)
 	// Init db
-	database, err = db.NewOpenMapDb(opmSettings.DbName, opmSettings.DbHost, opmSettings.DbUser, opmSettings.DbPassword)
+	database, err = db.NewOpenMapDb(opmSettings.DbName, opmSettings.DbHost, opmSettings.DbUser, opmSettings.DbPassword, db.Options{ReadHost: opmSettings.DbReadHost, ReadTags: opmSettings.DbReadTags})
 	if err != nil {
 		log.Fatal(err)
 	}
+	database.Region = opmSettings.Region
+	database.FixSwappedCoordinates = opmSettings.FixSwappedCoordinates
+	database.SuppressAfterMisses = opmSettings.SuppressAfterMisses
+	database.Leagues = opmSettings.Leagues
+	database.SnapDistance = opmSettings.SnapDistance
+	if opmSettings.TimezoneURL != "" {
+		database.ResolveTimezone = util.NewTimezoneClient(opmSettings.TimezoneURL).Lookup
+	}
+	database.MinAccountLevel = scannerSettings.MinAccountLevel
+	database.ScanHistory = time.Duration(scannerSettings.ScanHistory) * 24 * time.Hour
+	switch scannerSettings.PokemonWrites {
+	case writesUpsert:
+		database.UpsertPokemon = true
+	case writesSeen:
+		seen = newSeenSet()
+		scannerMetrics.Memory.Track("seen_pokemon", seen)
+	case writesInsert:
+	default:
+		log.Fatalf("Unknown PokemonWrites %q", scannerSettings.PokemonWrites)
+	}
+	database.WarnClockSkew(time.Duration(opmSettings.MaxClockSkew) * time.Second)
+	store, err = openStore(database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go watchTombstones(events, database.GetDeletedSince)
+	if len(scannerSettings.WebhookURLs) > 0 || len(scannerSettings.WebhookTargets) > 0 {
+		webhooks = newWebhookDispatcher(scannerSettings)
+		webhooks.lookup = database.GetObject
+		webhooks.run()
+		expvar.Publish("scanner_webhooks", webhooks)
+	}
+	subscribeAll(events)
+	database.SetPoolLimit(opmSettings.DbPoolLimit)
+	if opmSettings.MigrateOnStartup {
+		applied, err := database.Migrate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) > 0 {
+			log.Printf("Applied migrations: %s", strings.Join(applied, ", "))
+		}
+	}
+	// Areas replace the Region setting
+	if imported, err := database.ImportRegion(); err != nil {
+		log.Println(err)
+	} else if imported {
+		log.Printf("Imported the Region setting as area %q", opm.RegionAreaID)
+	}
+	// Proxy health checks
+	// The proxy checker only knows the proxies stored in MongoDB
+	if scannerSettings.ProxyCheckInterval > 0 && scannerSettings.ProxyCheckConcurrency > 0 && store == opm.Database(database) {
+		go newProxyChecker(scannerSettings).run()
+	}
+	// Warm-up of quarantined accounts, at a location that has to be configured
+	if scannerSettings.IntakeLat == 0 && scannerSettings.IntakeLng == 0 {
+		if opmSettings.AccountIntake {
+			log.Println("Account intake is on, but no intake location is set. Quarantined accounts are not warmed up.")
+		}
+	} else if scannerSettings.IntakeInterval > 0 && store == opm.Database(database) {
+		intake = newAccountIntake(scannerSettings)
+		if scannerSettings.MockMode {
+			intake.upstream = func(*util.TrainerSession, float64, float64) error { return nil }
+		}
+		go intake.run()
+	}
+	if scannerSettings.MinAccountLevel > 0 && store != opm.Database(database) {
+		log.Println("MinAccountLevel is only supported with MongoDB, accounts of any level are used")
+	}
 	// Load trainers
 	trainers := make([]*util.TrainerSession, 0)
 	for {
@@ -61,7 +162,7 @@ func main() {
 			break
 		}
 		trainers = append(trainers, t)
-		scannerStatus[t.Account.Username] = opm.StatusEntry{AccountName: t.Account.Username, ProxyId: t.Proxy.ID}
+		scannerStatus.Set(t)
 		if len(trainers) >= scannerSettings.Accounts {
 			break
 		}
@@ -72,11 +173,11 @@ func main() {
 		for _, t := range trainers {
 			if !t.IsLoggedIn() {
 				<-loginTicks
-				log.Printf("Logging in %s", t.Account.Username)
+				log.Printf("Logging in %s", util.Username(t.Account.Username))
 				t.Context, _ = context.WithTimeout(context.Background(), 10*time.Second)
 				err := t.Login()
 				if err == api.ErrProxyDead {
-					p, err := database.GetProxy()
+					p, err := store.GetProxy()
 					if err != nil {
 						t.SetProxy(p)
 					}
@@ -95,23 +196,80 @@ func main() {
 	}(trainers)
 	// Init trainerQueue
 	trainerQueue = util.NewTrainerQueue(trainers)
+	// Only the pool creates further trainers
+	pool = newTrainerPool(scannerSettings.Accounts, len(trainers), scannerSettings.TrainerJobQueue, time.Duration(scannerSettings.QueueTimeout)*time.Second)
+	trainerQueue.OnDrop = pool.Retire
+	go pool.run()
+	// Memory accounting
+	scannerMetrics.Memory.Track("error_budget", budget)
+	scannerMetrics.Memory.Track("trainer_status", scannerStatus)
+	scannerMetrics.Memory.Track("scan_labels", scannerMetrics.ScansByLabel)
+	scannerMetrics.Memory.Track("trainer_queue", trainerQueue)
+	go scannerMetrics.Memory.Run(time.Duration(scannerSettings.MemoryCheckInterval) * time.Second)
 	// Start ticker
 	loginTicks = make(chan bool)
 	go func(d time.Duration) {
 		for {
-			loginTicks <- true
+			// No logins while scanning is paused
+			if !budget.Paused() {
+				loginTicks <- true
+			}
 			time.Sleep(d)
 		}
 	}(1 * time.Second)
-
-	ticks = make(chan bool)
-	go func(d time.Duration) {
-		for {
-			ticks <- true
-			time.Sleep(d)
-		}
-	}(time.Duration(scannerSettings.APICallRate) * time.Millisecond)
+	// Background writes of scan results
+	if scannerSettings.WriteBatchSize > 0 {
+		writer = newPersistWriter(scannerSettings)
+		go writer.run()
+		expvar.Publish("scanner_writer", writer)
+	}
+	// Requests for the same cell share one scan
+	if scannerSettings.CoalesceWindow > 0 {
+		coalescer = newScanCoalescer(time.Duration(scannerSettings.CoalesceWindow) * time.Second)
+		expvar.Publish("scanner_coalesced", coalescer)
+	}
+	// Removal of expired Pokemon and idle trainers
+	if scannerSettings.CleanupInterval > 0 {
+		cleanup = newJanitor(scannerSettings)
+		go cleanup.run()
+	}
+	go stopOnSignal()
 	// Start webserver
 	log.Println("Starting http server")
 	listenAndServe()
 }
+
+// stopOnSignal saves the buffered scan results and waits for a running cleanup before the
+// process exits on SIGINT or SIGTERM
+func stopOnSignal() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+	log.Println("Shutting down")
+	if writer != nil {
+		log.Printf("Saving %d buffered objects", writer.Pending())
+		writer.Close()
+	}
+	// Hand the queued events to the stream and the webhooks
+	events.Close()
+	if cleanup != nil {
+		cleanup.Stop()
+	}
+	os.Exit(0)
+}
+
+// openStore returns the configured backend for map objects, accounts and proxies
+func openStore(mongo *db.OpenMapDb) (opm.Database, error) {
+	switch opmSettings.DbBackend {
+	case "", opm.BackendMongo:
+		return mongo, nil
+	case opm.BackendPostgres:
+		p, err := postgres.New(opmSettings.DbDSN)
+		if err != nil {
+			return nil, err
+		}
+		p.Leagues = opmSettings.Leagues
+		return p, nil
+	}
+	return nil, fmt.Errorf("Unknown database backend %q", opmSettings.DbBackend)
+}
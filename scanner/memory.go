@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// trackedStructure is an in-process structure whose memory usage is accounted
+type trackedStructure interface {
+	// ApproxBytes returns the approximate memory used by the structure
+	ApproxBytes() int64
+	// Shrink drops data to reduce memory usage
+	Shrink()
+}
+
+// memoryAccountant keeps the tracked structures below a memory cap
+type memoryAccountant struct {
+	sync.Mutex
+	max        int64
+	structures map[string]trackedStructure
+	usage      map[string]int64
+	evictions  int
+}
+
+func newMemoryAccountant(max int64) *memoryAccountant {
+	return &memoryAccountant{
+		max:        max,
+		structures: make(map[string]trackedStructure),
+		usage:      make(map[string]int64),
+	}
+}
+
+// Track registers a structure under the given name
+func (m *memoryAccountant) Track(name string, s trackedStructure) {
+	m.Lock()
+	defer m.Unlock()
+	m.structures[name] = s
+}
+
+// Check updates the usage and shrinks structures while the cap is exceeded
+func (m *memoryAccountant) Check() {
+	m.Lock()
+	defer m.Unlock()
+	total := m.measure()
+	for round := 0; m.max > 0 && total > m.max && round < 3; round++ {
+		log.Printf("Tracked memory %d bytes exceeds cap of %d bytes, shrinking", total, m.max)
+		for _, s := range m.structures {
+			s.Shrink()
+		}
+		m.evictions++
+		total = m.measure()
+	}
+}
+
+// measure must be called with the lock held
+func (m *memoryAccountant) measure() int64 {
+	total := int64(0)
+	for name, s := range m.structures {
+		b := s.ApproxBytes()
+		m.usage[name] = b
+		total += b
+	}
+	return total
+}
+
+// Usage returns the last measured usage per structure
+func (m *memoryAccountant) Usage() map[string]int64 {
+	m.Lock()
+	defer m.Unlock()
+	usage := make(map[string]int64)
+	for k, v := range m.usage {
+		usage[k] = v
+	}
+	return usage
+}
+
+// Run checks the memory usage periodically
+func (m *memoryAccountant) Run(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for {
+		m.Check()
+		time.Sleep(interval)
+	}
+}
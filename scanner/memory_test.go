@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// TestMemoryBoundedUnderChurn fast-forwards three weeks of account churn through the
+// tracked structures and checks that the accountant keeps them below the cap
+func TestMemoryBoundedUnderChurn(t *testing.T) {
+	const (
+		hours         = 3 * 7 * 24
+		accountsPerH  = 30
+		bannedPerH    = 20
+		pokemonPerH   = 100
+		memoryCap     = 32 << 10
+		entriesPerBan = 160
+	)
+	clock := newFakeClock()
+	registry := newStatusRegistry()
+	registry.nowFunc = clock.Now
+	b := newErrorBudget(settings{FailureWindow: 600, PauseCooldown: 1800})
+	b.nowFunc = clock.Now
+	seen := newSeenSet()
+	labels := newLabelCounters(20)
+	m := newMemoryAccountant(memoryCap)
+	m.Track("trainer_status", registry)
+	m.Track("error_budget", b)
+	m.Track("seen_pokemon", seen)
+	m.Track("scan_labels", labels)
+
+	account := 0
+	for h := 0; h < hours; h++ {
+		for i := 0; i < accountsPerH; i++ {
+			account++
+			trainer := &util.TrainerSession{Account: opm.Account{Username: fmt.Sprintf("trainer%d", account)}}
+			registry.Set(trainer)
+			registry.Scanning(trainer.Account.Username, 1, 2)
+			registry.Done(trainer.Account.Username, nil)
+			b.RecordScan(i%3 != 0)
+			labels.Incr(fmt.Sprintf("client%d", account%50))
+			if i < bannedPerH {
+				registry.Banned(trainer.Account.Username)
+				b.RecordBan()
+			} else {
+				registry.Remove(trainer.Account.Username)
+			}
+		}
+		var pokemon []opm.MapObject
+		for i := 0; i < pokemonPerH; i++ {
+			pokemon = append(pokemon, opm.MapObject{Type: opm.POKEMON, ID: fmt.Sprintf("%d-%d", h, i), Expiry: clock.Now().Add(15 * time.Minute).Unix()})
+		}
+		seen.Filter(pokemon, clock.Now())
+
+		m.Check()
+		total := int64(0)
+		for _, bytes := range m.Usage() {
+			total += bytes
+		}
+		if total > memoryCap {
+			t.Fatalf("hour %d: %d bytes tracked, cap is %d", h, total, memoryCap)
+		}
+		clock.Advance(time.Hour)
+	}
+	if m.evictions == 0 {
+		t.Error("the cap never fired")
+	}
+	// Without Shrink every banned account of the three weeks would still be listed
+	if n := registry.ApproxBytes() / entriesPerBan; n > 10*bannedPerH {
+		t.Errorf("%d status entries left after %d banned accounts", n, hours*bannedPerH)
+	}
+	// The pause decision still has every sample of its windows
+	if s := b.State(); s.BansLastHour != bannedPerH {
+		t.Errorf("%d bans in the last hour after shrinking, want %d", s.BansLastHour, bannedPerH)
+	}
+}
+
+func TestBudgetShrinkKeepsWindow(t *testing.T) {
+	b, clock := withBudget(t, settings{MaxFailureRate: 50, MinFailureSamples: 10, FailureWindow: 600, PauseCooldown: 1800})
+	for i := 0; i < 6; i++ {
+		b.RecordScan(true)
+	}
+	clock.Advance(11 * time.Minute)
+	for i := 0; i < 9; i++ {
+		b.RecordScan(i%2 != 0)
+	}
+	b.Shrink()
+	if got := b.ApproxBytes(); got != 9*32 {
+		t.Errorf("%d bytes after Shrink, want the 9 samples of the window", got)
+	}
+	// The 10th sample in the window trips the pause with 6 of 10 failed. Had Shrink dropped
+	// samples of the window there would be too few of them.
+	b.RecordScan(false)
+	if !b.Paused() {
+		t.Errorf("not paused with %+v", b.State())
+	}
+}
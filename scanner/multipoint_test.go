@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// TestMultiPointResponses checks the response of /batchscan, /areascan and /routescan for
+// the three outcomes of the partial-result contract
+func TestMultiPointResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		status   int
+		partial  string
+		err      string
+	}{
+		{"all succeeded", []string{opm.PointOk, opm.PointOk}, 200, "", ""},
+		{"partial", []string{opm.PointOk, opm.PointFailed}, 200, "true", "Scan failed"},
+		{"nothing succeeded", []string{opm.PointFailed, opm.PointSkipped}, 502, "", "Scan failed"},
+	}
+	for _, test := range tests {
+		var response opm.MultiPointResponse
+		for _, s := range test.statuses {
+			response.Points = append(response.Points, opm.PointStatus{Status: s})
+		}
+		w := httptest.NewRecorder()
+		writeMultiPointResponse(w, httptest.NewRequest("POST", "/batchscan", nil), response, "")
+		if w.Code != test.status || w.Header().Get("X-Partial-Result") != test.partial {
+			t.Errorf("%s: %d with X-Partial-Result %q, want %d %q", test.name, w.Code, w.Header().Get("X-Partial-Result"), test.status, test.partial)
+		}
+		var got opm.MultiPointResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Error != test.err || len(got.Points) != len(test.statuses) || got.Succeeded+got.Failed+got.Skipped != len(test.statuses) {
+			t.Errorf("%s: body %s", test.name, w.Body)
+		}
+	}
+	// Errors before any point was scanned
+	w := httptest.NewRecorder()
+	writeMultiPointResponse(w, httptest.NewRequest("POST", "/routescan", nil), opm.MultiPointResponse{}, "Wrong format")
+	if w.Code != 400 {
+		t.Errorf("wrong format = %d, want 400", w.Code)
+	}
+	withBudget(t, settings{})
+	withMetrics(t)
+	w = httptest.NewRecorder()
+	writeMultiPointResponse(w, httptest.NewRequest("POST", "/areascan", nil), opm.MultiPointResponse{}, opm.ErrBusy.Error())
+	if w.Code != 503 {
+		t.Errorf("busy = %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// Timeouts of the trainer pool
+const (
+	candidateWait = 100 * time.Millisecond // time a request waits for further trainer candidates
+	createBackoff = 30 * time.Second       // pause after a trainer could not be created from the db
+)
+
+// trainerPool hands out trainers to the handlers. Requests wait on a bounded queue and are
+// served in order by a single manager goroutine. The manager creates new trainers up to the
+// target, beyond it only jobs that no trainer has the budget for get one, see Create.
+type trainerPool struct {
+	jobs       chan *trainerJob
+	timeout    time.Duration // time a request waits in the queue
+	target     int64
+	size       int64 // trainers alive, loaded at startup or created by the manager
+	nextCreate time.Time
+	// Stats
+	created   int64
+	rejected  int64
+	served    int64
+	abandoned int64
+	expired   int64
+	waitNs    int64
+}
+
+// States of a trainer job, a job is either served or abandoned by its request
+const (
+	jobWaiting int32 = iota
+	jobServed
+	jobAbandoned
+)
+
+type trainerJob struct {
+	ctx      context.Context
+	queued   time.Time
+	deadline time.Time
+	state    int32
+	reply    chan trainerResult
+}
+
+type trainerResult struct {
+	trainer *util.TrainerSession
+	err     error
+}
+
+// poolStats is a snapshot of the trainer pool metrics
+type poolStats struct {
+	Target    int64 `json:"target"`
+	Size      int64 `json:"size"`
+	Depth     int   `json:"depth"`
+	Capacity  int   `json:"capacity"`
+	Created   int64 `json:"created"`
+	Rejected  int64 `json:"rejected"`
+	Abandoned int64 `json:"abandoned"` // the request was cancelled while it waited
+	Expired   int64 `json:"expired"`   // no trainer within the queue timeout
+	WaitAvgMs int64 `json:"wait_avg_ms"`
+}
+
+// newTrainerPool creates a pool that already holds size trainers. At most queue requests
+// wait for a trainer, each for up to timeout.
+func newTrainerPool(target, size, queue int, timeout time.Duration) *trainerPool {
+	if queue <= 0 {
+		queue = 1
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &trainerPool{
+		jobs:    make(chan *trainerJob, queue),
+		timeout: timeout,
+		target:  int64(target),
+		size:    int64(size),
+	}
+}
+
+// Get returns a trainer. Requests are served in order and wait until a trainer is available,
+// the queue timeout passed or ctx is done. Get fails with opm.ErrBusy right away when too many
+// requests are waiting already, and when no trainer became available in time.
+func (p *trainerPool) Get(ctx context.Context) (*util.TrainerSession, error) {
+	job := &trainerJob{ctx: ctx, queued: time.Now(), deadline: time.Now().Add(p.timeout), reply: make(chan trainerResult, 1)}
+	if d, ok := ctx.Deadline(); ok && d.Before(job.deadline) {
+		job.deadline = d
+	}
+	select {
+	case p.jobs <- job:
+	default:
+		atomic.AddInt64(&p.rejected, 1)
+		return nil, opm.ErrBusy
+	}
+	if position := len(p.jobs); position > 1 {
+		log.Printf("Waiting for a trainer at queue position %d", position)
+	}
+	timer := time.NewTimer(time.Until(job.deadline))
+	defer timer.Stop()
+	select {
+	case r := <-job.reply:
+		return r.trainer, r.err
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	if atomic.CompareAndSwapInt32(&job.state, jobWaiting, jobAbandoned) {
+		if ctx.Err() != nil {
+			atomic.AddInt64(&p.abandoned, 1)
+		} else {
+			atomic.AddInt64(&p.expired, 1)
+		}
+		return nil, opm.ErrBusy
+	}
+	// Served in the meantime
+	r := <-job.reply
+	return r.trainer, r.err
+}
+
+// Retire removes a trainer that the queue dropped, so a replacement can be created
+func (p *trainerPool) Retire(t *util.TrainerSession) {
+	atomic.AddInt64(&p.size, -1)
+}
+
+// run serves the queued requests. Jobs whose request is gone pass their trainer on to the next job.
+func (p *trainerPool) run() {
+	for job := range p.jobs {
+		if atomic.LoadInt32(&job.state) != jobWaiting {
+			continue
+		}
+		trainer, err := p.acquire(job.deadline)
+		if !atomic.CompareAndSwapInt32(&job.state, jobWaiting, jobServed) {
+			if err == nil {
+				trainerQueue.Queue(trainer, 0)
+			}
+			continue
+		}
+		atomic.AddInt64(&p.waitNs, int64(time.Since(job.queued)))
+		atomic.AddInt64(&p.served, 1)
+		job.reply <- trainerResult{trainer: trainer, err: err}
+	}
+}
+
+// acquire creates a trainer while the pool is below its target, otherwise it waits for a queued
+// one until the deadline
+func (p *trainerPool) acquire(deadline time.Time) (*util.TrainerSession, error) {
+	if atomic.LoadInt64(&p.size) < p.target && time.Now().After(p.nextCreate) {
+		trainer, err := NewTrainerFromDb()
+		if err == nil {
+			atomic.AddInt64(&p.size, 1)
+			atomic.AddInt64(&p.created, 1)
+			scannerStatus.Set(trainer)
+			return trainer, nil
+		}
+		if errors.Is(err, db.ErrUnavailable) {
+			log.Println(err)
+		}
+		// Don't ask the db for every request while there are no free accounts or proxies
+		p.nextCreate = time.Now().Add(createBackoff)
+	}
+	trainer, err := trainerQueue.Get(time.Until(deadline))
+	if err != nil {
+		return nil, opm.ErrBusy
+	}
+	return trainer, nil
+}
+
+// Create creates a trainer from the db for a job that no queued trainer has the budget for.
+// It is counted like the trainers of the manager, even beyond the target.
+func (p *trainerPool) Create() (*util.TrainerSession, error) {
+	trainer, err := NewTrainerFromDb()
+	if err != nil {
+		if errors.Is(err, db.ErrUnavailable) {
+			log.Println(err)
+		}
+		return nil, err
+	}
+	atomic.AddInt64(&p.size, 1)
+	atomic.AddInt64(&p.created, 1)
+	scannerStatus.Set(trainer)
+	return trainer, nil
+}
+
+// retryAfter sets the Retry-After header of a busy or paused scanner and returns the hint for
+// the response. Paused clients wait for the end of the pause. Busy clients wait until the queued
+// requests are through at the current scan rate, or for the next trainer out of its cooldown.
+func retryAfter(w http.ResponseWriter, paused bool) *opm.RetryHint {
+	fallback := util.RetrySignal{Reason: opm.RetryReasonBusy, Wait: time.Duration(scannerSettings.BusyRetryAfter) * time.Second}
+	if paused {
+		var wait time.Duration
+		if s := budget.State(); s.Paused {
+			wait = time.Until(time.Unix(s.Until, 0))
+		}
+		return util.RetryAfter(w, fallback, util.RetrySignal{Reason: opm.RetryReasonPaused, Wait: wait})
+	}
+	var queue, cooldown time.Duration
+	if rate := scannerMetrics.ScansPerMinute.Rate(); rate > 0 && pool != nil && len(pool.jobs) > 0 {
+		queue = time.Duration(float64(len(pool.jobs)+1) * float64(time.Minute) / float64(rate))
+	}
+	if trainerQueue != nil {
+		cooldown = trainerQueue.NextReady()
+	}
+	return util.RetryAfter(w, fallback,
+		util.RetrySignal{Reason: opm.RetryReasonQueue, Wait: queue},
+		util.RetrySignal{Reason: opm.RetryReasonCooldown, Wait: cooldown})
+}
+
+// candidateContext returns the context for fetching the i-th trainer candidate of a request.
+// Only the first one waits in the queue, further candidates are taken if they are available.
+func candidateContext(ctx context.Context, i int) (context.Context, context.CancelFunc) {
+	if i == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, candidateWait)
+}
+
+// Stats returns the current pool metrics
+func (p *trainerPool) Stats() poolStats {
+	s := poolStats{
+		Target:    p.target,
+		Size:      atomic.LoadInt64(&p.size),
+		Depth:     len(p.jobs),
+		Capacity:  cap(p.jobs),
+		Created:   atomic.LoadInt64(&p.created),
+		Rejected:  atomic.LoadInt64(&p.rejected),
+		Abandoned: atomic.LoadInt64(&p.abandoned),
+		Expired:   atomic.LoadInt64(&p.expired),
+	}
+	if served := atomic.LoadInt64(&p.served); served > 0 {
+		s.WaitAvgMs = atomic.LoadInt64(&p.waitNs) / served / int64(time.Millisecond)
+	}
+	return s
+}
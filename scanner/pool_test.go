@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+func TestPoolLoadNeverExceedsTarget(t *testing.T) {
+	const workers = 4
+	withSettings(t, func(s *settings) { s.ScanDelay, s.MaxJumpSpeed, s.StickyRadius, s.MockMode = 0, 0, 0, false })
+	u, s := withTrainers(t)
+	pool.target = workers
+	for i := 0; i < 50; i++ {
+		s.accounts = append(s.accounts, opm.Account{Username: fmt.Sprintf("trainer%d", i)})
+	}
+	getMapResult = func(trainer *util.TrainerSession, lat, lng float64) ([]opm.MapObject, error) {
+		time.Sleep(10 * time.Millisecond)
+		return u.getMapResult(trainer, lat, lng)
+	}
+
+	// Five times as many clients as trainers, scanning different points so they aren't shared
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	statuses := make(map[int]int)
+	for c := 0; c < 5*workers; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				values := url.Values{"lat": {fmt.Sprintf("52.%02d%02d", c, i)}, "lng": {"13.4"}}
+				r := httptest.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				w := httptest.NewRecorder()
+				requestHandler(w, r)
+				if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+					t.Error("503 without Retry-After")
+				}
+				mutex.Lock()
+				statuses[w.Code]++
+				mutex.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	s.Lock()
+	checkedOut := 50 - len(s.accounts)
+	s.Unlock()
+	if checkedOut > workers {
+		t.Errorf("%d accounts checked out, want at most %d", checkedOut, workers)
+	}
+	stats := pool.Stats()
+	if stats.Size > workers || stats.Created != int64(checkedOut) {
+		t.Errorf("pool = %+v, want at most %d trainers, all created by the manager", stats, workers)
+	}
+	if statuses[http.StatusOK] == 0 || statuses[http.StatusOK]+statuses[http.StatusServiceUnavailable] != 50*workers {
+		t.Errorf("statuses = %v, want successful scans and the rest busy", statuses)
+	}
+}
+
+func TestPoolRejectsWhenQueueIsFull(t *testing.T) {
+	// Without the manager the first request waits in the queue until it times out
+	p := newTrainerPool(1, 0, 1, 100*time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, err := p.Get(context.Background())
+		done <- err
+	}()
+	eventually(t, "request queued", func() bool { return len(p.jobs) == 1 })
+	if _, err := p.Get(context.Background()); err != opm.ErrBusy {
+		t.Errorf("Get with a full queue = %v, want ErrBusy", err)
+	}
+	if err := <-done; err != opm.ErrBusy {
+		t.Errorf("Get after the queue timeout = %v, want ErrBusy", err)
+	}
+	if s := p.Stats(); s.Depth != 1 || s.Capacity != 1 || s.Rejected != 1 || s.Expired != 1 {
+		t.Errorf("stats = %+v, want one rejected and one expired request", s)
+	}
+}
+
+// withPool replaces the pool of withTrainers with one whose requests wait for timeout.
+// Its manager only serves the queue once start is called.
+func withPool(t *testing.T, timeout time.Duration, trainers ...*util.TrainerSession) (p *trainerPool, start func()) {
+	withTrainers(t, trainers...)
+	old := pool
+	p = newTrainerPool(len(trainers), len(trainers), 10, timeout)
+	pool = p
+	done := make(chan struct{})
+	started := false
+	t.Cleanup(func() {
+		close(p.jobs)
+		if started {
+			<-done
+		}
+		pool = old
+	})
+	return p, func() {
+		started = true
+		go func() {
+			p.run()
+			close(done)
+		}()
+	}
+}
+
+func TestPoolServesInOrder(t *testing.T) {
+	p, start := withPool(t, 5*time.Second, budgetTrainer("trainer", 0, 0))
+	var mutex sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			trainer, err := p.Get(context.Background())
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+			trainerQueue.Queue(trainer, 0)
+		}(i)
+		eventually(t, fmt.Sprintf("request %d queued", i), func() bool { return len(p.jobs) == i })
+	}
+	// One trainer serves the queued requests one after the other
+	start()
+	wg.Wait()
+	if fmt.Sprint(order) != "[1 2 3]" {
+		t.Errorf("requests served in order %v, want the order they were queued in", order)
+	}
+}
+
+func TestPoolAbandonedRequestPassesTrainerOn(t *testing.T) {
+	p, start := withPool(t, 5*time.Second, budgetTrainer("trainer", 0, 0))
+	busy, err := trainerQueue.Get(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := p.Get(ctx)
+		first <- err
+	}()
+	eventually(t, "first request queued", func() bool { return len(p.jobs) == 1 })
+	second := make(chan *util.TrainerSession)
+	go func() {
+		trainer, err := p.Get(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		second <- trainer
+	}()
+	eventually(t, "second request queued", func() bool { return len(p.jobs) == 2 })
+	// The first request gives up while the manager waits for a trainer on its behalf
+	start()
+	eventually(t, "the manager took the first request", func() bool { return len(p.jobs) == 1 })
+	cancel()
+	if err := <-first; err != opm.ErrBusy {
+		t.Errorf("cancelled request = %v, want ErrBusy", err)
+	}
+	trainerQueue.Queue(busy, 0)
+	select {
+	case trainer := <-second:
+		if trainer != busy {
+			t.Errorf("second request got %v, want the trainer of the first", trainer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the trainer of the cancelled request was not passed on")
+	}
+	if s := p.Stats(); s.Abandoned != 1 || s.Expired != 0 {
+		t.Errorf("stats = %+v, want one abandoned request", s)
+	}
+}
+
+func TestScanLeavesQueueWhenClientDisconnects(t *testing.T) {
+	withSettings(t, func(s *settings) { s.ScanDelay, s.MaxJumpSpeed, s.StickyRadius, s.MockMode = 0, 0, 0, false })
+	p, start := withPool(t, 5*time.Second, budgetTrainer("trainer", 0, 0))
+	u := &scriptedUpstream{}
+	getMapResult = u.getMapResult
+	busy, err := trainerQueue.Get(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"lat": {"52.5"}, "lng": {"13.4"}}.Encode())).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	done := make(chan struct{})
+	go func() {
+		requestHandler(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	eventually(t, "the request waits for a trainer", func() bool { return len(p.jobs) == 1 })
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the handler still waits after the client disconnected")
+	}
+	if s := p.Stats(); s.Abandoned != 1 {
+		t.Errorf("stats = %+v, want the disconnected request abandoned", s)
+	}
+	// The manager skips the abandoned request
+	start()
+	trainerQueue.Queue(busy, 0)
+	if w, resp := scanRequest(t, "POST"); w.Code != http.StatusOK || !resp.Ok {
+		t.Errorf("next scan = %d %+v, want the trainer back", w.Code, resp)
+	}
+	if len(u.scans) != 1 {
+		t.Errorf("scans = %v, want only the one of the next request", u.scans)
+	}
+}
+
+func TestBusyRetryAfterFromQueue(t *testing.T) {
+	withSettings(t, func(s *settings) { s.BusyRetryAfter = 5 })
+	p, _ := withPool(t, time.Minute)
+	w := httptest.NewRecorder()
+	if hint := retryAfter(w, false); hint.Reason != opm.RetryReasonBusy || hint.Seconds != 5 {
+		t.Errorf("hint without a scan rate = %+v, want the fallback", hint)
+	}
+	// Two requests are waiting and the scanner does a scan per second
+	p.jobs <- &trainerJob{}
+	p.jobs <- &trainerJob{}
+	scannerMetrics.ScansPerMinute.Incr(60)
+	w = httptest.NewRecorder()
+	hint := retryAfter(w, false)
+	if hint.Reason != opm.RetryReasonQueue || hint.Seconds != 3 || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("hint = %+v, Retry-After %q, want 3 s for the queue and this request", hint, w.Header().Get("Retry-After"))
+	}
+	var resp opm.APIResponse
+	w = httptest.NewRecorder()
+	writeScanError(w, httptest.NewRequest("POST", "/", nil), opm.ErrBusy)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusServiceUnavailable || resp.RetryAfter == nil || resp.RetryAfter.Seconds != 3 {
+		t.Errorf("busy response = %d %s, want the queue hint", w.Code, w.Body)
+	}
+}
+
+func TestBusyRetryAfterFromCooldown(t *testing.T) {
+	withSettings(t, func(s *settings) { s.BusyRetryAfter = 5 })
+	trainer := budgetTrainer("trainer", 0, 0)
+	withPool(t, time.Minute, trainer)
+	if _, err := trainerQueue.Get(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is queued, the only trainer is back after its scan delay
+	trainerQueue.Queue(trainer, 20*time.Second)
+	if hint := retryAfter(httptest.NewRecorder(), false); hint.Reason != opm.RetryReasonCooldown || hint.Seconds != 20 {
+		t.Errorf("hint = %+v, want 20 s until the trainer is ready", hint)
+	}
+}
+
+func TestPausedRetryAfter(t *testing.T) {
+	withSettings(t, func(s *settings) { s.BusyRetryAfter = 5 })
+	withTrainers(t)
+	b, _ := withBudget(t, settings{MaxBansPerHour: 1, FailureWindow: 600, PauseCooldown: 120})
+	b.nowFunc = time.Now
+	b.RecordBan()
+	b.RecordBan()
+	if hint := retryAfter(httptest.NewRecorder(), true); hint.Reason != opm.RetryReasonPaused || hint.Seconds < 119 || hint.Seconds > 120 {
+		t.Errorf("hint = %+v, want the 120 s until the end of the pause", hint)
+	}
+	// Once the pause is lifted the fallback applies
+	b.Resume()
+	if hint := retryAfter(httptest.NewRecorder(), true); hint.Reason != opm.RetryReasonBusy || hint.Seconds != 5 {
+		t.Errorf("hint after the pause = %+v, want the fallback", hint)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// proxyCheckStore is the part of the db the proxy checker uses
+type proxyCheckStore interface {
+	GetProxiesToCheck(checkedBefore int64, limit int) ([]opm.Proxy, error)
+	ClaimProxy(id int64) (bool, error)
+	RecordProxyCheck(id int64) error
+	MarkProxyDead(id int64) error
+	ReturnProxy(p opm.Proxy) error
+}
+
+// proxyChecker periodically checks unused proxies, so dead ones are found before
+// a scan wastes a login on them. Only proxies with an URL can be checked, proxies
+// connected to the hub are marked dead by the hub when they disconnect.
+type proxyChecker struct {
+	store       proxyCheckStore
+	target      string
+	interval    time.Duration
+	concurrency int
+	maxFailures int
+	timeout     time.Duration
+	// Consecutive failed checks per proxy id
+	failuresMutex sync.Mutex
+	failures      map[int64]int
+}
+
+func newProxyChecker(s settings) *proxyChecker {
+	maxFailures := s.ProxyCheckFailures
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	return &proxyChecker{
+		store:       database,
+		target:      s.ProxyCheckURL,
+		interval:    time.Duration(s.ProxyCheckInterval) * time.Second,
+		concurrency: s.ProxyCheckConcurrency,
+		maxFailures: maxFailures,
+		timeout:     10 * time.Second,
+		failures:    make(map[int64]int),
+	}
+}
+
+func (c *proxyChecker) run() {
+	wait := c.interval
+	for {
+		time.Sleep(wait)
+		n := c.checkAll()
+		if n == 0 {
+			// Nothing to check, back off up to 10 intervals
+			if wait < 10*c.interval {
+				wait *= 2
+			}
+			continue
+		}
+		wait = c.interval
+	}
+}
+
+// checkAll checks every proxy that is due and returns the number of checked proxies
+func (c *proxyChecker) checkAll() int {
+	proxies, err := c.store.GetProxiesToCheck(time.Now().Add(-c.interval).Unix(), 100*c.concurrency)
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.concurrency)
+	for _, p := range proxies {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p opm.Proxy) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c.checkOne(p)
+		}(p)
+	}
+	wg.Wait()
+	return len(proxies)
+}
+
+// checkOne checks a proxy while it's marked as used, so no trainer gets it during the
+// check. The proxy is only marked dead after maxFailures failed checks in a row.
+func (c *proxyChecker) checkOne(p opm.Proxy) {
+	claimed, err := c.store.ClaimProxy(p.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !claimed {
+		// A trainer took the proxy since it was listed
+		return
+	}
+	err = c.request(p)
+	if err == nil {
+		c.resetFailures(p.ID)
+		if err := c.store.RecordProxyCheck(p.ID); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	n := c.addFailure(p.ID)
+	log.Printf("Proxy %d failed health check %d/%d: %s", p.ID, n, c.maxFailures, err)
+	if n < c.maxFailures {
+		if err := c.store.ReturnProxy(p); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	c.resetFailures(p.ID)
+	if err := c.store.MarkProxyDead(p.ID); err != nil {
+		log.Println(err)
+	}
+}
+
+func (c *proxyChecker) addFailure(id int64) int {
+	c.failuresMutex.Lock()
+	defer c.failuresMutex.Unlock()
+	c.failures[id]++
+	return c.failures[id]
+}
+
+func (c *proxyChecker) resetFailures(id int64) {
+	c.failuresMutex.Lock()
+	defer c.failuresMutex.Unlock()
+	delete(c.failures, id)
+}
+
+// request sends a HEAD request to the target through the proxy. The transport is only
+// used for this request, its connection is closed afterwards.
+func (c *proxyChecker) request(p opm.Proxy) error {
+	transport, err := util.ProxyTransport(p)
+	if err != nil {
+		return err
+	}
+	if transport == nil {
+		return errors.New("proxy has no URL")
+	}
+	transport.DisableKeepAlives = true
+	defer transport.CloseIdleConnections()
+	client := http.Client{
+		Timeout:   c.timeout,
+		Transport: transport,
+	}
+	resp, err := client.Head(c.target)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// proxyStore is a fake db with the proxy states the checker changes
+type proxyStore struct {
+	sync.Mutex
+	proxies map[int64]*opm.Proxy
+	checks  map[int64]int
+}
+
+func newProxyStore(proxies ...opm.Proxy) *proxyStore {
+	s := &proxyStore{proxies: make(map[int64]*opm.Proxy), checks: make(map[int64]int)}
+	for i := range proxies {
+		s.proxies[proxies[i].ID] = &proxies[i]
+	}
+	return s
+}
+
+func (s *proxyStore) GetProxiesToCheck(checkedBefore int64, limit int) ([]opm.Proxy, error) {
+	s.Lock()
+	defer s.Unlock()
+	var result []opm.Proxy
+	for _, p := range s.proxies {
+		if !p.Use && !p.Dead && p.URL != "" && p.LastCheck < checkedBefore {
+			result = append(result, *p)
+		}
+	}
+	return result, nil
+}
+
+func (s *proxyStore) ClaimProxy(id int64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	p := s.proxies[id]
+	if p.Use || p.Dead {
+		return false, nil
+	}
+	p.Use = true
+	return true, nil
+}
+
+func (s *proxyStore) RecordProxyCheck(id int64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.proxies[id].Use = false
+	s.checks[id]++
+	return nil
+}
+
+func (s *proxyStore) MarkProxyDead(id int64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.proxies[id].Use, s.proxies[id].Dead = false, true
+	return nil
+}
+
+func (s *proxyStore) ReturnProxy(p opm.Proxy) error {
+	s.Lock()
+	defer s.Unlock()
+	s.proxies[p.ID].Use, s.proxies[p.ID].Dead = false, false
+	return nil
+}
+
+func (s *proxyStore) get(id int64) opm.Proxy {
+	s.Lock()
+	defer s.Unlock()
+	return *s.proxies[id]
+}
+
+func (s *proxyStore) checked(id int64) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.checks[id]
+}
+
+func newTestProxyChecker(store proxyCheckStore, maxFailures int) *proxyChecker {
+	c := newProxyChecker(settings{ProxyCheckURL: "http://check.invalid/version", ProxyCheckInterval: 300, ProxyCheckConcurrency: 2, ProxyCheckFailures: maxFailures})
+	c.store = store
+	return c
+}
+
+func TestProxyCheckMarksDeadAfterConsecutiveFailures(t *testing.T) {
+	// A closed listener refuses the connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	store := newProxyStore(opm.Proxy{ID: 1, URL: "http://" + l.Addr().String()})
+	c := newTestProxyChecker(store, 3)
+	p := store.get(1)
+
+	c.checkOne(p)
+	c.checkOne(p)
+	if got := store.get(1); got.Dead || got.Use {
+		t.Fatalf("proxy after 2 failures = %+v, want alive and unused", got)
+	}
+	c.checkOne(p)
+	if got := store.get(1); !got.Dead || got.Use {
+		t.Fatalf("proxy after 3 failures = %+v, want dead and unused", got)
+	}
+}
+
+func TestProxyCheckSuccessResetsFailures(t *testing.T) {
+	var failing int32 = 1
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			// Drop the connection like a broken proxy
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer proxy.Close()
+	store := newProxyStore(opm.Proxy{ID: 1, URL: proxy.URL})
+	c := newTestProxyChecker(store, 2)
+	p := store.get(1)
+
+	c.checkOne(p)
+	atomic.StoreInt32(&failing, 0)
+	c.checkOne(p)
+	atomic.StoreInt32(&failing, 1)
+	c.checkOne(p)
+	if got := store.get(1); got.Dead {
+		t.Fatal("proxy marked dead, a success in between should reset the failures")
+	}
+	c.checkOne(p)
+	if got := store.get(1); !got.Dead {
+		t.Fatal("proxy not marked dead after 2 failures in a row")
+	}
+}
+
+func TestProxyCheckClaimsProxy(t *testing.T) {
+	var store *proxyStore
+	var inUse int32
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.URL.String() != "http://check.invalid/version" {
+			t.Errorf("proxy got %s %s, want HEAD of the target", r.Method, r.URL)
+		}
+		if store.get(1).Use {
+			atomic.StoreInt32(&inUse, 1)
+		}
+	}))
+	defer proxy.Close()
+	var conns, closed int32
+	proxy.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&conns, 1)
+		case http.StateClosed:
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	proxy.Start()
+	store = newProxyStore(opm.Proxy{ID: 1, URL: proxy.URL}, opm.Proxy{ID: 2, URL: proxy.URL, Use: true})
+	c := newTestProxyChecker(store, 3)
+
+	if n := c.checkAll(); n != 1 {
+		t.Fatalf("checked %d proxies, want only the unused one", n)
+	}
+	if atomic.LoadInt32(&inUse) != 1 {
+		t.Error("proxy not marked as used during its check")
+	}
+	if got := store.get(1); got.Use || store.checked(1) != 1 {
+		t.Errorf("proxy after the check = %+v with %d checks, want unused and one check", got, store.checked(1))
+	}
+	// A trainer takes the proxy after it was listed
+	p := store.get(1)
+	store.Lock()
+	store.proxies[1].Use = true
+	store.Unlock()
+	c.checkOne(p)
+	if store.checked(1) != 1 || !store.get(1).Use {
+		t.Error("checked a proxy a trainer uses")
+	}
+	// The checks leave no connections open
+	eventually(t, "closed connections", func() bool { return atomic.LoadInt32(&closed) == atomic.LoadInt32(&conns) })
+}
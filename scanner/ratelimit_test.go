@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+func TestProxySwapMovesToNewLimiter(t *testing.T) {
+	withSettings(t, func(s *settings) { s.ScansPerProxyPerMinute = 60 })
+	old := proxyLimiter
+	proxyLimiter = util.NewKeyLimiter()
+	defer func() { proxyLimiter = old }()
+	trainer := budgetTrainer("ash", 0, 0)
+	trainer.SetProxy(opm.Proxy{ID: 1})
+	other := budgetTrainer("misty", 0, 0)
+	other.SetProxy(opm.Proxy{ID: 1})
+	wait := func(name string, trainer *util.TrainerSession, want error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		trainer.Context = ctx
+		if err := waitForProxy(trainer); err != want {
+			t.Errorf("%s: waitForProxy = %v, want %v", name, err, want)
+		}
+	}
+	wait("first call", trainer, nil)
+	// The limit is per proxy, not per trainer
+	wait("other trainer on the proxy", other, context.DeadlineExceeded)
+	// After ErrProxyDead the trainer gets a new proxy, and its limit
+	trainer.SetProxy(opm.Proxy{ID: 2})
+	wait("new proxy", trainer, nil)
+	wait("new proxy again", trainer, context.DeadlineExceeded)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// extendWriteDeadline lets a multi-point request write its response until shortly after
+// its deadline, the server's write timeout is for single scans
+func extendWriteDeadline(w http.ResponseWriter, deadline time.Time) {
+	err := http.NewResponseController(w).SetWriteDeadline(deadline.Add(5 * time.Second))
+	if err != nil {
+		log.Printf("Failed to extend the write deadline: %v", err)
+	}
+}
+
+// waitUntil waits d, but not past the deadline. It returns false if the deadline came first.
+func waitUntil(d time.Duration, deadline time.Time) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-time.After(d):
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// scanContext returns the context of a scan of a multi-point request. It ends after the
+// request timeout or at the deadline of the request, whichever comes first.
+func scanContext(r *http.Request, deadline time.Time) (context.Context, context.CancelFunc) {
+	if t := time.Now().Add(opm.RequestTimeout * time.Second); t.Before(deadline) {
+		deadline = t
+	}
+	return context.WithDeadline(detached(r), deadline)
+}
+
+// writeMultiPointResponse sends a multi-point response. Errors before any point was
+// scanned are passed in e, otherwise the status is derived from the point results.
+func writeMultiPointResponse(w http.ResponseWriter, r *http.Request, response opm.MultiPointResponse, e string) {
+	status := http.StatusBadRequest
+	if e == "" {
+		response.Summarize()
+		status = response.HTTPStatus()
+		if !response.Ok {
+			e = "Scan failed"
+		}
+		if response.Partial {
+			w.Header().Add("X-Partial-Result", "true")
+		}
+	} else if e == opm.ErrBusy.Error() || e == opm.ErrPaused.Error() {
+		status = http.StatusServiceUnavailable
+		response.RetryAfter = retryAfter(w, e == opm.ErrPaused.Error())
+	}
+	response.Error = publicError(e)
+	responder.Write(w, r, status, response)
+}
+
+// parseRoute reads the route from an encoded polyline ("polyline" form value) or a JSON array of points
+func parseRoute(r *http.Request) ([]geo.LatLng, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var points []geo.LatLng
+		err := json.NewDecoder(r.Body).Decode(&points)
+		return points, err
+	}
+	return geo.DecodePolyline(r.FormValue("polyline"))
+}
+
+// routeHandler scans points along a route. The route is handed off to another trainer
+// if the current one runs out of budget.
+func routeHandler(w http.ResponseWriter, r *http.Request) {
+	var response opm.MultiPointResponse
+	if r.Method != "POST" {
+		writeMultiPointResponse(w, r, response, opm.ErrWrongMethod.Error())
+		return
+	}
+	path, err := parseRoute(r)
+	if err != nil || len(path) == 0 {
+		writeMultiPointResponse(w, r, response, "Wrong format")
+		return
+	}
+	if geo.PathLength(path) > float64(scannerSettings.MaxRouteLength) {
+		writeMultiPointResponse(w, r, response, "Wrong format")
+		return
+	}
+	if budget.Paused() {
+		writeMultiPointResponse(w, r, response, opm.ErrPaused.Error())
+		return
+	}
+	points := geo.SamplePath(path, float64(scannerSettings.ScanRadius))
+	var travel time.Duration
+	for i := 1; i < len(points); i++ {
+		travel += travelTime(points[i-1], points[i])
+	}
+	// A route that can't be walked at the speed limit within the duration would only be
+	// scanned in part
+	if travel > time.Duration(scannerSettings.MaxRouteDuration)*time.Second {
+		writeMultiPointResponse(w, r, response, "Wrong format")
+		return
+	}
+	log.Printf("Scanning route with %d points", len(points))
+	// Estimated time per point, used to check if a trainer can finish before its session rotates
+	perScan := travel/time.Duration(len(points)) + opm.RequestTimeout*time.Second/2
+	// Get trainer
+	trainer, err := getTrainerFor(r.Context(), len(points), perScan)
+	if err != nil {
+		writeMultiPointResponse(w, r, response, err.Error())
+		return
+	}
+	defer func() { releaseTrainer(trainer, time.Duration(scannerSettings.ScanDelay)*time.Second) }()
+	// Walk the route
+	deadline := time.Now().Add(time.Duration(scannerSettings.MaxRouteDuration) * time.Second)
+	extendWriteDeadline(w, deadline)
+	response.MapObjects = make([]opm.MapObject, 0)
+	response.Points = make([]opm.PointStatus, len(points))
+	seen := make(map[string]bool)
+	failed := false
+	for i, p := range points {
+		response.Points[i] = opm.PointStatus{Lat: p.Lat, Lng: p.Lng, Status: opm.PointSkipped}
+		if failed || time.Now().After(deadline) {
+			continue
+		}
+		// Hand off to another trainer before this one runs out of budget
+		if trainer.Capacity(perScan) == 0 {
+			next, err := getTrainerFor(r.Context(), len(points)-i, perScan)
+			if err != nil {
+				failed = true
+				continue
+			}
+			log.Printf("Handing off route from %s to %s at point %d", util.Username(trainer.Account.Username), util.Username(next.Account.Username), i)
+			releaseTrainer(trainer, time.Duration(scannerSettings.ScanDelay)*time.Second)
+			trainer = next
+		} else if i > 0 && !waitUntil(travelTime(points[i-1], p), deadline) {
+			// Respect the speed limit
+			continue
+		}
+		scannerMetrics.ScansPerMinute.Incr(1)
+		ctx, cancel := scanContext(r, deadline)
+		trainer.Context = ctx
+		mapObjects, err := scan(trainer, p.Lat, p.Lng)
+		cancel()
+		if err != nil {
+			response.Points[i].Status = opm.PointFailed
+			response.Points[i].Error = publicError(err.Error())
+			// The trainer can not continue
+			failed = trainer.Account.Banned || trainer.Account.CaptchaFlagged || err == opm.ErrBusy
+			continue
+		}
+		persist(ctx, mapObjects)
+		response.Points[i].Status = opm.PointOk
+		response.Points[i].Objects = len(mapObjects)
+		for _, o := range mapObjects {
+			if !seen[o.ID] {
+				seen[o.ID] = true
+				response.MapObjects = append(response.MapObjects, o)
+			}
+		}
+	}
+	writeMultiPointResponse(w, r, response, "")
+}
+
+// waypointLine is a line of a /route response
+type waypointLine struct {
+	Index int
+	opm.PointStatus
+}
+
+// waypointHandler walks a single trainer along the given waypoints and scans each of them.
+// Unlike routeHandler the points are not resampled and the trainer doesn't change. The
+// results are sent as newline-delimited JSON as soon as a waypoint is done, followed by a
+// summary line. The optional delay form value is the minimum number of seconds between two
+// waypoints.
+func waypointHandler(w http.ResponseWriter, r *http.Request) {
+	var response opm.MultiPointResponse
+	if r.Method != "POST" {
+		writeMultiPointResponse(w, r, response, opm.ErrWrongMethod.Error())
+		return
+	}
+	points, err := parseRoute(r)
+	if err != nil || len(points) == 0 || len(points) > scannerSettings.MaxRouteWaypoints {
+		writeMultiPointResponse(w, r, response, "Wrong format")
+		return
+	}
+	var delay time.Duration
+	if r.FormValue("delay") != "" {
+		seconds, err := strconv.Atoi(r.FormValue("delay"))
+		if err != nil || seconds < 0 || seconds > scannerSettings.MaxRouteDuration {
+			writeMultiPointResponse(w, r, response, "Wrong format")
+			return
+		}
+		delay = time.Duration(seconds) * time.Second
+	}
+	if budget.Paused() {
+		writeMultiPointResponse(w, r, response, opm.ErrPaused.Error())
+		return
+	}
+	log.Printf("Walking route with %d waypoints", len(points))
+	var travel time.Duration
+	for i := 1; i < len(points); i++ {
+		travel += stepTime(points[i-1], points[i], delay)
+	}
+	perScan := travel/time.Duration(len(points)) + opm.RequestTimeout*time.Second/2
+	trainer, err := getTrainerFor(r.Context(), len(points), perScan)
+	if err != nil {
+		writeMultiPointResponse(w, r, response, err.Error())
+		return
+	}
+	defer func() { trainerQueue.Queue(trainer, time.Duration(scannerSettings.ScanDelay)*time.Second) }()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	deadline := time.Now().Add(time.Duration(scannerSettings.MaxRouteDuration) * time.Second)
+	extendWriteDeadline(w, deadline)
+	response.Points = make([]opm.PointStatus, len(points))
+	seen := make(map[string]bool)
+	failed := false
+	for i, p := range points {
+		result := opm.PointStatus{Lat: p.Lat, Lng: p.Lng, Status: opm.PointSkipped}
+		if !failed && i > 0 && !waitUntil(stepTime(points[i-1], p, delay), deadline) {
+			failed = true
+		}
+		if !failed && time.Now().Before(deadline) && r.Context().Err() == nil {
+			result = walkWaypoint(r, trainer, p, seen, deadline)
+			// Failures of the waypoint don't end the route, a dead account or proxy does
+			failed = trainer.Account.Banned || trainer.Account.CaptchaFlagged || trainer.Account.TokenExpired || trainer.Proxy.Dead
+		}
+		if err := enc.Encode(waypointLine{Index: i, PointStatus: result}); err != nil {
+			log.Println(err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		result.MapObjects = nil
+		response.Points[i] = result
+	}
+	// Summary without the points that were already sent
+	response.Summarize()
+	response.Points = nil
+	if !response.Ok {
+		response.Error = "Scan failed"
+	}
+	enc.Encode(response)
+}
+
+// walkWaypoint scans a waypoint of a /route request and persists the objects. Only the
+// objects that were not found at an earlier waypoint are returned.
+func walkWaypoint(r *http.Request, trainer *util.TrainerSession, p geo.LatLng, seen map[string]bool, deadline time.Time) opm.PointStatus {
+	result := opm.PointStatus{Lat: p.Lat, Lng: p.Lng}
+	scannerMetrics.ScansPerMinute.Incr(1)
+	ctx, cancel := scanContext(r, deadline)
+	defer cancel()
+	trainer.Context = ctx
+	mapObjects, err := scan(trainer, p.Lat, p.Lng)
+	if err != nil {
+		result.Status = opm.PointFailed
+		result.Error = publicError(err.Error())
+		return result
+	}
+	persist(ctx, mapObjects)
+	result.Status = opm.PointOk
+	result.Objects = len(mapObjects)
+	for _, o := range mapObjects {
+		if !seen[o.ID] {
+			seen[o.ID] = true
+			result.MapObjects = append(result.MapObjects, o)
+		}
+	}
+	return result
+}
+
+// stepTime returns the time between two waypoints, at least delay and never faster than
+// the speed limit
+func stepTime(a, b geo.LatLng, delay time.Duration) time.Duration {
+	if t := travelTime(a, b); t > delay {
+		return t
+	}
+	return delay
+}
+
+// travelTime returns the time a trainer needs between two points at the configured maximum speed
+func travelTime(a, b geo.LatLng) time.Duration {
+	if scannerSettings.MaxSpeed <= 0 {
+		return 0
+	}
+	metersPerSecond := scannerSettings.MaxSpeed / 3.6
+	return time.Duration(geo.Distance(a, b) / metersPerSecond * float64(time.Second))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+)
+
+// withSettings replaces the scanner settings for a test
+func withSettings(t *testing.T, change func(s *settings)) {
+	old := scannerSettings
+	change(&scannerSettings)
+	t.Cleanup(func() { scannerSettings = old })
+}
+
+// withMetrics sets up fresh scanner metrics for a test
+func withMetrics(t *testing.T) *metrics {
+	old := scannerMetrics
+	scannerMetrics = NewScannerMetrics()
+	scannerMetrics.Memory = newMemoryAccountant(0)
+	scannerMetrics.ScansByLabel = newLabelCounters(20)
+	scannerMetrics.Inflight = newInflightLimiter(0, 0)
+	t.Cleanup(func() { scannerMetrics = old })
+	return scannerMetrics
+}
+
+func TestRouteOverDurationIsRejected(t *testing.T) {
+	withBudget(t, settings{})
+	withSettings(t, func(s *settings) {
+		s.ScanRadius, s.MaxRouteLength, s.MaxRouteDuration, s.MaxSpeed = 70, 5000, 120, 30
+	})
+	// 2000 m at 30 km/h take 240 s
+	start := geo.LatLng{Lat: 52, Lng: 13}
+	body, _ := json.Marshal([]geo.LatLng{start, geo.Destination(start, 2000, 0)})
+	r := httptest.NewRequest("POST", "/routescan", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	routeHandler(w, r)
+	var response opm.MultiPointResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusBadRequest || response.Error != "Wrong format" {
+		t.Errorf("route of 240 s = %d %s, want it rejected", w.Code, w.Body)
+	}
+}
+
+func TestDefaultRouteFitsDuration(t *testing.T) {
+	d := time.Duration(float64(defaultScannerSettings.MaxRouteLength) / (defaultScannerSettings.MaxSpeed / 3.6) * float64(time.Second))
+	if d > time.Duration(defaultScannerSettings.MaxRouteDuration)*time.Second {
+		t.Errorf("a route of MaxRouteLength takes %s at MaxSpeed, longer than MaxRouteDuration", d)
+	}
+}
+
+func TestWaitUntilDeadline(t *testing.T) {
+	start := time.Now()
+	if waitUntil(time.Minute, start.Add(10*time.Millisecond)) {
+		t.Error("waited past the deadline")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %s, want at the deadline", d)
+	}
+	if !waitUntil(time.Millisecond, time.Now().Add(time.Minute)) {
+		t.Error("gave up before the deadline")
+	}
+}
+
+func TestScanContextDeadline(t *testing.T) {
+	r := httptest.NewRequest("POST", "/routescan", nil)
+	deadline := time.Now().Add(time.Second)
+	ctx, cancel := scanContext(r, deadline)
+	defer cancel()
+	if got, _ := ctx.Deadline(); !got.Equal(deadline) {
+		t.Errorf("scan deadline %s, want the route deadline %s", got, deadline)
+	}
+	ctx, cancel = scanContext(r, time.Now().Add(time.Hour))
+	defer cancel()
+	if got, _ := ctx.Deadline(); time.Until(got) > opm.RequestTimeout*time.Second {
+		t.Errorf("scan deadline %s, want the request timeout", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -14,128 +15,324 @@ import (
 
 	"github.com/femot/pgoapi-go/api"
 	"github.com/pogodevorg/POGOProtos-go"
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/internal/faults"
+	"github.com/pogointel/opm/internal/logging"
 	"github.com/pogointel/opm/opm"
 	"github.com/pogointel/opm/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var checkRequest = func(r *http.Request) bool { return true }
 
 func listenAndServe() {
-	// Setup routes
-	mux := http.NewServeMux()
-	mux.HandleFunc("/status", statusHandler)
-	mux.HandleFunc("/scan", requestHandler)
-	mux.Handle("/debug/vars", http.DefaultServeMux)
-
-	// Start listening
 	s := &http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 20 * time.Second,
 		Addr:         fmt.Sprintf(":%d", opmSettings.ScannerListenPort),
-		Handler:      mux,
+		Handler:      newMux(),
 	}
 	log.Fatal(s.ListenAndServe())
 }
 
+// newMux sets up the routes of the scanner
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", traced(statusHandler))
+	scanFn, routeFn, batchFn, areaFn, waypointFn := requestHandler, routeHandler, batchHandler, areaHandler, waypointHandler
+	if opmSettings.RequireAPIKey {
+		auth := util.NewAPIKeyAuth(lookupAPIKey, opmSettings.KeyRequestsPerMinute, opmSettings.KeyBurst)
+		auth.Responder = responder
+		scanFn, routeFn, batchFn, areaFn = auth.Wrap(scanFn), auth.Wrap(routeFn), auth.Wrap(batchFn), auth.Wrap(areaFn)
+		waypointFn = auth.Wrap(waypointFn)
+	}
+	mux.HandleFunc("/scan", traced(util.Gzip(scanFn)))
+	mux.HandleFunc("/routescan", traced(util.Gzip(routeFn)))
+	mux.HandleFunc("/batchscan", traced(util.Gzip(batchFn)))
+	mux.HandleFunc("/areascan", traced(util.Gzip(areaFn)))
+	mux.HandleFunc("/route", traced(util.Gzip(waypointFn)))
+	mux.HandleFunc("/spawnpoints", traced(spawnpointsHandler))
+	mux.HandleFunc("/coverage", traced(coverageHandler))
+	mux.HandleFunc("/stats", traced(statsHandler))
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/resume", traced(resumeHandler))
+	// Not traced, the websocket needs the original writer and lives for hours
+	mux.HandleFunc("/ws", streamHandler)
+	mux.Handle("/debug/vars", http.DefaultServeMux)
+	if opmSettings.UnsafeFaultInjection {
+		if !faults.Compiled {
+			log.Println("UnsafeFaultInjection is set, but this binary was built without the faults tag")
+		}
+		mux.HandleFunc("/debug/faults", faultsHandler)
+	}
+	return mux
+}
+
+// lookupAPIKey returns the API key for the API key middleware
+func lookupAPIKey(k string) (opm.APIKey, error) {
+	key, err := database.GetAPIKey(k)
+	if errors.Is(err, db.ErrNotFound) {
+		return key, opm.ErrInvalidAPIKey
+	}
+	return key, err
+}
+
 func requestHandler(w http.ResponseWriter, r *http.Request) {
-	// Create a context
-	ctx, cancel := context.WithTimeout(context.Background(), opm.RequestTimeout*time.Second)
-	defer cancel()
 	// Check method
 	if r.Method != "POST" {
-		writeScanResponse(w, false, opm.ErrWrongMethod.Error(), nil)
+		writeScanError(w, r, opm.ErrWrongMethod)
 		return
 	}
 	// Get Latitude and Longitude
-	lat, err := strconv.ParseFloat(r.FormValue("lat"), 64)
+	lat, lng, err := util.ParseLatLng(r)
 	if err != nil {
-		writeScanResponse(w, false, err.Error(), nil)
+		writeScanError(w, r, err)
 		return
 	}
-	lng, err := strconv.ParseFloat(r.FormValue("lng"), 64)
-	if err != nil {
-		writeScanResponse(w, false, err.Error(), nil)
+	// Error budget
+	if budget.Paused() {
+		writeScanError(w, r, opm.ErrPaused)
 		return
 	}
-	log.Printf("Scanning %f, %f", lat, lng)
+	// Optional label for attribution
+	label := r.FormValue("label")
+	if !validLabel(label) {
+		writeScanError(w, r, opm.ErrWrongFormat)
+		return
+	}
+	label = scannerMetrics.ScansByLabel.Incr(label)
+	logging.Log(r.Context(), logging.Entry{Event: "scan.start", Lat: lat, Lng: lng, Msg: fmt.Sprintf("Scanning %f, %f [%s]", lat, lng, label)})
 	// Mock mode
 	if scannerSettings.MockMode {
 		mockObject := opm.MapObject{Type: opm.POKEMON, Expiry: time.Now().Add(10 * time.Minute).Unix()}
 		mockObject.Source = "mock"
 
 		rand.Seed(time.Now().Unix())
-		mockObject.PokemonID = rand.Intn(150)
+		mockObject.PokemonID = rand.Intn(opm.SpeciesCount()) + 1
 		randomId := rand.Int63n(372036854775807)
 		mockObject.ID = strconv.FormatInt(randomId, 36)
 		mockObject.Lat, mockObject.Lng = util.LatLngOffset(lat, lng, 0.02)
 		mapObjects := []opm.MapObject{mockObject}
+		scannerMetrics.ScansPerMinute.Incr(1)
 		b, _ := json.Marshal(mockObject)
-		log.Printf("Sending mock object: %s", string(b))
-		writeScanResponse(w, true, "", mapObjects)
+		logging.Log(r.Context(), logging.Entry{Event: "scan.mock", Msg: "Sending mock object: " + string(b)})
+		writeScanResponse(w, r, true, "", mapObjects)
 		return
 	}
-	// Get trainer from queue
-	trainer, err := trainerQueue.Get(5 * time.Second)
+	// Requests for the same cell share one scan
+	result, shared, err := coalescer.Do(r.Context(), lat, lng, func() (scanResult, error) {
+		// Shared requests are counted by the coalescer
+		scannerMetrics.ScansPerMinute.Incr(1)
+		acquire := r.Context()
+		if coalescer != nil {
+			// Other requests may wait for this scan, it keeps its place in the queue when
+			// this client goes away
+			ctx, cancel := context.WithTimeout(detached(r), opm.RequestTimeout*time.Second)
+			defer cancel()
+			acquire = ctx
+		}
+		return scanLocation(r, acquire, lat, lng)
+	})
+	if err != nil {
+		writeScanError(w, r, err)
+		return
+	}
+	if shared {
+		logging.Log(r.Context(), logging.Entry{Event: "scan.shared", Lat: lat, Lng: lng, Msg: fmt.Sprintf("Shared scan of %s: %d objects", cellKey(lat, lng), len(result.objects))})
+	}
+	response := opm.APIResponse{Ok: true, MapObjects: result.objects}
+	if result.footprint.IsSet() {
+		response.Footprint = &result.footprint
+	}
+	responder.Write(w, r, http.StatusOK, response)
+}
+
+// scanLocation scans lat/lng with a trainer and saves the result. The trainer is waited for
+// until acquire is done.
+func scanLocation(r *http.Request, acquire context.Context, lat, lng float64) (scanResult, error) {
+	// Get trainer, waiting in the queue until acquire is done
+	_, span := tracer.Start(r.Context(), "acquire trainer")
+	trainer, err := PreferNearbyTrainer(acquire, lat, lng)
+	endSpan(span, err)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer trainerQueue.Queue(trainer, time.Duration(scannerSettings.ScanDelay)*time.Second)
+	// The scan is finished even if the client disconnects
+	ctx, cancel := context.WithTimeout(detached(r), opm.RequestTimeout*time.Second)
+	defer cancel()
+	trainer.Context = ctx
+	// Perform scan
+	mapObjects, err := scan(trainer, lat, lng)
 	if err != nil {
-		// Timeout -> try setup a new one
-		p, err := database.GetProxy()
+		return scanResult{}, err
+	}
+	footprint := trainer.Footprint
+	scanLog(trainer, logging.Entry{Event: "scan.done", Lat: lat, Lng: lng, Msg: fmt.Sprintf("Scanned %f, %f: %d objects, footprint %+v", lat, lng, len(mapObjects), footprint)})
+	// Save to db
+	persist(ctx, mapObjects)
+	recordScan(ctx, lat, lng, footprint, trainer.Account.Username, len(mapObjects))
+	return scanResult{objects: mapObjects, footprint: footprint}, nil
+}
+
+// recordScan adds a successful scan to the scan history of the coverage map
+func recordScan(ctx context.Context, lat, lng float64, footprint opm.BoundingBox, trainer string, objects int) {
+	if scannerSettings.ScanHistory <= 0 || store != opm.Database(database) {
+		return
+	}
+	if err := database.AddScan(lat, lng, footprint, trainer, objects, time.Now()); err != nil {
+		logging.Log(ctx, logging.Entry{Level: logging.Error, Event: "db.scan", Lat: lat, Lng: lng, Err: err})
+	}
+}
+
+// trainerCandidates is the number of queued trainers considered for a job
+const trainerCandidates = 3
+
+// getTrainerFor returns a trainer that can do the given number of scans, perScan apart, before
+// it runs out of budget or its session is rotated. Trainers that can't are left for cheaper work.
+// If no candidate can finish the job, the one with the most capacity is returned and the caller
+// has to hand off the rest of the job. Exhausted trainers wait for their budget and are no
+// candidates, if there are only exhausted trainers a new one is created from the db.
+func getTrainerFor(ctx context.Context, scans int, perScan time.Duration) (*util.TrainerSession, error) {
+	var best *util.TrainerSession
+	bestCapacity, exhausted := 0, false
+	seen := make(map[*util.TrainerSession]bool)
+	for fetched, candidates := 0, 0; candidates < trainerCandidates; fetched++ {
+		wait, cancel := candidateContext(ctx, fetched)
+		trainer, err := pool.Get(wait)
+		cancel()
 		if err != nil {
-			writeScanResponse(w, false, opm.ErrBusy.Error(), nil)
-			return
+			break
 		}
-		a, err := database.GetAccount()
+		if seen[trainer] {
+			// Every queued trainer was considered
+			trainerQueue.Queue(trainer, 0)
+			break
+		}
+		seen[trainer] = true
+		c := trainer.Capacity(perScan)
+		if c == 0 {
+			releaseTrainer(trainer, 0)
+			exhausted = true
+			continue
+		}
+		candidates++
+		if c < 0 || c >= scans {
+			if best != nil {
+				trainerQueue.Queue(best, 0)
+			}
+			return trainer, nil
+		}
+		if c > bestCapacity {
+			if best != nil {
+				trainerQueue.Queue(best, 0)
+			}
+			best, bestCapacity = trainer, c
+			continue
+		}
+		trainerQueue.Queue(trainer, 0)
+	}
+	if best == nil {
+		// A busy pool gets no extra trainers, only one whose trainers are all exhausted
+		if !exhausted {
+			return nil, opm.ErrBusy
+		}
+		trainer, err := pool.Create()
 		if err != nil {
-			database.ReturnProxy(p)
-			writeScanResponse(w, false, opm.ErrBusy.Error(), nil)
-			return
+			return nil, opm.ErrBusy
 		}
-		trainer = util.NewTrainerSession(a, &api.Location{}, feed, crypto)
-		trainer.SetProxy(p)
-		scannerStatus[trainer.Account.Username] = opm.StatusEntry{AccountName: trainer.Account.Username, ProxyId: trainer.Proxy.ID}
+		return trainer, nil
 	}
-	defer trainerQueue.Queue(trainer, time.Duration(scannerSettings.ScanDelay)*time.Second)
+	return best, nil
+}
+
+// releaseTrainer queues a trainer again after delay. A trainer that used up its hourly budget
+// waits until the budget has room again.
+func releaseTrainer(trainer *util.TrainerSession, delay time.Duration) {
+	if reset := trainer.BudgetResetIn(); reset > delay {
+		delay = reset
+	}
+	trainerQueue.Queue(trainer, delay)
+}
+
+// scan performs a scan with the trainer and handles proxy and account problems
+func scan(trainer *util.TrainerSession, lat, lng float64) (result []opm.MapObject, err error) {
+	ctx, span := tracer.Start(trainer.Context, "scan", trace.WithAttributes(
+		attribute.Float64("lat", lat), attribute.Float64("lng", lng), attribute.String("account", trainer.Account.Username)))
+	defer func() { endSpan(span, err) }()
+	parent := trainer.Context
 	trainer.Context = ctx
-	// Perform scan
+	defer func() { trainer.Context = parent }()
+	scannerStatus.Scanning(trainer.Account.Username, lat, lng)
+	defer func() { scannerStatus.Done(trainer.Account.Username, err) }()
+	trainer.RecordScan()
+	jumped := scannerSettings.MaxJumpSpeed > 0 && trainer.SpeedTo(lat, lng, time.Now()) > scannerSettings.MaxJumpSpeed
+	start := time.Now().Unix()
 	mapObjects, err := getMapResult(trainer, lat, lng)
 	// Error handling
 	retrySuccess := false
-	// Check error/timeout
-	if err != nil && ctx.Err() != nil {
-		writeScanResponse(w, false, opm.ErrScanTimeout.Error(), mapObjects)
-		return
+	// Check error/timeout, a timeout counts against the error budget like any failed scan
+	if err != nil && trainer.Context.Err() != nil {
+		events.Emit(scanCompleted{Lat: lat, Lng: lng, Start: start, Err: opm.ErrScanTimeout})
+		return nil, opm.ErrScanTimeout
 	}
 	// Handle proxy death
 	if err != nil && err == api.ErrProxyDead {
 		trainer.Proxy.Dead = true
+		events.Emit(proxyDied{ProxyID: trainer.Proxy.ID})
+		scanLog(trainer, logging.Entry{Level: logging.Warn, Event: "proxy.dead", Lat: lat, Lng: lng, Msg: "Proxy died, retrying with a new one"})
 		var p opm.Proxy
-		p, err = database.GetProxy()
+		p, err = store.GetProxy()
 		if err == nil {
 			trainer.SetProxy(p)
-			scannerStatus[trainer.Account.Username] = opm.StatusEntry{AccountName: trainer.Account.Username, ProxyId: trainer.Proxy.ID}
+			scannerStatus.Set(trainer)
 			// Retry with new proxy
 			mapObjects, err = getMapResult(trainer, lat, lng)
 			retrySuccess = err == nil
 		} else {
-			delete(scannerStatus, trainer.Account.Username)
-			database.ReturnAccount(trainer.Account)
-			log.Println("No proxies available")
-			writeScanResponse(w, false, opm.ErrBusy.Error(), nil)
-			return
+			scannerStatus.Remove(trainer.Account.Username)
+			if err := store.ReturnAccount(trainer.Account); err != nil {
+				scanLog(trainer, logging.Entry{Level: logging.Error, Event: "db.account", Err: err})
+			}
+			scanLog(trainer, logging.Entry{Level: logging.Warn, Event: "scan.noproxy", Msg: "No proxies available"})
+			return nil, opm.ErrBusy
 		}
 	}
 	// Account problems
 	if err != nil {
-		errString := err.Error()
-		if strings.Contains(errString, "Your username or password is incorrect") || err == api.ErrAccountBanned || err.Error() == "Empty response" || strings.Contains(errString, "not yet active") {
-			log.Printf("Account %s banned", trainer.Account.Username)
+		reason := banReason(err)
+		if jumped && reason == opm.BanTemporary {
+			// Softbanned by the jump, the account is fine after a cooldown
+			scanLog(trainer, logging.Entry{Level: logging.Warn, Event: "account.softban", Lat: lat, Lng: lng, Msg: "Account probably softbanned after a jump"})
+		} else if reason != "" {
+			events.Emit(accountBanned{Username: trainer.Account.Username})
 			trainer.Account.Banned = true
-			database.UpdateAccount(trainer.Account)
-			delete(scannerStatus, trainer.Account.Username)
+			trainer.Account.BannedAt = time.Now().Unix()
+			trainer.Account.BanReason = reason
+			scanLog(trainer, logging.Entry{Level: logging.Warn, Event: "account.banned", Lat: lat, Lng: lng, Msg: "Account banned (" + reason + ")", Err: err})
+			if err := store.MarkAccountBanned(trainer.Account.Username, reason); err != nil {
+				scanLog(trainer, logging.Entry{Level: logging.Error, Event: "db.account", Err: err})
+			}
+			scannerStatus.Banned(trainer.Account.Username)
+		} else if err == opm.ErrTokenExpired {
+			// Not banned, the account needs a new token
+			scanLog(trainer, logging.Entry{Level: logging.Warn, Event: "account.token", Msg: "Token of account expired"})
+			trainer.Account.TokenExpired = true
+			if err := store.MarkTokenExpired(trainer.Account.Username); err != nil {
+				scanLog(trainer, logging.Entry{Level: logging.Error, Event: "db.account", Err: err})
+			}
+			scannerStatus.Remove(trainer.Account.Username)
 		} else if err == api.ErrCheckChallenge {
-			log.Printf("Account %s flagged for Challenge", trainer.Account.Username)
+			scanLog(trainer, logging.Entry{Level: logging.Warn, Event: "account.captcha", Msg: "Account flagged for Challenge"})
+			// Not banned, the account is usable again once the captcha is solved. pgoapi
+			// doesn't hand out the challenge url, so it is stored empty.
 			trainer.Account.CaptchaFlagged = true
-			database.UpdateAccount(trainer.Account)
-			delete(scannerStatus, trainer.Account.Username)
+			trainer.Account.CaptchaAt = time.Now().Unix()
+			if err := store.FlagCaptcha(trainer.Account.Username, ""); err != nil {
+				scanLog(trainer, logging.Entry{Level: logging.Error, Event: "db.account", Err: err})
+			}
+			scannerStatus.Remove(trainer.Account.Username)
 		}
 	}
 	// Just retry when this error comes
@@ -144,39 +341,154 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// Final error check
 	if err != nil && !retrySuccess {
-		writeScanResponse(w, false, err.Error(), nil)
+		events.Emit(scanCompleted{Lat: lat, Lng: lng, Start: start, Err: err})
+		return nil, err
+	}
+	events.Emit(scanCompleted{Lat: lat, Lng: lng, Start: start, Objects: mapObjects})
+	return mapObjects, nil
+}
+
+// recordMisses flags known Pokemon in the scanned area that were not in the result
+func recordMisses(lat, lng float64, start int64, mapObjects []opm.MapObject) {
+	seen := make([]string, 0, len(mapObjects))
+	for _, o := range mapObjects {
+		if o.Type == opm.POKEMON {
+			seen = append(seen, o.ID)
+		}
+	}
+	n, err := database.RecordMisses(lat, lng, scannerSettings.ScanRadius, start, seen)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if n > 0 {
+		log.Printf("%d known Pokemon missing at %f, %f", n, lat, lng)
+	}
+}
+
+// persist saves the result of a scan, in the background if write batching is on
+func persist(ctx context.Context, mapObjects []opm.MapObject) {
+	if writer == nil || !writer.Add(mapObjects) {
+		saveMapObjects(ctx, mapObjects)
+	}
+}
+
+// saveMapObjects persists the result of a scan and publishes the new objects.
+// Other backends than MongoDB only store the objects, without spawnpoints, sightings and suppressions.
+func saveMapObjects(ctx context.Context, mapObjects []opm.MapObject) {
+	_, span := tracer.Start(ctx, "persist", trace.WithAttributes(attribute.Int("objects", len(mapObjects))))
+	defer span.End()
+	if seen != nil {
+		mapObjects = seen.Filter(mapObjects, opm.Now())
+	}
+	if store == opm.Database(database) {
+		events.Emit(objectsPersisted{Objects: database.SaveMapObjects(ctx, mapObjects)})
 		return
 	}
-	//Save to db
+	added := make([]opm.MapObject, 0, len(mapObjects))
 	for _, o := range mapObjects {
-		database.AddMapObject(o)
+		err := store.AddMapObject(o)
+		if err == nil {
+			added = append(added, o)
+		} else if !errors.Is(err, db.ErrDuplicate) {
+			logging.Log(ctx, logging.Entry{Level: logging.Error, Event: "db.save", Msg: "Failed to save " + o.ID, Err: err})
+		}
 	}
-	writeScanResponse(w, true, "", mapObjects)
+	events.Emit(objectsPersisted{Objects: added})
 }
 
-func writeScanResponse(w http.ResponseWriter, ok bool, e string, response []opm.MapObject) {
+func writeScanResponse(w http.ResponseWriter, r *http.Request, ok bool, e string, response []opm.MapObject) {
 	if !ok {
 		log.Println(e)
-		if e == opm.ErrBusy.Error() {
+		if e == opm.ErrBusy.Error() || e == opm.ErrPaused.Error() {
 			scannerMetrics.ScanBusyPerMinute.Incr(1)
 		} else {
 			scannerMetrics.ScanFailsPerMinute.Incr(1)
 		}
 	}
-	w.Header().Add("Content-Type", "application/json")
+	responder.Write(w, r, http.StatusOK, opm.APIResponse{Ok: ok, Error: publicError(e), MapObjects: response})
+}
 
-	if e != "" && e != opm.ErrScanTimeout.Error() && e != opm.ErrBusy.Error() && e != "Wrong format" && e != "Wrong method" && e != "Failed to get MapObjects from DB" {
-		e = "Scan failed"
+// writeScanError answers a failed scan request with the error code and HTTP status of the error
+func writeScanError(w http.ResponseWriter, r *http.Request, err error) {
+	code, status := errorCode(err)
+	logging.Log(r.Context(), logging.Entry{Level: logging.Warn, Event: "scan.failed", Err: err})
+	var hint *opm.RetryHint
+	if code == opm.ErrCodeBusy {
+		scannerMetrics.ScanBusyPerMinute.Incr(1)
+		hint = retryAfter(w, err == opm.ErrPaused)
+	} else {
+		scannerMetrics.ScanFailsPerMinute.Incr(1)
 	}
+	responder.Write(w, r, status, opm.APIResponse{Ok: false, Error: publicError(err.Error()), ErrorCode: code, RetryAfter: hint})
+}
 
-	r := opm.APIResponse{Ok: ok, Error: e, MapObjects: response}
-	err := json.NewEncoder(w).Encode(r)
-	if err != nil {
-		log.Println(err)
+// errorCode classifies a scan error for the client
+func errorCode(err error) (string, int) {
+	switch {
+	case err == opm.ErrWrongMethod:
+		return opm.ErrCodeBadRequest, http.StatusMethodNotAllowed
+	case err == opm.ErrWrongFormat || err == opm.ErrInvalidCoordinates:
+		return opm.ErrCodeBadRequest, http.StatusBadRequest
+	case err == opm.ErrBusy || err == opm.ErrPaused:
+		return opm.ErrCodeBusy, http.StatusServiceUnavailable
+	case err == opm.ErrScanTimeout:
+		return opm.ErrCodeTimeout, http.StatusGatewayTimeout
+	case err == api.ErrProxyDead:
+		return opm.ErrCodeProxy, http.StatusBadGateway
+	case isAccountError(err):
+		return opm.ErrCodeAccount, http.StatusBadGateway
+	}
+	return opm.ErrCodeScanFailed, http.StatusBadGateway
+}
+
+// isAccountError reports whether the scan failed because of the account, see scan
+func isAccountError(err error) bool {
+	return banReason(err) != "" || err == api.ErrCheckChallenge || err == opm.ErrTokenExpired || err == api.ErrInvalidAuthToken
+}
+
+// banReason classifies the errors that ban an account. It returns "" for other errors.
+// pgoapi only reports some of them as messages.
+func banReason(err error) string {
+	e := err.Error()
+	switch {
+	case strings.Contains(e, "Your username or password is incorrect"):
+		return opm.BanCredentials
+	case strings.Contains(e, "not yet active"):
+		return opm.BanInactive
+	case err == api.ErrAccountBanned:
+		return opm.BanPermanent
+	case e == "Empty response":
+		return opm.BanTemporary
 	}
+	return ""
 }
 
-func getMapResult(trainer *util.TrainerSession, lat float64, lng float64) ([]opm.MapObject, error) {
+// publicError hides internal error messages from clients
+func publicError(e string) string {
+	if e != "" && e != opm.ErrScanTimeout.Error() && e != opm.ErrBusy.Error() && e != opm.ErrPaused.Error() && e != "Wrong format" && e != "Wrong method" && e != "Failed to get MapObjects from DB" && e != opm.ErrInvalidCoordinates.Error() {
+		return "Scan failed"
+	}
+	return e
+}
+
+// waitForProxy waits until the current proxy of the trainer may make another upstream call,
+// at most ScansPerProxyPerMinute go through each proxy
+func waitForProxy(trainer *util.TrainerSession) error {
+	return proxyLimiter.Wait(trainer.Context, strconv.FormatInt(trainer.Proxy.ID, 10), scannerSettings.ScansPerProxyPerMinute, 1)
+}
+
+// getMapResult returns the map objects around lat/lng from upstream, replaced in tests
+var getMapResult = upstreamMapResult
+
+func upstreamMapResult(trainer *util.TrainerSession, lat float64, lng float64) ([]opm.MapObject, error) {
+	// Limit concurrent upstream requests
+	err := scannerMetrics.Inflight.Acquire(trainer.Context)
+	if err != nil {
+		return nil, err
+	}
+	defer scannerMetrics.Inflight.Release()
+	trainer.Footprint = opm.BoundingBox{}
 	// Set location
 	trainer.MoveTo(&api.Location{Lat: lat, Lon: lng})
 	// Login trainer
@@ -186,7 +498,11 @@ func getMapResult(trainer *util.TrainerSession, lat float64, lng float64) ([]opm
 		case <-trainer.Context.Done():
 			return nil, opm.ErrScanTimeout
 		}
-		err := trainer.Login()
+		_, span := tracer.Start(trainer.Context, "login")
+		err := faults.Inject(faults.UpstreamLogin)
+		if err == nil {
+			err = trainer.Login()
+		}
 		if err == api.ErrInvalidAuthToken {
 			trainer.ForceLogin = true
 			select {
@@ -196,94 +512,297 @@ func getMapResult(trainer *util.TrainerSession, lat float64, lng float64) ([]opm
 			}
 			err = trainer.Login()
 		}
+		endSpan(span, err)
 		if err != nil {
 			if err != api.ErrProxyDead {
-				log.Printf("Login error (%s): %s\n", trainer.Account.Username, err.Error())
+				scanLog(trainer, logging.Entry{Level: logging.Error, Event: "upstream.login", Lat: lat, Lng: lng, Msg: "Login error", Err: err})
 			}
 			return nil, err
 		}
 	}
 	// Query api
-	<-ticks
-	mapObjects, err := trainer.GetPlayerMap()
+	if err := waitForProxy(trainer); err != nil {
+		return nil, opm.ErrScanTimeout
+	}
+	_, span := tracer.Start(trainer.Context, "upstream GetPlayerMap", trace.WithSpanKind(trace.SpanKindClient))
+	var mapObjects *protos.GetMapObjectsResponse
+	err = faults.Inject(faults.ProxyConnect)
+	if err != nil {
+		err = api.ErrProxyDead
+	} else if err = faults.Inject(faults.UpstreamMap); err == nil {
+		mapObjects, err = trainer.GetPlayerMap()
+	}
+	endSpan(span, err)
 	if err != nil && err != api.ErrNewRPCURL {
 		if err != api.ErrProxyDead {
-			log.Printf("Error getting map objects (%s): %s\n", trainer.Account.Username, err.Error())
+			scanLog(trainer, logging.Entry{Level: logging.Error, Event: "upstream.map", Lat: lat, Lng: lng, Msg: "Error getting map objects", Err: err})
 		}
 		return nil, err
 	}
 	// Parse and return result
-	return parseMapObjects(mapObjects), nil
+	received := opm.Now()
+	captureResponse(lat, lng, received, mapObjects)
+	trainer.Footprint = util.ParseFootprint(mapObjects)
+	_, span = tracer.Start(trainer.Context, "parse")
+	defer span.End()
+	if scannerSettings.RecordNearby && store == opm.Database(database) {
+		if err := database.AddNearby(util.ParseNearbyPokemon(mapObjects, lat, lng, received)); err != nil {
+			scanLog(trainer, logging.Entry{Level: logging.Error, Event: "db.nearby", Err: err})
+		}
+	}
+	return util.ParseMapObjects(mapObjects, received), nil
 }
 
-func parseMapObjects(r *protos.GetMapObjectsResponse) []opm.MapObject {
-	objects := make([]opm.MapObject, 0)
-	// Cells
-	for _, c := range r.MapCells {
-		// Pokemon
-		for _, p := range c.WildPokemons {
-			expiry := time.Now().Add(time.Duration(p.TimeTillHiddenMs) * time.Millisecond).Unix()
-			if expiry > time.Now().Add(15*time.Minute).Unix() {
-				continue
-			}
-			objects = append(objects, opm.MapObject{
-				Type:         opm.POKEMON,
-				ID:           strconv.FormatUint(p.EncounterId, 36),
-				PokemonID:    int(p.PokemonData.PokemonId),
-				SpawnpointID: p.SpawnPointId,
-				Lat:          p.Latitude,
-				Lng:          p.Longitude,
-				Expiry:       expiry,
-			})
+// scanLog logs a line of the scan of the trainer, with its account and proxy
+func scanLog(trainer *util.TrainerSession, e logging.Entry) {
+	e.Account = util.Username(trainer.Account.Username)
+	e.Proxy = strconv.FormatInt(trainer.Proxy.ID, 10)
+	logging.Log(trainer.Context, e)
+}
+
+// statusSummary is returned by the status endpoint when the summary parameter is set
+type statusSummary struct {
+	Budget   budgetState     `json:"budget"`
+	Queue    util.QueueStats `json:"queue"`
+	Pool     *poolStats      `json:"pool,omitempty"` // requests waiting for a trainer
+	Trainers int             `json:"trainers"`
+	Accounts map[string]int  `json:"accounts,omitempty"` // per stage
+	Intake   *intakeStats    `json:"intake,omitempty"`
+	Cleanup  *janitorStats   `json:"cleanup,omitempty"`
+}
+
+// faultsHandler sets the failure injection rules, see the faults package
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("secret") != opmSettings.Secret {
+		responder.WriteWith(w, r, http.StatusForbidden, "nope", util.TextSerializer{})
+		return
+	}
+	faults.Handler(w, r)
+}
+
+// statusHandler lists the trainers in use with their activity, as JSON or with format=text as a table
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("secret") != opmSettings.Secret {
+		responder.WriteWith(w, r, http.StatusForbidden, "nope", util.TextSerializer{})
+		return
+	}
+
+	// Error budget state
+	if budget.Paused() {
+		w.Header().Add("X-Scanner-Paused", budget.State().Reason)
+	}
+	// Summary instead of the account list
+	if r.FormValue("summary") != "" {
+		summary := statusSummary{
+			Budget:   budget.State(),
+			Trainers: scannerStatus.Active(),
 		}
-		// Forts
-		for _, f := range c.Forts {
-			switch f.Type {
-			case protos.FortType_CHECKPOINT:
-				if f.LureInfo != nil {
-					// Lured pokemon found!
-					objects = append(objects, opm.MapObject{
-						Type:      opm.POKEMON,
-						ID:        strconv.FormatUint(f.LureInfo.EncounterId, 36),
-						PokemonID: int(f.LureInfo.ActivePokemonId),
-						Lat:       f.Latitude,
-						Lng:       f.Longitude,
-						Expiry:    f.LureInfo.LureExpiresTimestampMs / 1000,
-					})
-				}
-				objects = append(objects, opm.MapObject{
-					Type:  opm.POKESTOP,
-					ID:    f.Id,
-					Lat:   f.Latitude,
-					Lng:   f.Longitude,
-					Lured: f.ActiveFortModifier != nil,
-				})
-			case protos.FortType_GYM:
-				objects = append(objects, opm.MapObject{
-					Type: opm.GYM,
-					ID:   f.Id,
-					Lat:  f.Latitude,
-					Lng:  f.Longitude,
-					Team: int(f.OwnedByTeam),
-				})
+		if trainerQueue != nil {
+			summary.Queue = trainerQueue.Stats()
+		}
+		if pool != nil {
+			stats := pool.Stats()
+			summary.Pool = &stats
+		}
+		if store == opm.Database(database) {
+			stages, err := database.AccountStageCounts()
+			if err != nil {
+				log.Println(err)
 			}
+			summary.Accounts = stages
+		}
+		if intake != nil {
+			stats := intake.Stats()
+			summary.Intake = &stats
 		}
+		if cleanup != nil {
+			stats := cleanup.Stats()
+			summary.Cleanup = &stats
+		}
+		responder.Write(w, r, http.StatusOK, summary)
+		return
 	}
-	return objects
+
+	list := scannerStatus.List()
+	if r.FormValue("format") == "text" {
+		responder.WriteWith(w, r, http.StatusOK, budgetLine(budget.State())+statusTable(list), util.TextSerializer{})
+		return
+	}
+	responder.Write(w, r, http.StatusOK, list)
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
+// maxSpawnpointRadius caps the radius parameter of the spawnpoints endpoint
+const maxSpawnpointRadius = 5000
+
+// spawnpointsHandler returns the learned spawnpoints around lat/lng
+func spawnpointsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("secret") != opmSettings.Secret {
+		responder.WriteWith(w, r, http.StatusForbidden, "nope", util.TextSerializer{})
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	lat, err := strconv.ParseFloat(r.FormValue("lat"), 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lng, err := strconv.ParseFloat(r.FormValue("lng"), 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	radius, err := strconv.Atoi(r.FormValue("radius"))
+	if err != nil || radius <= 0 || radius > maxSpawnpointRadius {
+		radius = opmSettings.CacheRadius
+	}
+	points, err := database.GetSpawnpoints(lat, lng, radius)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	responder.Write(w, r, http.StatusOK, points)
+}
+
+// coverageHandler returns the number of scans per geohash cell of the bounding box given by
+// north, south, east and west, since the unix time since (default the last 24 hours)
+func coverageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("secret") != opmSettings.Secret {
+		responder.WriteWith(w, r, http.StatusForbidden, "nope", util.TextSerializer{})
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var box [4]float64
+	for i, name := range []string{"north", "south", "east", "west"} {
+		v, err := strconv.ParseFloat(r.FormValue(name), 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		box[i] = v
+	}
+	north, south, east, west := box[0], box[1], box[2], box[3]
+	width := east - west
+	if west > east {
+		width += 360
+	}
+	// Queries are polygons, which can't span a hemisphere
+	if north > 90 || south < -90 || north <= south || width <= 0 || width >= 180 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	since := time.Now().Add(-24 * time.Hour)
+	if v := r.FormValue("since"); v != "" {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		since = time.Unix(ts, 0)
+	}
+	cells, err := database.GetScanCoverage(north, south, east, west, since)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	responder.Write(w, r, http.StatusOK, cells)
+}
+
+// maxStatsRadius caps the radius parameter of the stats endpoint
+const maxStatsRadius = 50000
+
+// objectStats is the response of the stats endpoint
+type objectStats struct {
+	Pokemon   int         `json:"pokemon"`
+	Pokestops int         `json:"pokestops"`
+	Gyms      int         `json:"gyms"`
+	BySpecies map[int]int `json:"by_species"`
+}
+
+// statsHandler counts the active objects, everywhere or within radius meters of lat/lng. The
+// species counts are limited to the Pokemon seen since the unix time since if it is given.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.FormValue("secret") != opmSettings.Secret {
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, "nope")
+		responder.WriteWith(w, r, http.StatusForbidden, "nope", util.TextSerializer{})
 		return
 	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var area *db.Circle
+	if r.FormValue("radius") != "" {
+		lat, lng, err := util.ParseLatLng(r)
+		radius, rErr := strconv.Atoi(r.FormValue("radius"))
+		if err != nil || rErr != nil || radius <= 0 || radius > maxStatsRadius {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		area = &db.Circle{Lat: lat, Lng: lng, Radius: radius}
+	}
+	var since int64
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	var stats objectStats
+	var err error
+	stats.BySpecies, err = database.PokemonCountsBySpecies(since, area)
+	if err == nil {
+		stats.Pokemon, err = database.CountActiveObjects([]int{opm.POKEMON}, area)
+	}
+	if err == nil {
+		stats.Pokestops, err = database.CountActiveObjects([]int{opm.POKESTOP}, area)
+	}
+	if err == nil {
+		stats.Gyms, err = database.CountActiveObjects([]int{opm.GYM}, area)
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	responder.Write(w, r, http.StatusOK, stats)
+}
 
-	list := make([]opm.StatusEntry, 0)
-	for _, v := range scannerStatus {
-		list = append(list, v)
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	paused := budget.Paused()
+	state := budget.State()
+	s, status := "ok", http.StatusOK
+	if paused {
+		s, status = "degraded", http.StatusServiceUnavailable
+	}
+	health := map[string]interface{}{"status": s, "budget": state}
+	if writer != nil {
+		// Objects the writer hasn't saved yet
+		health["backlog"] = writer.Pending()
+		if writer.Backlogged() {
+			health["status"], status = "degraded", http.StatusServiceUnavailable
+		}
+	}
+	responder.Write(w, r, status, health)
+}
+
+func resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("secret") != opmSettings.Secret {
+		responder.WriteWith(w, r, http.StatusForbidden, "nope", util.TextSerializer{})
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	budget.Resume()
+	responder.WriteWith(w, r, http.StatusOK, "resumed", util.TextSerializer{})
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// Trainer states of the status endpoint
+const (
+	stateIdle     = "idle"
+	stateScanning = "scanning"
+	stateBanned   = "banned"
+)
+
+// bannedRetention is how long banned trainers stay on the status page
+const bannedRetention = time.Hour
+
+// statusRegistry keeps the status entries of the trainers in use, by account name
+type statusRegistry struct {
+	sync.Mutex
+	entries map[string]*opm.StatusEntry
+	added   map[string]int64 // unix time the trainer was added, for trainers that never scanned
+	nowFunc func() time.Time
+}
+
+func newStatusRegistry() *statusRegistry {
+	return &statusRegistry{entries: make(map[string]*opm.StatusEntry), added: make(map[string]int64), nowFunc: time.Now}
+}
+
+// Set adds the trainer or updates its proxy, the counters of a known trainer are kept
+func (s *statusRegistry) Set(trainer *util.TrainerSession) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.entries[trainer.Account.Username]
+	if !ok {
+		e = &opm.StatusEntry{AccountName: trainer.Account.Username, State: stateIdle}
+		s.entries[trainer.Account.Username] = e
+		s.added[trainer.Account.Username] = s.nowFunc().Unix()
+	}
+	e.ProxyId = trainer.Proxy.ID
+}
+
+// Remove drops the trainer, its account is no longer in use
+func (s *statusRegistry) Remove(username string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.entries, username)
+	delete(s.added, username)
+}
+
+// Scanning marks the start of a scan at lat/lng
+func (s *statusRegistry) Scanning(username string, lat, lng float64) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.entries[username]; ok {
+		e.State = stateScanning
+		e.LastScan = s.nowFunc().Unix()
+		e.LastLat, e.LastLng = lat, lng
+	}
+}
+
+// Done records the outcome of a scan started with Scanning
+func (s *statusRegistry) Done(username string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.entries[username]
+	if !ok {
+		return
+	}
+	e.Scans++
+	if err != nil {
+		e.Failures++
+		e.ConsecutiveErrors++
+	} else {
+		e.ConsecutiveErrors = 0
+	}
+	if e.State != stateBanned {
+		e.State = stateIdle
+	}
+}
+
+// Banned keeps the trainer on the status page for a while, see bannedRetention
+func (s *statusRegistry) Banned(username string) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.entries[username]; ok {
+		e.State = stateBanned
+	}
+}
+
+// List returns the entries sorted by account name and drops banned trainers that
+// haven't scanned for bannedRetention
+func (s *statusRegistry) List() []opm.StatusEntry {
+	s.Lock()
+	defer s.Unlock()
+	s.dropBanned()
+	list := make([]opm.StatusEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].AccountName < list[j].AccountName })
+	return list
+}
+
+// dropBanned removes banned trainers that haven't scanned for bannedRetention. Must be
+// called with the lock held.
+func (s *statusRegistry) dropBanned() {
+	cutoff := s.nowFunc().Add(-bannedRetention).Unix()
+	for name, e := range s.entries {
+		if e.State == stateBanned && e.LastScan < cutoff {
+			delete(s.entries, name)
+			delete(s.added, name)
+		}
+	}
+}
+
+// ApproxBytes returns the approximate memory used by the entries
+func (s *statusRegistry) ApproxBytes() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return int64(len(s.entries) * 160)
+}
+
+// Shrink drops the banned trainers that are past their retention, the others are in use.
+// Without it they are only dropped when the status page is listed.
+func (s *statusRegistry) Shrink() {
+	s.Lock()
+	defer s.Unlock()
+	s.dropBanned()
+}
+
+// Idle reports whether the trainer is idle and hasn't scanned since cutoff (unix time).
+// Trainers that never scanned count from the time they were added.
+func (s *statusRegistry) Idle(username string, cutoff int64) bool {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.entries[username]
+	if !ok || e.State != stateIdle {
+		return false
+	}
+	last := e.LastScan
+	if last == 0 {
+		last = s.added[username]
+	}
+	return last < cutoff
+}
+
+// Active returns the number of trainers that are not banned
+func (s *statusRegistry) Active() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, e := range s.entries {
+		if e.State != stateBanned {
+			n++
+		}
+	}
+	return n
+}
+
+// statusTable renders the entries as a human readable table
+func statusTable(list []opm.StatusEntry) string {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tPROXY\tSTATE\tSCANS\tFAILURES\tERRORS\tLAST SCAN\tLOCATION")
+	for _, e := range list {
+		last, location := "-", "-"
+		if e.LastScan != 0 {
+			last = time.Since(time.Unix(e.LastScan, 0)).Round(time.Second).String() + " ago"
+			location = fmt.Sprintf("%f,%f", e.LastLat, e.LastLng)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%d\t%s\t%s\n", e.AccountName, e.ProxyId, e.State, e.Scans, e.Failures, e.ConsecutiveErrors, last, location)
+	}
+	tw.Flush()
+	return b.String()
+}
+
+// budgetLine renders a pause of the error budget as the first line of the status table,
+// it is empty while scanning
+func budgetLine(s budgetState) string {
+	if !s.Paused {
+		return ""
+	}
+	return fmt.Sprintf("Scanning paused until %s: %s\n\n", time.Unix(s.Until, 0).Format(time.RFC3339), s.Reason)
+}
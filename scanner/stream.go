@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+const (
+	// Time allowed to write a message to a stream client
+	streamWriteWait = 10 * time.Second
+	// Time allowed to read the next pong message from a stream client
+	streamPongWait = 60 * time.Second
+	// Ping period, must be less than streamPongWait
+	streamPingPeriod = (streamPongWait * 9) / 10
+	// Number of objects buffered per client before it is evicted
+	streamClientBuffer = 256
+)
+
+var streamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// streamClient is a websocket client subscribed to new map objects
+type streamClient struct {
+	hub   *streamHub
+	conn  *websocket.Conn
+	send  chan opm.MapObject
+	types map[int]bool
+	// Subscription region, radius 0 means everywhere
+	center geo.LatLng
+	radius float64
+}
+
+// matches returns true if the client is subscribed to the object
+func (c *streamClient) matches(o opm.MapObject) bool {
+	if !c.types[o.Type] {
+		return false
+	}
+	return c.radius <= 0 || geo.Distance(c.center, geo.LatLng{Lat: o.Lat, Lng: o.Lng}) <= c.radius
+}
+
+// streamHub broadcasts newly saved map objects to all subscribed clients.
+// Clients that can't keep up are evicted instead of slowing down the scanner.
+type streamHub struct {
+	maxClients int
+	register   chan *streamClient
+	unregister chan *streamClient
+	broadcast  chan []opm.MapObject
+	clients    map[*streamClient]bool
+}
+
+func newStreamHub(maxClients int) *streamHub {
+	return &streamHub{
+		maxClients: maxClients,
+		register:   make(chan *streamClient),
+		unregister: make(chan *streamClient),
+		broadcast:  make(chan []opm.MapObject, 64),
+		clients:    make(map[*streamClient]bool),
+	}
+}
+
+func (h *streamHub) run() {
+	for {
+		select {
+		case c := <-h.register:
+			if len(h.clients) >= h.maxClients {
+				close(c.send)
+				continue
+			}
+			h.clients[c] = true
+		case c := <-h.unregister:
+			h.remove(c)
+		case objects := <-h.broadcast:
+			for c := range h.clients {
+				for _, o := range objects {
+					if !c.matches(o) {
+						continue
+					}
+					select {
+					case c.send <- o:
+					default:
+						log.Printf("Evicting slow stream client %s", util.AnonymizeIP(c.conn.RemoteAddr().String(), opmSettings.LogIPs, opmSettings.Secret))
+						h.remove(c)
+					}
+					if !h.clients[c] {
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func (h *streamHub) remove(c *streamClient) {
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// Publish sends objects to the subscribed clients. It never blocks the caller.
+func (h *streamHub) Publish(objects []opm.MapObject) {
+	if len(objects) == 0 {
+		return
+	}
+	select {
+	case h.broadcast <- objects:
+	default:
+		log.Println("Stream broadcast queue full, dropping objects")
+	}
+}
+
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	c := &streamClient{
+		hub:   stream,
+		send:  make(chan opm.MapObject, streamClientBuffer),
+		types: make(map[int]bool),
+	}
+	// Same type filter as /cache
+	if r.FormValue("p") != "" {
+		c.types[opm.POKEMON] = true
+	}
+	if r.FormValue("s") != "" {
+		c.types[opm.POKESTOP] = true
+	}
+	if r.FormValue("g") != "" {
+		c.types[opm.GYM] = true
+	}
+	if len(c.types) == 0 {
+		c.types = map[int]bool{opm.POKEMON: true, opm.POKESTOP: true, opm.GYM: true}
+	}
+	// Region
+	if r.FormValue("radius") != "" {
+		var err error
+		c.center.Lat, err = strconv.ParseFloat(r.FormValue("lat"), 64)
+		if err != nil {
+			http.Error(w, "Wrong format", http.StatusBadRequest)
+			return
+		}
+		c.center.Lng, err = strconv.ParseFloat(r.FormValue("lng"), 64)
+		if err != nil {
+			http.Error(w, "Wrong format", http.StatusBadRequest)
+			return
+		}
+		c.radius, err = strconv.ParseFloat(r.FormValue("radius"), 64)
+		if err != nil || c.radius <= 0 {
+			http.Error(w, "Wrong format", http.StatusBadRequest)
+			return
+		}
+	}
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.conn = conn
+	c.hub.register <- c
+	go c.writePump()
+	c.readPump()
+}
+
+// readPump discards incoming messages and keeps the read deadline up to date
+func (c *streamClient) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+		return nil
+	})
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// writePump sends the objects of the client and pings it regularly
+func (c *streamClient) writePump() {
+	ticker := time.NewTicker(streamPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case o, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if !ok {
+				// Evicted or rejected by the hub
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteJSON(o); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/client"
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+
+	"golang.org/x/net/context"
+)
+
+// withStream starts a stream hub and a scanner that serves /ws
+func withStream(t *testing.T) (*eventBus, *client.Client) {
+	old := stream
+	stream = newStreamHub(10)
+	go stream.run()
+	t.Cleanup(func() { stream = old })
+	bus := newEventBus()
+	subscribeAll(bus)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", streamHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return bus, client.New(server.URL, "")
+}
+
+func TestStreamSubscription(t *testing.T) {
+	bus, c := withStream(t)
+	center := opm.MapObject{Type: opm.POKEMON, ID: "center", PokemonID: 1, Lat: 52.52, Lng: 13.405}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := c.Watch(ctx, client.WatchQuery{Pokemon: true, Lat: center.Lat, Lng: center.Lng, Radius: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	received := make(chan opm.MapObject, 10)
+	go func() {
+		defer close(received)
+		for {
+			o, err := s.Next()
+			if err != nil {
+				return
+			}
+			received <- o
+		}
+	}()
+
+	// The client is registered with the hub after the upgrade, scans are repeated until it
+	// gets the first object
+	done := make(chan struct{})
+	go func() {
+		for {
+			bus.Emit(objectsPersisted{Objects: []opm.MapObject{center}})
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	select {
+	case o := <-received:
+		if o.ID != "center" {
+			t.Fatalf("first object = %+v, want the subscribed Pokemon", o)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the first object")
+	}
+	close(done)
+
+	// About 500 m and 2 km north of the center
+	bus.Emit(objectsPersisted{Objects: []opm.MapObject{
+		{Type: opm.POKEMON, ID: "far", PokemonID: 2, Lat: 52.538, Lng: 13.405},
+		{Type: opm.GYM, ID: "gym", Lat: 52.5245, Lng: 13.405},
+		{Type: opm.POKEMON, ID: "near", PokemonID: 3, Lat: 52.5245, Lng: 13.405},
+	}})
+	bus.Emit(objectsPersisted{Objects: []opm.MapObject{{Type: opm.POKEMON, ID: "last", PokemonID: 4, Lat: 52.52, Lng: 13.41}}})
+	var got []string
+	timeout := time.After(time.Second)
+	for len(got) == 0 || got[len(got)-1] != "last" {
+		select {
+		case o, ok := <-received:
+			if !ok {
+				t.Fatalf("stream closed after %v", got)
+			}
+			if o.ID != "center" {
+				got = append(got, o.ID)
+			}
+		case <-timeout:
+			t.Fatalf("timed out after %v", got)
+		}
+	}
+	if len(got) != 2 || got[0] != "near" {
+		t.Errorf("received %v, want near and last", got)
+	}
+}
+
+func TestStreamDeletion(t *testing.T) {
+	bus, c := withStream(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	s, err := c.Watch(ctx, client.WatchQuery{Pokemon: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	received := make(chan opm.MapObject, 10)
+	go func() {
+		defer close(received)
+		for {
+			o, err := s.Next()
+			if err != nil {
+				return
+			}
+			received <- o
+		}
+	}()
+	pokemon := opm.MapObject{Type: opm.POKEMON, ID: "p1", PokemonID: 16, Lat: 52.52, Lng: 13.405}
+	// Repeated until the client is registered with the hub
+	done := make(chan struct{})
+	go func() {
+		for {
+			bus.Emit(objectsPersisted{Objects: []opm.MapObject{pokemon}})
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the Pokemon")
+	}
+	close(done)
+
+	// Another process deletes the Pokemon
+	var polled []db.DeletedCursor
+	deleted := pokemon
+	deleted.Deleted = true
+	start, last := db.DeletedCursor{LastSeen: 1000}, db.DeletedCursor{LastSeen: 1000, ID: "p1"}
+	next := pollTombstones(bus, start, func(after db.DeletedCursor, limit int) ([]opm.MapObject, db.DeletedCursor, error) {
+		polled = append(polled, after)
+		if after == start {
+			return []opm.MapObject{deleted}, last, nil
+		}
+		return nil, after, nil
+	})
+	// The poll pages until no deletions are left
+	if len(polled) != 2 || polled[1] != last || next != last {
+		t.Errorf("polled after %v, next poll after %+v", polled, next)
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case o, ok := <-received:
+			if !ok {
+				t.Fatal("stream closed before the deletion")
+			}
+			if o.Deleted {
+				if o.ID != "p1" {
+					t.Errorf("deletion of %s, want p1", o.ID)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the deletion")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// Time between polls for deleted objects
+const tombstonePoll = 5 * time.Second
+
+// Deleted objects per query of a poll
+const tombstonePage = 500
+
+// deletedSinceFunc returns the objects deleted after the cursor, see db.OpenMapDb.GetDeletedSince
+type deletedSinceFunc func(after db.DeletedCursor, limit int) ([]opm.MapObject, db.DeletedCursor, error)
+
+// watchTombstones emits the objects deleted by any process, so the stream and the webhooks
+// tell their consumers about the deletion
+func watchTombstones(bus *eventBus, deletedSince deletedSinceFunc) {
+	cursor := db.DeletedCursorAt(time.Now().Unix())
+	for {
+		time.Sleep(tombstonePoll)
+		cursor = pollTombstones(bus, cursor, deletedSince)
+	}
+}
+
+// pollTombstones emits the objects deleted after the cursor, a page per event, and returns
+// the cursor of the next poll
+func pollTombstones(bus *eventBus, cursor db.DeletedCursor, deletedSince deletedSinceFunc) db.DeletedCursor {
+	for {
+		deleted, next, err := deletedSince(cursor, tombstonePage)
+		if err != nil {
+			log.Println(err)
+			return cursor
+		}
+		if len(deleted) > 0 {
+			bus.Emit(objectsDeleted{Objects: deleted})
+		}
+		if next == cursor {
+			return cursor
+		}
+		cursor = next
+	}
+}
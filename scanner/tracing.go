@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/pogointel/opm/internal/logging"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the scan pipeline. Until initTracing installs an exporter,
+// the global provider is the no-op provider of OpenTelemetry.
+var tracer = otel.Tracer("github.com/pogointel/opm/scanner")
+
+// initTracing exports spans via OTLP/HTTP to the configured endpoint. Without an endpoint
+// nothing is set up and all spans are no-ops.
+func initTracing(s settings) {
+	if s.TracingEndpoint == "" {
+		return
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(s.TracingEndpoint)}
+	if s.TracingInsecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		log.Printf("Tracing disabled: %s", err)
+		return
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(s.TracingSampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "opm-scanner"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	log.Printf("Exporting traces to %s (sample rate %.2f)", s.TracingEndpoint, s.TracingSampleRate)
+}
+
+// traced starts a server span for every request, continuing the trace of the caller if
+// it sent a traceparent header. Handlers get the span and the request id for the logs with
+// the request context. The request id is taken from X-Request-Id if the caller sent a
+// valid one and is echoed in the response.
+func traced(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		ctx := otel.GetTextMapPropagator().Extract(logging.WithRequestID(r.Context(), id), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.method", r.Method), attribute.String("http.target", r.URL.Path), attribute.String("request.id", id)))
+		defer span.End()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		inner(sw, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	}
+}
+
+// detached returns a context that carries the span and the request id of the request but is
+// not canceled when the client goes away, so a scan that was started is still finished and saved.
+func detached(r *http.Request) context.Context {
+	ctx := logging.WithRequestID(context.Background(), logging.RequestID(r.Context()))
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(r.Context()))
+}
+
+// statusWriter records the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes of streamed responses on
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original writer for http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// endSpan records the error of a pipeline step and ends its span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
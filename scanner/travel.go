@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// PreferNearbyTrainer returns a trainer that can move to the point without exceeding the
+// maximum jump speed, so it doesn't get softbanned. An idle trainer near the point is taken
+// first, see stickyTrainer. The closest of the candidates is preferred.
+// If none of them can make it in time, the closest one is queued again until it can and
+// opm.ErrBusy is returned.
+func PreferNearbyTrainer(ctx context.Context, lat, lng float64) (*util.TrainerSession, error) {
+	if trainer := stickyTrainer(lat, lng); trainer != nil {
+		return trainer, nil
+	}
+	max := scannerSettings.MaxJumpSpeed
+	if max <= 0 {
+		return getTrainerFor(ctx, 1, 0)
+	}
+	var best *util.TrainerSession
+	var bestWait time.Duration
+	for i := 0; i < trainerCandidates; i++ {
+		candidate, cancel := candidateContext(ctx, i)
+		trainer, err := getTrainerFor(candidate, 1, 0)
+		cancel()
+		if err != nil {
+			break
+		}
+		wait := trainer.CooldownTo(lat, lng, max, time.Now())
+		if wait == 0 {
+			if best != nil {
+				trainerQueue.Queue(best, 0)
+			}
+			return trainer, nil
+		}
+		if best == nil || wait < bestWait {
+			if best != nil {
+				trainerQueue.Queue(best, 0)
+			}
+			best, bestWait = trainer, wait
+			continue
+		}
+		trainerQueue.Queue(trainer, 0)
+	}
+	if best == nil {
+		return nil, opm.ErrBusy
+	}
+	log.Printf("No trainer near %f, %f, %s cools down for %s", lat, lng, util.Username(best.Account.Username), bestWait.Round(time.Second))
+	trainerQueue.Queue(best, bestWait)
+	return nil, opm.ErrBusy
+}
+
+// stickyTrainer takes the idle trainer whose last scan is closest to the point, so scans of
+// an area stay with the trainers that are already there instead of logging in new ones. Only
+// trainers within StickyRadius that can move to the point without exceeding MaxJumpSpeed are
+// considered. It returns nil if there is none, and while requests wait for a trainer, which
+// are served in order.
+func stickyTrainer(lat, lng float64) *util.TrainerSession {
+	radius := float64(scannerSettings.StickyRadius)
+	if radius <= 0 || len(pool.jobs) > 0 {
+		return nil
+	}
+	p, now := geo.LatLng{Lat: lat, Lng: lng}, time.Now()
+	return trainerQueue.TakeBest(func(t *util.TrainerSession) (float64, bool) {
+		last, ok := t.LastLocation()
+		if !ok || t.Capacity(0) == 0 {
+			return 0, false
+		}
+		d := geo.Distance(last, p)
+		if d > radius {
+			return 0, false
+		}
+		if max := scannerSettings.MaxJumpSpeed; max > 0 && t.CooldownTo(lat, lng, max, now) > 0 {
+			return 0, false
+		}
+		return d, true
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+
+	"golang.org/x/net/context"
+)
+
+// trainerAt returns a trainer that just moved to distance meters north of the point
+func trainerAt(name string, p geo.LatLng, distance float64) *util.TrainerSession {
+	trainer := util.NewTrainerSession(opm.Account{Username: name}, &api.Location{}, nil, nil)
+	if distance >= 0 {
+		at := geo.Destination(p, distance, 0)
+		trainer.MoveTo(&api.Location{Lat: at.Lat, Lon: at.Lng})
+	}
+	return trainer
+}
+
+func TestPreferNearbyTrainer(t *testing.T) {
+	// 36 km/h is 10 m/s, each km is 100 s of cooldown
+	withSettings(t, func(s *settings) { s.MaxJumpSpeed, s.StickyRadius = 36, 0 })
+	p := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	ready := trainerAt("ready", p, -1)
+	withTrainers(t, trainerAt("far", p, 10000), trainerAt("near", p, 1000), ready)
+
+	trainer, err := PreferNearbyTrainer(context.Background(), p.Lat, p.Lng)
+	if err != nil || trainer != ready {
+		t.Fatalf("PreferNearbyTrainer = %v, %v, want the trainer that can move there", trainer, err)
+	}
+}
+
+func TestPreferNearbyTrainerCoolsDownClosest(t *testing.T) {
+	withSettings(t, func(s *settings) { s.MaxJumpSpeed, s.StickyRadius = 36, 0 })
+	p := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	far, near, mid := trainerAt("far", p, 10000), trainerAt("near", p, 1000), trainerAt("mid", p, 5000)
+	withTrainers(t, far, near, mid)
+
+	if trainer, err := PreferNearbyTrainer(context.Background(), p.Lat, p.Lng); err != opm.ErrBusy {
+		t.Fatalf("PreferNearbyTrainer = %v, %v, want busy while all trainers cool down", trainer, err)
+	}
+	// The others are queued again right away, the closest waits for its cooldown
+	got := make(map[*util.TrainerSession]bool)
+	for i := 0; i < 2; i++ {
+		trainer, err := trainerQueue.Get(100 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("trainer %d not queued again: %v", i, err)
+		}
+		got[trainer] = true
+	}
+	if !got[far] || !got[mid] {
+		t.Errorf("queued trainers = %v, want far and mid", got)
+	}
+	// The cooldowns of the others are cleared right after they were queued
+	eventually(t, "the cooldown of the closest trainer", func() bool { return trainerQueue.NextReady() > 0 })
+	if wait := trainerQueue.NextReady(); wait < 90*time.Second || wait > 100*time.Second {
+		t.Errorf("closest trainer ready in %s, want its 100 s cooldown", wait)
+	}
+	trainerQueue.Queue(far, 0)
+	trainerQueue.Queue(mid, 0)
+}
+
+func TestPreferNearbyTrainerDisabled(t *testing.T) {
+	withSettings(t, func(s *settings) { s.MaxJumpSpeed, s.StickyRadius = 0, 0 })
+	p := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	far := trainerAt("far", p, 10000)
+	withTrainers(t, far)
+	if trainer, err := PreferNearbyTrainer(context.Background(), p.Lat, p.Lng); err != nil || trainer != far {
+		t.Errorf("PreferNearbyTrainer = %v, %v, want any trainer without MaxJumpSpeed", trainer, err)
+	}
+}
+
+func TestEmptyResponseAfterJumpIsSoftban(t *testing.T) {
+	withSettings(t, func(s *settings) { s.MaxJumpSpeed = 36 })
+	p := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	jumped, stayed := trainerAt("jumped", p, 10000), trainerAt("stayed", p, 0)
+	_, store := withTrainers(t, jumped, stayed)
+	getMapResult = func(trainer *util.TrainerSession, lat, lng float64) ([]opm.MapObject, error) {
+		return nil, errors.New("Empty response")
+	}
+	for _, trainer := range []*util.TrainerSession{jumped, stayed} {
+		if _, err := scan(trainer, p.Lat, p.Lng); err == nil {
+			t.Errorf("scan of %s succeeded", trainer.Account.Username)
+		}
+	}
+	if jumped.Account.Banned {
+		t.Error("account banned for an empty response after a jump")
+	}
+	if !stayed.Account.Banned || len(store.banned) != 1 || store.banned[0] != "stayed" {
+		t.Errorf("banned accounts = %v, want the one that didn't jump", store.banned)
+	}
+}
+
+// simulateLogins scans a scripted stream of requests around two points 5 km apart with four
+// idle trainers and returns the number of logins. A trainer logs in before its first scan and
+// reuses its session afterwards.
+func simulateLogins(t *testing.T, stickyRadius int) int {
+	withSettings(t, func(s *settings) {
+		s.ScanDelay, s.MaxJumpSpeed, s.StickyRadius, s.MockMode = 0, 0, stickyRadius, false
+	})
+	var trainers []*util.TrainerSession
+	for i := 0; i < 4; i++ {
+		trainers = append(trainers, trainerAt(fmt.Sprintf("trainer%d", i), geo.LatLng{}, -1))
+	}
+	u, _ := withTrainers(t, trainers...)
+	loggedIn := make(map[string]bool)
+	getMapResult = func(trainer *util.TrainerSession, lat, lng float64) ([]opm.MapObject, error) {
+		trainer.MoveTo(&api.Location{Lat: lat, Lon: lng})
+		loggedIn[trainer.Account.Username] = true
+		return u.getMapResult(trainer, lat, lng)
+	}
+	areas := []geo.LatLng{{Lat: 52.5, Lng: 13.4}, geo.Destination(geo.LatLng{Lat: 52.5, Lng: 13.4}, 5000, 90)}
+	for i, area := range []int{0, 0, 1, 0, 1, 1, 0, 1, 0, 0, 1, 1, 0, 1, 0, 1} {
+		// The requests come one after the other, the previous trainer is back in the queue
+		eventually(t, "all trainers idle", func() bool {
+			s := trainerQueue.Stats()
+			return s.Available == 4 && s.Cooling == 0
+		})
+		// The points are up to 200 m from the center of their area
+		p := geo.Destination(areas[area], float64(i%3)*100, float64(i*45))
+		values := url.Values{"lat": {fmt.Sprint(p.Lat)}, "lng": {fmt.Sprint(p.Lng)}}
+		r := httptest.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		requestHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	return len(loggedIn)
+}
+
+func TestStickyTrainersCutLogins(t *testing.T) {
+	without := simulateLogins(t, 0)
+	with := simulateLogins(t, 1000)
+	// Without stickiness the requests go around all trainers, with it each area keeps the
+	// trainer that scanned it first
+	if without != 4 || with != 2 {
+		t.Errorf("%d logins without stickiness and %d with it, want 4 and 2", without, with)
+	}
+}
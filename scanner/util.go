@@ -2,28 +2,172 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"log"
 	"time"
 
 	"github.com/paulbellamy/ratecounter"
 
 	"github.com/femot/pgoapi-go/api"
+	"github.com/pogointel/opm/db"
 	"github.com/pogointel/opm/opm"
 	"github.com/pogointel/opm/util"
 )
 
 type settings struct {
-	Accounts    int  // Number of initial accounts to load from db
-	ScanDelay   int  // Time between scans per account in seconds
-	APICallRate int  // Time between API calls in milliseconds
-	MockMode    bool // Return random pokemon
+	Accounts               int  // Number of initial accounts to load from db
+	ScanDelay              int  // Time between scans per account in seconds
+	ScansPerProxyPerMinute int  // Upstream calls per proxy and minute (0 = unlimited)
+	MockMode               bool // Return random pokemon
+	MaxScanLabels          int  // Maximum number of distinct scan labels in the metrics
+	// Per account budget
+	MaxScansPerHour int // Maximum number of scans per account and hour (0 = unlimited)
+	SessionLifetime int // Time in seconds after which a session is renewed (0 = never)
+	// Token accounts
+	GoogleClientID     string // OAuth client for refreshing Google tokens (optional)
+	GoogleClientSecret string
+	// Routes
+	ScanRadius        int     // Visibility radius of a scan in meters
+	MaxRouteLength    int     // Maximum length of a route in meters
+	MaxRouteDuration  int     // Maximum time for a route scan in seconds
+	MaxSpeed          float64 // Maximum speed of a trainer in km/h
+	MaxRouteWaypoints int     // Maximum number of waypoints of a /route request
+	// Softbans
+	MaxJumpSpeed float64 // Maximum implied speed in km/h between two scans of a trainer (0 = disabled)
+	// Locality
+	StickyRadius int // Scans prefer an idle trainer whose last scan is within this many meters (0 = disabled)
+	// Coalescing, requests for the same cell of about 11 m share a running scan
+	CoalesceWindow int // Seconds a finished scan is returned to further requests for its cell (0 = no sharing)
+	// Batches
+	MaxBatchPoints  int // Maximum number of points per batch scan
+	MaxBatchWorkers int // Number of points of a batch that are scanned concurrently
+	// Areas
+	MaxAreaRadius   int // Maximum radius of an area scan in meters
+	AreaParallelism int // Number of cell groups of an area that are scanned concurrently
+	// Stream
+	MaxStreamClients int // Maximum number of websocket clients on /ws
+	// Memory
+	MaxTrackedMemory    int64 // Cap for in-process metrics structures in bytes
+	MemoryCheckInterval int   // Time between memory checks in seconds
+	// Raw capture for replay
+	CapturePercent float64 // Percentage of responses that are stored raw (0 = off)
+	CaptureTTL     int     // Time in hours captured responses are kept
+	// Proxy health checks
+	ProxyCheckURL         string // HTTPS URL requested through each proxy
+	ProxyCheckInterval    int    // Time between checks of a proxy in seconds (0 = disabled)
+	ProxyCheckConcurrency int    // Number of proxies checked at the same time
+	ProxyCheckFailures    int    // Consecutive failed checks before a proxy is marked dead
+	// Upstream
+	MaxInFlight    int // Maximum number of concurrent upstream requests
+	InFlightWaitMs int // Time in milliseconds a request waits for a free upstream slot
+	// Backpressure
+	TrainerJobQueue int // Number of requests waiting for a trainer, further requests are rejected as busy
+	QueueTimeout    int // Seconds a request waits for a trainer before it is answered as busy
+	BusyRetryAfter  int // Retry-After in seconds of busy responses
+	// Error budget
+	MaxBansPerHour    int     // Pause scanning when more accounts get banned within an hour (0 = disabled)
+	MaxFailureRate    float64 // Pause scanning when the upstream failure rate exceeds this percentage (0 = disabled)
+	MinFailureSamples int     // Minimum number of scans in the window before the failure rate is evaluated
+	FailureWindow     int     // Window for the failure rate in seconds
+	PauseCooldown     int     // Time in seconds until a pause is lifted automatically
+	AlertURL          string  // URL that receives operator alerts (optional)
+	// Writes
+	PokemonWrites string // "seen" skips Pokemon saved before, "upsert" upserts them by id, "insert" lets the db reject duplicates
+	RecordNearby  bool   // store nearby Pokemon (no coordinates) for triangulation, MongoDB only
+	ScanHistory   int    // Days successful scans are kept for /coverage (0 = not recorded), MongoDB only
+	// Write batching
+	WriteBatchSize  int // Objects saved together in the background (0 = saved with the scan)
+	WriteBatchBytes int // Estimated size in bytes at which a batch is saved early (0 = no limit)
+	WriteFlushMs    int // Time in milliseconds objects wait for their batch to fill
+	WriteQueue      int // Scan results waiting for the writer, further results are saved with the scan
+	// Leveling
+	MinAccountLevel int // Only scan with accounts of at least this level (0 = any level), MongoDB only
+	// Cleanup
+	CleanupInterval    int // Seconds between removals of expired Pokemon (0 = left to opmctl -removepokemon)
+	IdleTrainerMinutes int // Trainers that haven't scanned this long are returned to the db (0 = kept)
+	TempBanCooloff     int // Minutes until temporarily banned accounts return to rotation (0 = kept banned), MongoDB only
+	// Account intake, see opm.Settings.AccountIntake
+	IntakeInterval  int     // Seconds between two warm-up interactions (0 = no warm-up)
+	IntakeSpacing   int     // Seconds between the warm-up interactions of one account
+	IntakeCleanRuns int     // Clean warm-up interactions before an account is promoted
+	IntakeLat       float64 // Location of the warm-up scans
+	IntakeLng       float64
+	// Tracing
+	TracingEndpoint   string  // OTLP/HTTP endpoint (host:port) that receives spans, empty = tracing off
+	TracingInsecure   bool    // send spans without TLS
+	TracingSampleRate float64 // fraction of requests that are traced
+	// Webhooks
+	WebhookURLs    []string        // URLs that receive new Pokemon in the RocketMap webhook format
+	WebhookTargets []webhookTarget // Webhooks with their own filters, in addition to WebhookURLs
+	WebhookQueue   int             // Number of messages queued per webhook before messages are dropped
+	// Pokemon with fewer seconds left when their message is sent are dropped (0 = disabled)
+	WebhookMinLifetime int
+	// Template of the map image linked in the messages, e.g. util.StaticMapOSM. Placeholders
+	// are {lat}, {lng} and {zoom}, empty = no image.
+	StaticMapURL string
 }
 
 var defaultScannerSettings = settings{
-	Accounts:    1,
-	ScanDelay:   25,
-	APICallRate: 1,
-	MockMode:    false,
+	Accounts:               1,
+	ScanDelay:              25,
+	ScansPerProxyPerMinute: 30,
+	MockMode:               false,
+	MaxScanLabels:          20,
+	// Routes
+	ScanRadius:        70,
+	MaxRouteLength:    2000,
+	MaxRouteDuration:  300,
+	MaxSpeed:          30,
+	MaxRouteWaypoints: 50,
+	// Coalescing
+	CoalesceWindow: 5,
+	// Batches
+	MaxBatchPoints:  32,
+	MaxBatchWorkers: 8,
+	// Areas
+	MaxAreaRadius:   1500,
+	AreaParallelism: 4,
+	// Stream
+	MaxStreamClients: 100,
+	// Memory
+	MaxTrackedMemory:    16 << 20,
+	MemoryCheckInterval: 60,
+	// Raw capture
+	CaptureTTL: 72,
+	// Proxy health checks
+	ProxyCheckURL:         "https://pgorelease.nianticlabs.com/plfe/version",
+	ProxyCheckInterval:    300,
+	ProxyCheckConcurrency: 5,
+	ProxyCheckFailures:    3,
+	// Upstream
+	MaxInFlight:    50,
+	InFlightWaitMs: 500,
+	// Backpressure
+	TrainerJobQueue: 100,
+	QueueTimeout:    30,
+	BusyRetryAfter:  5,
+	// Error budget
+	MinFailureSamples: 20,
+	FailureWindow:     600,
+	PauseCooldown:     1800,
+	// Writes
+	PokemonWrites: writesSeen,
+	ScanHistory:   14,
+	// Write batching
+	WriteBatchBytes: 1 << 20,
+	WriteFlushMs:    500,
+	WriteQueue:      100,
+	// Cleanup
+	CleanupInterval: 60,
+	// Account intake
+	IntakeInterval:  300,
+	IntakeSpacing:   7200,
+	IntakeCleanRuns: 3,
+	// Tracing
+	TracingSampleRate: 1,
+	// Webhooks
+	WebhookQueue: 1000,
 }
 
 func loadSettings() (settings, error) {
@@ -42,8 +186,6 @@ func loadSettings() (settings, error) {
 	return s, err
 }
 
-type status map[string]opm.StatusEntry
-
 type metrics struct {
 	// Requests
 	BlockedRequestsPerMinute *ratecounter.RateCounter
@@ -52,6 +194,11 @@ type metrics struct {
 	ScanFailsPerMinute  *ratecounter.RateCounter
 	ScanBusyPerMinute   *ratecounter.RateCounter
 	ScanResponseTimesMs *RingBuffer
+	ScansByLabel        *labelCounters
+	// Upstream
+	Inflight *inflightLimiter
+	// Memory
+	Memory *memoryAccountant
 	// Cache
 	CacheRequestsPerMinute     *ratecounter.RateCounter
 	CacheRequestFailsPerMinute *ratecounter.RateCounter
@@ -76,6 +223,19 @@ type scannerMetricsData struct {
 	ScanFailsPerMinute int64 `json:"scan_fails_per_minute"`
 	ScanBusyPerMinute  int64 `json:"scan_busy_per_minute"`
 
+	ScansPerMinuteByLabel map[string]int64 `json:"scans_per_minute_by_label"`
+
+	UpstreamInFlight      int64 `json:"upstream_in_flight"`
+	UpstreamInFlightWaits int64 `json:"upstream_in_flight_waits"`
+
+	TrainerQueue util.QueueStats `json:"trainer_queue"`
+	TrainerPool  poolStats       `json:"trainer_pool"`
+
+	SuppressedBySpecies map[int]int64 `json:"suppressed_by_species"`
+	SeenPokemonSkipped  int64         `json:"seen_pokemon_skipped"`
+
+	TrackedMemoryBytes map[string]int64 `json:"tracked_memory_bytes"`
+
 	ScanResponseTimesMax int64   `json:"scan_response_times_max"`
 	ScanResponseTimesMin int64   `json:"scan_response_times_min"`
 	ScanResponseTimesAvg float64 `json:"scan_response_times_avg"`
@@ -140,12 +300,28 @@ func (s *metrics) String() string {
 		ScanResponseTimesMin:       scanTimesMin,
 		ScanResponseTimesMax:       scanTimesMax,
 		ScanResponseTimesAvg:       scanTimesAvg,
+		ScansPerMinuteByLabel:      s.ScansByLabel.Rates(),
+		UpstreamInFlight:           s.Inflight.InFlight(),
+		UpstreamInFlightWaits:      s.Inflight.Waits(),
+		TrackedMemoryBytes:         s.Memory.Usage(),
 		CacheRequestsPerMinute:     s.CacheRequestsPerMinute.Rate(),
 		CacheRequestFailsPerMinute: s.CacheRequestFailsPerMinute.Rate(),
 		CacheResponseTimesAvg:      cacheTimesAvg,
 		CacheResponseTimesMax:      cacheTimesMax,
 		CacheResponseTimesMin:      cacheTimesMin,
 	}
+	if trainerQueue != nil {
+		data.TrainerQueue = trainerQueue.Stats()
+	}
+	if pool != nil {
+		data.TrainerPool = pool.Stats()
+	}
+	if seen != nil {
+		data.SeenPokemonSkipped = seen.Skipped()
+	}
+	if database != nil {
+		data.SuppressedBySpecies = database.SuppressedCounts()
+	}
 	bytes, _ := json.Marshal(data)
 	return string(bytes)
 }
@@ -201,16 +377,48 @@ func NewBuffer(cap int) *RingBuffer {
 }
 
 func NewTrainerFromDb() (*util.TrainerSession, error) {
-	p, err := database.GetProxy()
+	p, err := store.GetProxy()
+	if errors.Is(err, db.ErrUnavailable) {
+		return &util.TrainerSession{}, err
+	}
 	if err != nil {
 		return &util.TrainerSession{}, opm.ErrBusy
 	}
-	a, err := database.GetAccount()
+	a, err := getAccount()
 	if err != nil {
-		database.ReturnProxy(p)
+		if err := store.ReturnProxy(p); err != nil {
+			log.Println(err)
+		}
+		if errors.Is(err, db.ErrUnavailable) {
+			return &util.TrainerSession{}, err
+		}
 		return &util.TrainerSession{}, opm.ErrBusy
 	}
+	return newTrainer(a, p), nil
+}
+
+// getAccount returns a free account of at least MinAccountLevel. Lower accounts are never
+// used for scanning, so the caller gets ErrNoAccountAvailable if there is none.
+func getAccount() (opm.Account, error) {
+	if scannerSettings.MinAccountLevel > 0 && store == opm.Database(database) {
+		return database.GetAccountMinLevel(scannerSettings.MinAccountLevel)
+	}
+	return store.GetAccount()
+}
+
+// newTrainer creates a trainer session with the configured budget
+func newTrainer(a opm.Account, p opm.Proxy) *util.TrainerSession {
 	trainer := util.NewTrainerSession(a, &api.Location{}, feed, crypto)
+	trainer.MaxScansPerHour = scannerSettings.MaxScansPerHour
+	trainer.SessionLifetime = time.Duration(scannerSettings.SessionLifetime) * time.Second
+	if scannerSettings.GoogleClientID != "" {
+		trainer.RefreshToken = util.GoogleTokenRefresher(scannerSettings.GoogleClientID, scannerSettings.GoogleClientSecret)
+	}
+	trainer.OnTokenRotated = func(a opm.Account) {
+		if err := store.UpdateAccount(a); err != nil {
+			log.Println(err)
+		}
+	}
 	trainer.SetProxy(p)
-	return trainer, nil
+	return trainer
 }
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// webhookRetries is the number of retries of a message that failed with a 5xx status
+const webhookRetries = 3
+
+// webhookTarget is a webhook of WebhookTargets
+type webhookTarget struct {
+	URL string
+	// Lured Pokestops with these lure types are sent too, e.g. ["glacial"] (see opm.LureGlacial).
+	// Empty = Pokemon only, like the URLs of WebhookURLs.
+	LureTypes []string
+	// Overrides WebhookMinLifetime for this webhook if set
+	MinLifetime int
+}
+
+// webhookMessage is a message in the RocketMap webhook format
+type webhookMessage struct {
+	Type    string      `json:"type"`
+	Message interface{} `json:"message"`
+}
+
+type webhookPokemon struct {
+	EncounterID   string  `json:"encounter_id"`
+	SpawnpointID  string  `json:"spawnpoint_id,omitempty"`
+	PokemonID     int     `json:"pokemon_id"`
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	DisappearTime int64   `json:"disappear_time"`
+	// Image of the map around the Pokemon, only set if StaticMapURL is configured
+	StaticMap string `json:"static_map,omitempty"`
+}
+
+type webhookPokestop struct {
+	PokestopID         string  `json:"pokestop_id"`
+	Latitude           float64 `json:"latitude"`
+	Longitude          float64 `json:"longitude"`
+	Enabled            bool    `json:"enabled"`
+	LureExpiration     int64   `json:"lure_expiration"` // 0 if unknown
+	ActiveFortModifier int     `json:"active_fort_modifier"`
+	LureType           string  `json:"lure_type"`
+	StaticMap          string  `json:"static_map,omitempty"`
+}
+
+// webhookDeleted is the message of a deleted Pokemon or Pokestop. RocketMap has no such
+// message, consumers that don't know it ignore it.
+type webhookDeleted struct {
+	ID        string  `json:"id"`
+	Type      string  `json:"object_type"` // "pokemon" or "pokestop"
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// webhookDispatcher posts new Pokemon and lures to the configured webhooks, and their deletion.
+// Every URL has its own bounded queue and worker, so a slow webhook neither blocks the scans nor
+// the other webhooks.
+type webhookDispatcher struct {
+	hooks     []*webhook
+	backoff   time.Duration
+	client    *http.Client
+	staticMap string // template of util.StaticMapURL, empty = no image
+	// Returns the stored version of an object. Pokemon are checked against it right before
+	// they are sent, nil = no check.
+	lookup func(id string) (opm.MapObject, error)
+	// Lures that were alerted, by stop id. Forts are saved with every scan, a lure is only
+	// alerted once.
+	lureMutex sync.Mutex
+	lures     map[string]lureAlert
+}
+
+type lureAlert struct {
+	lureType string
+	expiry   int64
+	sent     time.Time
+}
+
+type webhook struct {
+	url       string
+	host      string // webhook URLs often contain tokens, so only the host is logged
+	name      string // host, with the position among the webhooks of the host if there are several
+	lureTypes map[string]bool
+	// Minimum time a Pokemon has left when its message is sent
+	minLifetime time.Duration
+	queue       chan opm.MapObject
+	sent        int64
+	failed      int64
+	dropped     int64
+	stale       int64
+}
+
+func newWebhookDispatcher(s settings) *webhookDispatcher {
+	d := &webhookDispatcher{
+		backoff:   time.Second,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		staticMap: s.StaticMapURL,
+		lures:     make(map[string]lureAlert),
+	}
+	targets := append([]webhookTarget(nil), s.WebhookTargets...)
+	for _, u := range s.WebhookURLs {
+		targets = append(targets, webhookTarget{URL: u})
+	}
+	hosts := make(map[string]int)
+	for _, t := range targets {
+		h := &webhook{url: t.URL, host: t.URL, lureTypes: make(map[string]bool), queue: make(chan opm.MapObject, s.WebhookQueue)}
+		h.minLifetime = time.Duration(s.WebhookMinLifetime) * time.Second
+		if t.MinLifetime != 0 {
+			h.minLifetime = time.Duration(t.MinLifetime) * time.Second
+		}
+		if parsed, err := url.Parse(t.URL); err == nil {
+			h.host = parsed.Host
+		}
+		hosts[h.host]++
+		h.name = h.host
+		if hosts[h.host] > 1 {
+			h.name = fmt.Sprintf("%s#%d", h.host, hosts[h.host])
+		}
+		for _, lureType := range t.LureTypes {
+			h.lureTypes[lureType] = true
+		}
+		d.hooks = append(d.hooks, h)
+	}
+	return d
+}
+
+// run starts one worker per webhook
+func (d *webhookDispatcher) run() {
+	for _, h := range d.hooks {
+		go d.work(h)
+	}
+}
+
+// Dispatch queues the Pokemon and new lures of objects. Deleted objects are sent to the
+// webhooks that get their type. It never blocks, messages are dropped when a queue is full.
+func (d *webhookDispatcher) Dispatch(objects []opm.MapObject) {
+	now := opm.Now()
+	for _, o := range objects {
+		switch {
+		case o.Deleted && o.Type == opm.POKEMON:
+			for _, h := range d.hooks {
+				d.enqueue(h, o)
+			}
+		case o.Deleted && o.Type == opm.POKESTOP:
+			d.lureMutex.Lock()
+			delete(d.lures, o.ID)
+			d.lureMutex.Unlock()
+			for _, h := range d.hooks {
+				if len(h.lureTypes) > 0 {
+					d.enqueue(h, o)
+				}
+			}
+		case o.Deleted:
+			// Gyms are not sent
+		case o.Type == opm.POKEMON && !opm.Expired(o.Expiry, now):
+			for _, h := range d.hooks {
+				d.enqueue(h, o)
+			}
+		case o.Type == opm.POKESTOP && o.LureType != "" && d.newLure(o):
+			for _, h := range d.hooks {
+				if h.lureTypes[o.LureType] {
+					d.enqueue(h, o)
+				}
+			}
+		}
+	}
+}
+
+func (d *webhookDispatcher) enqueue(h *webhook, o opm.MapObject) {
+	select {
+	case h.queue <- o:
+	default:
+		if atomic.AddInt64(&h.dropped, 1)%100 == 1 {
+			log.Printf("Webhook %s can't keep up, dropping messages", h.host)
+		}
+	}
+}
+
+// newLure reports whether the lure of the stop wasn't alerted yet and remembers it. The
+// expiry of a lure is only known while a lured Pokemon is at the stop, lures without one
+// are remembered for opm.MaxLureLifetime.
+func (d *webhookDispatcher) newLure(o opm.MapObject) bool {
+	d.lureMutex.Lock()
+	defer d.lureMutex.Unlock()
+	now := opm.Now()
+	for id, l := range d.lures {
+		if now.Sub(l.sent) > opm.MaxLureLifetime || opm.Expired(l.expiry, now) {
+			delete(d.lures, id)
+		}
+	}
+	if l, ok := d.lures[o.ID]; ok && l.lureType == o.LureType {
+		if l.expiry == 0 && o.Expiry != 0 {
+			l.expiry = o.Expiry
+			d.lures[o.ID] = l
+		}
+		return false
+	}
+	d.lures[o.ID] = lureAlert{lureType: o.LureType, expiry: o.Expiry, sent: now}
+	return true
+}
+
+// fresh returns the Pokemon as it is stored and whether it's still worth an alert. Pokemon
+// that were deleted since they were queued, or that have less than the minimum lifetime of
+// the webhook left, are stale. Pokemon with an unknown expiry are never stale. A failed lookup doesn't hold the message back.
+func (d *webhookDispatcher) fresh(h *webhook, o opm.MapObject) (opm.MapObject, bool) {
+	if d.lookup != nil {
+		stored, err := d.lookup(o.ID)
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			return o, false
+		case err == nil && stored.Expiry != 0 && stored.Expiry < o.Expiry:
+			// The expiry was corrected downward
+			o.Expiry = stored.Expiry
+		}
+	}
+	if o.Expiry == 0 {
+		return o, true
+	}
+	now := opm.Now()
+	return o, !opm.Expired(o.Expiry, now) && time.Unix(o.Expiry, 0).Sub(now) >= h.minLifetime
+}
+
+// message returns the webhook message of an object
+func (d *webhookDispatcher) message(o opm.MapObject) webhookMessage {
+	if o.Deleted {
+		m := webhookDeleted{ID: o.ID, Type: "pokemon", Latitude: o.Lat, Longitude: o.Lng}
+		if o.Type == opm.POKESTOP {
+			m.Type = "pokestop"
+		}
+		return webhookMessage{Type: "deleted", Message: m}
+	}
+	if o.Type == opm.POKESTOP {
+		return webhookMessage{
+			Type: "pokestop",
+			Message: webhookPokestop{
+				PokestopID:         o.ID,
+				Latitude:           o.Lat,
+				Longitude:          o.Lng,
+				Enabled:            true,
+				LureExpiration:     o.Expiry,
+				ActiveFortModifier: opm.LureItem(o.LureType),
+				LureType:           o.LureType,
+				StaticMap:          util.StaticMapURL(d.staticMap, o.Lat, o.Lng, o.Type),
+			},
+		}
+	}
+	return webhookMessage{
+		Type: "pokemon",
+		Message: webhookPokemon{
+			EncounterID:   o.ID,
+			SpawnpointID:  o.SpawnpointID,
+			PokemonID:     o.PokemonID,
+			Latitude:      o.Lat,
+			Longitude:     o.Lng,
+			DisappearTime: o.Expiry,
+			StaticMap:     util.StaticMapURL(d.staticMap, o.Lat, o.Lng, o.Type),
+		},
+	}
+}
+
+func (d *webhookDispatcher) work(h *webhook) {
+	for o := range h.queue {
+		if o.Type == opm.POKEMON && !o.Deleted {
+			var ok bool
+			if o, ok = d.fresh(h, o); !ok {
+				atomic.AddInt64(&h.stale, 1)
+				continue
+			}
+		}
+		body, err := json.Marshal(d.message(o))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if d.post(h, body) {
+			atomic.AddInt64(&h.sent, 1)
+		} else {
+			atomic.AddInt64(&h.failed, 1)
+		}
+	}
+}
+
+// post sends one message. Server errors and network errors are retried with exponential backoff.
+func (d *webhookDispatcher) post(h *webhook, body []byte) bool {
+	backoff := d.backoff
+	for try := 0; ; try++ {
+		resp, err := d.client.Post(h.url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				if resp.StatusCode >= 300 {
+					log.Printf("Webhook %s: %s", h.host, resp.Status)
+					return false
+				}
+				return true
+			}
+			err = errors.New(resp.Status)
+		}
+		if try == webhookRetries {
+			log.Printf("Webhook %s failed after %d retries: %s", h.host, webhookRetries, err)
+			return false
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// String returns the counters per webhook for expvar
+func (d *webhookDispatcher) String() string {
+	type webhookStats struct {
+		Queued  int   `json:"queued"`
+		Sent    int64 `json:"sent"`
+		Failed  int64 `json:"failed"`
+		Dropped int64 `json:"dropped"`
+		Stale   int64 `json:"stale"`
+	}
+	stats := make(map[string]webhookStats, len(d.hooks))
+	for _, h := range d.hooks {
+		stats[h.name] = webhookStats{len(h.queue), atomic.LoadInt64(&h.sent), atomic.LoadInt64(&h.failed), atomic.LoadInt64(&h.dropped), atomic.LoadInt64(&h.stale)}
+	}
+	data, _ := json.Marshal(stats)
+	return string(data)
+}
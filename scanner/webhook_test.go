@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+)
+
+// webhookRecorder is a webhook server that records the messages per path
+type webhookRecorder struct {
+	*httptest.Server
+	sync.Mutex
+	messages map[string][]webhookMessage
+	raw      map[string][]map[string]interface{}
+}
+
+func newWebhookRecorder(t *testing.T) *webhookRecorder {
+	rec := &webhookRecorder{messages: make(map[string][]webhookMessage), raw: make(map[string][]map[string]interface{})}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var m webhookMessage
+		var raw map[string]interface{}
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Errorf("invalid message %s: %v", body, err)
+		}
+		json.Unmarshal(body, &raw)
+		rec.Lock()
+		rec.messages[r.URL.Path] = append(rec.messages[r.URL.Path], m)
+		rec.raw[r.URL.Path] = append(rec.raw[r.URL.Path], raw)
+		rec.Unlock()
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+// received returns the message types received on path
+func (rec *webhookRecorder) received(path string) []string {
+	rec.Lock()
+	defer rec.Unlock()
+	var types []string
+	for _, m := range rec.messages[path] {
+		types = append(types, m.Type)
+	}
+	return types
+}
+
+func (rec *webhookRecorder) rawMessages(path string) []map[string]interface{} {
+	rec.Lock()
+	defer rec.Unlock()
+	return append([]map[string]interface{}(nil), rec.raw[path]...)
+}
+
+func newTestDispatcher(s settings) *webhookDispatcher {
+	if s.WebhookQueue == 0 {
+		s.WebhookQueue = 10
+	}
+	d := newWebhookDispatcher(s)
+	d.backoff = time.Millisecond
+	d.run()
+	return d
+}
+
+func TestWebhookLureFilter(t *testing.T) {
+	rec := newWebhookRecorder(t)
+	d := newTestDispatcher(settings{
+		WebhookURLs:    []string{rec.URL + "/all"},
+		WebhookTargets: []webhookTarget{{URL: rec.URL + "/glacial", LureTypes: []string{opm.LureGlacial}}},
+	})
+	expiry := time.Now().Add(10 * time.Minute).Unix()
+	glacial := opm.MapObject{Type: opm.POKESTOP, ID: "stop1", Lat: 1, Lng: 2, Lured: true, LureType: opm.LureGlacial}
+	d.Dispatch([]opm.MapObject{
+		{Type: opm.POKEMON, ID: "p1", PokemonID: 16, Expiry: expiry},
+		glacial,
+		{Type: opm.POKESTOP, ID: "stop2", Lured: true, LureType: opm.LureMossy},
+		{Type: opm.POKESTOP, ID: "stop3"},
+	})
+	// The next scan saves the stop again, now with the expiry of its lured Pokemon
+	glacial.Expiry = expiry
+	d.Dispatch([]opm.MapObject{glacial})
+
+	eventually(t, "the glacial lure", func() bool { return len(rec.received("/glacial")) == 2 })
+	eventually(t, "the Pokemon", func() bool { return len(rec.received("/all")) == 1 })
+	time.Sleep(20 * time.Millisecond)
+	if got := rec.received("/all"); len(got) != 1 || got[0] != "pokemon" {
+		t.Errorf("/all received %v, want only the Pokemon", got)
+	}
+	got := rec.rawMessages("/glacial")
+	if len(got) != 2 {
+		t.Fatalf("/glacial received %d messages, want the Pokemon and one lure", len(got))
+	}
+	var stop map[string]interface{}
+	for _, m := range got {
+		if m["type"] == "pokestop" {
+			stop = m["message"].(map[string]interface{})
+		}
+	}
+	if stop == nil || stop["pokestop_id"] != "stop1" || stop["lure_type"] != opm.LureGlacial || stop["active_fort_modifier"] != float64(502) {
+		t.Errorf("lure message = %v, want the glacial lure of stop1", stop)
+	}
+
+	// A different lure on the stop is a new alert
+	d.Dispatch([]opm.MapObject{{Type: opm.POKESTOP, ID: "stop1", Lured: true, LureType: opm.LureMossy}})
+	d.Dispatch([]opm.MapObject{{Type: opm.POKESTOP, ID: "stop1", Lured: true, LureType: opm.LureGlacial}})
+	eventually(t, "the second glacial lure", func() bool { return len(rec.received("/glacial")) == 3 })
+}
+
+func TestWebhookStaleAlerts(t *testing.T) {
+	clock := newFakeClock()
+	oldNow := opm.Now
+	opm.Now = clock.Now
+	defer func() { opm.Now = oldNow }()
+	rec := newWebhookRecorder(t)
+	d := newWebhookDispatcher(settings{
+		WebhookURLs:        []string{rec.URL + "/default"},
+		WebhookTargets:     []webhookTarget{{URL: rec.URL + "/strict", MinLifetime: 300}},
+		WebhookQueue:       10,
+		WebhookMinLifetime: 60,
+	})
+	d.backoff = time.Millisecond
+	left := func(seconds int) int64 { return clock.Now().Add(time.Duration(seconds) * time.Second).Unix() }
+	pokemon := []opm.MapObject{
+		{Type: opm.POKEMON, ID: "short", Expiry: left(90)},
+		{Type: opm.POKEMON, ID: "medium", Expiry: left(240)},
+		{Type: opm.POKEMON, ID: "long", Expiry: left(900)},
+		{Type: opm.POKEMON, ID: "deleted", Expiry: left(900)},
+		{Type: opm.POKEMON, ID: "corrected", Expiry: left(900)},
+		{Type: opm.POKEMON, ID: "unknown"},
+	}
+	stored := make(map[string]opm.MapObject)
+	for _, o := range pokemon {
+		stored[o.ID] = o
+	}
+	var mutex sync.Mutex
+	d.lookup = func(id string) (opm.MapObject, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		o, ok := stored[id]
+		if !ok {
+			return o, db.ErrNotFound
+		}
+		return o, nil
+	}
+	d.Dispatch(pokemon)
+	// While the messages are queued one Pokemon is deleted and one turns out to despawn early
+	mutex.Lock()
+	delete(stored, "deleted")
+	corrected := stored["corrected"]
+	corrected.Expiry = left(100)
+	stored["corrected"] = corrected
+	mutex.Unlock()
+	// The queue is delayed by a minute, the short Pokemon has 30 s left when it's sent
+	clock.Advance(time.Minute)
+	d.run()
+
+	eventually(t, "the default webhook", func() bool { return len(rec.received("/default")) == 3 })
+	eventually(t, "the strict webhook", func() bool { return len(rec.received("/strict")) == 2 })
+	ids := func(path string) map[string]bool {
+		got := make(map[string]bool)
+		for _, m := range rec.rawMessages(path) {
+			got[m["message"].(map[string]interface{})["encounter_id"].(string)] = true
+		}
+		return got
+	}
+	if got := ids("/default"); !got["medium"] || !got["long"] || !got["unknown"] {
+		t.Errorf("/default received %v, want medium, long and unknown", got)
+	}
+	if got := ids("/strict"); !got["long"] || !got["unknown"] {
+		t.Errorf("/strict received %v, want long and unknown", got)
+	}
+	// The stale counts are per webhook, the second one of the host is numbered
+	type webhookStats struct{ Sent, Stale int64 }
+	var stats map[string]webhookStats
+	host := rec.Listener.Addr().String()
+	// A message is counted as sent after the webhook answered
+	eventually(t, "the sent counts", func() bool {
+		json.Unmarshal([]byte(d.String()), &stats)
+		return stats[host+"#2"].Sent == 3 && stats[host].Sent == 2
+	})
+	if s := stats[host+"#2"]; s.Sent != 3 || s.Stale != 3 {
+		t.Errorf("/default stats = %+v, want 3 sent and 3 stale", s)
+	}
+	if s := stats[host]; s.Sent != 2 || s.Stale != 4 {
+		t.Errorf("/strict stats = %+v, want 2 sent and 4 stale", s)
+	}
+}
+
+func TestWebhookDeletions(t *testing.T) {
+	rec := newWebhookRecorder(t)
+	d := newTestDispatcher(settings{
+		WebhookURLs:    []string{rec.URL + "/pokemon"},
+		WebhookTargets: []webhookTarget{{URL: rec.URL + "/lures", LureTypes: []string{opm.LureGlacial}}},
+	})
+	// Deleted objects are gone from the db, they are not stale
+	d.lookup = func(id string) (opm.MapObject, error) { return opm.MapObject{}, db.ErrNotFound }
+	stop := opm.MapObject{Type: opm.POKESTOP, ID: "stop1", Lat: 1, Lng: 2, Lured: true, LureType: opm.LureGlacial}
+	d.Dispatch([]opm.MapObject{stop})
+	eventually(t, "the lure", func() bool { return len(rec.received("/lures")) == 1 })
+
+	deleted := stop
+	deleted.Deleted = true
+	d.Dispatch([]opm.MapObject{
+		{Type: opm.POKEMON, ID: "p1", Lat: 3, Lng: 4, Deleted: true},
+		deleted,
+		{Type: opm.GYM, ID: "gym1", Deleted: true},
+	})
+	eventually(t, "the deletions", func() bool {
+		return len(rec.received("/pokemon")) == 1 && len(rec.received("/lures")) == 3
+	})
+	for _, m := range append(rec.rawMessages("/pokemon"), rec.rawMessages("/lures")[1:]...) {
+		msg := m["message"].(map[string]interface{})
+		if m["type"] != "deleted" || (msg["id"] != "p1" && msg["id"] != "stop1") {
+			t.Errorf("message = %v, want a deletion", m)
+		}
+		if msg["id"] == "stop1" && (msg["object_type"] != "pokestop" || msg["latitude"] != float64(1)) {
+			t.Errorf("stop deletion = %v", msg)
+		}
+	}
+	// The lure of the deleted stop is alerted again when the stop comes back
+	d.Dispatch([]opm.MapObject{stop})
+	eventually(t, "the lure again", func() bool { return len(rec.received("/lures")) == 4 })
+	time.Sleep(20 * time.Millisecond)
+	if got := rec.received("/pokemon"); len(got) != 1 {
+		t.Errorf("/pokemon received %v, want only the Pokemon deletion", got)
+	}
+}
+
+func TestWebhookPokemonPayload(t *testing.T) {
+	var contentType string
+	var mutex sync.Mutex
+	rec := newWebhookRecorder(t)
+	inner := rec.Config.Handler
+	rec.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		contentType = r.Header.Get("Content-Type")
+		mutex.Unlock()
+		inner.ServeHTTP(w, r)
+	})
+	d := newTestDispatcher(settings{WebhookURLs: []string{rec.URL + "/hook"}})
+	expiry := time.Now().Add(10 * time.Minute).Unix()
+	d.Dispatch([]opm.MapObject{{Type: opm.POKEMON, ID: "p1", PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: expiry, SpawnpointID: "sp1"}})
+	eventually(t, "the Pokemon", func() bool { return len(rec.received("/hook")) == 1 })
+
+	m := rec.rawMessages("/hook")[0]
+	if len(m) != 2 || m["type"] != "pokemon" {
+		t.Fatalf("message = %v, want type and message only", m)
+	}
+	want := map[string]interface{}{
+		"encounter_id":   "p1",
+		"spawnpoint_id":  "sp1",
+		"pokemon_id":     float64(16),
+		"latitude":       52.5,
+		"longitude":      13.4,
+		"disappear_time": float64(expiry),
+	}
+	msg := m["message"].(map[string]interface{})
+	if len(msg) != len(want) {
+		t.Errorf("message fields = %v, want %v", msg, want)
+	}
+	for k, v := range want {
+		if msg[k] != v {
+			t.Errorf("%s = %v, want %v", k, msg[k], v)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int // status of each try, the last one repeats
+		tries    int
+		sent     bool
+	}{
+		{"recovers", []int{503, 500, 200}, 3, true},
+		{"gives up", []int{502}, 1 + webhookRetries, false},
+		{"client error", []int{400}, 1, false},
+	}
+	for _, c := range cases {
+		var tries int64
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(atomic.AddInt64(&tries, 1))
+			if n > len(c.statuses) {
+				n = len(c.statuses)
+			}
+			w.WriteHeader(c.statuses[n-1])
+		}))
+		d := newTestDispatcher(settings{WebhookURLs: []string{s.URL}})
+		d.Dispatch([]opm.MapObject{{Type: opm.POKEMON, ID: "p1", Expiry: time.Now().Add(10 * time.Minute).Unix()}})
+		var stats map[string]struct{ Sent, Failed int64 }
+		eventually(t, c.name, func() bool {
+			json.Unmarshal([]byte(d.String()), &stats)
+			h := stats[s.Listener.Addr().String()]
+			return h.Sent+h.Failed == 1
+		})
+		h := stats[s.Listener.Addr().String()]
+		if n := atomic.LoadInt64(&tries); int(n) != c.tries || (h.Sent == 1) != c.sent {
+			t.Errorf("%s: %d tries and stats %+v, want %d tries and sent %v", c.name, n, h, c.tries, c.sent)
+		}
+		s.Close()
+	}
+}
+
+func TestWebhookDropsWhenQueueIsFull(t *testing.T) {
+	rec := newWebhookRecorder(t)
+	// Without workers the queues fill up
+	d := newWebhookDispatcher(settings{WebhookURLs: []string{rec.URL + "/hook"}, WebhookQueue: 2})
+	d.backoff = time.Millisecond
+	expiry := time.Now().Add(10 * time.Minute).Unix()
+	var pokemon []opm.MapObject
+	for i := 0; i < 5; i++ {
+		pokemon = append(pokemon, opm.MapObject{Type: opm.POKEMON, ID: fmt.Sprintf("p%d", i), Expiry: expiry})
+	}
+	done := make(chan struct{})
+	go func() {
+		d.Dispatch(pokemon)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatch blocked on a full queue")
+	}
+	var stats map[string]struct{ Queued, Dropped int64 }
+	json.Unmarshal([]byte(d.String()), &stats)
+	if h := stats[rec.Listener.Addr().String()]; h.Queued != 2 || h.Dropped != 3 {
+		t.Errorf("stats = %+v, want 2 queued and 3 dropped", h)
+	}
+	d.run()
+	eventually(t, "the queued Pokemon", func() bool { return len(rec.received("/hook")) == 2 })
+}
+
+func TestWebhookStaticMap(t *testing.T) {
+	rec := newWebhookRecorder(t)
+	d := newTestDispatcher(settings{
+		WebhookTargets: []webhookTarget{{URL: rec.URL + "/hook", LureTypes: []string{opm.LureGlacial}}},
+		StaticMapURL:   "https://maps.example.com/{lat},{lng}/{zoom}.png",
+	})
+	d.Dispatch([]opm.MapObject{
+		{Type: opm.POKEMON, ID: "p1", PokemonID: 16, Lat: 52.5, Lng: 13.4, Expiry: time.Now().Add(10 * time.Minute).Unix()},
+		{Type: opm.POKESTOP, ID: "stop1", Lat: -33.8, Lng: 151.2, Lured: true, LureType: opm.LureGlacial},
+	})
+	eventually(t, "both messages", func() bool { return len(rec.received("/hook")) == 2 })
+	want := map[string]string{
+		"pokemon":  "https://maps.example.com/52.500000,13.400000/17.png",
+		"pokestop": "https://maps.example.com/-33.800000,151.200000/16.png",
+	}
+	for _, m := range rec.rawMessages("/hook") {
+		msg := m["message"].(map[string]interface{})
+		if msg["static_map"] != want[m["type"].(string)] {
+			t.Errorf("%s static_map = %v, want %s", m["type"], msg["static_map"], want[m["type"].(string)])
+		}
+	}
+}
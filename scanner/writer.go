@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// Flush reasons of the persistWriter
+const (
+	flushSize     = "size"
+	flushBytes    = "bytes"
+	flushDeadline = "deadline"
+	flushShutdown = "shutdown"
+)
+
+// batchBuckets are the upper bounds of the batch size histogram
+var batchBuckets = []int{1, 10, 50, 100, 500, 1000}
+
+// persistWriter saves the results of scans in the background. Objects are collected until
+// the batch has maxObjects objects, reaches maxBytes (estimated) or the oldest one waited
+// for the flush deadline, whichever comes first.
+type persistWriter struct {
+	queue      chan []opm.MapObject
+	maxObjects int
+	maxBytes   int
+	deadline   time.Duration
+	closing    sync.RWMutex // Add holds it for reading, so no result is queued after Close
+	closed     bool
+	stop       chan struct{}
+	done       chan struct{}
+	pending    int64 // objects not saved yet, queued or in the batch
+	overflowed int64 // results saved with the scan because the queue was full
+	mu         sync.Mutex
+	flushes    map[string]int64
+	buckets    []int64 // one per batchBuckets entry, plus +Inf
+	latency    time.Duration
+	saved      int64
+}
+
+func newPersistWriter(s settings) *persistWriter {
+	return &persistWriter{
+		queue:      make(chan []opm.MapObject, s.WriteQueue),
+		maxObjects: s.WriteBatchSize,
+		maxBytes:   s.WriteBatchBytes,
+		deadline:   time.Duration(s.WriteFlushMs) * time.Millisecond,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		flushes:    make(map[string]int64),
+		buckets:    make([]int64, len(batchBuckets)+1),
+	}
+}
+
+// Add queues the objects of a scan. It never blocks and returns false if the queue is
+// full, the caller has to save the objects itself then.
+func (pw *persistWriter) Add(objects []opm.MapObject) bool {
+	if len(objects) == 0 {
+		return true
+	}
+	pw.closing.RLock()
+	defer pw.closing.RUnlock()
+	if pw.closed {
+		return false
+	}
+	atomic.AddInt64(&pw.pending, int64(len(objects)))
+	select {
+	case pw.queue <- objects:
+		return true
+	default:
+	}
+	atomic.AddInt64(&pw.pending, -int64(len(objects)))
+	if atomic.AddInt64(&pw.overflowed, 1)%100 == 1 {
+		log.Println("Writer can't keep up, saving with the scan")
+	}
+	return false
+}
+
+// queuedObject is an object in the batch with the time it was queued
+type queuedObject struct {
+	opm.MapObject
+	queued time.Time
+}
+
+func (pw *persistWriter) run() {
+	defer close(pw.done)
+	var batch []queuedObject
+	size := 0
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	flush := func(reason string) {
+		timer.Stop()
+		if len(batch) > 0 {
+			pw.flush(batch, reason)
+		}
+		batch, size = nil, 0
+	}
+	for {
+		select {
+		case objects := <-pw.queue:
+			if len(batch) == 0 {
+				timer.Reset(pw.deadline)
+			}
+			now := time.Now()
+			for _, o := range objects {
+				batch = append(batch, queuedObject{o, now})
+				size += approxObjectSize(o)
+			}
+			if len(batch) >= pw.maxObjects {
+				flush(flushSize)
+			} else if pw.maxBytes > 0 && size >= pw.maxBytes {
+				flush(flushBytes)
+			}
+		case <-timer.C:
+			flush(flushDeadline)
+		case <-pw.stop:
+			// Results queued before Close are saved too
+			for len(pw.queue) > 0 {
+				now := time.Now()
+				for _, o := range <-pw.queue {
+					batch = append(batch, queuedObject{o, now})
+				}
+			}
+			flush(flushShutdown)
+			return
+		}
+	}
+}
+
+// flush saves the batch and records the flush
+func (pw *persistWriter) flush(batch []queuedObject, reason string) {
+	objects := make([]opm.MapObject, len(batch))
+	for i, q := range batch {
+		objects[i] = q.MapObject
+	}
+	saveMapObjects(context.Background(), objects)
+	atomic.AddInt64(&pw.pending, -int64(len(batch)))
+	now := time.Now()
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.flushes[reason]++
+	pw.buckets[sort.SearchInts(batchBuckets, len(batch))]++
+	for _, q := range batch {
+		pw.latency += now.Sub(q.queued)
+	}
+	pw.saved += int64(len(batch))
+}
+
+// Close stops accepting results, saves the queued ones and waits until they are written
+func (pw *persistWriter) Close() {
+	pw.closing.Lock()
+	if !pw.closed {
+		pw.closed = true
+		close(pw.stop)
+	}
+	pw.closing.Unlock()
+	<-pw.done
+}
+
+// Pending returns the number of objects that are not saved yet
+func (pw *persistWriter) Pending() int64 {
+	return atomic.LoadInt64(&pw.pending)
+}
+
+// Backlogged reports whether the queue is more than half full, the writer falls behind then
+func (pw *persistWriter) Backlogged() bool {
+	return len(pw.queue) > cap(pw.queue)/2
+}
+
+// approxObjectSize estimates the size of the stored document of an object in bytes
+func approxObjectSize(o opm.MapObject) int {
+	return 160 + len(o.ID) + len(o.SpawnpointID) + len(o.LureType) + len(o.LuredBy) + len(o.Source)
+}
+
+// String returns the writer metrics for expvar. The latency is the average time from
+// queueing to saving.
+func (pw *persistWriter) String() string {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	stats := struct {
+		Pending    int64            `json:"pending"`
+		Queued     int              `json:"queued"`
+		Overflowed int64            `json:"overflowed"`
+		Flushes    map[string]int64 `json:"flushes"`
+		BatchSizes map[string]int64 `json:"batch_sizes"`
+		LatencyMs  float64          `json:"latency_avg_ms"`
+	}{
+		Pending:    atomic.LoadInt64(&pw.pending),
+		Queued:     len(pw.queue),
+		Overflowed: atomic.LoadInt64(&pw.overflowed),
+		Flushes:    pw.flushes,
+		BatchSizes: make(map[string]int64),
+	}
+	// Cumulative buckets
+	sum := int64(0)
+	for i, b := range batchBuckets {
+		sum += pw.buckets[i]
+		stats.BatchSizes["le_"+strconv.Itoa(b)] = sum
+	}
+	stats.BatchSizes["le_inf"] = sum + pw.buckets[len(batchBuckets)]
+	if pw.saved > 0 {
+		stats.LatencyMs = float64(pw.latency) / float64(pw.saved) / float64(time.Millisecond)
+	}
+	data, _ := json.Marshal(stats)
+	return string(data)
+}
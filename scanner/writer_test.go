@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// timedStore takes delay for every write, like a round trip to the database, and records
+// when each object was stored
+type timedStore struct {
+	fakeStore
+	delay  time.Duration
+	stored map[string]time.Time
+}
+
+func (s *timedStore) AddMapObject(m opm.MapObject) error {
+	time.Sleep(s.delay)
+	s.Lock()
+	defer s.Unlock()
+	s.objects = append(s.objects, m)
+	s.stored[m.ID] = time.Now()
+	return nil
+}
+
+// withWriter saves scan results to a timedStore, through a persistWriter with the settings
+// unless WriteBatchSize is 0
+func withWriter(tb testing.TB, delay time.Duration, s settings) (*timedStore, *persistWriter) {
+	oldStore, oldEvents, oldWriter := store, events, writer
+	ts := &timedStore{delay: delay, stored: make(map[string]time.Time)}
+	store, events, writer = ts, newEventBus(), nil
+	if s.WriteBatchSize > 0 {
+		writer = newPersistWriter(s)
+		go writer.run()
+	}
+	pw := writer
+	tb.Cleanup(func() {
+		if pw != nil {
+			pw.Close()
+		}
+		store, events, writer = oldStore, oldEvents, oldWriter
+	})
+	return ts, pw
+}
+
+// scanObjects returns the result of a scan with n objects
+func scanObjects(scan, n int) []opm.MapObject {
+	objects := make([]opm.MapObject, n)
+	for i := range objects {
+		objects[i] = opm.MapObject{Type: opm.POKEMON, ID: fmt.Sprintf("%d/%d", scan, i), PokemonID: 16, Lat: 52.5, Lng: 13.4}
+	}
+	return objects
+}
+
+func TestPersistWriterFlushes(t *testing.T) {
+	s, pw := withWriter(t, 0, settings{WriteBatchSize: 10, WriteBatchBytes: 1000, WriteFlushMs: 50, WriteQueue: 10})
+	// A full batch is saved at once
+	if !pw.Add(scanObjects(1, 10)) {
+		t.Fatal("Add failed with an empty queue")
+	}
+	eventually(t, "the full batch saved", func() bool { return pw.Pending() == 0 })
+	// Three small objects reach neither limit and wait for the deadline
+	pw.Add(scanObjects(2, 3))
+	time.Sleep(20 * time.Millisecond)
+	if n := pw.Pending(); n != 3 {
+		t.Errorf("%d objects pending before the deadline, want 3", n)
+	}
+	eventually(t, "the deadline flush", func() bool { return pw.Pending() == 0 })
+	// Seven objects are estimated at more than 1000 bytes
+	pw.Add(scanObjects(3, 4))
+	pw.Add(scanObjects(4, 3))
+	eventually(t, "the bytes flush", func() bool { return pw.Pending() == 0 })
+	pw.mu.Lock()
+	flushes := fmt.Sprint(pw.flushes)
+	pw.mu.Unlock()
+	if want := "map[bytes:1 deadline:1 size:1]"; flushes != want {
+		t.Errorf("flushes = %s, want %s", flushes, want)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.objects) != 20 {
+		t.Errorf("%d objects stored, want 20", len(s.objects))
+	}
+}
+
+func TestPersistWriterOverflowAndClose(t *testing.T) {
+	s, pw := withWriter(t, 50*time.Millisecond, settings{WriteBatchSize: 100, WriteFlushMs: 10, WriteQueue: 1})
+	// The first result is being written, the second waits in the queue and the third is
+	// saved with the scan
+	persist(context.Background(), scanObjects(1, 1))
+	eventually(t, "the first write", func() bool { return len(pw.queue) == 0 })
+	time.Sleep(20 * time.Millisecond)
+	persist(context.Background(), scanObjects(2, 1))
+	start := time.Now()
+	persist(context.Background(), scanObjects(3, 1))
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("overflowed result returned after %s, want it saved with the scan", d)
+	}
+	if n := atomic.LoadInt64(&pw.overflowed); n != 1 {
+		t.Errorf("%d results overflowed, want 1", n)
+	}
+	// Close saves the queued result and nothing is accepted afterwards
+	pw.Close()
+	if pw.Pending() != 0 || pw.Add(scanObjects(4, 1)) {
+		t.Errorf("writer accepts results or has %d pending after Close", pw.Pending())
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.objects) != 3 {
+		t.Errorf("%d objects stored, want the 3 before Close", len(s.objects))
+	}
+}
+
+// BenchmarkPersistLatency compares saving with the scan to the batching writer for a steady
+// stream of small scans and for bursts of concurrent large ones. A write takes a millisecond. blocked-µs/scan is the time
+// a request waits for persist, saved-µs/object the time from persist to the object being
+// stored.
+func BenchmarkPersistLatency(b *testing.B) {
+	for _, pattern := range []struct {
+		name             string
+		clients, objects int
+		interval         time.Duration // between the scans of a client
+	}{
+		{"steady", 1, 3, 10 * time.Millisecond},
+		{"burst", 16, 30, 0},
+	} {
+		for _, mode := range []struct {
+			name string
+			s    settings
+		}{
+			{"sync", settings{}},
+			{"batched", settings{WriteBatchSize: 100, WriteBatchBytes: 1 << 20, WriteFlushMs: 5, WriteQueue: 100}},
+		} {
+			b.Run(pattern.name+"/"+mode.name, func(b *testing.B) {
+				s, pw := withWriter(b, time.Millisecond, mode.s)
+				// Overflows are logged
+				defer log.SetOutput(log.Writer())
+				log.SetOutput(io.Discard)
+				scans := make([][]opm.MapObject, b.N)
+				for i := range scans {
+					scans[i] = scanObjects(i, pattern.objects)
+				}
+				started := make([]time.Time, b.N)
+				var blocked int64
+				next := make(chan int)
+				var wg sync.WaitGroup
+				for c := 0; c < pattern.clients; c++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := range next {
+							started[i] = time.Now()
+							persist(context.Background(), scans[i])
+							atomic.AddInt64(&blocked, int64(time.Since(started[i])))
+							time.Sleep(pattern.interval)
+						}
+					}()
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					next <- i
+				}
+				close(next)
+				wg.Wait()
+				if pw != nil {
+					pw.Close()
+				}
+				b.StopTimer()
+
+				s.Lock()
+				defer s.Unlock()
+				if len(s.stored) != b.N*pattern.objects {
+					b.Fatalf("%d objects stored, want %d", len(s.stored), b.N*pattern.objects)
+				}
+				var saved time.Duration
+				for i, objects := range scans {
+					for _, o := range objects {
+						saved += s.stored[o.ID].Sub(started[i])
+					}
+				}
+				b.ReportMetric(float64(blocked)/float64(b.N)/1e3, "blocked-µs/scan")
+				b.ReportMetric(float64(saved)/float64(len(s.stored))/1e3, "saved-µs/object")
+			})
+		}
+	}
+}
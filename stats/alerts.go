@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Alert severities, same as the levels of the apiserver diagnostics
+const (
+	severityWarn = "warn"
+	severityCrit = "crit"
+)
+
+// alertSample holds the values the conditions are evaluated on
+type alertSample struct {
+	FreeAccounts   int
+	BannedAccounts int
+	DbErr          error
+	ScannerErr     error
+	FailureRate    float64
+	QueueAvailable int64
+}
+
+// condition is a named alert condition. It fires when test has been true for at least
+// the pending duration and clears as soon as test is false again.
+type condition struct {
+	Name     string
+	Severity string
+	Pending  time.Duration
+	test     func(s alertSample, now time.Time) (bool, string)
+
+	active      bool
+	activeSince time.Time
+	firing      bool
+	firingSince time.Time
+	message     string
+}
+
+// alertState is the exported state of a condition
+type alertState struct {
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	Firing   bool   `json:"firing"`
+	Since    int64  `json:"since,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// alertManager evaluates the conditions and keeps their state
+type alertManager struct {
+	sync.Mutex
+	conditions []*condition
+	alertURL   string
+	nowFunc    func() time.Time
+}
+
+func newAlertManager(s settings) *alertManager {
+	return &alertManager{
+		conditions: defaultConditions(s),
+		alertURL:   s.AlertURL,
+		nowFunc:    time.Now,
+	}
+}
+
+// defaultConditions are the key operational conditions of an OPM installation
+func defaultConditions(s settings) []*condition {
+	return []*condition{
+		{
+			Name:     "no_accounts",
+			Severity: severityCrit,
+			Pending:  time.Duration(s.NoAccountsFor) * time.Second,
+			test: func(a alertSample, now time.Time) (bool, string) {
+				return a.DbErr == nil && a.FreeAccounts <= 0, "No account available"
+			},
+		},
+		{
+			Name:     "ban_spike",
+			Severity: severityWarn,
+			test:     banSpike(s.MaxBansPerHour),
+		},
+		{
+			Name:     "upstream_failures",
+			Severity: severityWarn,
+			test: func(a alertSample, now time.Time) (bool, string) {
+				return a.ScannerErr == nil && s.MaxFailureRate > 0 && a.FailureRate > s.MaxFailureRate,
+					fmt.Sprintf("Upstream failure rate %.1f%%", a.FailureRate)
+			},
+		},
+		{
+			Name:     "queue_saturated",
+			Severity: severityWarn,
+			Pending:  time.Duration(s.QueueSaturatedFor) * time.Second,
+			test: func(a alertSample, now time.Time) (bool, string) {
+				return a.ScannerErr == nil && a.QueueAvailable <= 0, "No trainer available"
+			},
+		},
+		{
+			Name:     "db_unreachable",
+			Severity: severityCrit,
+			test: func(a alertSample, now time.Time) (bool, string) {
+				if a.DbErr == nil {
+					return false, ""
+				}
+				return true, a.DbErr.Error()
+			},
+		},
+	}
+}
+
+type banCount struct {
+	t      time.Time
+	banned int
+}
+
+// banSpike fires when the number of banned accounts grew by more than max within the last hour
+func banSpike(max int) func(alertSample, time.Time) (bool, string) {
+	var history []banCount
+	return func(a alertSample, now time.Time) (bool, string) {
+		if a.DbErr != nil || max <= 0 {
+			return false, ""
+		}
+		history = append(history, banCount{now, a.BannedAccounts})
+		i := 0
+		for i < len(history)-1 && now.Sub(history[i].t) > time.Hour {
+			i++
+		}
+		history = history[i:]
+		// Accounts that get unbanned make the difference negative, which is fine
+		bans := a.BannedAccounts - history[0].banned
+		return bans > max, fmt.Sprintf("%d accounts banned within the last hour", bans)
+	}
+}
+
+// Evaluate updates the state of all conditions with the sample and logs transitions
+func (m *alertManager) Evaluate(s alertSample) {
+	m.Lock()
+	defer m.Unlock()
+	now := m.nowFunc()
+	for _, c := range m.conditions {
+		active, message := c.test(s, now)
+		if !active {
+			c.active = false
+			if c.firing {
+				c.firing = false
+				m.notify(fmt.Sprintf("Alert %s cleared after %s", c.Name, now.Sub(c.firingSince).Round(time.Second)))
+			}
+			continue
+		}
+		if !c.active {
+			c.active = true
+			c.activeSince = now
+		}
+		c.message = message
+		if !c.firing && now.Sub(c.activeSince) >= c.Pending {
+			c.firing = true
+			c.firingSince = now
+			m.notify(fmt.Sprintf("Alert %s firing: %s", c.Name, message))
+		}
+	}
+}
+
+// States returns the current state of all conditions
+func (m *alertManager) States() []alertState {
+	m.Lock()
+	defer m.Unlock()
+	states := make([]alertState, 0, len(m.conditions))
+	for _, c := range m.conditions {
+		state := alertState{Name: c.Name, Severity: c.Severity, Firing: c.firing}
+		if c.firing {
+			state.Since = c.firingSince.Unix()
+			state.Message = c.message
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// String returns one gauge per condition (1 = firing) for expvar
+func (m *alertManager) String() string {
+	gauges := make(map[string]int)
+	for _, s := range m.States() {
+		gauges[s.Name] = 0
+		if s.Firing {
+			gauges[s.Name] = 1
+		}
+	}
+	b, _ := json.Marshal(gauges)
+	return string(b)
+}
+
+// notify logs a transition and routes it to the operator alert URL. Must be called with the lock held.
+func (m *alertManager) notify(message string) {
+	log.Printf("ALERT: %s", message)
+	if m.alertURL == "" {
+		return
+	}
+	go func(url string) {
+		body, _ := json.Marshal(map[string]string{"content": message})
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		resp.Body.Close()
+	}(m.alertURL)
+}
+
+// scannerSummary is the part of the scanner status summary used for the conditions
+type scannerSummary struct {
+	Budget struct {
+		FailureRate float64 `json:"failure_rate"`
+	} `json:"budget"`
+	Queue struct {
+		Available int64 `json:"available"`
+	} `json:"queue"`
+}
+
+// collectSample gathers the current values from the stats counters, the database and the scanner
+func collectSample(statusURL string) alertSample {
+	s := alertSample{
+		FreeAccounts:   stats.AccountsTotal - stats.AccountsInUse - stats.AccountsBanned - stats.AccountsChallenged,
+		BannedAccounts: stats.AccountsBanned,
+	}
+	_, s.DbErr = database.Ping()
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(statusURL)
+	if err != nil {
+		s.ScannerErr = err
+		return s
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.ScannerErr = fmt.Errorf("scanner status: %s", resp.Status)
+		return s
+	}
+	var summary scannerSummary
+	s.ScannerErr = json.NewDecoder(resp.Body).Decode(&summary)
+	s.FailureRate = summary.Budget.FailureRate
+	s.QueueAvailable = summary.Queue.Available
+	return s
+}
+
+func runAlerts(interval time.Duration, statusURL string) {
+	for {
+		time.Sleep(interval)
+		alerts.Evaluate(collectSample(statusURL))
+	}
+}
+
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	responder.Write(w, r, http.StatusOK, alerts.States())
+}
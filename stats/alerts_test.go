@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestAlerts returns an alert manager with the default thresholds and a settable clock
+func newTestAlerts(s settings) (*alertManager, *time.Time) {
+	now := time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)
+	m := newAlertManager(s)
+	m.nowFunc = func() time.Time { return now }
+	return m, &now
+}
+
+// healthy is a sample on which no condition fires
+var healthy = alertSample{FreeAccounts: 10, QueueAvailable: 5}
+
+// firing returns the names of the firing conditions
+func firing(m *alertManager) map[string]bool {
+	names := make(map[string]bool)
+	for _, s := range m.States() {
+		if s.Firing {
+			names[s.Name] = true
+		}
+	}
+	return names
+}
+
+func TestAlertsPendingConditions(t *testing.T) {
+	m, now := newTestAlerts(defaultStatsSettings)
+	m.Evaluate(healthy)
+	if got := firing(m); len(got) != 0 {
+		t.Fatalf("firing %v on a healthy sample", got)
+	}
+	out := alertSample{FreeAccounts: 0, QueueAvailable: 0}
+	m.Evaluate(out)
+	*now = now.Add(119 * time.Second)
+	m.Evaluate(out)
+	if got := firing(m); len(got) != 0 {
+		t.Fatalf("firing %v before the pending time", got)
+	}
+	*now = now.Add(time.Second)
+	m.Evaluate(out)
+	if got := firing(m); len(got) != 1 || !got["queue_saturated"] {
+		t.Fatalf("firing %v after 2 minutes, want queue_saturated", got)
+	}
+	*now = now.Add(3 * time.Minute)
+	m.Evaluate(out)
+	if got := firing(m); len(got) != 2 || !got["no_accounts"] {
+		t.Fatalf("firing %v after 5 minutes, want no_accounts too", got)
+	}
+	var gauges map[string]int
+	if err := json.Unmarshal([]byte(m.String()), &gauges); err != nil {
+		t.Fatal(err)
+	}
+	if len(gauges) != 5 || gauges["no_accounts"] != 1 || gauges["queue_saturated"] != 1 || gauges["ban_spike"] != 0 {
+		t.Errorf("gauges = %v", gauges)
+	}
+
+	// A single healthy sample clears both, and the pending time starts over
+	m.Evaluate(alertSample{FreeAccounts: 1, QueueAvailable: 1})
+	if got := firing(m); len(got) != 0 {
+		t.Fatalf("firing %v after recovery", got)
+	}
+	m.Evaluate(out)
+	if got := firing(m); len(got) != 0 {
+		t.Errorf("firing %v right after recovery, want the pending time again", got)
+	}
+}
+
+func TestAlertsBanSpike(t *testing.T) {
+	m, now := newTestAlerts(defaultStatsSettings)
+	sample := healthy
+	for _, banned := range []int{0, 5, 10} {
+		sample.BannedAccounts = banned
+		m.Evaluate(sample)
+		*now = now.Add(10 * time.Minute)
+	}
+	if firing(m)["ban_spike"] {
+		t.Fatal("ban_spike firing at 10 bans, want more than MaxBansPerHour")
+	}
+	sample.BannedAccounts = 11
+	m.Evaluate(sample)
+	states := m.States()
+	for _, s := range states {
+		if s.Name == "ban_spike" && (!s.Firing || s.Message != "11 accounts banned within the last hour" || s.Since != now.Unix()) {
+			t.Errorf("ban_spike = %+v", s)
+		}
+	}
+	// No new bans, the old ones leave the hour
+	*now = now.Add(61 * time.Minute)
+	m.Evaluate(sample)
+	if firing(m)["ban_spike"] {
+		t.Error("ban_spike still firing an hour after the bans")
+	}
+}
+
+func TestAlertsUpstreamFailures(t *testing.T) {
+	m, _ := newTestAlerts(defaultStatsSettings)
+	sample := healthy
+	sample.FailureRate = 50
+	m.Evaluate(sample)
+	if firing(m)["upstream_failures"] {
+		t.Fatal("upstream_failures firing at the threshold")
+	}
+	sample.FailureRate = 75
+	m.Evaluate(sample)
+	if !firing(m)["upstream_failures"] {
+		t.Fatal("upstream_failures not firing above the threshold")
+	}
+	// Without a scanner status the scanner conditions can't be evaluated
+	m.Evaluate(alertSample{FreeAccounts: 10, ScannerErr: errors.New("connection refused")})
+	if got := firing(m); len(got) != 0 {
+		t.Errorf("firing %v without a scanner status", got)
+	}
+}
+
+func TestAlertsDbUnreachable(t *testing.T) {
+	m, now := newTestAlerts(defaultStatsSettings)
+	m.Evaluate(healthy)
+	// The account counts are stale without the database
+	down := alertSample{DbErr: errors.New("no reachable servers"), QueueAvailable: 5}
+	for i := 0; i < 10; i++ {
+		m.Evaluate(down)
+		*now = now.Add(time.Minute)
+	}
+	if got := firing(m); len(got) != 1 || !got["db_unreachable"] {
+		t.Fatalf("firing %v, want only db_unreachable", got)
+	}
+	m.Evaluate(healthy)
+	if got := firing(m); len(got) != 0 {
+		t.Errorf("firing %v after the database is back", got)
+	}
+}
+
+func TestAlertsNotifyTransitions(t *testing.T) {
+	var mutex sync.Mutex
+	var messages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		mutex.Lock()
+		messages = append(messages, body["content"])
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	s := defaultStatsSettings
+	s.AlertURL = server.URL
+	m, now := newTestAlerts(s)
+	down := healthy
+	down.DbErr = errors.New("no reachable servers")
+	m.Evaluate(down)
+	// Staying in the same state is no transition
+	m.Evaluate(down)
+	*now = now.Add(90 * time.Second)
+	m.Evaluate(healthy)
+	m.Evaluate(healthy)
+
+	received := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), messages...)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(received()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	got := strings.Join(received(), "\n")
+	// The posts are sent concurrently
+	if len(received()) != 2 || !strings.Contains(got, "Alert db_unreachable firing: no reachable servers") || !strings.Contains(got, "Alert db_unreachable cleared after 1m30s") {
+		t.Errorf("notifications = %q, want the firing and the clearing", got)
+	}
+}
@@ -3,27 +3,34 @@ package main
 import (
 	"encoding/json"
 	"expvar"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/pogointel/opm/db"
 	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
 )
 
 var opmSettings opm.Settings
+var statsSettings settings
 var stats *Stats
+var alerts *alertManager
 var database *db.OpenMapDb
+var responder = util.NewResponder()
 
 type Stats struct {
 	// Accounts
-	AccountsInUse      int `json:"accounts_in_use"`
-	AccountsBanned     int `json:"accounts_banned"`
-	AccountsChallenged int `json:"accounts_challenged"`
-	AccountsTotal      int `json:"accounts_total"`
+	AccountsInUse      int            `json:"accounts_in_use"`
+	AccountsBanned     int            `json:"accounts_banned"`
+	AccountsBannedBy   map[string]int `json:"accounts_banned_by"` // ban reason, "" = unknown
+	AccountsChallenged int            `json:"accounts_challenged"`
+	AccountsTotal      int            `json:"accounts_total"`
 	// Proxies
 	ProxiesAlive int `json:"proxies_alive"`
 	ProxiesInUse int `json:"proxies_in_use"`
+	ProxiesDead  int `json:"proxies_dead"`
 	// MapObjects
 	PokemonTotal int `json:"pokemon_total"`
 	PokemonAlive int `json:"pokemon_alive"`
@@ -39,19 +46,30 @@ func (s *Stats) String() string {
 func main() {
 	// db
 	var err error
-	opmSettings, err := opm.LoadSettings("")
+	opmSettings, err = opm.LoadSettings("")
 	if err != nil {
 		log.Printf("Error loading settings (%s). Using default settings.\n", err)
 	}
+	statsSettings, err = loadSettings()
+	if err != nil {
+		log.Printf("Error loading stats settings (%s). Using default settings.\n", err)
+	}
+	if statsSettings.ScannerStatusURL == "" {
+		statsSettings.ScannerStatusURL = fmt.Sprintf("http://%s:%d/status?summary=1&secret=%s", opmSettings.ScannerListenAddress, opmSettings.ScannerListenPort, opmSettings.Secret)
+	}
 	// stuff
 	stats = &Stats{}
 	expvar.Publish("opm_stats", stats)
-	database, err = db.NewOpenMapDb(opmSettings.DbName, opmSettings.DbHost, opmSettings.DbUser, opmSettings.DbPassword)
+	alerts = newAlertManager(statsSettings)
+	expvar.Publish("opm_alerts", alerts)
+	http.HandleFunc("/alerts", alertsHandler)
+	database, err = db.NewOpenMapDb(opmSettings.DbName, opmSettings.DbHost, opmSettings.DbUser, opmSettings.DbPassword, db.Options{ReadHost: opmSettings.DbReadHost, ReadTags: opmSettings.DbReadTags})
 	if err != nil {
 		log.Fatal(err)
 	}
 	go runStats()
 	go runObjects()
+	go runAlerts(time.Duration(statsSettings.AlertEvalInterval)*time.Second, statsSettings.ScannerStatusURL)
 	http.ListenAndServe(":8324", nil)
 }
 
@@ -71,21 +89,23 @@ func runObjects() {
 func runStats() {
 	for {
 		// Accounts
-		accountsTotal, accountsUse, accountsBanned, accountsChallenged, err := database.AccountStats()
+		accounts, err := database.AccountStats()
 		if err != nil {
 			log.Println(err)
 		}
-		stats.AccountsTotal = accountsTotal
-		stats.AccountsBanned = accountsBanned
-		stats.AccountsInUse = accountsUse
-		stats.AccountsChallenged = accountsChallenged
+		stats.AccountsTotal = accounts.Total
+		stats.AccountsBanned = accounts.Banned
+		stats.AccountsBannedBy = accounts.BannedBy
+		stats.AccountsInUse = accounts.Used
+		stats.AccountsChallenged = accounts.Flagged
 		// Proxies
-		proxiesAlive, proxiesUse, err := database.ProxyStats()
+		proxiesAlive, proxiesUse, proxiesDead, err := database.ProxyStats()
 		if err != nil {
 			log.Println(err)
 		}
 		stats.ProxiesInUse = proxiesUse
 		stats.ProxiesAlive = proxiesAlive
+		stats.ProxiesDead = proxiesDead
 		// Sleep
 		time.Sleep(15 * time.Second)
 	}
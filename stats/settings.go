@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+type settings struct {
+	// Alert conditions
+	NoAccountsFor     int     // Fire no_accounts when no account was free for this many seconds
+	MaxBansPerHour    int     // Fire ban_spike when more accounts got banned within an hour
+	MaxFailureRate    float64 // Fire upstream_failures when the scanner failure rate exceeds this percentage
+	QueueSaturatedFor int     // Fire queue_saturated when no trainer was available for this many seconds
+	AlertEvalInterval int     // Time between evaluations in seconds
+	AlertURL          string  // URL that receives transitions as operator alerts (optional)
+	ScannerStatusURL  string  // Scanner status summary, defaults to the scanner from the OPM settings
+}
+
+var defaultStatsSettings = settings{
+	NoAccountsFor:     300,
+	MaxBansPerHour:    10,
+	MaxFailureRate:    50,
+	QueueSaturatedFor: 120,
+	AlertEvalInterval: 30,
+}
+
+func loadSettings() (settings, error) {
+	s := defaultStatsSettings
+	// Try to find system settings file
+	bytes, err := ioutil.ReadFile("/etc/opm/stats.json")
+	if err != nil {
+		// Return default settings
+		return s, err
+	}
+	// Unmarshal json
+	err = json.Unmarshal(bytes, &s)
+	return s, err
+}
@@ -1,15 +1,66 @@
 package util
 
 import (
+	"math"
 	"math/rand"
+	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/kellydunn/golang-geo"
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
 )
 
-// LatLngOffset returns a new pair of coordinates at a given distance in a random direction
+// LatLngOffset returns a new pair of coordinates at a given distance (km) in a random direction
 func LatLngOffset(lat, lng, distance float64) (float64, float64) {
 	rand.Seed(time.Now().Unix())
-	newPoint := geo.NewPoint(lat, lng).PointAtDistanceAndBearing(distance, float64(rand.Intn(360)))
-	return newPoint.Lat(), newPoint.Lng()
+	p := geo.Destination(geo.LatLng{Lat: lat, Lng: lng}, distance*1000, float64(rand.Intn(360)))
+	return p.Lat, p.Lng
+}
+
+// ImpliedSpeed returns the speed in km/h needed to get from one point to the other in the given time
+func ImpliedSpeed(from, to geo.LatLng, elapsed time.Duration) float64 {
+	d := geo.Distance(from, to)
+	if d == 0 {
+		return 0
+	}
+	if elapsed <= 0 {
+		return math.Inf(1)
+	}
+	return d / 1000 / elapsed.Hours()
+}
+
+// TravelCooldown returns how much longer than elapsed the trip between the points takes at maxSpeed km/h
+func TravelCooldown(from, to geo.LatLng, elapsed time.Duration, maxSpeed float64) time.Duration {
+	if maxSpeed <= 0 {
+		return 0
+	}
+	need := time.Duration(geo.Distance(from, to) / 1000 / maxSpeed * float64(time.Hour))
+	if need <= elapsed {
+		return 0
+	}
+	return need - elapsed
+}
+
+// ParseLatLng returns the lat and lng parameters of the request. It returns opm.ErrWrongFormat
+// if one of them is missing or malformed and opm.ErrInvalidCoordinates if it is out of range.
+func ParseLatLng(r *http.Request) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(r.FormValue("lat"), 64)
+	if err != nil {
+		return 0, 0, opm.ErrWrongFormat
+	}
+	lng, err := strconv.ParseFloat(r.FormValue("lng"), 64)
+	if err != nil {
+		return 0, 0, opm.ErrWrongFormat
+	}
+	if !ValidLatLng(lat, lng) {
+		return 0, 0, opm.ErrInvalidCoordinates
+	}
+	return lat, lng, nil
+}
+
+// ValidLatLng reports whether lat and lng are in range
+func ValidLatLng(lat, lng float64) bool {
+	// NaN fails both comparisons
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
 }
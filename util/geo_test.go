@@ -0,0 +1,100 @@
+package util
+
+import (
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+)
+
+func TestImpliedSpeed(t *testing.T) {
+	from := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	to := geo.Destination(from, 1000, 90)
+	tests := []struct {
+		to      geo.LatLng
+		elapsed time.Duration
+		want    float64
+	}{
+		{to, time.Minute, 60},
+		{to, time.Hour, 1},
+		{to, 0, math.Inf(1)},
+		{from, 0, 0},
+		{from, time.Minute, 0},
+	}
+	for _, test := range tests {
+		if got := ImpliedSpeed(from, test.to, test.elapsed); math.Abs(got-test.want) > 0.01 && got != test.want {
+			t.Errorf("ImpliedSpeed(%v, %s) = %f, want %f", test.to, test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestTravelCooldown(t *testing.T) {
+	from := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	to := geo.Destination(from, 1000, 0)
+	tests := []struct {
+		elapsed  time.Duration
+		maxSpeed float64
+		want     time.Duration
+	}{
+		// 1 km at 60 km/h takes a minute
+		{0, 60, time.Minute},
+		{20 * time.Second, 60, 40 * time.Second},
+		{time.Minute, 60, 0},
+		{time.Hour, 60, 0},
+		{0, 0, 0},
+	}
+	for _, test := range tests {
+		got := TravelCooldown(from, to, test.elapsed, test.maxSpeed)
+		if d := got - test.want; d < -10*time.Millisecond || d > 10*time.Millisecond {
+			t.Errorf("TravelCooldown(%s, %f) = %s, want %s", test.elapsed, test.maxSpeed, got, test.want)
+		}
+	}
+}
+
+func TestTrainerSpeedTo(t *testing.T) {
+	trainer := NewTrainerSession(opm.Account{Username: "trainer"}, &api.Location{}, nil, nil)
+	now := time.Now()
+	if s := trainer.SpeedTo(52.5, 13.4, now); s != 0 {
+		t.Errorf("speed of a trainer that has not moved = %f, want 0", s)
+	}
+	if d := trainer.CooldownTo(52.5, 13.4, 60, now); d != 0 {
+		t.Errorf("cooldown of a trainer that has not moved = %s, want 0", d)
+	}
+	trainer.MoveTo(&api.Location{Lat: 52.5, Lon: 13.4})
+	to := geo.Destination(geo.LatLng{Lat: 52.5, Lng: 13.4}, 2000, 45)
+	at := time.Now().Add(time.Minute)
+	if s := trainer.SpeedTo(to.Lat, to.Lng, at); math.Abs(s-120) > 1 {
+		t.Errorf("speed for 2 km in a minute = %f, want 120 km/h", s)
+	}
+	if d := trainer.CooldownTo(to.Lat, to.Lng, 60, at); d < time.Minute-time.Second || d > time.Minute {
+		t.Errorf("cooldown for 2 km after a minute at 60 km/h = %s, want a minute", d)
+	}
+}
+
+func TestParseLatLng(t *testing.T) {
+	tests := []struct {
+		lat, lng string
+		err      error
+	}{
+		{"52.5", "13.4", nil},
+		{"-90", "-180", nil},
+		{"90", "180", nil},
+		{"", "13.4", opm.ErrWrongFormat},
+		{"52.5", "", opm.ErrWrongFormat},
+		{"52.5", "x", opm.ErrWrongFormat},
+		{"NaN", "13.4", opm.ErrInvalidCoordinates},
+		{"90.0001", "13.4", opm.ErrInvalidCoordinates},
+		{"52.5", "-180.0001", opm.ErrInvalidCoordinates},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/?"+url.Values{"lat": {test.lat}, "lng": {test.lng}}.Encode(), nil)
+		if _, _, err := ParseLatLng(r); err != test.err {
+			t.Errorf("ParseLatLng(%q, %q) = %v, want %v", test.lat, test.lng, err, test.err)
+		}
+	}
+}
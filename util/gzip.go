@@ -0,0 +1,153 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MinGzipSize is the smallest body that is compressed, smaller ones gain nothing
+const MinGzipSize = 1024
+
+// Gzip compresses the responses of inner for clients that accept gzip. The response is
+// buffered until inner returns. Streaming handlers that flush are compressed as they go,
+// every flush sends what was compressed so far.
+func Gzip(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			inner(w, r)
+			return
+		}
+		bw := &bufferedWriter{ResponseWriter: w}
+		inner(bw, r)
+		bw.finish()
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.TrimSpace(fields[0])
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil || q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// bufferedWriter holds back the status and body of a response until finish, so the
+// encoding can be chosen once the size of the body is known
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+	// Set after the first flush, the rest of the response is passed through gz, or as is if
+	// gz is nil
+	streaming bool
+	gz        *gzip.Writer
+}
+
+func (bw *bufferedWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+	}
+}
+
+func (bw *bufferedWriter) Write(b []byte) (int, error) {
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	if bw.gz != nil {
+		return bw.gz.Write(b)
+	}
+	if bw.streaming {
+		return bw.ResponseWriter.Write(b)
+	}
+	return bw.buf.Write(b)
+}
+
+// Unwrap returns the original writer for http.ResponseController
+func (bw *bufferedWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// Flush switches to a compressed stream and sends what was written so far. Responses that
+// are already encoded are passed through as they are.
+func (bw *bufferedWriter) Flush() {
+	if !bw.streaming {
+		bw.streaming = true
+		if bw.status == 0 {
+			bw.status = http.StatusOK
+		}
+		h := bw.ResponseWriter.Header()
+		if h.Get("Content-Encoding") == "" {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			bw.gz = gzip.NewWriter(bw.ResponseWriter)
+		}
+		bw.ResponseWriter.WriteHeader(bw.status)
+		bw.Write(bw.buf.Bytes())
+		bw.buf.Reset()
+	}
+	if bw.gz != nil {
+		if err := bw.gz.Flush(); err != nil {
+			log.Println(err)
+		}
+	}
+	if f, ok := bw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the response, compressed if the body is large enough and not encoded yet
+func (bw *bufferedWriter) finish() {
+	if bw.gz != nil {
+		if err := bw.gz.Close(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if bw.streaming {
+		return
+	}
+	w, h := bw.ResponseWriter, bw.ResponseWriter.Header()
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	if bw.buf.Len() < MinGzipSize || h.Get("Content-Encoding") != "" {
+		w.WriteHeader(bw.status)
+		w.Write(bw.buf.Bytes())
+		return
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(bw.buf.Bytes())
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(bw.status)
+		w.Write(bw.buf.Bytes())
+		return
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Set("Content-Length", strconv.Itoa(compressed.Len()))
+	w.WriteHeader(bw.status)
+	w.Write(compressed.Bytes())
+}
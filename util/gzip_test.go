@@ -0,0 +1,123 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"br, gzip":           true,
+		"deflate, br":        false,
+		"*":                  true,
+		"gzip;q=0":           false,
+		"gzip; q=0.5":        true,
+		"gzip;q=invalid":     false,
+		"identity, gzip;q=1": true,
+		"gzipped":            false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+// gunzip returns the decompressed body of a gzip response
+func gunzip(t *testing.T, w *httptest.ResponseRecorder) []byte {
+	t.Helper()
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// gzipRequest sends a request with the Accept-Encoding header to the handler
+func gzipRequest(handler func(http.ResponseWriter, *http.Request), acceptEncoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestGzipMatchesIdentity(t *testing.T) {
+	resp := NewResponder(JSONSerializer{})
+	payload := strings.Repeat(`{"type": 1, "id": "pokestop"}`, 100)
+	handler := Gzip(func(w http.ResponseWriter, r *http.Request) {
+		resp.Write(w, r, http.StatusTeapot, payload)
+	})
+	identity := gzipRequest(handler, "")
+	if identity.Header().Get("Content-Encoding") != "" || identity.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("identity headers = %v", identity.Header())
+	}
+	for _, accept := range []string{"gzip", "br, gzip"} {
+		w := gzipRequest(handler, accept)
+		if w.Code != http.StatusTeapot || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: %d %v, want the status and Vary", accept, w.Code, w.Header())
+		}
+		if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) || w.Body.Len() >= identity.Body.Len() {
+			t.Errorf("%s: Content-Length %s for %d compressed bytes, %d uncompressed", accept, w.Header().Get("Content-Length"), w.Body.Len(), identity.Body.Len())
+		}
+		if body := gunzip(t, w); !bytes.Equal(body, identity.Body.Bytes()) {
+			t.Errorf("%s: decompressed body differs from the identity response", accept)
+		}
+	}
+	if w := gzipRequest(handler, "gzip;q=0"); !bytes.Equal(w.Body.Bytes(), identity.Body.Bytes()) || w.Header().Get("Content-Encoding") != "" {
+		t.Error("gzip;q=0 got a compressed response")
+	}
+}
+
+func TestGzipSkipsSmallAndEncodedBodies(t *testing.T) {
+	small := Gzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}`))
+	})
+	if w := gzipRequest(small, "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"ok": true}` {
+		t.Errorf("small body = %v %q, want it as is", w.Header(), w.Body)
+	}
+	// A body the handler encoded itself, like the scanner's answer proxied by the apiserver
+	var encoded bytes.Buffer
+	gz := gzip.NewWriter(&encoded)
+	gz.Write(bytes.Repeat([]byte("x"), 4*MinGzipSize))
+	gz.Close()
+	proxied := Gzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(encoded.Bytes())
+	})
+	if w := gzipRequest(proxied, "gzip"); !bytes.Equal(w.Body.Bytes(), encoded.Bytes()) {
+		t.Error("an encoded body was compressed again")
+	}
+}
+
+func TestGzipStreaming(t *testing.T) {
+	chunk := strings.Repeat("pokemon ", 50)
+	handler := Gzip(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	})
+	identity := gzipRequest(handler, "")
+	w := gzipRequest(handler, "gzip")
+	if !w.Flushed || w.Header().Get("Content-Length") != "" {
+		t.Errorf("streamed response flushed %v with Content-Length %q", w.Flushed, w.Header().Get("Content-Length"))
+	}
+	if body := gunzip(t, w); !bytes.Equal(body, identity.Body.Bytes()) || len(body) != 5*len(chunk) {
+		t.Errorf("decompressed stream has %d bytes, want the %d of the identity response", len(body), identity.Body.Len())
+	}
+}
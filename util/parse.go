@@ -0,0 +1,158 @@
+package util
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pogodevorg/POGOProtos-go"
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+)
+
+// ParseMapObjects converts a GetMapObjectsResponse to map objects. Relative times in the response
+// are resolved against at, which is the time the response was received and becomes the
+// capture time of the objects.
+func ParseMapObjects(r *protos.GetMapObjectsResponse, at time.Time) []opm.MapObject {
+	objects := make([]opm.MapObject, 0)
+	wild := make(map[string]bool)
+	// Cells
+	for _, c := range r.MapCells {
+		// Pokemon
+		for _, p := range c.WildPokemons {
+			expiry := opm.ExpiryAfter(at, time.Duration(p.TimeTillHiddenMs)*time.Millisecond)
+			if opm.TooFarAhead(expiry, at) {
+				continue
+			}
+			o := opm.MapObject{
+				Type:         opm.POKEMON,
+				ID:           strconv.FormatUint(p.EncounterId, 36),
+				PokemonID:    int(p.PokemonData.PokemonId),
+				SpawnpointID: p.SpawnPointId,
+				Lat:          p.Latitude,
+				Lng:          p.Longitude,
+				Expiry:       expiry,
+			}
+			// Encounter data is only present for encountered Pokemon, which always have a CP
+			if d := p.PokemonData; d.Cp > 0 {
+				o.IVs = &opm.IVs{
+					Attack:  int(d.IndividualAttack),
+					Defense: int(d.IndividualDefense),
+					Stamina: int(d.IndividualStamina),
+				}
+				o.CP = int(d.Cp)
+				o.Move1 = int(d.Move_1)
+				o.Move2 = int(d.Move_2)
+			}
+			wild[o.ID] = true
+			objects = append(objects, o)
+		}
+		// Forts
+		for _, f := range c.Forts {
+			switch f.Type {
+			case protos.FortType_CHECKPOINT:
+				// Lure module
+				lureType := ""
+				for _, item := range f.ActiveFortModifier {
+					if t := opm.LureTypeFromItem(int(item)); t != "" {
+						lureType = t
+						break
+					}
+				}
+				var lureExpiry int64
+				if f.LureInfo != nil {
+					lureExpiry = opm.ExpiryFromMs(f.LureInfo.LureExpiresTimestampMs)
+					// Lured pokemon found!
+					objects = append(objects, opm.MapObject{
+						Type:      opm.POKEMON,
+						ID:        strconv.FormatUint(f.LureInfo.EncounterId, 36),
+						PokemonID: int(f.LureInfo.ActivePokemonId),
+						Lat:       f.Latitude,
+						Lng:       f.Longitude,
+						Expiry:    lureExpiry,
+						LureType:  lureType,
+						LuredBy:   f.Id,
+					})
+				}
+				objects = append(objects, opm.MapObject{
+					Type:     opm.POKESTOP,
+					ID:       f.Id,
+					Lat:      f.Latitude,
+					Lng:      f.Longitude,
+					Lured:    f.ActiveFortModifier != nil,
+					LureType: lureType,
+					// Only known while a lured Pokemon is there, otherwise the stop shows lured until the next scan
+					Expiry: lureExpiry,
+				})
+			case protos.FortType_GYM:
+				objects = append(objects, opm.MapObject{
+					Type:           opm.GYM,
+					ID:             f.Id,
+					Lat:            f.Latitude,
+					Lng:            f.Longitude,
+					Team:           int(f.OwnedByTeam),
+					GymPoints:      f.GymPoints,
+					GuardPokemonID: int(f.GuardPokemonId),
+					GuardPokemonCP: int(f.GuardPokemonCp),
+				})
+			}
+		}
+	}
+	// Catchable Pokemon that were not in the wild lists of any cell
+	for _, c := range r.MapCells {
+		for _, p := range c.CatchablePokemons {
+			id := strconv.FormatUint(p.EncounterId, 36)
+			// A negative timestamp means the game doesn't know the expiry, and 0 would never expire
+			expiry := opm.ExpiryFromMs(p.ExpirationTimestampMs)
+			if wild[id] || expiry <= 0 || opm.TooFarAhead(expiry, at) {
+				continue
+			}
+			wild[id] = true
+			objects = append(objects, opm.MapObject{
+				Type:         opm.POKEMON,
+				ID:           id,
+				PokemonID:    int(p.PokemonId),
+				SpawnpointID: p.SpawnPointId,
+				Lat:          p.Latitude,
+				Lng:          p.Longitude,
+				Expiry:       expiry,
+			})
+		}
+	}
+	captured := at.UnixNano() / int64(time.Millisecond)
+	for i := range objects {
+		objects[i].CapturedAt = captured
+	}
+	return objects
+}
+
+// ParseNearbyPokemon returns the nearby Pokemon of a GetMapObjectsResponse. They have no
+// coordinates, only the location of the scan and a distance or the fort they are at.
+func ParseNearbyPokemon(r *protos.GetMapObjectsResponse, lat, lng float64, at time.Time) []opm.NearbyPokemon {
+	nearby := make([]opm.NearbyPokemon, 0)
+	for _, c := range r.MapCells {
+		for _, p := range c.NearbyPokemons {
+			nearby = append(nearby, opm.NearbyPokemon{
+				EncounterID: strconv.FormatUint(p.EncounterId, 36),
+				PokemonID:   int(p.PokemonId),
+				FortID:      p.FortId,
+				Distance:    float64(p.DistanceInMeters),
+				Lat:         lat,
+				Lng:         lng,
+				SeenAt:      at.Unix(),
+			})
+		}
+	}
+	return nearby
+}
+
+// ParseFootprint returns the bounding box of the map cells of a GetMapObjectsResponse, which
+// is the area the scan actually refreshed. It is empty if the response has no cells.
+func ParseFootprint(r *protos.GetMapObjectsResponse) opm.BoundingBox {
+	ids := make([]uint64, 0, len(r.MapCells))
+	for _, c := range r.MapCells {
+		if c.S2CellId != 0 {
+			ids = append(ids, c.S2CellId)
+		}
+	}
+	return opm.BoundingBox(geo.S2CellsBound(ids))
+}
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pogodevorg/POGOProtos-go"
+	"github.com/pogointel/opm/internal/geo"
+	"github.com/pogointel/opm/opm"
+)
+
+// testMapResponse has a wild, a catchable and a nearby Pokemon of each kind the parser
+// distinguishes, spread over two cells
+func testMapResponse(at time.Time) *protos.GetMapObjectsResponse {
+	ms := at.UnixNano() / int64(time.Millisecond)
+	return &protos.GetMapObjectsResponse{MapCells: []*protos.MapCell{
+		{
+			WildPokemons: []*protos.WildPokemon{
+				{EncounterId: 1, Latitude: 52.5, Longitude: 13.4, SpawnPointId: "sp1", TimeTillHiddenMs: 600000, PokemonData: &protos.PokemonData{PokemonId: 16}},
+				{EncounterId: 2, Latitude: 52.5, Longitude: 13.4, TimeTillHiddenMs: 300000, PokemonData: &protos.PokemonData{PokemonId: 149, Cp: 3000, IndividualAttack: 15, IndividualDefense: 14, IndividualStamina: 13, Move_1: 1, Move_2: 2}},
+			},
+			CatchablePokemons: []*protos.MapPokemon{
+				// Also in the wild list
+				{EncounterId: 1, PokemonId: 16, Latitude: 52.5, Longitude: 13.4, ExpirationTimestampMs: ms + 600000},
+				{EncounterId: 3, PokemonId: 25, Latitude: 52.51, Longitude: 13.41, SpawnPointId: "sp3", ExpirationTimestampMs: ms + 120500},
+				// Unknown expiry
+				{EncounterId: 4, PokemonId: 10, Latitude: 52.5, Longitude: 13.4, ExpirationTimestampMs: -1},
+			},
+			NearbyPokemons: []*protos.NearbyPokemon{
+				{EncounterId: 5, PokemonId: 147, FortId: "stop1"},
+			},
+		},
+		{
+			// The wild entry of a catchable Pokemon can be in another cell
+			CatchablePokemons: []*protos.MapPokemon{
+				{EncounterId: 2, PokemonId: 149, Latitude: 52.5, Longitude: 13.4, ExpirationTimestampMs: ms + 300000},
+				// Further ahead than any Pokemon lives
+				{EncounterId: 6, PokemonId: 19, Latitude: 52.5, Longitude: 13.4, ExpirationTimestampMs: ms + int64(2*opm.MaxPokemonLifetime/time.Millisecond)},
+			},
+			NearbyPokemons: []*protos.NearbyPokemon{
+				{EncounterId: 7, PokemonId: 63, DistanceInMeters: 120},
+			},
+		},
+	}}
+}
+
+func TestParseMapObjects(t *testing.T) {
+	at := time.Unix(1500000000, 0)
+	objects := ParseMapObjects(testMapResponse(at), at)
+	byID := make(map[string]opm.MapObject)
+	for _, o := range objects {
+		if _, ok := byID[o.ID]; ok {
+			t.Errorf("encounter %s parsed twice", o.ID)
+		}
+		if o.CapturedAt != at.Unix()*1000 {
+			t.Errorf("%s captured at %d, want the time of the response", o.ID, o.CapturedAt)
+		}
+		byID[o.ID] = o
+	}
+	id := func(encounter uint64) string { return strconv.FormatUint(encounter, 36) }
+	if len(objects) != 3 {
+		t.Fatalf("parsed %v, want the two wild and one catchable Pokemon", objects)
+	}
+	if o := byID[id(1)]; o.PokemonID != 16 || o.SpawnpointID != "sp1" || o.Expiry != at.Unix()+600 || o.IVs != nil {
+		t.Errorf("wild Pokemon = %+v", o)
+	}
+	if o := byID[id(2)]; o.IVs == nil || o.IVs.Attack != 15 || o.IVs.Defense != 14 || o.IVs.Stamina != 13 || o.CP != 3000 || o.Move1 != 1 || o.Move2 != 2 {
+		t.Errorf("encountered Pokemon = %+v, want its encounter data", o)
+	}
+	// Expiries of catchable Pokemon are truncated to the second
+	want := opm.MapObject{Type: opm.POKEMON, ID: id(3), PokemonID: 25, SpawnpointID: "sp3", Lat: 52.51, Lng: 13.41, Expiry: at.Unix() + 120, CapturedAt: at.Unix() * 1000}
+	if o := byID[id(3)]; o != want {
+		t.Errorf("catchable Pokemon = %+v, want %+v", o, want)
+	}
+}
+
+func TestParseNearbyPokemon(t *testing.T) {
+	at := time.Unix(1500000000, 0)
+	nearby := ParseNearbyPokemon(testMapResponse(at), 52.5, 13.4, at)
+	want := []opm.NearbyPokemon{
+		{EncounterID: "5", PokemonID: 147, FortID: "stop1", Lat: 52.5, Lng: 13.4, SeenAt: at.Unix()},
+		{EncounterID: "7", PokemonID: 63, Distance: 120, Lat: 52.5, Lng: 13.4, SeenAt: at.Unix()},
+	}
+	if len(nearby) != len(want) {
+		t.Fatalf("nearby = %+v, want %+v", nearby, want)
+	}
+	for i := range want {
+		if nearby[i] != want[i] {
+			t.Errorf("nearby[%d] = %+v, want %+v", i, nearby[i], want[i])
+		}
+	}
+	if objects := ParseMapObjects(testMapResponse(at), at); len(objects) != 3 {
+		t.Errorf("nearby Pokemon were parsed as map objects: %v", objects)
+	}
+}
+
+func TestParseFootprint(t *testing.T) {
+	// Two cells west and east of the scan, the ones between were not returned
+	center := geo.LatLng{Lat: 52.5, Lng: 13.4}
+	west := geo.S2Cell(geo.Destination(center, 500, 270), geo.S2Level)
+	east := geo.S2Cell(geo.Destination(center, 500, 90), geo.S2Level)
+	r := &protos.GetMapObjectsResponse{MapCells: []*protos.MapCell{{S2CellId: west}, {S2CellId: east}, {}}}
+	footprint := geo.Box(ParseFootprint(r))
+	if footprint != geo.S2CellsBound([]uint64{west, east}) {
+		t.Errorf("footprint = %+v, want the bound of both cells", footprint)
+	}
+	for _, id := range []uint64{west, east} {
+		if !footprint.Contains(geo.S2CellCenter(id)) {
+			t.Errorf("footprint %+v doesn't contain cell %d", footprint, id)
+		}
+	}
+	if footprint.Contains(geo.Destination(center, 500, 0)) || footprint.Contains(geo.Destination(center, 1000, 90)) {
+		t.Errorf("footprint %+v is larger than the cells", footprint)
+	}
+	// Cells without ids refreshed nothing
+	if f := ParseFootprint(testMapResponse(time.Now())); f.IsSet() {
+		t.Errorf("footprint of cells without ids = %+v", f)
+	}
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// Modes of AnonymizeIP
+const (
+	IPRaw      = ""
+	IPTruncate = "truncate"
+	IPHash     = "hash"
+)
+
+// AnonymizeIP prepares a client address for the logs. IPTruncate zeroes the host part
+// (/24 for IPv4, /48 for IPv6), IPHash returns a keyed hash, so requests of one client can
+// still be correlated by whoever knows the key. addr may contain a port, which is dropped
+// by both modes. Unknown modes hash.
+func AnonymizeIP(addr, mode, key string) string {
+	if mode == IPRaw {
+		return addr
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	switch mode {
+	case IPTruncate:
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "-"
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	default:
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(host))
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+}
+
+// logRedaction is the configuration of the redacted logs, see RedactLogs
+var logRedaction = struct {
+	sync.RWMutex
+	key       string
+	usernames bool
+}{}
+
+// RedactLogs sends the standard logger through a filter that strips the credentials of
+// URLs and the given secrets from every line. Usernames passed through Username are
+// hashed unless s.LogUsernames is set. Call it once the settings are loaded, the filtered
+// lines are written to the output the standard logger had before.
+func RedactLogs(s opm.Settings, secrets ...string) {
+	logRedaction.Lock()
+	logRedaction.key = s.Secret
+	logRedaction.usernames = s.LogUsernames
+	logRedaction.Unlock()
+	var pairs []string
+	for _, secret := range append([]string{s.Secret, s.DbPassword}, secrets...) {
+		if secret != "" {
+			pairs = append(pairs, secret, "[redacted]")
+		}
+	}
+	log.SetOutput(&redactingWriter{out: log.Writer(), secrets: strings.NewReplacer(pairs...)})
+}
+
+// Username prepares an account username for the logs. The hash is stable, so the lines of
+// one account can still be correlated.
+func Username(username string) string {
+	logRedaction.RLock()
+	defer logRedaction.RUnlock()
+	if logRedaction.usernames || username == "" {
+		return username
+	}
+	mac := hmac.New(sha256.New, []byte(logRedaction.key))
+	mac.Write([]byte(username))
+	return "acct-" + hex.EncodeToString(mac.Sum(nil))[:8]
+}
+
+// redactingWriter filters the lines of the standard logger, which writes every line with a
+// single call
+type redactingWriter struct {
+	out     io.Writer
+	secrets *strings.Replacer
+}
+
+func (w *redactingWriter) Write(b []byte) (int, error) {
+	line := w.secrets.Replace(opm.RedactCredentials(string(b)))
+	if _, err := io.WriteString(w.out, line); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,186 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"math"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// ErrUnsupportedPayload is returned by ProtobufSerializer for payloads other than opm.APIResponse
+var ErrUnsupportedPayload = errors.New("Payload can not be encoded as protobuf")
+
+// ProtobufSerializer encodes opm.APIResponse in the binary format of opm/opm.proto.
+// Other payloads are written by the default serializer of the Responder.
+type ProtobufSerializer struct{}
+
+// ContentType returns the media type of the serializer
+func (ProtobufSerializer) ContentType() string {
+	return "application/x-protobuf"
+}
+
+// Format returns the value of the format parameter that selects the serializer
+func (ProtobufSerializer) Format() string {
+	return "pb"
+}
+
+// CanEncode returns true for the payloads Encode supports
+func (ProtobufSerializer) CanEncode(v interface{}) bool {
+	switch v.(type) {
+	case opm.APIResponse, *opm.APIResponse:
+		return true
+	}
+	return false
+}
+
+// Encode writes v, which has to be an opm.APIResponse
+func (ProtobufSerializer) Encode(w io.Writer, v interface{}) error {
+	var resp opm.APIResponse
+	switch r := v.(type) {
+	case opm.APIResponse:
+		resp = r
+	case *opm.APIResponse:
+		resp = *r
+	default:
+		return ErrUnsupportedPayload
+	}
+	_, err := w.Write(encodeAPIResponse(nil, resp))
+	return err
+}
+
+// Wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// pbWriter appends protobuf fields to a buffer. Zero values are skipped, as in proto3.
+type pbWriter struct {
+	b []byte
+}
+
+func (p *pbWriter) varint(v uint64) {
+	for v >= 0x80 {
+		p.b = append(p.b, byte(v)|0x80)
+		v >>= 7
+	}
+	p.b = append(p.b, byte(v))
+}
+
+func (p *pbWriter) tag(field, wire int) {
+	p.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (p *pbWriter) int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, wireVarint)
+	p.varint(uint64(v))
+}
+
+// sint writes a zigzag encoded value, which keeps negative numbers short
+func (p *pbWriter) sint(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, wireVarint)
+	p.varint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (p *pbWriter) bool(field int, v bool) {
+	if v {
+		p.int(field, 1)
+	}
+}
+
+func (p *pbWriter) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, wireFixed64)
+	bits := math.Float64bits(v)
+	for i := uint(0); i < 8; i++ {
+		p.b = append(p.b, byte(bits>>(8*i)))
+	}
+}
+
+func (p *pbWriter) bytes(field int, v []byte) {
+	p.tag(field, wireBytes)
+	p.varint(uint64(len(v)))
+	p.b = append(p.b, v...)
+}
+
+func (p *pbWriter) string(field int, v string) {
+	if v != "" {
+		p.bytes(field, []byte(v))
+	}
+}
+
+// e6 converts a coordinate to millionths of a degree
+func e6(v float64) int64 {
+	return int64(math.Round(v * 1e6))
+}
+
+func encodeAPIResponse(b []byte, r opm.APIResponse) []byte {
+	p := pbWriter{b: b}
+	p.bool(1, r.Ok)
+	p.string(2, r.Error)
+	p.string(3, r.ErrorCode)
+	var buf []byte
+	for _, o := range r.MapObjects {
+		buf = encodeMapObject(buf[:0], o)
+		p.bytes(4, buf)
+	}
+	p.int(5, r.HistoricalAt)
+	if r.Footprint != nil {
+		f := pbWriter{}
+		f.double(1, r.Footprint.North)
+		f.double(2, r.Footprint.South)
+		f.double(3, r.Footprint.East)
+		f.double(4, r.Footprint.West)
+		p.bytes(6, f.b)
+	}
+	if r.RetryAfter != nil {
+		h := pbWriter{}
+		h.int(1, int64(r.RetryAfter.Seconds))
+		h.string(2, r.RetryAfter.Reason)
+		p.bytes(7, h.b)
+	}
+	return p.b
+}
+
+func encodeMapObject(b []byte, o opm.MapObject) []byte {
+	p := pbWriter{b: b}
+	p.int(1, int64(o.Type))
+	p.string(2, o.ID)
+	p.sint(3, e6(o.Lat))
+	p.sint(4, e6(o.Lng))
+	p.int(5, o.Expiry)
+	p.int(6, int64(o.PokemonID))
+	p.bool(7, o.Lured)
+	p.string(8, o.LureType)
+	p.string(9, o.LuredBy)
+	p.int(10, int64(o.Team))
+	p.string(11, o.Source)
+	if o.IVs != nil {
+		iv := pbWriter{}
+		iv.int(1, int64(o.IVs.Attack))
+		iv.int(2, int64(o.IVs.Defense))
+		iv.int(3, int64(o.IVs.Stamina))
+		iv.double(4, o.IVs.Percent)
+		p.bytes(12, iv.b)
+	}
+	p.int(13, int64(o.CP))
+	p.int(14, int64(o.Move1))
+	p.int(15, int64(o.Move2))
+	p.int(16, o.GymPoints)
+	p.int(17, int64(o.GuardPokemonID))
+	p.int(18, int64(o.GuardPokemonCP))
+	p.bool(19, o.Deleted)
+	p.string(20, o.Timezone)
+	p.string(21, o.LocalTime)
+	return p.b
+}
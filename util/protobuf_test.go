@@ -0,0 +1,304 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// pbField is a field of an encoded message. Varints and fixed64 values are in v, the
+// content of length delimited fields in b.
+type pbField struct {
+	num  int
+	v    uint64
+	b    []byte
+	wire int
+}
+
+// readVarint returns the varint at the start of b and its length
+func readVarint(t *testing.T, b []byte) (uint64, int) {
+	t.Helper()
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		t.Fatalf("invalid varint in % x", b)
+	}
+	return v, n
+}
+
+// readFields splits a message into its fields, in the order they were written
+func readFields(t *testing.T, b []byte) []pbField {
+	t.Helper()
+	var fields []pbField
+	for len(b) > 0 {
+		tag, n := readVarint(t, b)
+		b = b[n:]
+		f := pbField{num: int(tag >> 3), wire: int(tag & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.v, n = readVarint(t, b)
+		case wireFixed64:
+			if len(b) < 8 {
+				t.Fatalf("field %d: truncated fixed64", f.num)
+			}
+			f.v, n = binary.LittleEndian.Uint64(b), 8
+		case wireBytes:
+			l, m := readVarint(t, b)
+			if uint64(len(b)-m) < l {
+				t.Fatalf("field %d: %d bytes, want %d", f.num, len(b)-m, l)
+			}
+			f.b, n = b[m:m+int(l)], m+int(l)
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", f.num, f.wire)
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func (f pbField) double() float64 { return math.Float64frombits(f.v) }
+func (f pbField) sint() int64     { return int64(f.v>>1) ^ -int64(f.v&1) }
+
+// decodeAPIResponse is the inverse of encodeAPIResponse, written against opm/opm.proto
+func decodeAPIResponse(t *testing.T, b []byte) opm.APIResponse {
+	t.Helper()
+	var r opm.APIResponse
+	for _, f := range readFields(t, b) {
+		switch f.num {
+		case 1:
+			r.Ok = f.v != 0
+		case 2:
+			r.Error = string(f.b)
+		case 3:
+			r.ErrorCode = string(f.b)
+		case 4:
+			r.MapObjects = append(r.MapObjects, decodeMapObject(t, f.b))
+		case 5:
+			r.HistoricalAt = int64(f.v)
+		case 6:
+			r.Footprint = &opm.BoundingBox{}
+			for _, g := range readFields(t, f.b) {
+				v := g.double()
+				switch g.num {
+				case 1:
+					r.Footprint.North = v
+				case 2:
+					r.Footprint.South = v
+				case 3:
+					r.Footprint.East = v
+				case 4:
+					r.Footprint.West = v
+				}
+			}
+		case 7:
+			r.RetryAfter = &opm.RetryHint{}
+			for _, g := range readFields(t, f.b) {
+				switch g.num {
+				case 1:
+					r.RetryAfter.Seconds = int(g.v)
+				case 2:
+					r.RetryAfter.Reason = string(g.b)
+				}
+			}
+		default:
+			t.Errorf("unknown APIResponse field %d", f.num)
+		}
+	}
+	return r
+}
+
+func decodeMapObject(t *testing.T, b []byte) opm.MapObject {
+	t.Helper()
+	var o opm.MapObject
+	for _, f := range readFields(t, b) {
+		switch f.num {
+		case 1:
+			o.Type = int(f.v)
+		case 2:
+			o.ID = string(f.b)
+		case 3:
+			o.Lat = float64(f.sint()) / 1e6
+		case 4:
+			o.Lng = float64(f.sint()) / 1e6
+		case 5:
+			o.Expiry = int64(f.v)
+		case 6:
+			o.PokemonID = int(f.v)
+		case 7:
+			o.Lured = f.v != 0
+		case 8:
+			o.LureType = string(f.b)
+		case 9:
+			o.LuredBy = string(f.b)
+		case 10:
+			o.Team = int(f.v)
+		case 11:
+			o.Source = string(f.b)
+		case 12:
+			o.IVs = &opm.IVs{}
+			for _, g := range readFields(t, f.b) {
+				switch g.num {
+				case 1:
+					o.IVs.Attack = int(g.v)
+				case 2:
+					o.IVs.Defense = int(g.v)
+				case 3:
+					o.IVs.Stamina = int(g.v)
+				case 4:
+					o.IVs.Percent = g.double()
+				}
+			}
+		case 13:
+			o.CP = int(f.v)
+		case 14:
+			o.Move1 = int(f.v)
+		case 15:
+			o.Move2 = int(f.v)
+		case 16:
+			o.GymPoints = int64(f.v)
+		case 17:
+			o.GuardPokemonID = int(f.v)
+		case 18:
+			o.GuardPokemonCP = int(f.v)
+		case 19:
+			o.Deleted = f.v != 0
+		case 20:
+			o.Timezone = string(f.b)
+		case 21:
+			o.LocalTime = string(f.b)
+		default:
+			t.Errorf("unknown MapObject field %d", f.num)
+		}
+	}
+	return o
+}
+
+func encodePB(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := (ProtobufSerializer{}).Encode(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	resp := opm.APIResponse{
+		Ok:           true,
+		HistoricalAt: 1500000000,
+		MapObjects: []opm.MapObject{
+			{Type: opm.POKEMON, ID: "pokemon", PokemonID: 149, Lat: 52.520008, Lng: 13.404954, Expiry: 1500000900,
+				Source: "scan", IVs: &opm.IVs{Attack: 15, Defense: 0, Stamina: 14, Percent: 64.4}, CP: 3000, Move1: 204, Move2: 83},
+			// Southern and western coordinates encode as negative sint32
+			{Type: opm.POKESTOP, ID: "stop", Lat: -33.856784, Lng: -151.215297, Lured: true, LureType: "glacial", LuredBy: "ash",
+				Timezone: "Australia/Sydney", LocalTime: "2017-07-14T12:40:00+10:00"},
+			{Type: opm.GYM, ID: "gym", Lat: 0.000001, Lng: -0.000001, Team: 2, GymPoints: 52000, GuardPokemonID: 143, GuardPokemonCP: 2800},
+			{Type: opm.POKEMON, ID: "gone", Deleted: true},
+		},
+		Footprint:  &opm.BoundingBox{North: 52.53, South: 52.51, East: 13.42, West: -13.39},
+		RetryAfter: &opm.RetryHint{Seconds: 30, Reason: opm.RetryReasonQueue},
+	}
+	if got := decodeAPIResponse(t, encodePB(t, &resp)); !reflect.DeepEqual(got, resp) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", got, resp)
+	}
+	failed := opm.APIResponse{Error: opm.ErrBusy.Error(), ErrorCode: opm.ErrCodeBusy}
+	if got := decodeAPIResponse(t, encodePB(t, failed)); !reflect.DeepEqual(got, failed) {
+		t.Errorf("decoded %+v, want %+v", got, failed)
+	}
+}
+
+func TestProtobufOmitsZeroFields(t *testing.T) {
+	if b := encodePB(t, opm.APIResponse{}); len(b) != 0 {
+		t.Errorf("empty response = % x, want no bytes", b)
+	}
+	// The object itself is written even if all its fields are zero
+	if b := encodePB(t, opm.APIResponse{MapObjects: []opm.MapObject{{}}}); !bytes.Equal(b, []byte{4<<3 | wireBytes, 0}) {
+		t.Errorf("zero object = % x", b)
+	}
+	stop := opm.MapObject{Type: opm.POKESTOP, ID: "stop", Lat: 52.5, Lng: 13.4}
+	for _, f := range readFields(t, encodeMapObject(nil, stop)) {
+		if f.num > 4 {
+			t.Errorf("Pokestop has field %d", f.num)
+		}
+	}
+	if err := (ProtobufSerializer{}).Encode(&bytes.Buffer{}, map[string]bool{"ok": true}); err != ErrUnsupportedPayload {
+		t.Errorf("Encode of a map = %v, want ErrUnsupportedPayload", err)
+	}
+}
+
+func TestResponderProtobuf(t *testing.T) {
+	resp := NewResponder(JSONSerializer{}, ProtobufSerializer{})
+	payload := opm.APIResponse{Ok: true, MapObjects: []opm.MapObject{{Type: opm.GYM, ID: "gym", Lat: 52.5, Lng: 13.4}}}
+	for _, c := range []struct{ url, accept string }{
+		{"/?format=pb", ""},
+		{"/", "application/x-protobuf"},
+		// The parameter wins over the header
+		{"/?format=pb", "application/json"},
+	} {
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Header.Set("Accept", c.accept)
+		name := c.url + " Accept " + c.accept
+		w := httptest.NewRecorder()
+		resp.Write(w, r, http.StatusOK, payload)
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-protobuf" {
+			t.Errorf("%s: Content-Type = %q, want protobuf", name, ct)
+			continue
+		}
+		if got := decodeAPIResponse(t, w.Body.Bytes()); !reflect.DeepEqual(got, payload) {
+			t.Errorf("%s: decoded %+v, want %+v", name, got, payload)
+		}
+	}
+	// Unknown formats and other payloads are JSON
+	w := httptest.NewRecorder()
+	resp.Write(w, httptest.NewRequest("GET", "/?format=xml", nil), http.StatusOK, payload)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("format=xml: Content-Type = %q, want JSON", ct)
+	}
+	w = httptest.NewRecorder()
+	resp.Write(w, httptest.NewRequest("GET", "/?format=pb", nil), http.StatusOK, map[string]int{"count": 3})
+	var body map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["count"] != 3 || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("map with format=pb = %q %q, want JSON", w.Header().Get("Content-Type"), w.Body)
+	}
+}
+
+// benchmarkResponse has 1000 objects, half Pokemon and half Pokestops
+func benchmarkResponse() opm.APIResponse {
+	resp := opm.APIResponse{Ok: true}
+	for i := 0; i < 1000; i++ {
+		o := opm.MapObject{ID: fmt.Sprintf("%016x", i*7919), Lat: 52.5 + float64(i)/1e4, Lng: 13.4 - float64(i)/1e4}
+		if i%2 == 0 {
+			o.Type, o.PokemonID, o.Expiry = opm.POKEMON, 1+i%151, 1500000000+int64(i)
+		} else {
+			o.Type = opm.POKESTOP
+		}
+		resp.MapObjects = append(resp.MapObjects, o)
+	}
+	return resp
+}
+
+// BenchmarkEncode1000Objects compares the serializers, bytes/response is the encoded size
+func BenchmarkEncode1000Objects(b *testing.B) {
+	resp := benchmarkResponse()
+	for _, s := range []Serializer{JSONSerializer{}, ProtobufSerializer{}} {
+		b.Run(s.ContentType(), func(b *testing.B) {
+			var buf bytes.Buffer
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := s.Encode(&buf, resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "bytes/response")
+		})
+	}
+}
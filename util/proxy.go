@@ -0,0 +1,72 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/pogointel/opm/opm"
+	"golang.org/x/net/context"
+)
+
+// baseTransport is the default transport before useContextTransports replaced it
+var baseTransport = http.DefaultTransport.(*http.Transport)
+
+// ProxyTransport returns a transport that sends all requests through the proxy. Proxies
+// without URL connect to the proxy hub themselves and have no transport.
+func ProxyTransport(p opm.Proxy) (*http.Transport, error) {
+	if p.URL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy %d: unsupported scheme %q", p.ID, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %d: no host in %q", p.ID, p.URL)
+	}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	transport := baseTransport.Clone()
+	transport.Proxy = http.ProxyURL(u)
+	return transport, nil
+}
+
+type transportKey struct{}
+
+// withTransport returns a context whose requests pgoapi sends through the transport
+func withTransport(ctx context.Context, transport http.RoundTripper) context.Context {
+	if transport == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, transportKey{}, transport)
+}
+
+// contextTransport sends requests through the transport of their context, pgoapi has no
+// other way to set the transport of a session
+type contextTransport struct {
+	fallback http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if transport, ok := r.Context().Value(transportKey{}).(http.RoundTripper); ok {
+		return transport.RoundTrip(r)
+	}
+	return t.fallback.RoundTrip(r)
+}
+
+var installTransport sync.Once
+
+// useContextTransports makes the default transport, which pgoapi uses, honour withTransport
+func useContextTransports() {
+	installTransport.Do(func() {
+		http.DefaultTransport = &contextTransport{fallback: http.DefaultTransport}
+	})
+}
@@ -1,15 +1,78 @@
 package util
 
 import (
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pogointel/opm/opm"
 )
 
+// waitBuckets are the upper bounds of the wait time histogram
+var waitBuckets = []time.Duration{
+	0,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// waitWindow is the time span used for wait time percentiles
+const waitWindow = 15 * time.Minute
+
+// maxWaitSamples caps the number of samples kept for percentiles
+const maxWaitSamples = 10000
+
 type TrainerQueue struct {
+	// OnDrop is called for trainers that are not queued again because they can't scan anymore
+	OnDrop func(*TrainerSession)
 	in     chan *TrainerSession
 	out    chan *TrainerSession
+	prunes chan pruneRequest
+	takes  chan takeRequest
 	buffer []*TrainerSession
+	// Stats
+	available int64
+	busy      int64
+	cooling   int64
+	timeouts  int64
+	preferred int64
+	waits     waitStats
+	cooldowns cooldowns
+}
+
+// cooldowns are the times at which the cooling trainers are queued again
+type cooldowns struct {
+	sync.Mutex
+	until map[*TrainerSession]time.Time
+}
+
+type waitSample struct {
+	t    time.Time
+	wait time.Duration
+}
+
+type waitStats struct {
+	sync.Mutex
+	buckets []int64 // one per waitBuckets entry, plus +Inf
+	samples []waitSample
+}
+
+// QueueStats is a snapshot of the TrainerQueue metrics
+type QueueStats struct {
+	Available int64            `json:"available"`
+	Busy      int64            `json:"busy"`
+	Cooling   int64            `json:"cooling"`
+	Timeouts  int64            `json:"timeouts"`
+	Preferred int64            `json:"preferred"` // handed out by TakeBest
+	WaitP50Ms int64            `json:"wait_p50_ms"`
+	WaitP95Ms int64            `json:"wait_p95_ms"`
+	Histogram map[string]int64 `json:"wait_histogram"`
 }
 
 // NewTrainerQueue creates a new buffered queue of *TrainerSessions.
@@ -17,10 +80,15 @@ type TrainerQueue struct {
 func NewTrainerQueue(trainers []*TrainerSession) *TrainerQueue {
 	// Create queue
 	tq := &TrainerQueue{
-		in:     make(chan *TrainerSession),
-		out:    make(chan *TrainerSession),
-		buffer: trainers,
+		in:        make(chan *TrainerSession),
+		out:       make(chan *TrainerSession),
+		prunes:    make(chan pruneRequest),
+		takes:     make(chan takeRequest),
+		buffer:    trainers,
+		available: int64(len(trainers)),
 	}
+	tq.waits.buckets = make([]int64, len(waitBuckets)+1)
+	tq.cooldowns.until = make(map[*TrainerSession]time.Time)
 	// Start *TrainerSession queue/dequeue
 	go tq.queue()
 	// Return TrainerQueue
@@ -30,38 +98,217 @@ func NewTrainerQueue(trainers []*TrainerSession) *TrainerQueue {
 // queue handles the buffer and sends/receives trainers on in/out channels
 func (t *TrainerQueue) queue() {
 	for {
+		// Nothing is sent on the nil channel while the buffer is empty
+		var out chan *TrainerSession
+		var next *TrainerSession
 		if len(t.buffer) > 0 {
-			select {
-			case t.out <- t.buffer[0]:
-				t.buffer = t.buffer[1:]
-			case s := <-t.in:
-				t.buffer = append(t.buffer, s)
-			}
-		} else {
-			s := <-t.in
+			out, next = t.out, t.buffer[0]
+		}
+		select {
+		case out <- next:
+			t.buffer = t.buffer[1:]
+		case s := <-t.in:
 			t.buffer = append(t.buffer, s)
+		case req := <-t.prunes:
+			kept := t.buffer[:0]
+			var dropped []*TrainerSession
+			for _, ts := range t.buffer {
+				if req.drop(ts) {
+					dropped = append(dropped, ts)
+				} else {
+					kept = append(kept, ts)
+				}
+			}
+			t.buffer = kept
+			req.reply <- dropped
+		case req := <-t.takes:
+			best, bestScore := -1, 0.0
+			for i, ts := range t.buffer {
+				if score, ok := req.score(ts); ok && (best < 0 || score < bestScore) {
+					best, bestScore = i, score
+				}
+			}
+			if best < 0 {
+				req.reply <- nil
+				break
+			}
+			ts := t.buffer[best]
+			t.buffer = append(t.buffer[:best], t.buffer[best+1:]...)
+			req.reply <- ts
 		}
+		atomic.StoreInt64(&t.available, int64(len(t.buffer)))
 	}
 }
 
+// pruneRequest asks the queue goroutine to remove trainers from the buffer
+type pruneRequest struct {
+	drop  func(*TrainerSession) bool
+	reply chan []*TrainerSession
+}
+
+// Prune removes the available trainers for which drop returns true and returns them.
+// Busy and cooling trainers are not considered. OnDrop is not called.
+func (t *TrainerQueue) Prune(drop func(*TrainerSession) bool) []*TrainerSession {
+	req := pruneRequest{drop: drop, reply: make(chan []*TrainerSession, 1)}
+	t.prunes <- req
+	return <-req.reply
+}
+
+// takeRequest asks the queue goroutine for the available trainer with the lowest score
+type takeRequest struct {
+	score func(*TrainerSession) (float64, bool)
+	reply chan *TrainerSession
+}
+
+// TakeBest removes the available trainer with the lowest score and returns it. Trainers for
+// which score returns false are not considered. It returns nil without waiting if there is
+// no such trainer.
+func (t *TrainerQueue) TakeBest(score func(*TrainerSession) (float64, bool)) *TrainerSession {
+	req := takeRequest{score: score, reply: make(chan *TrainerSession, 1)}
+	t.takes <- req
+	ts := <-req.reply
+	if ts != nil {
+		atomic.AddInt64(&t.busy, 1)
+		atomic.AddInt64(&t.preferred, 1)
+	}
+	return ts
+}
+
 // Get requests a *TrainerSession from the queue
 // This will block until a *TrainerSession is available
 func (t *TrainerQueue) Get(timeout time.Duration) (*TrainerSession, error) {
+	start := time.Now()
 	select {
 	case trainer := <-t.out:
+		atomic.AddInt64(&t.busy, 1)
+		t.waits.add(start, time.Since(start))
 		return trainer, nil
 	case <-time.After(timeout):
+		atomic.AddInt64(&t.timeouts, 1)
 		return &TrainerSession{}, opm.ErrTimeout
 	}
 }
 
 // Queue returns a *TrainerSession to the queue. Also adds new *TrainerSessions.
 func (t *TrainerQueue) Queue(ts *TrainerSession, delay time.Duration) {
+	if atomic.AddInt64(&t.busy, -1) < 0 {
+		// Trainer was not taken from this queue
+		atomic.AddInt64(&t.busy, 1)
+	}
 	if ts.Account.Banned || ts.Proxy.Dead || ts.Account.CaptchaFlagged {
+		if t.OnDrop != nil {
+			t.OnDrop(ts)
+		}
 		return
 	}
+	atomic.AddInt64(&t.cooling, 1)
+	t.cooldowns.Lock()
+	t.cooldowns.until[ts] = time.Now().Add(delay)
+	t.cooldowns.Unlock()
 	go func(x *TrainerSession) {
 		time.Sleep(delay)
 		t.in <- x
+		t.cooldowns.Lock()
+		delete(t.cooldowns.until, x)
+		t.cooldowns.Unlock()
+		atomic.AddInt64(&t.cooling, -1)
 	}(ts)
 }
+
+// NextReady returns the time until the next cooling trainer is queued again. It is 0 if a
+// trainer is available or none is cooling down.
+func (t *TrainerQueue) NextReady() time.Duration {
+	if atomic.LoadInt64(&t.available) > 0 {
+		return 0
+	}
+	t.cooldowns.Lock()
+	defer t.cooldowns.Unlock()
+	var next time.Time
+	for _, until := range t.cooldowns.until {
+		if next.IsZero() || until.Before(next) {
+			next = until
+		}
+	}
+	if next.IsZero() {
+		return 0
+	}
+	return time.Until(next)
+}
+
+// Stats returns the current queue metrics
+func (t *TrainerQueue) Stats() QueueStats {
+	p50, p95 := t.waits.percentiles()
+	return QueueStats{
+		Available: atomic.LoadInt64(&t.available),
+		Busy:      atomic.LoadInt64(&t.busy),
+		Cooling:   atomic.LoadInt64(&t.cooling),
+		Timeouts:  atomic.LoadInt64(&t.timeouts),
+		Preferred: atomic.LoadInt64(&t.preferred),
+		WaitP50Ms: int64(p50 / time.Millisecond),
+		WaitP95Ms: int64(p95 / time.Millisecond),
+		Histogram: t.waits.histogram(),
+	}
+}
+
+func (w *waitStats) add(now time.Time, d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	// Histogram
+	i := sort.Search(len(waitBuckets), func(i int) bool { return d <= waitBuckets[i] })
+	w.buckets[i]++
+	// Samples for percentiles
+	w.samples = append(w.samples, waitSample{t: now, wait: d})
+	w.prune(now)
+}
+
+// prune drops samples outside of the window. Must be called with the lock held.
+func (w *waitStats) prune(now time.Time) {
+	i := 0
+	for i < len(w.samples) && (now.Sub(w.samples[i].t) > waitWindow || len(w.samples)-i > maxWaitSamples) {
+		i++
+	}
+	w.samples = w.samples[i:]
+}
+
+func (w *waitStats) percentiles() (time.Duration, time.Duration) {
+	w.Lock()
+	w.prune(time.Now())
+	waits := make([]time.Duration, len(w.samples))
+	for i, s := range w.samples {
+		waits[i] = s.wait
+	}
+	w.Unlock()
+	if len(waits) == 0 {
+		return 0, 0
+	}
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	return waits[(len(waits)-1)*50/100], waits[(len(waits)-1)*95/100]
+}
+
+func (w *waitStats) histogram() map[string]int64 {
+	w.Lock()
+	defer w.Unlock()
+	// Cumulative buckets
+	h := make(map[string]int64)
+	sum := int64(0)
+	for i, b := range waitBuckets {
+		sum += w.buckets[i]
+		h["le_"+b.String()] = sum
+	}
+	h["le_inf"] = sum + w.buckets[len(waitBuckets)]
+	return h
+}
+
+// ApproxBytes returns the approximate memory used by the queue metrics
+func (t *TrainerQueue) ApproxBytes() int64 {
+	t.waits.Lock()
+	defer t.waits.Unlock()
+	return int64(len(t.waits.samples) * 32)
+}
+
+// Shrink drops the older half of the wait time samples
+func (t *TrainerQueue) Shrink() {
+	t.waits.Lock()
+	defer t.waits.Unlock()
+	t.waits.samples = append([]waitSample(nil), t.waits.samples[len(t.waits.samples)/2:]...)
+}
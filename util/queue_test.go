@@ -0,0 +1,97 @@
+package util
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// TestQueueWaitUnderLoad runs more clients than trainers and checks that the wait time
+// metrics match the simulated load
+func TestQueueWaitUnderLoad(t *testing.T) {
+	const (
+		trainers = 2
+		clients  = 8
+		rounds   = 5
+		hold     = 20 * time.Millisecond
+	)
+	var sessions []*TrainerSession
+	for i := 0; i < trainers; i++ {
+		sessions = append(sessions, &TrainerSession{})
+	}
+	q := NewTrainerQueue(sessions)
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				ts, err := q.Get(5 * time.Second)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(hold)
+				q.Queue(ts, 0)
+			}
+		}()
+	}
+	wg.Wait()
+	s := q.Stats()
+	if got := s.Histogram["le_inf"]; got != clients*rounds {
+		t.Errorf("histogram counts %d waits, want %d", got, clients*rounds)
+	}
+	if s.Timeouts != 0 || s.Busy != 0 {
+		t.Errorf("timeouts %d, busy %d, want none", s.Timeouts, s.Busy)
+	}
+	// Cumulative buckets never decrease
+	prev := int64(0)
+	for _, b := range waitBuckets {
+		n := s.Histogram["le_"+b.String()]
+		if n < prev {
+			t.Errorf("bucket le_%s = %d is below the previous bucket %d", b, n, prev)
+		}
+		prev = n
+	}
+	// Four clients per trainer: most requests wait for up to three holds
+	if s.WaitP95Ms < int64(hold/time.Millisecond) || s.WaitP95Ms > 1000 {
+		t.Errorf("p95 = %d ms, want between %v and 1s", s.WaitP95Ms, hold)
+	}
+	if s.WaitP50Ms > s.WaitP95Ms {
+		t.Errorf("p50 %d ms > p95 %d ms", s.WaitP50Ms, s.WaitP95Ms)
+	}
+	if s.Histogram["le_5s"] != clients*rounds {
+		t.Errorf("%d waits over 5s", clients*rounds-s.Histogram["le_5s"])
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	q := NewTrainerQueue(nil)
+	if _, err := q.Get(10 * time.Millisecond); err != opm.ErrTimeout {
+		t.Fatalf("Get from an empty queue = %v, want opm.ErrTimeout", err)
+	}
+	if s := q.Stats(); s.Timeouts != 1 || s.Histogram["le_inf"] != 0 {
+		t.Errorf("stats = %+v, want one timeout and no wait sample", s)
+	}
+}
+
+func TestQueueNextReady(t *testing.T) {
+	trainer := &TrainerSession{}
+	q := NewTrainerQueue([]*TrainerSession{trainer})
+	if d := q.NextReady(); d != 0 {
+		t.Errorf("NextReady with a free trainer = %s, want 0", d)
+	}
+	if _, err := q.Get(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := q.NextReady(); d != 0 {
+		t.Errorf("NextReady while nobody cools down = %s, want 0", d)
+	}
+	// The trainer is back after its scan delay
+	q.Queue(trainer, 3*time.Second)
+	if d := q.NextReady(); d <= 2*time.Second || d > 3*time.Second {
+		t.Errorf("NextReady = %s, want the 3 s cooldown", d)
+	}
+}
@@ -0,0 +1,193 @@
+package util
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// tokenBucket is a token bucket that refills continuously
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Duration // time to refill the empty bucket
+}
+
+// sweepInterval is the minimum time between two sweeps of the idle buckets
+const sweepInterval = time.Minute
+
+// KeyLimiter is a token bucket rate limiter with one bucket per key. Buckets that were
+// idle long enough to be full again are dropped, so the limiter only holds active keys.
+type KeyLimiter struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	nowFunc   func() time.Time
+	lastSweep time.Time
+}
+
+// NewKeyLimiter creates an empty KeyLimiter
+func NewKeyLimiter() *KeyLimiter {
+	return &KeyLimiter{
+		buckets: make(map[string]*tokenBucket),
+		nowFunc: time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the key. The bucket holds up to burst tokens
+// and refills with perMinute tokens per minute. If no token is left, it returns false
+// and the time until the next token is available.
+func (l *KeyLimiter) Allow(key string, perMinute, burst int) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := l.nowFunc()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	// Refill
+	rate := float64(perMinute) / 60 // tokens per second
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	b.full = time.Duration(float64(burst) / rate * float64(time.Second))
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops the buckets that were idle long enough to refill completely, at most once
+// per sweepInterval. A key that comes back gets a full bucket, like it would have anyway.
+func (l *KeyLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= b.full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Wait blocks until Allow hands out a token for the key or ctx is done
+func (l *KeyLimiter) Wait(ctx context.Context, key string, perMinute, burst int) error {
+	for {
+		ok, wait := l.Allow(key, perMinute, burst)
+		if ok {
+			return nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// APIKeyAuth is a middleware that requires an enabled API key and applies the rate limit of the key.
+// Lookup has to return opm.ErrInvalidAPIKey for unknown keys, other errors are answered with 503.
+type APIKeyAuth struct {
+	Lookup           func(key string) (opm.APIKey, error)
+	Limiter          *KeyLimiter
+	DefaultPerMinute int
+	DefaultBurst     int
+	Responder        *Responder // writes the error responses
+}
+
+// NewAPIKeyAuth creates an APIKeyAuth that looks up keys with the given function
+func NewAPIKeyAuth(lookup func(string) (opm.APIKey, error), perMinute, burst int) *APIKeyAuth {
+	return &APIKeyAuth{
+		Lookup:           lookup,
+		Limiter:          NewKeyLimiter(),
+		DefaultPerMinute: perMinute,
+		DefaultBurst:     burst,
+		Responder:        NewResponder(),
+	}
+}
+
+// RequestKey returns the API key of the request from the key form value or the X-Api-Key header
+func RequestKey(r *http.Request) string {
+	key := r.FormValue("key")
+	if key == "" {
+		key = r.Header.Get("X-Api-Key")
+	}
+	return key
+}
+
+// Wrap returns a handler that answers 401 for missing or invalid keys and 429 for keys over their limit
+func (a *APIKeyAuth) Wrap(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k := RequestKey(r)
+		if k == "" {
+			a.writeAuthError(w, r, http.StatusUnauthorized, opm.ErrCodeAuth, opm.ErrNoAPIKey)
+			return
+		}
+		key, err := a.Lookup(k)
+		if err == opm.ErrInvalidAPIKey || err == nil && !key.Enabled {
+			a.writeAuthError(w, r, http.StatusUnauthorized, opm.ErrCodeAuth, opm.ErrInvalidAPIKey)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			hint := RetryAfter(w, RetrySignal{Reason: opm.RetryReasonUnavailable, Wait: UnavailableRetry})
+			a.Responder.Write(w, r, http.StatusServiceUnavailable, opm.APIResponse{Ok: false, Error: "Service unavailable", RetryAfter: hint})
+			return
+		}
+		perMinute, burst := a.limits(key)
+		if ok, wait := a.Limiter.Allow(key.PublicKey, perMinute, burst); !ok {
+			hint := RetryAfter(w, RetrySignal{Reason: opm.RetryReasonRateLimit, Wait: wait})
+			a.Responder.Write(w, r, http.StatusTooManyRequests, opm.APIResponse{Ok: false, Error: opm.ErrRateLimited.Error(), ErrorCode: opm.ErrCodeRateLimited, RetryAfter: hint})
+			return
+		}
+		inner(w, r)
+	}
+}
+
+// CallerLimit returns the rate limit of the API key of the request. It's false if the
+// request has no enabled key.
+func (a *APIKeyAuth) CallerLimit(r *http.Request) (perMinute, burst int, ok bool) {
+	k := RequestKey(r)
+	if k == "" {
+		return 0, 0, false
+	}
+	key, err := a.Lookup(k)
+	if err != nil || !key.Enabled {
+		return 0, 0, false
+	}
+	perMinute, burst = a.limits(key)
+	return perMinute, burst, true
+}
+
+// limits returns the rate limit of a key, the defaults apply unless the key has its own
+func (a *APIKeyAuth) limits(key opm.APIKey) (perMinute, burst int) {
+	perMinute, burst = key.RequestsPerMinute, key.Burst
+	if perMinute == 0 {
+		perMinute = a.DefaultPerMinute
+	}
+	if burst == 0 {
+		burst = a.DefaultBurst
+	}
+	return perMinute, burst
+}
+
+func (a *APIKeyAuth) writeAuthError(w http.ResponseWriter, r *http.Request, status int, code string, e error) {
+	a.Responder.Write(w, r, status, opm.APIResponse{Ok: false, Error: e.Error(), ErrorCode: code})
+}
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func testLimiter() (*KeyLimiter, *time.Time) {
+	now := time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)
+	l := NewKeyLimiter()
+	l.nowFunc = func() time.Time { return now }
+	return l, &now
+}
+
+func TestKeyLimiterEvictsRefilledBuckets(t *testing.T) {
+	l, now := testLimiter()
+	// 60 per minute with a burst of 10 refill in 10 s
+	for i := 0; i < 10; i++ {
+		l.Allow("idle", 60, 10)
+		l.Allow("busy", 60, 10)
+	}
+	if ok, _ := l.Allow("busy", 60, 10); ok {
+		t.Fatal("allowed over the burst")
+	}
+	*now = now.Add(sweepInterval)
+	l.Allow("busy", 60, 10)
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket was kept after it refilled")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("busy bucket was dropped")
+	}
+	// A returning key starts with a full bucket, as it would have anyway
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow("idle", 60, 10); !ok {
+			t.Fatalf("returning key limited after %d requests", i)
+		}
+	}
+}
+
+func TestKeyLimiterKeepsRefillingBuckets(t *testing.T) {
+	l, now := testLimiter()
+	// 1 per minute with a burst of 5 refill in 5 minutes
+	for i := 0; i < 5; i++ {
+		l.Allow("slow", 1, 5)
+	}
+	*now = now.Add(2 * time.Minute)
+	l.Allow("other", 60, 10)
+	if _, ok := l.buckets["slow"]; !ok {
+		t.Fatal("bucket dropped before it refilled")
+	}
+	// Two tokens are back, the limit still applies
+	l.Allow("slow", 1, 5)
+	l.Allow("slow", 1, 5)
+	if ok, _ := l.Allow("slow", 1, 5); ok {
+		t.Error("a sweep reset the bucket")
+	}
+	*now = now.Add(10 * time.Minute)
+	l.Allow("other", 60, 10)
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets, want only the one in use", len(l.buckets))
+	}
+}
+
+func TestAPIKeyAuthErrorCodes(t *testing.T) {
+	auth := NewAPIKeyAuth(func(key string) (opm.APIKey, error) {
+		switch key {
+		case "valid":
+			return opm.APIKey{PrivateKey: key, PublicKey: "pub", Enabled: true}, nil
+		case "disabled":
+			return opm.APIKey{PrivateKey: key, PublicKey: "off"}, nil
+		case "broken":
+			return opm.APIKey{}, errors.New("db down")
+		}
+		return opm.APIKey{}, opm.ErrInvalidAPIKey
+	}, 60, 1)
+	handler := auth.Wrap(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		key    string
+		status int
+		code   string
+	}{
+		{"", http.StatusUnauthorized, opm.ErrCodeAuth},
+		{"unknown", http.StatusUnauthorized, opm.ErrCodeAuth},
+		{"disabled", http.StatusUnauthorized, opm.ErrCodeAuth},
+		{"broken", http.StatusServiceUnavailable, ""},
+		{"valid", http.StatusOK, ""},
+		// The burst of 1 is used up
+		{"valid", http.StatusTooManyRequests, opm.ErrCodeRateLimited},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/?key="+test.key, nil))
+		var resp opm.APIResponse
+		if test.status != http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("key %q: invalid response %q", test.key, w.Body)
+				continue
+			}
+		}
+		if w.Code != test.status || resp.ErrorCode != test.code {
+			t.Errorf("key %q: %d %s, want %d %s", test.key, w.Code, resp.ErrorCode, test.status, test.code)
+		}
+	}
+}
+
+func TestAPIKeyAuthRetryHints(t *testing.T) {
+	auth := NewAPIKeyAuth(func(key string) (opm.APIKey, error) {
+		if key == "broken" {
+			return opm.APIKey{}, errors.New("db down")
+		}
+		return opm.APIKey{PrivateKey: key, PublicKey: "pub", Enabled: true}, nil
+	}, 6, 1)
+	handler := auth.Wrap(func(w http.ResponseWriter, r *http.Request) {})
+	hint := func(key string) (int, string, *opm.RetryHint) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/?key="+key, nil))
+		var resp opm.APIResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, w.Header().Get("Retry-After"), resp.RetryAfter
+	}
+	hint("valid")
+	// 6 per minute refill a token every 10 s
+	if code, header, h := hint("valid"); code != http.StatusTooManyRequests || header != "10" || h == nil || h.Reason != opm.RetryReasonRateLimit || h.Seconds != 10 {
+		t.Errorf("limited key = %d, Retry-After %q, hint %+v, want 10 s until the next token", code, header, h)
+	}
+	if code, header, h := hint("broken"); code != http.StatusServiceUnavailable || header != "5" || h == nil || h.Reason != opm.RetryReasonUnavailable {
+		t.Errorf("failed lookup = %d, Retry-After %q, hint %+v, want 5 s for the database", code, header, h)
+	}
+}
+
+func TestKeyLimiterScalesWithKeys(t *testing.T) {
+	// Ten minutes of three workers per proxy asking for a call every 100 ms, at 30 calls per
+	// proxy and minute
+	const perMinute, minutes = 30, 10
+	for _, proxies := range []int{1, 2, 4, 8} {
+		l, now := testLimiter()
+		calls := make(map[string]int)
+		total := 0
+		for step := 0; step < minutes*600; step++ {
+			*now = now.Add(100 * time.Millisecond)
+			for w := 0; w < 3*proxies; w++ {
+				key := strconv.Itoa(w % proxies)
+				if ok, _ := l.Allow(key, perMinute, 1); ok {
+					calls[key]++
+					total++
+				}
+			}
+		}
+		for key, n := range calls {
+			if n > perMinute*minutes+1 || n < perMinute*minutes-1 {
+				t.Errorf("%d proxies: %d calls through proxy %s, want %d", proxies, n, key, perMinute*minutes)
+			}
+		}
+		if len(calls) != proxies || total < proxies*(perMinute*minutes-1) {
+			t.Errorf("%d proxies: %d calls in total, want %d", proxies, total, proxies*perMinute*minutes)
+		}
+	}
+}
+
+func TestKeyLimiterWait(t *testing.T) {
+	l := NewKeyLimiter()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, "proxy", 60, 1); err != nil {
+		t.Fatal(err)
+	}
+	// The next token is a second away
+	if err := l.Wait(ctx, "proxy", 60, 1); err != context.DeadlineExceeded {
+		t.Errorf("Wait = %v, want the deadline", err)
+	}
+	start := time.Now()
+	if err := l.Wait(context.Background(), "fast", 6000, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(context.Background(), "fast", 6000, 1); err != nil || time.Since(start) < 5*time.Millisecond {
+		t.Errorf("Wait = %v after %s, want about 10 ms", err, time.Since(start))
+	}
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pogodevorg/POGOProtos-go"
+)
+
+// EncodeMapResponse serializes and gzips a GetMapObjectsResponse for raw capture
+func EncodeMapResponse(r *protos.GetMapObjectsResponse) ([]byte, error) {
+	b, err := proto.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeMapResponse is the inverse of EncodeMapResponse
+func DecodeMapResponse(data []byte) (*protos.GetMapObjectsResponse, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	r := &protos.GetMapObjectsResponse{}
+	err = proto.Unmarshal(b, r)
+	return r, err
+}
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serializer encodes response payloads for one media type
+type Serializer interface {
+	ContentType() string
+	Encode(w io.Writer, v interface{}) error
+}
+
+// JSONSerializer encodes payloads as JSON. Type defaults to application/json.
+type JSONSerializer struct {
+	Type string
+}
+
+// ContentType returns the media type of the serializer
+func (s JSONSerializer) ContentType() string {
+	if s.Type == "" {
+		return "application/json"
+	}
+	return s.Type
+}
+
+// Encode writes v as JSON
+func (s JSONSerializer) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// TextSerializer writes payloads with fmt.Fprint, for the plain text answers of the admin endpoints
+type TextSerializer struct{}
+
+// ContentType returns the media type of the serializer
+func (TextSerializer) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
+
+// Encode writes v as text
+func (TextSerializer) Encode(w io.Writer, v interface{}) error {
+	_, err := fmt.Fprint(w, v)
+	return err
+}
+
+// Responder writes the responses of the HTTP handlers. The serializer is chosen by the
+// Accept header of the request, the first one is the default. Headers, including CORS,
+// are always set before the status line, and the size and time of every response are
+// recorded in Stats.
+type Responder struct {
+	serializers []Serializer
+	// CORS sets the CORS headers of a response, nil for none
+	CORS  func(h http.Header, r *http.Request)
+	Stats *ResponseStats
+}
+
+// NewResponder returns a responder using the given serializers, JSON if there are none
+func NewResponder(serializers ...Serializer) *Responder {
+	if len(serializers) == 0 {
+		serializers = []Serializer{JSONSerializer{}}
+	}
+	return &Responder{serializers: serializers, Stats: newResponseStats()}
+}
+
+// Write answers the request with status and the payload, serialized by content negotiation.
+// Payloads the negotiated serializer can't encode are written with the default serializer.
+func (resp *Responder) Write(w http.ResponseWriter, r *http.Request, status int, payload interface{}) {
+	s := resp.Negotiate(r)
+	if c, ok := s.(payloadChecker); ok && !c.CanEncode(payload) {
+		s = resp.serializers[0]
+	}
+	resp.WriteWith(w, r, status, payload, s)
+}
+
+// formatSerializer is a serializer that can also be selected with the format parameter
+type formatSerializer interface {
+	Format() string
+}
+
+// payloadChecker is a serializer that only supports some payloads
+type payloadChecker interface {
+	CanEncode(v interface{}) bool
+}
+
+// WriteWith answers the request with status and the payload, serialized with s
+func (resp *Responder) WriteWith(w http.ResponseWriter, r *http.Request, status int, payload interface{}, s Serializer) {
+	start := time.Now()
+	var buf bytes.Buffer
+	if err := s.Encode(&buf, payload); err != nil {
+		log.Println(err)
+		status = http.StatusInternalServerError
+		buf.Reset()
+	}
+	resp.ApplyCORS(w, r)
+	w.Header().Set("Content-Type", s.ContentType())
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	n, err := w.Write(buf.Bytes())
+	if err != nil {
+		log.Println(err)
+	}
+	resp.Stats.record(status, n, time.Since(start))
+}
+
+// ApplyCORS sets the CORS headers unless they are already set. Handlers that stream their
+// response can call it before writing.
+func (resp *Responder) ApplyCORS(w http.ResponseWriter, r *http.Request) {
+	if resp.CORS == nil || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		return
+	}
+	resp.CORS(w.Header(), r)
+}
+
+// Negotiate returns the serializer selected by the format parameter, or else the first one
+// accepted by the request. Quality values are ignored, the media ranges are taken in the
+// order of the header.
+func (resp *Responder) Negotiate(r *http.Request) Serializer {
+	if format := r.FormValue("format"); format != "" {
+		for _, s := range resp.serializers {
+			if f, ok := s.(formatSerializer); ok && f.Format() == format {
+				return s
+			}
+		}
+	}
+	accept := r.Header.Get("Accept")
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		for _, s := range resp.serializers {
+			t, _, _ := mime.ParseMediaType(s.ContentType())
+			if mediaType == t || mediaType == "*/*" || mediaType == strings.SplitN(t, "/", 2)[0]+"/*" {
+				return s
+			}
+		}
+	}
+	return resp.serializers[0]
+}
+
+// ResponseStats counts the responses written by a Responder
+type ResponseStats struct {
+	sync.Mutex
+	responses int64
+	bytes     int64
+	duration  time.Duration
+	byStatus  map[int]int64
+}
+
+func newResponseStats() *ResponseStats {
+	return &ResponseStats{byStatus: make(map[int]int64)}
+}
+
+func (s *ResponseStats) record(status, n int, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.responses++
+	s.bytes += int64(n)
+	s.duration += d
+	s.byStatus[status]++
+}
+
+// String returns the stats as JSON for expvar. The duration is the time spent serializing
+// and writing, the handler time is in the request log.
+func (s *ResponseStats) String() string {
+	s.Lock()
+	defer s.Unlock()
+	stats := struct {
+		Responses int64         `json:"responses"`
+		Bytes     int64         `json:"bytes"`
+		AvgMs     float64       `json:"avg_ms"`
+		ByStatus  map[int]int64 `json:"by_status"`
+	}{Responses: s.responses, Bytes: s.bytes, ByStatus: s.byStatus}
+	if s.responses > 0 {
+		stats.AvgMs = float64(s.duration) / float64(s.responses) / float64(time.Millisecond)
+	}
+	b, _ := json.Marshal(stats)
+	return string(b)
+}
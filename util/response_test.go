@@ -0,0 +1,76 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestResponderHeaders(t *testing.T) {
+	resp := NewResponder(JSONSerializer{}, TextSerializer{})
+	cors := 0
+	resp.CORS = func(h http.Header, r *http.Request) {
+		cors++
+		h.Add("Access-Control-Allow-Origin", "*")
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	// CORS applied by a decorator before the handler is not applied again
+	resp.ApplyCORS(w, r)
+	resp.Write(w, r, http.StatusTeapot, map[string]bool{"ok": true})
+	// The recorder keeps the headers of the status line, later ones would be lost
+	result := w.Result()
+	if result.StatusCode != http.StatusTeapot || result.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("response = %d %v, want 418 and JSON", result.StatusCode, result.Header)
+	}
+	if result.Header.Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length = %s for %d bytes", result.Header.Get("Content-Length"), w.Body.Len())
+	}
+	if cors != 1 || len(result.Header["Access-Control-Allow-Origin"]) != 1 {
+		t.Errorf("CORS applied %d times, headers %v", cors, result.Header)
+	}
+	var body map[string]bool
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || !body["ok"] {
+		t.Errorf("body = %q", w.Body)
+	}
+}
+
+func TestResponderNegotiation(t *testing.T) {
+	resp := NewResponder(JSONSerializer{}, TextSerializer{})
+	for accept, want := range map[string]string{
+		"":                               "application/json",
+		"text/plain":                     "text/plain; charset=utf-8",
+		"text/*":                         "text/plain; charset=utf-8",
+		"application/xml, text/plain":    "text/plain; charset=utf-8",
+		"text/html;q=0.9, */*":           "application/json",
+		"application/xml":                "application/json",
+		"not a media type, text/plain":   "text/plain; charset=utf-8",
+		"application/json; charset=utf8": "application/json",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		resp.Write(w, r, http.StatusOK, "<3")
+		if got := w.Result().Header.Get("Content-Type"); got != want {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestResponderEncodeError(t *testing.T) {
+	resp := NewResponder()
+	w := httptest.NewRecorder()
+	resp.Write(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, func() {})
+	if w.Code != http.StatusInternalServerError || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "0" {
+		t.Errorf("unencodable payload = %d %q, want an empty 500", w.Code, w.Body)
+	}
+	var stats struct {
+		Responses int64            `json:"responses"`
+		ByStatus  map[string]int64 `json:"by_status"`
+	}
+	if err := json.Unmarshal([]byte(resp.Stats.String()), &stats); err != nil || stats.Responses != 1 || stats.ByStatus["500"] != 1 {
+		t.Errorf("stats = %s, want the 500", resp.Stats)
+	}
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// MaxRetryAfter caps the Retry-After of all busy, paused and rate limited responses
+const MaxRetryAfter = 10 * time.Minute
+
+// UnavailableRetry is the Retry-After of requests that failed on the database
+const UnavailableRetry = 5 * time.Second
+
+// RetrySignal is the time until a busy or limited service is expected to recover, with the
+// reason (see the opm.RetryReason constants). Signals without a wait don't apply.
+type RetrySignal struct {
+	Reason string
+	Wait   time.Duration
+}
+
+// RetryAfter picks the first signal that applies, or the fallback if none does, sets the
+// Retry-After header and returns the hint for the response. The wait is rounded up to whole
+// seconds between 1 and MaxRetryAfter.
+func RetryAfter(w http.ResponseWriter, fallback RetrySignal, signals ...RetrySignal) *opm.RetryHint {
+	s := fallback
+	for _, signal := range signals {
+		if signal.Wait > 0 {
+			s = signal
+			break
+		}
+	}
+	if s.Wait > MaxRetryAfter {
+		s.Wait = MaxRetryAfter
+	}
+	seconds := int(math.Ceil(s.Wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return &opm.RetryHint{Seconds: seconds, Reason: s.Reason}
+}
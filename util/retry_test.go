@@ -0,0 +1,37 @@
+package util
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func TestRetryAfter(t *testing.T) {
+	fallback := RetrySignal{Reason: opm.RetryReasonBusy, Wait: 5 * time.Second}
+	tests := []struct {
+		name    string
+		signals []RetrySignal
+		reason  string
+		seconds int
+	}{
+		{"no signals", nil, opm.RetryReasonBusy, 5},
+		{"none applies", []RetrySignal{{opm.RetryReasonQueue, 0}, {opm.RetryReasonCooldown, -time.Second}}, opm.RetryReasonBusy, 5},
+		{"first that applies", []RetrySignal{{opm.RetryReasonQueue, 0}, {opm.RetryReasonCooldown, 12 * time.Second}, {opm.RetryReasonPaused, time.Second}}, opm.RetryReasonCooldown, 12},
+		{"rounded up", []RetrySignal{{opm.RetryReasonRateLimit, 1500 * time.Millisecond}}, opm.RetryReasonRateLimit, 2},
+		{"at least a second", []RetrySignal{{opm.RetryReasonRateLimit, time.Millisecond}}, opm.RetryReasonRateLimit, 1},
+		{"capped", []RetrySignal{{opm.RetryReasonPaused, time.Hour}}, opm.RetryReasonPaused, int(MaxRetryAfter / time.Second)},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		hint := RetryAfter(w, fallback, test.signals...)
+		if hint.Reason != test.reason || hint.Seconds != test.seconds {
+			t.Errorf("%s: hint = %+v, want %d s for %s", test.name, hint, test.seconds, test.reason)
+		}
+		if got := w.Header().Get("Retry-After"); got != strconv.Itoa(test.seconds) {
+			t.Errorf("%s: Retry-After = %q, want %d", test.name, got, test.seconds)
+		}
+	}
+}
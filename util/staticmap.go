@@ -0,0 +1,48 @@
+package util
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// Static map templates for StaticMapURL. The size and marker style are part of the
+// template, so they can be adjusted without code changes.
+const (
+	StaticMapOSM = "https://staticmap.openstreetmap.de/staticmap.php?center={lat},{lng}&zoom={zoom}&size=400x300&markers={lat},{lng},red-pushpin"
+	// Append the API key
+	StaticMapGoogle = "https://maps.googleapis.com/maps/api/staticmap?center={lat},{lng}&zoom={zoom}&size=400x300&markers={lat},{lng}&key="
+	// Self-hosted tileserver-gl, replace the host and style
+	StaticMapTileserver = "http://localhost:8080/styles/osm-bright/static/{lng},{lat},{zoom}/400x300.png"
+)
+
+// StaticMapZoom returns the zoom of the image of a map object. Pokemon need the streets
+// around them, for gyms the neighborhood is enough.
+func StaticMapZoom(objectType int) int {
+	switch objectType {
+	case opm.POKEMON:
+		return 17
+	case opm.POKESTOP:
+		return 16
+	default:
+		return 15
+	}
+}
+
+// StaticMapURL returns the link to an image of the map centered on the object, built from
+// a template with the placeholders {lat}, {lng} and {zoom}, see StaticMapOSM. An empty
+// template returns "". The image isn't fetched, notifications only carry the link.
+func StaticMapURL(template string, lat, lng float64, objectType int) string {
+	if template == "" {
+		return ""
+	}
+	// Fixed precision, the shortest format would switch to exponents for coordinates
+	// close to 0
+	return strings.NewReplacer(
+		"{lat}", url.QueryEscape(strconv.FormatFloat(lat, 'f', 6, 64)),
+		"{lng}", url.QueryEscape(strconv.FormatFloat(lng, 'f', 6, 64)),
+		"{zoom}", strconv.Itoa(StaticMapZoom(objectType)),
+	).Replace(template)
+}
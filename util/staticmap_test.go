@@ -0,0 +1,59 @@
+package util
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func TestStaticMapURL(t *testing.T) {
+	for _, c := range []struct {
+		template   string
+		lat, lng   float64
+		objectType int
+		want       string
+	}{
+		{StaticMapOSM, 52.520008, 13.404954, opm.POKEMON,
+			"https://staticmap.openstreetmap.de/staticmap.php?center=52.520008,13.404954&zoom=17&size=400x300&markers=52.520008,13.404954,red-pushpin"},
+		{StaticMapGoogle + "k3y", -33.856784, 151.215297, opm.POKESTOP,
+			"https://maps.googleapis.com/maps/api/staticmap?center=-33.856784,151.215297&zoom=16&size=400x300&markers=-33.856784,151.215297&key=k3y"},
+		// lng comes first in the path of tileserver-gl
+		{StaticMapTileserver, 52.5, -0.1275, opm.GYM, "http://localhost:8080/styles/osm-bright/static/-0.127500,52.500000,15/400x300.png"},
+		// Close to 0 the coordinates stay decimal
+		{StaticMapOSM, 0.000001, -0.0000001, opm.POKEMON,
+			"https://staticmap.openstreetmap.de/staticmap.php?center=0.000001,-0.000000&zoom=17&size=400x300&markers=0.000001,-0.000000,red-pushpin"},
+		{"", 52.5, 13.4, opm.POKEMON, ""},
+	} {
+		if got := StaticMapURL(c.template, c.lat, c.lng, c.objectType); got != c.want {
+			t.Errorf("StaticMapURL(%q, %v, %v) =\n%s\nwant\n%s", c.template, c.lat, c.lng, got, c.want)
+		}
+	}
+}
+
+func TestStaticMapURLQuery(t *testing.T) {
+	// Each placeholder as a parameter of its own parses back to the values
+	link := StaticMapURL("https://maps.example.com/map?lat={lat}&lng={lng}&z={zoom}&marker={lat}%2C{lng}", -1e-7, 179.9999999, opm.POKESTOP)
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	lat, latErr := strconv.ParseFloat(q.Get("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(q.Get("lng"), 64)
+	if latErr != nil || lngErr != nil || lat != 0 || lng != 180 || q.Get("z") != "16" {
+		t.Errorf("query of %s = %v, want the coordinates rounded to 6 digits and zoom 16", link, q)
+	}
+	if m := q.Get("marker"); m != "-0.000000,180.000000" {
+		t.Errorf("marker = %q", m)
+	}
+}
+
+func TestStaticMapZoom(t *testing.T) {
+	for objectType, want := range map[int]int{opm.POKEMON: 17, opm.POKESTOP: 16, opm.GYM: 15} {
+		if got := StaticMapZoom(objectType); got != want {
+			t.Errorf("zoom of type %d = %d, want %d", objectType, got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// ErrUnknownTimezone is returned when the lookup service answers with an unknown zone
+var ErrUnknownTimezone = errors.New("Unknown timezone")
+
+// TimezoneClient resolves the IANA timezone of a location with a lookup service. URL contains
+// {lat} and {lng}, the service answers with the zone id as plain text or as JSON with a
+// timezone or timeZoneId field.
+type TimezoneClient struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewTimezoneClient creates a client for the lookup service at url
+func NewTimezoneClient(url string) *TimezoneClient {
+	return &TimezoneClient{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Lookup returns the timezone of the location
+func (c *TimezoneClient) Lookup(lat, lng float64) (string, error) {
+	u := strings.NewReplacer(
+		"{lat}", strconv.FormatFloat(lat, 'f', 6, 64),
+		"{lng}", strconv.FormatFloat(lng, 'f', 6, 64),
+	).Replace(c.URL)
+	resp, err := c.Client.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Timezone lookup: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	tz := strings.TrimSpace(string(body))
+	if strings.HasPrefix(tz, "{") {
+		var v struct {
+			Timezone   string `json:"timezone"`
+			TimeZoneID string `json:"timeZoneId"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return "", err
+		}
+		tz = v.Timezone
+		if tz == "" {
+			tz = v.TimeZoneID
+		}
+	}
+	if _, err := loadLocation(tz); err != nil || tz == "" {
+		return "", ErrUnknownTimezone
+	}
+	return tz, nil
+}
+
+// locations caches the loaded zones by id
+var locations = struct {
+	sync.Mutex
+	m map[string]*time.Location
+}{m: make(map[string]*time.Location)}
+
+func loadLocation(tz string) (*time.Location, error) {
+	locations.Lock()
+	defer locations.Unlock()
+	if l, ok := locations.m[tz]; ok {
+		return l, nil
+	}
+	l, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, err
+	}
+	locations.m[tz] = l
+	return l, nil
+}
+
+// WithLocalTime returns a copy of the objects with LocalTime set for the objects with a
+// known timezone. The time is formatted as RFC 3339 with the offset of the zone.
+func WithLocalTime(objects []opm.MapObject, now time.Time) []opm.MapObject {
+	result := make([]opm.MapObject, len(objects))
+	for i, o := range objects {
+		if o.Timezone != "" {
+			if l, err := loadLocation(o.Timezone); err == nil {
+				o.LocalTime = now.In(l).Format(time.RFC3339)
+			}
+		}
+		result[i] = o
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// timezoneService answers lookups for a few known coordinates, in the formats the client
+// supports
+func timezoneService(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("lat") + "," + r.FormValue("lng") {
+		case "52.520008,13.404954":
+			w.Write([]byte("Europe/Berlin\n"))
+		case "40.712776,-74.005974":
+			w.Write([]byte(`{"timezone": "America/New_York"}`))
+		case "-33.856784,151.215297":
+			w.Write([]byte(`{"status": "OK", "timeZoneId": "Australia/Sydney"}`))
+		case "35.689487,139.691711":
+			w.Write([]byte(`{"timezone": "Asia/Tokyo"}`))
+		case "0.000000,0.000000":
+			w.Write([]byte("Atlantic/Null_Island"))
+		case "90.000000,0.000000":
+			w.Write([]byte(`{"timezone": ""}`))
+		default:
+			http.Error(w, "no zone", http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestTimezoneLookup(t *testing.T) {
+	c := NewTimezoneClient(timezoneService(t).URL + "/tz?lat={lat}&lng={lng}")
+	for _, known := range []struct {
+		lat, lng float64
+		want     string
+	}{
+		{52.520008, 13.404954, "Europe/Berlin"},
+		{40.712776, -74.005974, "America/New_York"},
+		{-33.856784, 151.215297, "Australia/Sydney"},
+		{35.689487, 139.691711, "Asia/Tokyo"},
+	} {
+		if tz, err := c.Lookup(known.lat, known.lng); tz != known.want || err != nil {
+			t.Errorf("Lookup(%f, %f) = %q, %v, want %s", known.lat, known.lng, tz, err, known.want)
+		}
+	}
+	// Zones time.LoadLocation doesn't know and empty answers are rejected
+	for _, lat := range []float64{0, 90} {
+		if tz, err := c.Lookup(lat, 0); err != ErrUnknownTimezone {
+			t.Errorf("Lookup(%f, 0) = %q, %v, want ErrUnknownTimezone", lat, tz, err)
+		}
+	}
+	if tz, err := c.Lookup(1, 2); err == nil {
+		t.Errorf("Lookup of a location without a zone = %q, want the status as error", tz)
+	}
+}
+
+func TestWithLocalTime(t *testing.T) {
+	now := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	objects := []opm.MapObject{
+		{Type: opm.GYM, ID: "berlin", Timezone: "Europe/Berlin"},
+		{Type: opm.POKESTOP, ID: "new-york", Timezone: "America/New_York"},
+		{Type: opm.POKESTOP, ID: "sydney", Timezone: "Australia/Sydney"},
+		{Type: opm.GYM, ID: "unresolved"},
+		{Type: opm.GYM, ID: "invalid", Timezone: "Mars/Olympus_Mons"},
+	}
+	want := []string{"2017-07-14T04:40:00+02:00", "2017-07-13T22:40:00-04:00", "2017-07-14T12:40:00+10:00", "", ""}
+	for i, o := range WithLocalTime(objects, now) {
+		if o.LocalTime != want[i] {
+			t.Errorf("local time of %s = %q, want %q", o.ID, o.LocalTime, want[i])
+		}
+		if objects[i].LocalTime != "" {
+			t.Errorf("WithLocalTime changed the object %s", o.ID)
+		}
+	}
+	// In winter the offsets change the other way round
+	winter := WithLocalTime(objects[:3], time.Date(2017, 1, 14, 2, 40, 0, 0, time.UTC))
+	if winter[0].LocalTime != "2017-01-14T03:40:00+01:00" || winter[2].LocalTime != "2017-01-14T13:40:00+11:00" {
+		t.Errorf("local times in January = %q, %q", winter[0].LocalTime, winter[2].LocalTime)
+	}
+}
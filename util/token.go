@@ -0,0 +1,109 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/femot/pgoapi-go/api"
+	"github.com/femot/pgoapi-go/auth"
+	"github.com/pogointel/opm/opm"
+)
+
+// TokenRefresher exchanges a stored token for an access token. If the provider rotated
+// the stored token, the new one is returned as rotated. Expired tokens return opm.ErrTokenExpired.
+type TokenRefresher func(provider, token string) (access, rotated string, err error)
+
+// tokenProvider logs in with an access token instead of username and password
+type tokenProvider struct {
+	provider string
+	token    string
+}
+
+func (p *tokenProvider) Login() (string, error) {
+	return p.token, nil
+}
+
+func (p *tokenProvider) GetProviderString() string {
+	return p.provider
+}
+
+func (p *tokenProvider) GetAccessToken() string {
+	return p.token
+}
+
+// usesToken reports whether the account logs in with its auth token
+func usesToken(a opm.Account) bool {
+	return a.Password == "" && a.AuthToken != ""
+}
+
+// newProvider returns the auth provider for the trainers account. Accounts without
+// password use their stored token, which is refreshed and persisted when it was rotated.
+func (t *TrainerSession) newProvider() (auth.Provider, error) {
+	if !usesToken(t.Account) {
+		return auth.NewProvider(t.Account.Provider, t.Account.Username, t.Account.Password)
+	}
+	if t.RefreshToken == nil {
+		return &tokenProvider{provider: t.Account.Provider, token: t.Account.AuthToken}, nil
+	}
+	access, rotated, err := t.RefreshToken(t.Account.Provider, t.Account.AuthToken)
+	if err != nil {
+		return nil, err
+	}
+	if rotated != "" && rotated != t.Account.AuthToken {
+		t.Account.AuthToken = rotated
+		if t.OnTokenRotated != nil {
+			t.OnTokenRotated(t.Account)
+		}
+	}
+	return &tokenProvider{provider: t.Account.Provider, token: access}, nil
+}
+
+// classifyLoginError tells expired tokens apart from other login errors
+func (t *TrainerSession) classifyLoginError(err error) error {
+	if err == api.ErrInvalidAuthToken && usesToken(t.Account) {
+		return opm.ErrTokenExpired
+	}
+	return err
+}
+
+const googleTokenURL = "https://oauth2.googleapis.com/token"
+
+// GoogleTokenRefresher returns a TokenRefresher that exchanges Google refresh tokens with
+// the given OAuth client. Tokens of other providers are used as they are.
+func GoogleTokenRefresher(clientID, clientSecret string) TokenRefresher {
+	client := http.Client{Timeout: 10 * time.Second}
+	return func(provider, token string) (string, string, error) {
+		if provider != "google" {
+			return token, "", nil
+		}
+		resp, err := client.PostForm(googleTokenURL, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {token},
+			"client_id":     {clientID},
+			"client_secret": {clientSecret},
+		})
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		var r struct {
+			IDToken      string `json:"id_token"`
+			RefreshToken string `json:"refresh_token"`
+			Error        string `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		if err != nil {
+			return "", "", err
+		}
+		if r.Error == "invalid_grant" {
+			return "", "", opm.ErrTokenExpired
+		}
+		if r.Error != "" || r.IDToken == "" {
+			return "", "", errors.New("Token refresh failed: " + r.Error)
+		}
+		return r.IDToken, r.RefreshToken, nil
+	}
+}
@@ -3,10 +3,13 @@ package util
 import (
 	"golang.org/x/net/context"
 	"log"
+	"net/http"
+	"time"
 
 	"github.com/femot/pgoapi-go/api"
 	"github.com/femot/pgoapi-go/auth"
 	"github.com/pogodevorg/POGOProtos-go"
+	"github.com/pogointel/opm/internal/geo"
 	"github.com/pogointel/opm/opm"
 )
 
@@ -18,8 +21,37 @@ type TrainerSession struct {
 	Feed       api.Feed
 	Location   *api.Location
 	Proxy      opm.Proxy
-	session    *api.Session
+	Transport  http.RoundTripper // upstream requests go through it, nil = through the proxy hub
+	session    Upstream
 	ForceLogin bool
+	// Budget
+	MaxScansPerHour int           // 0 = unlimited
+	SessionLifetime time.Duration // Sessions are renewed after this time, 0 = never
+	loginTime       time.Time
+	scanTimes       []time.Time
+	movedAt         time.Time // last MoveTo, zero if the trainer has not been anywhere yet
+	// Area covered by the map cells of the last map request, empty if it failed
+	Footprint opm.BoundingBox
+	// Token accounts
+	RefreshToken   TokenRefresher      // nil = use the stored token as access token
+	OnTokenRotated func(a opm.Account) // called when the provider rotated the stored token
+}
+
+// Upstream is the part of a pgoapi session a trainer uses
+type Upstream interface {
+	IsExpired() bool
+	Init(ctx context.Context, proxyID int64) error
+	Announce(ctx context.Context, proxyID int64) (*protos.GetMapObjectsResponse, error)
+	Call(ctx context.Context, requests []*protos.Request, proxyID int64) (*protos.ResponseEnvelope, error)
+	GetInventory(ctx context.Context, proxyID int64) (*protos.GetInventoryResponse, error)
+	GetPlayer(ctx context.Context, proxyID int64) (*protos.GetPlayerResponse, error)
+	GetPlayerMap(ctx context.Context, proxyID int64) (*protos.GetMapObjectsResponse, error)
+	MoveTo(location *api.Location)
+}
+
+// NewUpstream creates the session of a login, replaced by the integration tests with a fake upstream
+var NewUpstream = func(t *TrainerSession, provider auth.Provider) Upstream {
+	return api.NewSession(provider, t.Location, t.Feed, t.crypto, false)
 }
 
 func NewTrainerSession(account opm.Account, location *api.Location, feed api.Feed, crypto api.Crypto) *TrainerSession {
@@ -49,26 +81,112 @@ func (t *TrainerSession) IsLoggedIn() bool {
 
 // Login initializes a (new) session. This can be used to login again, after the session is expired.
 func (t *TrainerSession) Login() error {
-	if !t.session.IsExpired() && !t.ForceLogin {
+	rotate := t.SessionLifetime > 0 && !t.loginTime.IsZero() && time.Since(t.loginTime) >= t.SessionLifetime
+	if !t.session.IsExpired() && !t.ForceLogin && !rotate {
 		return nil
 	}
 	t.ForceLogin = false
-	provider, err := auth.NewProvider(t.Account.Provider, t.Account.Username, t.Account.Password)
+	provider, err := t.newProvider()
 	if err != nil {
 		return err
 	}
-	session := api.NewSession(provider, t.Location, t.Feed, t.crypto, false)
-	err = session.Init(t.Context, t.Proxy.ID)
+	session := NewUpstream(t, provider)
+	err = session.Init(t.upstreamContext(), t.Proxy.ID)
 	if err != nil {
-		return err
+		return t.classifyLoginError(err)
 	}
 	t.session = session
+	t.loginTime = time.Now()
 	return nil
 }
 
+// RecordScan counts a scan against the hourly budget
+func (t *TrainerSession) RecordScan() {
+	t.scanTimes = append(t.scanTimes, time.Now())
+	t.pruneScans()
+}
+
+func (t *TrainerSession) pruneScans() {
+	i := 0
+	for i < len(t.scanTimes) && time.Since(t.scanTimes[i]) > time.Hour {
+		i++
+	}
+	t.scanTimes = t.scanTimes[i:]
+}
+
+// RemainingScans returns the number of scans left in the hourly budget, or -1 if there is no budget
+func (t *TrainerSession) RemainingScans() int {
+	if t.MaxScansPerHour <= 0 {
+		return -1
+	}
+	t.pruneScans()
+	if len(t.scanTimes) >= t.MaxScansPerHour {
+		return 0
+	}
+	return t.MaxScansPerHour - len(t.scanTimes)
+}
+
+// BudgetResetIn returns the time until the hourly budget has room for another scan, or 0 if
+// it has room now
+func (t *TrainerSession) BudgetResetIn() time.Duration {
+	if t.RemainingScans() != 0 {
+		return 0
+	}
+	// The scans before this one drop out of the window first
+	return time.Until(t.scanTimes[len(t.scanTimes)-t.MaxScansPerHour].Add(time.Hour))
+}
+
+// TimeToRotation returns the time until the session is renewed, or -1 if sessions are not rotated
+func (t *TrainerSession) TimeToRotation() time.Duration {
+	if t.SessionLifetime <= 0 {
+		return -1
+	}
+	if t.loginTime.IsZero() {
+		return t.SessionLifetime
+	}
+	d := t.SessionLifetime - time.Since(t.loginTime)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Capacity returns how many scans, perScan apart, the trainer can do before it runs out of
+// budget or its session is rotated. It returns -1 if there is no limit.
+func (t *TrainerSession) Capacity(perScan time.Duration) int {
+	c := t.RemainingScans()
+	if ttr := t.TimeToRotation(); ttr >= 0 && perScan > 0 {
+		n := int(ttr / perScan)
+		if c < 0 || n < c {
+			c = n
+		}
+	}
+	return c
+}
+
+// SetProxy routes the upstream requests of the trainer through the proxy. Proxies with URL
+// are dialed directly, the others through the proxy hub by id.
 func (t *TrainerSession) SetProxy(p opm.Proxy) {
-	log.Printf("Using proxy %d for %s", p.ID, t.Account.Username)
+	log.Printf("Using proxy %d for %s", p.ID, Username(t.Account.Username))
+	if old, ok := t.Transport.(*http.Transport); ok {
+		old.CloseIdleConnections()
+	}
 	t.Proxy = p
+	t.Transport = nil
+	transport, err := ProxyTransport(p)
+	if err != nil {
+		log.Printf("%v, using the proxy hub", err)
+		return
+	}
+	if transport != nil {
+		useContextTransports()
+		t.Transport = transport
+	}
+}
+
+// upstreamContext is the context of pgoapi calls, with the transport of the proxy
+func (t *TrainerSession) upstreamContext() context.Context {
+	return withTransport(t.Context, t.Transport)
 }
 
 func (t *TrainerSession) SetAccount(a opm.Account) {
@@ -77,21 +195,48 @@ func (t *TrainerSession) SetAccount(a opm.Account) {
 
 // Wrap session functions for trainer sessions
 func (t *TrainerSession) Announce() (*protos.GetMapObjectsResponse, error) {
-	return t.session.Announce(t.Context, t.Proxy.ID)
+	return t.session.Announce(t.upstreamContext(), t.Proxy.ID)
 }
 func (t *TrainerSession) Call(requests []*protos.Request) (*protos.ResponseEnvelope, error) {
-	return t.session.Call(t.Context, requests, t.Proxy.ID)
+	return t.session.Call(t.upstreamContext(), requests, t.Proxy.ID)
 }
 func (t *TrainerSession) GetInventory() (*protos.GetInventoryResponse, error) {
-	return t.session.GetInventory(t.Context, t.Proxy.ID)
+	return t.session.GetInventory(t.upstreamContext(), t.Proxy.ID)
 }
 func (t *TrainerSession) GetPlayer() (*protos.GetPlayerResponse, error) {
-	return t.session.GetPlayer(t.Context, t.Proxy.ID)
+	return t.session.GetPlayer(t.upstreamContext(), t.Proxy.ID)
 }
 func (t *TrainerSession) GetPlayerMap() (*protos.GetMapObjectsResponse, error) {
-	return t.session.GetPlayerMap(t.Context, t.Proxy.ID)
+	return t.session.GetPlayerMap(t.upstreamContext(), t.Proxy.ID)
 }
 func (t *TrainerSession) MoveTo(location *api.Location) {
 	t.Location = location
+	t.movedAt = time.Now()
 	t.session.MoveTo(location)
 }
+
+// LastLocation returns where the trainer moved to last, false if it has not been anywhere yet
+func (t *TrainerSession) LastLocation() (geo.LatLng, bool) {
+	if t.movedAt.IsZero() {
+		return geo.LatLng{}, false
+	}
+	return geo.LatLng{Lat: t.Location.Lat, Lng: t.Location.Lon}, true
+}
+
+// SpeedTo returns the speed in km/h the trainer would travel at if it moved to the point at the
+// given time. It is 0 for trainers that have not been anywhere yet.
+func (t *TrainerSession) SpeedTo(lat, lng float64, at time.Time) float64 {
+	if t.movedAt.IsZero() {
+		return 0
+	}
+	return ImpliedSpeed(geo.LatLng{Lat: t.Location.Lat, Lng: t.Location.Lon}, geo.LatLng{Lat: lat, Lng: lng}, at.Sub(t.movedAt))
+}
+
+// CooldownTo returns how long the trainer has to wait before it can move to the point without
+// exceeding maxSpeed km/h
+func (t *TrainerSession) CooldownTo(lat, lng, maxSpeed float64, at time.Time) time.Duration {
+	if t.movedAt.IsZero() {
+		return 0
+	}
+	return TravelCooldown(geo.LatLng{Lat: t.Location.Lat, Lng: t.Location.Lon}, geo.LatLng{Lat: lat, Lng: lng}, at.Sub(t.movedAt), maxSpeed)
+}